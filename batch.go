@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+	scanUtils "github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// In batch mode, the standalone scanner scans the images of a list, up to the parallel number at a time.
+// Every scan runs in its own scanner task with its own working folder; the cve database is loaded once.
+// The result of each image is written to its own file under the output folder, named by its position
+// in the list, with an index sorted by the image name, so the output doesn't depend on the scan order.
+
+const batchIndexFile = "index.json"
+
+type batchScan struct {
+	image     string
+	req       *share.ScanImageRequest
+	result    *cvetools.ScanReport
+	err       error
+	elapsed   time.Duration
+	done      func(s *batchScan) // called by the worker once the scan ends, nil for none
+	notBefore time.Time          // the scan is not started earlier, zero for no wait
+}
+
+type batchIndexEntry struct {
+	Image    string `json:"image"`
+	File     string `json:"file"`
+	ErrMsg   string `json:"error_message,omitempty"`
+	Vuls     int    `json:"vulnerabilities"`
+	Critical int    `json:"critical"`
+	High     int    `json:"high"`
+	Medium   int    `json:"medium"`
+	ScanTime string `json:"scan_time"`
+}
+
+// readImageList reads the images, one per line; empty lines and lines starting with # are skipped
+func readImageList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var images []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("No image in the list: %s", path)
+	}
+	return images, nil
+}
+
+// batchResultFile names the result file of the image by its position in the list
+func batchResultFile(i int, image string) string {
+	name := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image)
+	return fmt.Sprintf("%04d_%s.json", i+1, name)
+}
+
+// scanImageList scans the images, the results are in the order of the list. Scans not started yet are
+// skipped when the context is canceled, and the running ones are stopped.
+func scanImageList(ctx context.Context, scans []*batchScan, parallel int, opts *onDemandOptions) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	queue := make(chan *batchScan)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range queue {
+				scanCtx := ctx
+				var records *jsonlScan
+				if opts.format == formatJSONL {
+					records = newJSONLScan(stdoutJSONL, s.req, opts)
+					scanCtx = records.withFindings(ctx)
+				}
+				start := time.Now()
+				s.result, s.err = runOnDemandScan(scanCtx, s.req, opts)
+				s.elapsed = time.Since(start)
+				log.WithFields(log.Fields{"image": s.image, "elapsed": s.elapsed}).Info("Scan done")
+				if records != nil {
+					records.end(s.result, s.err, s.elapsed)
+				}
+				if s.done != nil {
+					s.done(s)
+				}
+			}
+		}()
+	}
+
+	for _, s := range scans {
+		if d := time.Until(s.notBefore); d > 0 && ctx.Err() == nil {
+			timer := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			s.err = ctx.Err()
+			continue
+		}
+		queue <- s
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// newBatchIndexEntry returns the index entry of the scan, with the error of a failed scan. The findings are
+// counted by the severity of -severity_source, as the summary line.
+func newBatchIndexEntry(s *batchScan, file string, opts *onDemandOptions) *batchIndexEntry {
+	entry := &batchIndexEntry{Image: s.image, File: file, ScanTime: s.elapsed.Round(time.Millisecond).String()}
+	if s.result == nil {
+		if s.err != nil {
+			entry.ErrMsg = s.err.Error()
+		}
+	} else if s.result.Error != share.ScanErrorCode_ScanErrNone {
+		entry.ErrMsg = scanUtils.ScanErrorToStr(s.result.Error)
+		if s.result.ErrorMessage != "" {
+			entry.ErrMsg = fmt.Sprintf("%s: %s", entry.ErrMsg, s.result.ErrorMessage)
+		}
+	} else {
+		c := countFindings(s.result, opts)
+		entry.Vuls, entry.Critical, entry.High, entry.Medium = c.Findings, c.Critical, c.High, c.Medium
+	}
+	return entry
+}
+
+// writeBatchResults writes the result files and the index, prints the results in the order of the list,
+// and returns the number of failed scans, and the first error of writing the files
+func writeBatchResults(scans []*batchScan, wall time.Duration, opts *onDemandOptions) (int, error) {
+	var failed int
+	var writeErr error
+	var total time.Duration
+	index := make([]*batchIndexEntry, len(scans))
+	for i, s := range scans {
+		file := batchResultFile(i, s.image)
+		entry := newBatchIndexEntry(s, file, opts)
+		if entry.ErrMsg != "" || s.result == nil {
+			failed++
+		}
+		index[i] = entry
+		total += s.elapsed
+
+		if s.result != nil || s.err != nil {
+			if err := writeResultToFile(s.req, s.result, s.err, opts, filepath.Join(scanOutputDir, file)); err != nil && writeErr == nil {
+				writeErr = err
+			}
+		}
+		writeResultToStdout(s.req, s.result, opts)
+		if s.result != nil || s.err != nil {
+			writeScanSummary(os.Stderr, s.req, s.result, s.err, s.elapsed, opts)
+		}
+	}
+
+	sort.SliceStable(index, func(i, j int) bool { return index[i].Image < index[j].Image })
+	data, _ := json.MarshalIndent(index, "", "    ")
+	output := filepath.Join(scanOutputDir, batchIndexFile)
+	if err := ioutil.WriteFile(output, data, 0644); err != nil {
+		log.WithFields(log.Fields{"error": err, "output": output}).Error("Failed to write scan index")
+		if writeErr == nil {
+			writeErr = err
+		}
+	}
+
+	// the stdout of -format jsonl has only the records
+	var w io.Writer = os.Stdout
+	if opts.format == formatJSONL {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "\nScanned %d images, %d failed, wall-clock time: %s, cumulative scan time: %s\n",
+		len(scans), failed, wall.Round(time.Second), total.Round(time.Second))
+	return failed, writeErr
+}
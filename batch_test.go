@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// testImage is an image of a single layer served by newTestRegistry
+type testImage struct {
+	manifest []byte
+	blobs    map[string][]byte // by the digest, the config and the layer
+	v2Reads  int32             // the reads of the schema 2 manifest
+}
+
+func blobDigest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// newTestImage builds an image of the files, the path and the content of each
+func newTestImage(t *testing.T, files map[string]string) *testImage {
+	return newTestPlatformImage(t, "amd64", files)
+}
+
+// newTestPlatformImage builds the image of the files for the linux architecture
+func newTestPlatformImage(t *testing.T, arch string, files map[string]string) *testImage {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(layer.Bytes())
+	zw.Close()
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"architecture": arch, "os": "linux", "config": map[string]interface{}{},
+		"rootfs":  map[string]interface{}{"type": "layers", "diff_ids": []string{blobDigest(layer.Bytes())}},
+		"history": []map[string]interface{}{{"created_by": "COPY . /"}},
+	})
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": map[string]interface{}{"mediaType": "application/vnd.docker.container.image.v1+json", "size": len(config), "digest": blobDigest(config)},
+		"layers": []map[string]interface{}{{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": gz.Len(), "digest": blobDigest(gz.Bytes())}},
+	})
+	return &testImage{manifest: manifest, blobs: map[string][]byte{blobDigest(config): config, blobDigest(gz.Bytes()): gz.Bytes()}}
+}
+
+// newTestRegistry serves the images by their repository:tag
+func newTestRegistry(t *testing.T, images map[string]*testImage) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v2/")
+		if path == "" {
+			w.Write([]byte("{}"))
+			return
+		}
+		if i := strings.LastIndex(path, "/manifests/"); i > 0 {
+			repo, ref := path[:i], path[i+len("/manifests/"):]
+			for name, img := range images {
+				if name == repo+":"+ref || ref == blobDigest(img.manifest) && strings.HasPrefix(name, repo+":") {
+					if strings.Contains(strings.Join(r.Header["Accept"], ","), "manifest.v2+json") {
+						atomic.AddInt32(&img.v2Reads, 1)
+					}
+					w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+					w.Header().Set("Docker-Content-Digest", blobDigest(img.manifest))
+					w.Write(img.manifest)
+					return
+				}
+			}
+		} else if i := strings.LastIndex(path, "/blobs/"); i > 0 {
+			for _, img := range images {
+				if data, ok := img.blobs[path[i+len("/blobs/"):]]; ok {
+					w.Write(data)
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// the tables of a debian vulnerability of openssl and a vulnerability of lodash
+func writeTestTables(t *testing.T, dir string) {
+	short, _ := json.Marshal(common.VulShort{Name: "CVE-2022-0001", Namespace: "debian:11", Fixin: []common.FeaShort{{Name: "openssl", Version: "1.2"}}})
+	full, _ := json.Marshal(common.VulFull{Name: "CVE-2022-0001", Namespace: "debian:11", Severity: "High"})
+	app, _ := json.Marshal(common.AppModuleVul{
+		VulName: "CVE-2022-0002", AppName: "npm", ModuleName: "lodash", Severity: "High",
+		AffectedVer: []common.AppModuleVersion{{OpCode: "lt", Version: "4.17.21"}},
+	})
+	for name, data := range map[string][]byte{"debian_index.tb": short, "debian_full.tb": full, "apps.tb": app} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var testDebianFiles = map[string]string{
+	"etc/os-release":                       "ID=debian\nVERSION_ID=\"11\"\n",
+	"var/lib/dpkg/status":                  "Package: openssl\nStatus: install ok installed\nVersion: 1.1\n\n",
+	"app/node_modules/lodash/package.json": "{\n  \"name\": \"lodash\",\n  \"version\": \"4.17.15\"\n}\n",
+}
+
+func TestBatchSharedDB(t *testing.T) {
+	defer func(tools *cvetools.CveTools, tasker *Tasker) { cveTools, scanTasker = tools, tasker }(cveTools, scanTasker)
+	scanTasker = nil
+	dir := t.TempDir()
+	writeTestTables(t, dir)
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.TbPath = dir + "/"
+	cveTools.SwapDB("1.000", "2022-01-02T00:00:00Z")
+
+	img := newTestImage(t, testDebianFiles)
+	srv := newTestRegistry(t, map[string]*testImage{"team/app:v1": img, "team/app:v2": img})
+
+	// the database files read by each scan of the batch
+	var reads []int64
+	last := common.DbFileReads()
+	var scans []*batchScan
+	for _, tag := range []string{"v1", "v2"} {
+		scans = append(scans, &batchScan{
+			image: "team/app:" + tag,
+			req:   &share.ScanImageRequest{Registry: srv.URL, Repository: "team/app", Tag: tag, ScanLayers: true},
+			done: func(s *batchScan) {
+				reads = append(reads, common.DbFileReads()-last)
+				last = common.DbFileReads()
+			},
+		})
+	}
+	scanImageList(context.Background(), scans, 1, &onDemandOptions{})
+
+	for _, s := range scans {
+		if s.err != nil || s.result == nil || s.result.Error != share.ScanErrorCode_ScanErrNone || len(s.result.Vuls) != 2 {
+			t.Fatalf("Incorrect scan of %s: %+v %v", s.image, s.result, s.err)
+		}
+	}
+	t.Logf("Database files read: %v", reads)
+	if len(reads) != 2 || reads[0] == 0 || reads[1] != 0 {
+		t.Errorf("Incorrect database files read by the scans of the batch: %v", reads)
+	}
+}
+
+func TestScanManifestReads(t *testing.T) {
+	defer func(tools *cvetools.CveTools, tasker *Tasker) { cveTools, scanTasker = tools, tasker }(cveTools, scanTasker)
+	scanTasker = nil
+	dir := t.TempDir()
+	writeTestTables(t, dir)
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.TbPath = dir + "/"
+	cveTools.SwapDB("1.000", "2022-01-02T00:00:00Z")
+
+	img := newTestImage(t, testDebianFiles)
+	srv := newTestRegistry(t, map[string]*testImage{"team/app:v1": img})
+
+	// the manifest read for the image info is reused to detect the OCI artifacts
+	s := &batchScan{image: "team/app:v1", req: &share.ScanImageRequest{Registry: srv.URL, Repository: "team/app", Tag: "v1"}}
+	scanImageList(context.Background(), []*batchScan{s}, 1, &onDemandOptions{})
+	if s.err != nil || s.result == nil || s.result.Error != share.ScanErrorCode_ScanErrNone {
+		t.Fatalf("Incorrect scan: %+v %v", s.result, s.err)
+	}
+	if reads := atomic.LoadInt32(&img.v2Reads); reads != 1 {
+		t.Errorf("Incorrect reads of the manifest: %d", reads)
+	}
+}
+
+func TestScanOrder(t *testing.T) {
+	defer func(tools *cvetools.CveTools, tasker *Tasker) { cveTools, scanTasker = tools, tasker }(cveTools, scanTasker)
+	scanTasker = nil
+	dir := t.TempDir()
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.TbPath = dir + "/"
+
+	// the vulnerabilities of the packages, a CVE of two packages and the severities tied
+	status := ""
+	var short, full []byte
+	for i, sev := range []string{"High", "Medium", "High", "High", "Low", "Medium", "High", "Medium"} {
+		pkgs := []common.FeaShort{{Name: fmt.Sprintf("pkg%d", i), Version: "1.2"}}
+		if i == 0 {
+			pkgs = append(pkgs, common.FeaShort{Name: "pkg7", Version: "1.2"})
+		}
+		s, _ := json.Marshal(common.VulShort{Name: fmt.Sprintf("CVE-2022-%04d", 10-i), Namespace: "debian:11", Fixin: pkgs})
+		f, _ := json.Marshal(common.VulFull{Name: fmt.Sprintf("CVE-2022-%04d", 10-i), Namespace: "debian:11", Severity: sev})
+		short, full = append(append(short, s...), '\n'), append(append(full, f...), '\n')
+		status += fmt.Sprintf("Package: pkg%d\nStatus: install ok installed\nVersion: 1.1\n\n", i)
+	}
+	for name, data := range map[string][]byte{"debian_index.tb": short, "debian_full.tb": full, "apps.tb": nil} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cveTools.SwapDB("1.000", "2022-01-02T00:00:00Z")
+
+	img := newTestImage(t, map[string]string{"etc/os-release": "ID=debian\nVERSION_ID=\"11\"\n", "var/lib/dpkg/status": status})
+	srv := newTestRegistry(t, map[string]*testImage{"team/app:v1": img})
+
+	// two scans of the same image with the same database give the same result
+	var results []string
+	for i := 0; i < 2; i++ {
+		s := &batchScan{image: "team/app:v1", req: &share.ScanImageRequest{Registry: srv.URL, Repository: "team/app", Tag: "v1", ScanLayers: true}}
+		scanImageList(context.Background(), []*batchScan{s}, 1, &onDemandOptions{})
+		if s.err != nil || s.result == nil || s.result.Error != share.ScanErrorCode_ScanErrNone || len(s.result.Vuls) != 9 {
+			t.Fatalf("Incorrect scan: %+v %v", s.result, s.err)
+		}
+		var order []string
+		for _, v := range s.result.Vuls {
+			order = append(order, v.Name+" "+v.PackageName)
+		}
+		for _, m := range s.result.Modules {
+			order = append(order, m.Name)
+		}
+		results = append(results, strings.Join(order, ","))
+	}
+	if results[0] != results[1] {
+		t.Errorf("Different orders of the scans:\n%s\n%s", results[0], results[1])
+	}
+	if !strings.HasPrefix(results[0], "CVE-2022-0004 pkg6,CVE-2022-0007 pkg3,CVE-2022-0008 pkg2,CVE-2022-0010 pkg0,CVE-2022-0010 pkg7,CVE-2022-0003 pkg7,") {
+		t.Errorf("Incorrect order: %s", results[0])
+	}
+}
+
+func TestScanOtherOSFailure(t *testing.T) {
+	defer func(tools *cvetools.CveTools, tasker *Tasker) { cveTools, scanTasker = tools, tasker }(cveTools, scanTasker)
+	scanTasker = nil
+	dir := t.TempDir()
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.TbPath = dir + "/"
+
+	// the debian packages of an alpine image, the debian tables are missing
+	short, _ := json.Marshal(common.VulShort{Name: "CVE-2022-0003", Namespace: "alpine:3.15", Fixin: []common.FeaShort{{Name: "musl", Version: "1.2.3-r0"}}})
+	full, _ := json.Marshal(common.VulFull{Name: "CVE-2022-0003", Namespace: "alpine:3.15", Severity: "Medium"})
+	for name, data := range map[string][]byte{"alpine_index.tb": short, "alpine_full.tb": full, "apps.tb": nil} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cveTools.SwapDB("1.000", "2022-01-02T00:00:00Z")
+	img := newTestImage(t, map[string]string{
+		"etc/os-release":       "ID=alpine\nVERSION_ID=3.15.0\n",
+		"lib/apk/db/installed": "P:musl\nV:1.2.2-r7\n\n",
+		"etc/apt/sources.list": "deb http://deb.debian.org/debian bullseye main\n",
+		"var/lib/dpkg/status":  testDebianFiles["var/lib/dpkg/status"],
+	})
+	srv := newTestRegistry(t, map[string]*testImage{"team/app:v1": img})
+
+	// the vulnerabilities of the image OS are kept, the failure of the other OS is noted
+	s := &batchScan{image: "team/app:v1", req: &share.ScanImageRequest{Registry: srv.URL, Repository: "team/app", Tag: "v1"}}
+	scanImageList(context.Background(), []*batchScan{s}, 1, &onDemandOptions{})
+	if s.err != nil || s.result == nil || s.result.Error != share.ScanErrorCode_ScanErrNone || len(s.result.Vuls) != 1 || s.result.Vuls[0].Name != "CVE-2022-0003" {
+		t.Fatalf("Incorrect scan: %+v %v", s.result, s.err)
+	}
+	if s.result.Coverage == nil || !strings.Contains(strings.Join(s.result.Coverage.Notes, "\n"), "the scan of debian:11 failed") {
+		t.Errorf("Incorrect coverage: %+v", s.result.Coverage)
+	}
+}
+
+func TestReadImageList(t *testing.T) {
+	f, _ := ioutil.TempFile("", "images")
+	defer os.Remove(f.Name())
+	f.WriteString("# images\nnginx:1.21\n\n  docker.io/library/alpine:3.15  \n")
+	f.Close()
+
+	images, err := readImageList(f.Name())
+	if err != nil || len(images) != 2 || images[0] != "nginx:1.21" || images[1] != "docker.io/library/alpine:3.15" {
+		t.Errorf("Unexpected images: %v %v", images, err)
+	}
+	if file := batchResultFile(1, images[1]); file != "0002_docker.io_library_alpine_3.15.json" {
+		t.Errorf("Unexpected result file: %s", file)
+	}
+}
@@ -30,6 +30,7 @@ type KeyVersion struct {
 	UpdateTime string
 	Keys       map[string]string
 	Shas       map[string]string
+	Sources    []string `json:",omitempty"` // of a merged database, the version of each source
 }
 
 type FeaShort struct {
@@ -65,6 +66,7 @@ type VulFull struct {
 	FixedIn     []FeaFull `json:"FI"`
 	CPEs        []string  `json:"CPE,omitempty"`
 	CVEs        []string  `json:"CVE,omitempty"`
+	Aliases     []string  `json:"ALIAS,omitempty"` // the other IDs of the vulnerability, like GHSA, OSV or vendor advisories
 	FeedRating  string    `json:"RATE,omitempty"`
 	IssuedDate  time.Time `json:"Issue"`
 	LastModDate time.Time `json:"LastMod"`
@@ -92,6 +94,7 @@ type AppModuleVul struct {
 	IssuedDate    time.Time          `json:"Issue"`
 	LastModDate   time.Time          `json:"LastMod"`
 	CVEs          []string           `json:"-"`
+	Aliases       []string           `json:"ALIAS,omitempty"` // the other IDs of the vulnerability, like GHSA or RUSTSEC
 }
 
 // ---
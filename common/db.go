@@ -8,11 +8,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -62,6 +66,53 @@ var DBS dbSpace = dbSpace{
 	},
 }
 
+// memDb holds the decrypted database files, keyed by the file name, when the database is loaded
+// in memory. The table loaders read from it instead of the expanded files under the table path.
+var memDb map[string][]byte
+var memDbVersion float64
+var memDbSources string // the versions of the sources of a merged database
+var memDbMutex sync.RWMutex
+
+// dbFileReads counts the database files opened by the table loaders
+var dbFileReads int64
+
+// DbFileReads returns the number of database files the tables were loaded from
+func DbFileReads() int64 {
+	return atomic.LoadInt64(&dbFileReads)
+}
+
+// openDbFile opens one database file, from memory if the database is loaded in memory
+func openDbFile(path, name string) (io.ReadCloser, error) {
+	atomic.AddInt64(&dbFileReads, 1)
+	memDbMutex.RLock()
+	db := memDb
+	memDbMutex.RUnlock()
+
+	if db != nil {
+		if data, ok := db[name]; ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return os.Open(filepath.Join(path, name))
+}
+
+func readDbFile(path, name string) ([]byte, error) {
+	f, err := openDbFile(path, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+func IsCveDbInMemory() bool {
+	memDbMutex.RLock()
+	defer memDbMutex.RUnlock()
+	return memDb != nil
+}
+
 func GetCVEDBEncryptKey() []byte {
 	return cveDBEncryptKey
 }
@@ -113,6 +164,19 @@ func ns2String(ns string) (string, string) {
 	return "", ""
 }
 
+var severityRank = map[string]int{
+	share.VulnSeverityCritical: 4,
+	share.VulnSeverityHigh:     3,
+	share.VulnSeverityMedium:   2,
+	share.VulnSeverityLow:      1,
+}
+
+// SeverityRank ranks the severity for the sorting, the higher the more severe, 0 for an unknown one. The
+// outputs of the database and of the scans are sorted by it.
+func SeverityRank(severity string) int {
+	return severityRank[severity]
+}
+
 func ReadCveDbMeta(path string, output bool) (map[string]*share.ScanVulnerability, []*OutputCVEVul, error) {
 	var osCVEs map[string]*OutputCVEVul
 	var appCVEs map[string]*OutputCVEVul
@@ -126,7 +190,15 @@ func ReadCveDbMeta(path string, output bool) (map[string]*share.ScanVulnerabilit
 
 	fullDb := make(map[string]*share.ScanVulnerability, 0)
 	for i := 0; i < DBMax; i++ {
-		if osCVEs, err = readCveDbMeta(path, DBS.Buffers[i].Name, fullDb, output); err != nil {
+		osname := DBS.Buffers[i].Name
+		f, err := openDbFile(path, fmt.Sprintf("%s_full.tb", osname))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "os": osname}).Error("Can't open file")
+			return nil, nil, err
+		}
+		osCVEs, err = readCveDbMeta(f, osname, fullDb, output)
+		f.Close()
+		if err != nil {
 			return nil, nil, err
 		}
 		if output {
@@ -140,7 +212,14 @@ func ReadCveDbMeta(path string, output bool) (map[string]*share.ScanVulnerabilit
 		}
 	}
 
-	if appCVEs, err = readAppDbMeta(path, fullDb, output); err != nil {
+	f, err := openDbFile(path, "apps.tb")
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("open file error")
+		return nil, nil, err
+	}
+	appCVEs, err = readAppDbMeta(f, fullDb, output)
+	f.Close()
+	if err != nil {
 		return nil, nil, err
 	}
 
@@ -161,26 +240,31 @@ func ReadCveDbMeta(path string, output bool) (map[string]*share.ScanVulnerabilit
 			i++
 		}
 
+		// severity from high to low, then cve name; the entries by os or app
 		sort.Slice(out, func(s, t int) bool {
+			if rs, rt := SeverityRank(out[s].Severity), SeverityRank(out[t].Severity); rs != rt {
+				return rs > rt
+			}
 			return out[s].Name < out[t].Name
 		})
+		for _, v := range out {
+			entries := v.Entries
+			sort.SliceStable(entries, func(s, t int) bool {
+				if entries[s].OSApp != entries[t].OSApp {
+					return entries[s].OSApp < entries[t].OSApp
+				}
+				return entries[s].OSAppVer < entries[t].OSAppVer
+			})
+		}
 	}
 
 	return fullDb, out, nil
 }
 
-func readCveDbMeta(path, osname string, fullDb map[string]*share.ScanVulnerability, output bool) (map[string]*OutputCVEVul, error) {
+func readCveDbMeta(r io.Reader, osname string, fullDb map[string]*share.ScanVulnerability, output bool) (map[string]*OutputCVEVul, error) {
 	var outCVEs map[string]*OutputCVEVul
 
-	filename := fmt.Sprintf("%s%s_full.tb", path, osname)
-	fvul, err := os.Open(filename)
-	if err != nil {
-		log.WithFields(log.Fields{"error": err, "os": osname}).Error("Can't open file")
-		return nil, err
-	}
-	defer fvul.Close()
-
-	data, err := ioutil.ReadAll(fvul)
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Read file error")
 		return nil, err
@@ -197,28 +281,10 @@ func readCveDbMeta(path, osname string, fullDb map[string]*share.ScanVulnerabili
 		var v VulFull
 		s := scanner.Text()
 		err := json.Unmarshal([]byte(s), &v)
-		var cveName string
-		// get ubuntu upstream out from ubuntu. make it an independent branch
-		if v.Namespace == "ubuntu:upstream" {
-			cveName = fmt.Sprintf("upstream:%s", v.Name)
-		} else {
-			cveName = fmt.Sprintf("%s:%s", osname, v.Name)
-		}
+		cveName := osVulName(osname, &v)
 		if err == nil {
 			if _, ok := fullDb[cveName]; !ok {
-				sv := &share.ScanVulnerability{
-					Description:      v.Description,
-					Link:             v.Link,
-					Severity:         v.Severity,
-					Score:            float32(v.CVSSv2.Score),
-					Vectors:          v.CVSSv2.Vectors,
-					ScoreV3:          float32(v.CVSSv3.Score),
-					VectorsV3:        v.CVSSv3.Vectors,
-					PublishedDate:    v.IssuedDate.Format(time.RFC3339),
-					LastModifiedDate: v.LastModDate.Format(time.RFC3339),
-					FeedRating:       v.FeedRating,
-				}
-				fullDb[cveName] = sv
+				fullDb[cveName] = osVulMeta(&v)
 			}
 
 			if output {
@@ -260,23 +326,108 @@ func readCveDbMeta(path, osname string, fullDb map[string]*share.ScanVulnerabili
 		}
 	}
 
-	log.WithFields(log.Fields{"vuls": len(fullDb), "osname": osname, "path": path}).Debug("")
+	log.WithFields(log.Fields{"vuls": len(fullDb), "osname": osname}).Debug("")
 	return outCVEs, nil
 }
 
-func readAppDbMeta(path string, fullDb map[string]*share.ScanVulnerability, output bool) (map[string]*OutputCVEVul, error) {
-	var outCVEs map[string]*OutputCVEVul
+// osVulName is the key of the vulnerability of the OS in the metadata given to the controller
+func osVulName(osname string, v *VulFull) string {
+	// get ubuntu upstream out from ubuntu. make it an independent branch
+	if v.Namespace == "ubuntu:upstream" {
+		return fmt.Sprintf("upstream:%s", v.Name)
+	}
+	return fmt.Sprintf("%s:%s", osname, v.Name)
+}
+
+func osVulMeta(v *VulFull) *share.ScanVulnerability {
+	return &share.ScanVulnerability{
+		Description:      v.Description,
+		Link:             v.Link,
+		Severity:         v.Severity,
+		Score:            float32(v.CVSSv2.Score),
+		Vectors:          v.CVSSv2.Vectors,
+		ScoreV3:          float32(v.CVSSv3.Score),
+		VectorsV3:        v.CVSSv3.Vectors,
+		PublishedDate:    v.IssuedDate.Format(time.RFC3339),
+		LastModifiedDate: v.LastModDate.Format(time.RFC3339),
+		FeedRating:       v.FeedRating,
+	}
+}
+
+func appVulMeta(v *AppModuleVul) *share.ScanVulnerability {
+	return &share.ScanVulnerability{
+		Description:      v.Description,
+		Link:             v.Link,
+		Severity:         v.Severity,
+		Score:            float32(v.Score),
+		Vectors:          v.Vectors,
+		ScoreV3:          float32(v.ScoreV3),
+		VectorsV3:        v.VectorsV3,
+		PublishedDate:    v.IssuedDate.Format(time.RFC3339),
+		LastModifiedDate: v.LastModDate.Format(time.RFC3339),
+		FeedRating:       v.Severity,
+	}
+}
 
-	var filename string
-	filename = fmt.Sprintf("%s/apps.tb", path)
-	fvul, err := os.Open(filename)
+// WalkCveDbMeta calls fn with the metadata of each vulnerability, the same as ReadCveDbMeta returns, in the
+// order of the tables. The tables are read a line at a time, only the names are kept to give a vulnerability
+// once, so the metadata of the whole database is never in memory. An error of fn stops the walk.
+func WalkCveDbMeta(path string, fn func(name string, v *share.ScanVulnerability) error) error {
+	seen := make(map[string]struct{})
+	visit := func(name string, meta func() *share.ScanVulnerability) error {
+		if _, ok := seen[name]; ok {
+			return nil
+		}
+		seen[name] = struct{}{}
+		return fn(name, meta())
+	}
+
+	for i := 0; i < DBMax; i++ {
+		osname := DBS.Buffers[i].Name
+		err := walkDbFile(path, fmt.Sprintf("%s_full.tb", osname), func(line []byte) error {
+			var v VulFull
+			if json.Unmarshal(line, &v) != nil {
+				return nil
+			}
+			return visit(osVulName(osname, &v), func() *share.ScanVulnerability { return osVulMeta(&v) })
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return walkDbFile(path, "apps.tb", func(line []byte) error {
+		var v AppModuleVul
+		if err := json.Unmarshal(line, &v); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Unmarshal vulnerability error")
+			return nil
+		}
+		return visit(fmt.Sprintf("%s:%s", DBAppName, v.VulName), func() *share.ScanVulnerability { return appVulMeta(&v) })
+	})
+}
+
+// walkDbFile calls fn with each line of the table
+func walkDbFile(path, name string, fn func(line []byte) error) error {
+	f, err := openDbFile(path, name)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("open file error")
-		return nil, err
+		log.WithFields(log.Fields{"error": err, "file": name}).Error("Can't open file")
+		return err
 	}
-	defer fvul.Close()
+	defer f.Close()
 
-	data, err := ioutil.ReadAll(fvul)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxBufferSize)
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func readAppDbMeta(r io.Reader, fullDb map[string]*share.ScanVulnerability, output bool) (map[string]*OutputCVEVul, error) {
+	var outCVEs map[string]*OutputCVEVul
+
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Read file error")
 		return nil, err
@@ -296,19 +447,7 @@ func readAppDbMeta(path string, fullDb map[string]*share.ScanVulnerability, outp
 		if err == nil {
 			cveName := fmt.Sprintf("%s:%s", DBAppName, v.VulName)
 			if _, ok := fullDb[cveName]; !ok {
-				sv := &share.ScanVulnerability{
-					Description:      v.Description,
-					Link:             v.Link,
-					Severity:         v.Severity,
-					Score:            float32(v.Score),
-					Vectors:          v.Vectors,
-					ScoreV3:          float32(v.ScoreV3),
-					VectorsV3:        v.VectorsV3,
-					PublishedDate:    v.IssuedDate.Format(time.RFC3339),
-					LastModifiedDate: v.LastModDate.Format(time.RFC3339),
-					FeedRating:       v.Severity,
-				}
-				fullDb[cveName] = sv
+				fullDb[cveName] = appVulMeta(&v)
 
 				if output {
 					var ov *OutputCVEVul
@@ -354,9 +493,7 @@ func readAppDbMeta(path string, fullDb map[string]*share.ScanVulnerability, outp
 }
 
 func LoadVulnerabilityIndex(path, osname string) ([]VulShort, error) {
-	var filename string
-	filename = fmt.Sprintf("%s/%s_index.tb", path, osname)
-	fvul, err := os.Open(filename)
+	fvul, err := openDbFile(path, fmt.Sprintf("%s_index.tb", osname))
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Open file error")
 		return nil, err
@@ -388,9 +525,7 @@ func LoadVulnerabilityIndex(path, osname string) ([]VulShort, error) {
 }
 
 func LoadFullVulnerabilities(path, osname string) (map[string]VulFull, error) {
-	filename := fmt.Sprintf("%s%s_full.tb", path, osname)
-
-	fvul, err := os.Open(filename)
+	fvul, err := openDbFile(path, fmt.Sprintf("%s_full.tb", osname))
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Debug("Can't open file")
 		return nil, err
@@ -421,18 +556,9 @@ func LoadFullVulnerabilities(path, osname string) (map[string]VulFull, error) {
 }
 
 func LoadAppVulsTb(path string) (map[string][]AppModuleVul, error) {
-	var filename string
-	filename = fmt.Sprintf("%s/apps.tb", path)
-	fvul, err := os.Open(filename)
+	data, err := readDbFile(path, "apps.tb")
 	if err != nil {
-		log.WithFields(log.Fields{"filename": filename, "error": err}).Error("open file error")
-		return nil, err
-	}
-	defer fvul.Close()
-
-	data, err := ioutil.ReadAll(fvul)
-	if err != nil {
-		log.WithFields(log.Fields{"filename": filename, "error": err}).Error("Read file error")
+		log.WithFields(log.Fields{"filename": "apps.tb", "error": err}).Error("Read file error")
 		return nil, err
 	}
 
@@ -460,7 +586,13 @@ func LoadAppVulsTb(path string) (map[string][]AppModuleVul, error) {
 	// for org.apache.logging.log4j:log4j-core, we will also search
 	// org.apache.logging.log4j.log4j-core: for backward compatibility
 	// log4j-core: for jar file without pom.xml. Prefix jar: to avoid collision
-	for mn, vf := range vul {
+	// the names are added to the map, only the names read are looked at
+	names := make([]string, 0, len(vul))
+	for mn := range vul {
+		names = append(names, mn)
+	}
+	for _, mn := range names {
+		vf := vul[mn]
 		if colon := strings.LastIndex(mn, ":"); colon > 0 {
 			m := strings.ReplaceAll(mn, ":", ".")
 			if _, ok := vul[m]; ok {
@@ -478,18 +610,9 @@ func LoadAppVulsTb(path string) (map[string][]AppModuleVul, error) {
 }
 
 func LoadRawFile(path, name string) ([]byte, error) {
-	var filename string
-	filename = fmt.Sprintf("%s/%s", path, name)
-	fp, err := os.Open(filename)
+	data, err := readDbFile(path, name)
 	if err != nil {
-		log.WithFields(log.Fields{"filename": filename, "error": err}).Error("open file error")
-		return nil, err
-	}
-	defer fp.Close()
-
-	data, err := ioutil.ReadAll(fp)
-	if err != nil {
-		log.WithFields(log.Fields{"filename": filename, "error": err}).Error("Read file error")
+		log.WithFields(log.Fields{"filename": name, "error": err}).Error("Read file error")
 		return nil, err
 	}
 
@@ -511,15 +634,17 @@ func LoadCveDb(path, desPath string, encryptKey []byte) (string, string, error)
 	}
 
 	// Read new db version
-	newVer, update, err := GetDbVersion(path)
+	sources := DbSources(path)
+	newVer, update, sourceVers, err := readSourcesVersion(sources)
 	if err == nil {
-		log.WithFields(log.Fields{"version": newVer, "update": update}).Debug("New DB found")
+		log.WithFields(log.Fields{"version": newVer, "update": update, "sources": len(sources)}).Debug("New DB found")
 	} else {
 		log.Error(err)
 	}
 
-	// Read expanded db version
+	// Read expanded db version, and the versions of its sources when it was merged
 	oldVer, _, oldErr := CheckExpandedDb(desPath, true)
+	oldSourceVers := expandedSourcesVersion(desPath)
 	if oldErr != nil && err != nil {
 		// no new database, no expanded database
 		log.WithFields(log.Fields{"error": err}).Error("No CVE database found")
@@ -528,7 +653,7 @@ func LoadCveDb(path, desPath string, encryptKey []byte) (string, string, error)
 		log.WithFields(log.Fields{"version": newVer}).Info("Expand new DB")
 
 		// has new database, no expanded database, untar the new database
-		err = unzipDb(path, desPath, encryptKey)
+		err = expandDb(sources, desPath, encryptKey)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("Unzip CVE database")
 			return "", "", err
@@ -540,7 +665,7 @@ func LoadCveDb(path, desPath string, encryptKey []byte) (string, string, error)
 			return "", "", errors.New("Invalid database format")
 		}
 		latestVer = fmt.Sprintf("%.3f", newVer)
-	} else if oldErr == nil && err == nil && newVer > oldVer {
+	} else if oldErr == nil && err == nil && (newVer > oldVer || sourceVers != oldSourceVers) {
 		log.WithFields(log.Fields{"version": newVer}).Info("Expand new DB")
 
 		// new database is newer then the expanded database, untar the new database
@@ -550,7 +675,7 @@ func LoadCveDb(path, desPath string, encryptKey []byte) (string, string, error)
 			return "", "", err
 		}
 
-		err = unzipDb(path, tmpDir+"/", encryptKey)
+		err = expandDb(sources, tmpDir+"/", encryptKey)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("Unzip CVE database")
 			os.RemoveAll(tmpDir)
@@ -560,7 +685,9 @@ func LoadCveDb(path, desPath string, encryptKey []byte) (string, string, error)
 		newVer, update, err = CheckExpandedDb(tmpDir+"/", true)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("CVE database format error")
-			os.Remove(path + share.DefaultCVEDBName)
+			if len(sources) == 1 {
+				os.Remove(sources[0])
+			}
 			os.RemoveAll(tmpDir)
 		} else {
 			removeDb(desPath)
@@ -579,100 +706,228 @@ func LoadCveDb(path, desPath string, encryptKey []byte) (string, string, error)
 	return latestVer, update, nil
 }
 
-func GetDbVersion(path string) (float64, string, error) {
-	f, err := os.Open(path + share.DefaultCVEDBName)
-	if err != nil {
-		return 0, "", fmt.Errorf("Read db file fail: %v", err)
+// DbSources returns the database files of the path, a comma-separated list of database folders or files.
+// A folder gives its cvedb file, then its supplemental databases named *.cvedb, by name. The first file is
+// the main database, the later ones override the vulnerabilities of the earlier ones.
+func DbSources(path string) []string {
+	var sources []string
+	for _, p := range strings.Split(path, ",") {
+		if p = strings.TrimSpace(p); p == "" && len(sources) > 0 {
+			continue
+		}
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			sources = append(sources, p)
+			continue
+		}
+		sources = append(sources, filepath.Join(p, share.DefaultCVEDBName))
+		if extra, _ := filepath.Glob(filepath.Join(p, "*"+SupplementalDbSuffix)); len(extra) > 0 {
+			sort.Strings(extra)
+			sources = append(sources, extra...)
+		}
 	}
-	defer f.Close()
+	return sources
+}
 
-	bhead := make([]byte, 4)
-	nlen, err := f.Read(bhead)
-	if err != nil || nlen != 4 {
-		return 0, "", fmt.Errorf("Read db file error: %v", err)
+// SupplementalDbSuffix names the supplemental databases of a database folder, merged with its cvedb file
+const SupplementalDbSuffix = ".cvedb"
+
+// GetDbVersion returns the version and the update time of the database of the path, of the main database
+// when the path has several sources
+func GetDbVersion(path string) (string, string, error) {
+	ver, update, _, err := readSourcesVersion(DbSources(path))
+	if err != nil {
+		return "", "", err
 	}
-	var headLen int32
-	err = binary.Read(bytes.NewReader(bhead), binary.BigEndian, &headLen)
+	return fmt.Sprintf("%.3f", ver), update, nil
+}
+
+// ExpandedDbVersion returns the version and the update time of the expanded database, as GetDbVersion
+func ExpandedDbVersion(path string) (string, string, error) {
+	ver, update, err := CheckExpandedDb(path, false)
 	if err != nil {
-		return 0, "", fmt.Errorf("Read header len error: %v", err)
+		return "", "", err
 	}
+	return fmt.Sprintf("%.3f", ver), update, nil
+}
 
-	if headLen > maxVersionHeader {
-		return 0, "", fmt.Errorf("Version Header too big: %v", headLen)
+// GetDbSources returns the hash of the versions of the sources of the database of the path, see dbSourcesHash
+func GetDbSources(path string) string {
+	_, _, sourceVers, err := readSourcesVersion(DbSources(path))
+	if err != nil {
+		return ""
 	}
+	return dbSourcesHash(sourceVers)
+}
 
-	bhead = make([]byte, headLen)
-	nlen, err = f.Read(bhead)
-	if err != nil || nlen != int(headLen) {
-		return 0, "", fmt.Errorf("Read db file version error:%v", err)
+// LoadedDbSources returns the hash of the versions of the sources of the database loaded, in memory or
+// expanded to the path, see dbSourcesHash
+func LoadedDbSources(path string) string {
+	memDbMutex.RLock()
+	inMemory, sourceVers := memDb != nil, memDbSources
+	memDbMutex.RUnlock()
+	if !inMemory {
+		sourceVers = expandedSourcesVersion(path)
 	}
+	return dbSourcesHash(sourceVers)
+}
 
-	var keyVer KeyVersion
+// dbSourcesHash tells a merged database from another with the same main database, like 1a2b3c4d, empty when
+// there is no supplemental database. The version of a merged database is the one of the main database, the
+// controllers parse it as a number, the hash is recorded beside it in the provenance of the results.
+func dbSourcesHash(sourceVers string) string {
+	if sourceVers == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(sourceVers))
+	return fmt.Sprintf("%x", sum[:4])
+}
 
-	err = json.Unmarshal(bhead, &keyVer)
-	if err != nil {
-		return 0, "", fmt.Errorf("Unmarshal keys error:%v", err)
+// readSourcesVersion returns the version of the main database and, with supplemental databases, the
+// versions of all the sources, to tell if any of them changed
+func readSourcesVersion(sources []string) (float64, string, string, error) {
+	var ver float64
+	var update string
+	versions := make([]string, 0, len(sources))
+	for i, file := range sources {
+		key, err := readDbVersion(file)
+		if err != nil {
+			return 0, "", "", err
+		}
+		if i == 0 {
+			if ver, err = strconv.ParseFloat(key.Version, 64); err != nil {
+				return 0, "", "", fmt.Errorf("Invalid version value:%v", err)
+			}
+			update = key.UpdateTime
+		}
+		versions = append(versions, dbSourceVersion(file, key))
 	}
-	verFl, err := strconv.ParseFloat(keyVer.Version, 64)
-	if err != nil {
-		return 0, "", fmt.Errorf("Invalid version value:%v", err)
+	if len(sources) < 2 {
+		return ver, update, "", nil
 	}
+	return ver, update, strings.Join(versions, ";"), nil
+}
 
-	return verFl, keyVer.UpdateTime, nil
+// dbSourceVersion identifies a source of a merged database by its file, version and update time
+func dbSourceVersion(file string, key *KeyVersion) string {
+	return fmt.Sprintf("%s %s %s", file, key.Version, key.UpdateTime)
 }
 
-func unzipDb(path, desPath string, encryptKey []byte) error {
-	f, err := os.Open(path + share.DefaultCVEDBName)
+// expandedSourcesVersion returns the versions of the sources of the expanded database, empty if it's not merged
+func expandedSourcesVersion(path string) string {
+	var key KeyVersion
+	if data, err := ioutil.ReadFile(path + "keys"); err != nil || json.Unmarshal(data, &key) != nil {
+		return ""
+	}
+	return strings.Join(key.Sources, ";")
+}
+
+// readDbVersion reads the version header of a database file
+func readDbVersion(file string) (*KeyVersion, error) {
+	f, err := os.Open(file)
 	if err != nil {
-		log.Info("Open zip db file fail")
-		return err
+		return nil, fmt.Errorf("Read db file fail: %v", err)
 	}
 	defer f.Close()
 
-	f.Seek(0, 0)
+	bhead, err := readDbKeys(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyVer KeyVersion
 
-	// read keys len
+	err = json.Unmarshal(bhead, &keyVer)
+	if err != nil {
+		return nil, fmt.Errorf("Unmarshal keys error:%v", err)
+	}
+	return &keyVer, nil
+}
+
+// readDbKeys reads the version and keys header at the beginning of the database file
+func readDbKeys(r io.Reader) ([]byte, error) {
 	bhead := make([]byte, 4)
-	nlen, err := f.Read(bhead)
-	if err != nil || nlen != 4 {
-		log.WithFields(log.Fields{"error": err}).Error("Read db file error")
-		return err
+	if _, err := io.ReadFull(r, bhead); err != nil {
+		return nil, fmt.Errorf("Read db file error: %v", err)
 	}
 	var headLen int32
-	err = binary.Read(bytes.NewReader(bhead), binary.BigEndian, &headLen)
+	err := binary.Read(bytes.NewReader(bhead), binary.BigEndian, &headLen)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Write header len error")
-		return err
+		return nil, fmt.Errorf("Read header len error: %v", err)
 	}
-	if headLen > maxVersionHeader {
-		log.Info("Version Header too big:", headLen)
-		return err
+	if headLen < 0 || headLen > maxVersionHeader {
+		return nil, fmt.Errorf("Version Header too big: %v", headLen)
 	}
 
-	// Read head and write keys file
 	bhead = make([]byte, headLen)
-	nlen, err = f.Read(bhead)
-	if err != nil || nlen != int(headLen) {
-		log.WithFields(log.Fields{"error": err}).Error("Read db file error")
-		return err
+	if _, err := io.ReadFull(r, bhead); err != nil {
+		return nil, fmt.Errorf("Read db file version error:%v", err)
 	}
-	err = ioutil.WriteFile(desPath+"keys", bhead, 0400)
+	return bhead, nil
+}
+
+// decryptDb reads the keys header and decrypts the rest of the database file, which is a tar archive
+func decryptDb(r io.Reader, encryptKey []byte) ([]byte, []byte, error) {
+	keys, err := readDbKeys(r)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Write keys file error")
-		return err
+		log.WithFields(log.Fields{"error": err}).Error("Read db file error")
+		return nil, nil, err
 	}
 
 	// Read the rest of DB
-	cipherData, err := ioutil.ReadAll(f)
+	cipherData, err := ioutil.ReadAll(r)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Read db file tar part error")
-		return err
+		return nil, nil, err
 	}
 
 	// Use local decrypt function
 	plainData, err := decrypt(cipherData, encryptKey)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Decrypt tar file error")
+		return nil, nil, err
+	}
+	return keys, plainData, nil
+}
+
+// expandDb writes the database files of the sources to the folder, merged if there are several
+func expandDb(sources []string, desPath string, encryptKey []byte) error {
+	if len(sources) == 1 {
+		return unzipDb(sources[0], desPath, encryptKey)
+	}
+
+	files, err := readDbSources(sources, encryptKey)
+	if err != nil {
+		return err
+	}
+	for name, data := range files {
+		mode := os.FileMode(0644)
+		if name == "keys" {
+			mode = 0400
+		}
+		if err := ioutil.WriteFile(filepath.Join(desPath, name), data, mode); err != nil {
+			log.WithFields(log.Fields{"error": err, "file": name}).Error("Write db file error")
+			return err
+		}
+	}
+	return nil
+}
+
+func unzipDb(file, desPath string, encryptKey []byte) error {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Info("Open zip db file fail")
+		return err
+	}
+	defer f.Close()
+
+	keys, plainData, err := decryptDb(f, encryptKey)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(desPath+"keys", keys, 0400)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Write keys file error")
 		return err
 	}
 
@@ -686,8 +941,184 @@ func unzipDb(path, desPath string, encryptKey []byte) error {
 	return nil
 }
 
-func checkDbHash(filename, hash string) bool {
-	data, err := ioutil.ReadFile(filename)
+// LoadCveDbInMemory decrypts the database into memory without writing the plaintext files.
+// The table loaders read from memory afterwards, whatever table path they are given.
+func LoadCveDbInMemory(path string, encryptKey []byte) (string, string, error) {
+	// Read new db version
+	sources := DbSources(path)
+	newVer, update, sourceVers, err := readSourcesVersion(sources)
+	if err != nil {
+		log.Error(err)
+		return "", "", err
+	}
+
+	memDbMutex.RLock()
+	loaded := memDb != nil && memDbVersion == newVer && memDbSources == sourceVers
+	memDbMutex.RUnlock()
+	if loaded {
+		return fmt.Sprintf("%.3f", newVer), update, nil
+	}
+
+	log.WithFields(log.Fields{"version": newVer, "sources": len(sources)}).Info("Load new DB in memory")
+
+	files, err := readDbSources(sources, encryptKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	newVer, update, err = checkDbData(files["keys"], true, func(name string) ([]byte, error) {
+		if data, ok := files[name]; ok {
+			return data, nil
+		}
+		return nil, os.ErrNotExist
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("CVE database format error")
+		return "", "", errors.New("Invalid database format")
+	}
+
+	memDbMutex.Lock()
+	closeSharedDb()
+	memDb = files
+	memDbVersion = newVer
+	memDbSources = sourceVers
+	memDbMutex.Unlock()
+
+	return fmt.Sprintf("%.3f", newVer), update, nil
+}
+
+// readDbSources decrypts the database files of the sources. The tables of the supplemental databases are
+// merged into the tables of the main one by vulnerability: the entries of a vulnerability of a later source
+// replace the ones of the earlier sources, by namespace and name in the OS tables and by name in apps.tb. The
+// other files of a later source replace the earlier ones. The keys of a merged database have the hashes of
+// the merged files and the versions of the sources.
+func readDbSources(sources []string, encryptKey []byte) (map[string][]byte, error) {
+	var files map[string][]byte
+	var key KeyVersion
+	for i, file := range sources {
+		f, err := os.Open(file)
+		if err != nil {
+			log.WithFields(log.Fields{"file": file}).Info("Open zip db file fail")
+			return nil, err
+		}
+		keys, plainData, err := decryptDb(f, encryptKey)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		source, err := utils.SelectivelyExtractArchive(bytes.NewReader(plainData), func(string) bool { return true }, maxExtractSize)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Extract db file error")
+			return nil, err
+		}
+		source["keys"] = keys
+		if i == 0 {
+			files = source
+			if len(sources) > 1 {
+				if err := json.Unmarshal(keys, &key); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		// the files of a supplemental database are only the ones it has a hash of
+		var sourceKey KeyVersion
+		if err := json.Unmarshal(keys, &sourceKey); err != nil {
+			return nil, err
+		}
+		if i == 1 {
+			key.Sources = []string{dbSourceVersion(sources[0], &KeyVersion{Version: key.Version, UpdateTime: key.UpdateTime})}
+		}
+		key.Sources = append(key.Sources, dbSourceVersion(file, &sourceKey))
+		for name, data := range source {
+			if name == "keys" {
+				continue
+			}
+			if sha := fmt.Sprintf("%x", sha256.Sum256(data)); sha != sourceKey.Shas[name] {
+				log.WithFields(log.Fields{"source": file, "file": name}).Error("Hash not match")
+				return nil, errors.New("database hash error")
+			}
+			files[name] = mergeDbFile(name, files[name], data)
+		}
+		log.WithFields(log.Fields{"source": file, "version": sourceKey.Version, "files": len(source) - 1}).Info("Merge supplemental DB")
+	}
+
+	if len(sources) > 1 {
+		key.Shas = make(map[string]string, len(files))
+		for name, data := range files {
+			if name != "keys" {
+				key.Shas[name] = fmt.Sprintf("%x", sha256.Sum256(data))
+			}
+		}
+		files["keys"], _ = json.Marshal(&key)
+	}
+	return files, nil
+}
+
+// mergeDbFile merges the file of a later source into the one of the earlier sources
+func mergeDbFile(name string, base, later []byte) []byte {
+	var entryKey func(line []byte) string
+	switch {
+	case strings.HasSuffix(name, "_full.tb") || strings.HasSuffix(name, "_index.tb"):
+		entryKey = func(line []byte) string {
+			var v struct {
+				Name      string `json:"N"`
+				Namespace string `json:"NS"`
+			}
+			if json.Unmarshal(line, &v) != nil || v.Name == "" {
+				return ""
+			}
+			return v.Namespace + ":" + v.Name
+		}
+	case name == "apps.tb":
+		entryKey = func(line []byte) string {
+			var v struct {
+				VulName string `json:"VN"`
+			}
+			if json.Unmarshal(line, &v) != nil {
+				return ""
+			}
+			return v.VulName
+		}
+	default:
+		return later
+	}
+
+	replaced := make(map[string]bool)
+	forEachDbLine(later, func(line []byte) {
+		if k := entryKey(line); k != "" {
+			replaced[k] = true
+		}
+	})
+	var merged bytes.Buffer
+	forEachDbLine(base, func(line []byte) {
+		if k := entryKey(line); k == "" || !replaced[k] {
+			merged.Write(line)
+			merged.WriteByte('\n')
+		}
+	})
+	forEachDbLine(later, func(line []byte) {
+		merged.Write(line)
+		merged.WriteByte('\n')
+	})
+	return merged.Bytes()
+}
+
+// forEachDbLine calls fn with each non-empty line of the table
+func forEachDbLine(data []byte, fn func(line []byte)) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxBufferSize)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(bytes.TrimSpace(line)) > 0 {
+			fn(line)
+		}
+	}
+}
+
+func checkDbHash(filename, hash string, read func(name string) ([]byte, error)) bool {
+	data, err := read(filename)
 	if err != nil {
 		log.WithFields(log.Fields{"file": filename, "error": err}).Info("Read file error")
 		return false
@@ -750,17 +1181,27 @@ func CheckExpandedDb(path string, checkHash bool) (float64, string, error) {
 		return 0, "", err
 	}
 
-	var key KeyVersion
-	err = json.Unmarshal(data, &key)
+	verFl, update, err := checkDbData(data, checkHash, func(name string) ([]byte, error) {
+		return ioutil.ReadFile(path + name)
+	})
 	if err != nil {
 		removeDb(path)
 		return 0, "", err
 	}
+	return verFl, update, nil
+}
+
+// checkDbData parses the keys header and verifies the hash of every database file given by read
+func checkDbData(keys []byte, checkHash bool, read func(name string) ([]byte, error)) (float64, string, error) {
+	var key KeyVersion
+	err := json.Unmarshal(keys, &key)
+	if err != nil {
+		return 0, "", err
+	}
 
 	var verFl float64
 	verFl, err = strconv.ParseFloat(key.Version, 64)
 	if err != nil {
-		removeDb(path)
 		return 0, "", err
 	}
 
@@ -768,17 +1209,66 @@ func CheckExpandedDb(path string, checkHash bool) (float64, string, error) {
 		valid := true
 
 		for i := 1; i < len(fileList); i++ {
-			if !checkDbHash(path+fileList[i], key.Shas[fileList[i]]) {
+			if !checkDbHash(fileList[i], key.Shas[fileList[i]], read) {
 				log.WithFields(log.Fields{"file": fileList[i]}).Error("Database hash error")
 				valid = false
 			}
 		}
 
 		if !valid {
-			removeDb(path)
 			return 0, "", errors.New("database hash error")
 		}
 	}
 
 	return verFl, key.UpdateTime, nil
 }
+
+// CveRecords are the records of a vulnerability in the tables, one per namespace of the OS tables and one per
+// module of the application table
+type CveRecords struct {
+	OS   []VulFull
+	Apps []AppModuleVul
+}
+
+// FindCveRecords returns the records of the vulnerability named id, or having id among its CVEs or aliases,
+// the case of id is ignored. The tables are walked a line at a time like WalkCveDbMeta does.
+func FindCveRecords(path, id string) (*CveRecords, error) {
+	match := func(name string, others ...[]string) bool {
+		if strings.EqualFold(name, id) {
+			return true
+		}
+		for _, ids := range others {
+			for _, other := range ids {
+				if strings.EqualFold(other, id) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var recs CveRecords
+	for i := 0; i < DBMax; i++ {
+		err := walkDbFile(path, fmt.Sprintf("%s_full.tb", DBS.Buffers[i].Name), func(line []byte) error {
+			var v VulFull
+			if json.Unmarshal(line, &v) == nil && match(v.Name, v.CVEs, v.Aliases) {
+				recs.OS = append(recs.OS, v)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := walkDbFile(path, "apps.tb", func(line []byte) error {
+		var v AppModuleVul
+		if json.Unmarshal(line, &v) == nil && match(v.VulName, v.CVEs, v.Aliases) {
+			recs.Apps = append(recs.Apps, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &recs, nil
+}
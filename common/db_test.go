@@ -0,0 +1,308 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+var testDbKey = []byte("0123456789abcdef0123456789abcdef")
+
+func writeTestDb(t *testing.T, dir string) {
+	issued := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	files := make(map[string][]byte)
+	for _, name := range fileList[1:] {
+		files[name] = []byte{}
+	}
+	for i := 0; i < DBMax; i++ {
+		osname := DBS.Buffers[i].Name
+		full, _ := json.Marshal(VulFull{
+			Name: "CVE-2022-0001", Namespace: osname + ":1", Description: osname, Severity: "High",
+			FixedIn: []FeaFull{{Name: "openssl", Version: "1.1"}}, IssuedDate: issued, LastModDate: issued,
+		})
+		index, _ := json.Marshal(VulShort{Name: "CVE-2022-0001", Namespace: osname + ":1"})
+		files[osname+"_full.tb"] = append(full, '\n')
+		files[osname+"_index.tb"] = append(index, '\n')
+	}
+	app, _ := json.Marshal(AppModuleVul{
+		VulName: "CVE-2022-0002", AppName: "maven", ModuleName: "org.apache:commons", Severity: "Medium",
+		FixedVer: []AppModuleVersion{{OpCode: "gteq", Version: "2.0"}}, IssuedDate: issued, LastModDate: issued,
+	})
+	files["apps.tb"] = append(app, '\n')
+	files[RHELCpeMapFile] = []byte("{}")
+	writeTestDbFile(t, dir+share.DefaultCVEDBName, "1.234", files)
+}
+
+// writeTestDbFile encrypts the files into a database file of the version
+func writeTestDbFile(t *testing.T, file, version string, files map[string][]byte) {
+	key := KeyVersion{Version: version, UpdateTime: "2022-01-02T00:00:00Z", Shas: make(map[string]string)}
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for name, data := range files {
+		key.Shas[name] = fmt.Sprintf("%x", sha256.Sum256(data))
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	tw.Close()
+
+	keys, _ := json.Marshal(key)
+	cipherData, err := encrypt(tarBuf.Bytes(), testDbKey)
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+
+	var db bytes.Buffer
+	binary.Write(&db, binary.BigEndian, int32(len(keys)))
+	db.Write(keys)
+	db.Write(cipherData)
+	if err := ioutil.WriteFile(file, db.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write db: %v", err)
+	}
+}
+
+type testDbData struct {
+	version string
+	update  string
+	meta    map[string]*share.ScanVulnerability
+	out     []*OutputCVEVul
+	index   []VulShort
+	full    map[string]VulFull
+	apps    map[string][]AppModuleVul
+	cpeMap  []byte
+}
+
+func readTestDb(t *testing.T, tbPath string) *testDbData {
+	var d testDbData
+	var err error
+	if d.meta, d.out, err = ReadCveDbMeta(tbPath, true); err != nil {
+		t.Fatalf("Failed to read db meta: %v", err)
+	}
+	if d.index, err = LoadVulnerabilityIndex(tbPath, "debian"); err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	if d.full, err = LoadFullVulnerabilities(tbPath, "debian"); err != nil {
+		t.Fatalf("Failed to read full: %v", err)
+	}
+	if d.apps, err = LoadAppVulsTb(tbPath); err != nil {
+		t.Fatalf("Failed to read apps: %v", err)
+	}
+	if d.cpeMap, err = LoadRawFile(tbPath, RHELCpeMapFile); err != nil {
+		t.Fatalf("Failed to read cpe map: %v", err)
+	}
+	return &d
+}
+
+func TestLoadCveDbModes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cvedb")
+	defer os.RemoveAll(dir)
+	dbPath := dir + "/"
+	tbPath := dir + "/tb/"
+	writeTestDb(t, dbPath)
+
+	// expanded to disk
+	ver, update, err := LoadCveDb(dbPath, tbPath, testDbKey)
+	if err != nil {
+		t.Fatalf("Failed to expand db: %v", err)
+	}
+	disk := readTestDb(t, tbPath)
+	disk.version, disk.update = ver, update
+
+	// in memory, the table path is not used
+	defer func() { memDb = nil }()
+	ver, update, err = LoadCveDbInMemory(dbPath, testDbKey)
+	if err != nil {
+		t.Fatalf("Failed to load db in memory: %v", err)
+	}
+	if !IsCveDbInMemory() {
+		t.Errorf("Database is not in memory")
+	}
+	mem := readTestDb(t, dir+"/none/")
+	mem.version, mem.update = ver, update
+
+	if mem.version != "1.234" || len(mem.meta) != DBMax+1 || len(mem.index) != 1 {
+		t.Errorf("Unexpected data: version=%s meta=%d index=%d", mem.version, len(mem.meta), len(mem.index))
+	}
+	if !reflect.DeepEqual(disk, mem) {
+		t.Errorf("Different data between modes:\n%+v\n%+v", disk, mem)
+	}
+}
+
+func TestWalkCveDbMeta(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cvedb")
+	defer os.RemoveAll(dir)
+	tbPath := dir + "/tb/"
+	writeTestDb(t, dir+"/")
+	if _, _, err := LoadCveDb(dir+"/", tbPath, testDbKey); err != nil {
+		t.Fatalf("Failed to expand db: %v", err)
+	}
+
+	meta, _, err := ReadCveDbMeta(tbPath, false)
+	if err != nil {
+		t.Fatalf("Failed to read db meta: %v", err)
+	}
+	walked := make(map[string]*share.ScanVulnerability)
+	err = WalkCveDbMeta(tbPath, func(name string, v *share.ScanVulnerability) error {
+		if _, ok := walked[name]; ok {
+			t.Errorf("%s given twice", name)
+		}
+		walked[name] = v
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(meta, walked) {
+		t.Errorf("Different metadata: %v\n%+v\n%+v", err, meta, walked)
+	}
+
+	stop := errors.New("stop")
+	var calls int
+	err = WalkCveDbMeta(tbPath, func(name string, v *share.ScanVulnerability) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Walk not stopped: %v, %d calls", err, calls)
+	}
+}
+
+func TestFindCveRecords(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cvedb")
+	defer os.RemoveAll(dir)
+	tbPath := dir + "/tb/"
+	writeTestDb(t, dir+"/")
+	if _, _, err := LoadCveDb(dir+"/", tbPath, testDbKey); err != nil {
+		t.Fatalf("Failed to expand db: %v", err)
+	}
+
+	recs, err := FindCveRecords(tbPath, "cve-2022-0001")
+	if err != nil || len(recs.OS) != DBMax || len(recs.Apps) != 0 {
+		t.Fatalf("Unexpected records: %v %+v", err, recs)
+	}
+	if v := recs.OS[1]; v.Namespace != "debian:1" || v.FixedIn[0].Version != "1.1" {
+		t.Errorf("Unexpected record: %+v", v)
+	}
+	if recs, _ = FindCveRecords(tbPath, "CVE-2022-0002"); len(recs.OS) != 0 || len(recs.Apps) != 1 || recs.Apps[0].ModuleName != "org.apache:commons" {
+		t.Errorf("Unexpected app records: %+v", recs)
+	}
+	if recs, _ = FindCveRecords(tbPath, "CVE-2000-0001"); len(recs.OS) != 0 || len(recs.Apps) != 0 {
+		t.Errorf("Unexpected records of an unknown CVE: %+v", recs)
+	}
+}
+
+func TestLoadCveDbInMemoryBadKey(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cvedb")
+	defer os.RemoveAll(dir)
+	writeTestDb(t, dir+"/")
+
+	defer func() { memDb = nil }()
+	if _, _, err := LoadCveDbInMemory(dir+"/", []byte("fedcba9876543210fedcba9876543210")); err == nil {
+		t.Errorf("Expect a decryption error")
+	}
+	if IsCveDbInMemory() {
+		t.Errorf("Database should not be loaded")
+	}
+}
+
+func TestMergeCveDbSources(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cvedb")
+	defer os.RemoveAll(dir)
+	writeTestDb(t, dir+"/")
+
+	// the internal feed overrides a debian vulnerability and an app one, and adds a vulnerability
+	issued := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	var full, index []byte
+	for _, name := range []string{"CVE-2022-0001", "CVE-2023-0001"} {
+		f, _ := json.Marshal(VulFull{Name: name, Namespace: "debian:1", Description: "internal", Severity: "Critical", IssuedDate: issued, LastModDate: issued})
+		i, _ := json.Marshal(VulShort{Name: name, Namespace: "debian:1"})
+		full, index = append(append(full, f...), '\n'), append(append(index, i...), '\n')
+	}
+	app, _ := json.Marshal(AppModuleVul{VulName: "CVE-2022-0002", AppName: "maven", ModuleName: "org.apache:commons", Severity: "High", IssuedDate: issued, LastModDate: issued})
+	writeTestDbFile(t, dir+"/internal"+SupplementalDbSuffix, "0.1", map[string][]byte{
+		"debian_full.tb": full, "debian_index.tb": index, "apps.tb": append(app, '\n'),
+	})
+
+	if sources := DbSources(dir); len(sources) != 2 || sources[0] != dir+"/"+share.DefaultCVEDBName {
+		t.Fatalf("Incorrect sources: %v", sources)
+	}
+	if sources := DbSources(dir + "/cvedb, " + dir + "/internal.cvedb"); len(sources) != 2 || sources[1] != dir+"/internal.cvedb" {
+		t.Fatalf("Incorrect sources of the list: %v", sources)
+	}
+
+	check := func(d *testDbData, mode string) {
+		if d.version != "1.234" || len(d.index) != 2 || len(d.meta) != DBMax+2 {
+			t.Errorf("%s: unexpected data: version=%s index=%d meta=%d", mode, d.version, len(d.index), len(d.meta))
+		}
+		if v := d.full["debian:1:CVE-2022-0001"]; v.Description != "internal" || v.Severity != "Critical" {
+			t.Errorf("%s: vulnerability not overridden: %+v", mode, v)
+		}
+		if v := d.meta["ubuntu:CVE-2022-0001"]; v == nil || v.Description != "ubuntu" {
+			t.Errorf("%s: vulnerability of another namespace overridden: %+v", mode, v)
+		}
+		if apps := d.apps["org.apache:commons"]; len(apps) != 1 || apps[0].Severity != "High" {
+			t.Errorf("%s: app vulnerability not overridden: %+v", mode, apps)
+		}
+	}
+
+	tbPath := dir + "/tb/"
+	ver, _, err := LoadCveDb(dir, tbPath, testDbKey)
+	if err != nil {
+		t.Fatalf("Failed to expand merged db: %v", err)
+	}
+	disk := readTestDb(t, tbPath)
+	disk.version = ver
+	check(disk, "disk")
+	if _, _, err := CheckExpandedDb(tbPath, true); err != nil {
+		t.Errorf("Merged db hashes not valid: %v", err)
+	}
+
+	defer func() { memDb = nil }()
+	if ver, _, err = LoadCveDbInMemory(dir, testDbKey); err != nil {
+		t.Fatalf("Failed to load merged db in memory: %v", err)
+	}
+	mem := readTestDb(t, dir+"/none/")
+	mem.version = ver
+	check(mem, "memory")
+
+	if v, _, err := ExpandedDbVersion(tbPath); err != nil || v != ver {
+		t.Errorf("Incorrect version of the expanded db: %s %s %v", ver, v, err)
+	}
+
+	sources := LoadedDbSources(tbPath)
+	if len(sources) != 8 || GetDbSources(dir) != sources {
+		t.Errorf("Incorrect sources of the merged db: %s %s", sources, GetDbSources(dir))
+	}
+
+	// a new version of the feed is loaded again, with the same version of the main database, and changes the
+	// sources of the database
+	memDb = nil
+	writeTestDbFile(t, dir+"/internal"+SupplementalDbSuffix, "0.2", map[string][]byte{"debian_full.tb": full[:len(full)/2]})
+	newVer, _, err := LoadCveDb(dir, tbPath, testDbKey)
+	if err != nil {
+		t.Fatalf("Failed to expand merged db: %v", err)
+	}
+	if d := readTestDb(t, tbPath); len(d.index) != 1 {
+		t.Errorf("New feed version not expanded: index=%d", len(d.index))
+	}
+	if v, _, err := GetDbVersion(dir); err != nil || newVer != ver || v != ver {
+		t.Errorf("Incorrect version of the merged db: %s %s %s %v", ver, newVer, v, err)
+	}
+	if s := LoadedDbSources(tbPath); s == sources || s != GetDbSources(dir) {
+		t.Errorf("Feed version not in the sources of the db: %s %s", sources, s)
+	}
+
+	// a tampered feed
+	data, _ := ioutil.ReadFile(dir + "/internal" + SupplementalDbSuffix)
+	ioutil.WriteFile(dir+"/internal"+SupplementalDbSuffix, data[:len(data)-16], 0600)
+	if _, _, err := LoadCveDbInMemory(dir, testDbKey); err == nil {
+		t.Errorf("Truncated feed accepted")
+	}
+}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The database loaded in memory is shared with the scanner tasks as a sealed memfd file, which they map
+// read-only instead of decrypting the database again, so the tasks share its pages. The file has the number
+// of the database files, then the name and the data of each file, with their lengths, little-endian.
+
+// memDbFile is the shared file of memDb, written for the first scanner task of the database
+var memDbFile *os.File
+
+// SharedCveDb returns a file of the database loaded in memory for a scanner task, to be given to
+// LoadSharedCveDb. The caller closes the file once the task has it.
+func SharedCveDb() (*os.File, error) {
+	memDbMutex.Lock()
+	defer memDbMutex.Unlock()
+	if memDb == nil {
+		return nil, errors.New("The database is not loaded in memory")
+	}
+	if memDbFile == nil {
+		f, err := writeSharedDb(memDb)
+		if err != nil {
+			return nil, err
+		}
+		memDbFile = f
+	}
+	fd, err := unix.FcntlInt(memDbFile.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), memDbFile.Name()), nil
+}
+
+// closeSharedDb closes the shared file of the database replaced, the tasks given it keep theirs
+func closeSharedDb() {
+	if memDbFile != nil {
+		memDbFile.Close()
+		memDbFile = nil
+	}
+}
+
+func writeSharedDb(files map[string][]byte) (*os.File, error) {
+	fd, err := unix.MemfdCreate("cvedb", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the shared database: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "cvedb")
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := bufio.NewWriter(f)
+	binary.Write(w, binary.LittleEndian, uint32(len(names)))
+	for _, name := range names {
+		binary.Write(w, binary.LittleEndian, uint32(len(name)))
+		w.WriteString(name)
+		binary.Write(w, binary.LittleEndian, uint64(len(files[name])))
+		w.Write(files[name])
+	}
+	if err = w.Flush(); err == nil {
+		_, err = unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SEAL|unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to write the shared database: %v", err)
+	}
+	return f, nil
+}
+
+// LoadSharedCveDb maps the file of SharedCveDb as the database in memory. It returns the version and the
+// update time of the database, like LoadCveDbInMemory.
+func LoadSharedCveDb(f *os.File) (string, string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to map the shared database: %v", err)
+	}
+	files, err := readSharedDb(data)
+	if err != nil {
+		unix.Munmap(data)
+		return "", "", err
+	}
+
+	// verified by the scanner
+	ver, update, err := checkDbData(files["keys"], false, nil)
+	if err != nil {
+		unix.Munmap(data)
+		return "", "", err
+	}
+	var key KeyVersion
+	json.Unmarshal(files["keys"], &key)
+	sources := strings.Join(key.Sources, ";")
+
+	memDbMutex.Lock()
+	memDb = files
+	memDbVersion = ver
+	memDbSources = sources
+	memDbMutex.Unlock()
+	return fmt.Sprintf("%.3f", ver), update, nil
+}
+
+// readSharedDb returns the files of the shared database, slices of its data
+func readSharedDb(data []byte) (map[string][]byte, error) {
+	errFormat := errors.New("Invalid shared database")
+	next := func(n uint64) ([]byte, error) {
+		if n > uint64(len(data)) {
+			return nil, errFormat
+		}
+		b := data[:n:n]
+		data = data[n:]
+		return b, nil
+	}
+
+	b, err := next(4)
+	if err != nil {
+		return nil, err
+	}
+	count := binary.LittleEndian.Uint32(b)
+	files := make(map[string][]byte, count)
+	for i := uint32(0); i < count; i++ {
+		if b, err = next(4); err != nil {
+			return nil, err
+		}
+		name, err := next(uint64(binary.LittleEndian.Uint32(b)))
+		if err != nil {
+			return nil, err
+		}
+		if b, err = next(8); err != nil {
+			return nil, err
+		}
+		if files[string(name)], err = next(binary.LittleEndian.Uint64(b)); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) != 0 || files["keys"] == nil {
+		return nil, errFormat
+	}
+	return files, nil
+}
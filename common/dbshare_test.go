@@ -0,0 +1,56 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSharedCveDb(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cvedb")
+	defer os.RemoveAll(dir)
+	writeTestDb(t, dir+"/")
+
+	defer func() { memDb = nil; closeSharedDb() }()
+	if _, err := SharedCveDb(); err == nil {
+		t.Errorf("Database shared without being loaded in memory")
+	}
+	ver, update, err := LoadCveDbInMemory(dir+"/", testDbKey)
+	if err != nil {
+		t.Fatalf("Failed to load db in memory: %v", err)
+	}
+	mem := readTestDb(t, dir+"/none/")
+	mem.version, mem.update = ver, update
+
+	// the task maps the file given by the scanner, the same file for each task of the database
+	f, err := SharedCveDb()
+	if err != nil {
+		t.Fatalf("Failed to share the db: %v", err)
+	}
+	defer f.Close()
+	shared := memDbFile
+	if f2, err := SharedCveDb(); err != nil || memDbFile != shared {
+		t.Errorf("Shared db written again: %v", err)
+	} else {
+		f2.Close()
+	}
+
+	memDb = nil
+	if ver, update, err = LoadSharedCveDb(f); err != nil {
+		t.Fatalf("Failed to map the shared db: %v", err)
+	}
+	mapped := readTestDb(t, dir+"/none/")
+	mapped.version, mapped.update = ver, update
+	if !reflect.DeepEqual(mem, mapped) {
+		t.Errorf("Different data of the shared db:\n%+v\n%+v", mem, mapped)
+	}
+
+	// the file is sealed, and a truncated one refused
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Errorf("Shared db not sealed")
+	}
+	if _, err := readSharedDb([]byte{1, 0, 0, 0, 4, 0, 0, 0, 'k', 'e'}); err == nil {
+		t.Errorf("Truncated shared db accepted")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// registryCreds are the credentials of the registries matching a host pattern of -creds_file
+type registryCreds struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"` // a bearer token, instead of the username and password
+}
+
+// credsFile maps the host patterns, like registry.corp:5000 or *.internal.corp, to their credentials
+type credsFile map[string]*registryCreds
+
+// loadCredsFile reads the -creds_file, a json object or a yaml mapping of the hosts to the credentials:
+//
+//	"*.internal.corp":
+//	  username: scanner
+//	  password: secret
+//	ghcr.io:
+//	  token: ghp_xxx
+func loadCredsFile(path string) (credsFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the credentials file: %v", err)
+	}
+	creds, err := parseCredsFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid credentials file %s: %v", path, err)
+	}
+	return creds, nil
+}
+
+func parseCredsFile(data []byte) (credsFile, error) {
+	raw := make(credsFile)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		var cur *registryCreds
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimRight(stripYAMLComment(scanner.Text()), " \t")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+				// a host, the port is part of it
+				if !strings.HasSuffix(strings.TrimSpace(line), ":") {
+					return nil, fmt.Errorf("line %d: not a host: mapping", n)
+				}
+				host := strings.Trim(strings.TrimSuffix(strings.TrimSpace(line), ":"), `"'`)
+				if _, ok := raw[host]; ok {
+					return nil, fmt.Errorf("line %d: duplicated %s", n, host)
+				}
+				cur = &registryCreds{}
+				raw[host] = cur
+				continue
+			}
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: credentials without the host", n)
+			}
+			// the value can have colons, the key can't
+			i := strings.Index(line, ":")
+			if i == -1 {
+				return nil, fmt.Errorf("line %d: not a key: value mapping", n)
+			}
+			key := strings.TrimSpace(line[:i])
+			value := strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+			switch key {
+			case "username":
+				cur.Username = value
+			case "password":
+				cur.Password = value
+			case "token":
+				cur.Token = value
+			default:
+				return nil, fmt.Errorf("line %d: unknown key %s, username, password or token", n, key)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	creds := make(credsFile, len(raw))
+	for host, c := range raw {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			return nil, fmt.Errorf("Entry without the host")
+		}
+		if strings.Contains(host, "*") && !strings.HasPrefix(host, "*.") {
+			return nil, fmt.Errorf("Invalid wildcard host %s, only a leading *. is supported", host)
+		}
+		if c == nil || (c.Username == "" && c.Token == "") {
+			return nil, fmt.Errorf("%s: no username or token", host)
+		}
+		if c.Token != "" && (c.Username != "" || c.Password != "") {
+			return nil, fmt.Errorf("%s: only one of the token and the username can be given", host)
+		}
+		creds[host] = c
+	}
+	return creds, nil
+}
+
+// stripYAMLComment removes the comment of the line, from a # at its start or after a space, outside the quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// credentials returns the credentials of the most specific host pattern matching the registry. The docker
+// hub patterns match all the docker hub aliases.
+func (creds credsFile) credentials(registry string) *registryCreds {
+	host := dockerConfigHost(registry)
+	if host == "" {
+		return nil
+	}
+
+	patterns := make([]string, 0, len(creds))
+	for pattern := range creds {
+		patterns = append(patterns, pattern)
+	}
+	var best *registryCreds
+	var bestRank int
+	for _, pattern := range longestFirst(patterns) {
+		c := creds[pattern]
+		rank := cvetools.HostPatternRank(pattern, host)
+		if rank == 0 && dockerhubRegs.Contains(pattern) && dockerhubRegs.Contains(host) {
+			rank = 1000
+		}
+		if rank > bestRank {
+			best, bestRank = c, rank
+		}
+	}
+	return best
+}
+
+// applyCredsFile sets the credentials of the registry of the request when the file has them, over the
+// -registry_username and -registry_password of all the images
+func applyCredsFile(req *share.ScanImageRequest, creds credsFile) {
+	if creds == nil {
+		return
+	}
+	if c := creds.credentials(req.Registry); c != nil {
+		req.Username, req.Password, req.Token = c.Username, c.Password, c.Token
+	}
+}
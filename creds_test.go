@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+func TestCredsFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "creds")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "creds.yaml")
+	ioutil.WriteFile(file, []byte(`# the registries of the sweep
+"*.internal.corp":
+  username: corp
+  password: "secret:1"
+team.internal.corp:
+  username: team
+  password: team-pass
+registry.lab:5000:  # the lab
+  token: lab-token # rotated monthly
+docker.io:
+  username: hubuser
+  password: "hub#pass" # quoted
+`), 0600)
+	creds, err := loadCredsFile(file)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+
+	tests := map[string]registryCreds{
+		"https://a.internal.corp":          {Username: "corp", Password: "secret:1"},
+		"https://x.team.internal.corp:443": {Username: "corp", Password: "secret:1"},
+		"https://team.internal.corp/app":   {Username: "team", Password: "team-pass"},
+		"https://registry.lab:5000":        {Token: "lab-token"},
+		"https://registry.hub.docker.com/": {Username: "hubuser", Password: "hub#pass"},
+	}
+	for registry, expect := range tests {
+		req := &share.ScanImageRequest{Registry: registry, Username: "all", Password: "all-pass"}
+		applyCredsFile(req, creds)
+		if req.Username != expect.Username || req.Password != expect.Password || req.Token != expect.Token {
+			t.Errorf("Incorrect credentials of %s: %+v", registry, req)
+		}
+	}
+
+	// the registries not in the file keep the credentials of the options
+	for _, registry := range []string{"https://internal.corp", "https://registry.lab:5001", ""} {
+		req := &share.ScanImageRequest{Registry: registry, Username: "all", Password: "all-pass"}
+		applyCredsFile(req, creds)
+		if req.Username != "all" || req.Password != "all-pass" {
+			t.Errorf("Credentials of %s are replaced: %+v", registry, req)
+		}
+	}
+
+	// the docker hub aliases take the longest pattern, at every run
+	creds = credsFile{"docker.io": {Username: "short"}, "index.docker.io": {Username: "long"}}
+	for i := 0; i < 20; i++ {
+		if c := creds.credentials("https://registry.hub.docker.com"); c.Username != "long" {
+			t.Fatalf("Incorrect docker hub alias: %+v", c)
+		}
+	}
+
+	ioutil.WriteFile(file, []byte(`{"ghcr.io": {"token": "t1"}, "*.corp": {"username": "u", "password": "p"}}`), 0600)
+	if creds, err = loadCredsFile(file); err != nil || creds.credentials("https://ghcr.io").Token != "t1" {
+		t.Errorf("Failed to load the json file: %v", err)
+	}
+
+	for _, invalid := range []string{
+		"registry.corp:\n  user: x\n",
+		"registry.corp:\n  username: x\n  token: t\n",
+		"registry*.corp:\n  username: x\n",
+		"registry.corp:\n  password: x\n",
+		"  username: x\n",
+	} {
+		ioutil.WriteFile(file, []byte(invalid), 0600)
+		if _, err := loadCredsFile(file); err == nil {
+			t.Errorf("Expected an error of %q", invalid)
+		}
+	}
+}
@@ -20,30 +20,45 @@ const log4jModName = "org.apache.logging.log4j.log4j"
 // "org.apache.logging.log4j:log4j-to-slf4j"
 var log4jComponents = utils.NewSet("org.apache.logging.log4j:log4j-core")
 
-func (cv *CveTools) DetectAppVul(path string, apps []detectors.AppFeatureVersion, namespace string) []vulFullReport {
+// DetectAppVul matches the application modules against the database of the scans
+func (cv *CveTools) DetectAppVul(apps []detectors.AppFeatureVersion, namespace string) []vulFullReport {
 	if apps == nil || len(apps) == 0 {
 		return nil
 	}
-	modVuls, err := common.LoadAppVulsTb(path)
+	cv.UpdateMux.RLock()
+	defer cv.UpdateMux.RUnlock()
+	h := cv.scanDB()
+	return detectAppVul(h, apps, namespace)
+}
+
+func detectAppVul(h *DBHandle, apps []detectors.AppFeatureVersion, namespace string) []vulFullReport {
+	if apps == nil || len(apps) == 0 {
+		return nil
+	}
+	modVuls, err := h.appVuls()
 	if err != nil {
 		return nil
 	}
-	vuls := make([]vulFullReport, 0)
-	for i, app := range apps {
+	// the modules are matched in parallel, each writes its own entry of apps
+	results := make([][]vulFullReport, len(apps))
+	parallelMatch(len(apps), func(i int) {
+		app := apps[i]
 		//If the entry exists, find vulnerabilities.
 		if mv, found := modVuls[app.ModuleName]; found {
-			results := checkForVulns(app, i, apps, mv)
-			vuls = append(vuls, results...)
+			results[i] = checkForVulns(app, i, apps, mv)
 		} else if strings.Contains(app.ModuleName, "log4j") {
 			//If the entry doesn't match and module contains log4j, check the exception list for component.
 			if log4jComponents.Contains(app.ModuleName) {
 				//If we find the entry on the exception list check the general log4j entry as well.
 				if mv, found := modVuls[log4jModName]; found {
-					results := checkForVulns(app, i, apps, mv)
-					vuls = append(vuls, results...)
+					results[i] = checkForVulns(app, i, apps, mv)
 				}
 			}
 		}
+	})
+	vuls := make([]vulFullReport, 0)
+	for _, r := range results {
+		vuls = append(vuls, r...)
 	}
 	return vuls
 }
@@ -89,6 +104,7 @@ func appVul2FullVul(app detectors.AppFeatureVersion, mv common.AppModuleVul) vul
 	fv.Vf.Description = mv.Description
 	fv.Vf.Link = mv.Link
 	fv.Vf.Severity = mv.Severity
+	fv.Vf.Aliases = mv.Aliases
 	fv.Vf.FixedIn = make([]common.FeaFull, 0)
 	fv.Vf.FixedIn = append(fv.Vf.FixedIn, moduleVer2FixVer(app, mv))
 	fv.Vf.CVSSv2.Score = mv.Score
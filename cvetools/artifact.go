@@ -0,0 +1,280 @@
+package cvetools
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	goDigest "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/scan/registry"
+)
+
+// the media types of the image configs, a manifest with another config is an artifact
+var imageConfigTypes = map[string]bool{
+	"": true,
+	"application/vnd.oci.image.config.v1+json":       true,
+	"application/vnd.docker.container.image.v1+json": true,
+}
+
+// the manifests an artifact subject can be scanned as an image
+var imageManifestTypes = map[string]bool{
+	"application/vnd.docker.distribution.manifest.v2+json": true,
+	registry.MediaTypeOCIManifest:                          true,
+	mediaTypeManifestList:                                  true,
+	registry.MediaTypeOCIIndex:                             true,
+}
+
+const (
+	mediaTypeHelmConfig = "application/vnd.cncf.helm.config.v1+json"
+	mediaTypeHelmChart  = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+	// the largest helm chart read for the image references
+	maxChartSize = 16 * 1024 * 1024
+)
+
+// ArtifactInfo is the OCI artifact found instead of a container image, like a helm chart or a wasm module
+type ArtifactInfo struct {
+	MediaType    string   `json:"MediaType"`
+	ArtifactType string   `json:"ArtifactType"`      // the artifact type, or the config media type of the older artifacts
+	Subject      string   `json:"Subject,omitempty"` // digest of the image the artifact refers to, the one scanned
+	Images       []string `json:"Images,omitempty"`  // the images referenced by the content, like the ones of a helm chart
+}
+
+// String describes the artifact for the scan error
+func (a *ArtifactInfo) String() string {
+	s := fmt.Sprintf("OCI artifact of type %s, not a container image", a.ArtifactType)
+	if len(a.Images) > 0 {
+		s += fmt.Sprintf(", it references the images: %s", strings.Join(a.Images, ", "))
+	}
+	return s
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type artifactManifest struct {
+	MediaType    string       `json:"mediaType"`
+	ArtifactType string       `json:"artifactType"`
+	Config       descriptor   `json:"config"`
+	Layers       []descriptor `json:"layers"`
+	Subject      *descriptor  `json:"subject"`
+}
+
+// parseArtifact returns the artifact of the manifest, nil if the manifest is of a container image
+// or a manifest list
+func parseArtifact(body []byte) (*artifactManifest, *ArtifactInfo) {
+	var m artifactManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, nil
+	}
+	if m.MediaType == mediaTypeManifestList || m.MediaType == registry.MediaTypeOCIIndex {
+		return nil, nil
+	}
+	if m.ArtifactType == "" && imageConfigTypes[m.Config.MediaType] {
+		return nil, nil
+	}
+
+	a := &ArtifactInfo{MediaType: m.MediaType, ArtifactType: m.ArtifactType}
+	if a.ArtifactType == "" {
+		a.ArtifactType = m.Config.MediaType
+	}
+	if m.Subject != nil && imageManifestTypes[m.Subject.MediaType] {
+		a.Subject = m.Subject.Digest
+	}
+	return &m, a
+}
+
+// getArtifact reads the manifest of the tag, accepting the OCI manifests, and returns the artifact if it is not a
+// container image. It is only called when the image info can't be read, otherwise the manifest is reused.
+func getArtifact(ctx context.Context, rc *scan.RegClient, repo, tag string) *ArtifactInfo {
+	_, body, err := rc.ManifestRequest(ctx, repo, tag, 2, registry.ManifestRequest_CosignSignature)
+	if err != nil {
+		// the error is reported when the image info is read
+		return nil
+	}
+	return readArtifact(ctx, rc, repo, tag, body)
+}
+
+// readArtifact returns the artifact of the manifest if it is not a container image. The images referenced by a
+// helm chart are listed, the subject of an artifact is the image to scan.
+func readArtifact(ctx context.Context, rc *scan.RegClient, repo, tag string, body []byte) *ArtifactInfo {
+	m, a := parseArtifact(body)
+	if a == nil {
+		return nil
+	}
+
+	if a.ArtifactType == mediaTypeHelmConfig {
+		for _, l := range m.Layers {
+			if l.MediaType != mediaTypeHelmChart {
+				continue
+			}
+			if l.Size > maxChartSize {
+				log.WithFields(log.Fields{"size": l.Size, "chart": l.Digest}).Info("Helm chart is too large to read")
+				continue
+			}
+			images, err := readChartImages(ctx, rc, repo, l.Digest)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "chart": l.Digest}).Error("Failed to read the helm chart")
+				continue
+			}
+			a.Images = append(a.Images, images...)
+		}
+	}
+	log.WithFields(log.Fields{"repo": repo, "tag": tag, "type": a.ArtifactType, "subject": a.Subject, "images": a.Images}).Info("OCI artifact")
+	return a
+}
+
+func readChartImages(ctx context.Context, rc *scan.RegClient, repo, digest string) ([]string, error) {
+	dg, err := goDigest.Parse(digest)
+	if err != nil {
+		return nil, err
+	}
+	rd, _, err := rc.DownloadLayer(ctx, repo, dg)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return chartImages(io.LimitReader(rd, maxChartSize))
+}
+
+// chartImages returns the images of the values.yaml files of a chart archive, and of its subcharts. An image
+// without a tag takes the app version of the chart.
+func chartImages(r io.Reader) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	values := make(map[string][]byte)   // chart folder -> values.yaml
+	versions := make(map[string]string) // chart folder -> appVersion
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		dir, file := path.Split(hdr.Name)
+		if file != "values.yaml" && file != "Chart.yaml" {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if file == "values.yaml" {
+			values[dir] = data
+		} else {
+			versions[dir] = yamlValue(data, "appVersion")
+		}
+	}
+
+	images := make([]string, 0)
+	seen := make(map[string]bool)
+	for dir, data := range values {
+		for _, image := range valuesImages(data, versions[dir]) {
+			if !seen[image] {
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+	return images, nil
+}
+
+// yamlValue returns the value of the top-level key
+func yamlValue(data []byte, key string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if k, v, ok := yamlKeyValue(scanner.Text()); ok && k == key && !strings.HasPrefix(scanner.Text(), " ") {
+			return v
+		}
+	}
+	return ""
+}
+
+// yamlKeyValue splits a "key: value" line, the value is unquoted and without the comment
+func yamlKeyValue(line string) (string, string, bool) {
+	line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "- "))
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	i := strings.Index(line, ":")
+	if i == -1 {
+		return "", "", false
+	}
+	key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+	if j := strings.Index(value, " #"); j != -1 {
+		value = strings.TrimSpace(value[:j])
+	}
+	return key, strings.Trim(value, `"'`), true
+}
+
+// valuesImages finds the images in the values of a chart, either "image: repo:tag" or an image block of
+// registry, repository and tag. The templated values can't be resolved and are skipped.
+func valuesImages(data []byte, appVersion string) []string {
+	images := make([]string, 0)
+	var block map[string]string
+	blockIndent := -1
+	flush := func() {
+		if block != nil && block["repository"] != "" {
+			image := block["repository"]
+			if block["registry"] != "" {
+				image = block["registry"] + "/" + image
+			}
+			if block["digest"] != "" {
+				image += "@" + block["digest"]
+			} else if block["tag"] != "" {
+				image += ":" + block["tag"]
+			} else if appVersion != "" {
+				image += ":" + appVersion
+			}
+			if !strings.Contains(image, "{{") {
+				images = append(images, image)
+			}
+		}
+		block, blockIndent = nil, -1
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, value, ok := yamlKeyValue(line)
+		if !ok {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if block != nil && indent <= blockIndent {
+			flush()
+		}
+		if block != nil {
+			block[key] = value
+			continue
+		}
+		if key == "image" {
+			if value == "" {
+				block, blockIndent = make(map[string]string), indent
+			} else if !strings.ContainsAny(value, "{ ") {
+				images = append(images, value)
+			}
+		}
+	}
+	flush()
+	return images
+}
@@ -0,0 +1,75 @@
+package cvetools
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOCIArtifact(t *testing.T) {
+	image := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:aa", "size": 10}}`
+	if _, a := parseArtifact([]byte(image)); a != nil {
+		t.Errorf("Image detected as an artifact: %+v", a)
+	}
+	index := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": []}`
+	if _, a := parseArtifact([]byte(index)); a != nil {
+		t.Errorf("Index detected as an artifact: %+v", a)
+	}
+
+	wasm := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.wasm.config.v1+json", "digest": "sha256:bb", "size": 10},
+		"layers": [{"mediaType": "application/vnd.wasm.content.layer.v1+wasm", "digest": "sha256:cc", "size": 100}]}`
+	if _, a := parseArtifact([]byte(wasm)); a == nil || a.ArtifactType != "application/vnd.wasm.config.v1+json" || a.Subject != "" {
+		t.Errorf("Incorrect wasm artifact: %+v", a)
+	} else if !strings.Contains(a.String(), "not a container image") {
+		t.Errorf("Incorrect artifact description: %s", a)
+	}
+
+	sbom := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "artifactType": "application/spdx+json",
+		"config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": "sha256:dd", "size": 2},
+		"subject": {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:ee", "size": 500}}`
+	if _, a := parseArtifact([]byte(sbom)); a == nil || a.ArtifactType != "application/spdx+json" || a.Subject != "sha256:ee" {
+		t.Errorf("Incorrect artifact subject: %+v", a)
+	}
+
+	// a helm chart with a subchart
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{
+		"web/Chart.yaml": "apiVersion: v2\nname: web\nappVersion: \"1.25.3\"\n",
+		"web/values.yaml": `replicaCount: 1
+image:
+  registry: docker.io
+  repository: bitnami/nginx
+  pullPolicy: IfNotPresent # tag is the app version
+sidecar:
+  image: "quay.io/prometheus/nginx-exporter:0.11.0"
+init:
+  image: "{{ .Values.global.registry }}/busybox:1.36"
+`,
+		"web/charts/db/Chart.yaml":  "name: db\nappVersion: 16.1\n",
+		"web/charts/db/values.yaml": "image:\n  repository: postgres\n  tag: \"16.1\"\nservice:\n  port: 5432\n",
+		"web/templates/deploy.yaml": "image: {{ .Values.image.repository }}\n",
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+
+	images, err := chartImages(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read the chart: %v", err)
+	}
+	sort.Strings(images)
+	expect := []string{"docker.io/bitnami/nginx:1.25.3", "postgres:16.1", "quay.io/prometheus/nginx-exporter:0.11.0"}
+	if !reflect.DeepEqual(images, expect) {
+		t.Errorf("Incorrect chart images: %+v", images)
+	}
+}
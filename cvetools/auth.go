@@ -0,0 +1,286 @@
+package cvetools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const tokenRequestTimeout = 20 * time.Second
+
+// IdentityTokenUsername is the username of the identity token, a refresh token of the token server,
+// given as the password, like the docker config.json does
+const IdentityTokenUsername = "<token>"
+
+// authChallenge is a challenge of the WWW-Authenticate header, the scheme and the parameter names in lower case
+type authChallenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenges parses the WWW-Authenticate headers, a header can have more than one challenge,
+// like: Basic realm="registry", Bearer realm="https://auth.example.com/token",service="registry"
+func parseChallenges(headers []string) []*authChallenge {
+	var list []*authChallenge
+	for _, h := range headers {
+		var cur *authChallenge
+		s := h
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			tok, rest := readToken(s)
+			if tok == "" {
+				break // malformed
+			}
+			if after := strings.TrimLeft(rest, " \t"); strings.HasPrefix(after, "=") && cur != nil {
+				var value string
+				value, s = readValue(strings.TrimLeft(after[1:], " \t"))
+				cur.params[strings.ToLower(tok)] = value
+			} else if strings.HasPrefix(after, "=") {
+				// a parameter without a scheme
+				_, s = readValue(strings.TrimLeft(after[1:], " \t"))
+			} else {
+				cur = &authChallenge{scheme: strings.ToLower(tok), params: make(map[string]string)}
+				list = append(list, cur)
+				s = rest
+			}
+		}
+	}
+	return list
+}
+
+func readToken(s string) (string, string) {
+	i := strings.IndexAny(s, " \t,=\"")
+	if i == -1 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// readValue reads a token or a quoted string
+func readValue(s string) (string, string) {
+	if !strings.HasPrefix(s, "\"") {
+		i := strings.IndexAny(s, " \t,")
+		if i == -1 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), ""
+}
+
+// pathScope derives the pull scope from the path of a registry API request, /v2/<name>/(manifests|blobs|tags)/...
+func pathScope(path string) string {
+	i := strings.Index(path, "/v2/")
+	if i == -1 {
+		return ""
+	}
+	path = path[i+4:]
+	for _, api := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if j := strings.LastIndex(path, api); j > 0 {
+			return fmt.Sprintf("repository:%s:pull", path[:j])
+		}
+	}
+	return ""
+}
+
+// challengeTransport authenticates as the registry asks in the WWW-Authenticate header of a 401 response:
+// a bearer token from the realm, which can be any endpoint, for the service and scope, or the basic auth.
+// The other schemes are left to the token transport of the registry package.
+type challengeTransport struct {
+	transport http.RoundTripper
+	fallback  http.RoundTripper
+	username  string
+	password  string
+
+	mutex  sync.Mutex
+	tokens map[string]string // bearer tokens by the scope of the request path
+}
+
+func newChallengeTransport(transport, fallback http.RoundTripper, username, password string) *challengeTransport {
+	return &challengeTransport{
+		transport: transport,
+		fallback:  fallback,
+		username:  username,
+		password:  password,
+		tokens:    make(map[string]string),
+	}
+}
+
+func (t *challengeTransport) cachedToken(scope string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.tokens[scope]
+}
+
+func (t *challengeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scope := pathScope(req.URL.Path)
+	sent := req
+	if token := t.cachedToken(scope); token != "" {
+		sent = cloneRequest(req)
+		sent.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := t.transport.RoundTrip(sent)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenges := parseChallenges(resp.Header.Values("WWW-Authenticate"))
+	if len(challenges) == 0 || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	// the bearer token is preferred when the registry offers both
+	sort.SliceStable(challenges, func(i, j int) bool {
+		return challenges[i].scheme == "bearer" && challenges[j].scheme != "bearer"
+	})
+	for _, c := range challenges {
+		switch c.scheme {
+		case "bearer":
+			token, err := t.fetchToken(req, c, scope)
+			if err != nil {
+				log.WithFields(log.Fields{"realm": c.params["realm"], "error": err}).Error("Failed to get the bearer token")
+				continue
+			}
+			t.mutex.Lock()
+			t.tokens[scope] = token
+			t.mutex.Unlock()
+
+			r := cloneRequest(req)
+			r.Header.Set("Authorization", "Bearer "+token)
+			return t.transport.RoundTrip(r)
+		case "basic":
+			if (t.username == "" && t.password == "") || t.username == IdentityTokenUsername {
+				continue
+			}
+			r := cloneRequest(req)
+			r.SetBasicAuth(t.username, t.password)
+			return t.transport.RoundTrip(r)
+		}
+	}
+
+	return t.fallback.RoundTrip(cloneRequest(req))
+}
+
+// fetchToken gets the token from the realm of the challenge, which is resolved against the request URL.
+// Without the scope in the challenge, it is derived from the request path.
+func (t *challengeTransport) fetchToken(req *http.Request, c *authChallenge, scope string) (string, error) {
+	realm, err := req.URL.Parse(c.params["realm"])
+	if err != nil || c.params["realm"] == "" {
+		return "", fmt.Errorf("Invalid realm: %s", c.params["realm"])
+	}
+	if s, ok := c.params["scope"]; ok {
+		scope = s
+	}
+
+	q := realm.Query()
+	if service := c.params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	realm.RawQuery = q.Encode()
+
+	client := &http.Client{Transport: t.transport, Timeout: tokenRequestTimeout}
+	if t.username == IdentityTokenUsername {
+		// the OAuth2 refresh token grant
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", "neuvector-scanner")
+		form.Set("refresh_token", t.password)
+		form.Set("service", c.params["service"])
+		form.Set("scope", scope)
+		realm.RawQuery = ""
+		treq, _ := http.NewRequestWithContext(req.Context(), http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+		treq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		token, _, err := requestToken(client, treq)
+		return token, err
+	}
+
+	treq, _ := http.NewRequestWithContext(req.Context(), http.MethodGet, realm.String(), nil)
+	if t.username != "" || t.password != "" {
+		treq.SetBasicAuth(t.username, t.password)
+	}
+	token, status, err := requestToken(client, treq)
+	if err == nil || (t.username == "" && t.password == "") || (status != http.StatusMethodNotAllowed && status != http.StatusNotFound) {
+		return token, err
+	}
+
+	// the OAuth2 password grant, for the token servers without the GET
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("client_id", "neuvector-scanner")
+	form.Set("username", t.username)
+	form.Set("password", t.password)
+	form.Set("service", c.params["service"])
+	form.Set("scope", scope)
+	realm.RawQuery = ""
+	treq, _ = http.NewRequestWithContext(req.Context(), http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+	treq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	token, _, err = requestToken(client, treq)
+	return token, err
+}
+
+func requestToken(client *http.Client, req *http.Request) (string, int, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode, fmt.Errorf("Token request status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", resp.StatusCode, err
+	}
+	if body.Token != "" {
+		return body.Token, resp.StatusCode, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, resp.StatusCode, nil
+	}
+	return "", resp.StatusCode, fmt.Errorf("No token in the response")
+}
+
+// cloneRequest copies the request to be sent again, with a new body
+func cloneRequest(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		r.Body, _ = req.GetBody()
+	}
+	return r
+}
@@ -0,0 +1,107 @@
+package cvetools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	list := parseChallenges([]string{
+		`Basic realm="registry, with comma", Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/app:pull"`,
+		`jwt realm="api"`,
+	})
+	if len(list) != 3 {
+		t.Fatalf("Incorrect challenges: %+v", list)
+	}
+	if list[0].scheme != "basic" || list[0].params["realm"] != "registry, with comma" {
+		t.Errorf("Incorrect basic challenge: %+v", list[0])
+	}
+	if c := list[1]; c.scheme != "bearer" || c.params["realm"] != "https://auth.example.com/token" ||
+		c.params["service"] != "registry.example.com" || c.params["scope"] != "repository:team/app:pull" {
+		t.Errorf("Incorrect bearer challenge: %+v", c)
+	}
+	if list[2].scheme != "jwt" || list[2].params["realm"] != "api" {
+		t.Errorf("Incorrect jwt challenge: %+v", list[2])
+	}
+
+	if s := pathScope("/registry/v2/team/app/manifests/1.0"); s != "repository:team/app:pull" {
+		t.Errorf("Incorrect scope: %s", s)
+	}
+}
+
+func TestBearerChallenge(t *testing.T) {
+	var tokenRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth/token":
+			// a token server of the OAuth2 password grant only
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			tokenRequests++
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "password" || r.Form.Get("username") != "user" ||
+				r.Form.Get("service") != "reg" || r.Form.Get("scope") != "repository:team/app:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token": "tok"}`))
+		case "/v2/team/app/tags/list":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.Header().Add("WWW-Authenticate", `Basic realm="reg", Bearer realm="/auth/token",service="reg"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"tags": ["1.0"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	rc := newRegClient(srv.URL, "", "user", "pass", "")
+	for i := 0; i < 2; i++ {
+		if tags, _ := rc.Tags("team/app"); len(tags) != 1 {
+			t.Fatalf("Request failed: %v", tags)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("Token is not reused: %d requests", tokenRequests)
+	}
+}
+
+func TestIdentityTokenGrant(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth2/token":
+			r.ParseForm()
+			if r.Method != http.MethodPost || r.Form.Get("grant_type") != "refresh_token" ||
+				r.Form.Get("refresh_token") != "refresh-1" || r.Form.Get("scope") != "repository:team/app:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token": "tok"}`))
+		case "/v2/team/app/tags/list":
+			if _, password, ok := r.BasicAuth(); ok && password == "refresh-1" {
+				t.Errorf("The identity token is sent to the registry")
+			}
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="/oauth2/token",service="reg"`)
+				w.Header().Add("WWW-Authenticate", `Basic realm="reg"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"tags": ["1.0"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	rc := newRegClient(srv.URL, "", IdentityTokenUsername, "refresh-1", "")
+	if tags, err := rc.Tags("team/app"); len(tags) != 1 {
+		t.Errorf("Request failed: %v %v", tags, err)
+	}
+}
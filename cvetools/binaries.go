@@ -0,0 +1,190 @@
+package cvetools
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/scanner/detectors"
+)
+
+// the largest file read to look for a version string
+const maxBinarySize = 128 * 1024 * 1024
+
+// binaryDetector finds the version of a well-known software in its binaries, for the copies installed
+// without a package manager, like a tarball extracted to /usr/local or a binary copied into a scratch image
+type binaryDetector struct {
+	module   string                                // the module name of the application vulnerabilities
+	packages []string                              // prefixes of the OS packages that install it
+	match    func(name string) bool                // the file names to inspect
+	version  func(name string, data []byte) string // the version found in the file, empty if none
+}
+
+var (
+	opensslVersion = regexp.MustCompile(`OpenSSL (\d+\.\d+\.\d+[a-z]?)[ \x00-]`)
+	nginxVersion   = regexp.MustCompile(`nginx/(\d+\.\d+\.\d+)\x00`)
+	pythonName     = regexp.MustCompile(`^(?:lib)?python(\d\.\d+)(?:m|\.so.*)?$`)
+)
+
+var binaryDetectors = []*binaryDetector{
+	&binaryDetector{
+		module:   "openssl",
+		packages: []string{"openssl", "libssl"},
+		match: func(name string) bool {
+			return name == "openssl" || strings.HasPrefix(name, "libssl.so") || strings.HasPrefix(name, "libcrypto.so")
+		},
+		version: func(name string, data []byte) string {
+			if m := opensslVersion.FindSubmatch(data); m != nil {
+				return string(m[1])
+			}
+			return ""
+		},
+	},
+	&binaryDetector{
+		module:   "nginx",
+		packages: []string{"nginx"},
+		match:    func(name string) bool { return name == "nginx" },
+		version: func(name string, data []byte) string {
+			if m := nginxVersion.FindSubmatch(data); m != nil {
+				return string(m[1])
+			}
+			return ""
+		},
+	},
+	&binaryDetector{
+		module:   "python",
+		packages: []string{"python", "libpython"},
+		match:    func(name string) bool { return pythonName.MatchString(name) },
+		version: func(name string, data []byte) string {
+			// PY_VERSION is a string of its own, like "3.9.7", of the minor version in the file name
+			minor := pythonName.FindStringSubmatch(name)[1]
+			re := regexp.MustCompile(`\x00(` + regexp.QuoteMeta(minor) + `\.\d+)\x00`)
+			if m := re.FindSubmatch(data); m != nil {
+				return string(m[1])
+			}
+			return ""
+		},
+	},
+}
+
+// the folders of the OS packages, a binary elsewhere is not installed by the package manager
+var systemBinaryDirs = []string{"/bin/", "/sbin/", "/lib/", "/lib64/", "/usr/bin/", "/usr/sbin/", "/usr/lib/", "/usr/lib64/"}
+
+// detectedBinary is a binary of a well-known software found in the image
+type detectedBinary struct {
+	detector *binaryDetector
+	path     string
+	version  string
+}
+
+// detectBinaries looks for the well-known binaries in the files of the image, by the file name and the
+// version string built into the file. A software found in several files, like libssl and libcrypto, is
+// reported once for each version.
+func detectBinaries(fileMap map[string]string) []*detectedBinary {
+	paths := make([]string, 0)
+	for path := range fileMap {
+		name := filepath.Base(path)
+		for _, d := range binaryDetectors {
+			if d.match(name) {
+				paths = append(paths, path)
+				break
+			}
+		}
+	}
+	// the copies out of the system folders first, so they are the ones kept for a version
+	sort.Slice(paths, func(i, j int) bool {
+		if si, sj := inSystemDir(paths[i]), inSystemDir(paths[j]); si != sj {
+			return sj
+		}
+		return paths[i] < paths[j]
+	})
+
+	found := make(map[string]bool)
+	bins := make([]*detectedBinary, 0)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		data, release, err := readBinary(fileMap[path])
+		if err != nil || data == nil {
+			continue
+		}
+		for _, d := range binaryDetectors {
+			if !d.match(name) {
+				continue
+			}
+			if ver := d.version(name, data); ver != "" {
+				if key := d.module + ":" + ver; !found[key] {
+					found[key] = true
+					bins = append(bins, &detectedBinary{detector: d, path: path, version: ver})
+				}
+			}
+			break
+		}
+		release()
+	}
+	if len(bins) > 0 {
+		log.WithFields(log.Fields{"binaries": len(bins)}).Debug("Detected binaries")
+	}
+	return bins
+}
+
+// readBinary maps the regular file, not too large, until it is released: the pages are read from the file as
+// the version is looked for and dropped under memory pressure, the file is not copied to the heap. It returns
+// nil for an empty file or a symlink, which can point outside the layer.
+func readBinary(fullpath string) ([]byte, func(), error) {
+	info, err := os.Lstat(fullpath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 || info.Size() > maxBinarySize {
+		return nil, nil, err
+	}
+	f, err := os.Open(fullpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { syscall.Munmap(data) }, nil
+}
+
+// bypassedBinaries returns the binaries to match as the application packages. A binary in the system
+// folders is skipped if an OS package of the software is installed, its vulnerabilities are matched
+// by the package.
+func bypassedBinaries(bins []*detectedBinary, features []detectors.FeatureVersion) []detectors.AppFeatureVersion {
+	apps := make([]detectors.AppFeatureVersion, 0, len(bins))
+	for _, b := range bins {
+		if inSystemDir(b.path) && hasOSPackage(features, b.detector.packages) {
+			continue
+		}
+		pkg := scan.AppPackage{AppName: b.detector.module, ModuleName: b.detector.module, Version: b.version, FileName: strings.TrimPrefix(b.path, "/")}
+		apps = append(apps, detectors.AppFeatureVersion{AppPackage: pkg, ModuleVuls: make([]detectors.ModuleVul, 0)})
+		log.WithFields(log.Fields{"module": b.detector.module, "version": b.version, "path": b.path}).Info("Binary installed without the package manager")
+	}
+	return apps
+}
+
+func inSystemDir(path string) bool {
+	for _, dir := range systemBinaryDirs {
+		if strings.HasPrefix(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasOSPackage(features []detectors.FeatureVersion, prefixes []string) bool {
+	for _, ft := range features {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(ft.Package, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
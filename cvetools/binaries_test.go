@@ -0,0 +1,65 @@
+package cvetools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/neuvector/scanner/detectors"
+)
+
+func TestDetectBinaries(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"/usr/local/nginx/sbin/nginx":   "\x7fELF\x00nginx/1.21.0\x00",
+		"/usr/lib/libssl.so.1.1":        "\x7fELF\x00OpenSSL 1.1.1k  25 Mar 2021\x00",
+		"/opt/app/lib/libcrypto.so.1.1": "\x7fELF\x00OpenSSL 1.1.1k  25 Mar 2021\x00",
+		"/usr/bin/openssl":              "\x7fELF\x00OpenSSL 3.0.2 15 Mar 2022\x00",
+		"/usr/local/bin/python3.9":      "\x7fELF\x003.10.1\x003.9.7\x00",
+		"/usr/local/bin/nginx.conf":     "nginx/1.0.0\x00",
+	}
+	fileMap := make(map[string]string)
+	for path, data := range files {
+		full := filepath.Join(root, path)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		if err := ioutil.WriteFile(full, []byte(data), 0755); err != nil {
+			t.Fatal(err)
+		}
+		fileMap[path] = full
+	}
+	// a symlink can point out of the layer
+	os.Symlink("/usr/bin/openssl", filepath.Join(root, "openssl"))
+	fileMap["/usr/local/bin/openssl"] = filepath.Join(root, "openssl")
+
+	bins := detectBinaries(fileMap)
+	got := make(map[string]string)
+	for _, b := range bins {
+		got[b.detector.module+":"+b.version] = b.path
+	}
+	expect := map[string]string{
+		"nginx:1.21.0":   "/usr/local/nginx/sbin/nginx",
+		"openssl:1.1.1k": "/opt/app/lib/libcrypto.so.1.1",
+		"openssl:3.0.2":  "/usr/bin/openssl",
+		"python:3.9.7":   "/usr/local/bin/python3.9",
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Incorrect binaries: %+v", got)
+	}
+
+	// the openssl of the system folders is installed by the OS package
+	features := []detectors.FeatureVersion{detectors.FeatureVersion{Package: "openssl"}}
+	apps := bypassedBinaries(bins, features)
+	if len(apps) != 3 {
+		t.Fatalf("Incorrect bypassed binaries: %+v", apps)
+	}
+	for _, app := range apps {
+		if app.FileName == "usr/bin/openssl" {
+			t.Errorf("OS package binary reported: %+v", app)
+		}
+	}
+	if apps = bypassedBinaries(bins, nil); len(apps) != 4 {
+		t.Errorf("Incorrect binaries without OS packages: %+v", apps)
+	}
+}
@@ -0,0 +1,481 @@
+package cvetools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+// ImageCheck is a best practice the image build doesn't follow, found in the history of the image
+type ImageCheck struct {
+	ID          string `json:"ID"`
+	Severity    string `json:"Severity"`
+	Description string `json:"Description"`
+	Line        string `json:"Line,omitempty"` // the history line, the secret values are masked
+}
+
+// the IDs of the checks, the ones listed in the ignore file are removed from the result
+const (
+	CheckRootUser        = "root-user"
+	CheckAddRemoteURL    = "add-remote-url"
+	CheckSecretBuildArg  = "secret-build-arg"
+	CheckAptNoCleanup    = "apt-no-cleanup"
+	CheckLatestBaseImage = "latest-base-image"
+	CheckCurlPipeShell   = "curl-pipe-shell"
+	CheckPrivilegedPort  = "privileged-port"
+	CheckSSHPort         = "ssh-port"
+	CheckStaleImage      = "stale-image"
+
+	// the checks of the image reference, with Misconfig
+	CheckMutableTag        = "mutable-tag"
+	CheckUnpinnedBaseImage = "unpinned-base-image"
+	CheckNoInitProcess     = "no-init-process"
+)
+
+var checkDescriptions = map[string]string{
+	CheckRootUser:        "The image runs as root, no USER of another user is set",
+	CheckAddRemoteURL:    "ADD downloads a remote URL, use curl or wget in RUN and verify the download",
+	CheckSecretBuildArg:  "A secret is passed as a build argument, it is visible in the image history",
+	CheckAptNoCleanup:    "apt-get install without removing /var/lib/apt/lists in the same RUN inflates the layer",
+	CheckLatestBaseImage: "The base image is the latest tag, the build is not reproducible",
+	CheckCurlPipeShell:   "A downloaded script is piped to a shell, without verifying it",
+	CheckPrivilegedPort:  "A port below 1024 is exposed while the image runs as a non-root user, it can't bind to it",
+	CheckSSHPort:         "The SSH port is exposed, use kubectl exec or docker exec instead of a SSH server",
+	CheckStaleImage:      "The image was built long ago, its packages may predate the advisories the database can match",
+
+	CheckMutableTag:        "The image is referenced by the latest tag, it can point to another image at any time, pin the digest",
+	CheckUnpinnedBaseImage: "The base image is not pinned by its digest, a rebuild can take another base image",
+	CheckNoInitProcess:     "The entrypoint runs as PID 1 without an init like tini or dumb-init, the zombie processes are not reaped",
+}
+
+var (
+	addRemoteURL   = regexp.MustCompile(`^ADD\s+(?:--\S+\s+)*https?://`)
+	secretBuildArg = regexp.MustCompile(`(?i)^ARG\s+(\w*(?:password|passwd|secret|token|api_?key|access_?key|private_?key|credential)\w*)=(\S+)`)
+	// the build arguments of a RUN, in the history as "|2 A=x B=y /bin/sh -c ..."
+	runBuildArgs  = regexp.MustCompile(`^\|\d+\s+(.*?)\s*/bin/sh -c `)
+	secretArgName = regexp.MustCompile(`(?i)password|passwd|secret|token|api_?key|access_?key|private_?key|credential`)
+	aptInstall    = regexp.MustCompile(`\bapt(?:-get)?\s+(?:-\S+\s+)*install\b`)
+	curlPipeShell = regexp.MustCompile(`\b(?:curl|wget)\b[^|;&]*\|\s*(?:sudo\s+)?(?:ba|z|da)?sh\b`)
+	// a vulnerability ID, like CVE-2021-44228, GHSA-35jh-r3h4-6jhm, RUSTSEC-2021-0078 or RHSA-2022:1234
+	vulnerabilityID = regexp.MustCompile(`(?i)^(?:GHSA-[a-z0-9-]+|[a-z]+-\S*\d\S*)$`)
+)
+
+// the init processes reaping the zombie processes as PID 1, by the name of the executable
+var initProcesses = utils.NewSet("dumb-init", "catatonit", "docker-init", "init", "s6-svscan", "runsvdir", "my_init", "supervisord", "systemd")
+
+// the executables of the tini releases, like tini, tini-static or tini-static-amd64
+var tiniProcess = regexp.MustCompile(`^tini(?:-static)?(?:-(?:amd64|arm64|armel|armhf|i386|mips64el|ppc64el|ppc64le|s390x))?$`)
+
+// the shells of the shell form of the entrypoint, like /bin/sh -c "exec tini -- app"
+var shellProcesses = utils.NewSet("sh", "bash", "ash", "dash")
+
+// the labels and the manifest annotations of the base image name, and of its digest
+var (
+	baseImageKeys       = []string{"org.opencontainers.image.base.name"}
+	baseImageDigestKeys = []string{"org.opencontainers.image.base.digest"}
+)
+
+// imageChecks runs the checks on the history of the image, the latest history line first as in the image
+// info. The labels and the manifest annotations give the base image, the ports are exposed by the config.
+func imageChecks(cmds []string, labels map[string]string, rawManifest []byte, ports []string) []*ImageCheck {
+	checks := make([]*ImageCheck, 0)
+	add := func(id, line string) {
+		checks = append(checks, &ImageCheck{ID: id, Severity: checkSeverity(id), Description: checkDescriptions[id], Line: line})
+	}
+
+	normalized := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		normalized[i] = scan.NormalizeImageCmd(strings.TrimSpace(cmd))
+	}
+	runAsRoot, _, _ := scan.ParseImageCmds(normalized)
+	if runAsRoot {
+		add(CheckRootUser, finalUser(normalized))
+	}
+
+	for i := len(normalized) - 1; i >= 0; i-- {
+		cmd := normalized[i]
+		if line, ok := maskRunBuildArgs(strings.TrimSpace(cmds[i])); ok {
+			add(CheckSecretBuildArg, line)
+		}
+		switch {
+		case addRemoteURL.MatchString(cmd):
+			add(CheckAddRemoteURL, cmd)
+		case secretBuildArg.MatchString(cmd):
+			add(CheckSecretBuildArg, secretBuildArg.ReplaceAllString(cmd, "ARG $1=****"))
+		case strings.HasPrefix(cmd, "RUN "):
+			if aptInstall.MatchString(cmd) && !strings.Contains(cmd, "/var/lib/apt/lists") {
+				add(CheckAptNoCleanup, cmd)
+			}
+			if curlPipeShell.MatchString(cmd) {
+				add(CheckCurlPipeShell, cmd)
+			}
+		}
+	}
+
+	if base := baseImageName(labels, rawManifest); base != "" && isLatestTag(base) {
+		add(CheckLatestBaseImage, base)
+	}
+
+	for _, port := range ports {
+		num, err := strconv.Atoi(strings.SplitN(port, "/", 2)[0])
+		if err != nil {
+			continue
+		}
+		if num == 22 {
+			add(CheckSSHPort, "EXPOSE "+port)
+		} else if num < 1024 && !runAsRoot {
+			add(CheckPrivilegedPort, "EXPOSE "+port)
+		}
+	}
+	return checks
+}
+
+// referenceChecks checks the scanned reference is not the latest tag, and the base image, of -base_image or
+// of the labels and the manifest annotations, is pinned by its digest. The lines have the digests the
+// references resolve to, to pin them. An image scanned without a tag, like a local image, is not checked.
+func referenceChecks(registry, repo, tag, digest, base, baseDigest string, labels map[string]string, rawManifest []byte) []*ImageCheck {
+	checks := make([]*ImageCheck, 0)
+	add := func(id, line string) {
+		checks = append(checks, &ImageCheck{ID: id, Severity: checkSeverity(id), Description: checkDescriptions[id], Line: line})
+	}
+
+	if tag == "latest" {
+		ref := repo
+		if host := registryHost(registry); host != "" {
+			ref = host + "/" + repo
+		}
+		add(CheckMutableTag, pinnedLine(ref+":latest", digest))
+	}
+
+	if base == "" {
+		base = baseImageName(labels, rawManifest)
+		baseDigest = annotatedValue(baseImageDigestKeys, labels, rawManifest)
+	}
+	if base != "" && !strings.Contains(base, "@") {
+		add(CheckUnpinnedBaseImage, pinnedLine(base, baseDigest))
+	}
+	return checks
+}
+
+// pid1Process returns the process the containers of the image run as PID 1, of the entrypoint and the cmd
+// of the config, nil if the config has neither. The shell form is followed into the command the script
+// execs, a shell running the command as its child is PID 1 itself.
+func pid1Process(entrypoint, cmd []string) *PID1 {
+	args := append(append([]string{}, entrypoint...), cmd...)
+	if len(args) == 0 {
+		return nil
+	}
+	pid1 := &PID1{Command: strings.Join(args, " ")}
+	for len(args) > 0 {
+		name := path.Base(args[0])
+		switch {
+		case tiniProcess.MatchString(name):
+			pid1.Init = "tini"
+			return pid1
+		case initProcesses.Contains(name):
+			pid1.Init = name
+			return pid1
+		case shellProcesses.Contains(name) && len(args) > 2 && args[1] == "-c":
+			script := strings.Fields(args[2])
+			if len(script) < 2 || script[0] != "exec" {
+				return pid1
+			}
+			args = script[1:]
+		default:
+			return pid1
+		}
+	}
+	return pid1
+}
+
+// initCheck reports PID 1 is not an init, the misconfiguration is fixed by an init in the entrypoint or by
+// running the containers with docker run --init
+func initCheck(pid1 *PID1) []*ImageCheck {
+	if pid1 == nil || pid1.Init != "" {
+		return nil
+	}
+	return []*ImageCheck{{ID: CheckNoInitProcess, Severity: checkSeverity(CheckNoInitProcess), Description: checkDescriptions[CheckNoInitProcess], Line: pid1.Command}}
+}
+
+// pinnedLine returns the reference and the reference pinned by the digest, if the digest is known
+func pinnedLine(ref, digest string) string {
+	if digest == "" {
+		return ref
+	}
+	name := ref
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return fmt.Sprintf("%s, pin %s@%s", ref, name, digest)
+}
+
+// maskRunBuildArgs returns the history line of a RUN with the values of the secret build arguments masked,
+// false if it has none
+func maskRunBuildArgs(cmd string) (string, bool) {
+	m := runBuildArgs.FindStringSubmatchIndex(cmd)
+	if m == nil {
+		return "", false
+	}
+	args := strings.Fields(cmd[m[2]:m[3]])
+	var secret bool
+	for i, arg := range args {
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 && secretArgName.MatchString(kv[0]) {
+			args[i] = kv[0] + "=****"
+			secret = true
+		}
+	}
+	if !secret {
+		return "", false
+	}
+	return cmd[:m[2]] + strings.Join(args, " ") + cmd[m[3]:], true
+}
+
+// envSecretFile is the file of the environment variables in the secret logs, as the secret scan names it
+const envSecretFile = "$EnvVariables"
+
+// envSecretLogs returns the secret logs of the environment variables named like a secret, the values are
+// masked as the other secrets. A variable already found by the secret rules is not repeated.
+func envSecretLogs(envs []string, found []share.CLUSSecretLog) []share.CLUSSecretLog {
+	logs := make([]share.CLUSSecretLog, 0)
+	for _, env := range envs {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 || kv[1] == "" || !secretArgName.MatchString(kv[0]) || strings.HasPrefix(kv[1], "/") {
+			continue
+		}
+		var dup bool
+		for _, l := range found {
+			if l.File == envSecretFile && strings.Contains(l.Line, env) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			logs = append(logs, share.CLUSSecretLog{
+				Type:       share.SecretRegular,
+				Text:       kv[1],
+				Line:       env,
+				File:       envSecretFile,
+				RuleDesc:   fmt.Sprintf("Credential in the environment variable %s", kv[0]),
+				Suggestion: "Pass the secret at runtime, a secret in the image config is visible to anyone pulling the image",
+			})
+		}
+	}
+	return logs
+}
+
+func checkSeverity(id string) string {
+	switch id {
+	case CheckSecretBuildArg, CheckCurlPipeShell:
+		return share.VulnSeverityHigh
+	case CheckRootUser, CheckAddRemoteURL, CheckLatestBaseImage, CheckSSHPort, CheckStaleImage, CheckMutableTag, CheckUnpinnedBaseImage:
+		return share.VulnSeverityMedium
+	default:
+		return share.VulnSeverityLow
+	}
+}
+
+// IsStaleImage tells if the image was created before the maximum age, the images of an unknown age are never stale
+func IsStaleImage(report *ScanReport, maxAge time.Duration) bool {
+	if maxAge == 0 || report == nil || report.ImageCreated == "" {
+		return false
+	}
+	created, err := time.Parse(time.RFC3339, report.ImageCreated)
+	if err != nil {
+		return false
+	}
+	return time.Since(created) > maxAge
+}
+
+func staleImageCheck(created string, maxAge time.Duration) *ImageCheck {
+	return &ImageCheck{
+		ID:          CheckStaleImage,
+		Severity:    checkSeverity(CheckStaleImage),
+		Description: checkDescriptions[CheckStaleImage],
+		Line:        fmt.Sprintf("created %s, older than %s", created, maxAge),
+	}
+}
+
+// finalUser returns the USER line in effect, empty if the user is never set
+func finalUser(cmds []string) string {
+	for _, cmd := range cmds {
+		if strings.HasPrefix(cmd, "USER ") {
+			return cmd
+		}
+	}
+	return ""
+}
+
+func baseImageName(labels map[string]string, rawManifest []byte) string {
+	return annotatedValue(baseImageKeys, labels, rawManifest)
+}
+
+// annotatedValue returns the value of the first key in the labels, then in the manifest annotations
+func annotatedValue(keys []string, labels map[string]string, rawManifest []byte) string {
+	for _, key := range keys {
+		if value := labels[key]; value != "" {
+			return value
+		}
+	}
+	var m struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if len(rawManifest) > 0 && json.Unmarshal(rawManifest, &m) == nil {
+		for _, key := range keys {
+			if value := m.Annotations[key]; value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// isLatestTag returns true for the latest tag, or an image without a tag or a digest
+func isLatestTag(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	return i == -1 || name[i+1:] == "latest"
+}
+
+// LoadIgnoreFile reads the IDs to ignore, one per line, the text after # is a comment. The image checks of
+// the IDs are removed from the results, the other IDs are of the vulnerabilities, by any of their names, CVEs
+// or aliases, like a GHSA ID. The text after the ID is the reason it's ignored, returned by the ID.
+func LoadIgnoreFile(path string) ([]string, map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read the ignore file: %v", err)
+	}
+	ids := make([]string, 0)
+	reasons := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !isIgnoreID(fields[0]) {
+			log.WithFields(log.Fields{"id": fields[0]}).Warn("Unknown check or vulnerability ID in the ignore file")
+		}
+		ids = append(ids, fields[0])
+		if len(fields) > 1 {
+			reasons[fields[0]] = strings.Join(fields[1:], " ")
+		}
+	}
+	return ids, reasons, scanner.Err()
+}
+
+// isIgnoreID returns true if the ID of the ignore file is of an image check or looks like a vulnerability ID
+func isIgnoreID(id string) bool {
+	if _, ok := checkDescriptions[id]; ok {
+		return true
+	}
+	return vulnerabilityID.MatchString(id)
+}
+
+// SetIgnoredChecks sets the IDs of the image checks removed by PostProcess
+func (cv *CveTools) SetIgnoredChecks(ids []string) {
+	ignored := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		ignored[id] = true
+	}
+	cv.postMutex.Lock()
+	defer cv.postMutex.Unlock()
+	cv.ignoredChecks = ignored
+}
+
+// SetIgnored sets the IDs of the ignore file, the IDs of the image checks ignore the checks and the others
+// the vulnerabilities
+func (cv *CveTools) SetIgnored(ids []string) {
+	checks := make([]string, 0)
+	vuls := make(map[string]bool)
+	for _, id := range ids {
+		if _, ok := checkDescriptions[id]; ok {
+			checks = append(checks, id)
+		} else {
+			vuls[strings.ToUpper(id)] = true
+		}
+	}
+	cv.SetIgnoredChecks(checks)
+	cv.postMutex.Lock()
+	defer cv.postMutex.Unlock()
+	cv.ignoredVuls = vuls
+}
+
+// SetIgnoreReasons sets the reasons of the ignored vulnerabilities by their IDs, kept with the findings
+// removed by PostProcess
+func (cv *CveTools) SetIgnoreReasons(reasons map[string]string) {
+	upper := make(map[string]string, len(reasons))
+	for id, reason := range reasons {
+		upper[strings.ToUpper(id)] = reason
+	}
+	cv.postMutex.Lock()
+	defer cv.postMutex.Unlock()
+	cv.ignoreReasons = upper
+}
+
+func filterChecks(checks []*ImageCheck, ignored map[string]bool) []*ImageCheck {
+	kept := make([]*ImageCheck, 0, len(checks))
+	for _, c := range checks {
+		if !ignored[c.ID] {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// filterVuls removes the vulnerabilities ignored by their names, their CVEs or their aliases of the database,
+// of the image and of its layers. The ones of the image are kept in the ignored findings, with the reason of
+// the ID that matched.
+func filterVuls(report *ScanReport, ignored map[string]bool, reasons map[string]string) {
+	// the ID of the ignore file, upper case, empty if not ignored
+	ignoredBy := func(v *share.ScanVulnerability) string {
+		ids := append([]string{v.Name}, v.CVEs...)
+		for _, id := range append(ids, report.Aliases[v.DBKey]...) {
+			if id = strings.ToUpper(id); ignored[id] {
+				return id
+			}
+		}
+		return ""
+	}
+	filter := func(vuls []*share.ScanVulnerability, record bool) []*share.ScanVulnerability {
+		kept := make([]*share.ScanVulnerability, 0, len(vuls))
+		for _, v := range vuls {
+			if id := ignoredBy(v); id == "" {
+				kept = append(kept, v)
+			} else if record {
+				report.Ignored = append(report.Ignored, &IgnoredFinding{Vulnerability: v, ID: id, Reason: reasons[id]})
+			}
+		}
+		return kept
+	}
+
+	n := len(report.Vuls)
+	report.Vuls = filter(report.Vuls, true)
+	for _, l := range report.Layers {
+		l.Vuls = filter(l.Vuls, false)
+	}
+	if n > len(report.Vuls) {
+		log.WithFields(log.Fields{
+			"repo": report.Repository, "tag": report.Tag, "ignored": n - len(report.Vuls),
+		}).Info("Vulnerabilities ignored")
+	}
+}
@@ -0,0 +1,258 @@
+package cvetools
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/utils"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/detectors"
+)
+
+func TestImageChecks(t *testing.T) {
+	// the latest history line first
+	cmds := []string{
+		`/bin/sh -c #(nop)  CMD ["/app"]`,
+		`|1 NPM_TOKEN=abc123 /bin/sh -c npm install`,
+		`/bin/sh -c curl -fsSL https://get.example.com/install.sh | bash`,
+		`/bin/sh -c apt-get update && apt-get install -y curl`,
+		`/bin/sh -c apt-get update && apt-get install -y ca-certificates && rm -rf /var/lib/apt/lists/*`,
+		`/bin/sh -c #(nop)  ARG DB_PASSWORD=hunter2`,
+		`/bin/sh -c #(nop) ADD https://example.com/app.tar.gz /app`,
+		`/bin/sh -c #(nop) ADD file:0123456789abcdef in /`,
+	}
+	labels := map[string]string{"org.opencontainers.image.base.name": "docker.io/library/ubuntu"}
+
+	checks := imageChecks(cmds, labels, nil, nil)
+	found := make(map[string]string)
+	for _, c := range checks {
+		found[c.ID] += c.Line + "\n"
+	}
+	expect := map[string]string{
+		CheckRootUser:        "\n",
+		CheckAddRemoteURL:    "ADD https://example.com/app.tar.gz /app\n",
+		CheckSecretBuildArg:  "ARG DB_PASSWORD=****\n|1 NPM_TOKEN=**** /bin/sh -c npm install\n",
+		CheckAptNoCleanup:    "RUN apt-get update && apt-get install -y curl\n",
+		CheckCurlPipeShell:   "RUN curl -fsSL https://get.example.com/install.sh | bash\n",
+		CheckLatestBaseImage: "docker.io/library/ubuntu\n",
+	}
+	if !reflect.DeepEqual(found, expect) {
+		t.Errorf("Incorrect checks: %+v", found)
+	}
+
+	// a non-root user and a pinned base image of the manifest annotations
+	cmds = []string{`/bin/sh -c #(nop)  USER 1000`, `/bin/sh -c #(nop) ADD file:0123456789abcdef in /`}
+	manifest := []byte(`{"annotations":{"org.opencontainers.image.base.name":"docker.io/library/alpine:3.19"}}`)
+	if checks := imageChecks(cmds, nil, manifest, nil); len(checks) != 0 {
+		t.Errorf("Unexpected checks: %+v", checks[0])
+	}
+	cmds = []string{`/bin/sh -c #(nop)  USER root`}
+	if checks := imageChecks(cmds, nil, nil, nil); len(checks) != 1 || checks[0].Line != "USER root" {
+		t.Errorf("Incorrect root user check: %+v", checks)
+	}
+
+	// the ignored checks are removed by the post-processing
+	cv := &CveTools{}
+	cv.SetIgnoredChecks([]string{CheckRootUser, CheckAptNoCleanup})
+	report := &ScanReport{ScanResult: &share.ScanResult{}, Checks: imageChecks(cmds, labels, nil, nil)}
+	cv.PostProcess(report)
+	if len(report.Checks) != 1 || report.Checks[0].ID != CheckLatestBaseImage {
+		t.Errorf("Incorrect checks after the ignore file: %+v", report.Checks)
+	}
+
+	// the build arguments are only in the raw history of the config, the image info is normalized
+	var conf imageConfig
+	raw := `{"history":[{"created_by":"/bin/sh -c #(nop) ADD file:0123456789abcdef in /"},{"created_by":"|1 NPM_TOKEN=abc123 /bin/sh -c npm install"}]}`
+	if err := json.Unmarshal([]byte(raw), &conf); err != nil {
+		t.Fatalf("Failed to parse the config: %v", err)
+	}
+	history := conf.history()
+	if len(history) != 2 || !strings.HasPrefix(history[0], "|1 NPM_TOKEN") {
+		t.Fatalf("Incorrect history: %+v", history)
+	}
+	var secret bool
+	for _, c := range imageChecks(history, nil, nil, nil) {
+		secret = secret || c.ID == CheckSecretBuildArg && c.Line == "|1 NPM_TOKEN=**** /bin/sh -c npm install"
+	}
+	if !secret {
+		t.Errorf("No secret build argument in the raw history")
+	}
+	normalized := []string{scan.NormalizeImageCmd(history[0]), scan.NormalizeImageCmd(history[1])}
+	for _, c := range imageChecks(normalized, nil, nil, nil) {
+		if c.ID == CheckSecretBuildArg {
+			t.Errorf("Unexpected secret build argument in the normalized history: %+v", c)
+		}
+	}
+}
+
+func TestConfigFindings(t *testing.T) {
+	ports := []string{"22/tcp", "443/tcp", "8080/tcp"}
+	cmds := []string{`/bin/sh -c #(nop)  USER app`}
+	checks := imageChecks(cmds, nil, nil, ports)
+	if len(checks) != 2 || checks[0].ID != CheckSSHPort || checks[1].ID != CheckPrivilegedPort || checks[1].Line != "EXPOSE 443/tcp" {
+		t.Errorf("Incorrect port checks: %+v", checks)
+	}
+	// root can bind to the privileged ports
+	checks = imageChecks(nil, nil, nil, []string{"443/tcp"})
+	if len(checks) != 1 || checks[0].ID != CheckRootUser {
+		t.Errorf("Incorrect port checks of root: %+v", checks)
+	}
+
+	envs := []string{
+		"PATH=/usr/local/bin:/usr/bin",
+		"DB_PASSWORD=hunter2hunter2",
+		"PASSWORD_FILE=/run/secrets/db",
+		"API_TOKEN=",
+		"AWS_SECRET_ACCESS_KEY=wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY",
+	}
+	found := []share.CLUSSecretLog{{File: envSecretFile, Line: "AWS_SECRET_ACCESS_KEY=wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"}}
+	logs := envSecretLogs(envs, found)
+	if len(logs) != 1 || logs[0].Line != "DB_PASSWORD=hunter2hunter2" || logs[0].File != envSecretFile {
+		t.Fatalf("Incorrect env secrets: %+v", logs)
+	}
+	// masked as the other secrets
+	res := buildSecretResult(logs, nil)
+	if res.Logs[0].Text != "hunter2hunt..." {
+		t.Errorf("Secret not masked: %+v", res.Logs[0])
+	}
+}
+
+func TestStaleImage(t *testing.T) {
+	var conf imageConfig
+	if err := json.Unmarshal([]byte(`{"created": "1970-01-01T00:00:00Z"}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if created := conf.created(); created != "" {
+		t.Errorf("The epoch of a reproducible build is not an age: %s", created)
+	}
+
+	maxAge := 180 * 24 * time.Hour
+	old := &ScanReport{ImageCreated: time.Now().Add(-2 * maxAge).UTC().Format(time.RFC3339)}
+	recent := &ScanReport{ImageCreated: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)}
+	unknown := &ScanReport{ImageAgeUnknown: true}
+	if !IsStaleImage(old, maxAge) || IsStaleImage(recent, maxAge) || IsStaleImage(unknown, maxAge) || IsStaleImage(old, 0) {
+		t.Errorf("Incorrect stale images")
+	}
+	if c := staleImageCheck(old.ImageCreated, maxAge); c.ID != CheckStaleImage || c.Severity != share.VulnSeverityMedium {
+		t.Errorf("Incorrect stale image check: %+v", c)
+	}
+}
+
+func TestReferenceChecks(t *testing.T) {
+	lines := func(checks []*ImageCheck) map[string]string {
+		found := make(map[string]string)
+		for _, c := range checks {
+			found[c.ID] = c.Line
+		}
+		return found
+	}
+
+	// the latest tag, and the base image of -base_image with the digest it resolved to
+	checks := referenceChecks("https://registry.corp:5000/", "library/app", "latest", "sha256:0123", "registry.corp/base:3.19", "sha256:4567", nil, nil)
+	expect := map[string]string{
+		CheckMutableTag:        "registry.corp:5000/library/app:latest, pin registry.corp:5000/library/app@sha256:0123",
+		CheckUnpinnedBaseImage: "registry.corp/base:3.19, pin registry.corp/base@sha256:4567",
+	}
+	if found := lines(checks); !reflect.DeepEqual(found, expect) {
+		t.Errorf("Incorrect checks: %+v", found)
+	}
+
+	// the base image of the manifest annotations, with the digest annotation
+	manifest := []byte(`{"annotations":{"org.opencontainers.image.base.name":"registry.lab:5000/alpine:3.19","org.opencontainers.image.base.digest":"sha256:89ab"}}`)
+	checks = referenceChecks("", "app", "1.0", "sha256:0123", "", "", nil, manifest)
+	expect = map[string]string{CheckUnpinnedBaseImage: "registry.lab:5000/alpine:3.19, pin registry.lab:5000/alpine@sha256:89ab"}
+	if found := lines(checks); !reflect.DeepEqual(found, expect) {
+		t.Errorf("Incorrect checks of the annotations: %+v", found)
+	}
+
+	// pinned, or without a base image
+	labels := map[string]string{"org.opencontainers.image.base.name": "alpine@sha256:89ab"}
+	if checks = referenceChecks("", "app", "1.0", "sha256:0123", "", "", labels, nil); len(checks) != 0 {
+		t.Errorf("Unexpected checks: %+v", checks[0])
+	}
+	if checks = referenceChecks("", "app", "1.0", "", "", "", nil, nil); len(checks) != 0 {
+		t.Errorf("Unexpected checks: %+v", checks[0])
+	}
+	// a local image has no tag
+	if checks = referenceChecks("", "app", "", "sha256:0123", "", "", nil, nil); len(checks) != 0 {
+		t.Errorf("Unexpected checks of an image without a tag: %+v", checks[0])
+	}
+}
+
+func TestInitProcess(t *testing.T) {
+	cases := []struct {
+		entrypoint, cmd []string
+		init            string
+	}{
+		{[]string{"/sbin/tini", "--"}, []string{"node", "server.js"}, "tini"},
+		{[]string{"/usr/local/bin/tini-static-amd64", "--", "app"}, nil, "tini"},
+		{[]string{"/usr/local/bin/tini-wrapper.sh"}, nil, ""},
+		{[]string{"/app/tinifier", "serve"}, nil, ""},
+		{[]string{"dumb-init", "--"}, []string{"python", "app.py"}, "dumb-init"},
+		{[]string{"/init"}, nil, "init"},
+		{nil, []string{"/bin/sh", "-c", "exec dumb-init -- nginx -g 'daemon off;'"}, "dumb-init"},
+		// the shell is PID 1, or the application itself
+		{nil, []string{"/bin/sh", "-c", "tini -- app"}, ""},
+		{[]string{"docker-entrypoint.sh"}, []string{"postgres"}, ""},
+		{nil, []string{"/bin/sh", "-c", "exec app"}, ""},
+	}
+	for _, c := range cases {
+		pid1 := pid1Process(c.entrypoint, c.cmd)
+		if pid1 == nil || pid1.Init != c.init {
+			t.Errorf("Incorrect init of %v %v: %+v", c.entrypoint, c.cmd, pid1)
+		}
+	}
+
+	checks := initCheck(pid1Process([]string{"docker-entrypoint.sh"}, []string{"postgres"}))
+	if len(checks) != 1 || checks[0].ID != CheckNoInitProcess || checks[0].Line != "docker-entrypoint.sh postgres" {
+		t.Errorf("Incorrect init check: %+v", checks)
+	}
+	// no entrypoint or cmd in the config, unknown
+	if pid1Process(nil, nil) != nil || len(initCheck(nil)) != 0 {
+		t.Errorf("Unexpected PID 1 without a command")
+	}
+}
+
+func TestVulAliases(t *testing.T) {
+	version, _ := utils.NewVersion("4.17.15")
+	vuls := []vulFullReport{
+		{Vf: common.VulFull{Name: "CVE-2021-23337", Severity: "High", Aliases: []string{"GHSA-35jh-r3h4-6jhm"}}, Ft: detectors.FeatureVersion{Package: "lodash", Version: version}},
+		{Vf: common.VulFull{Name: "CVE-2020-8203", Severity: "High"}, Ft: detectors.FeatureVersion{Package: "lodash", Version: version}},
+		{Vf: common.VulFull{Name: "RUSTSEC-2021-0078", Severity: "Medium", CVEs: []string{"CVE-2021-32714"}}, Ft: detectors.FeatureVersion{Package: "hyper", Version: version}},
+	}
+	aliases := make(map[string][]string)
+	items := getVulItemList(vuls, common.DBAppName, aliases)
+	if len(items) != 3 || len(aliases) != 1 || aliases["apps:CVE-2021-23337"][0] != "GHSA-35jh-r3h4-6jhm" {
+		t.Fatalf("Incorrect aliases: %+v", aliases)
+	}
+
+	// a mistyped ID of the ignore file is warned of
+	for id, known := range map[string]bool{
+		CheckRootUser: true, "CVE-2021-44228": true, "ghsa-35jh-r3h4-6jhm": true, "RUSTSEC-2021-0078": true, "RHSA-2022:1234": true,
+		"root_user": false, "latest-tag": false, "CVE2021-44228": false, "44228": false,
+	} {
+		if isIgnoreID(id) != known {
+			t.Errorf("Incorrect ignore ID %s: %v", id, !known)
+		}
+	}
+
+	// ignored by an alias, a CVE or a name, regardless of the case
+	for _, id := range []string{"ghsa-35jh-r3h4-6jhm", "CVE-2021-32714", "cve-2020-8203"} {
+		cv := &CveTools{}
+		cv.SetIgnored([]string{CheckRootUser, id})
+		report := &ScanReport{ScanResult: &share.ScanResult{Vuls: append([]*share.ScanVulnerability(nil), items...)}, Aliases: aliases}
+		report.Layers = []*share.ScanLayerResult{{Vuls: append([]*share.ScanVulnerability(nil), items...)}}
+		cv.PostProcess(report)
+		if len(report.Vuls) != 2 || len(report.Layers[0].Vuls) != 2 {
+			t.Errorf("Incorrect vulnerabilities ignoring %s: %+v", id, report.Vuls)
+		}
+		if !cv.ignoredChecks[CheckRootUser] || cv.ignoredVuls[CheckRootUser] {
+			t.Errorf("Incorrect ignored checks: %+v", cv.ignoredChecks)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package cvetools
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+// ComplianceCISDocker is the image-scoped subset of the CIS Docker Benchmark, section 4
+const ComplianceCISDocker = "cis-docker"
+
+// the version of the benchmark the controls are of
+const cisDockerVersion = "1.6.0"
+
+// the results of a compliance control
+const (
+	CompliancePass          = "pass"
+	ComplianceFail          = "fail"
+	ComplianceNotApplicable = "not-applicable"
+)
+
+// ComplianceReport is the result of the compliance controls of a benchmark. The score is the percentage of
+// the applicable controls that passed.
+type ComplianceReport struct {
+	Benchmark     string               `json:"Benchmark"`
+	Version       string               `json:"Version"`
+	Controls      []*ComplianceControl `json:"Controls"`
+	Passed        int                  `json:"Passed"`
+	Failed        int                  `json:"Failed"`
+	NotApplicable int                  `json:"NotApplicable"`
+	Score         float64              `json:"Score"`
+}
+
+// ComplianceControl is the result of a control, the detail tells why it failed or is not applicable
+type ComplianceControl struct {
+	ID     string `json:"ID"`
+	Title  string `json:"Title"`
+	Result string `json:"Result"`
+	Detail string `json:"Detail,omitempty"`
+}
+
+// ParseCompliance validates the -compliance option, empty to disable
+func ParseCompliance(value string) (string, error) {
+	switch value {
+	case "", ComplianceCISDocker:
+		return value, nil
+	default:
+		return "", fmt.Errorf("Unsupported compliance benchmark %q, only %s", value, ComplianceCISDocker)
+	}
+}
+
+var (
+	// a RUN that updates the package index without installing in the same command
+	pkgUpdate  = regexp.MustCompile(`\b(?:apt-get|apt|yum|dnf|apk|zypper)\s+(?:-\S+\s+)*(?:update|makecache|refresh)\b`)
+	pkgInstall = regexp.MustCompile(`\b(?:apt-get|apt|yum|dnf|apk|zypper)\s+(?:-\S+\s+)*(?:install|add|upgrade|dist-upgrade)\b`)
+)
+
+// cisDockerCompliance runs the image controls of the CIS Docker Benchmark on the scanned image. The controls
+// that can't be assessed from an image, like the trusted base images, are not applicable.
+func cisDockerCompliance(report *ScanReport, req *ImageScanRequest) *ComplianceReport {
+	cr := &ComplianceReport{Benchmark: ComplianceCISDocker, Version: cisDockerVersion}
+	add := func(id, title, result, detail string) {
+		cr.Controls = append(cr.Controls, &ComplianceControl{ID: id, Title: title, Result: result, Detail: detail})
+		switch result {
+		case CompliancePass:
+			cr.Passed++
+		case ComplianceFail:
+			cr.Failed++
+		default:
+			cr.NotApplicable++
+		}
+	}
+
+	cmds := make([]string, len(report.Cmds))
+	for i, cmd := range report.Cmds {
+		cmds[i] = scan.NormalizeImageCmd(strings.TrimSpace(cmd))
+	}
+	runAsRoot, hasADD, hasHealthCheck := scan.ParseImageCmds(cmds)
+
+	if runAsRoot {
+		add("4.1", "Ensure that a user for the container has been created", ComplianceFail, "the image runs as root")
+	} else {
+		add("4.1", "Ensure that a user for the container has been created", CompliancePass, finalUser(cmds))
+	}
+	add("4.2", "Ensure that containers use only trusted base images", ComplianceNotApplicable, "manual review")
+	add("4.3", "Ensure that unnecessary packages are not installed in the container", ComplianceNotApplicable, "manual review")
+	var fixable int
+	for _, v := range report.Vuls {
+		if v.FixedVersion != "" {
+			fixable++
+		}
+	}
+	if fixable > 0 {
+		add("4.4", "Ensure images are scanned and rebuilt to include security patches", ComplianceFail, fmt.Sprintf("%d vulnerabilities have a fix", fixable))
+	} else {
+		add("4.4", "Ensure images are scanned and rebuilt to include security patches", CompliancePass, "")
+	}
+
+	switch sv := report.Signature; {
+	case sv == nil:
+		add("4.5", "Ensure Content trust for Docker is enabled", ComplianceNotApplicable, "no signature verification requested")
+	case sv.Verified:
+		add("4.5", "Ensure Content trust for Docker is enabled", CompliancePass, "signed by "+sv.Signer)
+	default:
+		add("4.5", "Ensure Content trust for Docker is enabled", ComplianceFail, sv.Error)
+	}
+
+	if hasHealthCheck {
+		add("4.6", "Ensure that HEALTHCHECK instructions have been added to container images", CompliancePass, "")
+	} else {
+		add("4.6", "Ensure that HEALTHCHECK instructions have been added to container images", ComplianceFail, "no HEALTHCHECK")
+	}
+
+	if line := updateAlone(cmds); line != "" {
+		add("4.7", "Ensure update instructions are not used alone in the Dockerfile", ComplianceFail, line)
+	} else {
+		add("4.7", "Ensure update instructions are not used alone in the Dockerfile", CompliancePass, "")
+	}
+
+	switch {
+	case !req.ScanSecrets:
+		add("4.8", "Ensure setuid and setgid permissions are removed", ComplianceNotApplicable, "the files are inspected by the secret scan")
+	case len(report.SetIdPerms) > 0:
+		add("4.8", "Ensure setuid and setgid permissions are removed", ComplianceFail, fmt.Sprintf("%d files, like %s", len(report.SetIdPerms), report.SetIdPerms[0].File))
+	default:
+		add("4.8", "Ensure setuid and setgid permissions are removed", CompliancePass, "")
+	}
+
+	if hasADD {
+		add("4.9", "Ensure that COPY is used instead of ADD in Dockerfiles", ComplianceFail, firstADD(cmds))
+	} else {
+		add("4.9", "Ensure that COPY is used instead of ADD in Dockerfiles", CompliancePass, "")
+	}
+
+	secrets := 0
+	for _, c := range report.Checks {
+		if c.ID == CheckSecretBuildArg {
+			secrets++
+		}
+	}
+	switch {
+	case secrets > 0:
+		add("4.10", "Ensure secrets are not stored in Dockerfiles", ComplianceFail, fmt.Sprintf("%d secret build arguments", secrets))
+	case report.Secrets != nil && hasEnvSecret(report.Secrets.Logs):
+		add("4.10", "Ensure secrets are not stored in Dockerfiles", ComplianceFail, "secrets in the environment variables")
+	default:
+		add("4.10", "Ensure secrets are not stored in Dockerfiles", CompliancePass, "")
+	}
+	add("4.11", "Ensure only verified packages are installed", ComplianceNotApplicable, "manual review")
+
+	if applicable := cr.Passed + cr.Failed; applicable > 0 {
+		cr.Score = float64(cr.Passed*10000/applicable) / 100
+	}
+	return cr
+}
+
+// updateAlone returns the first RUN that updates the package index without installing any package
+func updateAlone(cmds []string) string {
+	for i := len(cmds) - 1; i >= 0; i-- {
+		cmd := cmds[i]
+		if strings.HasPrefix(cmd, "RUN ") && pkgUpdate.MatchString(cmd) && !pkgInstall.MatchString(cmd) {
+			return cmd
+		}
+	}
+	return ""
+}
+
+// firstADD returns the first ADD of a file not from the build context, as scan.ParseImageCmds tells it
+func firstADD(cmds []string) string {
+	for i := len(cmds) - 1; i >= 0; i-- {
+		if cmd := cmds[i]; strings.HasPrefix(cmd, "ADD ") && !strings.HasPrefix(strings.TrimSpace(cmd[4:]), "file:") {
+			return cmd
+		}
+	}
+	return ""
+}
+
+func hasEnvSecret(logs []*share.ScanSecretLog) bool {
+	for _, l := range logs {
+		if l.File == envSecretFile {
+			return true
+		}
+	}
+	return false
+}
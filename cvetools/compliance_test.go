@@ -0,0 +1,52 @@
+package cvetools
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+func TestCISDockerCompliance(t *testing.T) {
+	report := &ScanReport{ScanResult: &share.ScanResult{
+		Cmds: []string{
+			`/bin/sh -c #(nop)  USER app`,
+			`/bin/sh -c #(nop)  HEALTHCHECK CMD ["/health"]`,
+			`/bin/sh -c apt-get update`,
+			`/bin/sh -c #(nop) ADD https://example.com/app.tar.gz /app`,
+			`/bin/sh -c #(nop) ADD file:0123456789abcdef in /`,
+		},
+		Vuls:       []*share.ScanVulnerability{{Name: "CVE-2023-0001", FixedVersion: "1.2"}, {Name: "CVE-2023-0002"}},
+		SetIdPerms: []*share.ScanSetIdPermLog{},
+		Secrets:    &share.ScanSecretResult{},
+	}}
+	cr := cisDockerCompliance(report, &ImageScanRequest{ScanImageRequest: share.ScanImageRequest{ScanSecrets: true}})
+
+	results := make(map[string]string)
+	for _, c := range cr.Controls {
+		results[c.ID] = c.Result
+	}
+	expect := map[string]string{
+		"4.1": CompliancePass, "4.2": ComplianceNotApplicable, "4.3": ComplianceNotApplicable, "4.4": ComplianceFail,
+		"4.5": ComplianceNotApplicable, "4.6": CompliancePass, "4.7": ComplianceFail, "4.8": CompliancePass,
+		"4.9": ComplianceFail, "4.10": CompliancePass, "4.11": ComplianceNotApplicable,
+	}
+	if !reflect.DeepEqual(results, expect) {
+		t.Errorf("Incorrect controls: %+v", results)
+	}
+	if cr.Passed != 4 || cr.Failed != 3 || cr.NotApplicable != 4 || cr.Score != 57.14 {
+		t.Errorf("Incorrect score: %+v", cr)
+	}
+
+	// the secret build arguments are found by the checks of the raw history
+	report.Checks = []*ImageCheck{{ID: CheckSecretBuildArg, Line: "|1 NPM_TOKEN=**** /bin/sh -c npm install"}}
+	for _, c := range cisDockerCompliance(report, &ImageScanRequest{ScanImageRequest: share.ScanImageRequest{ScanSecrets: true}}).Controls {
+		if c.ID == "4.10" && c.Result != ComplianceFail {
+			t.Errorf("Incorrect secret build argument control: %+v", c)
+		}
+	}
+
+	if _, err := ParseCompliance("cis-k8s"); err == nil {
+		t.Errorf("Unsupported benchmark accepted")
+	}
+}
@@ -0,0 +1,408 @@
+package cvetools
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	goDigest "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/scan/registry"
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// the signature formats found for the image
+const (
+	SignatureFormatCosign   = "cosign"
+	SignatureFormatNotation = "notation"
+)
+
+const notationArtifactType = "application/vnd.cncf.notary.signature"
+
+// a signature payload is a small JSON document, a big one is not read
+const maxSignaturePayloadSize = 1 << 20
+
+// CosignKey is a cosign public key to verify the image signatures with, in PEM
+type CosignKey struct {
+	Name string `json:"Name"` // the key file, recorded as the signer
+	PEM  string `json:"PEM"`
+}
+
+// SignatureVerification is the outcome of verifying the cosign signatures of the image with the given keys
+// or the keyless policy. The image is verified if any signature is verified and signs the scanned digest.
+type SignatureVerification struct {
+	Verified    bool                   `json:"Verified"`
+	Signed      bool                   `json:"Signed"` // signatures were found
+	Digest      string                 `json:"Digest"`
+	Formats     []string               `json:"Formats,omitempty"`     // cosign or notation
+	Signer      string                 `json:"Signer,omitempty"`      // the key that verified the signature, or the certificate identity
+	Issuer      string                 `json:"Issuer,omitempty"`      // the OIDC issuer of a keyless signature
+	Identity    string                 `json:"Identity,omitempty"`    // docker-reference of the signed payload
+	Annotations map[string]interface{} `json:"Annotations,omitempty"` // optional claims of the signed payload
+	Verifiers   []*VerifierResult      `json:"Verifiers,omitempty"`
+	Error       string                 `json:"Error,omitempty"`
+}
+
+// VerifierResult is the outcome of each configured key, keyless identity or verifier of the roots of trust
+type VerifierResult struct {
+	Verifier string `json:"Verifier"` // the key file, the certificate identity, or <root of trust>/<verifier>
+	Verified bool   `json:"Verified"`
+	Error    string `json:"Error,omitempty"`
+}
+
+// a configured key or keyless policy, check returns the signer and the OIDC issuer of a verified signature
+type cosignVerifier struct {
+	name  string
+	check func(annotations map[string]string, payload, sig []byte) (string, string, error)
+}
+
+// the signature image manifest, the signature of each payload layer is in its annotation
+type cosignManifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// the simple signing payload that cosign signs
+type cosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// LoadCosignKey reads and validates a cosign public key file
+func LoadCosignKey(path string) (*CosignKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parsePublicKey(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &CosignKey{Name: path, PEM: string(data)}, nil
+}
+
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// verifyBlob verifies the signature of the payload, signed on its sha256 digest except with ed25519
+func verifyBlob(pub crypto.PublicKey, payload, sig []byte) error {
+	digest := sha256.Sum256(payload)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], sig) {
+			return errors.New("Invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return rsa.VerifyPSS(key, crypto.SHA256, digest[:], sig, nil)
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, sig) {
+			return errors.New("Invalid ED25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported key type %T", pub)
+}
+
+// getSignatureData fetches the cosign signature manifest and payloads of the digest, like GetSignatureDataForImage
+// of the registry client, but the downloads stop as soon as ctx is done, and the payload size is capped.
+func getSignatureData(ctx context.Context, rc *scan.RegClient, repo, digest string) (scan.SignatureData, share.ScanErrorCode) {
+	info, errCode := rc.GetImageInfo(ctx, repo, scan.GetCosignSignatureTagFromDigest(digest), registry.ManifestRequest_CosignSignature)
+	if errCode != share.ScanErrorCode_ScanErrNone {
+		return scan.SignatureData{}, contextErrorCode(ctx, errCode)
+	}
+
+	s := scan.SignatureData{Payloads: make(map[string]string), Manifest: string(info.RawManifest)}
+	for _, layer := range info.Layers {
+		data, err := downloadSignaturePayload(ctx, rc, repo, layer)
+		if err != nil {
+			log.WithFields(log.Fields{"digest": digest, "layer": layer, "error": err}).Error("Failed to download the signature payload")
+			return scan.SignatureData{}, contextErrorCode(ctx, share.ScanErrorCode_ScanErrRegistryAPI)
+		}
+		s.Payloads[layer] = string(data)
+	}
+	return s, share.ScanErrorCode_ScanErrNone
+}
+
+func downloadSignaturePayload(ctx context.Context, rc *scan.RegClient, repo, layer string) ([]byte, error) {
+	rdr, size, err := rc.DownloadLayer(ctx, repo, goDigest.Digest(layer))
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	if size > maxSignaturePayloadSize {
+		return nil, fmt.Errorf("Payload size %d is over the limit", size)
+	}
+
+	// the read is aborted when ctx is done, the request is made with it
+	data, err := ioutil.ReadAll(io.LimitReader(rdr, maxSignaturePayloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSignaturePayloadSize {
+		return nil, fmt.Errorf("Payload is over the size limit %d", maxSignaturePayloadSize)
+	}
+	return data, nil
+}
+
+// contextErrorCode tells a cancelled or timed out request from the registry errors
+func contextErrorCode(ctx context.Context, code share.ScanErrorCode) share.ScanErrorCode {
+	switch ctx.Err() {
+	case context.Canceled:
+		return share.ScanErrorCode_ScanErrCanceled
+	case context.DeadlineExceeded:
+		return share.ScanErrorCode_ScanErrTimeout
+	}
+	return code
+}
+
+// verifyImageWithKeys fetches the signature data of the image digest and verifies it
+func verifyImageWithKeys(ctx context.Context, rc *scan.RegClient, repo, digest string, keys []*CosignKey, keyless *KeylessPolicy) *SignatureVerification {
+	var sv *SignatureVerification
+	sigData, errCode := getSignatureData(ctx, rc, repo, digest)
+	switch errCode {
+	case share.ScanErrorCode_ScanErrNone:
+		sv = verifyCosignSignatures(digest, &sigData, keys, keyless)
+	case share.ScanErrorCode_ScanErrImageNotFound:
+		sv = verifyCosignSignatures(digest, nil, keys, keyless)
+	default:
+		return &SignatureVerification{Digest: digest, Error: fmt.Sprintf("Failed to fetch the signatures: %s", scan.ScanErrorToStr(errCode))}
+	}
+
+	// notation signatures are only reported, they are not verified
+	if hasNotationSignature(ctx, rc, repo, digest) {
+		sv.Formats = append(sv.Formats, SignatureFormatNotation)
+		if !sv.Signed {
+			sv.Signed = true
+			sv.Error = "Notation signatures are not verified"
+		}
+	}
+
+	log.WithFields(log.Fields{"digest": digest, "verified": sv.Verified, "signer": sv.Signer, "error": sv.Error}).Info("Verify image signature")
+	return sv
+}
+
+// hasNotationSignature looks up the notation signatures of the digest with the OCI referrers API,
+// a registry without the API has none
+func hasNotationSignature(ctx context.Context, rc *scan.RegClient, repo, digest string) bool {
+	url := fmt.Sprintf("%s/v2/%s/referrers/%s?artifactType=%s", rc.URL, repo, digest, notationArtifactType)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Accept", "application/vnd.oci.image.index.v1+json")
+	resp, err := rc.Client.Client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	var index struct {
+		Manifests []struct {
+			ArtifactType string `json:"artifactType"`
+		} `json:"manifests"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return false
+	}
+	for _, m := range index.Manifests {
+		if m.ArtifactType == notationArtifactType {
+			return true
+		}
+	}
+	return false
+}
+
+// addTrustVerifierResults records the status of each verifier of the roots of trust in the request,
+// by the satisfied verifiers of the sigstore interface, to the outcome of the keys if any
+func addTrustVerifierResults(sv *SignatureVerification, digest string, roots []*share.SigstoreRootOfTrust, info *share.ScanSignatureInfo) *SignatureVerification {
+	if sv == nil {
+		sv = &SignatureVerification{Digest: digest}
+		if info == nil || info.VerificationError != share.ScanErrorCode_ScanErrImageNotFound {
+			sv.Signed = true
+			sv.Formats = []string{SignatureFormatCosign}
+		}
+	}
+	satisfied := utils.NewSet()
+	if info != nil {
+		for _, v := range info.Verifiers {
+			satisfied.Add(v)
+		}
+	}
+
+	for _, root := range roots {
+		for _, v := range root.Verifiers {
+			res := &VerifierResult{Verifier: fmt.Sprintf("%s/%s", root.Name, v.Name)}
+			if satisfied.Contains(res.Verifier) {
+				res.Verified = true
+				if !sv.Verified {
+					sv.Verified = true
+					sv.Signer = res.Verifier
+					sv.Error = ""
+				}
+			} else if info != nil && info.VerificationError != share.ScanErrorCode_ScanErrNone {
+				res.Error = scan.ScanErrorToStr(info.VerificationError)
+			} else {
+				res.Error = "No signature is verified by the verifier"
+			}
+			sv.Verifiers = append(sv.Verifiers, res)
+		}
+	}
+	if !sv.Verified && sv.Error == "" {
+		if sv.Signed {
+			sv.Error = "No signature is verified by the verifiers"
+		} else {
+			sv.Error = "No signature found"
+		}
+	}
+	return sv
+}
+
+// verifyCosignSignatures checks the signature payloads of the image against the keys and the keyless policy
+func verifyCosignSignatures(digest string, sigData *scan.SignatureData, keys []*CosignKey, keyless *KeylessPolicy) *SignatureVerification {
+	sv := &SignatureVerification{Digest: digest}
+	if sigData == nil || len(sigData.Payloads) == 0 {
+		sv.Error = "No signature found"
+		return sv
+	}
+	sv.Signed = true
+	sv.Formats = []string{SignatureFormatCosign}
+
+	var man cosignManifest
+	if err := json.Unmarshal([]byte(sigData.Manifest), &man); err != nil {
+		sv.Error = fmt.Sprintf("Invalid signature manifest: %v", err)
+		return sv
+	}
+
+	// the decoded signatures, the ones that can't be decoded fail every verifier
+	type signature struct {
+		annotations map[string]string
+		payload     []byte
+		sig         []byte
+		parsed      cosignPayload
+	}
+	var sigs []*signature
+	var lastErr string
+	for _, l := range man.Layers {
+		payload, ok := sigData.Payloads[l.Digest]
+		if !ok {
+			continue
+		}
+		s := &signature{annotations: l.Annotations, payload: []byte(payload)}
+		var err error
+		if s.sig, err = base64.StdEncoding.DecodeString(l.Annotations[cosignSignatureAnnotation]); err != nil || len(s.sig) == 0 {
+			lastErr = "Invalid signature encoding"
+			continue
+		}
+		if err := json.Unmarshal(s.payload, &s.parsed); err != nil {
+			lastErr = fmt.Sprintf("Invalid signature payload: %v", err)
+			continue
+		}
+		sigs = append(sigs, s)
+	}
+
+	// every verifier is checked, so the outcome of each of them is reported
+	for _, v := range cosignVerifiers(keys, keyless) {
+		res := &VerifierResult{Verifier: v.name}
+		for _, s := range sigs {
+			signer, issuer, err := v.check(s.annotations, s.payload, s.sig)
+			if err != nil {
+				res.Error = err.Error()
+				continue
+			}
+			// a valid signature of another image, like a copied signature tag, is not accepted
+			if s.parsed.Critical.Image.DockerManifestDigest != digest {
+				res.Error = fmt.Sprintf("Signed digest %s is not the image digest", s.parsed.Critical.Image.DockerManifestDigest)
+				continue
+			}
+
+			res.Verified, res.Error = true, ""
+			if !sv.Verified {
+				sv.Verified = true
+				sv.Signer = signer
+				sv.Issuer = issuer
+				sv.Identity = s.parsed.Critical.Identity.DockerReference
+				sv.Annotations = s.parsed.Optional
+			}
+			break
+		}
+		if !res.Verified {
+			if res.Error == "" {
+				res.Error = "No signature is verified by the verifier"
+			}
+			lastErr = res.Error
+		}
+		sv.Verifiers = append(sv.Verifiers, res)
+	}
+
+	if !sv.Verified {
+		if lastErr == "" {
+			lastErr = "No signature is verified by the keys"
+		}
+		sv.Error = lastErr
+	}
+	return sv
+}
+
+func cosignVerifiers(keys []*CosignKey, keyless *KeylessPolicy) []*cosignVerifier {
+	var list []*cosignVerifier
+	for _, k := range keys {
+		name := k.Name
+		pub, err := parsePublicKey([]byte(k.PEM))
+		list = append(list, &cosignVerifier{name: name, check: func(_ map[string]string, payload, sig []byte) (string, string, error) {
+			if err != nil {
+				return "", "", err
+			}
+			if err := verifyBlob(pub, payload, sig); err != nil {
+				return "", "", errors.New("No signature is verified by the key")
+			}
+			return name, "", nil
+		}})
+	}
+	if keyless != nil {
+		list = append(list, &cosignVerifier{name: keyless.Identity, check: func(annotations map[string]string, payload, sig []byte) (string, string, error) {
+			if annotations[cosignCertificateAnnotation] == "" {
+				return "", "", errors.New("No keyless signature")
+			}
+			return verifyKeyless(keyless, annotations, payload, sig)
+		}})
+	}
+	return list
+}
@@ -0,0 +1,140 @@
+package cvetools
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+func makeCosignSignature(t *testing.T, key *ecdsa.PrivateKey, digest string) *scan.SignatureData {
+	payload := fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"example.com/app"},`+
+		`"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":{"team":"dev"}}`, digest)
+	hash := sha256.Sum256([]byte(payload))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	manifest := fmt.Sprintf(`{"layers":[{"digest":"sha256:p1","annotations":{"%s":"%s"}}]}`,
+		cosignSignatureAnnotation, base64.StdEncoding.EncodeToString(sig))
+	return &scan.SignatureData{Manifest: manifest, Payloads: map[string]string{"sha256:p1": payload}}
+}
+
+func makeCosignKey(t *testing.T, name string, key *ecdsa.PrivateKey) *CosignKey {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return &CosignKey{Name: name, PEM: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))}
+}
+
+func TestVerifyCosignSignatures(t *testing.T) {
+	const digest = "sha256:1111"
+	signer, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := []*CosignKey{makeCosignKey(t, "other.pub", other), makeCosignKey(t, "cosign.pub", signer)}
+
+	sv := verifyCosignSignatures(digest, makeCosignSignature(t, signer, digest), keys, nil)
+	if !sv.Verified || sv.Signer != "cosign.pub" || sv.Identity != "example.com/app" || sv.Annotations["team"] != "dev" {
+		t.Errorf("Incorrect verification: %+v", sv)
+	}
+	if len(sv.Formats) != 1 || sv.Formats[0] != SignatureFormatCosign || len(sv.Verifiers) != 2 ||
+		sv.Verifiers[0].Verified || sv.Verifiers[0].Error == "" || !sv.Verifiers[1].Verified || sv.Verifiers[1].Verifier != "cosign.pub" {
+		t.Errorf("Incorrect verifier results: %+v", sv)
+	}
+
+	sv = verifyCosignSignatures(digest, makeCosignSignature(t, signer, digest), keys[:1], nil)
+	if sv.Verified || !sv.Signed || sv.Error == "" {
+		t.Errorf("Expect not verified by another key: %+v", sv)
+	}
+
+	sv = verifyCosignSignatures(digest, makeCosignSignature(t, signer, "sha256:2222"), keys, nil)
+	if sv.Verified || sv.Error == "" {
+		t.Errorf("Expect not verified for another digest: %+v", sv)
+	}
+
+	sv = verifyCosignSignatures(digest, nil, keys, nil)
+	if sv.Verified || sv.Signed {
+		t.Errorf("Expect unsigned: %+v", sv)
+	}
+}
+
+func TestTrustVerifierResults(t *testing.T) {
+	roots := []*share.SigstoreRootOfTrust{
+		{Name: "prod", Verifiers: []*share.SigstoreVerifier{{Name: "release"}, {Name: "build"}}},
+	}
+
+	sv := addTrustVerifierResults(nil, "sha256:1111", roots, &share.ScanSignatureInfo{Verifiers: []string{"prod/build"}})
+	if !sv.Verified || !sv.Signed || sv.Signer != "prod/build" || len(sv.Verifiers) != 2 ||
+		sv.Verifiers[0].Verified || !sv.Verifiers[1].Verified {
+		t.Errorf("Incorrect verifier results: %+v", sv)
+	}
+
+	info := &share.ScanSignatureInfo{VerificationError: share.ScanErrorCode_ScanErrImageNotFound}
+	if sv = addTrustVerifierResults(nil, "sha256:1111", roots, info); sv.Verified || sv.Signed || sv.Error == "" {
+		t.Errorf("Expect unsigned: %+v", sv)
+	}
+
+	keys := &SignatureVerification{Verified: true, Signed: true, Signer: "cosign.pub",
+		Verifiers: []*VerifierResult{{Verifier: "cosign.pub", Verified: true}}}
+	if sv = addTrustVerifierResults(keys, "sha256:1111", roots, &share.ScanSignatureInfo{}); !sv.Verified ||
+		sv.Signer != "cosign.pub" || len(sv.Verifiers) != 3 {
+		t.Errorf("Incorrect verifier results with keys: %+v", sv)
+	}
+}
+
+func TestSignaturePayloadDownload(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":small"):
+			w.Write([]byte(`{"critical":{}}`))
+		case strings.HasSuffix(r.URL.Path, ":big"):
+			w.Write(make([]byte, maxSignaturePayloadSize+1))
+		default:
+			// a slow registry, sends a part of the payload and stalls
+			w.Write([]byte(`{"critical":`))
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer srv.Close()
+	rc := newRegClient(srv.URL, "", "", "", "")
+
+	if data, err := downloadSignaturePayload(context.Background(), rc, "app", "sha256:small"); err != nil || string(data) != `{"critical":{}}` {
+		t.Errorf("Incorrect payload: %s %v", data, err)
+	}
+	if _, err := downloadSignaturePayload(context.Background(), rc, "app", "sha256:big"); err == nil {
+		t.Errorf("Expect the big payload rejected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := downloadSignaturePayload(ctx, rc, "app", "sha256:slow"); err == nil {
+		t.Errorf("Expect the download cancelled")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("The cancelled download took %v", d)
+	}
+	if code := contextErrorCode(ctx, share.ScanErrorCode_ScanErrRegistryAPI); code != share.ScanErrorCode_ScanErrTimeout {
+		t.Errorf("Incorrect error code: %v", code)
+	}
+}
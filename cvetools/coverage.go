@@ -0,0 +1,86 @@
+package cvetools
+
+import (
+	"fmt"
+
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+const (
+	LayerScanned = "scanned"
+	LayerEmpty   = "empty"
+	LayerPartial = "partial"
+	LayerSkipped = "skipped"
+)
+
+// ScanCoverage tells which layers were inspected. A clean result can only be trusted when it is complete.
+type ScanCoverage struct {
+	Complete bool             `json:"Complete"`
+	Scanned  int              `json:"Scanned"`
+	Skipped  int              `json:"Skipped"`
+	Layers   []*LayerCoverage `json:"Layers"`
+	Notes    []string         `json:"Notes,omitempty"`
+}
+
+type LayerCoverage struct {
+	Digest string `json:"Digest"`
+	Status string `json:"Status"`
+	Reason string `json:"Reason,omitempty"`
+	Files  int    `json:"Files"` // package and application files inspected
+}
+
+// buildCoverage summarizes the inspection of each layer. The applications of the unmapped layers
+// are not matched because their files are not in the image file map.
+func buildCoverage(layers []string, sizes map[string]int64, layerFiles map[string]*scan.LayerFiles, unmapped utils.Set, mapErr error) *ScanCoverage {
+	cov := &ScanCoverage{Layers: make([]*LayerCoverage, 0, len(layers))}
+	done := utils.NewSet()
+	for _, layer := range layers {
+		if layer == "" || done.Contains(layer) {
+			continue
+		}
+		done.Add(layer)
+
+		lc := &LayerCoverage{Digest: layer}
+		lf, ok := layerFiles[layer]
+		if lf != nil {
+			lc.Files = len(lf.Pkgs) + len(lf.Apps)
+		}
+		size, hasSize := sizes[layer]
+		switch {
+		case !ok:
+			lc.Status, lc.Reason = LayerSkipped, "not downloaded"
+		case len(sizes) > 0 && !hasSize:
+			lc.Status, lc.Reason = LayerSkipped, "no size in the manifest, not downloaded"
+		case len(sizes) > 0 && size == 0, layer == emptyGzipLayer:
+			lc.Status = LayerEmpty
+		case unmapped.Contains(layer):
+			lc.Status, lc.Reason = LayerPartial, fmt.Sprintf("applications not matched, failed to map files: %v", mapErr)
+		default:
+			lc.Status = LayerScanned
+		}
+
+		switch lc.Status {
+		case LayerSkipped, LayerPartial:
+			cov.Skipped++
+		case LayerScanned:
+			cov.Scanned++
+		}
+		cov.Layers = append(cov.Layers, lc)
+	}
+	cov.Complete = cov.Skipped == 0
+	return cov
+}
+
+// markFailed gives the reason of the layers that failed to download in the best-effort mode
+func (cov *ScanCoverage) markFailed(failed map[string]string) {
+	if len(failed) == 0 {
+		return
+	}
+	for _, lc := range cov.Layers {
+		if reason, ok := failed[lc.Digest]; ok {
+			lc.Status, lc.Reason = LayerSkipped, fmt.Sprintf("download failed: %s", reason)
+		}
+	}
+	cov.Notes = append(cov.Notes, fmt.Sprintf("partial result, %d of %d layers failed to download", len(failed), len(cov.Layers)))
+}
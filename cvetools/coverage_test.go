@@ -0,0 +1,58 @@
+package cvetools
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+func TestBuildCoverage(t *testing.T) {
+	layers := []string{"sha256:a", "sha256:b", "sha256:c", "sha256:d", "sha256:a", ""}
+	sizes := map[string]int64{"sha256:a": 100, "sha256:b": 0, "sha256:c": 200}
+	layerFiles := map[string]*scan.LayerFiles{
+		"sha256:a": &scan.LayerFiles{Size: 300, Pkgs: map[string][]byte{"var/lib/dpkg/status": nil}},
+		"sha256:b": &scan.LayerFiles{},
+		"sha256:c": &scan.LayerFiles{Size: 500},
+		"sha256:d": &scan.LayerFiles{},
+	}
+
+	cov := buildCoverage(layers, sizes, layerFiles, utils.NewSet("sha256:c"), errors.New("walk error"))
+	if len(cov.Layers) != 4 || cov.Scanned != 1 || cov.Skipped != 2 || cov.Complete {
+		t.Fatalf("Incorrect coverage: %+v", cov)
+	}
+	expect := []string{LayerScanned, LayerEmpty, LayerPartial, LayerSkipped}
+	for i, l := range cov.Layers {
+		if l.Status != expect[i] {
+			t.Errorf("Incorrect status: %s => %s", l.Digest, l.Status)
+		}
+	}
+	if cov.Layers[0].Files != 1 {
+		t.Errorf("Incorrect files: %d", cov.Layers[0].Files)
+	}
+
+	cov = buildCoverage(layers[:2], sizes, layerFiles, utils.NewSet(), nil)
+	if !cov.Complete || cov.Scanned != 1 {
+		t.Errorf("Incorrect coverage: %+v", cov)
+	}
+}
+
+func TestMarkFailedLayers(t *testing.T) {
+	layers := []string{"sha256:a", "sha256:b"}
+	layerFiles := map[string]*scan.LayerFiles{"sha256:a": &scan.LayerFiles{Size: 100}}
+	cov := buildCoverage(layers, nil, layerFiles, utils.NewSet(), nil)
+	cov.markFailed(map[string]string{"sha256:b": "Network error"})
+	if cov.Complete || cov.Skipped != 1 || len(cov.Notes) != 1 {
+		t.Fatalf("Incorrect coverage: %+v", cov)
+	}
+	if l := cov.Layers[1]; l.Status != LayerSkipped || l.Reason != "download failed: Network error" {
+		t.Errorf("Incorrect failed layer: %+v", l)
+	}
+
+	cov = buildCoverage(layers[:1], nil, layerFiles, utils.NewSet(), nil)
+	cov.markFailed(nil)
+	if !cov.Complete || len(cov.Notes) != 0 {
+		t.Errorf("Incorrect coverage: %+v", cov)
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
@@ -16,7 +14,6 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/neuvector/neuvector/share"
-	"github.com/neuvector/neuvector/share/httptrace"
 	"github.com/neuvector/neuvector/share/scan"
 	"github.com/neuvector/neuvector/share/scan/registry"
 	"github.com/neuvector/neuvector/share/scan/secrets"
@@ -129,16 +126,49 @@ func diffFeatures(lastFeat, features []detectors.FeatureVersion) []detectors.Fea
 */
 
 type layerScanFiles struct {
-	pkgs map[string]*detectors.FeatureFile
-	apps []detectors.AppFeatureVersion
+	pkgs     map[string]*detectors.FeatureFile
+	apps     []detectors.AppFeatureVersion
+	binaries []*detectedBinary   // the well-known binaries of the image, not of a single layer
+	stats    *ScanStats          // to record the phase timings, can be nil
+	aliases  map[string][]string // to collect the aliases of the vulnerabilities found by their DB keys, can be nil
+	db       *DBHandle           // the database the packages were matched with, set by doScan
+}
+
+// DBVersion returns the version and the create time of the CVE database in use, read together
+func (cv *CveTools) DBVersion() (string, string) {
+	cv.UpdateMux.RLock()
+	defer cv.UpdateMux.RUnlock()
+	return cv.CveDBVersion, cv.CveDBCreateTime
+}
+
+// dbSources returns the hash of the sources of the CVE database in use, empty if it is not merged
+func (cv *CveTools) dbSources() string {
+	cv.UpdateMux.RLock()
+	defer cv.UpdateMux.RUnlock()
+	return cv.CveDBSources
+}
+
+// SetDBVersion stamps the result with the CVE database that produced it, so a stored result can be
+// re-evaluated knowing which database it came from. A matched result has the version of the database it was
+// matched with, the database can be updated after the match, the others get the current one.
+func (cv *CveTools) SetDBVersion(result *share.ScanResult) {
+	if result != nil && result.Version == "" {
+		result.Version, result.CVEDBCreateTime = cv.DBVersion()
+	}
+}
+
+// stamp sets the version of the database the result was matched with, nil if the packages were not matched
+func (h *DBHandle) stamp(result *share.ScanResult) {
+	if h != nil {
+		result.Version, result.CVEDBCreateTime = h.Version, h.CreateTime
+	}
 }
 
 func (cv *CveTools) ScanImageData(data *share.ScanData) (*share.ScanResult, error) {
 	result := &share.ScanResult{
-		Provider:        share.ScanProvider_Neuvector,
-		Version:         cv.CveDBVersion,
-		CVEDBCreateTime: cv.CveDBCreateTime,
+		Provider: share.ScanProvider_Neuvector,
 	}
+	defer cv.SetDBVersion(result)
 
 	pkgs, err := utils.SelectivelyExtractArchive(bytes.NewReader(data.Buffer), func(filename string) bool {
 		return true
@@ -160,7 +190,12 @@ func (cv *CveTools) ScanImageData(data *share.ScanData) (*share.ScanResult, erro
 		afvs[i] = detectors.AppFeatureVersion{AppPackage: a, ModuleVuls: make([]detectors.ModuleVul, 0)}
 	}
 
-	namespace, serr, vuls, features, apps := cv.doScan(&layerScanFiles{pkgs: files, apps: afvs}, nil)
+	layerFiles := &layerScanFiles{pkgs: files, apps: afvs}
+	namespace, serr, vuls, features, apps, notes := cv.doScan(layerFiles, nil)
+	layerFiles.db.stamp(result)
+	if len(notes) > 0 {
+		log.WithFields(log.Fields{"notes": notes}).Info("More than one OS package database")
+	}
 	result.Error = serr
 	result.Vuls = vuls
 
@@ -188,35 +223,57 @@ func (cv *CveTools) ScanAppPackage(req *share.ScanAppRequest, namespace string)
 		apps = append(apps, afv)
 	}
 
-	appvuls := cv.DetectAppVul(cv.TbPath, apps, namespace)
-	vulList := getVulItemList(appvuls, common.DBAppName)
+	cv.UpdateMux.RLock()
+	h := cv.scanDB()
+	appvuls := detectAppVul(h, apps, namespace)
+	cv.UpdateMux.RUnlock()
+	vulList := getVulItemList(appvuls, common.DBAppName, nil)
 
 	result := &share.ScanResult{
-		Provider:        share.ScanProvider_Neuvector,
-		Version:         cv.CveDBVersion,
-		CVEDBCreateTime: cv.CveDBCreateTime,
-		Error:           share.ScanErrorCode_ScanErrNone,
-		Vuls:            vulList,
-		Modules:         feature2Module(namespace, nil, apps),
+		Provider: share.ScanProvider_Neuvector,
+		Error:    share.ScanErrorCode_ScanErrNone,
+		Vuls:     vulList,
+		Modules:  feature2Module(namespace, nil, apps),
 	}
+	h.stamp(result)
 	return result, nil
 }
 
 // ScanImage helps the Image scanning
 func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest, imgPath string) (*share.ScanResult, error) {
+	report, err := cv.ScanImageReport(ctx, &ImageScanRequest{ScanImageRequest: *req}, imgPath)
+	return report.ScanResult, err
+}
+
+// ScanImageReport scans the image and returns the result with the image details share.ScanResult cannot carry
+func (cv *CveTools) ScanImageReport(ctx context.Context, req *ImageScanRequest, imgPath string) (*ScanReport, error) {
 	var err error
 	result := &share.ScanResult{
-		Provider:        share.ScanProvider_Neuvector,
-		Version:         cv.CveDBVersion,
-		CVEDBCreateTime: cv.CveDBCreateTime,
-		Error:           share.ScanErrorCode_ScanErrNone,
-		Registry:        req.Registry,
-		Repository:      req.Repository,
-		Tag:             req.Tag,
-		Layers:          make([]*share.ScanLayerResult, 0),
-	}
+		Provider:   share.ScanProvider_Neuvector,
+		Error:      share.ScanErrorCode_ScanErrNone,
+		Registry:   req.Registry,
+		Repository: req.Repository,
+		Tag:        req.Tag,
+		Layers:     make([]*share.ScanLayerResult, 0),
+	}
+	report := &ScanReport{ScanResult: result, Stats: &ScanStats{}}
+	start := time.Now()
+	defer report.SetProvenance(cv, start, req.options())
+
+	if req.ScanID == "" {
+		req.ScanID = NewScanID()
+	}
+	ctx = WithScanID(ctx, req.ScanID)
+	ctx = withExcludePaths(ctx, req.ExcludePaths)
+	ctx, digestErrs := withDigestErrors(ctx)
+	ctx, report.Stats.progress = withProgressTracker(ctx, req.ScanID, fmt.Sprintf("%s%s:%s", req.Registry, req.Repository, req.Tag))
+	ctx = withScanStats(ctx, report.Stats)
+	log.WithFields(log.Fields{
+		"scan": req.ScanID, "registry": req.Registry, "image": fmt.Sprintf("%s:%s", req.Repository, req.Tag),
+	}).Info("Scan image")
 
 	var baseReg, baseRepo, baseTag string
+	var baseDigest string // of the base image of the request
 	if req.BaseImage != "" {
 		reg, repo, tag, err := scan.ParseImageName(req.BaseImage)
 		if err != nil {
@@ -225,7 +282,7 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 			}).Error("Failed to parse base image")
 
 			result.Error = share.ScanErrorCode_ScanErrArgument
-			return result, nil
+			return report, nil
 		}
 
 		baseReg = reg
@@ -243,67 +300,203 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 	// var layeredSecret []*share.ScanSecretResult
 	var setidPerm []*share.ScanSetIdPermLog
 	var layers []string
+	var failedLayers map[string]string // layers failed to download in the best-effort mode
+	var exposedPorts []string          // of the image config, only read from the registry
+	var history []string               // the raw history of the image config, only read from the registry
 
 	// for layered storages
 	if imgPath == "" { // not-defined yet
 		imgPath = CreateImagePath("")
-		defer os.RemoveAll(imgPath)
+		defer RemoveImagePath(imgPath)
+	}
+
+	if (len(req.CosignKeys) > 0 || req.Keyless != nil) && req.Registry == "" {
+		report.Signature = &SignatureVerification{Error: "The signatures of a local image can't be verified"}
 	}
 
 	if req.Registry != "" {
 		var errCode share.ScanErrorCode
 
+		phaseStart := time.Now()
 		if baseRepo != "" {
 			if baseReg == "" {
 				log.WithFields(log.Fields{
 					"base": req.BaseImage,
 				}).Error("Base image must be remote if the image to be scanned is remote")
 				result.Error = share.ScanErrorCode_ScanErrNotSupport
-				return result, nil
+				return report, nil
 			}
 
-			rc := scan.NewRegClient(baseReg, req.Token, req.Username, req.Password, req.Proxy, new(httptrace.NopTracer))
+			rc := newRegClient(baseReg, req.Token, req.Username, req.Password, req.Proxy)
 			info, errCode = rc.GetImageInfo(ctx, baseRepo, baseTag, registry.ManifestRequest_Default)
 			if errCode != share.ScanErrorCode_ScanErrNone {
 				result.Error = errCode
-				return result, nil
+				return report, nil
 			}
 
 			for _, l := range info.Layers {
 				baseLayers.Add(l)
 			}
+			baseDigest = info.Digest
 
 			log.WithFields(log.Fields{"baseImage": req.BaseImage, "base": baseLayers, "layers": len(info.Layers)}).Debug()
 		}
 
-		rc := scan.NewRegClient(req.Registry, req.Token, req.Username, req.Password, req.Proxy, new(httptrace.NopTracer))
+		rc := newRegClient(req.Registry, req.Token, req.Username, req.Password, req.Proxy)
 
-		info, errCode = rc.GetImageInfo(ctx, req.Repository, req.Tag, registry.ManifestRequest_Default)
+		// pick the requested platform from a manifest list, instead of linux/amd64
+		tag := req.Tag
+		var platform *ImagePlatform
+		if req.Platform != "" {
+			if platform, err = ParseImagePlatform(req.Platform); err != nil {
+				report.ErrorMessage = err.Error()
+				result.Error = share.ScanErrorCode_ScanErrArgument
+				return report, nil
+			}
+			if tag, err = resolvePlatformTag(ctx, rc, req.Repository, req.Tag, platform); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error()
+				report.ErrorMessage = err.Error()
+				result.Error = share.ScanErrorCode_ScanErrNotSupport
+				return report, nil
+			}
+		}
+
+		// an OCI artifact is reported as it is, or its subject is scanned. The manifest read for the image info is
+		// reused, it is read again with the OCI types only if the image info fails.
+		info, errCode = rc.GetImageInfo(ctx, req.Repository, tag, registry.ManifestRequest_Default)
+		if errCode == share.ScanErrorCode_ScanErrNone {
+			report.Artifact = readArtifact(ctx, rc, req.Repository, tag, info.RawManifest)
+		} else {
+			report.Artifact = getArtifact(ctx, rc, req.Repository, tag)
+		}
+		if report.Artifact != nil {
+			if report.Artifact.Subject == "" {
+				report.Stats.addPhase(PhaseManifest, phaseStart, 0)
+				report.ErrorMessage = fmt.Sprintf("%s:%s is an %s", req.Repository, req.Tag, report.Artifact)
+				result.Error = share.ScanErrorCode_ScanErrNotSupport
+				return report, nil
+			}
+			tag = report.Artifact.Subject
+			if platform != nil {
+				if tag, err = resolvePlatformTag(ctx, rc, req.Repository, tag, platform); err != nil {
+					report.ErrorMessage = err.Error()
+					result.Error = share.ScanErrorCode_ScanErrNotSupport
+					return report, nil
+				}
+			}
+			info, errCode = rc.GetImageInfo(ctx, req.Repository, tag, registry.ManifestRequest_Default)
+		}
+		report.Stats.addPhase(PhaseManifest, phaseStart, 0)
 		if errCode != share.ScanErrorCode_ScanErrNone {
 			result.Error = errCode
-			return result, nil
+			return report, nil
+		}
+
+		// the sizes are of the manifest selected from a manifest list, checked before any download
+		var imageSize int64
+		for _, size := range info.Sizes {
+			imageSize += size
+		}
+		if req.MaxImageSize > 0 && imageSize > req.MaxImageSize {
+			log.WithFields(log.Fields{"size": imageSize, "max": req.MaxImageSize}).Error("Image is too big")
+			report.ErrorMessage = fmt.Sprintf("Image size %d bytes is over the limit of %d bytes", imageSize, req.MaxImageSize)
+			report.ImageSize = newImageSize(info.Layers, info.Sizes, nil)
+			result.Size = imageSize
+			result.Error = share.ScanErrorCode_ScanErrSizeOverLimit
+			return report, nil
+		}
+
+		// fail fast if the working volume can't hold the files of the image the scan writes
+		report.Stats.ScratchEstimate = estimateScratchSpace(info.Sizes)
+		if free, err := FreeSpace(); err == nil && uint64(report.Stats.ScratchEstimate) > free {
+			log.WithFields(log.Fields{"required": report.Stats.ScratchEstimate, "available": free}).Error("Insufficient disk space for the image")
+			report.ErrorMessage = fmt.Sprintf("Insufficient disk space: %d bytes required, %d bytes available", report.Stats.ScratchEstimate, free)
+			result.Error = share.ScanErrorCode_ScanErrFileSystem
+			return report, nil
 		}
 
 		// There is a download timeout inside this function
-		layerFiles, errCode = rc.DownloadRemoteImage(ctx, req.Repository, imgPath, info.Layers, info.Sizes)
+		report.Stats.progress.setLayers(info.Layers, info.Sizes)
+		phaseStart = time.Now()
+		layerFiles, errCode = downloadImageLayers(ctx, rc, req.Repository, imgPath, info.Layers, info.Sizes)
+		if errCode != share.ScanErrorCode_ScanErrNone && req.BestEffort && ctx.Err() == nil {
+			// a flaky layer fails the whole download, keep what can be downloaded
+			log.WithFields(log.Fields{"error": errCode}).Info("Download the layers one by one")
+			var lfs map[string]*scan.LayerFiles
+			if lfs, failedLayers = downloadEachLayer(ctx, rc, req.Repository, imgPath, info.Layers, info.Sizes); len(lfs) > 0 {
+				layerFiles, errCode = lfs, share.ScanErrorCode_ScanErrNone
+			}
+		}
+		report.Stats.addPhase(PhaseDownload, phaseStart, imageSize)
+		report.Stats.ScratchUsed = dirSize(imgPath)
+		if de := digestErrs.first(); de != nil {
+			// a corrupted or tampered layer fails the scan, even in the best-effort mode
+			report.ErrorMessage = de.Error()
+			result.Error = share.ScanErrorCode_ScanErrRegistryAPI
+			return report, nil
+		}
 		if errCode != share.ScanErrorCode_ScanErrNone {
 			result.Error = errCode
-			return result, nil
+			return report, nil
 		}
 
-		result.SignatureInfo, result.Error, err = getSatisfiedSignatureVerifiersForImage(rc, req, info, ctx)
+		phaseStart = time.Now()
+		result.SignatureInfo, result.Error, err = getSatisfiedSignatureVerifiersForImage(rc, &req.ScanImageRequest, info, ctx)
+		if len(req.CosignKeys) > 0 || req.Keyless != nil {
+			report.Signature = verifyImageWithKeys(ctx, rc, req.Repository, info.Digest, req.CosignKeys, req.Keyless)
+		}
+		if hasTrustVerifier(req.RootsOfTrust) {
+			report.Signature = addTrustVerifierResults(report.Signature, info.Digest, req.RootsOfTrust, result.SignatureInfo)
+		}
+		report.Stats.addPhase(PhaseSignature, phaseStart, 0)
 		if err != nil {
 			// do not return Failed scan status just because signature handling is no good
 			// return result, fmt.Errorf("error when verifying signatures for image: %s", err.Error())
 		}
 
+		// the platform picked from a manifest list and the build time are only recorded in the image config
+		phaseStart = time.Now()
+		conf, err := getImageConfig(ctx, rc, req.Repository, info.ID)
+		report.Stats.addPhase(PhaseConfig, phaseStart, 0)
+		if err == nil {
+			report.ImagePlatform = conf.platform()
+			report.ImageCreated = conf.created()
+			report.ImageAgeUnknown = report.ImageCreated == ""
+			exposedPorts = conf.exposedPorts()
+			history = conf.history()
+			report.PID1 = pid1Process(conf.Config.Entrypoint, conf.Config.Cmd)
+			conf.addLabels(info)
+		} else {
+			log.WithFields(log.Fields{"id": info.ID, "error": err}).Debug("Failed to read image config")
+		}
+		if platform != nil && report.ImagePlatform != nil && !report.ImagePlatform.matches(platform) {
+			// not a manifest list, the only platform is not the requested one
+			report.ErrorMessage = fmt.Sprintf("Image platform %s is not the requested %s", report.ImagePlatform, platform)
+			result.Error = share.ScanErrorCode_ScanErrNotSupport
+			return report, nil
+		}
+
 		layers = info.Layers
 		for _, lf := range layerFiles {
 			result.Size += lf.Size
 		}
 		result.ImageID = info.ID
 		result.Digest = info.Digest
-		log.WithFields(log.Fields{"layers": len(info.Layers), "id": info.ID, "digest": info.Digest, "size": result.Size}).Debug("scan remote image")
+		if req.SiblingTags > 0 {
+			// costs a request per tag, only when asked
+			phaseStart = time.Now()
+			if tags, err := siblingTags(ctx, rc, req.Repository, req.Tag, info.Digest, req.SiblingTags); err == nil {
+				info.RepoTags = tags
+				report.RepoTags = tags
+			} else {
+				log.WithFields(log.Fields{"repo": req.Repository, "error": err}).Info("Skip the sibling tags")
+			}
+			report.Stats.addPhase(PhaseTags, phaseStart, 0)
+		}
+		log.WithFields(log.Fields{
+			"layers": len(info.Layers), "id": info.ID, "digest": info.Digest, "size": result.Size, "platform": report.ImagePlatform,
+			"scratchEstimate": report.Stats.ScratchEstimate, "scratchUsed": report.Stats.ScratchUsed,
+		}).Debug("scan remote image")
 	} else {
 		var errCode share.ScanErrorCode
 
@@ -313,26 +506,29 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 					"base": req.BaseImage,
 				}).Error("Base image must be local if the image to be scanned is local")
 				result.Error = share.ScanErrorCode_ScanErrNotSupport
-				return result, nil
+				return report, nil
 			}
 
 			meta, errCode := cv.ScanTool.GetLocalImageMeta(ctx, baseRepo, baseTag, cv.RtSock)
 			if errCode != share.ScanErrorCode_ScanErrNone {
 				result.Error = errCode
-				return result, nil
+				return report, nil
 			}
 
 			for _, l := range meta.Layers {
 				baseLayers.Add(l)
 			}
+			baseDigest = meta.Digest
 
 			log.WithFields(log.Fields{"baseImage": req.BaseImage, "base": baseLayers, "layers": len(meta.Layers)}).Debug()
 		}
 
+		phaseStart := time.Now()
 		info, layerFiles, layers, errCode = cv.ScanTool.LoadLocalImage(ctx, req.Repository, req.Tag, cv.RtSock, imgPath)
+		report.Stats.addPhase(PhaseLocalImage, phaseStart, 0)
 		if errCode != share.ScanErrorCode_ScanErrNone {
 			result.Error = errCode
-			return result, nil
+			return report, nil
 		}
 
 		for _, lf := range layerFiles {
@@ -365,20 +561,22 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 	}
 
 	// Build a map for whole image
-	fileMap := make(map[string]string) // [path]:[file from untar layers]
-	for i := len(layers) - 1; i >= 0; i-- {
-		layerPath := filepath.Join(imgPath, layers[i])
-		if _, err := collectImageFileMap(layerPath, fileMap); err != nil {
-			log.WithFields(log.Fields{"error": err, "layer": layerPath}).Error("virtual image map")
-			break
-		}
-	}
+	phaseStart := time.Now()
+	fileMap, unmapped, mapErr := imageFileMap(imgPath, layers)
+	report.ExcludedPaths = excludeFileMap(fileMap, req.ExcludePaths)
+	excludeLayerFiles(layerFiles, req.ExcludePaths)
+	binaries := detectBinaries(fileMap)
+	report.Stats.addPhase(PhaseFileMap, phaseStart, 0)
+	report.Coverage = buildCoverage(layers, info.Sizes, layerFiles, unmapped, mapErr)
+	report.ImageSize = newImageSize(layers, info.Sizes, layerFiles)
+	report.Coverage.markFailed(failedLayers)
 
 	// parallel scanning: cve and secrets
 	done := make(chan bool, 1)
 	if req.ScanSecrets {
 		go func() {
 			log.Info("Scanning secrets ....")
+			secretStart := time.Now()
 			config := secrets.Config{
 				MiniWeight: 0.1, // Some other texts will dilute the weight, so it is better to stay at a smaller weight
 			}
@@ -391,8 +589,10 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 			}
 			envVars, _ := ioutil.ReadAll(buffers)
 			logs, perms, err := secrets.FindSecretsByFilePathMap(fileMap, envVars, config)
+			logs = append(logs, envSecretLogs(info.Envs, logs)...)
 			secret = buildSecretResult(logs, err)
 			setidPerm = buildSetIdPermLogs(perms)
+			report.Stats.addPhase(PhaseSecrets, secretStart, 0)
 			log.Info("Done secrets ....")
 			done <- true
 		}()
@@ -400,85 +600,60 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 		done <- false // bypass
 	}
 
-	// Merge file data, layer order in schema V1, the first is the latest layer
-	gotFirstCpe := false
-	mergedFiles := make(map[string]*detectors.FeatureFile)
-	mergedApps := make(map[string][]detectors.AppFeatureVersion)
-	for _, l := range info.Layers {
-		isBase := baseLayers.Contains(l)
-		if lf, ok := layerFiles[l]; ok {
-			var hasRpmPackages bool
-			for filename, _ := range lf.Pkgs {
-				if scan.RPMPkgFiles.Contains(filename) {
-					hasRpmPackages = true
-					break
-				}
-			}
-
-			for filename, data := range lf.Pkgs {
-				if _, ok := mergedFiles[filename]; !ok {
-					// for redhat CPE
-					if strings.HasPrefix(filename, contentManifest) && strings.HasSuffix(filename, ".json") {
-						if hasRpmPackages && !gotFirstCpe {
-							mergedFiles[filename] = &detectors.FeatureFile{Data: data, InBase: isBase}
-							gotFirstCpe = true
-						}
-					} else {
-						mergedFiles[filename] = &detectors.FeatureFile{Data: data, InBase: isBase}
-					}
-				}
-			}
-			for filename, apps := range lf.Apps {
-				fpath := filepath.Join("/", filename) // add "/" at its front
-				if pos := strings.Index(fpath, ":"); pos > 0 {
-					// jar: a package inside a package
-					fpath = fpath[:pos]
-				}
-
-				if _, ok := fileMap[fpath]; !ok {
-					// log.WithFields(log.Fields{"filename": fpath, "apps": apps}).Info("Ignore")
-					continue
-				}
+	mergedFiles, appFVs := mergeLayerFiles(info.Layers, layerFiles, baseLayers, fileMap)
 
-				if _, ok := mergedApps[filename]; !ok {
-					// convert AppPackage to AppFeatureVersion
-					afvs := make([]detectors.AppFeatureVersion, len(apps))
-					for i, a := range apps {
-						afvs[i] = detectors.AppFeatureVersion{
-							AppPackage: a,
-							ModuleVuls: make([]detectors.ModuleVul, 0),
-							InBase:     isBase,
-						}
-					}
-
-					mergedApps[filename] = afvs
-				}
-			}
-		}
-	}
-
-	appFVs := make([]detectors.AppFeatureVersion, 0)
-	for _, afvs := range mergedApps {
-		appFVs = append(appFVs, afvs...)
-	}
-
-	namespace, serr, vuls, features, apps := cv.doScan(&layerScanFiles{pkgs: mergedFiles, apps: appFVs}, nil)
+	aliases := make(map[string][]string)
+	merged := &layerScanFiles{pkgs: mergedFiles, apps: appFVs, binaries: binaries, stats: report.Stats, aliases: aliases}
+	namespace, serr, vuls, features, apps, notes := cv.doScan(merged, nil)
+	merged.db.stamp(result)
+	report.db = merged.db
+	report.Coverage.Notes = append(report.Coverage.Notes, notes...)
 	if namespace != nil {
 		result.Namespace = namespace.Name
 		result.Modules = feature2Module(namespace.Name, features, apps)
+		report.Locations = moduleLocations(namespace.Name, features, apps)
 	}
 	result.Error = serr
 	result.Vuls = vuls
+	if len(aliases) > 0 {
+		report.Aliases = aliases
+	}
+	reportFindings(ctx, report)
+	if result.Namespace == "" {
+		report.Coverage.Notes = append(report.Coverage.Notes, "no supported OS detected, OS packages are not matched")
+	}
 	result.Author = info.Author
 	result.Envs = info.Envs
 	result.Labels = info.Labels
 	result.Cmds = info.Cmds
+	if len(history) != len(info.Cmds) {
+		history = info.Cmds
+	}
+	report.Checks = imageChecks(history, info.Labels, info.RawManifest, exposedPorts)
+	if req.Misconfig {
+		report.Checks = append(report.Checks, referenceChecks(req.Registry, req.Repository, req.Tag, result.Digest, req.BaseImage, baseDigest, info.Labels, info.RawManifest)...)
+		report.Checks = append(report.Checks, initCheck(report.PID1)...)
+	}
+	if IsStaleImage(report, req.MaxImageAge) {
+		report.Checks = append(report.Checks, staleImageCheck(report.ImageCreated, req.MaxImageAge))
+	}
 
 	// scan layer
 	if serr == share.ScanErrorCode_ScanErrNone && scanLayers {
+		phaseStart = time.Now()
+		// a digest repeated in the image is scanned once, each occurrence keeps its own layer result
+		scannedLayers := make(map[string][]*share.ScanVulnerability)
 		for i := len(info.Layers) - 1; i >= 0; i-- {
 			layer := info.Layers[i]
-			if layer == "" {
+			if scanned, ok := scannedLayers[layer]; ok && layer != "" {
+				lf := layerFiles[layer]
+				result.Layers[i] = &share.ScanLayerResult{
+					Digest: layer,
+					Vuls:   append(make([]*share.ScanVulnerability, 0, len(scanned)), scanned...),
+					Cmds:   info.Cmds[i],
+					Size:   lf.Size,
+				}
+			} else if layer == "" {
 				// This could be empty layers of local images
 				l := &share.ScanLayerResult{
 					Digest: layer,
@@ -508,7 +683,7 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 						}
 						appFVs = append(appFVs, afvs...)
 					}
-					_, _, vuls, _, _ = cv.doScan(&layerScanFiles{pkgs: files, apps: appFVs}, namespace)
+					_, _, vuls, _, _, _ = cv.doScan(&layerScanFiles{pkgs: files, apps: appFVs}, namespace)
 					l := &share.ScanLayerResult{
 						Digest: layer,
 						Vuls:   vuls,
@@ -516,6 +691,7 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 						Size:   lf.Size,
 					}
 					result.Layers[i] = l
+					scannedLayers[layer] = vuls
 					log.WithFields(log.Fields{"vuls": len(vuls), "layer": layer}).Debug("scan layer done")
 				} else {
 					l := &share.ScanLayerResult{
@@ -525,11 +701,18 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 						Size:   lf.Size,
 					}
 					result.Layers[i] = l
+					scannedLayers[layer] = l.Vuls
 				}
 			} else {
 				log.WithFields(log.Fields{"layer": layer}).Error("layer not found")
+				result.Layers[i] = &share.ScanLayerResult{
+					Digest: layer,
+					Vuls:   make([]*share.ScanVulnerability, 0),
+					Cmds:   info.Cmds[i],
+				}
 			}
 		}
+		report.Stats.addPhase(PhaseLayers, phaseStart, 0)
 	}
 
 	log.Info("Done cve ....")
@@ -579,19 +762,29 @@ func (cv *CveTools) ScanImage(ctx context.Context, req *share.ScanImageRequest,
 		}
 	}
 
+	// an incomplete scan is not reported as a pass in strict mode
+	if req.Strict && result.Error == share.ScanErrorCode_ScanErrNone && !report.Coverage.Complete {
+		log.WithFields(log.Fields{"id": info.ID, "skipped": report.Coverage.Skipped}).Error("Incomplete scan")
+		report.ErrorMessage = fmt.Sprintf("Incomplete scan, %d layers skipped or partially scanned", report.Coverage.Skipped)
+		result.Error = share.ScanErrorCode_ScanErrFileSystem
+	}
+
+	if req.Compliance == ComplianceCISDocker && result.Error == share.ScanErrorCode_ScanErrNone {
+		report.Compliance = cisDockerCompliance(report, req)
+	}
+
 	// bs, _ := json.Marshal(result)
 	// fmt.Println(string(bs[:]))
 
-	return result, nil
+	return report, nil
 }
 
 // ScanAwsLambda helps the AWS Lambda scanning
 func (cv *CveTools) ScanAwsLambda(req *share.ScanAwsLambdaRequest, imgPath string) (*share.ScanResult, error) {
 	result := &share.ScanResult{
-		Provider:        share.ScanProvider_Neuvector,
-		Version:         cv.CveDBVersion,
-		CVEDBCreateTime: cv.CveDBCreateTime,
+		Provider: share.ScanProvider_Neuvector,
 	}
+	defer cv.SetDBVersion(result)
 
 	uid := uuid.New().String()
 	filename := fmt.Sprintf("/tmp/%s-%s-%s.zip", req.Region, req.FuncName, uid)
@@ -609,7 +802,7 @@ func (cv *CveTools) ScanAwsLambda(req *share.ScanAwsLambdaRequest, imgPath strin
 		// for scan Secrets
 		if imgPath == "" { // not-defined yet
 			imgPath = CreateImagePath("")
-			defer os.RemoveAll(imgPath)
+			defer RemoveImagePath(imgPath)
 		}
 
 		if err := utils.Unzip(filename, imgPath); err != nil {
@@ -658,19 +851,47 @@ func (cv *CveTools) ScanAwsLambda(req *share.ScanAwsLambdaRequest, imgPath strin
 
 var releaseRegexp = regexp.MustCompile(`^([a-z-]+):([0-9.]+)`)
 
-func (cv *CveTools) doScan(layerFiles *layerScanFiles, imageNs *detectors.Namespace) (*detectors.Namespace, share.ScanErrorCode, []*share.ScanVulnerability, []detectors.FeatureVersion, []detectors.AppFeatureVersion) {
+// doScan matches the packages with the databases, the notes tell how the packages of more than one OS are handled
+func (cv *CveTools) doScan(layerFiles *layerScanFiles, imageNs *detectors.Namespace) (*detectors.Namespace, share.ScanErrorCode, []*share.ScanVulnerability, []detectors.FeatureVersion, []detectors.AppFeatureVersion, []string) {
+	phaseStart := time.Now()
 	features, namespace, apps, serr := cv.getFeatures(layerFiles, imageNs)
+	layerFiles.stats.addPhase(PhasePackages, phaseStart, 0)
 
 	var ns detectors.Namespace
 	if namespace != nil {
 		ns = *namespace
 	}
 	if serr != share.ScanErrorCode_ScanErrNone {
-		return namespace, serr, nil, nil, nil
+		return namespace, serr, nil, nil, nil, nil
+	}
+
+	groups, notes := splitOSFeatures(features, ns.Name, detectors.DetectAllNamespaces(layerFiles.pkgs))
+	phaseStart = time.Now()
+	defer layerFiles.stats.addPhase(PhaseMatching, phaseStart, 0)
+
+	// the scans share the parsed tables, the database is not replaced while they match
+	cv.UpdateMux.RLock()
+	defer cv.UpdateMux.RUnlock()
+	h := cv.scanDB()
+	layerFiles.db = h
+	errCode, vuls := cv.startScan(h, groups[0].features, ns.Name, apps, layerFiles.aliases)
+	features = groups[0].features
+	for _, g := range groups[1:] {
+		if g.namespace != "" && errCode == share.ScanErrorCode_ScanErrNone {
+			log.WithFields(log.Fields{"detector": g.detector, "namespace": g.namespace, "features": len(g.features)}).Info("Scan packages of another OS")
+			// the packages of the image OS are matched, a failure of another OS is noted instead of failing them
+			if gerr, gvuls := cv.startScan(h, g.features, g.namespace, nil, layerFiles.aliases); gerr == share.ScanErrorCode_ScanErrNone {
+				vuls = append(vuls, gvuls...)
+			} else {
+				log.WithFields(log.Fields{"namespace": g.namespace, "error": gerr}).Error("Failed to scan packages of another OS")
+				notes = append(notes, fmt.Sprintf("%d packages of the %s database are not matched, the scan of %s failed: %s",
+					len(g.features), g.detector, g.namespace, scan.ScanErrorToStr(gerr)))
+			}
+		}
+		features = append(features, g.features...)
 	}
-
-	errCode, vuls := cv.startScan(features, ns.Name, apps)
-	return namespace, errCode, vuls, features, apps
+	layerFiles.stats.setFindings(len(vuls))
+	return namespace, errCode, vuls, features, apps, notes
 }
 
 func os2DB(nsName string) (string, int) {
@@ -727,11 +948,12 @@ func os2DB(nsName string) (string, int) {
 	return nsName, db
 }
 
-func (cv *CveTools) startScan(features []detectors.FeatureVersion, nsName string, appPkg []detectors.AppFeatureVersion) (share.ScanErrorCode, []*share.ScanVulnerability) {
+// startScan matches the packages of the OS and the application modules with the database, UpdateMux must be
+// read locked
+func (cv *CveTools) startScan(h *DBHandle, features []detectors.FeatureVersion, nsName string, appPkg []detectors.AppFeatureVersion, aliases map[string][]string) (share.ScanErrorCode, []*share.ScanVulnerability) {
 	var db int
 	var vss []common.VulShort
 	var vfs map[string]common.VulFull
-	var err error
 
 	nsName, db = os2DB(nsName)
 	if db == common.DBMax {
@@ -739,24 +961,12 @@ func (cv *CveTools) startScan(features []detectors.FeatureVersion, nsName string
 		return share.ScanErrorCode_ScanErrNone, make([]*share.ScanVulnerability, 0)
 	}
 
-	cv.UpdateMux.Lock()
-	defer cv.UpdateMux.Unlock()
-
-	if common.DBS.Buffers[db].Short == nil {
-		common.DBS.Buffers[db].Short, err = common.LoadVulnerabilityIndex(cv.TbPath, common.DBS.Buffers[db].Name)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Load Database error:", common.DBS.Buffers[db].Name)
-			return share.ScanErrorCode_ScanErrDatabase, nil
-		}
-		common.DBS.Buffers[db].Full, err = common.LoadFullVulnerabilities(cv.TbPath, common.DBS.Buffers[db].Name)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Load full Database error:", common.DBS.Buffers[db].Name)
-			return share.ScanErrorCode_ScanErrDatabase, nil
-		}
+	tables, err := h.osTables(db)
+	if err != nil {
+		return share.ScanErrorCode_ScanErrDatabase, nil
 	}
-
-	vss = common.DBS.Buffers[db].Short
-	vfs = common.DBS.Buffers[db].Full
+	vss = tables.short
+	vfs = tables.full
 
 	log.WithFields(log.Fields{"db": common.DBS.Buffers[db].Name, "namespace": nsName, "short": len(vss), "full": len(vfs)}).Info("Load Database")
 
@@ -774,12 +984,12 @@ func (cv *CveTools) startScan(features []detectors.FeatureVersion, nsName string
 
 		// get the full vulneribility description from full database
 		vuls = getFullAffectedVul(avsr, vfs)
-		vulList = append(vulList, getVulItemList(vuls, common.DBS.Buffers[db].Name)...)
+		vulList = append(vulList, getVulItemList(vuls, common.DBS.Buffers[db].Name, aliases)...)
 	}
 
 	if len(appPkg) != 0 {
-		appvuls := cv.DetectAppVul(cv.TbPath, appPkg, nsName)
-		vulList = append(vulList, getVulItemList(appvuls, common.DBAppName)...)
+		appvuls := detectAppVul(h, appPkg, nsName)
+		vulList = append(vulList, getVulItemList(appvuls, common.DBAppName, aliases)...)
 	}
 
 	return share.ScanErrorCode_ScanErrNone, vulList
@@ -812,6 +1022,8 @@ func getFullAffectedVul(avs []vulShortReport, vfs map[string]common.VulFull) []v
 		kname := fmt.Sprintf("%s:%s", short.Vs.Namespace, name)
 		vf, ok := vfs[kname]
 		if ok {
+			// the table is shared by the scans, the fixed versions are appended to a copy
+			vf.FixedIn = append([]common.FeaFull(nil), vf.FixedIn...)
 			for _, fts := range short.Vs.Fixin {
 				vf.FixedIn = append(vf.FixedIn, common.FeaFull{
 					Name: fts.Name, Namespace: vf.Namespace, Version: fts.Version, MinVer: fts.MinVer, AddedBy: "",
@@ -827,13 +1039,16 @@ func getFullAffectedVul(avs []vulShortReport, vfs map[string]common.VulFull) []v
 func getAffectedVul(mv map[string][]common.VulShort, features []detectors.FeatureVersion, namespace string) []vulShortReport {
 	avs := make([]vulShortReport, 0)
 
+	// the packages are matched in parallel, the results are collected in the order of the packages
+	affected := make([][]common.VulShort, len(features))
+	parallelMatch(len(features), func(i int) {
+		affected[i], features[i].ModuleVuls = searchAffectedFeature(mv, namespace, features[i])
+	})
 	for i, ft := range features {
-		vs, mc := searchAffectedFeature(mv, namespace, ft)
-		for _, v := range vs {
+		for _, v := range affected[i] {
 			vsr := vulShortReport{Vs: v, Ft: ft}
 			avs = append(avs, vsr)
 		}
-		features[i].ModuleVuls = mc
 	}
 	return avs
 }
@@ -885,6 +1100,9 @@ func (cv *CveTools) getFeatures(layerFiles *layerScanFiles, imageNs *detectors.N
 		}
 	}
 
+	// the binaries installed without the package manager are matched by their version
+	layerFiles.apps = append(layerFiles.apps, bypassedBinaries(layerFiles.binaries, features)...)
+
 	log.WithFields(log.Fields{"apps": len(layerFiles.apps), "features": len(features), "namespace": namespace}).Debug()
 	return features, namespace, layerFiles.apps, share.ScanErrorCode_ScanErrNone
 }
@@ -1140,7 +1358,9 @@ func (s *sorter) Less(i, j int) bool {
 	return s.by(s.vulnerabilities[i], s.vulnerabilities[j])
 }
 
-func getVulItemList(vuls []vulFullReport, dbPrefix string) []*share.ScanVulnerability {
+// getVulItemList converts the vulnerabilities found to the result, the aliases of the database are added to
+// the map by the DB keys if it is not nil
+func getVulItemList(vuls []vulFullReport, dbPrefix string, aliases map[string][]string) []*share.ScanVulnerability {
 	vulnerabilities := make([]vulnerabilityInfo, 0)
 	vulList := make([]*share.ScanVulnerability, 0)
 	if len(vuls) == 0 {
@@ -1250,6 +1470,10 @@ func getVulItemList(vuls []vulFullReport, dbPrefix string) []*share.ScanVulnerab
 			item.CVEs = []string{v.Name}
 		}
 
+		if aliases != nil && len(v.Aliases) > 0 {
+			aliases[item.DBKey] = v.Aliases
+		}
+
 		if dbPrefix == common.DBAppName {
 			item.FileName = featver.File
 			item.PackageNameDeprecated = featver.File // backward compatible. Release <=5.2 returns filename as the package name.
@@ -1282,6 +1506,9 @@ func feature2Module(namespace string, features []detectors.FeatureVersion, apps
 
 	for _, f := range features {
 		m := &share.ScanModule{Name: f.Package, Version: f.Version.String(), Source: namespace}
+		if f.Namespace != "" {
+			m.Source = f.Namespace
+		}
 		for _, mv := range f.ModuleVuls {
 			cve := &share.ScanModuleVul{Name: mv.Name, Status: mv.Status}
 			m.Vuls = append(m.Vuls, cve)
@@ -1316,6 +1543,42 @@ func feature2Module(namespace string, features []detectors.FeatureVersion, apps
 	return modules
 }
 
+// moduleLocations lists every file a module was found in, the modules are not deduplicated
+// across the files, so that each copy of a module can be told apart
+func moduleLocations(namespace string, features []detectors.FeatureVersion, apps []detectors.AppFeatureVersion) []*ModuleLocation {
+	locs := make([]*ModuleLocation, 0, len(features)+len(apps))
+	dedup := utils.NewSet()
+	add := func(name, version, source, path string) {
+		key := fmt.Sprintf("%s-%s-%s-%s", source, name, version, path)
+		if !dedup.Contains(key) {
+			dedup.Add(key)
+			locs = append(locs, &ModuleLocation{Name: name, Version: version, Source: source, Path: path})
+		}
+	}
+
+	for _, f := range features {
+		source := namespace
+		if f.Namespace != "" {
+			source = f.Namespace
+		}
+		add(f.Package, f.Version.String(), source, f.File)
+	}
+	for _, app := range apps {
+		add(app.ModuleName, app.Version, app.AppName, app.FileName)
+	}
+
+	sort.Slice(locs, func(i, j int) bool {
+		if locs[i].Name != locs[j].Name {
+			return locs[i].Name < locs[j].Name
+		}
+		if locs[i].Version != locs[j].Version {
+			return locs[i].Version < locs[j].Version
+		}
+		return locs[i].Path < locs[j].Path
+	})
+	return locs
+}
+
 func buildSecretResult(logs []share.CLUSSecretLog, err error) *share.ScanSecretResult {
 	res := &share.ScanSecretResult{
 		Error: share.ScanErrorCode_ScanErrNone,
@@ -1370,26 +1633,28 @@ func buildSetIdPermLogs(perms []share.CLUSSetIdPermLog) []*share.ScanSetIdPermLo
 	return permLogs
 }
 
+func hasTrustVerifier(roots []*share.SigstoreRootOfTrust) bool {
+	for _, t := range roots {
+		if len(t.Verifiers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func getSatisfiedSignatureVerifiersForImage(rc *scan.RegClient, req *share.ScanImageRequest, info *scan.ImageInfo,
 	ctx context.Context) (*share.ScanSignatureInfo, share.ScanErrorCode, error) {
 
 	sigInfo := &share.ScanSignatureInfo{
 		VerificationTimestamp: time.Now().UTC().Format(time.RFC3339),
 	}
-	hasVerifier := false
-	for _, t := range req.RootsOfTrust {
-		if len(t.Verifiers) > 0 {
-			hasVerifier = true
-			break
-		}
-	}
-	if !hasVerifier {
+	if !hasTrustVerifier(req.RootsOfTrust) {
 		return sigInfo, share.ScanErrorCode_ScanErrNone, nil
 	}
 
 	log.WithFields(log.Fields{"imageDigest": info.Digest}).Info("Fetching signature data for image ...")
 
-	signatureData, errCode := rc.GetSignatureDataForImage(ctx, req.Repository, info.Digest)
+	signatureData, errCode := getSignatureData(ctx, rc, req.Repository, info.Digest)
 	if errCode != share.ScanErrorCode_ScanErrNone {
 		sigInfo.VerificationError = errCode
 		if errCode == share.ScanErrorCode_ScanErrImageNotFound {
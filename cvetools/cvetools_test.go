@@ -4,7 +4,9 @@ import (
 	"testing"
 
 	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/utils"
 	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/detectors"
 )
 
 const testTmpPath = "/tmp/scanner_test/"
@@ -73,3 +75,35 @@ func TestSelectDB(t *testing.T) {
 		}
 	}
 }
+
+func TestModuleLocations(t *testing.T) {
+	ver, _ := utils.NewVersion("1.2.11")
+	features := []detectors.FeatureVersion{
+		{Package: "zlib", Version: ver, File: "/var/lib/dpkg/status"},
+	}
+	apps := []detectors.AppFeatureVersion{
+		{AppPackage: scan.AppPackage{AppName: "npm", ModuleName: "lodash", Version: "4.17.4", FileName: "/app/b/node_modules/lodash/package.json"}},
+		{AppPackage: scan.AppPackage{AppName: "npm", ModuleName: "lodash", Version: "4.17.4", FileName: "/app/a/node_modules/lodash/package.json"}},
+		{AppPackage: scan.AppPackage{AppName: "npm", ModuleName: "lodash", Version: "4.17.4", FileName: "/app/a/node_modules/lodash/package.json"}},
+		{AppPackage: scan.AppPackage{AppName: "jar", ModuleName: "log4j", Version: "2.14", FileName: "/app/x.war:WEB-INF/lib/log4j.jar"}},
+	}
+
+	locs := moduleLocations("debian:10", features, apps)
+	expect := []string{
+		"lodash /app/a/node_modules/lodash/package.json",
+		"lodash /app/b/node_modules/lodash/package.json",
+		"log4j /app/x.war:WEB-INF/lib/log4j.jar",
+		"zlib /var/lib/dpkg/status",
+	}
+	if len(locs) != len(expect) {
+		t.Fatalf("Incorrect locations: %+v", locs)
+	}
+	for i, l := range locs {
+		if s := l.Name + " " + l.Path; s != expect[i] {
+			t.Errorf("Incorrect location at %d: %s, expect %s", i, s, expect[i])
+		}
+	}
+	if locs[3].Source != "debian:10" {
+		t.Errorf("Incorrect source: %s", locs[3].Source)
+	}
+}
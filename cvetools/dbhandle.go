@@ -0,0 +1,111 @@
+package cvetools
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/scanner/common"
+)
+
+// osTables are the vulnerabilities of an OS in the database
+type osTables struct {
+	short []common.VulShort
+	full  map[string]common.VulFull
+}
+
+// DBHandle is the CVE database shared by the scans of the process. A table is parsed the first time a scan
+// needs it and kept until the database is replaced, the scans don't read the database files again. The scans
+// match with UpdateMux read locked, a new database replaces the handle once they are done, and the tables of
+// the replaced handle are released with it.
+type DBHandle struct {
+	Version    string
+	CreateTime string
+	Sources    string // the hash of the sources of a merged database, see common.LoadedDbSources
+
+	path      string
+	tables    [common.DBMax]lazyTables
+	appsMutex sync.Mutex
+	apps      map[string][]common.AppModuleVul
+}
+
+// lazyTables are the tables of an OS, parsed by the first scan needing them, the scans of the other OSes
+// don't wait for it
+type lazyTables struct {
+	mutex  sync.Mutex
+	tables *osTables
+}
+
+func newDBHandle(path, version, createTime, sources string) *DBHandle {
+	return &DBHandle{Version: version, CreateTime: createTime, Sources: sources, path: path}
+}
+
+// SwapDB replaces the database of the scans, called with UpdateMux locked once the database files are replaced.
+// The tables of the new database are parsed when the scans need them.
+func (cv *CveTools) SwapDB(version, createTime string) {
+	cv.CveDBVersion = version
+	cv.CveDBCreateTime = createTime
+	cv.CveDBSources = common.LoadedDbSources(cv.TbPath)
+
+	cv.dbMutex.Lock()
+	cv.db = newDBHandle(cv.TbPath, version, createTime, cv.CveDBSources)
+	cv.dbMutex.Unlock()
+}
+
+// CurrentDB returns the database of the scans, nil before it is loaded. A new handle replaces it when the
+// database is updated.
+func (cv *CveTools) CurrentDB() *DBHandle {
+	cv.dbMutex.Lock()
+	defer cv.dbMutex.Unlock()
+	return cv.db
+}
+
+// scanDB returns the database of the scans. UpdateMux must be read locked as long as the handle is used, so
+// the database files are not replaced while the tables are parsed.
+func (cv *CveTools) scanDB() *DBHandle {
+	cv.dbMutex.Lock()
+	defer cv.dbMutex.Unlock()
+	if cv.db == nil {
+		cv.db = newDBHandle(cv.TbPath, cv.CveDBVersion, cv.CveDBCreateTime, cv.CveDBSources)
+	}
+	return cv.db
+}
+
+// osTables returns the tables of the OS, parsed on the first use
+func (h *DBHandle) osTables(db int) (*osTables, error) {
+	lt := &h.tables[db]
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	if lt.tables != nil {
+		return lt.tables, nil
+	}
+
+	name := common.DBS.Buffers[db].Name
+	short, err := common.LoadVulnerabilityIndex(h.path, name)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Load Database error:", name)
+		return nil, err
+	}
+	full, err := common.LoadFullVulnerabilities(h.path, name)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Load full Database error:", name)
+		return nil, err
+	}
+	lt.tables = &osTables{short: short, full: full}
+	return lt.tables, nil
+}
+
+// appVuls returns the vulnerabilities of the application modules, parsed on the first use
+func (h *DBHandle) appVuls() (map[string][]common.AppModuleVul, error) {
+	h.appsMutex.Lock()
+	defer h.appsMutex.Unlock()
+	if h.apps != nil {
+		return h.apps, nil
+	}
+	apps, err := common.LoadAppVulsTb(h.path)
+	if err != nil {
+		return nil, err
+	}
+	h.apps = apps
+	return apps, nil
+}
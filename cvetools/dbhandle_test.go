@@ -0,0 +1,89 @@
+package cvetools
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/utils"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/detectors"
+)
+
+func TestSharedDB(t *testing.T) {
+	writeTables := func(dir, severity string) {
+		short, _ := json.Marshal(common.VulShort{Name: "CVE-2022-0001", Namespace: "debian:11", Fixin: []common.FeaShort{{Name: "openssl", Version: "1.2"}}})
+		full, _ := json.Marshal(common.VulFull{Name: "CVE-2022-0001", Namespace: "debian:11", Severity: severity})
+		app, _ := json.Marshal(common.AppModuleVul{
+			VulName: "CVE-2022-0002", AppName: "npm", ModuleName: "lodash", Severity: severity,
+			AffectedVer: []common.AppModuleVersion{{OpCode: "lt", Version: "4.17.21"}},
+		})
+		ioutil.WriteFile(filepath.Join(dir, "debian_index.tb"), append(short, '\n'), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "debian_full.tb"), append(full, '\n'), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "apps.tb"), append(app, '\n'), 0644)
+	}
+	match := func(cv *CveTools) []*share.ScanVulnerability {
+		features := []detectors.FeatureVersion{{Package: "openssl"}}
+		features[0].Version, _ = utils.NewVersion("1.1")
+		apps := []detectors.AppFeatureVersion{{AppPackage: scan.AppPackage{AppName: "npm", ModuleName: "lodash", Version: "4.17.15"}}}
+		cv.UpdateMux.RLock()
+		defer cv.UpdateMux.RUnlock()
+		_, vuls := cv.startScan(cv.scanDB(), features, "debian:11", apps, nil)
+		return vuls
+	}
+
+	dir := t.TempDir()
+	writeTables(dir, "High")
+	cv := NewCveTools("", nil)
+	cv.TbPath = dir
+	cv.SwapDB("1.000", "2022-01-02T00:00:00Z")
+
+	reads := common.DbFileReads()
+	if vuls := match(cv); len(vuls) != 2 || vuls[0].Severity != "High" {
+		t.Fatalf("Incorrect vulnerabilities: %+v", vuls)
+	}
+	first := common.DbFileReads() - reads
+	reads = common.DbFileReads()
+	if vuls := match(cv); len(vuls) != 2 {
+		t.Errorf("Incorrect vulnerabilities of the second scan: %+v", vuls)
+	}
+	t.Logf("Database files read: %d by the first scan, %d by the second", first, common.DbFileReads()-reads)
+	if first == 0 || common.DbFileReads() != reads {
+		t.Errorf("The second scan read %d database files", common.DbFileReads()-reads)
+	}
+
+	// a table being parsed doesn't hold the other ones
+	h := cv.CurrentDB()
+	h.tables[common.DBDebian].mutex.Lock()
+	parsed := make(chan struct{})
+	go func() {
+		h.osTables(common.DBAlpine)
+		h.appVuls()
+		close(parsed)
+	}()
+	select {
+	case <-parsed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The tables wait for the parse of another OS")
+	}
+	h.tables[common.DBDebian].mutex.Unlock()
+
+	// the scans use the new database once it is swapped
+	writeTables(dir, "Medium")
+	cv.UpdateMux.Lock()
+	cv.SwapDB("2.000", "2022-02-02T00:00:00Z")
+	cv.UpdateMux.Unlock()
+	if vuls := match(cv); len(vuls) != 2 || vuls[0].Severity != "Medium" || vuls[1].Severity != "Medium" {
+		t.Errorf("Incorrect vulnerabilities of the new database: %+v", vuls)
+	}
+	if cv.CurrentDB() == h {
+		t.Errorf("The database is not replaced")
+	}
+	if ver, _ := cv.DBVersion(); ver != "2.000" {
+		t.Errorf("Incorrect database version: %s", ver)
+	}
+}
@@ -0,0 +1,154 @@
+package cvetools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	goDigest "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+// blobPath matches the blob requests of the registry API, the digest is the last element
+var blobPath = regexp.MustCompile(`/v2/.+/blobs/([a-z0-9]+:[a-f0-9]+)$`)
+
+// DigestError is a downloaded blob whose content doesn't match its digest, corrupted or tampered on the way
+type DigestError struct {
+	Expected goDigest.Digest
+	Actual   goDigest.Digest
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("Layer %s does not match its digest, the content is %s", e.Expected, e.Actual)
+}
+
+type digestErrorsKey struct{}
+
+// digestErrors collects the digest mismatches of the blobs downloaded for a scan
+type digestErrors struct {
+	mutex  sync.Mutex
+	errors []*DigestError
+}
+
+// withDigestErrors returns the context to collect the digest mismatches of its registry requests
+func withDigestErrors(ctx context.Context) (context.Context, *digestErrors) {
+	de := &digestErrors{}
+	return context.WithValue(ctx, digestErrorsKey{}, de), de
+}
+
+func (de *digestErrors) add(err *DigestError) {
+	de.mutex.Lock()
+	defer de.mutex.Unlock()
+	de.errors = append(de.errors, err)
+}
+
+// first returns the first mismatch, nil if none
+func (de *digestErrors) first() *DigestError {
+	de.mutex.Lock()
+	defer de.mutex.Unlock()
+	if len(de.errors) == 0 {
+		return nil
+	}
+	return de.errors[0]
+}
+
+// digestTransport verifies the blobs downloaded from the registry against their digests. The vendored
+// registry client extracts a layer straight from the response without checking it, and doesn't always read
+// it to the end, so the body is hashed into a temporary file and only given to the client once verified.
+// The layers of a scan are streamed instead, see streamedBody.
+type digestTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *digestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	dg := blobDigest(req)
+	if dg == "" {
+		return resp, nil
+	}
+
+	var body io.ReadCloser
+	if ls, ok := req.Context().Value(layerStreamsKey{}).(*layerStreams); ok {
+		body, err = streamedBody(req, resp.Body, dg, start, progressFromContext(req.Context()), ls)
+		resp.ContentLength = -1
+	} else {
+		var n int64
+		if body, n, err = verifiedBody(resp.Body, dg, progressFromContext(req.Context())); err == nil {
+			scanStatsFromContext(req.Context()).addLayer(string(dg), start, n)
+		}
+	}
+	if err != nil {
+		if de, ok := err.(*DigestError); ok {
+			reportDigestError(req, de)
+		}
+		return nil, err
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// reportDigestError logs the mismatch and records it for the scan of the request
+func reportDigestError(req *http.Request, de *DigestError) {
+	log.WithFields(log.Fields{"expected": de.Expected, "actual": de.Actual, "url": req.URL.Host}).Error("Layer digest mismatch")
+	if c, ok := req.Context().Value(digestErrorsKey{}).(*digestErrors); ok {
+		c.add(de)
+	}
+}
+
+// blobDigest returns the digest of a blob request, or of the blob request redirected to the storage
+func blobDigest(req *http.Request) goDigest.Digest {
+	for r := req; r != nil; r = r.Response.Request {
+		if m := blobPath.FindStringSubmatch(r.URL.Path); m != nil {
+			if dg := goDigest.Digest(m[1]); dg.Validate() == nil {
+				return dg
+			}
+			return ""
+		}
+		if r.Response == nil {
+			break
+		}
+	}
+	return ""
+}
+
+// verifiedBody copies the body into a work file while hashing it, the file and its size are returned as
+// the body if the content matches the digest. Its space is freed when it is closed or garbage collected.
+// The bytes of a layer are counted as they come for the progress of the scan, pt can be nil.
+func verifiedBody(body io.ReadCloser, dg goDigest.Digest, pt *progressTracker) (io.ReadCloser, int64, error) {
+	defer body.Close()
+
+	f, err := workFile(".blob-")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	digester := dg.Algorithm().Digester()
+	w := io.MultiWriter(f, digester.Hash())
+	if pt != nil {
+		pt.start(string(dg))
+		w = io.MultiWriter(w, &progressWriter{pt: pt, digest: string(dg)})
+	}
+	n, err := io.Copy(w, body)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if actual := digester.Digest(); actual != dg {
+		f.Close()
+		return nil, 0, &DigestError{Expected: dg, Actual: actual}
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	pt.add(string(dg), 0, true)
+	return f, n, nil
+}
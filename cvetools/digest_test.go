@@ -0,0 +1,49 @@
+package cvetools
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	goDigest "github.com/opencontainers/go-digest"
+)
+
+func TestLayerDigestVerification(t *testing.T) {
+	layer := []byte("layer content")
+	good := goDigest.FromBytes(layer)
+	tampered := goDigest.FromString("original content")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/blobs/" + good.String():
+			// redirected to the storage, as most registries do
+			http.Redirect(w, r, "/storage/"+good.Encoded(), http.StatusTemporaryRedirect)
+		case "/storage/" + good.Encoded(), "/v2/app/blobs/" + tampered.String():
+			w.Write(layer)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	rc := newRegClient(srv.URL, "", "", "", "")
+	ctx, digestErrs := withDigestErrors(context.Background())
+	rd, _, err := rc.DownloadLayer(ctx, "app", good)
+	if err != nil {
+		t.Fatalf("Failed to download the layer: %v", err)
+	}
+	data, _ := ioutil.ReadAll(rd)
+	rd.Close()
+	if !bytes.Equal(data, layer) || digestErrs.first() != nil {
+		t.Errorf("Incorrect layer: %s, %v", data, digestErrs.first())
+	}
+
+	if _, _, err = rc.DownloadLayer(ctx, "app", tampered); err == nil {
+		t.Errorf("Tampered layer accepted")
+	}
+	if de := digestErrs.first(); de == nil || de.Expected != tampered || de.Actual != good {
+		t.Errorf("Incorrect digest error: %+v", de)
+	}
+}
@@ -0,0 +1,151 @@
+package cvetools
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+// ExcludedPaths are the files of the image excluded from the scan by a pattern of the request
+type ExcludedPaths struct {
+	Pattern string   `json:"Pattern"`
+	Files   int      `json:"Files"`
+	Paths   []string `json:"Paths,omitempty"` // the first ones in order, up to maxExcludedPaths
+}
+
+// the excluded paths listed in the report of each pattern
+const maxExcludedPaths = 20
+
+type excludePathsKey struct{}
+
+// withExcludePaths returns the context to exclude the files from the streamed layers
+func withExcludePaths(ctx context.Context, patterns []string) context.Context {
+	if len(patterns) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, excludePathsKey{}, patterns)
+}
+
+func excludePathsFromContext(ctx context.Context) []string {
+	patterns, _ := ctx.Value(excludePathsKey{}).([]string)
+	return patterns
+}
+
+// ValidateExcludePaths checks the syntax of the patterns of the excluded paths
+func ValidateExcludePaths(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			return fmt.Errorf("Empty exclude path")
+		}
+		for _, elem := range strings.Split(pattern, "/") {
+			if _, err := path.Match(elem, ""); err != nil {
+				return fmt.Errorf("Invalid exclude path %s: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchExcludePath tells if the file, an absolute path in the image, is excluded by the pattern. The
+// elements of the pattern are matched as by path.Match, "**" matches any number of folders, and a
+// pattern matches the files under the folders it matches too. A pattern without a leading "/" matches
+// at any depth, like node_modules/*/test.
+func matchExcludePath(pattern, file string) bool {
+	if !strings.HasPrefix(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return matchElems(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(file, "/"), "/"))
+}
+
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	// the files under the matched folder
+	return true
+}
+
+// isExcludedPath tells if a pattern excludes the file, as the layers name it, without the leading "/"
+func isExcludedPath(patterns []string, file string) bool {
+	for _, pattern := range patterns {
+		if matchExcludePath(pattern, "/"+file) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeFileMap removes the excluded files from the file map of the image, so the binaries, the secrets
+// and the applications of the files are not scanned. It returns the files excluded by each pattern, a file
+// is counted for the first pattern excluding it.
+func excludeFileMap(fileMap map[string]string, patterns []string) []*ExcludedPaths {
+	if len(patterns) == 0 {
+		return nil
+	}
+	excluded := make([]*ExcludedPaths, len(patterns))
+	for i, pattern := range patterns {
+		excluded[i] = &ExcludedPaths{Pattern: pattern}
+	}
+	files := make([]string, 0, len(fileMap))
+	for file := range fileMap {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		for i, pattern := range patterns {
+			if matchExcludePath(pattern, file) {
+				delete(fileMap, file)
+				if excluded[i].Files++; len(excluded[i].Paths) < maxExcludedPaths {
+					excluded[i].Paths = append(excluded[i].Paths, file)
+				}
+				break
+			}
+		}
+	}
+	return excluded
+}
+
+// excludeLayerFiles removes the package files and the applications of the excluded paths from the layers
+func excludeLayerFiles(layerFiles map[string]*scan.LayerFiles, patterns []string) {
+	if len(patterns) == 0 {
+		return
+	}
+	for _, lf := range layerFiles {
+		if lf == nil {
+			continue
+		}
+		for file := range lf.Pkgs {
+			if isExcludedPath(patterns, file) {
+				delete(lf.Pkgs, file)
+			}
+		}
+		for file := range lf.Apps {
+			// a package in an archive is named archive:package
+			name := file
+			if i := strings.Index(name, ":"); i > 0 {
+				name = name[:i]
+			}
+			if isExcludedPath(patterns, strings.TrimPrefix(name, "/")) {
+				delete(lf.Apps, file)
+			}
+		}
+	}
+}
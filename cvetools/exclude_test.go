@@ -0,0 +1,82 @@
+package cvetools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+func TestExcludePaths(t *testing.T) {
+	cases := []struct {
+		pattern, file string
+		match         bool
+	}{
+		{"/usr/share/doc", "/usr/share/doc/zlib/copyright", true},
+		{"/usr/share/doc", "/usr/share/docs/readme", false},
+		{"/usr/*/doc", "/usr/local/doc/readme", true},
+		{"node_modules/**/test", "/app/node_modules/lodash/test/index.js", true},
+		{"node_modules/**/test", "/app/node_modules/test/index.js", true},
+		{"node_modules/**/test", "/app/node_modules/lodash/index.js", false},
+		{"*.md", "/opt/README.md", true},
+		{"/*.md", "/opt/README.md", false},
+	}
+	for _, c := range cases {
+		if m := matchExcludePath(c.pattern, c.file); m != c.match {
+			t.Errorf("%s matched %s: %v, expect %v", c.pattern, c.file, m, c.match)
+		}
+	}
+	if err := ValidateExcludePaths([]string{"/usr/[a-"}); err == nil {
+		t.Errorf("Invalid pattern accepted")
+	}
+
+	fileMap := map[string]string{"/usr/share/doc/a": "", "/usr/share/doc/b": "", "/usr/bin/app": "", "/opt/README.md": ""}
+	excluded := excludeFileMap(fileMap, []string{"/usr/share", "*.md", "/usr/share/doc"})
+	if _, ok := fileMap["/usr/bin/app"]; len(fileMap) != 1 || !ok {
+		t.Errorf("Incorrect files left: %v", fileMap)
+	}
+	if len(excluded) != 3 || excluded[0].Files != 2 || excluded[1].Files != 1 || excluded[2].Files != 0 ||
+		!reflect.DeepEqual(excluded[0].Paths, []string{"/usr/share/doc/a", "/usr/share/doc/b"}) {
+		t.Errorf("Incorrect excluded paths: %+v %+v %+v", excluded[0], excluded[1], excluded[2])
+	}
+
+	layerFiles := map[string]*scan.LayerFiles{"l1": {
+		Pkgs: map[string][]byte{"var/lib/dpkg/status": nil, "opt/test/requirements.txt": nil},
+		Apps: map[string][]scan.AppPackage{"/opt/test/app.jar:log4j": nil, "/usr/lib/app.jar": nil},
+	}}
+	excludeLayerFiles(layerFiles, []string{"test"})
+	if lf := layerFiles["l1"]; len(lf.Pkgs) != 1 || lf.Pkgs["opt/test/requirements.txt"] != nil || len(lf.Apps) != 1 {
+		t.Errorf("Incorrect layer files: %+v", lf)
+	}
+
+	// the excluded files of the streamed layers are extracted empty
+	blob, dg := makeLayerBlob(t, map[string]string{
+		"etc/app.conf":         "password = secret\n",
+		"usr/share/doc/a.conf": "password = secret\n",
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/app/blobs/"+dg {
+			w.Write(blob)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	rc := newRegClient(srv.URL, "", "", "", "")
+	dir := t.TempDir()
+	ctx := withExcludePaths(context.Background(), []string{"/usr/share/doc"})
+	if _, errCode := downloadImageLayers(ctx, rc, "app", dir, []string{dg}, map[string]int64{dg: int64(len(blob))}); errCode != share.ScanErrorCode_ScanErrNone {
+		t.Fatalf("Failed to download: %v", errCode)
+	}
+	kept, _ := os.Stat(filepath.Join(dir, dg, "etc/app.conf"))
+	skipped, _ := os.Stat(filepath.Join(dir, dg, "usr/share/doc/a.conf"))
+	if kept == nil || kept.Size() == 0 || skipped == nil || skipped.Size() != 0 {
+		t.Errorf("Incorrect extracted files: %v %v", kept, skipped)
+	}
+}
@@ -0,0 +1,20 @@
+package cvetools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+// FindingID identifies the vulnerability of a package, the same in every scan of any image, so the tickets of
+// an issue tracker can be upserted by it. It is derived from the vulnerability name, the package, its installed
+// version and the file the package was found in, not from the metadata like the score or the description.
+func FindingID(v *share.ScanVulnerability) string {
+	h := sha256.New()
+	for _, s := range []string{v.Name, v.PackageName, v.PackageVersion, v.FileName} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
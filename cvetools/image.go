@@ -0,0 +1,340 @@
+package cvetools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	goDigest "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/scan/registry"
+	"github.com/neuvector/neuvector/share/utils"
+	"github.com/neuvector/scanner/detectors"
+)
+
+// imageConfig is the part of the image config blob that scan.ImageInfo does not keep
+type imageConfig struct {
+	OS           string    `json:"os"`
+	Architecture string    `json:"architecture"`
+	Variant      string    `json:"variant"`
+	Created      time.Time `json:"created"`
+	Config       struct {
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Labels       map[string]string   `json:"Labels"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+	} `json:"config"`
+	History []struct {
+		CreatedBy string `json:"created_by"`
+	} `json:"history"`
+}
+
+func (c *imageConfig) platform() *ImagePlatform {
+	if c.OS == "" && c.Architecture == "" {
+		return nil
+	}
+	return &ImagePlatform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant}
+}
+
+const mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// manifestIndex is a docker manifest list or an OCI image index
+type manifestIndex struct {
+	MediaType string `json:"mediaType"`
+	Manifests []struct {
+		Digest   string        `json:"digest"`
+		Platform ImagePlatform `json:"platform"`
+	} `json:"manifests"`
+}
+
+// ParseImagePlatform parses os/architecture[/variant], like linux/arm64 or linux/arm/v7
+func ParseImagePlatform(value string) (*ImagePlatform, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(value)), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid platform: %s", value)
+	}
+	p := &ImagePlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// matches tells if the platform is the requested one, the variant is only compared if it is requested
+func (p *ImagePlatform) matches(req *ImagePlatform) bool {
+	return p.OS == req.OS && p.Architecture == req.Architecture && (req.Variant == "" || p.Variant == req.Variant)
+}
+
+// selectPlatformManifest returns the digest of the platform's manifest if the body is a manifest list,
+// or "" if it is not a manifest list
+func selectPlatformManifest(body []byte, platform *ImagePlatform) (string, error) {
+	var ml manifestIndex
+	if err := json.Unmarshal(body, &ml); err != nil || len(ml.Manifests) == 0 ||
+		(ml.MediaType != mediaTypeManifestList && ml.MediaType != registry.MediaTypeOCIIndex) {
+		return "", nil
+	}
+
+	available := make([]string, 0, len(ml.Manifests))
+	for _, m := range ml.Manifests {
+		if m.Platform.matches(platform) {
+			return m.Digest, nil
+		}
+		available = append(available, m.Platform.String())
+	}
+	return "", fmt.Errorf("Platform %s not in the manifest list: %s", platform, strings.Join(available, ", "))
+}
+
+// resolvePlatformTag returns the manifest digest of the platform for a manifest list, otherwise the tag
+func resolvePlatformTag(ctx context.Context, rc *scan.RegClient, repo, tag string, platform *ImagePlatform) (string, error) {
+	_, body, err := rc.ManifestRequest(ctx, repo, tag, 2, registry.ManifestRequest_Default)
+	if err != nil {
+		// the error is reported when the image info is read
+		return tag, nil
+	}
+	dg, err := selectPlatformManifest(body, platform)
+	if err != nil || dg == "" {
+		return tag, err
+	}
+	log.WithFields(log.Fields{"platform": platform, "tag": tag, "digest": dg}).Debug("manifest list")
+	return dg, nil
+}
+
+// emptyGzipLayer is the well-known gzipped empty tar that the images list for the layers without files
+const emptyGzipLayer = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+
+// uniqueLayers removes the repeated digests and the empty layers from the layer list
+func uniqueLayers(layers []string) []string {
+	list := make([]string, 0, len(layers))
+	seen := utils.NewSet()
+	for _, layer := range layers {
+		if layer == "" || layer == emptyGzipLayer || seen.Contains(layer) {
+			continue
+		}
+		seen.Add(layer)
+		list = append(list, layer)
+	}
+	return list
+}
+
+// downloadImageLayers downloads and extracts each distinct layer once, the files of a digest are shared by all
+// the positions it has in the image. The empty gzip layer is not downloaded. The layers are streamed, only the
+// files the scan reads are written, unless FullExtraction.
+func downloadImageLayers(ctx context.Context, rc *scan.RegClient, repo, imgPath string, layers []string, sizes map[string]int64) (map[string]*scan.LayerFiles, share.ScanErrorCode) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx, streams := withLayerStreams(ctx)
+	layerFiles, errCode := rc.DownloadRemoteImage(ctx, repo, imgPath, uniqueLayers(layers), sizes)
+	streams.setSizes(layerFiles)
+	if errCode == share.ScanErrorCode_ScanErrNone {
+		addEmptyLayers(layerFiles, layers)
+	}
+	return layerFiles, errCode
+}
+
+func addEmptyLayers(layerFiles map[string]*scan.LayerFiles, layers []string) {
+	for _, layer := range layers {
+		if layer == emptyGzipLayer {
+			layerFiles[layer] = &scan.LayerFiles{Pkgs: make(map[string][]byte), Apps: make(map[string][]scan.AppPackage)}
+			return
+		}
+	}
+}
+
+// downloadEachLayer downloads the layers one by one after the download of the image failed, the layers that were
+// extracted are not downloaded again. It returns the files of the downloaded layers and the failure of the others.
+func downloadEachLayer(ctx context.Context, rc *scan.RegClient, repo, imgPath string, layers []string, sizes map[string]int64) (map[string]*scan.LayerFiles, map[string]string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx, streams := withLayerStreams(ctx)
+	layerFiles := make(map[string]*scan.LayerFiles)
+	failed := make(map[string]string)
+	addEmptyLayers(layerFiles, layers)
+	defer streams.setSizes(layerFiles)
+	for _, layer := range layers {
+		if _, ok := layerFiles[layer]; ok || layer == "" {
+			continue
+		}
+		if _, ok := failed[layer]; ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			failed[layer] = ctx.Err().Error()
+			continue
+		}
+
+		lfs, errCode := rc.DownloadRemoteImage(ctx, repo, imgPath, []string{layer}, sizes)
+		if lf, ok := lfs[layer]; errCode == share.ScanErrorCode_ScanErrNone && ok {
+			layerFiles[layer] = lf
+		} else {
+			log.WithFields(log.Fields{"layer": layer, "error": errCode}).Error("Failed to download layer")
+			failed[layer] = scan.ScanErrorToStr(errCode)
+		}
+	}
+	return layerFiles, failed
+}
+
+// imageFileMap maps the paths of the image to the files of the extracted layers, the layers are the latest first,
+// so the file of an upper layer replaces the ones of the layers below. The empty layers have no folder, the
+// folder of the image would map the files of all the layers, the versions replaced by the upper layers included.
+// The layers not mapped after an error are returned.
+func imageFileMap(imgPath string, layers []string) (map[string]string, utils.Set, error) {
+	fileMap := make(map[string]string) // [path]:[file from untar layers]
+	unmapped := utils.NewSet()
+	for i := len(layers) - 1; i >= 0; i-- {
+		if layers[i] == "" {
+			continue
+		}
+		layerPath := filepath.Join(imgPath, layers[i])
+		if _, err := collectImageFileMap(layerPath, fileMap); err != nil {
+			log.WithFields(log.Fields{"error": err, "layer": layerPath}).Error("virtual image map")
+			for ; i >= 0; i-- {
+				unmapped.Add(layers[i])
+			}
+			return fileMap, unmapped, err
+		}
+	}
+	return fileMap, unmapped, nil
+}
+
+// mergeLayerFiles merges the package files and the applications of the layers, the latest first, the file of the
+// topmost layer that has it is scanned. The applications of the files removed by an upper layer are not in the file
+// map and are skipped.
+func mergeLayerFiles(layers []string, layerFiles map[string]*scan.LayerFiles, baseLayers utils.Set, fileMap map[string]string) (map[string]*detectors.FeatureFile, []detectors.AppFeatureVersion) {
+	gotFirstCpe := false
+	mergedFiles := make(map[string]*detectors.FeatureFile)
+	mergedApps := make(map[string][]detectors.AppFeatureVersion)
+	for _, l := range layers {
+		isBase := baseLayers.Contains(l)
+		lf, ok := layerFiles[l]
+		if !ok {
+			continue
+		}
+		var hasRpmPackages bool
+		for filename := range lf.Pkgs {
+			if scan.RPMPkgFiles.Contains(filename) {
+				hasRpmPackages = true
+				break
+			}
+		}
+
+		for filename, data := range lf.Pkgs {
+			if _, ok := mergedFiles[filename]; !ok {
+				// for redhat CPE
+				if strings.HasPrefix(filename, contentManifest) && strings.HasSuffix(filename, ".json") {
+					if hasRpmPackages && !gotFirstCpe {
+						mergedFiles[filename] = &detectors.FeatureFile{Data: data, InBase: isBase}
+						gotFirstCpe = true
+					}
+				} else {
+					mergedFiles[filename] = &detectors.FeatureFile{Data: data, InBase: isBase}
+				}
+			}
+		}
+		for filename, apps := range lf.Apps {
+			fpath := filepath.Join("/", filename) // add "/" at its front
+			if pos := strings.Index(fpath, ":"); pos > 0 {
+				// jar: a package inside a package
+				fpath = fpath[:pos]
+			}
+			if _, ok := fileMap[fpath]; !ok {
+				continue
+			}
+
+			if _, ok := mergedApps[filename]; !ok {
+				// convert AppPackage to AppFeatureVersion
+				afvs := make([]detectors.AppFeatureVersion, len(apps))
+				for i, a := range apps {
+					afvs[i] = detectors.AppFeatureVersion{
+						AppPackage: a,
+						ModuleVuls: make([]detectors.ModuleVul, 0),
+						InBase:     isBase,
+					}
+				}
+				mergedApps[filename] = afvs
+			}
+		}
+	}
+
+	appFVs := make([]detectors.AppFeatureVersion, 0)
+	for _, afvs := range mergedApps {
+		appFVs = append(appFVs, afvs...)
+	}
+	return mergedFiles, appFVs
+}
+
+// exposedPorts returns the sorted ports of the config, like "80/tcp"
+func (c *imageConfig) exposedPorts() []string {
+	ports := make([]string, 0, len(c.Config.ExposedPorts))
+	for port := range c.Config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// history returns the history lines as the builder recorded them, the latest first as in the image info.
+// The registry client normalizes the lines of the image info, which drops the build arguments of a RUN.
+func (c *imageConfig) history() []string {
+	cmds := make([]string, 0, len(c.History))
+	for i := len(c.History) - 1; i >= 0; i-- {
+		cmds = append(cmds, c.History[i].CreatedBy)
+	}
+	return cmds
+}
+
+// addLabels adds the labels of the config missing in the image info. The registry client only reads the
+// config of the docker media type, the labels of an OCI image are only found here.
+func (c *imageConfig) addLabels(info *scan.ImageInfo) {
+	if len(c.Config.Labels) == 0 {
+		return
+	}
+	if info.Labels == nil {
+		info.Labels = make(map[string]string, len(c.Config.Labels))
+	}
+	for k, v := range c.Config.Labels {
+		if _, ok := info.Labels[k]; !ok {
+			info.Labels[k] = v
+		}
+	}
+}
+
+// created returns the creation time, empty if unknown. Reproducible builds set it to the epoch, which is
+// not the time the image was built.
+func (c *imageConfig) created() string {
+	if c.Created.IsZero() || c.Created.Unix() <= 0 {
+		return ""
+	}
+	return c.Created.UTC().Format(time.RFC3339)
+}
+
+// getImageConfig reads the config blob of a schema v2 image, id is the config digest without the "sha256:" prefix
+func getImageConfig(ctx context.Context, rc *scan.RegClient, repo, id string) (*imageConfig, error) {
+	if id == "" {
+		return nil, fmt.Errorf("no image config")
+	}
+
+	rd, _, err := rc.DownloadLayer(ctx, repo, goDigest.NewDigestFromEncoded(goDigest.SHA256, id))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	body, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf imageConfig
+	if err = json.Unmarshal(body, &conf); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
@@ -0,0 +1,210 @@
+package cvetools
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	goDigest "github.com/opencontainers/go-digest"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/scan/registry"
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+func TestSelectPlatformManifest(t *testing.T) {
+	list := []byte(`{
+		"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+		"manifests": [
+			{"digest": "sha256:amd64", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:armv7", "platform": {"os": "linux", "architecture": "arm", "variant": "v7"}},
+			{"digest": "sha256:arm64", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}}
+		]}`)
+
+	tests := map[string]string{"linux/arm64": "sha256:arm64", "linux/arm/v7": "sha256:armv7", "LINUX/AMD64": "sha256:amd64"}
+	for value, expect := range tests {
+		p, err := ParseImagePlatform(value)
+		if err != nil {
+			t.Fatalf("Failed to parse platform: %s %v", value, err)
+		}
+		if dg, err := selectPlatformManifest(list, p); err != nil || dg != expect {
+			t.Errorf("Unexpected manifest: platform=%s digest=%s err=%v", value, dg, err)
+		}
+	}
+
+	p, _ := ParseImagePlatform("linux/s390x")
+	if _, err := selectPlatformManifest(list, p); err == nil {
+		t.Errorf("Expect an error for a missing platform")
+	}
+	if dg, err := selectPlatformManifest([]byte(`{"schemaVersion": 2, "layers": []}`), p); dg != "" || err != nil {
+		t.Errorf("Unexpected result of an image manifest: %s %v", dg, err)
+	}
+	if _, err := ParseImagePlatform("arm64"); err == nil {
+		t.Errorf("Expect an error for an invalid platform")
+	}
+}
+
+func makeLayerBlob(t *testing.T, files map[string]string) ([]byte, string) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	sum := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), fmt.Sprintf("sha256:%x", sum)
+}
+
+func TestDuplicateLayers(t *testing.T) {
+	base, baseDigest := makeLayerBlob(t, map[string]string{"etc/os-release": "ID=alpine\nVERSION_ID=3.17.0\n"})
+	app, appDigest := makeLayerBlob(t, map[string]string{"app/config.json": "{}"})
+	blobs := map[string][]byte{baseDigest: base, appDigest: app}
+
+	var mutex sync.Mutex
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		digest := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		mutex.Lock()
+		requests[digest]++
+		mutex.Unlock()
+		if blob, ok := blobs[digest]; ok {
+			w.Write(blob)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	// the repeated COPY of the same content, and an empty layer
+	layers := []string{appDigest, emptyGzipLayer, appDigest, baseDigest}
+	if list := uniqueLayers(layers); len(list) != 2 || list[0] != appDigest || list[1] != baseDigest {
+		t.Errorf("Incorrect unique layers: %v", list)
+	}
+
+	sizes := map[string]int64{baseDigest: int64(len(base)), appDigest: int64(len(app)), emptyGzipLayer: 32}
+	rc := newRegClient(srv.URL, "", "", "", "")
+	layerFiles, errCode := downloadImageLayers(context.Background(), rc, "app", t.TempDir(), layers, sizes)
+	if errCode != share.ScanErrorCode_ScanErrNone {
+		t.Fatalf("Failed to download: %v", errCode)
+	}
+	if requests[appDigest] != 1 || requests[baseDigest] != 1 || requests[emptyGzipLayer] != 0 {
+		t.Errorf("Incorrect downloads: %v", requests)
+	}
+	if len(layerFiles) != 3 || layerFiles[appDigest] == nil || layerFiles[baseDigest] == nil || layerFiles[emptyGzipLayer] == nil {
+		t.Errorf("Incorrect layer files: %v", layerFiles)
+	}
+	if _, ok := layerFiles[baseDigest].Pkgs["etc/os-release"]; !ok {
+		t.Errorf("Missing file of the base layer: %+v", layerFiles[baseDigest])
+	}
+
+	cov := buildCoverage(layers, sizes, layerFiles, utils.NewSet(), nil)
+	if len(cov.Layers) != 3 || cov.Layers[1].Status != LayerEmpty || !cov.Complete {
+		t.Errorf("Incorrect coverage: %+v", cov)
+	}
+}
+
+func TestOCIConfigLabels(t *testing.T) {
+	layer, layerDigest := makeLayerBlob(t, map[string]string{"etc/os-release": "ID=alpine\nVERSION_ID=3.17.0\n"})
+	config := []byte(`{"architecture":"amd64","os":"linux","config":{"Labels":{"org.opencontainers.image.source":"https://github.com/org/app","org.opencontainers.image.licenses":"Apache-2.0"}}}`)
+	configDigest := goDigest.FromBytes(config)
+	manifest := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"%s","size":%d},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"%s","size":%d}]}`,
+		registry.MediaTypeOCIManifest, configDigest, len(config), layerDigest, len(layer)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/manifests/1.0":
+			w.Header().Set("Content-Type", registry.MediaTypeOCIManifest)
+			w.Header().Set("Docker-Content-Digest", goDigest.FromBytes(manifest).String())
+			w.Write(manifest)
+		case "/v2/app/blobs/" + configDigest.String():
+			w.Write(config)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	rc := newRegClient(srv.URL, "", "", "", "")
+	info, errCode := rc.GetImageInfo(context.Background(), "app", "1.0", registry.ManifestRequest_Default)
+	if errCode != share.ScanErrorCode_ScanErrNone {
+		t.Fatalf("Failed to read the image: %v", errCode)
+	}
+	// the labels of an OCI config are not read by the registry client
+	if len(info.Labels) != 0 {
+		t.Errorf("Unexpected labels: %v", info.Labels)
+	}
+	conf, err := getImageConfig(context.Background(), rc, "app", info.ID)
+	if err != nil {
+		t.Fatalf("Failed to read the config: %v", err)
+	}
+	conf.addLabels(info)
+	if info.Labels["org.opencontainers.image.source"] != "https://github.com/org/app" || info.Labels["org.opencontainers.image.licenses"] != "Apache-2.0" {
+		t.Errorf("Incorrect labels: %v", info.Labels)
+	}
+}
+
+func TestLaterLayerFix(t *testing.T) {
+	// the base layer has the vulnerable version, the layer above upgrades it, an ENV in between has no layer
+	lower, upper := "sha256:1111", "sha256:2222"
+	imgPath := t.TempDir()
+	files := map[string]map[string]string{
+		lower: {"usr/lib/libssl.so.1.1": "OpenSSL 1.1.1k  25 Mar 2021\x00", "app/package.json": "{}"},
+		upper: {"usr/lib/libssl.so.1.1": "OpenSSL 1.1.1w  11 Sep 2023\x00", "app/package.json": "{}"},
+	}
+	for layer, fs := range files {
+		for name, content := range fs {
+			path := filepath.Join(imgPath, layer, name)
+			os.MkdirAll(filepath.Dir(path), 0755)
+			ioutil.WriteFile(path, []byte(content), 0644)
+		}
+	}
+	layers := []string{upper, "", lower}
+
+	fileMap, unmapped, err := imageFileMap(imgPath, layers)
+	if err != nil || unmapped.Cardinality() != 0 {
+		t.Fatalf("Failed to map the files: %v %v", err, unmapped)
+	}
+	if path := fileMap["/usr/lib/libssl.so.1.1"]; path != filepath.Join(imgPath, upper, "usr/lib/libssl.so.1.1") {
+		t.Errorf("The file of the lower layer is mapped: %s", path)
+	}
+	for path := range fileMap {
+		if strings.HasPrefix(path, "/sha256:") {
+			t.Errorf("The folder of a layer is mapped: %s", path)
+		}
+	}
+	if bins := detectBinaries(fileMap); len(bins) != 1 || bins[0].version != "1.1.1w" {
+		t.Errorf("Incorrect binaries: %+v", bins)
+	}
+
+	layerFiles := map[string]*scan.LayerFiles{
+		lower: {
+			Pkgs: map[string][]byte{"var/lib/dpkg/status": []byte("Package: openssl\nVersion: 1.1.1k-1\n")},
+			Apps: map[string][]scan.AppPackage{"app/package.json": {{AppName: "npm", ModuleName: "lodash", Version: "4.17.15", FileName: "app/package.json"}}},
+		},
+		upper: {
+			Pkgs: map[string][]byte{"var/lib/dpkg/status": []byte("Package: openssl\nVersion: 1.1.1w-0\n")},
+			Apps: map[string][]scan.AppPackage{"app/package.json": {{AppName: "npm", ModuleName: "lodash", Version: "4.17.21", FileName: "app/package.json"}}},
+		},
+	}
+	pkgs, apps := mergeLayerFiles(layers, layerFiles, utils.NewSet(lower), fileMap)
+	if f := pkgs["var/lib/dpkg/status"]; f == nil || !strings.Contains(string(f.Data), "1.1.1w") || f.InBase {
+		t.Errorf("Incorrect package file: %+v", f)
+	}
+	if len(apps) != 1 || apps[0].Version != "4.17.21" || apps[0].InBase {
+		t.Errorf("Incorrect applications: %+v", apps)
+	}
+}
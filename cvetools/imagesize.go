@@ -0,0 +1,44 @@
+package cvetools
+
+import (
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+// ImageSize is the size of the image and its layers, in bytes
+type ImageSize struct {
+	Layers       int          `json:"Layers"`
+	Compressed   int64        `json:"Compressed"`             // of the layers in the manifest, 0 for a local image
+	Uncompressed int64        `json:"Uncompressed,omitempty"` // of the extracted layers, 0 if not extracted
+	LayerSizes   []*LayerSize `json:"LayerSizes,omitempty"`   // in the order of the layer results
+}
+
+// LayerSize is the size of a layer, a layer repeated in the image is counted once
+type LayerSize struct {
+	Digest       string `json:"Digest"`
+	Compressed   int64  `json:"Compressed"`
+	Uncompressed int64  `json:"Uncompressed,omitempty"`
+}
+
+// newImageSize sums the compressed sizes of the manifest and the extracted sizes of the layers, layerFiles
+// is nil if the layers were not downloaded
+func newImageSize(layers []string, sizes map[string]int64, layerFiles map[string]*scan.LayerFiles) *ImageSize {
+	is := &ImageSize{LayerSizes: make([]*LayerSize, 0, len(layers))}
+	done := utils.NewSet()
+	for _, layer := range layers {
+		if layer == "" || done.Contains(layer) {
+			continue
+		}
+		done.Add(layer)
+
+		ls := &LayerSize{Digest: layer, Compressed: sizes[layer]}
+		if lf, ok := layerFiles[layer]; ok && lf != nil {
+			ls.Uncompressed = lf.Size
+		}
+		is.Layers++
+		is.Compressed += ls.Compressed
+		is.Uncompressed += ls.Uncompressed
+		is.LayerSizes = append(is.LayerSizes, ls)
+	}
+	return is
+}
@@ -0,0 +1,24 @@
+package cvetools
+
+import (
+	"testing"
+
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+func TestImageSize(t *testing.T) {
+	// the latest layer first, with the empty history lines and a repeated layer
+	layers := []string{"sha256:c", "", "sha256:b", "sha256:a", "sha256:b"}
+	sizes := map[string]int64{"sha256:a": 1000, "sha256:b": 200, "sha256:c": 30}
+
+	is := newImageSize(layers, sizes, nil)
+	if is.Layers != 3 || is.Compressed != 1230 || is.Uncompressed != 0 || len(is.LayerSizes) != 3 {
+		t.Errorf("Incorrect size before the download: %+v", is)
+	}
+
+	layerFiles := map[string]*scan.LayerFiles{"sha256:a": {Size: 3000}, "sha256:b": {Size: 500}, "sha256:c": {Size: 0}}
+	is = newImageSize(layers, sizes, layerFiles)
+	if is.Uncompressed != 3500 || is.LayerSizes[1].Digest != "sha256:b" || is.LayerSizes[1].Uncompressed != 500 {
+		t.Errorf("Incorrect size: %+v %+v", is, is.LayerSizes[1])
+	}
+}
@@ -0,0 +1,134 @@
+package cvetools
+
+import (
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// InflateWorkers is the number of goroutines streaming the layers of all the scans of the process, 0 for the
+// number of CPUs. A layer takes up to 3: one hashes the blob as it is downloaded, one inflates it, and one
+// extracts the files, the layers streamed when the workers are busy are extracted in a single goroutine.
+// The gzip stream of a layer is still inflated by a single goroutine, a deflate block refers to the data of
+// the blocks before it; the pipeline only keeps the hashing and the extraction off it.
+var InflateWorkers = 0
+
+// the size and the number of the blocks read ahead of a stage of the layer pipeline
+const (
+	inflateBlockSize = 1024 * 1024
+	inflateBlocks    = 4
+)
+
+// the helper goroutines of the layer pipelines, all the layers and the scans share them
+var inflateHelpers int64
+
+// acquireInflateHelper returns true if a stage of a layer can run in its own goroutine, it is released by
+// releaseInflateHelper
+func acquireInflateHelper() bool {
+	workers := InflateWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	// the goroutine extracting the layer is not a helper
+	if atomic.AddInt64(&inflateHelpers, 1) > int64(workers-1) {
+		atomic.AddInt64(&inflateHelpers, -1)
+		return false
+	}
+	return true
+}
+
+func releaseInflateHelper() {
+	atomic.AddInt64(&inflateHelpers, -1)
+}
+
+// pipelined returns r read ahead in a helper goroutine if one is free, so the stage producing the data runs
+// beside the stage consuming it, the data is the same. The helper stops at the end of r or when the reader
+// is closed.
+func pipelined(r io.Reader) io.ReadCloser {
+	if !acquireInflateHelper() {
+		return ioutil.NopCloser(r)
+	}
+	ra := &readAhead{
+		blocks: make(chan []byte, inflateBlocks),
+		free:   make(chan []byte, inflateBlocks+1),
+		done:   make(chan struct{}),
+	}
+	go ra.run(r)
+	return ra
+}
+
+// readAhead reads the blocks of a reader in a goroutine
+type readAhead struct {
+	blocks chan []byte
+	free   chan []byte // the blocks read, to be filled again
+	err    error       // the error of the reader, set before blocks is closed
+	cur    []byte
+	last   []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (ra *readAhead) run(r io.Reader) {
+	defer releaseInflateHelper()
+	defer close(ra.blocks)
+	for {
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		default:
+			buf = make([]byte, inflateBlockSize)
+		}
+		buf = buf[:cap(buf)]
+
+		var n int
+		var err error
+		for n < len(buf) && err == nil {
+			var m int
+			m, err = r.Read(buf[n:])
+			n += m
+		}
+		if n > 0 {
+			select {
+			case ra.blocks <- buf[:n]:
+			case <-ra.done:
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				ra.err = err
+			}
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	if len(ra.cur) == 0 {
+		if ra.last != nil {
+			select {
+			case ra.free <- ra.last:
+			default:
+			}
+			ra.last = nil
+		}
+		b, ok := <-ra.blocks
+		if !ok {
+			if ra.err != nil {
+				return 0, ra.err
+			}
+			return 0, io.EOF
+		}
+		ra.cur, ra.last = b, b
+	}
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
+
+func (ra *readAhead) Close() error {
+	ra.once.Do(func() { close(ra.done) })
+	return nil
+}
@@ -0,0 +1,47 @@
+package cvetools
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestPipelinedReader(t *testing.T) {
+	InflateWorkers = 2
+	defer func() { InflateWorkers = 0 }()
+
+	data := make([]byte, 3*inflateBlockSize+100)
+	rand.Read(data)
+	r := pipelined(bytes.NewReader(data))
+	if _, ok := r.(*readAhead); !ok {
+		t.Fatalf("Expect a helper goroutine")
+	}
+	if r2 := pipelined(bytes.NewReader(data)); r2 == nil {
+		t.Fatalf("Expect a reader without a helper")
+	} else if _, ok := r2.(*readAhead); ok {
+		t.Errorf("Expect the helpers bounded by the workers")
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Incorrect data: %d bytes, %v", len(got), err)
+	}
+
+	// the error of the stage is returned after its data
+	r = pipelined(io.MultiReader(bytes.NewReader(data[:100]), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if got, err = ioutil.ReadAll(r); err != io.ErrUnexpectedEOF || len(got) != 100 {
+		t.Errorf("Incorrect error: %d bytes, %v", len(got), err)
+	}
+	r.Close()
+	for i := 0; i < 100 && atomic.LoadInt64(&inflateHelpers) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&inflateHelpers); n != 0 {
+		t.Errorf("The helpers are not released: %d", n)
+	}
+}
@@ -0,0 +1,259 @@
+package cvetools
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// the default paths of the Fulcio root and the Rekor public key, they are not in the scanner image and have to be
+// mounted, like from the trusted root of the sigstore instance
+const (
+	DefaultFulcioRoot = "/etc/neuvector/certs/fulcio_root.pem"
+	DefaultRekorKey   = "/etc/neuvector/certs/rekor.pub"
+)
+
+const (
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+// the OIDC issuer extensions of a Fulcio certificate, the first one has the raw string value
+var (
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// KeylessPolicy verifies the signatures of the short-lived Fulcio certificates, by the identity and the
+// OIDC issuer of the signer. The certificate is verified at the time the signature was logged in Rekor,
+// read from the Rekor bundle in the signature, so no online call is needed.
+type KeylessPolicy struct {
+	Identity    string `json:"Identity"` // the email or URI subject alternative name
+	Issuer      string `json:"Issuer"`
+	FulcioRoots string `json:"FulcioRoots"` // PEM
+	RekorKey    string `json:"RekorKey"`    // PEM, required: the logged time the certificate is verified at is signed by it
+}
+
+// the offline Rekor bundle cosign attaches to a signature
+type rekorBundle struct {
+	SignedEntryTimestamp string `json:"SignedEntryTimestamp"`
+	Payload              struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	} `json:"Payload"`
+}
+
+// the hashedrekord entry in the Rekor bundle body
+type rekorEntry struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content string `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// LoadKeylessPolicy reads the Fulcio root and the Rekor public key. Both are required: without the signed entry
+// timestamp of Rekor, the time the signature was logged, when the short-lived certificate must be valid, can be
+// forged.
+func LoadKeylessPolicy(identity, issuer, rootFile, rekorFile string) (*KeylessPolicy, error) {
+	if identity == "" || issuer == "" {
+		return nil, errors.New("Both the certificate identity and OIDC issuer are required")
+	}
+
+	roots, err := ioutil.ReadFile(rootFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the Fulcio root: %v", err)
+	}
+	if _, err := parseCertificates(roots); err != nil {
+		return nil, fmt.Errorf("Invalid Fulcio root %s: %v", rootFile, err)
+	}
+
+	if rekorFile == "" {
+		return nil, errors.New("The Rekor public key is required to verify the keyless signatures")
+	}
+	data, err := ioutil.ReadFile(rekorFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the Rekor public key: %v", err)
+	}
+	if _, err := parsePublicKey(data); err != nil {
+		return nil, fmt.Errorf("Invalid Rekor public key %s: %v", rekorFile, err)
+	}
+	return &KeylessPolicy{Identity: identity, Issuer: issuer, FulcioRoots: string(roots), RekorKey: string(data)}, nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("No PEM certificate")
+	}
+	return certs, nil
+}
+
+// certificateIssuer reads the OIDC issuer from the Fulcio extensions
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidFulcioIssuerV2) {
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidFulcioIssuer) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// certificateIdentities returns the email and URI subject alternative names
+func certificateIdentities(cert *x509.Certificate) []string {
+	ids := append([]string{}, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	return ids
+}
+
+// verifyRekorBundle checks the bundle logs this signature of the payload, and verifies the signed entry
+// timestamp by the Rekor key. It returns the time the entry was logged.
+func verifyRekorBundle(data string, payload, sig []byte, rekorKey string) (time.Time, error) {
+	var bundle rekorBundle
+	if err := json.Unmarshal([]byte(data), &bundle); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid Rekor bundle: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid Rekor entry: %v", err)
+	}
+	var entry rekorEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid Rekor entry: %v", err)
+	}
+	hash := sha256.Sum256(payload)
+	if entry.Kind != "hashedrekord" || entry.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) {
+		return time.Time{}, errors.New("Rekor entry is not of the signed payload")
+	}
+	if logged, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.Content); err != nil || !bytes.Equal(logged, sig) {
+		return time.Time{}, errors.New("Rekor entry is not of the signature")
+	}
+
+	if rekorKey == "" {
+		return time.Time{}, errors.New("No Rekor public key, the signed entry timestamp can't be verified")
+	}
+	pub, err := parsePublicKey([]byte(rekorKey))
+	if err != nil {
+		return time.Time{}, err
+	}
+	set, err := base64.StdEncoding.DecodeString(bundle.SignedEntryTimestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid signed entry timestamp: %v", err)
+	}
+	// the canonical json of the payload, the keys in order and no spaces
+	canonical, _ := json.Marshal(map[string]interface{}{
+		"body":           bundle.Payload.Body,
+		"integratedTime": bundle.Payload.IntegratedTime,
+		"logIndex":       bundle.Payload.LogIndex,
+		"logID":          bundle.Payload.LogID,
+	})
+	if err := verifyBlob(pub, canonical, set); err != nil {
+		return time.Time{}, fmt.Errorf("Invalid signed entry timestamp: %v", err)
+	}
+
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// verifyKeyless verifies a signature with the Fulcio certificate in the annotations, and returns the signer identity
+func verifyKeyless(policy *KeylessPolicy, annotations map[string]string, payload, sig []byte) (string, string, error) {
+	certs, err := parseCertificates([]byte(annotations[cosignCertificateAnnotation]))
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid signing certificate: %v", err)
+	}
+	leaf := certs[0]
+
+	bundle, ok := annotations[cosignBundleAnnotation]
+	if !ok {
+		return "", "", errors.New("No Rekor bundle, the short-lived certificate can't be verified offline")
+	}
+	signedAt, err := verifyRekorBundle(bundle, payload, sig, policy.RekorKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	roots, err := parseCertificates([]byte(policy.FulcioRoots))
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid Fulcio root: %v", err)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   signedAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	for _, c := range roots {
+		opts.Roots.AddCert(c)
+	}
+	if chain, err := parseCertificates([]byte(annotations[cosignChainAnnotation])); err == nil {
+		for _, c := range chain {
+			opts.Intermediates.AddCert(c)
+		}
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return "", "", fmt.Errorf("Signing certificate is not issued by Fulcio: %v", err)
+	}
+
+	if _, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok {
+		return "", "", fmt.Errorf("Unsupported certificate key type %T", leaf.PublicKey)
+	}
+	if err := verifyBlob(leaf.PublicKey, payload, sig); err != nil {
+		return "", "", err
+	}
+
+	issuer := certificateIssuer(leaf)
+	if issuer != policy.Issuer {
+		return "", issuer, fmt.Errorf("Certificate issuer %s is not %s", issuer, policy.Issuer)
+	}
+	for _, id := range certificateIdentities(leaf) {
+		if id == policy.Identity {
+			return id, issuer, nil
+		}
+	}
+	return "", issuer, fmt.Errorf("Certificate identity %v is not %s", certificateIdentities(leaf), policy.Identity)
+}
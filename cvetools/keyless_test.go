@@ -0,0 +1,114 @@
+package cvetools
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+func TestVerifyKeyless(t *testing.T) {
+	const digest = "sha256:1111"
+	const identity = "https://github.com/org/app/.github/workflows/release.yml@refs/heads/main"
+	const issuer = "https://token.actions.githubusercontent.com"
+
+	// a Fulcio-like root, and a short-lived leaf expired long ago but valid when the signature was logged
+	signedAt := time.Now().Add(-24 * time.Hour)
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rootTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sigstore"},
+		NotBefore: signedAt.Add(-time.Hour), NotAfter: signedAt.Add(365 * 24 * time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	rootDer, _ := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	root, _ := x509.ParseCertificate(rootDer)
+
+	issuerExt, _ := asn1.Marshal(issuer)
+	uri, _ := url.Parse(identity)
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2), NotBefore: signedAt.Add(-time.Minute), NotAfter: signedAt.Add(10 * time.Minute),
+		URIs: []*url.URL{uri}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}, KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: oidFulcioIssuerV2, Value: issuerExt}},
+	}
+	leafDer, _ := x509.CreateCertificate(rand.Reader, leafTmpl, root, &leafKey.PublicKey, rootKey)
+
+	sigData := makeCosignSignature(t, leafKey, digest)
+	payload := sigData.Payloads["sha256:p1"]
+	var man cosignManifest
+	json.Unmarshal([]byte(sigData.Manifest), &man)
+	sigB64 := man.Layers[0].Annotations[cosignSignatureAnnotation]
+	leafPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDer}))
+
+	// the offline Rekor bundle, with the entry timestamp signed by the Rekor key
+	hash := sha256.Sum256([]byte(payload))
+	body := fmt.Sprintf(`{"apiVersion":"0.0.1","kind":"hashedrekord","spec":{"data":{"hash":{"algorithm":"sha256","value":"%s"}},`+
+		`"signature":{"content":"%s","publicKey":{"content":"%s"}}}}`,
+		hex.EncodeToString(hash[:]), sigB64, base64.StdEncoding.EncodeToString([]byte(leafPEM)))
+	bodyB64 := base64.StdEncoding.EncodeToString([]byte(body))
+	canonical := fmt.Sprintf(`{"body":"%s","integratedTime":%d,"logID":"c0d23d6a","logIndex":42}`, bodyB64, signedAt.Unix())
+	rekorKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	setHash := sha256.Sum256([]byte(canonical))
+	set, _ := ecdsa.SignASN1(rand.Reader, rekorKey, setHash[:])
+	bundle := fmt.Sprintf(`{"SignedEntryTimestamp":"%s","Payload":%s}`, base64.StdEncoding.EncodeToString(set), canonical)
+
+	makeData := func(withBundle bool) *scan.SignatureData {
+		ann := map[string]string{cosignSignatureAnnotation: sigB64, cosignCertificateAnnotation: leafPEM}
+		if withBundle {
+			ann[cosignBundleAnnotation] = bundle
+		}
+		m := map[string]interface{}{"layers": []interface{}{map[string]interface{}{"digest": "sha256:p1", "annotations": ann}}}
+		data, _ := json.Marshal(m)
+		return &scan.SignatureData{Manifest: string(data), Payloads: sigData.Payloads}
+	}
+
+	policy := &KeylessPolicy{
+		Identity:    identity,
+		Issuer:      issuer,
+		FulcioRoots: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDer})),
+		RekorKey:    makeCosignKey(t, "rekor.pub", rekorKey).PEM,
+	}
+	sv := verifyCosignSignatures(digest, makeData(true), nil, policy)
+	if !sv.Verified || sv.Signer != identity || sv.Issuer != issuer {
+		t.Errorf("Incorrect verification: %+v", sv)
+	}
+
+	if sv = verifyCosignSignatures(digest, makeData(false), nil, policy); sv.Verified {
+		t.Errorf("Expect not verified without the bundle: %+v", sv)
+	}
+
+	other := *policy
+	other.Identity = "https://github.com/org/other/.github/workflows/release.yml@refs/heads/main"
+	if sv = verifyCosignSignatures(digest, makeData(true), nil, &other); sv.Verified || !strings.Contains(sv.Error, "identity") {
+		t.Errorf("Expect not verified for another identity: %+v", sv)
+	}
+
+	// without the Rekor key the logged time, when the expired certificate was valid, can't be trusted
+	other = *policy
+	other.RekorKey = ""
+	if sv = verifyCosignSignatures(digest, makeData(true), nil, &other); sv.Verified || !strings.Contains(sv.Error, "Rekor") {
+		t.Errorf("Expect not verified without the Rekor key: %+v", sv)
+	}
+
+	other = *policy
+	otherRekor, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other.RekorKey = makeCosignKey(t, "rekor.pub", otherRekor).PEM
+	if sv = verifyCosignSignatures(digest, makeData(true), nil, &other); sv.Verified {
+		t.Errorf("Expect not verified with another Rekor key: %+v", sv)
+	}
+}
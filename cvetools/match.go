@@ -0,0 +1,68 @@
+package cvetools
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// MatchWorkers is the number of goroutines matching the packages of an image against the database, 0 for the
+// number of CPUs
+var MatchWorkers = 0
+
+// minParallelMatch is the number of packages below which the matching is faster in a single goroutine, the
+// goroutines cost more than they save, see BenchmarkMatchFeatures
+const minParallelMatch = 128
+
+// the packages a worker takes at a time, the packages of a source are next to each other and cost the same
+const matchChunk = 32
+
+// matchWorkers returns the number of goroutines to match n packages with
+func matchWorkers(n int) int {
+	workers := MatchWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if n < minParallelMatch || workers < 1 {
+		return 1
+	}
+	if max := (n + matchChunk - 1) / matchChunk; workers > max {
+		workers = max
+	}
+	return workers
+}
+
+// parallelMatch calls match for the indexes 0 to n-1 on the workers. match stores its result at the index,
+// so the results are in the order of the packages whatever the order they are matched in.
+func parallelMatch(n int, match func(i int)) {
+	workers := matchWorkers(n)
+	if workers == 1 {
+		for i := 0; i < n; i++ {
+			match(i)
+		}
+		return
+	}
+
+	var next int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				start := int(atomic.AddInt64(&next, matchChunk)) - matchChunk
+				if start >= n {
+					return
+				}
+				end := start + matchChunk
+				if end > n {
+					end = n
+				}
+				for i := start; i < end; i++ {
+					match(i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,67 @@
+package cvetools
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/neuvector/neuvector/share/utils"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/detectors"
+)
+
+// newMatchInput returns a database of n packages with a vulnerability each, and the installed packages
+func newMatchInput(n int) (map[string][]common.VulShort, []detectors.FeatureVersion) {
+	vss := make([]common.VulShort, n)
+	features := make([]detectors.FeatureVersion, n)
+	for i := 0; i < n; i++ {
+		pkg := fmt.Sprintf("pkg%d", i)
+		vss[i] = common.VulShort{Name: fmt.Sprintf("CVE-2022-%d", i), Namespace: "debian:11", Fixin: []common.FeaShort{{Name: pkg, Version: "1.2"}}}
+		features[i] = detectors.FeatureVersion{Package: pkg}
+		features[i].Version, _ = utils.NewVersion(fmt.Sprintf("1.%d", i%3+1))
+	}
+	return makeFeatureMap(vss, "debian:11"), features
+}
+
+func TestParallelMatch(t *testing.T) {
+	defer func(w int) { MatchWorkers = w }(MatchWorkers)
+
+	if w := matchWorkers(minParallelMatch - 1); w != 1 {
+		t.Errorf("Small image matched by %d workers", w)
+	}
+	MatchWorkers = 8
+	if w := matchWorkers(minParallelMatch); w != minParallelMatch/matchChunk {
+		t.Errorf("Incorrect workers: %d", w)
+	}
+
+	// the vulnerabilities are in the same order whatever the workers
+	mv, features := newMatchInput(1000)
+	MatchWorkers = 1
+	serial := getAffectedVul(mv, features, "debian:11")
+	MatchWorkers = 8
+	parallel := getAffectedVul(mv, features, "debian:11")
+	if len(serial) == 0 || len(serial) != len(parallel) {
+		t.Fatalf("Incorrect vulnerabilities: %d, %d", len(serial), len(parallel))
+	}
+	for i := range serial {
+		if serial[i].Vs.Name != parallel[i].Vs.Name || serial[i].Ft.Package != parallel[i].Ft.Package {
+			t.Fatalf("Incorrect order at %d: %s, %s", i, serial[i].Vs.Name, parallel[i].Vs.Name)
+		}
+	}
+}
+
+// BenchmarkMatchFeatures compares the matching in one goroutine with the workers, for a small and a large
+// image, the small images stay in one goroutine below minParallelMatch
+func BenchmarkMatchFeatures(b *testing.B) {
+	defer func(w int) { MatchWorkers = w }(MatchWorkers)
+	for _, n := range []int{50, minParallelMatch, 5000} {
+		mv, features := newMatchInput(n)
+		for _, workers := range []int{1, 0} {
+			b.Run(fmt.Sprintf("packages=%d/workers=%d", n, workers), func(b *testing.B) {
+				MatchWorkers = workers
+				for i := 0; i < b.N; i++ {
+					getAffectedVul(mv, features, "debian:11")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package cvetools
+
+import (
+	"sort"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/common"
+)
+
+// SeverityRank ranks the severity for the sorting, the higher the more severe, 0 for an unknown one
+func SeverityRank(severity string) int {
+	return common.SeverityRank(severity)
+}
+
+// the findings come out of maps, sort them so that two scans of the same image with the same database
+// produce the same result: severity from high to low, then cve name, then package name
+func sortVuls(vuls []*share.ScanVulnerability) {
+	sort.SliceStable(vuls, func(i, j int) bool {
+		a, b := vuls[i], vuls[j]
+		if ra, rb := SeverityRank(a.Severity), SeverityRank(b.Severity); ra != rb {
+			return ra > rb
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.PackageName != b.PackageName {
+			return a.PackageName < b.PackageName
+		}
+		if a.PackageVersion != b.PackageVersion {
+			return a.PackageVersion < b.PackageVersion
+		}
+		return a.FileName < b.FileName
+	})
+}
+
+// SortScanResult orders the vulnerabilities, modules, secrets and setid findings of the result.
+// The layers keep the image order.
+func SortScanResult(result *share.ScanResult) {
+	if result == nil {
+		return
+	}
+
+	sortVuls(result.Vuls)
+	for _, l := range result.Layers {
+		sortVuls(l.Vuls)
+	}
+
+	mods := result.Modules
+	sort.SliceStable(mods, func(i, j int) bool {
+		if mods[i].Name != mods[j].Name {
+			return mods[i].Name < mods[j].Name
+		}
+		if mods[i].Version != mods[j].Version {
+			return mods[i].Version < mods[j].Version
+		}
+		return mods[i].Source < mods[j].Source
+	})
+	for _, m := range mods {
+		sort.SliceStable(m.Vuls, func(i, j int) bool { return m.Vuls[i].Name < m.Vuls[j].Name })
+	}
+
+	if result.Secrets != nil {
+		logs := result.Secrets.Logs
+		sort.SliceStable(logs, func(i, j int) bool {
+			if logs[i].File != logs[j].File {
+				return logs[i].File < logs[j].File
+			}
+			if logs[i].Type != logs[j].Type {
+				return logs[i].Type < logs[j].Type
+			}
+			if logs[i].RuleDesc != logs[j].RuleDesc {
+				return logs[i].RuleDesc < logs[j].RuleDesc
+			}
+			return logs[i].Text < logs[j].Text
+		})
+	}
+
+	perms := result.SetIdPerms
+	sort.SliceStable(perms, func(i, j int) bool {
+		if perms[i].File != perms[j].File {
+			return perms[i].File < perms[j].File
+		}
+		return perms[i].Type < perms[j].Type
+	})
+}
@@ -0,0 +1,68 @@
+package cvetools
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+func makeOrderFixture(reverse bool) *share.ScanResult {
+	vuls := []*share.ScanVulnerability{
+		&share.ScanVulnerability{Name: "CVE-2021-0002", Severity: share.VulnSeverityMedium, PackageName: "openssl"},
+		&share.ScanVulnerability{Name: "CVE-2021-0001", Severity: share.VulnSeverityMedium, PackageName: "zlib"},
+		&share.ScanVulnerability{Name: "CVE-2021-0001", Severity: share.VulnSeverityMedium, PackageName: "openssl"},
+		&share.ScanVulnerability{Name: "CVE-2022-0003", Severity: share.VulnSeverityLow, PackageName: "bash"},
+		&share.ScanVulnerability{Name: "CVE-2020-0004", Severity: share.VulnSeverityCritical, PackageName: "curl"},
+		&share.ScanVulnerability{Name: "CVE-2023-0005", Severity: share.VulnSeverityHigh, PackageName: "curl"},
+	}
+	mods := []*share.ScanModule{
+		&share.ScanModule{Name: "zlib", Version: "1.2", Vuls: []*share.ScanModuleVul{{Name: "CVE-2021-0001"}}},
+		&share.ScanModule{Name: "openssl", Version: "1.1", Vuls: []*share.ScanModuleVul{{Name: "CVE-2021-0002"}, {Name: "CVE-2021-0001"}}},
+		&share.ScanModule{Name: "curl", Version: "7.0"},
+	}
+	secrets := []*share.ScanSecretLog{
+		&share.ScanSecretLog{File: "/etc/key.pem", Type: "private key"},
+		&share.ScanSecretLog{File: "/app/.env", Type: "password"},
+	}
+	if reverse {
+		for i, j := 0, len(vuls)-1; i < j; i, j = i+1, j-1 {
+			vuls[i], vuls[j] = vuls[j], vuls[i]
+		}
+		mods[0], mods[2] = mods[2], mods[0]
+		secrets[0], secrets[1] = secrets[1], secrets[0]
+	}
+	return &share.ScanResult{
+		Vuls:    vuls,
+		Modules: mods,
+		Secrets: &share.ScanSecretResult{Logs: secrets},
+		Layers:  []*share.ScanLayerResult{{Digest: "sha256:a", Vuls: vuls[:3]}},
+	}
+}
+
+func TestSortScanResult(t *testing.T) {
+	r1, r2 := makeOrderFixture(false), makeOrderFixture(true)
+	SortScanResult(r1)
+	SortScanResult(r2)
+	d1, _ := json.Marshal(r1)
+	d2, _ := json.Marshal(r2)
+	if string(d1) != string(d2) {
+		t.Errorf("Results are not identical:\n%s\n%s", d1, d2)
+	}
+
+	expect := []string{"CVE-2020-0004", "CVE-2023-0005", "CVE-2021-0001", "CVE-2021-0001", "CVE-2021-0002", "CVE-2022-0003"}
+	for i, v := range r1.Vuls {
+		if v.Name != expect[i] {
+			t.Errorf("Incorrect order at %d: %s, expect %s", i, v.Name, expect[i])
+		}
+	}
+	if r1.Vuls[2].PackageName != "openssl" || r1.Vuls[3].PackageName != "zlib" {
+		t.Errorf("Incorrect package order: %s %s", r1.Vuls[2].PackageName, r1.Vuls[3].PackageName)
+	}
+	if r1.Modules[0].Name != "curl" || r1.Modules[1].Vuls[0].Name != "CVE-2021-0001" {
+		t.Errorf("Incorrect module order: %+v", r1.Modules)
+	}
+	if r1.Secrets.Logs[0].File != "/app/.env" {
+		t.Errorf("Incorrect secret order: %+v", r1.Secrets.Logs)
+	}
+}
@@ -0,0 +1,143 @@
+package cvetools
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+// PackageFindings are the vulnerabilities of an installed package, remediated at once by upgrading it to
+// the fixed version, the lowest version that fixes all its vulnerabilities that have a fix
+type PackageFindings struct {
+	Package         string   `json:"Package"`
+	Version         string   `json:"Version"`
+	File            string   `json:"File,omitempty"`
+	FixedVersion    string   `json:"FixedVersion,omitempty"`
+	Severity        string   `json:"Severity"`
+	Disagree        bool     `json:"Disagree,omitempty"` // the vendor and NVD ratings of a most severe one disagree
+	Vulnerabilities []string `json:"Vulnerabilities"`
+	Unfixed         int      `json:"Unfixed,omitempty"` // the vulnerabilities without a fix
+}
+
+// GroupByPackage aggregates the vulnerabilities per package, the most severe packages first. The severity of
+// each vulnerability is the one the function returns with if its ratings disagree, the vendor one if it is nil.
+func GroupByPackage(vuls []*share.ScanVulnerability, severity func(v *share.ScanVulnerability) (string, bool)) []*PackageFindings {
+	type group struct {
+		pf    *PackageFindings
+		fixed *utils.Version
+		fixes []string // the fixed version of each vulnerability, when not comparable
+	}
+	groups := make(map[string]*group)
+	order := make([]*group, 0)
+	for _, v := range vuls {
+		sev, disagree := v.Severity, false
+		if severity != nil {
+			sev, disagree = severity(v)
+		}
+		key := v.PackageName + "\x00" + v.PackageVersion + "\x00" + v.FileName
+		g, ok := groups[key]
+		if !ok {
+			g = &group{pf: &PackageFindings{Package: v.PackageName, Version: v.PackageVersion, File: v.FileName, Severity: sev}}
+			groups[key] = g
+			order = append(order, g)
+		}
+		pf := g.pf
+		pf.Vulnerabilities = append(pf.Vulnerabilities, v.Name)
+		if rank := SeverityRank(sev); rank > SeverityRank(pf.Severity) {
+			pf.Severity, pf.Disagree = sev, disagree
+		} else if rank == SeverityRank(pf.Severity) {
+			pf.Disagree = pf.Disagree || disagree
+		}
+
+		if v.FixedVersion == "" {
+			pf.Unfixed++
+			continue
+		}
+		fix, ok := requiredFix(v.PackageVersion, v.FixedVersion)
+		if !ok {
+			g.fixes = append(g.fixes, v.FixedVersion)
+			continue
+		}
+		if g.fixed == nil || fix.Compare(*g.fixed) > 0 {
+			g.fixed = &fix
+		}
+	}
+
+	pfs := make([]*PackageFindings, len(order))
+	for i, g := range order {
+		if g.fixed != nil {
+			g.pf.FixedVersion = g.fixed.String()
+		}
+		if len(g.fixes) > 0 {
+			// a version that can't be compared is listed as is
+			fixes := make([]string, 0, len(g.fixes)+1)
+			seen := make(map[string]bool)
+			if g.pf.FixedVersion != "" {
+				fixes = append(fixes, g.pf.FixedVersion)
+			}
+			for _, f := range g.fixes {
+				if !seen[f] {
+					seen[f] = true
+					fixes = append(fixes, f)
+				}
+			}
+			g.pf.FixedVersion = strings.Join(fixes, ", ")
+		}
+		sort.Strings(g.pf.Vulnerabilities)
+		pfs[i] = g.pf
+	}
+	sort.SliceStable(pfs, func(i, j int) bool {
+		a, b := pfs[i], pfs[j]
+		if ra, rb := SeverityRank(a.Severity), SeverityRank(b.Severity); ra != rb {
+			return ra > rb
+		}
+		if len(a.Vulnerabilities) != len(b.Vulnerabilities) {
+			return len(a.Vulnerabilities) > len(b.Vulnerabilities)
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.File < b.File
+	})
+	return pfs
+}
+
+// requiredFix returns the version to upgrade the installed version to for a vulnerability. The fixed
+// version of an OS package is a version, the one of an application module can be the fixed ranges of the
+// branches, like ">=2.9.10.8;<2.10 OR >=2.10.5", the lowest fixed version above the installed one is taken.
+func requiredFix(installed, fixed string) (utils.Version, bool) {
+	cur, err := utils.NewVersion(installed)
+	if err != nil {
+		return utils.Version{}, false
+	}
+
+	var best *utils.Version
+	var highest *utils.Version
+	for _, branch := range strings.Split(fixed, " OR ") {
+		for _, cond := range strings.Split(branch, ";") {
+			cond = strings.TrimSpace(cond)
+			if strings.HasPrefix(cond, "<") {
+				// the upper bound of the branch
+				continue
+			}
+			ver, err := utils.NewVersion(strings.TrimLeft(cond, ">="))
+			if err != nil {
+				return utils.Version{}, false
+			}
+			if highest == nil || ver.Compare(*highest) > 0 {
+				highest = &ver
+			}
+			if ver.Compare(cur) > 0 && (best == nil || ver.Compare(*best) < 0) {
+				best = &ver
+			}
+		}
+	}
+	if best != nil {
+		return *best, true
+	} else if highest != nil {
+		return *highest, true
+	}
+	return utils.Version{}, false
+}
@@ -0,0 +1,36 @@
+package cvetools
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+func TestGroupByPackage(t *testing.T) {
+	vuls := []*share.ScanVulnerability{
+		{Name: "CVE-2022-0778", Severity: share.VulnSeverityHigh, PackageName: "openssl", PackageVersion: "1.1.1k-r0", FixedVersion: "1.1.1n-r0"},
+		{Name: "CVE-2021-3712", Severity: share.VulnSeverityMedium, PackageName: "openssl", PackageVersion: "1.1.1k-r0", FixedVersion: "1.1.1l-r0"},
+		{Name: "CVE-2023-0001", Severity: share.VulnSeverityLow, PackageName: "openssl", PackageVersion: "1.1.1k-r0"},
+		{Name: "CVE-2022-0002", Severity: share.VulnSeverityLow, PackageName: "zlib", PackageVersion: "1:1.2.11-r3", FixedVersion: "1:1.2.12-r0"},
+		// the fixed branches of a module, the fix of the installed branch is required
+		{Name: "CVE-2020-36518", Severity: share.VulnSeverityMedium, PackageName: "jackson-databind", PackageVersion: "2.12.3",
+			FileName: "app.jar", FixedVersion: ">=2.12.6.1;<2.13 OR >=2.13.2.1"},
+		{Name: "CVE-2022-42003", Severity: share.VulnSeverityHigh, PackageName: "jackson-databind", PackageVersion: "2.12.3",
+			FileName: "app.jar", FixedVersion: ">=2.12.7.1;<2.13 OR >=2.13.4.2"},
+	}
+	pfs := GroupByPackage(vuls, nil)
+	if len(pfs) != 3 {
+		t.Fatalf("Incorrect packages: %+v", pfs)
+	}
+	if pf := pfs[0]; pf.Package != "openssl" || pf.Severity != share.VulnSeverityHigh || pf.FixedVersion != "1.1.1n-r0" ||
+		pf.Unfixed != 1 || !reflect.DeepEqual(pf.Vulnerabilities, []string{"CVE-2021-3712", "CVE-2022-0778", "CVE-2023-0001"}) {
+		t.Errorf("Incorrect openssl: %+v", pf)
+	}
+	if pf := pfs[1]; pf.Package != "jackson-databind" || pf.File != "app.jar" || pf.FixedVersion != "2.12.7.1" {
+		t.Errorf("Incorrect jackson-databind: %+v", pf)
+	}
+	if pf := pfs[2]; pf.Package != "zlib" || pf.FixedVersion != "1:1.2.12-r0" {
+		t.Errorf("Incorrect zlib: %+v", pf)
+	}
+}
@@ -0,0 +1,81 @@
+package cvetools
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/neuvector/neuvector/share/utils"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/detectors"
+)
+
+// the OS vulnerability databases that can match the packages found by each package database detector
+var pkgDetectorDBs = map[string]utils.Set{
+	"dpkg": utils.NewSet(common.DBUbuntu, common.DBDebian),
+	"apk":  utils.NewSet(common.DBAlpine),
+	"rpm":  utils.NewSet(common.DBCentos, common.DBAmazon, common.DBOracle, common.DBMariner, common.DBSuse),
+}
+
+// osFeatures are the packages to be matched with the database of an OS
+type osFeatures struct {
+	namespace string
+	detector  string
+	features  []detectors.FeatureVersion
+}
+
+// splitOSFeatures groups the packages by the OS whose database can match them. An image can have more than
+// one OS package database, like dpkg and apk of different bases; the packages of the database that doesn't
+// belong to the image OS are matched with another OS found in the image. The first group is of the image OS.
+func splitOSFeatures(features []detectors.FeatureVersion, nsName string, candidates []*detectors.Namespace) ([]*osFeatures, []string) {
+	primary := &osFeatures{namespace: nsName}
+	if nsName == "" {
+		primary.features = features
+		return []*osFeatures{primary}, nil
+	}
+
+	_, imageDB := os2DB(nsName)
+	others := make(map[string]*osFeatures)
+	for _, ft := range features {
+		dbs, ok := pkgDetectorDBs[ft.Detector]
+		if !ok || imageDB == common.DBMax || dbs.Contains(imageDB) {
+			primary.features = append(primary.features, ft)
+			continue
+		}
+		g, ok := others[ft.Detector]
+		if !ok {
+			g = &osFeatures{detector: ft.Detector}
+			for _, ns := range candidates {
+				if _, db := os2DB(ns.Name); dbs.Contains(db) {
+					g.namespace = ns.Name
+					break
+				}
+			}
+			others[ft.Detector] = g
+		}
+		g.features = append(g.features, ft)
+	}
+
+	names := make([]string, 0, len(others))
+	for name := range others {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []*osFeatures{primary}
+	var notes []string
+	for _, name := range names {
+		g := others[name]
+		if g.namespace == "" {
+			notes = append(notes, fmt.Sprintf("%d packages of the %s database are not matched, the image OS is %s and no release of their OS is found",
+				len(g.features), g.detector, nsName))
+		} else {
+			notes = append(notes, fmt.Sprintf("%d packages of the %s database are matched with %s, the image OS is %s",
+				len(g.features), g.detector, g.namespace, nsName))
+		}
+		for i := range g.features {
+			g.features[i].Namespace = g.namespace
+		}
+		groups = append(groups, g)
+	}
+	return groups, notes
+}
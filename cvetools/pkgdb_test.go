@@ -0,0 +1,41 @@
+package cvetools
+
+import (
+	"testing"
+
+	"github.com/neuvector/scanner/detectors"
+)
+
+func TestSplitOSFeatures(t *testing.T) {
+	features := []detectors.FeatureVersion{
+		{Package: "musl", Detector: "apk"},
+		{Package: "openssl", Detector: "dpkg"},
+		{Package: "bash", Detector: "dpkg"},
+		{Package: "nginx", Detector: "others"},
+	}
+
+	// debian packages on an alpine image, the debian release is found from the apt sources
+	candidates := []*detectors.Namespace{{Name: "alpine:3.15"}, {Name: "debian:11"}}
+	groups, notes := splitOSFeatures(features, "alpine:3.15", candidates)
+	if len(groups) != 2 || len(notes) != 1 {
+		t.Fatalf("Unexpected groups: groups=%d notes=%v", len(groups), notes)
+	}
+	if g := groups[0]; g.namespace != "alpine:3.15" || len(g.features) != 2 {
+		t.Errorf("Unexpected image OS group: %+v", g)
+	}
+	if g := groups[1]; g.namespace != "debian:11" || g.detector != "dpkg" || len(g.features) != 2 || g.features[0].Namespace != "debian:11" {
+		t.Errorf("Unexpected dpkg group: %+v", g)
+	}
+
+	// no release of the other OS
+	groups, notes = splitOSFeatures(features, "alpine:3.15", candidates[:1])
+	if len(groups) != 2 || groups[1].namespace != "" || len(notes) != 1 {
+		t.Errorf("Unexpected groups without release: groups=%d notes=%v", len(groups), notes)
+	}
+
+	// single package database
+	groups, notes = splitOSFeatures(features[1:], "debian:11", candidates)
+	if len(groups) != 1 || len(groups[0].features) != 3 || notes != nil {
+		t.Errorf("Unexpected groups of a single OS: groups=%d notes=%v", len(groups), notes)
+	}
+}
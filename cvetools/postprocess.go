@@ -0,0 +1,104 @@
+package cvetools
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+// ImageMetadata is the image of the vulnerabilities given to a post-processor
+type ImageMetadata struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+	ImageID    string
+	Platform   *ImagePlatform
+	Labels     map[string]string
+}
+
+// PostProcessor modifies the matched vulnerabilities of an image before the result is returned or written,
+// like adding the links of the internal tickets or overriding the severity by the policy of the organization.
+// It returns the list to keep, a vulnerability can be changed in place, removed or added.
+type PostProcessor interface {
+	Name() string
+	Process(image *ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error)
+}
+
+// RegisterPostProcessor adds the post-processor, they run in the order of registration. The scans run by the
+// scanner tasks are post-processed in the scanner, so the post-processors are registered once at startup.
+func (cv *CveTools) RegisterPostProcessor(p PostProcessor) {
+	cv.postMutex.Lock()
+	defer cv.postMutex.Unlock()
+	cv.postProcessors = append(cv.postProcessors, p)
+}
+
+// PostProcess runs the post-processors on the vulnerabilities of the successful scan, the ones of the layers
+// are not processed. A post-processor that fails or panics is skipped, the list is kept as it was before it.
+// The severity map is applied last, so the severities of the result always follow it. The ignored image
+// checks and vulnerabilities are removed first, then the ones of a not_affected or a fixed VEX statement are
+// moved to the suppressed ones.
+func (cv *CveTools) PostProcess(report *ScanReport) {
+	if report == nil || report.ScanResult == nil || report.Error != share.ScanErrorCode_ScanErrNone {
+		return
+	}
+	cv.postMutex.RLock()
+	processors, severityMap, ignoredChecks, ignoredVuls := cv.postProcessors, cv.severityMap, cv.ignoredChecks, cv.ignoredVuls
+	reasons, vex, filters := cv.ignoreReasons, cv.vex, cv.scanFilters
+	cv.postMutex.RUnlock()
+	if filters != nil && report.Provenance != nil {
+		report.Provenance.Filters = filters
+	}
+	if len(ignoredChecks) > 0 {
+		report.Checks = filterChecks(report.Checks, ignoredChecks)
+	}
+	if len(ignoredVuls) > 0 {
+		filterVuls(report, ignoredVuls, reasons)
+	}
+	if len(vex) > 0 {
+		applyVEX(report, vex)
+	}
+	if len(severityMap) > 0 {
+		// the overrides record the severities of the database, not the ones the post-processors set
+		defer severityMap.apply(report, databaseSeverities(report.Vuls))
+	}
+	if len(processors) == 0 {
+		return
+	}
+
+	image := &ImageMetadata{
+		Registry:   report.Registry,
+		Repository: report.Repository,
+		Tag:        report.Tag,
+		Digest:     report.Digest,
+		ImageID:    report.ImageID,
+		Platform:   report.ImagePlatform,
+		Labels:     report.Labels,
+	}
+	for _, p := range processors {
+		vuls, err := runPostProcessor(p, image, report.Vuls)
+		if err != nil {
+			log.WithFields(log.Fields{"processor": p.Name(), "error": err}).Error("Post-processor failed")
+			continue
+		}
+		report.Vuls = vuls
+	}
+}
+
+func runPostProcessor(p PostProcessor, image *ImageMetadata, vuls []*share.ScanVulnerability) (out []*share.ScanVulnerability, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	// a copy, so a failed post-processor leaves the list as it was
+	in := make([]*share.ScanVulnerability, len(vuls))
+	for i, v := range vuls {
+		c := *v
+		in[i] = &c
+	}
+	return p.Process(image, in)
+}
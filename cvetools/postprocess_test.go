@@ -0,0 +1,76 @@
+package cvetools
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+type testPostProcessor struct {
+	name    string
+	process func(image *ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error)
+}
+
+func (p *testPostProcessor) Name() string { return p.name }
+
+func (p *testPostProcessor) Process(image *ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error) {
+	return p.process(image, vuls)
+}
+
+func TestPostProcessors(t *testing.T) {
+	cv := &CveTools{}
+	cv.RegisterPostProcessor(&testPostProcessor{name: "severity", process: func(image *ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error) {
+		var out []*share.ScanVulnerability
+		for _, v := range vuls {
+			if v.Name == "CVE-2021-0002" {
+				continue // accepted risk
+			}
+			if image.Labels["team"] == "payments" && v.Severity == share.VulnSeverityMedium {
+				v.Severity = share.VulnSeverityHigh
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}})
+	cv.RegisterPostProcessor(&testPostProcessor{name: "panic", process: func(image *ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error) {
+		vuls[0].Severity = share.VulnSeverityLow
+		var m map[string]string
+		m["x"] = "y"
+		return vuls, nil
+	}})
+	cv.RegisterPostProcessor(&testPostProcessor{name: "error", process: func(image *ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error) {
+		return nil, errors.New("ticket service is down")
+	}})
+	cv.RegisterPostProcessor(&testPostProcessor{name: "links", process: func(image *ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error) {
+		for _, v := range vuls {
+			v.Link = "https://tickets.corp/" + image.Repository + "/" + v.Name
+		}
+		return vuls, nil
+	}})
+
+	report := &ScanReport{ScanResult: &share.ScanResult{
+		Repository: "team/app",
+		Labels:     map[string]string{"team": "payments"},
+		Vuls: []*share.ScanVulnerability{
+			&share.ScanVulnerability{Name: "CVE-2021-0001", Severity: share.VulnSeverityMedium},
+			&share.ScanVulnerability{Name: "CVE-2021-0002", Severity: share.VulnSeverityHigh},
+		},
+	}}
+	cv.PostProcess(report)
+	if len(report.Vuls) != 1 {
+		t.Fatalf("Incorrect vulnerabilities: %+v", report.Vuls)
+	}
+	if v := report.Vuls[0]; v.Severity != share.VulnSeverityHigh || v.Link != "https://tickets.corp/team/app/CVE-2021-0001" {
+		t.Errorf("Incorrect vulnerability: %+v", v)
+	}
+
+	// a failed scan is not processed
+	failed := &ScanReport{ScanResult: &share.ScanResult{Error: share.ScanErrorCode_ScanErrImageNotFound, Vuls: []*share.ScanVulnerability{
+		&share.ScanVulnerability{Name: "CVE-2021-0001", Severity: share.VulnSeverityMedium},
+	}}}
+	cv.PostProcess(failed)
+	if len(failed.Vuls) != 1 || failed.Vuls[0].Severity != share.VulnSeverityMedium || failed.Vuls[0].Link != "" {
+		t.Errorf("Failed scan processed: %+v", failed.Vuls)
+	}
+}
@@ -0,0 +1,87 @@
+package cvetools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Profile captures the CPU profile of a scan, and the heap profile at its end, in a folder. Only a profile
+// can run at a time in a process, a scanner task profiles its own process.
+type Profile struct {
+	dir    string
+	suffix string // after the name of the image, like ".task" for the profiles of a scanner task
+	cpu    *os.File
+}
+
+// StartProfile starts the CPU profile, written to the folder as a temporary file until the profile is stopped
+func StartProfile(dir, suffix string) (*Profile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create the profile folder: %v", err)
+	}
+	f, err := ioutil.TempFile(dir, ".cpu-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the CPU profile: %v", err)
+	}
+	if err = pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("Failed to start the CPU profile: %v", err)
+	}
+	return &Profile{dir: dir, suffix: suffix, cpu: f}, nil
+}
+
+// Stop ends the CPU profile and writes the heap profile, both named by ProfileName. It returns the files
+// written, it can be called on a nil Profile.
+func (p *Profile) Stop(name string) []string {
+	if p == nil {
+		return nil
+	}
+	pprof.StopCPUProfile()
+	p.cpu.Close()
+
+	var files []string
+	cpuFile := filepath.Join(p.dir, name+p.suffix+".cpu.pprof")
+	if err := os.Rename(p.cpu.Name(), cpuFile); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to write the CPU profile")
+		os.Remove(p.cpu.Name())
+	} else {
+		files = append(files, cpuFile)
+	}
+
+	heapFile := filepath.Join(p.dir, name+p.suffix+".heap.pprof")
+	f, err := os.Create(heapFile)
+	if err == nil {
+		// the heap of the objects still in use, after the garbage of the scan is collected
+		runtime.GC()
+		err = pprof.WriteHeapProfile(f)
+		f.Close()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to write the heap profile")
+	} else {
+		files = append(files, heapFile)
+	}
+	return files
+}
+
+var unsafeProfileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// ProfileName names the profiles of a scan by the digest of the image, so the captures of the images don't
+// overwrite each other, or by the image reference when the scan failed before the digest is known
+func ProfileName(digest, image string) string {
+	if i := strings.Index(digest, ":"); i != -1 && i < len(digest)-1 {
+		return digest[i+1:]
+	}
+	if name := strings.Trim(unsafeProfileName.ReplaceAllString(image, "_"), "_."); name != "" {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,246 @@
+package cvetools
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+// ProgressEvent tells how far an image scan is. A phase reports Done when it ends, the download also reports
+// the layers and the bytes downloaded while it runs, to estimate the time left. The events after the matching
+// carry the vulnerabilities found.
+type ProgressEvent struct {
+	ScanID      string `json:"ScanID,omitempty"`
+	Image       string `json:"Image,omitempty"`
+	Phase       string `json:"Phase"`
+	Done        bool   `json:"Done,omitempty"`
+	Millis      int64  `json:"Millis,omitempty"` // the time of the phase, when done
+	Layers      int    `json:"Layers,omitempty"` // downloaded
+	TotalLayers int    `json:"TotalLayers,omitempty"`
+	Bytes       int64  `json:"Bytes,omitempty"` // downloaded, compressed
+	TotalBytes  int64  `json:"TotalBytes,omitempty"`
+	Findings    int    `json:"Findings,omitempty"` // vulnerabilities found, before the ignore file and the VEX
+	// the vulnerabilities matched, only relayed from the scanner tasks to the function of WithFindings
+	Matched *ScanReport `json:"Matched,omitempty"`
+}
+
+// ProgressFunc receives the progress events of a scan, it is called from the goroutines of the scan and
+// must not block
+type ProgressFunc func(*ProgressEvent)
+
+// the download progress is reported at most at this interval, and when a layer is done
+const progressInterval = 500 * time.Millisecond
+
+type progressFuncKey struct{}
+type progressTrackerKey struct{}
+
+// progressTracker counts the downloaded layers and bytes of a scan
+type progressTracker struct {
+	fn     ProgressFunc
+	scanID string
+	image  string
+
+	mutex      sync.Mutex
+	sizes      map[string]int64 // the layers to download
+	got        map[string]int64 // the bytes downloaded of each layer
+	done       map[string]bool
+	bytes      int64
+	totalBytes int64
+	last       time.Time
+	findings   int
+}
+
+// WithProgress returns the context to report the progress of the image scans to fn. The scanner tasks, in
+// another process, write the progress of their scans to a pipe, it is relayed to fn as it comes.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressFuncKey{}, fn)
+}
+
+// ProgressFromContext returns the function of WithProgress, nil if none
+func ProgressFromContext(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressFuncKey{}).(ProgressFunc)
+	return fn
+}
+
+// withProgressTracker returns the context to count the download of a scan, the tracker is nil if the
+// progress is not reported
+func withProgressTracker(ctx context.Context, scanID, image string) (context.Context, *progressTracker) {
+	fn := ProgressFromContext(ctx)
+	if fn == nil {
+		return ctx, nil
+	}
+	pt := &progressTracker{fn: fn, scanID: scanID, image: image}
+	return context.WithValue(ctx, progressTrackerKey{}, pt), pt
+}
+
+func progressFromContext(ctx context.Context) *progressTracker {
+	pt, _ := ctx.Value(progressTrackerKey{}).(*progressTracker)
+	return pt
+}
+
+// setLayers starts the download of the layers, the sizes are of the manifest
+func (pt *progressTracker) setLayers(layers []string, sizes map[string]int64) {
+	if pt == nil {
+		return
+	}
+	pt.mutex.Lock()
+	pt.sizes = make(map[string]int64)
+	pt.got = make(map[string]int64)
+	pt.done = make(map[string]bool)
+	pt.bytes, pt.totalBytes = 0, 0
+	for _, layer := range uniqueLayers(layers) {
+		if layer == emptyGzipLayer {
+			continue
+		}
+		pt.sizes[layer] = sizes[layer]
+		pt.totalBytes += sizes[layer]
+	}
+	ev := pt.downloadEvent()
+	pt.mutex.Unlock()
+	pt.fn(ev)
+}
+
+// start restarts the count of a layer, downloaded again when the layers are retried one by one
+func (pt *progressTracker) start(digest string) {
+	if pt == nil {
+		return
+	}
+	pt.mutex.Lock()
+	if _, ok := pt.sizes[digest]; ok {
+		pt.bytes -= pt.got[digest]
+		pt.got[digest] = 0
+		pt.done[digest] = false
+	}
+	pt.mutex.Unlock()
+}
+
+// add counts the bytes of a blob, they are reported if the blob is a layer
+func (pt *progressTracker) add(digest string, n int64, done bool) {
+	if pt == nil {
+		return
+	}
+	pt.mutex.Lock()
+	if _, ok := pt.sizes[digest]; !ok {
+		pt.mutex.Unlock()
+		return
+	}
+	pt.bytes += n
+	pt.got[digest] += n
+	if done {
+		pt.done[digest] = true
+	}
+	var ev *ProgressEvent
+	if done || time.Since(pt.last) >= progressInterval {
+		pt.last = time.Now()
+		ev = pt.downloadEvent()
+	}
+	pt.mutex.Unlock()
+	if ev != nil {
+		pt.fn(ev)
+	}
+}
+
+func (pt *progressTracker) downloadEvent() *ProgressEvent {
+	var layers int
+	for _, done := range pt.done {
+		if done {
+			layers++
+		}
+	}
+	return &ProgressEvent{
+		ScanID: pt.scanID, Image: pt.image, Phase: PhaseDownload, Layers: layers, TotalLayers: len(pt.sizes), Bytes: pt.bytes, TotalBytes: pt.totalBytes,
+		Findings: pt.findings,
+	}
+}
+
+// setFindings counts the vulnerabilities matched, reported from the end of the matching on
+func (pt *progressTracker) setFindings(n int) {
+	if pt == nil {
+		return
+	}
+	pt.mutex.Lock()
+	pt.findings = n
+	pt.mutex.Unlock()
+}
+
+func (pt *progressTracker) phaseDone(phase string, millis int64) {
+	if pt == nil {
+		return
+	}
+	pt.mutex.Lock()
+	findings := pt.findings
+	pt.mutex.Unlock()
+	pt.fn(&ProgressEvent{ScanID: pt.scanID, Image: pt.image, Phase: phase, Done: true, Millis: millis, Findings: findings})
+}
+
+// ProgressJSONWriter returns the function writing the progress events to w as JSON lines
+func ProgressJSONWriter(w io.Writer) ProgressFunc {
+	var mutex sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(ev *ProgressEvent) {
+		mutex.Lock()
+		enc.Encode(ev)
+		mutex.Unlock()
+	}
+}
+
+// FindingsFunc receives the vulnerabilities of an image scan as soon as they are matched, before the scan ends.
+// The report has the image and the matched vulnerabilities only, they are copies the function can change.
+type FindingsFunc func(*ScanReport)
+
+type findingsFuncKey struct{}
+
+// WithFindings returns the context to report the vulnerabilities of the image scans to fn when they are matched.
+// The scans run by the scanner tasks report them with their progress.
+func WithFindings(ctx context.Context, fn FindingsFunc) context.Context {
+	return context.WithValue(ctx, findingsFuncKey{}, fn)
+}
+
+// FindingsFromContext returns the function of WithFindings, nil if none
+func FindingsFromContext(ctx context.Context) FindingsFunc {
+	fn, _ := ctx.Value(findingsFuncKey{}).(FindingsFunc)
+	return fn
+}
+
+// reportFindings calls the function of WithFindings with the matched vulnerabilities of the report
+func reportFindings(ctx context.Context, report *ScanReport) {
+	fn := FindingsFromContext(ctx)
+	if fn == nil || report.Error != share.ScanErrorCode_ScanErrNone {
+		return
+	}
+	result := *report.ScanResult
+	result.Vuls = make([]*share.ScanVulnerability, len(report.Vuls))
+	for i, v := range report.Vuls {
+		c := *v
+		result.Vuls[i] = &c
+	}
+	// the layers and the secrets are not scanned yet
+	result.Layers, result.Secrets = nil, &share.ScanSecretResult{}
+	fn(&ScanReport{
+		ScanResult: &result, SchemaVersion: report.SchemaVersion, ImagePlatform: report.ImagePlatform, Locations: report.Locations,
+		Aliases: report.Aliases,
+	})
+}
+
+// ProgressFindings returns the function reporting the matched vulnerabilities to fn as a progress event, the
+// way the scanner tasks report them with their progress
+func ProgressFindings(fn ProgressFunc) FindingsFunc {
+	return func(report *ScanReport) {
+		fn(&ProgressEvent{Phase: PhaseMatching, Done: true, Findings: len(report.Vuls), Matched: report})
+	}
+}
+
+// progressWriter counts the bytes of a blob written while it is downloaded
+type progressWriter struct {
+	pt     *progressTracker
+	digest string
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.pt.add(w.digest, int64(len(p)), false)
+	return len(p), nil
+}
@@ -0,0 +1,101 @@
+package cvetools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	goDigest "github.com/opencontainers/go-digest"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+func TestScanProgress(t *testing.T) {
+	layer := []byte("layer content")
+	dg := goDigest.FromBytes(layer)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/app/blobs/"+dg.String() {
+			w.Write(layer)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	var mutex sync.Mutex
+	var events []*ProgressEvent
+	ctx := WithProgress(context.Background(), func(ev *ProgressEvent) {
+		mutex.Lock()
+		events = append(events, ev)
+		mutex.Unlock()
+	})
+	ctx, pt := withProgressTracker(ctx, "scan1", "app:1.0")
+	stats := &ScanStats{progress: pt}
+
+	pt.setLayers([]string{dg.String(), emptyGzipLayer}, map[string]int64{dg.String(): int64(len(layer)), emptyGzipLayer: 32})
+	rc := newRegClient(srv.URL, "", "", "", "")
+	for i := 0; i < 2; i++ {
+		// downloaded again, as when the layers are retried one by one, and counted once
+		rd, _, err := rc.DownloadLayer(ctx, "app", dg)
+		if err != nil {
+			t.Fatalf("Failed to download the layer: %v", err)
+		}
+		rd.Close()
+	}
+	stats.addPhase(PhaseDownload, time.Now(), 0)
+
+	if len(events) < 3 {
+		t.Fatalf("Too few events: %d", len(events))
+	}
+	first, last := events[0], events[len(events)-2]
+	if first.Phase != PhaseDownload || first.TotalLayers != 1 || first.TotalBytes != int64(len(layer)) || first.Bytes != 0 {
+		t.Errorf("Incorrect first event: %+v", first)
+	}
+	if last.Layers != 1 || last.Bytes != int64(len(layer)) || last.ScanID != "scan1" || last.Image != "app:1.0" {
+		t.Errorf("Incorrect download event: %+v", last)
+	}
+	if done := events[len(events)-1]; done.Phase != PhaseDownload || !done.Done {
+		t.Errorf("Incorrect phase event: %+v", done)
+	}
+
+	// the phases after the matching carry the vulnerabilities found
+	stats.setFindings(7)
+	stats.addPhase(PhaseMatching, time.Now(), 0)
+	if done := events[len(events)-1]; done.Phase != PhaseMatching || !done.Done || done.Findings != 7 {
+		t.Errorf("Incorrect matching event: %+v", done)
+	}
+	(*ScanStats)(nil).setFindings(7)
+
+	// the scans without a progress function have no tracker
+	if _, pt := withProgressTracker(context.Background(), "scan2", "app:1.0"); pt != nil {
+		t.Errorf("Unexpected tracker")
+	}
+}
+
+func TestReportFindings(t *testing.T) {
+	var got *ScanReport
+	ctx := WithFindings(context.Background(), func(r *ScanReport) { got = r })
+	report := NewScanReport(&share.ScanResult{
+		Digest: "sha256:0123", Vuls: []*share.ScanVulnerability{{Name: "CVE-2022-0778", Severity: share.VulnSeverityHigh}},
+		Layers: []*share.ScanLayerResult{{Digest: "sha256:4567"}},
+	})
+	reportFindings(ctx, report)
+	if got == nil || got.Digest != "sha256:0123" || len(got.Vuls) != 1 || got.Layers != nil || got.Secrets == nil {
+		t.Fatalf("Incorrect findings: %+v", got)
+	}
+	// copies, the post-processing of the findings doesn't change the result
+	got.Vuls[0].Severity = share.VulnSeverityLow
+	if report.Vuls[0].Severity != share.VulnSeverityHigh || report.Secrets != nil {
+		t.Errorf("The result is changed by the findings: %+v", report.Vuls[0])
+	}
+
+	// relayed from the scanner tasks with their progress
+	var events []*ProgressEvent
+	ProgressFindings(func(ev *ProgressEvent) { events = append(events, ev) })(got)
+	if len(events) != 1 || events[0].Phase != PhaseMatching || events[0].Matched != got || events[0].Findings != 1 {
+		t.Errorf("Incorrect findings event: %+v", events)
+	}
+}
@@ -0,0 +1,157 @@
+package cvetools
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+// ReportSchemaVersion is the version of the ScanReport fields, bump it when a field is added or changes its meaning.
+// Version 1 is the report before the version was recorded.
+const ReportSchemaVersion = 20
+
+// ScannerVersion is set at build time, -ldflags "-X github.com/neuvector/scanner/cvetools.ScannerVersion=..."
+var ScannerVersion = "unknown"
+
+// ScannerCommit and ScannerBuildDate are set at build time as ScannerVersion, for -binary_version
+var (
+	ScannerCommit    = "unknown"
+	ScannerBuildDate = "unknown"
+)
+
+// TaskProtocolVersion is the version of the request and result files and the flags of the scanner tasks, bump
+// it when they change in a way a scanner task of another version would misread
+const TaskProtocolVersion = 3
+
+// TaskHandshake is what a scanner task answers to -handshake, for the scanner to check the task binary is
+// of its version before running the scans in it
+type TaskHandshake struct {
+	ScannerVersion string `json:"ScannerVersion"`
+	Protocol       int    `json:"Protocol"`
+	SchemaVersion  int    `json:"SchemaVersion"`
+}
+
+// NewTaskHandshake returns the handshake of this binary
+func NewTaskHandshake() *TaskHandshake {
+	return &TaskHandshake{ScannerVersion: ScannerVersion, Protocol: TaskProtocolVersion, SchemaVersion: ReportSchemaVersion}
+}
+
+// Check returns an error if a scanner task of the handshake can't run the scans of this binary. The scanner
+// versions may differ, only the protocol and the report schema have to match.
+func (h *TaskHandshake) Check() error {
+	if h.Protocol != TaskProtocolVersion || h.SchemaVersion != ReportSchemaVersion {
+		return fmt.Errorf("The scanner task %s speaks the protocol %d and the report schema %d, the scanner %s needs %d and %d",
+			h.ScannerVersion, h.Protocol, h.SchemaVersion, ScannerVersion, TaskProtocolVersion, ReportSchemaVersion)
+	}
+	return nil
+}
+
+// ScanProvenance records who scanned the image, when and how, for audits
+type ScanProvenance struct {
+	ScannerVersion  string       `json:"ScannerVersion"`
+	CVEDBVersion    string       `json:"CVEDBVersion"`
+	CVEDBCreateTime string       `json:"CVEDBCreateTime"`
+	CVEDBSources    string       `json:"CVEDBSources,omitempty"` // the hash of the sources of a merged database
+	StartedAt       string       `json:"StartedAt"`              // RFC3339
+	FinishedAt      string       `json:"FinishedAt"`             // RFC3339
+	Options         *ScanOptions `json:"Options,omitempty"`
+	Filters         *ScanFilters `json:"Filters,omitempty"`
+}
+
+// ScanOptions are the effective options of an image scan
+type ScanOptions struct {
+	Platform        string `json:"Platform,omitempty"`
+	MaxImageSize    int64  `json:"MaxImageSize,omitempty"`
+	Strict          bool   `json:"Strict,omitempty"`
+	BestEffort      bool   `json:"BestEffort,omitempty"`
+	VerifySignature bool   `json:"VerifySignature,omitempty"`
+	ScanLayers      bool   `json:"ScanLayers"`
+	ScanSecrets     bool   `json:"ScanSecrets"`
+	BaseImage       string `json:"BaseImage,omitempty"`
+}
+
+// ScanFilters are the effective filters of the findings of a report, set by PostProcess
+type ScanFilters struct {
+	SeveritySource  string `json:"SeveritySource,omitempty"`  // the severity of the counts and the outputs, vendor, nvd or max
+	SeverityMapHash string `json:"SeverityMapHash,omitempty"` // of the -severity_map file, see FileHash
+	IgnoreFileHash  string `json:"IgnoreFileHash,omitempty"`  // of the -ignore_file, see FileHash
+}
+
+// FileHash returns the sha256 digest of the file, like sha256:<hex>, for the provenance to tell which
+// version of a filter file was applied
+func FileHash(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// SetScanFilters sets the filters recorded in the provenance of the reports by PostProcess, nil for none
+func (cv *CveTools) SetScanFilters(f *ScanFilters) {
+	cv.postMutex.Lock()
+	defer cv.postMutex.Unlock()
+	cv.scanFilters = f
+}
+
+func (req *ImageScanRequest) options() *ScanOptions {
+	return &ScanOptions{
+		Platform:        req.Platform,
+		MaxImageSize:    req.MaxImageSize,
+		Strict:          req.Strict,
+		BestEffort:      req.BestEffort,
+		VerifySignature: len(req.CosignKeys) > 0 || req.Keyless != nil,
+		ScanLayers:      req.ScanLayers,
+		ScanSecrets:     req.ScanSecrets,
+		BaseImage:       req.BaseImage,
+	}
+}
+
+// SetProvenance stamps the report and its result with the schema version and the provenance, opts is nil
+// for the non-image scans
+func (r *ScanReport) SetProvenance(cv *CveTools, start time.Time, opts *ScanOptions) {
+	cv.SetDBVersion(r.ScanResult)
+	sources := cv.dbSources()
+	if r.db != nil {
+		sources = r.db.Sources
+	}
+	r.SchemaVersion = ReportSchemaVersion
+	r.Provenance = &ScanProvenance{
+		ScannerVersion:  ScannerVersion,
+		CVEDBVersion:    r.Version,
+		CVEDBCreateTime: r.CVEDBCreateTime,
+		CVEDBSources:    sources,
+		StartedAt:       start.UTC().Format(time.RFC3339),
+		FinishedAt:      time.Now().UTC().Format(time.RFC3339),
+		Options:         opts,
+	}
+}
+
+// DecodeScanReport reads a report of the current or an earlier schema version. The reports of version 1 are
+// plain share.ScanResult, or carry the image details without the provenance.
+func DecodeScanReport(data []byte) (*ScanReport, error) {
+	var r ScanReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.ScanResult == nil {
+		return nil, fmt.Errorf("Empty result")
+	}
+
+	switch {
+	case r.SchemaVersion == 0:
+		r.SchemaVersion = 1
+	case r.SchemaVersion > ReportSchemaVersion:
+		return nil, fmt.Errorf("Unsupported report schema version %d, the latest is %d", r.SchemaVersion, ReportSchemaVersion)
+	}
+	return &r, nil
+}
+
+// NewScanReport wraps the result of a non-image scan
+func NewScanReport(result *share.ScanResult) *ScanReport {
+	return &ScanReport{ScanResult: result}
+}
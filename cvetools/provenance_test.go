@@ -0,0 +1,82 @@
+package cvetools
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/common"
+)
+
+func TestDecodeScanReport(t *testing.T) {
+	// version 1, a plain share.ScanResult
+	r, err := DecodeScanReport([]byte(`{"Repository": "library/nginx", "Version": "1.234"}`))
+	if err != nil || r.SchemaVersion != 1 || r.Repository != "library/nginx" || r.Provenance != nil {
+		t.Errorf("Unexpected version 1 report: %+v %v", r, err)
+	}
+
+	r, err = DecodeScanReport([]byte(`{"Repository": "library/nginx", "SchemaVersion": 2,
+		"Provenance": {"ScannerVersion": "v1.0", "CVEDBVersion": "1.234", "Options": {"Platform": "linux/arm64"}}}`))
+	if err != nil || r.SchemaVersion != 2 || r.Provenance == nil || r.Provenance.Options.Platform != "linux/arm64" {
+		t.Errorf("Unexpected version 2 report: %+v %v", r, err)
+	}
+
+	if _, err = DecodeScanReport([]byte(`{"Repository": "library/nginx", "SchemaVersion": 99}`)); err == nil {
+		t.Errorf("Expect an error for a newer version")
+	}
+	if _, err = DecodeScanReport([]byte(`{}`)); err == nil {
+		t.Errorf("Expect an error for an empty report")
+	}
+}
+
+func TestResultDBVersion(t *testing.T) {
+	dir := t.TempDir()
+	app, _ := json.Marshal(common.AppModuleVul{
+		VulName: "CVE-2022-0002", AppName: "npm", ModuleName: "lodash",
+		AffectedVer: []common.AppModuleVersion{{OpCode: "lt", Version: "4.17.21"}},
+	})
+	ioutil.WriteFile(filepath.Join(dir, "apps.tb"), append(app, '\n'), 0644)
+	cv := NewCveTools("", nil)
+	cv.TbPath = dir + "/"
+	cv.SwapDB("3.011", "2026-09-01T00:00:00Z")
+
+	result, _ := cv.ScanAppPackage(&share.ScanAppRequest{Packages: []*share.ScanAppPackage{
+		{AppName: "npm", ModuleName: "lodash", Version: "4.17.15", FileName: "app/package.json"},
+	}}, "")
+	if len(result.Vuls) != 1 || result.Version != "3.011" {
+		t.Fatalf("Incorrect scan: %+v", result)
+	}
+
+	// the database updated after the match, the result keeps the version it was matched with
+	cv.UpdateMux.Lock()
+	cv.SwapDB("3.012", "2026-10-01T00:00:00Z")
+	cv.UpdateMux.Unlock()
+	report := NewScanReport(result)
+	report.SetProvenance(cv, time.Now(), nil)
+	if report.Version != "3.011" || report.CVEDBCreateTime != "2026-09-01T00:00:00Z" || report.Provenance.CVEDBVersion != "3.011" {
+		t.Errorf("Incorrect database version: %+v %+v", report.ScanResult, report.Provenance)
+	}
+
+	// the post-processing records the filters of the findings
+	ioutil.WriteFile(filepath.Join(dir, "ignore"), []byte("CVE-2021-0001 accepted\n"), 0644)
+	hash, err := FileHash(filepath.Join(dir, "ignore"))
+	if err != nil || hash != fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("CVE-2021-0001 accepted\n"))) {
+		t.Fatalf("Incorrect file hash: %s %v", hash, err)
+	}
+	cv.SetScanFilters(&ScanFilters{SeveritySource: SeveritySourceMax, IgnoreFileHash: hash})
+	cv.PostProcess(report)
+	if f := report.Provenance.Filters; f == nil || f.SeveritySource != SeveritySourceMax || f.IgnoreFileHash != hash {
+		t.Errorf("Incorrect filters: %+v", f)
+	}
+
+	// a scan failing before the match has the current one
+	result, _ = cv.ScanImageData(&share.ScanData{Buffer: []byte("not an archive")})
+	if result.Version != "3.012" || result.CVEDBCreateTime != "2026-10-01T00:00:00Z" {
+		t.Errorf("Incorrect database version of a failed scan: %+v", result)
+	}
+}
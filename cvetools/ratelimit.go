@@ -0,0 +1,478 @@
+package cvetools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RateLimit is the request budget of each registry host, for the registry sweeps. The sweep process applies
+// it, a scanner task asks the sweep process for each of its requests on the socket of its request.
+type RateLimit struct {
+	RequestsPerMinute int    `json:"RequestsPerMinute,omitempty"` // 0 for no budget, the requests are only slowed down
+	BlobDownloads     int    `json:"BlobDownloads,omitempty"`     // concurrent blob downloads, 0 for no limit
+	Socket            string `json:"Socket,omitempty"`            // of the sweep process handing out the requests
+}
+
+// RateStats is how the registry hosts responded to the requests under the rate limit
+type RateStats struct {
+	Requests  int     `json:"Requests"`
+	PerMinute int     `json:"PerMinute"`           // the requests of the last minute
+	Throttled int     `json:"Throttled,omitempty"` // the responses 429 and 503
+	Slow      int     `json:"Slow,omitempty"`      // the responses of an elevated latency
+	Slowdown  float64 `json:"Slowdown,omitempty"`  // the highest slow-down of the hosts, 1 for none
+}
+
+// the adaptive slow-down: the interval between the requests is multiplied by the slow-down, doubled by a
+// throttled response, raised by a slow one and lowered back by the healthy ones
+const (
+	maxSlowdown        = 32.0
+	slowdownDecay      = 0.9
+	slowLatencyRaise   = 1.5
+	slowLatencyFactor  = 4 // times the average latency
+	slowLatencyMin     = time.Second
+	latencySamples     = 10 // before the latency is compared to the average
+	unlimitedInterval  = 100 * time.Millisecond
+	throttledRetries   = 3
+	throttledRetryWait = 5 * time.Second
+)
+
+var (
+	rateMutex sync.Mutex
+	rateLimit *RateLimit
+	rateHosts = make(map[string]*hostLimiter)
+)
+
+// SetRateLimit sets the budget of the requests to each registry host, nil for no limit. With a socket, the
+// requests are handed out by the process serving it.
+func SetRateLimit(limit *RateLimit) {
+	rateMutex.Lock()
+	defer rateMutex.Unlock()
+	rateLimit = limit
+	rateHosts = make(map[string]*hostLimiter)
+}
+
+// RateLimitStats returns the stats of all the hosts of the rate limit, nil without a rate limit or when the
+// requests are handed out by another process
+func RateLimitStats() *RateStats {
+	rateMutex.Lock()
+	defer rateMutex.Unlock()
+	if rateLimit == nil || rateLimit.Socket != "" {
+		return nil
+	}
+	stats := &RateStats{Slowdown: 1}
+	for _, l := range rateHosts {
+		s := l.stats()
+		stats.Requests += s.Requests
+		stats.PerMinute += s.PerMinute
+		stats.Throttled += s.Throttled
+		stats.Slow += s.Slow
+		if s.Slowdown > stats.Slowdown {
+			stats.Slowdown = s.Slowdown
+		}
+	}
+	return stats
+}
+
+func hostRateLimiter(host string) *hostLimiter {
+	rateMutex.Lock()
+	defer rateMutex.Unlock()
+	if rateLimit == nil {
+		return nil
+	}
+	l, ok := rateHosts[host]
+	if !ok {
+		l = newHostLimiter(host, rateLimit)
+		rateHosts[host] = l
+	}
+	return l
+}
+
+// hostLimiter spaces the requests to a host by the budget and the slow-down, and holds the blob downloads
+// over the limit until a download ends
+type hostLimiter struct {
+	host     string
+	interval time.Duration // of the budget, 0 for none
+	blobs    chan struct{}
+
+	mutex    sync.Mutex
+	next     time.Time // of the next request
+	slowdown float64
+	latency  time.Duration // the moving average, of the requests other than the blob downloads
+	samples  int
+	recent   []time.Time // the requests of the last minute
+	counts   RateStats
+}
+
+func newHostLimiter(host string, limit *RateLimit) *hostLimiter {
+	l := &hostLimiter{host: host, slowdown: 1}
+	if limit.RequestsPerMinute > 0 {
+		l.interval = time.Minute / time.Duration(limit.RequestsPerMinute)
+	}
+	if limit.BlobDownloads > 0 {
+		l.blobs = make(chan struct{}, limit.BlobDownloads)
+	}
+	return l
+}
+
+// wait returns at the time of the next request of the host
+func (l *hostLimiter) wait(ctx context.Context) error {
+	l.mutex.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	interval := l.interval
+	if interval == 0 && l.slowdown > 1 {
+		interval = unlimitedInterval
+	}
+	l.next = start.Add(time.Duration(float64(interval) * l.slowdown))
+	l.mutex.Unlock()
+
+	if d := time.Until(start); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// rateAttempt is how the host responded to a request, sent by a scanner task to the sweep process
+type rateAttempt struct {
+	Status     int           `json:"Status,omitempty"` // 0 without a response
+	RetryAfter string        `json:"RetryAfter,omitempty"`
+	Failed     bool          `json:"Failed,omitempty"`
+	Latency    time.Duration `json:"Latency"`
+}
+
+func newRateAttempt(resp *http.Response, err error, latency time.Duration) rateAttempt {
+	a := rateAttempt{Failed: err != nil, Latency: latency}
+	if resp != nil {
+		a.Status = resp.StatusCode
+		a.RetryAfter = resp.Header.Get("Retry-After")
+	}
+	return a
+}
+
+// observe adapts the slow-down to the response, it returns the wait asked by a throttled response
+func (l *hostLimiter) observe(a rateAttempt, blob bool) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.counts.Requests++
+	l.recent = append(l.recent, now)
+	for len(l.recent) > 0 && now.Sub(l.recent[0]) > time.Minute {
+		l.recent = l.recent[1:]
+	}
+
+	if a.Status == http.StatusTooManyRequests || a.Status == http.StatusServiceUnavailable {
+		l.counts.Throttled++
+		l.raise(2)
+		wait := retryAfter(a.RetryAfter, now)
+		if next := now.Add(wait); wait > 0 && next.After(l.next) {
+			l.next = next
+		}
+		log.WithFields(log.Fields{"host": l.host, "status": a.Status, "slowdown": l.slowdown, "retry_after": wait}).Warn("Throttled by the registry")
+		return true, wait
+	}
+	latency := a.Latency
+	if a.Failed || blob {
+		return false, 0
+	}
+
+	if l.samples >= latencySamples && latency > slowLatencyMin && latency > l.latency*slowLatencyFactor {
+		l.counts.Slow++
+		l.raise(slowLatencyRaise)
+		log.WithFields(log.Fields{"host": l.host, "latency": latency, "average": l.latency, "slowdown": l.slowdown}).Debug("Slow registry response")
+	} else if l.slowdown = l.slowdown * slowdownDecay; l.slowdown < 1 {
+		l.slowdown = 1
+	}
+	if l.samples == 0 {
+		l.latency = latency
+	} else {
+		l.latency = (l.latency*7 + latency) / 8
+	}
+	l.samples++
+	return false, 0
+}
+
+func (l *hostLimiter) raise(factor float64) {
+	if l.slowdown *= factor; l.slowdown > maxSlowdown {
+		l.slowdown = maxSlowdown
+	}
+}
+
+func (l *hostLimiter) stats() RateStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s := l.counts
+	s.Slowdown = l.slowdown
+	for _, t := range l.recent {
+		if time.Since(t) <= time.Minute {
+			s.PerMinute++
+		}
+	}
+	return s
+}
+
+// retryAfter returns the wait of the Retry-After header, in seconds or a date, 0 if none
+func retryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// limit spaces the sends of a request by the budget and the slow-down, and sends it again when throttled. The
+// request is resent after discard, when it has no body. It returns the release of the blob download, for when
+// its body is read.
+func (l *hostLimiter) limit(ctx context.Context, blob, resendable bool, send func() (rateAttempt, error), discard func()) (func(), error) {
+	release := func() {}
+	if blob && l.blobs != nil {
+		select {
+		case l.blobs <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-l.blobs }) }
+	}
+
+	for retry := 0; ; retry++ {
+		if err := l.wait(ctx); err != nil {
+			release()
+			return nil, err
+		}
+		a, err := send()
+		if err != nil {
+			release()
+			return nil, err
+		}
+		throttled, wait := l.observe(a, blob)
+		if throttled && retry < throttledRetries && resendable {
+			discard()
+			if wait == 0 {
+				// spaced by the slow-down, and at least this long
+				l.mutex.Lock()
+				if next := time.Now().Add(throttledRetryWait); next.After(l.next) {
+					l.next = next
+				}
+				l.mutex.Unlock()
+			}
+			continue
+		}
+		if a.Failed || a.Status == 0 {
+			release()
+		}
+		return release, nil
+	}
+}
+
+// rateTransport applies the rate limit of the host of each request, the throttled requests without a body
+// are sent again after the wait
+type rateTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *rateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rateMutex.Lock()
+	limit := rateLimit
+	rateMutex.Unlock()
+	if limit != nil && limit.Socket != "" {
+		return t.remoteRoundTrip(req, limit.Socket)
+	}
+	l := hostRateLimiter(req.URL.Host)
+	if l == nil {
+		return t.transport.RoundTrip(req)
+	}
+
+	blob := isBlobRequest(req)
+	var resp *http.Response
+	var err error
+	send := func() (rateAttempt, error) {
+		start := time.Now()
+		resp, err = t.transport.RoundTrip(req)
+		return newRateAttempt(resp, err, time.Since(start)), nil
+	}
+	release, werr := l.limit(req.Context(), blob, isResendable(req), send, func() { discardBody(resp) })
+	if werr != nil {
+		return nil, werr
+	}
+	if blob && err == nil && resp != nil {
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	}
+	return resp, err
+}
+
+// rateRequest opens the request of a scanner task to the sweep process, which answers with a rateGrant
+// before each send, the task answers each send with its rateAttempt. The connection of a blob download is
+// held until its body is closed.
+type rateRequest struct {
+	Host       string `json:"Host"`
+	Blob       bool   `json:"Blob,omitempty"`
+	Resendable bool   `json:"Resendable,omitempty"`
+}
+
+type rateGrant struct {
+	Done bool `json:"Done,omitempty"` // the last send is the response
+}
+
+// remoteRoundTrip sends the request when the sweep process grants it
+func (t *rateTransport) remoteRoundTrip(req *http.Request, socket string) (*http.Response, error) {
+	ctx := req.Context()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("The sweep hands out no requests: %w", err)
+	}
+	// a canceled request ends the wait of the grant
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	defer close(stop)
+
+	blob := isBlobRequest(req)
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	var resp *http.Response
+	err = enc.Encode(&rateRequest{Host: req.URL.Host, Blob: blob, Resendable: isResendable(req)})
+	for err == nil {
+		var grant rateGrant
+		if derr := dec.Decode(&grant); derr != nil {
+			discardBody(resp)
+			conn.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("The sweep hands out no requests: %w", derr)
+		}
+		if grant.Done {
+			break
+		}
+		discardBody(resp)
+		start := time.Now()
+		resp, err = t.transport.RoundTrip(req)
+		if eerr := enc.Encode(newRateAttempt(resp, err, time.Since(start))); eerr != nil && err == nil {
+			err = eerr
+			discardBody(resp)
+			resp = nil
+		}
+	}
+	if blob && err == nil && resp != nil {
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { conn.Close() }}
+	} else {
+		conn.Close()
+	}
+	return resp, err
+}
+
+// ServeRateLimit hands out the requests of the scanner tasks on a unix socket, by the rate limit of this
+// process, until the context ends
+func ServeRateLimit(ctx context.Context, socket string) error {
+	os.Remove(socket)
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		os.Remove(socket)
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveRateRequest(ctx, conn)
+		}
+	}()
+	return nil
+}
+
+func serveRateRequest(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+	var req rateRequest
+	if err := dec.Decode(&req); err != nil {
+		return
+	}
+	send := func() (rateAttempt, error) {
+		var a rateAttempt
+		if err := enc.Encode(&rateGrant{}); err != nil {
+			return a, err
+		}
+		err := dec.Decode(&a)
+		return a, err
+	}
+	l := hostRateLimiter(req.Host)
+	if l == nil {
+		send()
+		enc.Encode(&rateGrant{Done: true})
+		return
+	}
+	release, err := l.limit(ctx, req.Blob, req.Resendable, send, func() {})
+	if err != nil {
+		return
+	}
+	defer release()
+	if enc.Encode(&rateGrant{Done: true}) == nil && req.Blob {
+		// the task closes the connection at the end of the download, or by exiting
+		io.Copy(ioutil.Discard, conn)
+	}
+}
+
+func isBlobRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/blobs/")
+}
+
+func isResendable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+func discardBody(resp *http.Response) {
+	if resp != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// releaseBody ends the blob download, for the next one, when its body is closed
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,118 @@
+package cvetools
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	var throttled int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/throttled" && atomic.AddInt32(&throttled, 1)%2 == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(dir, "rate.sock")
+	if err := ServeRateLimit(ctx, socket); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRateLimit(nil)
+	client := &http.Client{Transport: &rateTransport{transport: http.DefaultTransport}}
+
+	// the requests of this process, and the ones handed out by the socket, as to a scanner task; the server of
+	// the socket applies the budget of this process
+	for _, socket := range []string{"", socket} {
+		SetRateLimit(&RateLimit{RequestsPerMinute: 600, BlobDownloads: 1, Socket: socket})
+
+		// the throttled request is sent again after the Retry-After
+		start := time.Now()
+		resp, err := client.Get(srv.URL + "/v2/throttled")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Throttled request not retried: %s %v %v", socket, resp, err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("Retry-After not honored: %s %v", socket, elapsed)
+		}
+		var stats RateStats
+		if l := hostRateLimiter(srv.Listener.Addr().String()); l != nil {
+			stats = l.stats()
+		}
+		if stats.Requests != 2 || stats.Throttled != 1 || stats.Slowdown < 1.5 {
+			t.Errorf("Incorrect rate stats: %s %+v", socket, stats)
+		}
+		if s := RateLimitStats(); (socket == "") != (s != nil) {
+			t.Errorf("Incorrect stats of the process: %s %+v", socket, s)
+		}
+
+		// a blob download holds the next one until its body is closed
+		blob, err := client.Get(srv.URL + "/v2/app/blobs/sha256:1111")
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := make(chan struct{})
+		go func() {
+			if resp, err := client.Get(srv.URL + "/v2/app/blobs/sha256:2222"); err == nil {
+				resp.Body.Close()
+			}
+			close(next)
+		}()
+		select {
+		case <-next:
+			t.Errorf("Blob download over the limit not held: %s", socket)
+		case <-time.After(500 * time.Millisecond):
+		}
+		blob.Body.Close()
+		select {
+		case <-next:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Blob download not released: %s", socket)
+		}
+	}
+
+	// the socket of an ended sweep fails the requests
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.Get(srv.URL + "/v2/app/manifests/latest"); err == nil {
+		t.Errorf("Request not handed out")
+	}
+
+	if wait := retryAfter("Wed, 21 Oct 2015 07:28:00 GMT", time.Date(2015, 10, 21, 7, 27, 0, 0, time.UTC)); wait != time.Minute {
+		t.Errorf("Incorrect Retry-After date: %v", wait)
+	}
+
+	// the slow responses raise the slow-down, the healthy ones lower it back
+	l := newHostLimiter("registry.local", &RateLimit{})
+	for i := 0; i < latencySamples; i++ {
+		l.observe(rateAttempt{Status: http.StatusOK, Latency: 100 * time.Millisecond}, false)
+	}
+	l.observe(rateAttempt{Status: http.StatusOK, Latency: 2 * time.Second}, false)
+	if s := l.stats(); s.Slow != 1 || s.Slowdown != slowLatencyRaise {
+		t.Errorf("Slow response not observed: %+v", s)
+	}
+	for i := 0; i < 10; i++ {
+		l.observe(rateAttempt{Status: http.StatusOK, Latency: 100 * time.Millisecond}, false)
+	}
+	if s := l.stats(); s.Slowdown != 1 {
+		t.Errorf("Slow-down not lowered: %+v", s)
+	}
+}
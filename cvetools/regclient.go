@@ -0,0 +1,278 @@
+package cvetools
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neuvector/neuvector/share/httptrace"
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/scan/registry"
+)
+
+// UserAgent is sent with all the registry requests, including the token requests to the auth servers
+var UserAgent = DefaultUserAgent()
+
+// UserAgentEnv overrides the default user agent, the -registry_user_agent option overrides both
+const UserAgentEnv = "SCANNER_REGISTRY_USER_AGENT"
+
+// DefaultUserAgent identifies the scanner and its version
+func DefaultUserAgent() string {
+	if agent := os.Getenv(UserAgentEnv); agent != "" {
+		return agent
+	}
+	return "neuvector-scanner/" + ScannerVersion
+}
+
+type scanIDKey struct{}
+
+// NewScanID returns a short random ID to correlate the logs and the registry requests of a scan
+func NewScanID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithScanID returns the context of the scan, the registry requests made with it carry the scan ID
+// in the user agent, like neuvector-scanner/5.3.0 (+3f2a9c01b7e4)
+func WithScanID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, scanIDKey{}, id)
+}
+
+// ScanIDFromContext returns the scan ID of WithScanID, empty if none
+func ScanIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(scanIDKey{}).(string)
+	return id
+}
+
+type userAgentTransport struct {
+	agent     string
+	transport http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper should not modify the request
+	r := req.Clone(req.Context())
+	if id := ScanIDFromContext(req.Context()); id != "" {
+		r.Header.Set("User-Agent", fmt.Sprintf("%s (+%s)", t.agent, id))
+	} else {
+		r.Header.Set("User-Agent", t.agent)
+	}
+	return t.transport.RoundTrip(r)
+}
+
+// the certificate files given to SetRegistryTLS, passed on to the scanner tasks
+var RegistryClientCert, RegistryClientKey, RegistryCACert string
+
+// registryTLS has the client certificate and the CA pool applied to the registry clients, nil if none
+var registryTLS *tls.Config
+
+// SetRegistryTLS loads the client certificate for the registries that authenticate by mTLS, and the CA
+// certificates to verify the registries with. Without a CA file, the registry certificate is not verified
+// as before. The CA certificates are added to the system pool, so the public auth servers are still trusted.
+func SetRegistryTLS(certFile, keyFile, caFile string) error {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil
+	}
+
+	cfg := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return fmt.Errorf("Both the client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Failed to load the client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read the CA certificate: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No CA certificate found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	RegistryClientCert, RegistryClientKey, RegistryCACert = certFile, keyFile, caFile
+	registryTLS = cfg
+	return nil
+}
+
+// applyRegistryTLS sets the client certificate and the CA pool on the transport of the registry client
+func applyRegistryTLS(tr *http.Transport, cfg *tls.Config) {
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	if len(cfg.Certificates) > 0 {
+		tr.TLSClientConfig.Certificates = cfg.Certificates
+	}
+	if cfg.RootCAs != nil {
+		tr.TLSClientConfig.RootCAs = cfg.RootCAs
+		tr.TLSClientConfig.InsecureSkipVerify = false
+	}
+}
+
+// RegistryBaseURL returns the base URL that the /v2/ API paths are appended to. The URL can have a path
+// prefix when the registry is behind a reverse proxy or an api gateway, like https://host/registry;
+// the /v2 suffix given with the prefix is removed, so it is not doubled. An IPv6 literal host is put
+// in brackets, the port can only be given with the brackets, like https://[fd00::1]:5000.
+func RegistryBaseURL(url string) string {
+	url = strings.TrimRight(url, "/")
+	i := strings.Index(url, "://")
+	if i == -1 {
+		return url
+	}
+
+	scheme, host, path := url[:i+3], url[i+3:], ""
+	if j := strings.Index(host, "/"); j != -1 {
+		host, path = host[:j], strings.TrimSuffix(host[j:], "/v2")
+	}
+	if strings.Count(host, ":") > 1 && net.ParseIP(host) != nil {
+		host = "[" + host + "]"
+	}
+	return scheme + host + path
+}
+
+// newRegClient creates the registry client with the TLS settings and the user agent set on the innermost
+// transport, under the token and basic auth transports, so every request is covered. Without a preset
+// token, the authentication follows the WWW-Authenticate challenges of the registry. The entry of the
+// registries configuration matching the host overrides the TLS settings.
+func newRegClient(url, token, username, password, proxy string) *scan.RegClient {
+	url = RegistryBaseURL(url)
+	entry := matchRegistry(urlHost(url))
+	if entry != nil {
+		url, username, password = applyRegistryEntry(entry, url, token, username, password)
+	}
+	rc := scan.NewRegClient(url, token, username, password, proxy, new(httptrace.NopTracer))
+	if rc.Registry == nil {
+		return rc
+	}
+
+	bt := basicTransport(rc.Client.Client.Transport)
+	if bt == nil {
+		return rc
+	}
+	if username == IdentityTokenUsername {
+		// the identity token is exchanged for a bearer token at the token endpoint, never sent to the registry
+		bt.Username, bt.Password = "", ""
+	}
+	tt, ok := bt.Transport.(*registry.TokenTransport)
+	if !ok {
+		return rc
+	}
+	if tr, ok := tt.Transport.(*http.Transport); ok {
+		var src *tls.Config
+		if entry != nil && entry.tls != nil {
+			src = entry.tls
+			tr.TLSClientConfig = entry.tls.Clone()
+		} else if registryTLS != nil {
+			src = registryTLS
+			applyRegistryTLS(tr, registryTLS)
+		}
+		tt.Transport = sharedTransport(transportKey{host: urlHost(url), proxy: proxy, tls: src}, tr)
+	}
+	tt.Transport = &rateTransport{transport: tt.Transport}
+	if UserAgent != "" {
+		tt.Transport = &userAgentTransport{agent: UserAgent, transport: tt.Transport}
+	}
+	tt.Transport = &digestTransport{transport: tt.Transport}
+	if tt.Token == "" {
+		bt.Transport = newChallengeTransport(tt.Transport, tt, tt.Username, tt.Password)
+	}
+	return rc
+}
+
+// the connection settings of the shared registry transports
+const (
+	registryMaxIdleConns        = 100
+	registryMaxIdleConnsPerHost = 16
+	registryIdleConnTimeout     = 90 * time.Second
+	registryHandshakeTimeout    = 10 * time.Second
+	registryKeepAlive           = 30 * time.Second
+)
+
+// transportKey identifies the transports that can be shared, by the registry host, the proxy and the
+// TLS settings applied, which are replaced, not modified, when reloaded. The transports of the replaced
+// settings are dropped by dropTransports.
+type transportKey struct {
+	host  string
+	proxy string
+	tls   *tls.Config
+}
+
+var (
+	transportMutex sync.Mutex
+	transports     = make(map[transportKey]*http.Transport)
+)
+
+// sharedTransport returns the transport of the registry host, so the manifest, blob and token requests of
+// all the scans reuse the kept-alive connections instead of a TLS handshake for each request. The transport
+// built for the registry client is kept, with keep-alives and HTTP/2, if there is none yet.
+func sharedTransport(key transportKey, tr *http.Transport) *http.Transport {
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+	if shared, ok := transports[key]; ok {
+		return shared
+	}
+
+	tr.DialContext = (&net.Dialer{Timeout: registryHandshakeTimeout, KeepAlive: registryKeepAlive}).DialContext
+	tr.ForceAttemptHTTP2 = true
+	tr.MaxIdleConns = registryMaxIdleConns
+	tr.MaxIdleConnsPerHost = registryMaxIdleConnsPerHost
+	tr.IdleConnTimeout = registryIdleConnTimeout
+	tr.TLSHandshakeTimeout = registryHandshakeTimeout
+	transports[key] = tr
+	return tr
+}
+
+// dropTransports drops the transports of the TLS settings of the registries configuration replaced by a
+// reload, the scans using them keep them until they end and their idle connections are closed
+func dropTransports(entries []*RegistryEntry) {
+	inUse := make(map[*tls.Config]bool)
+	for _, e := range entries {
+		if e.tls != nil {
+			inUse[e.tls] = true
+		}
+	}
+
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+	for key, tr := range transports {
+		if key.tls != nil && key.tls != registryTLS && !inUse[key.tls] {
+			tr.CloseIdleConnections()
+			delete(transports, key)
+		}
+	}
+}
+
+// basicTransport walks down the transport chain built by the registry package
+func basicTransport(rt http.RoundTripper) *registry.BasicTransport {
+	for {
+		switch t := rt.(type) {
+		case *registry.ErrorTransport:
+			rt = t.Transport
+		case *registry.BasicTransport:
+			return t
+		default:
+			return nil
+		}
+	}
+}
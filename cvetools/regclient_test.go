@@ -0,0 +1,273 @@
+package cvetools
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share/httptrace"
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+func TestRegClientUserAgent(t *testing.T) {
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.Header.Get("User-Agent"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	saved := UserAgent
+	defer func() { UserAgent = saved }()
+	UserAgent = "test-scanner/1.0"
+
+	rc := newRegClient(srv.URL, "", "user", "pass", "")
+	resp, err := rc.Client.Get(srv.URL + "/v2/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if len(agents) != 1 || agents[0] != UserAgent {
+		t.Errorf("Incorrect user agent: %v", agents)
+	}
+}
+
+func TestRegistryPathPrefix(t *testing.T) {
+	tests := map[string]string{
+		"https://registry.example.com":               "https://registry.example.com",
+		"https://registry.example.com/":              "https://registry.example.com",
+		"https://host.example.com/registry":          "https://host.example.com/registry",
+		"https://host.example.com/registry/":         "https://host.example.com/registry",
+		"https://host.example.com/registry/v2/":      "https://host.example.com/registry",
+		"https://host.example.com/gw/team/registry/": "https://host.example.com/gw/team/registry",
+		"https://[fd00::10]:5000/":                   "https://[fd00::10]:5000",
+		"https://[fd00::10]/registry/v2":             "https://[fd00::10]/registry",
+		"https://fd00::10":                           "https://[fd00::10]",
+		"http://fd00::10/registry/":                  "http://[fd00::10]/registry",
+	}
+	for url, expect := range tests {
+		if base := RegistryBaseURL(url); base != expect {
+			t.Errorf("Incorrect base url of %s: %s, expect %s", url, base, expect)
+		}
+	}
+
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"tags": ["1.0"]}`))
+	}))
+	defer srv.Close()
+
+	rc := newRegClient(srv.URL+"/registry/v2/", "", "", "", "")
+	tags, _ := rc.Tags("team/app")
+	if len(tags) != 1 || len(paths) != 1 || paths[0] != "/registry/v2/team/app/tags/list" {
+		t.Errorf("Incorrect request: paths=%v tags=%v", paths, tags)
+	}
+}
+
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "scanner"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestRegistryClientCert(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "regtls")
+	defer os.RemoveAll(dir)
+	defer func() {
+		registryTLS = nil
+		RegistryClientCert, RegistryClientKey, RegistryCACert = "", "", ""
+	}()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"tags": ["1.0"]}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	if err := SetRegistryTLS(certFile, "", ""); err == nil {
+		t.Errorf("Expect an error without the client key")
+	}
+	if err := SetRegistryTLS(certFile, keyFile, caFile); err != nil {
+		t.Fatalf("Failed to set the registry TLS: %v", err)
+	}
+
+	rc := newRegClient(srv.URL, "", "", "", "")
+	tags, err := rc.Tags("app")
+	if err != nil || len(tags) != 1 {
+		t.Errorf("Request failed: tags=%v error=%v", tags, err)
+	}
+}
+
+func TestRegistryIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	var hosts []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"tags": ["1.0"]}`))
+	}))
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	rc := newRegClient(fmt.Sprintf("http://[::1]:%d/", port), "", "", "", "")
+	tags, _ := rc.Tags("team/app")
+	if len(tags) != 1 || len(hosts) != 1 || hosts[0] != fmt.Sprintf("[::1]:%d", port) {
+		t.Errorf("Incorrect request: hosts=%v tags=%v", hosts, tags)
+	}
+}
+
+// newLatencyRegistry is a TLS registry that counts the new connections, with the latency added to each response
+func newLatencyRegistry(latency time.Duration) (*httptest.Server, *int64) {
+	var conns int64
+	var mutex sync.Mutex
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"tags": ["1.0"]}`))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			conns++
+			mutex.Unlock()
+		}
+	}
+	srv.StartTLS()
+	return srv, &conns
+}
+
+func TestRegClientConnectionReuse(t *testing.T) {
+	srv, conns := newLatencyRegistry(0)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		rc := newRegClient(srv.URL, "", "", "", "")
+		for j := 0; j < 3; j++ {
+			if _, err := rc.Tags("team/app"); err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+		}
+	}
+	srv.Close()
+	if *conns != 1 {
+		t.Errorf("Incorrect connections: %d, expect 1", *conns)
+	}
+}
+
+// BenchmarkRegistryConnections compares the registry clients sharing the transport of the host with
+// the transport created for each client, for a scan of a manifest and a few blob requests
+func BenchmarkRegistryConnections(b *testing.B) {
+	clients := map[string]func(url string) *scan.RegClient{
+		"shared": func(url string) *scan.RegClient { return newRegClient(url, "", "", "", "") },
+		"unshared": func(url string) *scan.RegClient {
+			return scan.NewRegClient(url, "", "", "", "", new(httptrace.NopTracer))
+		},
+	}
+	for name, newClient := range clients {
+		b.Run(name, func(b *testing.B) {
+			srv, conns := newLatencyRegistry(2 * time.Millisecond)
+			defer srv.Close()
+			for i := 0; i < b.N; i++ {
+				rc := newClient(srv.URL)
+				for j := 0; j < 4; j++ {
+					rc.Tags("team/app")
+				}
+			}
+			b.StopTimer()
+			srv.Close()
+			b.ReportMetric(float64(*conns)/float64(b.N), "handshakes/op")
+		})
+	}
+}
+
+func TestScanUserAgent(t *testing.T) {
+	var agents []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.Header.Get("User-Agent"))
+		if r.URL.Path == "/token" {
+			w.Write([]byte(`{"token": "t1"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer t1" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="registry"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	saved := UserAgent
+	defer func() { UserAgent = saved }()
+	UserAgent = "neuvector-scanner/1.0"
+
+	// the token request carries the scan ID too
+	rc := newRegClient(srv.URL, "", "", "", "")
+	req, _ := http.NewRequestWithContext(WithScanID(context.Background(), "3f2a9c01b7e4"), http.MethodGet, srv.URL+"/v2/", nil)
+	resp, err := rc.Client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	expect := "neuvector-scanner/1.0 (+3f2a9c01b7e4)"
+	if len(agents) != 3 || agents[0] != expect || agents[1] != expect || agents[2] != expect {
+		t.Errorf("Incorrect user agents: %v", agents)
+	}
+
+	os.Setenv(UserAgentEnv, "corp-scanner/2")
+	defer os.Unsetenv(UserAgentEnv)
+	if agent := DefaultUserAgent(); agent != "corp-scanner/2" {
+		t.Errorf("Incorrect user agent of the environment: %s", agent)
+	}
+	if id := NewScanID(); len(id) != 12 || id == NewScanID() {
+		t.Errorf("Incorrect scan id: %s", id)
+	}
+}
@@ -0,0 +1,257 @@
+package cvetools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RegistryEntry is the settings of the registries matching the host, like registry.corp:5000 or *.internal.corp.
+// A wildcard matches the subdomains at any depth, not the domain itself. Without a port in the host, the
+// entry matches all the ports of the host.
+type RegistryEntry struct {
+	Host               string `json:"host"`
+	CAFile             string `json:"ca_file,omitempty"`
+	InsecureSkipVerify *bool  `json:"insecure_skip_verify,omitempty"` // nil to keep the default
+	ClientCert         string `json:"client_cert,omitempty"`
+	ClientKey          string `json:"client_key,omitempty"`
+	PlainHTTP          bool   `json:"plain_http,omitempty"`
+	Username           string `json:"username,omitempty"`
+	Password           string `json:"password,omitempty"`
+
+	tls *tls.Config
+}
+
+var (
+	registriesMutex   sync.RWMutex
+	registriesConf    string // the file given to LoadRegistriesConf
+	registryEntries   []*RegistryEntry
+	registriesModTime time.Time
+)
+
+// RegistriesConfFile returns the file of the registries configuration in use, passed on to the scanner tasks,
+// empty for none
+func RegistriesConfFile() string {
+	registriesMutex.RLock()
+	defer registriesMutex.RUnlock()
+	return registriesConf
+}
+
+// LoadRegistriesConf reads the per-registry settings, a json list of the entries. The certificate files
+// are loaded here, so an invalid entry fails the whole file and the settings in use are kept. The entries
+// without their own certificates take the ones of SetRegistryTLS, so it is called first.
+func LoadRegistriesConf(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read the registries configuration: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read the registries configuration: %v", err)
+	}
+	entries, err := parseRegistriesConf(data)
+	if err != nil {
+		return fmt.Errorf("Invalid registries configuration %s: %v", path, err)
+	}
+
+	registriesMutex.Lock()
+	registriesConf = path
+	registryEntries = entries
+	registriesModTime = info.ModTime()
+	registriesMutex.Unlock()
+	dropTransports(entries)
+	return nil
+}
+
+func parseRegistriesConf(data []byte) ([]*RegistryEntry, error) {
+	var entries []*RegistryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		e.Host = strings.ToLower(strings.TrimSpace(e.Host))
+		if e.Host == "" {
+			return nil, fmt.Errorf("Entry without the host")
+		}
+		if strings.Contains(e.Host, "*") && !strings.HasPrefix(e.Host, "*.") {
+			return nil, fmt.Errorf("Invalid wildcard host %s, only a leading *. is supported", e.Host)
+		}
+		if err := e.loadTLS(); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Host, err)
+		}
+	}
+	return entries, nil
+}
+
+func (e *RegistryEntry) loadTLS() error {
+	if e.CAFile == "" && e.ClientCert == "" && e.ClientKey == "" && e.InsecureSkipVerify == nil {
+		return nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if e.ClientCert != "" || e.ClientKey != "" {
+		if e.ClientCert == "" || e.ClientKey == "" {
+			return fmt.Errorf("Both the client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(e.ClientCert, e.ClientKey)
+		if err != nil {
+			return fmt.Errorf("Failed to load the client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	} else if registryTLS != nil {
+		cfg.Certificates = registryTLS.Certificates
+	}
+	if e.CAFile != "" {
+		data, err := ioutil.ReadFile(e.CAFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read the CA certificate: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No CA certificate found in %s", e.CAFile)
+		}
+		cfg.RootCAs = pool
+		cfg.InsecureSkipVerify = false
+	} else if registryTLS != nil && registryTLS.RootCAs != nil {
+		// the CA given by -registry_ca_cert
+		cfg.RootCAs = registryTLS.RootCAs
+		cfg.InsecureSkipVerify = false
+	}
+	if e.InsecureSkipVerify != nil {
+		cfg.InsecureSkipVerify = *e.InsecureSkipVerify
+	}
+	e.tls = cfg
+	return nil
+}
+
+// ReloadRegistriesConf loads the configuration again if the file was modified, it returns true if reloaded
+func ReloadRegistriesConf() (bool, error) {
+	registriesMutex.RLock()
+	path, modTime := registriesConf, registriesModTime
+	registriesMutex.RUnlock()
+	if path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read the registries configuration: %v", err)
+	}
+	if info.ModTime().Equal(modTime) {
+		return false, nil
+	}
+	if err := LoadRegistriesConf(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchRegistriesConf checks the registries configuration at the interval and reloads it when modified.
+// The scans already running keep the settings they started with.
+func WatchRegistriesConf(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if reloaded, err := ReloadRegistriesConf(); err != nil {
+				log.WithFields(log.Fields{"file": RegistriesConfFile(), "error": err}).Error("Keep the registries configuration in use")
+			} else if reloaded {
+				log.WithFields(log.Fields{"file": RegistriesConfFile()}).Info("Registries configuration reloaded")
+			}
+		}
+	}()
+}
+
+// matchRegistry returns the entry of the host, with or without the port. The exact host is preferred,
+// then the longest wildcard.
+func matchRegistry(hostport string) *RegistryEntry {
+	registriesMutex.RLock()
+	defer registriesMutex.RUnlock()
+	if len(registryEntries) == 0 {
+		return nil
+	}
+
+	var best *RegistryEntry
+	var bestRank int
+	for _, e := range registryEntries {
+		if rank := HostPatternRank(e.Host, hostport); rank > bestRank {
+			best, bestRank = e, rank
+		}
+	}
+	return best
+}
+
+// HostPatternRank returns how specific the host pattern, like registry.corp:5000 or *.internal.corp, is for
+// the host, 0 if it doesn't match. The exact host ranks above the wildcards, the longer pattern above the
+// shorter one; a pattern without the port matches all the ports of the host.
+func HostPatternRank(pattern, hostport string) int {
+	pattern, hostport = strings.ToLower(pattern), strings.ToLower(hostport)
+	name := hostport
+	if _, _, err := net.SplitHostPort(pattern); err == nil {
+		// the port has to match too
+	} else if h, _, err := net.SplitHostPort(hostport); err == nil {
+		name = h
+	}
+	name = strings.Trim(name, "[]")
+	pattern = strings.Trim(pattern, "[]")
+
+	// a host:port entry is longer, so more specific than the same host without the port
+	if pattern == name {
+		return 1000 + len(pattern)
+	} else if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(name, pattern[1:]) {
+		return len(pattern)
+	}
+	return 0
+}
+
+// urlHost returns the host:port of a registry URL
+func urlHost(url string) string {
+	if i := strings.Index(url, "://"); i != -1 {
+		url = url[i+3:]
+	}
+	if i := strings.Index(url, "/"); i != -1 {
+		url = url[:i]
+	}
+	return url
+}
+
+// applyRegistryEntry returns the URL and the credentials of the registry client with the entry settings.
+// The credentials of the entry are only used when the scan request has none.
+func applyRegistryEntry(e *RegistryEntry, url, token, username, password string) (string, string, string) {
+	if e.PlainHTTP && strings.HasPrefix(url, "https://") {
+		url = "http://" + strings.TrimPrefix(url, "https://")
+	}
+	if token == "" && username == "" && password == "" {
+		username, password = e.Username, e.Password
+	}
+	return url, username, password
+}
+
+// CheckRegistry pings the registry with the settings resolved for the host, and returns the entry used
+func CheckRegistry(host, username, password string) (*RegistryEntry, error) {
+	url := host
+	if !strings.Contains(url, "://") {
+		url = "https://" + url
+	}
+	rc := newRegClient(url, "", username, password, "")
+	if rc.Registry == nil {
+		return nil, fmt.Errorf("Invalid registry %s", host)
+	}
+	e := matchRegistry(urlHost(RegistryBaseURL(url)))
+	if _, err := rc.Alive(); err != nil {
+		return e, err
+	}
+	return e, nil
+}
@@ -0,0 +1,104 @@
+package cvetools
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistriesConf(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "registries")
+	defer os.RemoveAll(dir)
+	defer func() {
+		registryEntries, registriesConf = nil, ""
+	}()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644)
+	conf := filepath.Join(dir, "registries.json")
+	ioutil.WriteFile(conf, []byte(fmt.Sprintf(`[
+		{"host": "*.internal.corp", "plain_http": true},
+		{"host": "registry.internal.corp:5000", "username": "u", "password": "p"},
+		{"host": "127.0.0.1", "ca_file": %q, "username": "user", "password": "pass"}
+	]`, caFile)), 0644)
+	if err := LoadRegistriesConf(conf); err != nil || RegistriesConfFile() != conf {
+		t.Fatalf("Failed to load: %v", err)
+	}
+
+	matches := map[string]string{
+		"a.internal.corp":             "*.internal.corp",
+		"a.b.internal.corp:443":       "*.internal.corp",
+		"registry.internal.corp:5000": "registry.internal.corp:5000",
+		"registry.internal.corp":      "*.internal.corp",
+		"internal.corp":               "",
+		"127.0.0.1:8443":              "127.0.0.1",
+	}
+	for host, expect := range matches {
+		e := matchRegistry(host)
+		if (e == nil && expect != "") || (e != nil && e.Host != expect) {
+			t.Errorf("Incorrect entry of %s: %+v, expect %s", host, e, expect)
+		}
+	}
+
+	url, user, pass := applyRegistryEntry(matchRegistry("a.internal.corp"), "https://a.internal.corp", "", "", "")
+	if url != "http://a.internal.corp" || user != "" || pass != "" {
+		t.Errorf("Incorrect plain http: %s %s %s", url, user, pass)
+	}
+	_, user, _ = applyRegistryEntry(matchRegistry("registry.internal.corp:5000"), "https://registry.internal.corp:5000", "", "me", "secret")
+	if user != "me" {
+		t.Errorf("The request credentials should be kept: %s", user)
+	}
+
+	// verified by the CA of the entry, with its credentials
+	host := strings.TrimPrefix(srv.URL, "https://")
+	if e, err := CheckRegistry(host, "", ""); err != nil || e == nil || e.Host != "127.0.0.1" {
+		t.Errorf("Registry check failed: entry=%+v error=%v", e, err)
+	}
+
+	// reloaded without the CA, the registry certificate is not trusted
+	ioutil.WriteFile(conf, []byte(`[{"host": "127.0.0.1", "insecure_skip_verify": false, "username": "user", "password": "pass"}]`), 0644)
+	os.Chtimes(conf, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if reloaded, err := ReloadRegistriesConf(); !reloaded || err != nil {
+		t.Fatalf("Not reloaded: %v", err)
+	}
+	if _, err := CheckRegistry(host, "", ""); err == nil {
+		t.Errorf("The untrusted registry should fail the check")
+	}
+	transportMutex.Lock()
+	for key := range transports {
+		if key.tls != nil && key.tls != matchRegistry(host).tls {
+			t.Errorf("The transport of the replaced entry is kept: %+v", key)
+		}
+	}
+	transportMutex.Unlock()
+	if reloaded, _ := ReloadRegistriesConf(); reloaded {
+		t.Errorf("Reloaded without change")
+	}
+
+	// an invalid file keeps the entries in use
+	ioutil.WriteFile(conf, []byte(`[{"host": "a*b.corp"}]`), 0644)
+	os.Chtimes(conf, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	if _, err := ReloadRegistriesConf(); err == nil {
+		t.Errorf("Invalid wildcard should fail")
+	}
+	if e := matchRegistry("127.0.0.1:443"); e == nil {
+		t.Errorf("Entries in use are dropped")
+	}
+}
@@ -0,0 +1,216 @@
+package cvetools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+// SeverityMap remaps the severity of the vulnerabilities by their CVE names, to follow the internal
+// risk rating instead of the one of the database
+type SeverityMap map[string]string
+
+// SeverityOverride records a vulnerability of the result whose severity was remapped
+type SeverityOverride struct {
+	Name     string `json:"Name"`
+	Package  string `json:"Package"`
+	Original string `json:"Original"`
+	Severity string `json:"Severity"`
+}
+
+var severityNames = map[string]string{
+	"critical": share.VulnSeverityCritical,
+	"high":     share.VulnSeverityHigh,
+	"medium":   share.VulnSeverityMedium,
+	"low":      share.VulnSeverityLow,
+}
+
+// LoadSeverityMap reads the -severity_map file, a json object or a flat yaml mapping of one
+// "CVE-2021-44228: critical" per line. The database has no CWE classes, so they can't be mapped.
+func LoadSeverityMap(path string) (SeverityMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the severity map: %v", err)
+	}
+	m, err := parseSeverityMap(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid severity map %s: %v", path, err)
+	}
+	return m, nil
+}
+
+func parseSeverityMap(data []byte) (SeverityMap, error) {
+	raw := make(map[string]string)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; scanner.Scan(); n++ {
+			line := scanner.Text()
+			if i := strings.Index(line, "#"); i != -1 {
+				line = line[:i]
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			i := strings.Index(line, ":")
+			if i == -1 {
+				return nil, fmt.Errorf("line %d: not a key: value mapping", n)
+			}
+			key := strings.Trim(strings.TrimSpace(line[:i]), `"'`)
+			value := strings.Trim(strings.TrimSpace(line[i+1:]), `"'`)
+			if _, ok := raw[key]; ok {
+				return nil, fmt.Errorf("line %d: duplicated %s", n, key)
+			}
+			raw[key] = value
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	m := make(SeverityMap, len(raw))
+	for key, value := range raw {
+		name := strings.ToUpper(strings.TrimSpace(key))
+		if strings.HasPrefix(name, "CWE-") {
+			return nil, fmt.Errorf("%s: the vulnerability database has no CWE classes, only the CVE names can be mapped", key)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty vulnerability name")
+		}
+		severity, ok := severityNames[strings.ToLower(strings.TrimSpace(value))]
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid severity %q, one of critical, high, medium and low", key, value)
+		}
+		m[name] = severity
+	}
+	return m, nil
+}
+
+// SetSeverityMap sets the map applied by PostProcess, nil to disable
+func (cv *CveTools) SetSeverityMap(m SeverityMap) {
+	cv.postMutex.Lock()
+	defer cv.postMutex.Unlock()
+	cv.severityMap = m
+}
+
+// severity returns the mapped severity of the vulnerability, by its name or one of its CVEs
+func (m SeverityMap) severity(v *share.ScanVulnerability) (string, bool) {
+	if s, ok := m[strings.ToUpper(v.Name)]; ok {
+		return s, true
+	}
+	for _, cve := range v.CVEs {
+		if s, ok := m[strings.ToUpper(cve)]; ok {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// severityKey identifies a finding by its vulnerability and package, the post-processors change copies of them
+func severityKey(v *share.ScanVulnerability) string {
+	return v.Name + "\x00" + v.PackageName + "\x00" + v.PackageVersion
+}
+
+// databaseSeverities returns the severities of the findings before they are post-processed
+func databaseSeverities(vuls []*share.ScanVulnerability) map[string]string {
+	severities := make(map[string]string, len(vuls))
+	for _, v := range vuls {
+		severities[severityKey(v)] = v.Severity
+	}
+	return severities
+}
+
+// apply remaps the vulnerabilities of the result and of the layers, the overrides of the result are recorded
+// with the severities of the database, the severity of a finding a post-processor added is its own
+func (m SeverityMap) apply(report *ScanReport, original map[string]string) {
+	report.SeverityOverrides = nil
+	for _, v := range report.Vuls {
+		s, ok := m.severity(v)
+		if !ok {
+			continue
+		}
+		from, found := original[severityKey(v)]
+		if !found {
+			from = v.Severity
+		}
+		if s != from {
+			report.SeverityOverrides = append(report.SeverityOverrides, &SeverityOverride{
+				Name: v.Name, Package: v.PackageName, Original: from, Severity: s,
+			})
+		}
+		v.Severity = s
+	}
+	for _, l := range report.Layers {
+		for _, v := range l.Vuls {
+			if s, ok := m.severity(v); ok {
+				v.Severity = s
+			}
+		}
+	}
+	if len(report.SeverityOverrides) > 0 {
+		log.WithFields(log.Fields{
+			"repo": report.Repository, "tag": report.Tag, "overrides": len(report.SeverityOverrides),
+		}).Info("Severity remapped")
+	}
+}
+
+// the sources of the severity of the findings: the rating of the database, the NVD rating of the CVSS scores,
+// or the higher of the two
+const (
+	SeveritySourceVendor = "vendor"
+	SeveritySourceNVD    = "nvd"
+	SeveritySourceMax    = "max"
+)
+
+// NVDSeverity returns the NVD rating of the CVSS v3 score, or of the v2 score without one, and the score it
+// was rated by. It is empty if the vulnerability has no score.
+func NVDSeverity(score, scoreV3 float32) (string, float32) {
+	switch {
+	case scoreV3 >= 9:
+		return share.VulnSeverityCritical, scoreV3
+	case scoreV3 >= 7:
+		return share.VulnSeverityHigh, scoreV3
+	case scoreV3 >= 4:
+		return share.VulnSeverityMedium, scoreV3
+	case scoreV3 > 0:
+		return share.VulnSeverityLow, scoreV3
+	case score >= 7:
+		return share.VulnSeverityHigh, score
+	case score >= 4:
+		return share.VulnSeverityMedium, score
+	case score > 0:
+		return share.VulnSeverityLow, score
+	}
+	return "", 0
+}
+
+// SelectSeverity returns the severity of the finding of the source, and if the vendor and the NVD ratings
+// disagree. A finding rated by one source only keeps that rating whatever the source.
+func SelectSeverity(source, vendor string, score, scoreV3 float32) (string, bool) {
+	nvd, _ := NVDSeverity(score, scoreV3)
+	if nvd == "" || vendor == "" {
+		if vendor == "" {
+			return nvd, false
+		}
+		return vendor, false
+	}
+	switch source {
+	case SeveritySourceNVD:
+		return nvd, nvd != vendor
+	case SeveritySourceMax:
+		if SeverityRank(nvd) > SeverityRank(vendor) {
+			return nvd, true
+		}
+	}
+	return vendor, nvd != vendor
+}
@@ -0,0 +1,98 @@
+package cvetools
+
+import (
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+func TestSeverityMap(t *testing.T) {
+	yaml := `# risk committee ratings
+CVE-2021-44228: critical
+"cve-2022-0001": 'Low'
+`
+	m, err := parseSeverityMap([]byte(yaml))
+	if err != nil {
+		t.Fatalf("Failed to parse the yaml map: %v", err)
+	}
+	if m["CVE-2021-44228"] != share.VulnSeverityCritical || m["CVE-2022-0001"] != share.VulnSeverityLow {
+		t.Errorf("Incorrect map: %+v", m)
+	}
+	if j, err := parseSeverityMap([]byte(`{"CVE-2021-44228": "critical"}`)); err != nil || j["CVE-2021-44228"] != share.VulnSeverityCritical {
+		t.Errorf("Incorrect json map: %+v, %v", j, err)
+	}
+	for _, bad := range []string{"CVE-2021-44228: severe\n", "CWE-79: high\n", "CVE-2021-44228\n", "CVE-1: low\nCVE-1: high\n"} {
+		if _, err := parseSeverityMap([]byte(bad)); err == nil {
+			t.Errorf("Invalid map accepted: %q", bad)
+		}
+	}
+
+	cv := &CveTools{}
+	cv.SetSeverityMap(m)
+	cv.RegisterPostProcessor(&testPostProcessor{name: "lower", process: func(image *ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error) {
+		for _, v := range vuls {
+			v.Severity = share.VulnSeverityMedium
+		}
+		return vuls, nil
+	}})
+	layerVul := &share.ScanVulnerability{Name: "CVE-2021-44228", Severity: share.VulnSeverityHigh}
+	report := &ScanReport{ScanResult: &share.ScanResult{
+		Vuls: []*share.ScanVulnerability{
+			&share.ScanVulnerability{Name: "GHSA-jfh8-c2jp-5v3q", CVEs: []string{"CVE-2021-44228"}, PackageName: "log4j", Severity: share.VulnSeverityHigh},
+			&share.ScanVulnerability{Name: "CVE-2021-0003", Severity: share.VulnSeverityHigh},
+		},
+		Layers: []*share.ScanLayerResult{&share.ScanLayerResult{Vuls: []*share.ScanVulnerability{layerVul}}},
+	}}
+	cv.PostProcess(report)
+	if report.Vuls[0].Severity != share.VulnSeverityCritical || report.Vuls[1].Severity != share.VulnSeverityMedium {
+		t.Errorf("Incorrect severities: %+v", report.Vuls)
+	}
+	if layerVul.Severity != share.VulnSeverityCritical {
+		t.Errorf("Incorrect layer severity: %+v", layerVul)
+	}
+	if len(report.SeverityOverrides) != 1 {
+		t.Fatalf("Incorrect overrides: %+v", report.SeverityOverrides)
+	}
+	// the severity of the database, not the one of the post-processor
+	if o := report.SeverityOverrides[0]; o.Name != "GHSA-jfh8-c2jp-5v3q" || o.Package != "log4j" || o.Original != share.VulnSeverityHigh {
+		t.Errorf("Incorrect override: %+v", o)
+	}
+}
+
+func TestSelectSeverity(t *testing.T) {
+	for _, c := range []struct {
+		score, scoreV3 float32
+		nvd            string
+		nvdScore       float32
+	}{
+		{0, 9.8, share.VulnSeverityCritical, 9.8},
+		{5, 7.5, share.VulnSeverityHigh, 7.5},
+		{7.5, 0, share.VulnSeverityHigh, 7.5},
+		{4.3, 0, share.VulnSeverityMedium, 4.3},
+		{0, 3.1, share.VulnSeverityLow, 3.1},
+		{0, 0, "", 0},
+	} {
+		if nvd, score := NVDSeverity(c.score, c.scoreV3); nvd != c.nvd || score != c.nvdScore {
+			t.Errorf("Incorrect NVD severity of %v/%v: %s %v", c.score, c.scoreV3, nvd, score)
+		}
+	}
+
+	for _, c := range []struct {
+		source, vendor string
+		scoreV3        float32
+		severity       string
+		disagree       bool
+	}{
+		{SeveritySourceVendor, share.VulnSeverityMedium, 9.8, share.VulnSeverityMedium, true},
+		{SeveritySourceNVD, share.VulnSeverityMedium, 9.8, share.VulnSeverityCritical, true},
+		{SeveritySourceMax, share.VulnSeverityMedium, 9.8, share.VulnSeverityCritical, true},
+		{SeveritySourceMax, share.VulnSeverityHigh, 3.1, share.VulnSeverityHigh, true},
+		{SeveritySourceNVD, share.VulnSeverityHigh, 7.5, share.VulnSeverityHigh, false},
+		// a single rating is kept whatever the source
+		{SeveritySourceNVD, share.VulnSeverityLow, 0, share.VulnSeverityLow, false},
+	} {
+		if severity, disagree := SelectSeverity(c.source, c.vendor, 0, c.scoreV3); severity != c.severity || disagree != c.disagree {
+			t.Errorf("Incorrect %s severity of %s/%v: %s %v", c.source, c.vendor, c.scoreV3, severity, disagree)
+		}
+	}
+}
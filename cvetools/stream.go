@@ -0,0 +1,296 @@
+package cvetools
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	goDigest "github.com/opencontainers/go-digest"
+
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+// FullExtraction writes all the files of the layers to the working folder, as the layers were extracted before
+// they were streamed, to debug a scan missing a file. It takes the disk space of the whole image.
+var FullExtraction = false
+
+// the files of the secret scan, it only reads the files up to its default maximum size
+const secretFileSize = 4 * 1024
+
+// the package databases, the OS release files and the build information read by the package detectors
+var (
+	packageDirs  = []string{"var/lib/dpkg/", "var/lib/rpm/", "usr/lib/sysimage/rpm/", "lib/apk/db/", "root/buildinfo/"}
+	packageFiles = []string{"etc/lsb-release", "etc/os-release", "usr/lib/os-release", "etc/apt/sources.list"}
+)
+
+// the application packages, as the vendored scanner selects them
+var (
+	pythonPackage = regexp.MustCompile(`/([a-zA-Z0-9_\.]+)-([a-zA-Z0-9\.]+)[\-a-zA-Z0-9\.]*\.(egg-info\/PKG-INFO|dist-info\/WHEEL)$`)
+	rubyPackage   = regexp.MustCompile(`/([a-zA-Z0-9_\-]+)-([0-9\.]+)\.gemspec$`)
+)
+
+// goBuildInfo marks the module information of a go binary, it is looked for in the ELF executables
+var goBuildInfo = []byte("\xff Go buildinf:")
+
+type layerStreamsKey struct{}
+
+// layerStreams records the size of all the files of the layers streamed for a scan, most of them are not written
+type layerStreams struct {
+	mutex   sync.Mutex
+	sizes   map[string]int64
+	exclude []string // the patterns of the files written empty, as they are not scanned
+}
+
+// withLayerStreams returns the context to stream the layers of its registry requests, the layers are extracted
+// in full with FullExtraction
+func withLayerStreams(ctx context.Context) (context.Context, *layerStreams) {
+	if FullExtraction {
+		return ctx, nil
+	}
+	ls := &layerStreams{sizes: make(map[string]int64), exclude: excludePathsFromContext(ctx)}
+	return context.WithValue(ctx, layerStreamsKey{}, ls), ls
+}
+
+func (ls *layerStreams) add(digest string, size int64) {
+	ls.mutex.Lock()
+	ls.sizes[digest] = size
+	ls.mutex.Unlock()
+}
+
+// setSizes sets the extracted size of the streamed layers, the vendored client only counts the files written
+func (ls *layerStreams) setSizes(layerFiles map[string]*scan.LayerFiles) {
+	if ls == nil {
+		return
+	}
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	for layer, lf := range layerFiles {
+		if size, ok := ls.sizes[layer]; ok && lf != nil {
+			lf.Size = size
+		}
+	}
+}
+
+// keepLayerFile returns true if the scan reads the file, the other files are written empty, so the file map
+// has them, with their modes for the setuid and setgid checks
+func keepLayerFile(name string, size int64) bool {
+	if size <= secretFileSize {
+		return true
+	}
+	for _, dir := range packageDirs {
+		if strings.HasPrefix(name, dir) {
+			return true
+		}
+	}
+	for _, file := range packageFiles {
+		if name == file {
+			return true
+		}
+	}
+	if strings.HasPrefix(name, "etc/") && strings.HasSuffix(name, "-release") {
+		return true
+	}
+	if strings.Contains(name, "node_modules") && strings.HasSuffix(name, "package.json") ||
+		strings.HasSuffix(name, ".jar") || strings.HasSuffix(name, ".war") || strings.HasSuffix(name, ".ear") ||
+		strings.HasSuffix(name, ".deps.json") || strings.HasSuffix(name, scan.WPVerFileSuffix) ||
+		pythonPackage.MatchString("/"+name) || rubyPackage.MatchString("/"+name) {
+		return true
+	}
+	base := filepath.Base(name)
+	for _, d := range binaryDetectors {
+		if d.match(base) {
+			return size <= maxBinarySize
+		}
+	}
+	return false
+}
+
+// streamedBody extracts the layer as it is downloaded: the blob is decompressed and only the files the scan
+// reads are given to the vendored client, in a tar of the same entries. The digest is computed on the way, the
+// end of the tar is only written once the blob matches it, so a tampered layer is never extracted in full.
+// A blob that is not a gzipped or a plain tar is verified as a whole by verifiedBody. The layer is timed from
+// start, when it was requested.
+func streamedBody(req *http.Request, body io.ReadCloser, dg goDigest.Digest, start time.Time, pt *progressTracker, ls *layerStreams) (io.ReadCloser, error) {
+	stats := scanStatsFromContext(req.Context())
+	raw := bufio.NewReader(body)
+	head, _ := raw.Peek(512)
+	gzipped := bytes.HasPrefix(head, []byte{0x1f, 0x8b})
+	if !gzipped && !(len(head) == 512 && bytes.Equal(head[257:262], []byte("ustar"))) {
+		f, n, err := verifiedBody(struct {
+			io.Reader
+			io.Closer
+		}{raw, body}, dg, pt)
+		if err == nil {
+			stats.addLayer(string(dg), start, n)
+		}
+		return f, err
+	}
+
+	digester := dg.Algorithm().Digester()
+	var read byteCounter
+	blob := io.TeeReader(raw, io.MultiWriter(digester.Hash(), &read))
+	if pt != nil {
+		pt.start(string(dg))
+		blob = io.TeeReader(blob, &progressWriter{pt: pt, digest: string(dg)})
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	ctx := req.Context()
+	go func() {
+		// the vendored client doesn't close the body, the stream is ended with the scan
+		select {
+		case <-ctx.Done():
+			pr.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(done)
+		defer body.Close()
+
+		// the blob is hashed, inflated and extracted in a pipeline when the helpers are free
+		hashed := pipelined(blob)
+		defer hashed.Close()
+		files := hashed
+		if gzipped {
+			gz, err := gzip.NewReader(hashed)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			files = pipelined(gz)
+			defer files.Close()
+		}
+		tw := tar.NewWriter(pw)
+		size, err := filterLayer(tw, tar.NewReader(files), ls.exclude)
+		if err == nil {
+			// the rest of the blob after the end of the tar, for the digest
+			if _, err = io.Copy(ioutil.Discard, files); err == nil {
+				_, err = io.Copy(ioutil.Discard, hashed)
+			}
+		}
+		if err == nil {
+			if actual := digester.Digest(); actual != dg {
+				de := &DigestError{Expected: dg, Actual: actual}
+				reportDigestError(req, de)
+				err = de
+			}
+		}
+		if err == nil {
+			ls.add(string(dg), size)
+			pt.add(string(dg), 0, true)
+			stats.addLayer(string(dg), start, int64(read))
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// filterLayer copies the folders and the files of the layer the scan reads, the other files and the excluded
+// ones are copied empty. It returns the size of all the files, as the vendored client counts them.
+func filterLayer(tw *tar.Writer, tr *tar.Reader, exclude []string) (int64, error) {
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return size, err
+		}
+		size += hdr.Size
+
+		name := strings.TrimPrefix(strings.TrimPrefix(hdr.Name, "./"), "/")
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+			err = tw.WriteHeader(hdr)
+		case hdr.Typeflag != tar.TypeReg:
+			// the links and the devices are not extracted
+		case len(exclude) > 0 && isExcludedPath(exclude, name):
+			err = writeEmptyFile(tw, hdr)
+		case keepLayerFile(name, hdr.Size):
+			if err = tw.WriteHeader(hdr); err == nil {
+				_, err = io.Copy(tw, tr)
+			}
+		case hdr.Mode&0111 != 0:
+			err = copyGoBinary(tw, tr, hdr)
+		default:
+			err = writeEmptyFile(tw, hdr)
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
+// copyGoBinary copies an executable if it is a go binary, for the modules it is built with, the other
+// executables are written empty. An ELF file is spooled to a work file while looking for the build info.
+func copyGoBinary(tw *tar.Writer, tr *tar.Reader, hdr *tar.Header) error {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(tr, head); err != nil || !bytes.Equal(head, []byte("\x7fELF")) {
+		return writeEmptyFile(tw, hdr)
+	}
+
+	f, err := workFile(".elf-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	finder := &magicFinder{magic: goBuildInfo}
+	if _, err = io.Copy(io.MultiWriter(f, finder), io.MultiReader(bytes.NewReader(head), tr)); err != nil {
+		return err
+	}
+	if !finder.found {
+		return writeEmptyFile(tw, hdr)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func writeEmptyFile(tw *tar.Writer, hdr *tar.Header) error {
+	empty := *hdr
+	empty.Size = 0
+	empty.PAXRecords = nil
+	return tw.WriteHeader(&empty)
+}
+
+// magicFinder looks for the magic bytes in the data written to it, across the writes
+type magicFinder struct {
+	magic []byte
+	tail  []byte
+	found bool
+}
+
+func (m *magicFinder) Write(p []byte) (int, error) {
+	if m.found {
+		return len(p), nil
+	}
+	data := append(m.tail, p...)
+	if bytes.Contains(data, m.magic) {
+		m.found = true
+		return len(p), nil
+	}
+	if keep := len(m.magic) - 1; len(data) > keep {
+		data = data[len(data)-keep:]
+	}
+	m.tail = append([]byte(nil), data...)
+	return len(p), nil
+}
@@ -0,0 +1,263 @@
+package cvetools
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	goDigest "github.com/opencontainers/go-digest"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+)
+
+func TestStreamedLayers(t *testing.T) {
+	dpkg := "Package: zlib1g\nStatus: install ok installed\nVersion: 1:1.2.11.dfsg-2\nArchitecture: amd64\n\n"
+	blob, dg := makeLayerBlob(t, map[string]string{
+		"var/lib/dpkg/status": dpkg,
+		"etc/app.conf":        "password = secret\n",
+		"opt/data.bin":        strings.Repeat("x", 1024*1024),
+	})
+	tampered := goDigest.FromString("original content").String()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/blobs/" + dg, "/v2/app/blobs/" + tampered:
+			w.Write(blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	rc := newRegClient(srv.URL, "", "", "", "")
+
+	dirSize := func(dir string) (size int64, files []string) {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+				files = append(files, path[len(dir):])
+			}
+			return nil
+		})
+		sort.Strings(files)
+		return size, files
+	}
+	extract := func(full bool) (*scan.LayerFiles, int64, []string) {
+		FullExtraction = full
+		defer func() { FullExtraction = false }()
+		dir := t.TempDir()
+		stats := &ScanStats{}
+		layerFiles, errCode := downloadImageLayers(withScanStats(context.Background(), stats), rc, "app", dir, []string{dg}, map[string]int64{dg: int64(len(blob))})
+		if errCode != share.ScanErrorCode_ScanErrNone || layerFiles[dg] == nil {
+			t.Fatalf("Failed to download: %v", errCode)
+		}
+		if len(stats.Layers) != 1 || stats.Layers[0].Digest != dg || stats.Layers[0].Bytes != int64(len(blob)) {
+			t.Errorf("Incorrect layer timings of the full extraction %v: %+v", full, stats.Layers)
+		}
+		size, files := dirSize(dir)
+		return layerFiles[dg], size, files
+	}
+
+	fullFiles, fullDisk, fullPaths := extract(true)
+	// in a pipeline, whatever the CPUs of the test
+	InflateWorkers = 3
+	lf, disk, paths := extract(false)
+	InflateWorkers = 0
+	t.Logf("Disk used by the layer: %d bytes extracted in full, %d bytes streamed", fullDisk, disk)
+	if disk*10 > fullDisk {
+		t.Errorf("The streamed layer takes %d bytes of the %d of the full extraction", disk, fullDisk)
+	}
+	if !reflect.DeepEqual(paths, fullPaths) {
+		t.Errorf("Incorrect files: %v, expect %v", paths, fullPaths)
+	}
+	if lf.Size != fullFiles.Size || len(lf.Pkgs["var/lib/dpkg/status"]) == 0 || !reflect.DeepEqual(lf.Pkgs, fullFiles.Pkgs) {
+		t.Errorf("Incorrect layer: size %d, expect %d, %v", lf.Size, fullFiles.Size, lf.Pkgs)
+	}
+
+	// the end of the tar is held until the digest is verified
+	ctx, digestErrs := withDigestErrors(context.Background())
+	if _, errCode := downloadImageLayers(ctx, rc, "app", t.TempDir(), []string{tampered}, nil); errCode == share.ScanErrorCode_ScanErrNone {
+		t.Errorf("Tampered layer accepted")
+	}
+	if de := digestErrs.first(); de == nil || de.Expected.String() != tampered {
+		t.Errorf("Incorrect digest error: %+v", de)
+	}
+
+	finder := &magicFinder{magic: goBuildInfo}
+	finder.Write([]byte("\x7fELF...\xff Go bu"))
+	finder.Write([]byte("ildinf:..."))
+	if !finder.found {
+		t.Errorf("Go build info not found across the writes")
+	}
+}
+
+func BenchmarkStreamLayer(b *testing.B) {
+	// a layer of 256MB of text, about 45MB compressed
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	tw := tar.NewWriter(gz)
+	rnd := mathrand.New(mathrand.NewSource(1))
+	words := []string{"layer ", "package ", "version ", "1.2.3 ", "usr/lib ", "\n", "openssl ", "zlib "}
+	for f := 0; f < 32; f++ {
+		var content bytes.Buffer
+		for content.Len() < 8*1024*1024 {
+			content.WriteString(words[rnd.Intn(len(words))])
+		}
+		tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("opt/data/%d.txt", f), Mode: 0644, Size: int64(content.Len()), Typeflag: tar.TypeReg})
+		tw.Write(content.Bytes())
+	}
+	tw.Close()
+	gz.Close()
+	blob := buf.Bytes()
+	dg := goDigest.FromBytes(blob)
+	ls := &layerStreams{sizes: make(map[string]int64)}
+
+	// a layer takes up to 3 goroutines
+	for _, workers := range []int{1, 3} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			InflateWorkers = workers
+			defer func() { InflateWorkers = 0 }()
+			b.SetBytes(int64(len(blob)))
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/v2/app/blobs/"+dg.String(), nil)
+				body, err := streamedBody(req, ioutil.NopCloser(bytes.NewReader(blob)), dg, time.Now(), nil, ls)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = io.Copy(ioutil.Discard, body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// zeroReader reads zeros without end, the content of the large synthetic files
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestLargeLayerMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("extracts a layer of 700MB")
+	}
+	defer func(path string) { ImageWorkingPath = path }(ImageWorkingPath)
+	ImageWorkingPath = filepath.Join(t.TempDir(), "images")
+
+	// the layer is written to a file as it is made, the test holds none of its files in memory
+	const mb = 1024 * 1024
+	files := []struct {
+		name string
+		mode int64
+		size int64
+		tail string
+	}{
+		{"var/lib/dpkg/status", 0644, 0, "Package: zlib1g\nStatus: install ok installed\nVersion: 1:1.2.11.dfsg-2\n\n"},
+		{"opt/model/weights.bin", 0644, 480 * mb, ""},                           // not read by the scan
+		{"usr/local/bin/tool", 0755, 128 * mb, "\x7fELF" + string(goBuildInfo)}, // spooled to a work file
+		{"usr/local/lib/libssl.so.1.1", 0644, 96 * mb, "OpenSSL 1.1.1k  25 Mar 2021\x00"},
+	}
+	blobFile, err := os.Create(filepath.Join(t.TempDir(), "layer.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digester := goDigest.SHA256.Digester()
+	gz, _ := gzip.NewWriterLevel(io.MultiWriter(blobFile, digester.Hash()), gzip.BestSpeed)
+	tw := tar.NewWriter(gz)
+	var total int64
+	for _, f := range files {
+		size := f.size + int64(len(f.tail))
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: f.mode, Size: size, Typeflag: tar.TypeReg})
+		if strings.HasPrefix(f.tail, "\x7fELF") {
+			// the ELF magic first, the go build info at the end
+			io.WriteString(tw, f.tail[:4])
+			io.CopyN(tw, zeroReader{}, f.size)
+			io.WriteString(tw, f.tail[4:])
+		} else {
+			io.CopyN(tw, zeroReader{}, f.size)
+			io.WriteString(tw, f.tail)
+		}
+		total += size
+	}
+	tw.Close()
+	gz.Close()
+	blobFile.Close()
+	dg := digester.Digest().String()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/app/blobs/"+dg {
+			http.ServeFile(w, r, blobFile.Name())
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	rc := newRegClient(srv.URL, "", "", "", "")
+
+	// the peak of the heap above the one before the scan
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base, peak := ms.HeapInuse, ms.HeapInuse
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > peak {
+				peak = ms.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	imgPath := t.TempDir()
+	layerFiles, errCode := downloadImageLayers(context.Background(), rc, "app", imgPath, []string{dg}, nil)
+	var bins []*detectedBinary
+	if errCode == share.ScanErrorCode_ScanErrNone {
+		fileMap, _, _ := imageFileMap(imgPath, []string{dg})
+		bins = detectBinaries(fileMap)
+	}
+	close(done)
+	<-sampled
+
+	if errCode != share.ScanErrorCode_ScanErrNone || len(layerFiles[dg].Pkgs["var/lib/dpkg/status"]) == 0 {
+		t.Fatalf("Failed to extract the layer: %v", errCode)
+	}
+	if len(bins) != 1 || bins[0].version != "1.1.1k" {
+		t.Errorf("Incorrect binaries: %+v", bins)
+	}
+	if info, err := os.Stat(filepath.Join(imgPath, dg, "usr/local/bin/tool")); err != nil || info.Size() != files[2].size+int64(len(files[2].tail)) {
+		t.Errorf("Incorrect go binary: %v", err)
+	}
+	const budget = 64 * mb
+	t.Logf("Heap of the scan of the %d MB layer: %d MB", total/mb, (peak-base)/mb)
+	if peak-base > budget {
+		t.Errorf("The scan of the %d MB layer takes %d MB of heap, over the budget of %d MB", total/mb, (peak-base)/mb, budget/mb)
+	}
+}
@@ -0,0 +1,239 @@
+package cvetools
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TagPolicy selects the tags of a registry sweep. Each policy set selects a part of the tags of a repository
+// matching the filter, and the tags swept are the intersection of the parts.
+type TagPolicy struct {
+	Filter        string        // path.Match glob of the tags, like v*, empty for all
+	Semver        *SemverRange  // the tags parsed as semver in the range, the other tags are excluded
+	LatestPerRepo int           // the tags of the N latest images of the repository, by the created time of the config, 0 for all
+	MaxAge        time.Duration // the tags of the images created within, the images of an unknown age are kept, 0 for all
+}
+
+// needsCreated tells if the created time of the images is read, it takes a config download per image
+func (p *TagPolicy) needsCreated() bool {
+	return p != nil && (p.LatestPerRepo > 0 || p.MaxAge > 0)
+}
+
+func (p *TagPolicy) matchFilter(tag string) bool {
+	if p == nil || p.Filter == "" {
+		return true
+	}
+	ok, _ := path.Match(p.Filter, tag)
+	return ok
+}
+
+func (p *TagPolicy) matchSemver(tag string) bool {
+	return p == nil || p.Semver == nil || p.Semver.Matches(tag)
+}
+
+// registryTag is a tag of a repository with the digest and the created time of its image, zero if unknown
+type registryTag struct {
+	tag     string
+	digest  string
+	created time.Time
+}
+
+// selectTags returns the tags selected by all the policies, in the order of the list
+func (p *TagPolicy) selectTags(tags []*registryTag, now time.Time) []*registryTag {
+	var latest map[string]bool
+	if p != nil && p.LatestPerRepo > 0 {
+		// the latest images, all the tags of an image are kept; the images of an unknown age are the oldest
+		images := make([]*registryTag, 0)
+		seen := make(map[string]bool)
+		for _, t := range tags {
+			if !seen[t.digest] {
+				seen[t.digest] = true
+				images = append(images, t)
+			}
+		}
+		sort.SliceStable(images, func(i, j int) bool { return images[i].created.After(images[j].created) })
+		latest = make(map[string]bool)
+		for i := 0; i < len(images) && i < p.LatestPerRepo; i++ {
+			latest[images[i].digest] = true
+		}
+	}
+
+	selected := make([]*registryTag, 0, len(tags))
+	for _, t := range tags {
+		if latest != nil && !latest[t.digest] {
+			continue
+		}
+		if !p.matchSemver(t.tag) {
+			continue
+		}
+		if p != nil && p.MaxAge > 0 && !t.created.IsZero() && now.Sub(t.created) > p.MaxAge {
+			continue
+		}
+		selected = append(selected, t)
+	}
+	return selected
+}
+
+// semver is a version of major.minor[.patch][-prerelease][+build], the build is ignored
+type semver struct {
+	nums [3]uint64
+	pre  []string
+}
+
+var (
+	semverTag     = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+	semverPartial = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?$`)
+	semverClause  = regexp.MustCompile(`(>=|<=|!=|>|<|=)?\s*(v?[0-9][0-9A-Za-z.+-]*)`)
+)
+
+// parseSemver parses a tag as semver, like 1.2.3, v1.2 or 1.2.3-rc.1; a tag of the major version only,
+// like 2 or 20230101, is not semver
+func parseSemver(tag string) (*semver, bool) {
+	return parseSemverMatch(semverTag.FindStringSubmatch(tag))
+}
+
+func parseSemverMatch(m []string) (*semver, bool) {
+	if m == nil {
+		return nil, false
+	}
+	v := &semver{}
+	for i := 0; i < 3; i++ {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(m[i+1], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		v.nums[i] = n
+	}
+	if m[4] != "" {
+		v.pre = strings.Split(m[4], ".")
+	}
+	return v, true
+}
+
+// compare returns -1, 0 or 1 by the semver precedence, a prerelease is before its release
+func (v *semver) compare(o *semver) int {
+	for i := 0; i < 3; i++ {
+		if v.nums[i] != o.nums[i] {
+			if v.nums[i] < o.nums[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		a, aErr := strconv.ParseUint(v.pre[i], 10, 64)
+		b, bErr := strconv.ParseUint(o.pre[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil && a != b:
+			if a < b {
+				return -1
+			}
+			return 1
+		case aErr == nil && bErr != nil:
+			// the numeric identifiers are before the alphanumeric ones
+			return -1
+		case aErr != nil && bErr == nil:
+			return 1
+		case v.pre[i] != o.pre[i]:
+			if v.pre[i] < o.pre[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(v.pre) < len(o.pre):
+		return -1
+	case len(v.pre) > len(o.pre):
+		return 1
+	}
+	return 0
+}
+
+// SemverRange is the constraints of a semver range, all of them are met by the versions in the range
+type SemverRange struct {
+	expr        string
+	constraints []semverConstraint
+}
+
+type semverConstraint struct {
+	op string
+	v  *semver
+}
+
+// ParseSemverRange parses the constraints separated by spaces or commas, like ">=1.2.0 <2". The operators
+// are >=, >, <=, <, = and !=, a version without one is =. The missing minor and patch of a version are 0.
+func ParseSemverRange(expr string) (*SemverRange, error) {
+	r := &SemverRange{expr: expr}
+	rest := strings.TrimSpace(expr)
+	for rest != "" {
+		loc := semverClause.FindStringSubmatchIndex(rest)
+		if loc == nil || loc[0] != 0 {
+			return nil, fmt.Errorf("Invalid semver range %s", expr)
+		}
+		op, value := "=", rest[loc[4]:loc[5]]
+		if loc[2] != -1 {
+			op = rest[loc[2]:loc[3]]
+		}
+		v, ok := parseSemverMatch(semverPartial.FindStringSubmatch(value))
+		if !ok {
+			return nil, fmt.Errorf("Invalid version %s of the semver range %s", value, expr)
+		}
+		r.constraints = append(r.constraints, semverConstraint{op: op, v: v})
+		rest = strings.TrimLeft(rest[loc[1]:], " ,")
+	}
+	if len(r.constraints) == 0 {
+		return nil, fmt.Errorf("Empty semver range")
+	}
+	return r, nil
+}
+
+func (r *SemverRange) String() string {
+	return r.expr
+}
+
+// Matches tells if the tag parses as semver in the range
+func (r *SemverRange) Matches(tag string) bool {
+	v, ok := parseSemver(tag)
+	if !ok {
+		return false
+	}
+	for _, c := range r.constraints {
+		cmp := v.compare(c.v)
+		var ok bool
+		switch c.op {
+		case ">=":
+			ok = cmp >= 0
+		case ">":
+			ok = cmp > 0
+		case "<=":
+			ok = cmp <= 0
+		case "<":
+			ok = cmp < 0
+		case "!=":
+			ok = cmp != 0
+		default:
+			ok = cmp == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package cvetools
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagPolicy(t *testing.T) {
+	for expr, tags := range map[string]map[string]bool{
+		">=1.2.0 <2":    {"1.2.0": true, "v1.9.3": true, "1.10": true, "2.0.0": false, "1.1.9": false, "1.2.0-rc.1": false, "1": false, "latest": false},
+		">1.2, !=1.3.0": {"1.3.0": false, "1.3.1": true, "1.2.0": false, "1.2.1-beta": true},
+		"1.4":           {"1.4.0": true, "v1.4": true, "1.4.0+build.5": true, "1.4.1": false},
+		"<1.0.0-rc.2":   {"1.0.0-rc.1": true, "1.0.0-beta": true, "1.0.0-rc.10": false, "1.0.0": false},
+	} {
+		r, err := ParseSemverRange(expr)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", expr, err)
+		}
+		for tag, match := range tags {
+			if r.Matches(tag) != match {
+				t.Errorf("%s matched %s: %v, expect %v", expr, tag, !match, match)
+			}
+		}
+	}
+	for _, expr := range []string{"", ">=", "~1.2", ">=1.x"} {
+		if _, err := ParseSemverRange(expr); err == nil {
+			t.Errorf("Invalid range %q accepted", expr)
+		}
+	}
+
+	now := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	tags := []*registryTag{
+		{tag: "main", digest: "d1", created: now.Add(-time.Hour)},
+		{tag: "1.0.0", digest: "d2", created: now.Add(-200 * 24 * time.Hour)},
+		{tag: "1.1.0", digest: "d3", created: now.Add(-10 * 24 * time.Hour)},
+		{tag: "1.1", digest: "d3", created: now.Add(-10 * 24 * time.Hour)},
+		{tag: "1.2.0", digest: "d4"},
+	}
+	selected := func(policy *TagPolicy) string {
+		var names []string
+		for _, rt := range policy.selectTags(tags, now) {
+			names = append(names, rt.tag)
+		}
+		return strings.Join(names, ",")
+	}
+	semver, _ := ParseSemverRange(">=1.0.0")
+	for _, c := range []struct {
+		policy *TagPolicy
+		expect string
+	}{
+		{nil, "main,1.0.0,1.1.0,1.1,1.2.0"},
+		// all the tags of the 2 latest images, the image of an unknown age is the oldest
+		{&TagPolicy{LatestPerRepo: 2}, "main,1.1.0,1.1"},
+		// the images of an unknown age are kept
+		{&TagPolicy{MaxAge: 90 * 24 * time.Hour}, "main,1.1.0,1.1,1.2.0"},
+		{&TagPolicy{Semver: semver, MaxAge: 90 * 24 * time.Hour}, "1.1.0,1.1,1.2.0"},
+		// the intersection, the latest images are ranked among all the tags
+		{&TagPolicy{Semver: semver, LatestPerRepo: 2}, "1.1.0,1.1"},
+	} {
+		if s := selected(c.policy); s != c.expect {
+			t.Errorf("Incorrect tags of %+v: %s, expect %s", c.policy, s, c.expect)
+		}
+	}
+}
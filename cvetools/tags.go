@@ -0,0 +1,316 @@
+package cvetools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/scan/registry"
+)
+
+// the manifests accepted when looking up the digest of a tag, a manifest list has its own digest
+var manifestAccept = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	mediaTypeManifestList,
+	registry.MediaTypeOCIManifest,
+	registry.MediaTypeOCIIndex,
+}
+
+// the next page of the tag list, as in the Link header `</v2/app/tags/list?last=b&n=100>; rel="next"`
+var nextLink = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// siblingTags returns the tags of the repository pointing at the scanned image, as "repo:tag". The digest of
+// each tag is looked up with a HEAD request, so a repository of more than max tags is not looked up at all.
+// A tag matches the digest of the scanned tag, which is of the manifest list if any, or the digest scanned.
+func siblingTags(ctx context.Context, rc *scan.RegClient, repo, tag, digest string, max int) ([]string, error) {
+	tags, err := listTags(ctx, rc, repo, max)
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]bool{digest: true}
+	if dg, err := manifestDigest(ctx, rc, repo, tag); err == nil {
+		digests[dg] = true
+	}
+	siblings := make([]string, 0)
+	for _, t := range tags {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if t != tag {
+			dg, err := manifestDigest(ctx, rc, repo, t)
+			if err != nil {
+				log.WithFields(log.Fields{"repo": repo, "tag": t, "error": err}).Debug("Failed to read the tag digest")
+				continue
+			}
+			if !digests[dg] {
+				continue
+			}
+		}
+		siblings = append(siblings, repo+":"+t)
+	}
+	sort.Strings(siblings)
+	return siblings, nil
+}
+
+// listTags lists the tags of the repository page by page, it fails when there are more than max tags
+func listTags(ctx context.Context, rc *scan.RegClient, repo string, max int) ([]string, error) {
+	tags, err := listPages(ctx, rc, fmt.Sprintf("%s/v2/%s/tags/list?n=%d", rc.URL, repo, max+1), "tags", max)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the tags: %v", err)
+	}
+	return tags, nil
+}
+
+// listPages reads the list of the key, like the tags, from the page of the url and the next pages of the
+// Link headers. It fails when there are more than max values, max 0 for no limit.
+func listPages(ctx context.Context, rc *scan.RegClient, next, key string, max int) ([]string, error) {
+	base, err := url.Parse(rc.URL)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := rc.Client.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s", resp.Status)
+		} else if err != nil {
+			return nil, err
+		}
+
+		var list []string
+		if raw, ok := page[key]; ok && string(raw) != "null" {
+			if err = json.Unmarshal(raw, &list); err != nil {
+				return nil, err
+			}
+		}
+		values = append(values, list...)
+		if max > 0 && len(values) > max {
+			return nil, fmt.Errorf("more than %d %s", max, key)
+		}
+		next = ""
+		if m := nextLink.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			if u, err := base.Parse(m[1]); err == nil {
+				next = u.String()
+			}
+		}
+	}
+	return values, nil
+}
+
+// manifestDigest returns the digest of the manifest of a tag, without downloading the manifest
+func manifestDigest(ctx context.Context, rc *scan.RegClient, repo, tag string) (string, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", rc.URL, repo, tag)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, mt := range manifestAccept {
+		req.Header.Add("Accept", mt)
+	}
+	resp, err := rc.Client.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to read the manifest: %s", resp.Status)
+	}
+	dg := resp.Header.Get("Docker-Content-Digest")
+	if dg == "" {
+		return "", fmt.Errorf("No digest of the manifest")
+	}
+	return dg, nil
+}
+
+// the catalog and tags-list page size of a registry sweep
+const sweepPageSize = 100
+
+// RegistryImage is an image found by a registry sweep, with all the tags pointing at its digest
+type RegistryImage struct {
+	Digest     string   `json:"digest"`
+	Repository string   `json:"repository"`        // the repository the digest was first found in, the image is scanned from it
+	Tags       []string `json:"tags"`              // as repo:tag, sorted
+	Created    string   `json:"created,omitempty"` // RFC3339, read for the tag policies of the image age
+}
+
+// ListRegistryImages lists the repositories of the registry catalog matching the repository filter, a
+// path.Match glob, empty to match all, and their tags selected by the policy, nil for all. The tags pointing
+// at the same digest, in any repository, are listed as one image. The repositories whose tags can't be
+// listed are logged and skipped.
+func ListRegistryImages(ctx context.Context, registry, token, username, password, repoFilter string, policy *TagPolicy) ([]*RegistryImage, error) {
+	rc := newRegClient(registry, token, username, password, "")
+	if rc.Registry == nil {
+		return nil, fmt.Errorf("Invalid registry %s", registry)
+	}
+	repos, err := listPages(ctx, rc, fmt.Sprintf("%s/v2/_catalog?n=%d", rc.URL, sweepPageSize), "repositories", 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the repositories: %v", err)
+	}
+
+	images := make(map[string]*RegistryImage)
+	created := make(map[string]*imageCreated) // by digest, read once for the tags of an image
+	for _, repo := range repos {
+		if ok, _ := path.Match(repoFilter, repo); repoFilter != "" && !ok {
+			continue
+		}
+		tags, err := listPages(ctx, rc, fmt.Sprintf("%s/v2/%s/tags/list?n=%d", rc.URL, repo, sweepPageSize), "tags", 0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.WithFields(log.Fields{"repo": repo, "error": err}).Error("Failed to list the tags")
+			continue
+		}
+		sort.Strings(tags)
+		candidates := make([]*registryTag, 0, len(tags))
+		for _, tag := range tags {
+			// the latest images are ranked among all the tags of the filter
+			if !policy.matchFilter(tag) || (!policy.matchSemver(tag) && (policy == nil || policy.LatestPerRepo == 0)) {
+				continue
+			}
+			dg, err := manifestDigest(ctx, rc, repo, tag)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				log.WithFields(log.Fields{"repo": repo, "tag": tag, "error": err}).Error("Failed to read the tag digest")
+				continue
+			}
+			rt := &registryTag{tag: tag, digest: dg}
+			if policy.needsCreated() {
+				if rt.created, err = cachedCreated(ctx, rc, repo, dg, created); err != nil {
+					if ctx.Err() != nil {
+						return nil, ctx.Err()
+					}
+					log.WithFields(log.Fields{"repo": repo, "tag": tag, "error": err}).Debug("Failed to read the image created time")
+				}
+			}
+			candidates = append(candidates, rt)
+		}
+
+		for _, rt := range policy.selectTags(candidates, time.Now()) {
+			if img, ok := images[rt.digest]; ok {
+				img.Tags = append(img.Tags, repo+":"+rt.tag)
+			} else {
+				images[rt.digest] = &RegistryImage{Digest: rt.digest, Repository: repo, Tags: []string{repo + ":" + rt.tag}}
+				if !rt.created.IsZero() {
+					images[rt.digest].Created = rt.created.UTC().Format(time.RFC3339)
+				}
+			}
+		}
+	}
+
+	list := make([]*RegistryImage, 0, len(images))
+	for _, img := range images {
+		sort.Strings(img.Tags)
+		list = append(list, img)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Tags[0] < list[j].Tags[0] })
+	return list, nil
+}
+
+// imageCreated is the created time of an image, or the error reading it
+type imageCreated struct {
+	t   time.Time
+	err error
+}
+
+// cachedCreated returns the created time of the image of the digest, read once for all its tags, a failed
+// lookup is not retried for the other tags
+func cachedCreated(ctx context.Context, rc *scan.RegClient, repo, digest string, cache map[string]*imageCreated) (time.Time, error) {
+	if c, ok := cache[digest]; ok {
+		return c.t, c.err
+	}
+	t, err := manifestCreated(ctx, rc, repo, digest)
+	if ctx.Err() == nil {
+		cache[digest] = &imageCreated{t: t, err: err}
+	}
+	return t, err
+}
+
+// the platform of a manifest list whose created time is read, the one a scan without a platform prefers
+var createdPlatform = &ImagePlatform{OS: "linux", Architecture: "amd64"}
+
+// manifestCreated returns the created time of the image config of the manifest, of the linux/amd64 image of
+// a manifest list, or its first image without one. It is zero when the config has no time, or the epoch of a
+// reproducible build.
+func manifestCreated(ctx context.Context, rc *scan.RegClient, repo, ref string) (time.Time, error) {
+	var m struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		manifestIndex
+	}
+	for i := 0; i < 2; i++ {
+		body, err := getManifest(ctx, rc, repo, ref)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if err = json.Unmarshal(body, &m); err != nil {
+			return time.Time{}, err
+		}
+		if m.Config.Digest != "" || len(m.Manifests) == 0 {
+			break
+		}
+		ref = m.Manifests[0].Digest
+		for _, e := range m.Manifests {
+			if e.Platform.matches(createdPlatform) {
+				ref = e.Digest
+				break
+			}
+		}
+		m.Manifests = nil
+	}
+	if m.Config.Digest == "" {
+		return time.Time{}, fmt.Errorf("no image config")
+	}
+
+	conf, err := getImageConfig(ctx, rc, repo, strings.TrimPrefix(m.Config.Digest, "sha256:"))
+	if err != nil || conf.created() == "" {
+		return time.Time{}, err
+	}
+	return conf.Created, nil
+}
+
+// getManifest reads the manifest, or the manifest list, of the reference
+func getManifest(ctx context.Context, rc *scan.RegClient, repo, ref string) ([]byte, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", rc.URL, repo, ref)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, mt := range manifestAccept {
+		req.Header.Add("Accept", mt)
+	}
+	resp, err := rc.Client.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to read the manifest: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,125 @@
+package cvetools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	goDigest "github.com/opencontainers/go-digest"
+)
+
+func TestSiblingTags(t *testing.T) {
+	const indexDigest = "sha256:1111"
+	const manifestDigest = "sha256:2222"
+	digests := map[string]string{"1.2.3": indexDigest, "latest": indexDigest, "prod": manifestDigest, "1.2.2": "sha256:3333"}
+	var heads int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/app/tags/list" && r.URL.Query().Get("last") == "":
+			w.Header().Set("Link", `</v2/app/tags/list?last=1.2.3&n=4>; rel="next"`)
+			w.Write([]byte(`{"name":"app","tags":["1.2.2","1.2.3"]}`))
+		case r.URL.Path == "/v2/app/tags/list":
+			w.Write([]byte(`{"name":"app","tags":["latest","prod"]}`))
+		case r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+			heads++
+			w.Header().Set("Docker-Content-Digest", digests[strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/")])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	rc := newRegClient(srv.URL, "", "", "", "")
+	tags, err := siblingTags(context.Background(), rc, "app", "1.2.3", manifestDigest, 10)
+	if err != nil || !reflect.DeepEqual(tags, []string{"app:1.2.3", "app:latest", "app:prod"}) {
+		t.Errorf("Incorrect sibling tags: %v %v", tags, err)
+	}
+	// the scanned tag and the other 3 tags
+	if heads != 4 {
+		t.Errorf("Incorrect manifest requests: %d", heads)
+	}
+
+	// too many tags to look up
+	heads = 0
+	if tags, err = siblingTags(context.Background(), rc, "app", "1.2.3", manifestDigest, 3); err == nil || heads != 0 {
+		t.Errorf("Expect the repository skipped: %v %d", tags, heads)
+	}
+}
+
+func TestListRegistryImages(t *testing.T) {
+	digests := map[string]string{
+		"team-a/app:v1": "sha256:1111", "team-a/app:v1.0": "sha256:1111", "team-a/app:latest": "sha256:1111",
+		"team-a/app:v2": "sha256:2222", "team-a/db:v1": "sha256:1111", "team-b/app:v1": "sha256:3333",
+		"team-a/app:v3": "sha256:4444", "team-a/app:v3.1": "sha256:4444",
+	}
+	// the image of v2 is a manifest list, its linux/amd64 image is created later, the manifest of v3 can't be read
+	conf1, conf2 := `{"created":"2024-01-01T00:00:00Z"}`, `{"created":"2024-06-01T00:00:00Z"}`
+	blobs := map[string]string{
+		"/v2/team-a/app/manifests/sha256:1111": fmt.Sprintf(`{"config":{"digest":"%s"}}`, goDigest.FromString(conf1)),
+		"/v2/team-a/app/manifests/sha256:2222": `{"manifests":[{"digest":"sha256:2224","platform":{"os":"linux","architecture":"arm64"}},` +
+			`{"digest":"sha256:2223","platform":{"os":"linux","architecture":"amd64"}}]}`,
+		"/v2/team-a/app/manifests/sha256:2224":                        fmt.Sprintf(`{"config":{"digest":"%s"}}`, goDigest.FromString(conf1)),
+		"/v2/team-a/app/manifests/sha256:2223":                        fmt.Sprintf(`{"config":{"digest":"%s"}}`, goDigest.FromString(conf2)),
+		"/v2/team-a/app/blobs/" + goDigest.FromString(conf1).String(): conf1,
+		"/v2/team-a/app/blobs/" + goDigest.FromString(conf2).String(): conf2,
+	}
+	var failed int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && blobs[r.URL.Path] != "":
+			w.Write([]byte(blobs[r.URL.Path]))
+		case r.Method == http.MethodGet && r.URL.Path == "/v2/team-a/app/manifests/sha256:4444":
+			failed++
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/v2/_catalog" && r.URL.Query().Get("last") == "":
+			w.Header().Set("Link", `</v2/_catalog?last=team-a%2Fapp&n=100>; rel="next"`)
+			w.Write([]byte(`{"repositories":["team-a/app"]}`))
+		case r.URL.Path == "/v2/_catalog":
+			w.Write([]byte(`{"repositories":["team-a/db","team-b/app"]}`))
+		case r.URL.Path == "/v2/team-a/app/tags/list":
+			w.Write([]byte(`{"name":"team-a/app","tags":["v2","v1.0","latest","v1","v3","v3.1"]}`))
+		case r.URL.Path == "/v2/team-a/db/tags/list":
+			w.Write([]byte(`{"name":"team-a/db","tags":["v1"]}`))
+		case r.URL.Path == "/v2/team-b/app/tags/list":
+			t.Errorf("Filtered repository listed")
+		case r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/manifests/"):
+			ref := strings.Replace(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/", ":", 1)
+			w.Header().Set("Docker-Content-Digest", digests[ref])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	list := func(policy *TagPolicy, expect []*RegistryImage) {
+		images, err := ListRegistryImages(context.Background(), srv.URL, "", "", "", "team-a/*", policy)
+		if err != nil || !reflect.DeepEqual(images, expect) {
+			t.Errorf("Incorrect images of %+v: %v", policy, err)
+			for _, img := range images {
+				t.Errorf("  %+v", img)
+			}
+		}
+	}
+	list(&TagPolicy{Filter: "v*"}, []*RegistryImage{
+		{Digest: "sha256:1111", Repository: "team-a/app", Tags: []string{"team-a/app:v1", "team-a/app:v1.0", "team-a/db:v1"}},
+		{Digest: "sha256:2222", Repository: "team-a/app", Tags: []string{"team-a/app:v2"}},
+		{Digest: "sha256:4444", Repository: "team-a/app", Tags: []string{"team-a/app:v3", "team-a/app:v3.1"}},
+	})
+	// the latest image of each repository, by the created time of the config, read once for a failed digest
+	list(&TagPolicy{Filter: "v*", LatestPerRepo: 1}, []*RegistryImage{
+		{Digest: "sha256:2222", Repository: "team-a/app", Tags: []string{"team-a/app:v2"}, Created: "2024-06-01T00:00:00Z"},
+		{Digest: "sha256:1111", Repository: "team-a/db", Tags: []string{"team-a/db:v1"}, Created: "2024-01-01T00:00:00Z"},
+	})
+	if failed != 1 {
+		t.Errorf("The failed created time read %d times", failed)
+	}
+	// v1 and latest are not semver
+	semver, _ := ParseSemverRange(">=1.0.0 <2")
+	list(&TagPolicy{Semver: semver}, []*RegistryImage{
+		{Digest: "sha256:1111", Repository: "team-a/app", Tags: []string{"team-a/app:v1.0"}},
+	})
+}
@@ -0,0 +1,139 @@
+package cvetools
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"time"
+)
+
+// Phases of an image scan. The registry token is requested with the first manifest request, so its time is
+// in PhaseManifest. The layers are extracted and the application packages are detected while they are
+// downloaded, so their time is in PhaseDownload.
+const (
+	PhaseManifest   = "manifest"
+	PhaseDownload   = "download"
+	PhaseSignature  = "signature"
+	PhaseConfig     = "config"
+	PhaseTags       = "tags"
+	PhaseLocalImage = "local_image"
+	PhaseFileMap    = "file_map"
+	PhasePackages   = "packages"
+	PhaseMatching   = "matching"
+	PhaseSecrets    = "secrets"
+	PhaseLayers     = "layers"
+)
+
+// PhaseTiming is the time spent on a phase of the scan
+type PhaseTiming struct {
+	Phase  string `json:"Phase"`
+	Millis int64  `json:"Millis"`
+	Bytes  int64  `json:"Bytes,omitempty"`
+}
+
+// LayerTiming is the time spent on a layer, from its request to its blob read and verified. The layer is
+// extracted while it is downloaded, so its time is both.
+type LayerTiming struct {
+	Digest string `json:"Digest"`
+	Millis int64  `json:"Millis"`
+	Bytes  int64  `json:"Bytes"` // of the compressed blob
+}
+
+var (
+	metricPhaseCount  = expvar.NewMap("scan_phase_count")
+	metricPhaseMillis = expvar.NewMap("scan_phase_millis")
+	metricPhaseBytes  = expvar.NewMap("scan_phase_bytes")
+)
+
+// addPhase records the time since start, it can be called on a nil ScanStats
+func (s *ScanStats) addPhase(phase string, start time.Time, bytes int64) {
+	if s == nil {
+		return
+	}
+	timing := &PhaseTiming{Phase: phase, Millis: time.Since(start).Milliseconds(), Bytes: bytes}
+	s.mutex.Lock()
+	s.Phases = append(s.Phases, timing)
+	s.mutex.Unlock()
+	s.progress.phaseDone(phase, timing.Millis)
+}
+
+type scanStatsKey struct{}
+
+// withScanStats returns the context to time the layers of its registry requests in the stats
+func withScanStats(ctx context.Context, s *ScanStats) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, scanStatsKey{}, s)
+}
+
+func scanStatsFromContext(ctx context.Context) *ScanStats {
+	s, _ := ctx.Value(scanStatsKey{}).(*ScanStats)
+	return s
+}
+
+// addLayer records the time since start of the layer, it can be called on a nil ScanStats
+func (s *ScanStats) addLayer(digest string, start time.Time, bytes int64) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Layers = append(s.Layers, &LayerTiming{Digest: digest, Millis: time.Since(start).Milliseconds(), Bytes: bytes})
+	s.mutex.Unlock()
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// setFindings reports the vulnerabilities matched with the progress, it can be called on a nil ScanStats
+func (s *ScanStats) setFindings(n int) {
+	if s == nil {
+		return
+	}
+	s.progress.setFindings(n)
+}
+
+// RecordPhaseStats adds the phase timings of a scan to the counters. It is called by the process serving the
+// scans, the scanner tasks report the timings in the result.
+func RecordPhaseStats(s *ScanStats) {
+	if s == nil {
+		return
+	}
+	for _, p := range s.Phases {
+		metricPhaseCount.Add(p.Phase, 1)
+		metricPhaseMillis.Add(p.Phase, p.Millis)
+		if p.Bytes > 0 {
+			metricPhaseBytes.Add(p.Phase, p.Bytes)
+		}
+	}
+}
+
+// PhaseStat is the aggregate of a phase over the scans
+type PhaseStat struct {
+	Phase  string
+	Count  int64
+	Millis int64
+	Bytes  int64
+}
+
+// PhaseStats returns the aggregate phase timings, sorted by the phase
+func PhaseStats() []*PhaseStat {
+	var list []*PhaseStat
+	metricPhaseCount.Do(func(kv expvar.KeyValue) {
+		ps := &PhaseStat{Phase: kv.Key, Count: kv.Value.(*expvar.Int).Value()}
+		if v, ok := metricPhaseMillis.Get(kv.Key).(*expvar.Int); ok {
+			ps.Millis = v.Value()
+		}
+		if v, ok := metricPhaseBytes.Get(kv.Key).(*expvar.Int); ok {
+			ps.Bytes = v.Value()
+		}
+		list = append(list, ps)
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Phase < list[j].Phase })
+	return list
+}
@@ -0,0 +1,30 @@
+package cvetools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPhaseStats(t *testing.T) {
+	var nilStats *ScanStats
+	nilStats.addPhase(PhaseManifest, time.Now(), 0)
+
+	s := &ScanStats{}
+	s.addPhase(PhaseDownload, time.Now().Add(-time.Second), 1000)
+	s.addPhase(PhaseMatching, time.Now(), 0)
+	if len(s.Phases) != 2 || s.Phases[0].Millis < 1000 || s.Phases[0].Bytes != 1000 {
+		t.Errorf("Unexpected phases: %+v", s.Phases)
+	}
+
+	RecordPhaseStats(s)
+	RecordPhaseStats(s)
+	var download *PhaseStat
+	for _, ps := range PhaseStats() {
+		if ps.Phase == PhaseDownload {
+			download = ps
+		}
+	}
+	if download == nil || download.Count != 2 || download.Bytes != 2000 || download.Millis < 2000 {
+		t.Errorf("Unexpected download stats: %+v", download)
+	}
+}
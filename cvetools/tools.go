@@ -11,7 +11,7 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const ImageWorkingPath = "/tmp/images"
+var ImageWorkingPath = "/tmp/images"
 
 func downloadFromUrl(url, fileName string) error {
 	output, err := os.Create(fileName)
@@ -54,6 +54,7 @@ func CreateImagePath(uid string) string {
 
 	///
 	os.MkdirAll(imgPath, 0755)
+	addActivePath(imgPath)
 	return imgPath
 }
 
@@ -2,7 +2,9 @@ package cvetools
 
 import (
 	"sync"
+	"time"
 
+	"github.com/neuvector/neuvector/share"
 	"github.com/neuvector/neuvector/share/scan"
 	"github.com/neuvector/neuvector/share/utils"
 	"github.com/neuvector/scanner/common"
@@ -25,10 +27,22 @@ type CveTools struct {
 	RtSock          string
 	CveDBVersion    string
 	CveDBCreateTime string
+	CveDBSources    string // the hash of the sources of a merged database, empty for the main database alone
 	UpdateMux       sync.RWMutex
 	// Update          updateData
 	SupportOs utils.Set
 	ScanTool  *scan.ScanUtil
+
+	postMutex      sync.RWMutex
+	postProcessors []PostProcessor
+	severityMap    SeverityMap
+	ignoredChecks  map[string]bool
+	ignoredVuls    map[string]bool   // upper case
+	ignoreReasons  map[string]string // by the upper case IDs
+	vex            []*VEXStatement
+	scanFilters    *ScanFilters // recorded in the provenance of the post-processed reports
+	dbMutex        sync.Mutex
+	db             *DBHandle // the database of the scans, see SwapDB
 }
 
 type vulShortReport struct {
@@ -40,3 +54,113 @@ type vulFullReport struct {
 	Vf common.VulFull
 	Ft detectors.FeatureVersion
 }
+
+// ImagePlatform is the os/architecture/variant of the scanned image
+type ImagePlatform struct {
+	OS           string `json:"OS"`
+	Architecture string `json:"Architecture"`
+	Variant      string `json:"Variant,omitempty"`
+}
+
+func (p *ImagePlatform) String() string {
+	if p == nil {
+		return ""
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ImageScanRequest extends share.ScanImageRequest with the options the controller API has no field for.
+// It is marshalled as a superset of share.ScanImageRequest, so a plain request can be read into it.
+type ImageScanRequest struct {
+	share.ScanImageRequest
+	MaxImageSize int64          `json:"MaxImageSize,omitempty"` // bytes of the compressed layers, 0 for no limit
+	Strict       bool           `json:"Strict,omitempty"`       // fail the scan if any layer was skipped or partially scanned
+	Platform     string         `json:"Platform,omitempty"`     // os/architecture[/variant] to pick from a manifest list
+	BestEffort   bool           `json:"BestEffort,omitempty"`   // scan the downloaded layers when some layers fail to download
+	CosignKeys   []*CosignKey   `json:"CosignKeys,omitempty"`   // verify the cosign signatures of the image with the keys
+	Keyless      *KeylessPolicy `json:"Keyless,omitempty"`      // or with the Fulcio certificates of the signer identity
+	ScanID       string         `json:"ScanID,omitempty"`       // in the logs and the user agent of the registry requests
+	Compliance   string         `json:"Compliance,omitempty"`   // the benchmark to check the image against, like cis-docker
+	MaxImageAge  time.Duration  `json:"MaxImageAge,omitempty"`  // report the images created earlier than this, 0 to disable
+	SiblingTags  int            `json:"SiblingTags,omitempty"`  // find the other tags of the image in a repository of up to this many tags, 0 to disable
+	Misconfig    bool           `json:"Misconfig,omitempty"`    // check the image reference and its base are pinned
+	ExcludePaths []string       `json:"ExcludePaths,omitempty"` // the patterns of the files not scanned, like /usr/share/doc or **/test/**
+	RateLimit    *RateLimit     `json:"RateLimit,omitempty"`    // the request budget of the registry hosts, handed out by the sweep process
+}
+
+// ScanReport extends share.ScanResult with the image details that the controller API has no field for.
+// It is marshalled as a superset of share.ScanResult, so it can be read back as a plain share.ScanResult.
+type ScanReport struct {
+	*share.ScanResult
+	db            *DBHandle              // the database the packages were matched with, nil if they were not
+	SchemaVersion int                    `json:"SchemaVersion,omitempty"` // ReportSchemaVersion, 0 in the reports of version 1
+	Provenance    *ScanProvenance        `json:"Provenance,omitempty"`
+	ImagePlatform *ImagePlatform         `json:"ImagePlatform,omitempty"`
+	ImageCreated  string                 `json:"ImageCreated,omitempty"` // RFC3339
+	ErrorMessage  string                 `json:"ErrorMessage,omitempty"` // details of Error when there are any
+	Stats         *ScanStats             `json:"Stats,omitempty"`
+	Coverage      *ScanCoverage          `json:"Coverage,omitempty"`
+	Locations     []*ModuleLocation      `json:"ModuleLocations,omitempty"`
+	Signature     *SignatureVerification `json:"SignatureVerification,omitempty"`
+	// the vulnerabilities remapped by the severity map, with their severity of the database
+	SeverityOverrides []*SeverityOverride `json:"SeverityOverrides,omitempty"`
+	// the OCI artifact found instead of an image, the image scanned is its subject if any
+	Artifact *ArtifactInfo `json:"Artifact,omitempty"`
+	// the best practices the image build doesn't follow, found in the image history
+	Checks []*ImageCheck `json:"Checks,omitempty"`
+	// the compressed and extracted sizes of the image and its layers
+	ImageSize *ImageSize `json:"ImageSize,omitempty"`
+	// the controls of the compliance benchmark requested
+	Compliance *ComplianceReport `json:"Compliance,omitempty"`
+	// the config has no creation time, or the epoch of a reproducible build
+	ImageAgeUnknown bool `json:"ImageAgeUnknown,omitempty"`
+	// the tags of the repository pointing at the image, with ImageScanRequest.SiblingTags
+	RepoTags []string `json:"RepoTags,omitempty"`
+	// the files not scanned, by the patterns of ImageScanRequest.ExcludePaths
+	ExcludedPaths []*ExcludedPaths `json:"ExcludedPaths,omitempty"`
+	// the process the containers run as PID 1, of the image config
+	PID1 *PID1 `json:"PID1,omitempty"`
+	// the other IDs of the vulnerabilities in the database, like GHSA, OSV or RUSTSEC, by their DB keys
+	Aliases map[string][]string `json:"Aliases,omitempty"`
+	// the vulnerabilities of a not_affected or a fixed VEX statement, not in the vulnerabilities of the result
+	VEXSuppressed []*VEXFinding `json:"VEXSuppressed,omitempty"`
+	// the vulnerabilities removed by the ignore file
+	Ignored []*IgnoredFinding `json:"Ignored,omitempty"`
+}
+
+// IgnoredFinding is a vulnerability removed by the ignore file, by its ID matched and the reason of the file
+type IgnoredFinding struct {
+	Vulnerability *share.ScanVulnerability `json:"Vulnerability"`
+	ID            string                   `json:"ID"` // upper case
+	Reason        string                   `json:"Reason,omitempty"`
+}
+
+// PID1 is the process the containers of the image run as PID 1, by the entrypoint and the cmd of the config
+type PID1 struct {
+	Command string `json:"Command"`
+	Init    string `json:"Init,omitempty"` // the init reaping the zombie processes, like tini, empty for a raw process
+}
+
+// ModuleLocation is where a module was found in the image: the package database of an OS package,
+// the binary or the archive of an application module. The archives nested in an archive are joined by ':'.
+type ModuleLocation struct {
+	Name    string `json:"Name"`
+	Version string `json:"Version"`
+	Source  string `json:"Source"`
+	Path    string `json:"Path"`
+}
+
+// ScanStats records how the scan went, for tuning the scanner
+type ScanStats struct {
+	ScratchEstimate int64          `json:"ScratchEstimate,omitempty"` // bytes, estimated from the compressed layer sizes, see estimateScratchSpace
+	ScratchUsed     int64          `json:"ScratchUsed,omitempty"`     // bytes, used by the downloaded layers
+	Phases          []*PhaseTiming `json:"Phases,omitempty"`
+	Layers          []*LayerTiming `json:"Layers,omitempty"` // the downloaded layers, as they complete
+
+	mutex    sync.Mutex
+	progress *progressTracker // reports the phases as they end
+}
@@ -0,0 +1,663 @@
+package cvetools
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+// the VEX statuses, the findings of a not_affected or a fixed statement are suppressed
+const (
+	VEXNotAffected        = "not_affected"
+	VEXAffected           = "affected"
+	VEXFixed              = "fixed"
+	VEXUnderInvestigation = "under_investigation"
+)
+
+// VEXStatement is a statement of an OpenVEX document: the status of the vulnerability in the products, an
+// image by its digest or purl, or a package by its purl. The subcomponents of an image are its packages the
+// statement is limited to.
+type VEXStatement struct {
+	Vulnerability string       `json:"Vulnerability"`
+	Aliases       []string     `json:"Aliases,omitempty"`
+	Products      []VEXProduct `json:"Products"`
+	Status        string       `json:"Status"`
+	Justification string       `json:"Justification,omitempty"`
+	Impact        string       `json:"Impact,omitempty"` // the impact statement of not_affected
+	Action        string       `json:"Action,omitempty"` // the action statement of affected
+	Document      string       `json:"Document"`         // the file of the statement
+	Timestamp     time.Time    `json:"Timestamp"`        // of the statement, or of its document
+}
+
+// VEXProduct is a product of a VEX statement
+type VEXProduct struct {
+	ID            string   `json:"ID"`
+	Subcomponents []string `json:"Subcomponents,omitempty"`
+}
+
+// VEXFinding is a vulnerability suppressed by a VEX statement, it is moved out of the vulnerabilities of the
+// result, so it is not counted, but kept with the status and the justification of the statement
+type VEXFinding struct {
+	Vulnerability *share.ScanVulnerability `json:"Vulnerability"`
+	Status        string                   `json:"Status"`
+	Justification string                   `json:"Justification,omitempty"`
+	Impact        string                   `json:"Impact,omitempty"`
+	Document      string                   `json:"Document"`
+}
+
+// the OpenVEX document, of the versions 0.0.1 and 0.2.0: the vulnerability is a name or an object, a product a
+// purl or an object, and the subcomponents are of the statement in 0.0.1
+type openVEXDocument struct {
+	Context    string `json:"@context"`
+	Timestamp  string `json:"timestamp"`
+	Statements []struct {
+		Timestamp       string            `json:"timestamp"`
+		Vulnerability   json.RawMessage   `json:"vulnerability"`
+		Products        []json.RawMessage `json:"products"`
+		Subcomponents   []json.RawMessage `json:"subcomponents"`
+		Status          string            `json:"status"`
+		Justification   string            `json:"justification"`
+		ImpactStatement string            `json:"impact_statement"`
+		ActionStatement string            `json:"action_statement"`
+	} `json:"statements"`
+	// a CSAF document, not supported
+	CSAF *struct {
+		Version string `json:"csaf_version"`
+	} `json:"document"`
+}
+
+// LoadVEX reads the statements of the OpenVEX documents, each path is a file or a folder of .json files read in
+// the order of their names. The latest statement of a finding by its timestamp wins, the last one in the order
+// of the documents if they have the same. A document that can't be read or is not a valid OpenVEX document is
+// an error.
+func LoadVEX(paths []string) ([]*VEXStatement, error) {
+	files := make([]string, 0)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the VEX document: %v", err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the VEX folder: %v", err)
+		}
+		names := make([]string, 0)
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+				names = append(names, e.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+
+	statements := make([]*VEXStatement, 0)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the VEX document: %v", err)
+		}
+		list, err := parseVEX(data, file)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid VEX document %s: %v", file, err)
+		}
+		statements = append(statements, list...)
+	}
+	return statements, nil
+}
+
+func parseVEX(data []byte, file string) ([]*VEXStatement, error) {
+	var doc openVEXDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.CSAF != nil && doc.CSAF.Version != "" {
+		return nil, fmt.Errorf("CSAF %s is not supported, only OpenVEX", doc.CSAF.Version)
+	}
+	if !strings.HasPrefix(doc.Context, "https://openvex.dev/ns") {
+		return nil, fmt.Errorf("not an OpenVEX document, @context %q", doc.Context)
+	}
+	docTime, err := vexTime(doc.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := make([]*VEXStatement, len(doc.Statements))
+	for i, s := range doc.Statements {
+		st := &VEXStatement{
+			Status: s.Status, Justification: s.Justification, Impact: s.ImpactStatement, Action: s.ActionStatement, Document: file,
+			Timestamp: docTime,
+		}
+		if s.Timestamp != "" {
+			if st.Timestamp, err = vexTime(s.Timestamp); err != nil {
+				return nil, fmt.Errorf("statement %d: %v", i+1, err)
+			}
+		}
+		var name string
+		if json.Unmarshal(s.Vulnerability, &name) == nil {
+			st.Vulnerability = name
+		} else {
+			var v struct {
+				Name    string   `json:"name"`
+				ID      string   `json:"@id"`
+				Aliases []string `json:"aliases"`
+			}
+			if err := json.Unmarshal(s.Vulnerability, &v); err != nil {
+				return nil, fmt.Errorf("statement %d: invalid vulnerability", i+1)
+			}
+			st.Vulnerability, st.Aliases = v.Name, v.Aliases
+		}
+		if st.Vulnerability == "" {
+			return nil, fmt.Errorf("statement %d: no vulnerability", i+1)
+		}
+
+		switch st.Status {
+		case VEXNotAffected:
+			if st.Justification == "" && st.Impact == "" {
+				return nil, fmt.Errorf("statement %d: %s of %s without a justification or an impact statement", i+1, st.Status, st.Vulnerability)
+			}
+		case VEXAffected, VEXFixed, VEXUnderInvestigation:
+		default:
+			return nil, fmt.Errorf("statement %d: unknown status %q", i+1, st.Status)
+		}
+
+		subs, err := vexIDs(s.Subcomponents)
+		if err != nil {
+			return nil, fmt.Errorf("statement %d: %v", i+1, err)
+		}
+		for _, raw := range s.Products {
+			var p VEXProduct
+			if json.Unmarshal(raw, &p.ID) != nil {
+				var o struct {
+					ID          string `json:"@id"`
+					Identifiers struct {
+						Purl string `json:"purl"`
+					} `json:"identifiers"`
+					Subcomponents []json.RawMessage `json:"subcomponents"`
+				}
+				if err := json.Unmarshal(raw, &o); err != nil {
+					return nil, fmt.Errorf("statement %d: invalid product", i+1)
+				}
+				if p.ID = o.ID; p.ID == "" {
+					p.ID = o.Identifiers.Purl
+				}
+				if p.Subcomponents, err = vexIDs(o.Subcomponents); err != nil {
+					return nil, fmt.Errorf("statement %d: %v", i+1, err)
+				}
+			}
+			if p.ID == "" {
+				return nil, fmt.Errorf("statement %d: product without an ID", i+1)
+			}
+			p.Subcomponents = append(p.Subcomponents, subs...)
+			st.Products = append(st.Products, p)
+		}
+		if len(st.Products) == 0 {
+			return nil, fmt.Errorf("statement %d: no product", i+1)
+		}
+		statements[i] = st
+	}
+	return statements, nil
+}
+
+// vexTime returns the time of an RFC 3339 timestamp, the zero time if it is empty
+func vexTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return t, nil
+}
+
+// vexIDs returns the IDs of the subcomponents, the purls or the objects with an @id
+func vexIDs(list []json.RawMessage) ([]string, error) {
+	ids := make([]string, 0, len(list))
+	for _, raw := range list {
+		var id string
+		if json.Unmarshal(raw, &id) != nil {
+			var o struct {
+				ID          string `json:"@id"`
+				Identifiers struct {
+					Purl string `json:"purl"`
+				} `json:"identifiers"`
+			}
+			if err := json.Unmarshal(raw, &o); err != nil {
+				return nil, fmt.Errorf("invalid subcomponent")
+			}
+			if id = o.ID; id == "" {
+				id = o.Identifiers.Purl
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("subcomponent without an ID")
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// SetVEX sets the VEX statements applied by PostProcess
+func (cv *CveTools) SetVEX(statements []*VEXStatement) {
+	cv.postMutex.Lock()
+	defer cv.postMutex.Unlock()
+	cv.vex = statements
+}
+
+// applyVEX moves the vulnerabilities of a not_affected or a fixed statement to the suppressed ones, the latest
+// statement of a vulnerability in the image or its package wins. The vulnerabilities of the layers are removed
+// too, they are only reported once.
+func applyVEX(report *ScanReport, statements []*VEXStatement) {
+	types := modulePurlTypes(report.Modules)
+	status := func(v *share.ScanVulnerability) *VEXStatement {
+		ids := map[string]bool{strings.ToUpper(v.Name): true}
+		for _, cve := range v.CVEs {
+			ids[strings.ToUpper(cve)] = true
+		}
+		for _, alias := range report.Aliases[v.DBKey] {
+			ids[strings.ToUpper(alias)] = true
+		}
+
+		var last *VEXStatement
+		for _, st := range statements {
+			if st.affects(ids) && st.appliesTo(report, v, types.of(v)) && (last == nil || !st.Timestamp.Before(last.Timestamp)) {
+				last = st
+			}
+		}
+		if last == nil || (last.Status != VEXNotAffected && last.Status != VEXFixed) {
+			return nil
+		}
+		return last
+	}
+
+	suppressed := make(map[*share.ScanVulnerability]bool)
+	kept := make([]*share.ScanVulnerability, 0, len(report.Vuls))
+	for _, v := range report.Vuls {
+		if st := status(v); st != nil {
+			report.VEXSuppressed = append(report.VEXSuppressed, &VEXFinding{
+				Vulnerability: v, Status: st.Status, Justification: st.Justification, Impact: st.Impact, Document: st.Document,
+			})
+			suppressed[v] = true
+		} else {
+			kept = append(kept, v)
+		}
+	}
+	report.Vuls = kept
+	for _, l := range report.Layers {
+		list := make([]*share.ScanVulnerability, 0, len(l.Vuls))
+		for _, v := range l.Vuls {
+			if status(v) == nil {
+				list = append(list, v)
+			}
+		}
+		l.Vuls = list
+	}
+	if len(suppressed) > 0 {
+		log.WithFields(log.Fields{
+			"repo": report.Repository, "tag": report.Tag, "suppressed": len(suppressed),
+		}).Info("Vulnerabilities suppressed by VEX")
+	}
+}
+
+// affects returns true if the statement is of one of the IDs of the vulnerability, upper case
+func (st *VEXStatement) affects(ids map[string]bool) bool {
+	if ids[strings.ToUpper(st.Vulnerability)] {
+		return true
+	}
+	for _, alias := range st.Aliases {
+		if ids[strings.ToUpper(alias)] {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo returns true if a product of the statement is the image, and one of its subcomponents the package
+// of the vulnerability if it lists them, or if a product is the package of the vulnerability. The purl type of
+// the package is the one of its ecosystem.
+func (st *VEXStatement) appliesTo(report *ScanReport, v *share.ScanVulnerability, typ string) bool {
+	for _, p := range st.Products {
+		if isImageProduct(report, p.ID) {
+			if len(p.Subcomponents) == 0 {
+				return true
+			}
+			for _, sub := range p.Subcomponents {
+				if isPackageProduct(v, typ, sub) {
+					return true
+				}
+			}
+		} else if isPackageProduct(v, typ, p.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// isImageProduct returns true if the product is the image: its digest, or an oci or docker purl of its
+// digest, or of its registry, repository and tag. An oci purl without a digest must have the repository_url
+// and the tag qualifiers, its name alone is the last part of any repository; a docker purl without a
+// repository_url is of Docker Hub.
+func isImageProduct(report *ScanReport, id string) bool {
+	digests := []string{report.Digest}
+	if report.ImageID != "" {
+		digests = append(digests, "sha256:"+strings.TrimPrefix(report.ImageID, "sha256:"))
+	}
+	isDigest := func(d string) bool {
+		for _, digest := range digests {
+			if digest != "" && d == digest {
+				return true
+			}
+		}
+		return false
+	}
+	if strings.HasPrefix(id, "sha256:") {
+		return isDigest(id)
+	}
+
+	p, ok := parsePurl(id)
+	if !ok || (p.typ != "oci" && p.typ != "docker") {
+		return false
+	}
+	if strings.HasPrefix(p.version, "sha256:") {
+		return isDigest(p.version)
+	}
+	tag, host, repo := p.version, p.qualifiers.Get("repository_url"), p.name
+	if p.namespace != "" {
+		repo = p.namespace + "/" + p.name
+	}
+	switch p.typ {
+	case "oci":
+		tag = p.qualifiers.Get("tag")
+		i := strings.Index(host, "/")
+		if i == -1 {
+			return false
+		}
+		host, repo = host[:i], host[i+1:]
+	case "docker":
+		if host == "" {
+			host = "docker.io"
+		}
+	}
+	if tag == "" || tag != report.Tag {
+		return false
+	}
+	return sameRegistry(host, registryHost(report.Registry)) &&
+		strings.TrimPrefix(repo, "library/") == strings.TrimPrefix(report.Repository, "library/")
+}
+
+// the hosts of Docker Hub
+var dockerHubHosts = map[string]bool{
+	"docker.io": true, "index.docker.io": true, "registry-1.docker.io": true, "registry.hub.docker.com": true, "hub.docker.com": true,
+}
+
+// sameRegistry returns true if the hosts are of the same registry, the hosts of Docker Hub are the same
+func sameRegistry(a, b string) bool {
+	a = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(a, "https://"), "http://"), "/"))
+	b = strings.ToLower(b)
+	if a == "" || b == "" {
+		return false
+	}
+	return a == b || (dockerHubHosts[a] && dockerHubHosts[b])
+}
+
+// the purl types of the modules, by the app name, or by the OS of the namespace like debian:11
+var purlTypes = map[string]string{
+	"golang": "golang", "node.js": "npm", "jar": "maven", "Tomcat": "maven", "python": "pypi", "ruby": "gem", ".NET": "nuget",
+	"ubuntu": "deb", "debian": "deb", "alpine": "apk",
+}
+
+// modulePurlType returns the purl type of the source of a module: rpm of the other OS namespaces, and generic
+// of the other apps, like nginx or openssl
+func modulePurlType(source string) string {
+	if t, ok := purlTypes[source]; ok {
+		return t
+	}
+	if i := strings.Index(source, ":"); i != -1 {
+		if t, ok := purlTypes[source[:i]]; ok {
+			return t
+		}
+		return "rpm"
+	}
+	return "generic"
+}
+
+// moduleTypes are the purl types of the modules of the report, by name and version, and by name
+type moduleTypes struct {
+	byVersion map[string]string
+	byName    map[string]string
+}
+
+func modulePurlTypes(modules []*share.ScanModule) *moduleTypes {
+	types := &moduleTypes{byVersion: make(map[string]string), byName: make(map[string]string)}
+	for _, m := range modules {
+		typ := modulePurlType(m.Source)
+		types.byVersion[m.Name+"@"+m.Version] = typ
+		types.byName[m.Name] = typ
+	}
+	return types
+}
+
+// of returns the purl type of the package of the vulnerability, empty if it is not a module of the report
+func (types *moduleTypes) of(v *share.ScanVulnerability) string {
+	if typ, ok := types.byVersion[v.PackageName+"@"+v.PackageVersion]; ok {
+		return typ
+	}
+	return types.byName[v.PackageName]
+}
+
+// isPackageProduct returns true if the product is the purl of the package of the vulnerability, of its type
+// and of its version if the purl has one
+func isPackageProduct(v *share.ScanVulnerability, typ, id string) bool {
+	p, ok := parsePurl(id)
+	if !ok || p.typ != typ {
+		return false
+	}
+	if p.version != "" && p.version != v.PackageVersion {
+		return false
+	}
+	// the package names of the languages have the namespace, like a maven group or a go module path
+	for _, name := range []string{p.name, p.namespace + "/" + p.name, p.namespace + ":" + p.name} {
+		if strings.EqualFold(name, v.PackageName) {
+			return true
+		}
+	}
+	return false
+}
+
+// purl is a package URL, pkg:type/namespace/name@version?qualifiers#subpath
+type purl struct {
+	typ        string
+	namespace  string
+	name       string
+	version    string
+	qualifiers url.Values
+}
+
+func parsePurl(s string) (*purl, bool) {
+	if !strings.HasPrefix(s, "pkg:") {
+		return nil, false
+	}
+	s = strings.TrimPrefix(s[4:], "/")
+	if i := strings.Index(s, "#"); i != -1 {
+		s = s[:i]
+	}
+	p := &purl{}
+	if i := strings.Index(s, "?"); i != -1 {
+		p.qualifiers, _ = url.ParseQuery(s[i+1:])
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, "@"); i != -1 {
+		p.version, _ = url.PathUnescape(s[i+1:])
+		s = s[:i]
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+		return nil, false
+	}
+	p.typ = strings.ToLower(parts[0])
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+	p.name = parts[len(parts)-1]
+	p.namespace = strings.Join(parts[1:len(parts)-1], "/")
+	if p.qualifiers == nil {
+		p.qualifiers = url.Values{}
+	}
+	return p, true
+}
+
+// the justifications of the not_affected statements of OpenVEX, a reason of the ignore file that is not one of
+// them is the impact statement
+var vexJustifications = map[string]bool{
+	"component_not_present":                             true,
+	"vulnerable_code_not_present":                       true,
+	"vulnerable_code_not_in_execute_path":               true,
+	"vulnerable_code_cannot_be_controlled_by_adversary": true,
+	"inline_mitigations_already_exist":                  true,
+}
+
+type openVEXOutput struct {
+	Context    string              `json:"@context"`
+	ID         string              `json:"@id"`
+	Author     string              `json:"author"`
+	Timestamp  string              `json:"timestamp,omitempty"`
+	Version    int                 `json:"version"`
+	Tooling    string              `json:"tooling"`
+	Statements []*openVEXStatement `json:"statements"`
+}
+
+type openVEXStatement struct {
+	Vulnerability struct {
+		Name    string   `json:"name"`
+		Aliases []string `json:"aliases,omitempty"`
+	} `json:"vulnerability"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Products  []struct {
+		ID string `json:"@id"`
+	} `json:"products"`
+	Status          string `json:"status"`
+	Justification   string `json:"justification,omitempty"`
+	ImpactStatement string `json:"impact_statement,omitempty"`
+}
+
+// WriteVEX returns the OpenVEX document of the vulnerabilities of the image removed by the ignore file, a
+// not_affected statement of each, with the reason of the file as the justification. The document is the same
+// for the same image, database and ignore file, so it can be kept in git: the statements are sorted, the
+// timestamp is the build time of the database, or the creation time of the image, and the ID is of the content.
+func WriteVEX(report *ScanReport) ([]byte, error) {
+	product := ImagePurl(report)
+	if product == "" {
+		return nil, fmt.Errorf("The image has no digest")
+	}
+	var timestamp string
+	if report.Provenance != nil {
+		if t, err := time.Parse(time.RFC3339, report.Provenance.CVEDBCreateTime); err == nil {
+			timestamp = t.UTC().Format(time.RFC3339)
+		}
+	}
+	if timestamp == "" {
+		timestamp = report.ImageCreated
+	}
+
+	// a statement of each vulnerability, the findings of its packages share it
+	byName := make(map[string]*openVEXStatement)
+	for _, f := range report.Ignored {
+		v := f.Vulnerability
+		if _, ok := byName[v.Name]; ok {
+			continue
+		}
+		st := &openVEXStatement{Timestamp: timestamp, Status: VEXNotAffected}
+		st.Vulnerability.Name = v.Name
+		seen := map[string]bool{v.Name: true}
+		for _, id := range append(append([]string{}, v.CVEs...), report.Aliases[v.DBKey]...) {
+			if !seen[id] {
+				seen[id] = true
+				st.Vulnerability.Aliases = append(st.Vulnerability.Aliases, id)
+			}
+		}
+		sort.Strings(st.Vulnerability.Aliases)
+		st.Products = append(st.Products, struct {
+			ID string `json:"@id"`
+		}{product})
+		switch {
+		case vexJustifications[f.Reason]:
+			st.Justification = f.Reason
+		case f.Reason != "":
+			st.ImpactStatement = f.Reason
+		default:
+			st.ImpactStatement = "Ignored by the ignore file of the scanner, no reason given"
+		}
+		byName[v.Name] = st
+	}
+	doc := &openVEXOutput{
+		Context: "https://openvex.dev/ns/v0.2.0", Author: "NeuVector scanner", Timestamp: timestamp, Version: 1,
+		Tooling: "NeuVector scanner", Statements: make([]*openVEXStatement, 0, len(byName)),
+	}
+	for _, st := range byName {
+		doc.Statements = append(doc.Statements, st)
+	}
+	sort.Slice(doc.Statements, func(i, j int) bool {
+		return doc.Statements[i].Vulnerability.Name < doc.Statements[j].Vulnerability.Name
+	})
+
+	// the ID is a UUID of the hash of the document without it
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	doc.ID = fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// ImagePurl returns the oci purl of the image by its digest, or by its ID without one, empty if it has neither
+func ImagePurl(report *ScanReport) string {
+	digest := report.Digest
+	if digest == "" && report.ImageID != "" {
+		digest = "sha256:" + strings.TrimPrefix(report.ImageID, "sha256:")
+	}
+	if digest == "" {
+		return ""
+	}
+	repo := report.Repository
+	purl := fmt.Sprintf("pkg:oci/%s@%s", repo[strings.LastIndex(repo, "/")+1:], strings.Replace(digest, ":", "%3A", 1))
+	q := url.Values{}
+	if host := registryHost(report.Registry); host != "" && repo != "" {
+		q.Set("repository_url", host+"/"+repo)
+	}
+	if report.Tag != "" {
+		q.Set("tag", report.Tag)
+	}
+	if len(q) > 0 {
+		purl += "?" + q.Encode()
+	}
+	return purl
+}
+
+// registryHost returns the host of the registry URL, like https://registry.corp:5000/
+func registryHost(registry string) string {
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return strings.TrimSuffix(registry, "/")
+}
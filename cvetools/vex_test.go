@@ -0,0 +1,218 @@
+package cvetools
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+func TestVEX(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vex")
+	defer os.RemoveAll(dir)
+
+	// v0.2.0 with the product objects, and v0.0.1 with the strings and the subcomponents of the statement
+	doc := `{"@context": "https://openvex.dev/ns/v0.2.0", "statements": [
+		{"vulnerability": {"name": "GHSA-35jh-r3h4-6jhm"}, "products": [{"@id": "pkg:oci/app@sha256%3A0123", "subcomponents": [{"@id": "pkg:npm/lodash@4.17.15"}]}],
+		 "status": "not_affected", "justification": "vulnerable_code_not_in_execute_path"},
+		{"vulnerability": {"name": "CVE-2020-8203"}, "products": [{"@id": "pkg:npm/lodash"}], "status": "under_investigation"},
+		{"vulnerability": {"name": "CVE-2022-0001"}, "products": [{"@id": "sha256:0123"}], "status": "fixed"}]}`
+	old := `{"@context": "https://openvex.dev/ns", "statements": [
+		{"vulnerability": "CVE-2022-0001", "products": ["pkg:docker/library/app@1.0"], "status": "affected", "action_statement": "upgrade"},
+		{"vulnerability": "CVE-2022-0002", "products": ["pkg:docker/app@1.0"], "subcomponents": ["pkg:deb/debian/openssl@1.1"], "status": "not_affected", "impact_statement": "not used"}]}`
+	ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(doc), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.json"), []byte(old), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "readme.txt"), []byte("not a document"), 0644)
+	statements, err := LoadVEX([]string{dir})
+	if err != nil || len(statements) != 5 {
+		t.Fatalf("Failed to load the VEX documents: %v", err)
+	}
+	if p := statements[4].Products[0]; p.ID != "pkg:docker/app@1.0" || len(p.Subcomponents) != 1 {
+		t.Errorf("Incorrect product: %+v", p)
+	}
+
+	vuls := []*share.ScanVulnerability{
+		{Name: "CVE-2021-23337", DBKey: "apps:CVE-2021-23337", PackageName: "lodash", PackageVersion: "4.17.15"},
+		{Name: "CVE-2020-8203", PackageName: "lodash", PackageVersion: "4.17.15"},
+		{Name: "CVE-2022-0001", PackageName: "openssl", PackageVersion: "1.1"},
+		{Name: "CVE-2022-0002", PackageName: "openssl", PackageVersion: "1.1"},
+		{Name: "CVE-2022-0002", PackageName: "zlib", PackageVersion: "1.2"},
+	}
+	modules := []*share.ScanModule{
+		{Name: "lodash", Version: "4.17.15", Source: "node.js"},
+		{Name: "openssl", Version: "1.1", Source: "debian:11"},
+		{Name: "zlib", Version: "1.2", Source: "debian:11"},
+	}
+	report := &ScanReport{
+		ScanResult: &share.ScanResult{
+			Registry: "https://registry-1.docker.io/", Repository: "library/app", Tag: "1.0", Digest: "sha256:0123", Vuls: vuls, Modules: modules,
+		},
+		Aliases: map[string][]string{"apps:CVE-2021-23337": {"GHSA-35jh-r3h4-6jhm"}},
+	}
+	report.Layers = []*share.ScanLayerResult{{Vuls: append([]*share.ScanVulnerability(nil), vuls...)}}
+	cv := &CveTools{}
+	cv.SetVEX(statements)
+	cv.PostProcess(report)
+
+	// by the alias in the image, and the subcomponent of the statement; the later affected statement wins
+	if len(report.Vuls) != 3 || len(report.Layers[0].Vuls) != 3 || len(report.VEXSuppressed) != 2 {
+		t.Fatalf("Incorrect suppressed vulnerabilities: %+v", report.Vuls)
+	}
+	if f := report.VEXSuppressed[0]; f.Vulnerability.Name != "CVE-2021-23337" || f.Status != VEXNotAffected || f.Justification != "vulnerable_code_not_in_execute_path" {
+		t.Errorf("Incorrect finding: %+v", f)
+	}
+	if f := report.VEXSuppressed[1]; f.Vulnerability.PackageName != "openssl" || f.Impact != "not used" || filepath.Base(f.Document) != "b.json" {
+		t.Errorf("Incorrect finding: %+v", f)
+	}
+
+	// another image
+	report = &ScanReport{ScanResult: &share.ScanResult{Repository: "other", Tag: "1.0", Digest: "sha256:4567", Vuls: vuls[:1]}}
+	cv.PostProcess(report)
+	if len(report.Vuls) != 1 || len(report.VEXSuppressed) != 0 {
+		t.Errorf("Unexpected suppressed vulnerabilities: %+v", report.VEXSuppressed)
+	}
+
+	// the purls without a digest are of the registry, the repository and the tag
+	image := &ScanReport{ScanResult: &share.ScanResult{Registry: "https://registry.corp:5000/", Repository: "team/nginx", Tag: "1.25"}}
+	for id, expect := range map[string]bool{
+		"pkg:oci/nginx?repository_url=registry.corp:5000/team/nginx&tag=1.25": true,
+		"pkg:oci/nginx?repository_url=registry.corp:5000/evil/nginx&tag=1.25": false,
+		"pkg:oci/nginx?repository_url=other.corp/team/nginx&tag=1.25":         false,
+		"pkg:oci/nginx?repository_url=registry.corp:5000/team/nginx":          false,
+		"pkg:oci/nginx?tag=1.25": false,
+		"pkg:docker/team/nginx@1.25?repository_url=registry.corp:5000": true,
+		"pkg:docker/team/nginx@1.25":                                   false,
+		"pkg:docker/team/nginx?repository_url=registry.corp:5000":      false,
+	} {
+		if isImageProduct(image, id) != expect {
+			t.Errorf("Incorrect image product %s: expect %v", id, expect)
+		}
+	}
+
+	// the purl type is the one of the ecosystem of the package
+	types := modulePurlTypes(modules)
+	for id, expect := range map[string]bool{
+		"pkg:npm/lodash@4.17.15": true, "pkg:pypi/lodash": false, "pkg:deb/debian/lodash": false,
+	} {
+		if isPackageProduct(vuls[0], types.of(vuls[0]), id) != expect {
+			t.Errorf("Incorrect package product %s: expect %v", id, expect)
+		}
+	}
+	if typ := types.of(vuls[2]); typ != "deb" || modulePurlType("centos:7") != "rpm" || modulePurlType("nginx") != "generic" {
+		t.Errorf("Incorrect purl types: %s", typ)
+	}
+
+	// the latest statement wins, not the last one
+	newer := `{"@context": "https://openvex.dev/ns/v0.2.0", "timestamp": "2024-02-01T00:00:00Z", "statements": [
+		{"vulnerability": {"name": "CVE-2022-0003"}, "products": [{"@id": "sha256:0123"}], "status": "fixed"}]}`
+	older := `{"@context": "https://openvex.dev/ns/v0.2.0", "timestamp": "2024-03-01T00:00:00Z", "statements": [
+		{"vulnerability": {"name": "CVE-2022-0003"}, "products": [{"@id": "sha256:0123"}], "status": "affected", "timestamp": "2024-01-01T00:00:00Z"}]}`
+	ioutil.WriteFile(filepath.Join(dir, "newer.json"), []byte(newer), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "older.json"), []byte(older), 0644)
+	statements, err = LoadVEX([]string{filepath.Join(dir, "newer.json"), filepath.Join(dir, "older.json")})
+	if err != nil || len(statements) != 2 {
+		t.Fatalf("Failed to load the VEX documents: %v", err)
+	}
+	cv.SetVEX(statements)
+	report = &ScanReport{ScanResult: &share.ScanResult{Digest: "sha256:0123", Vuls: []*share.ScanVulnerability{{Name: "CVE-2022-0003"}}}}
+	cv.PostProcess(report)
+	if len(report.VEXSuppressed) != 1 || report.VEXSuppressed[0].Status != VEXFixed {
+		t.Errorf("Incorrect statement by the timestamps: %+v", report.Vuls)
+	}
+
+	// the invalid documents fail the load
+	for _, bad := range []string{
+		`{"@context": "https://openvex.dev/ns/v0.2.0", "statements": [`,
+		`{"document": {"csaf_version": "2.0"}}`,
+		`{"@context": "https://openvex.dev/ns/v0.2.0", "statements": [{"vulnerability": {"name": "CVE-1"}, "products": [{"@id": "sha256:0123"}], "status": "not_affected"}]}`,
+		`{"@context": "https://openvex.dev/ns/v0.2.0", "statements": [{"vulnerability": {"name": "CVE-1"}, "products": [{"@id": "sha256:0123"}], "status": "ignored"}]}`,
+		`{"@context": "https://openvex.dev/ns/v0.2.0", "statements": [{"vulnerability": {"name": "CVE-1"}, "status": "fixed"}]}`,
+		`{"@context": "https://openvex.dev/ns/v0.2.0", "timestamp": "yesterday", "statements": []}`,
+	} {
+		file := filepath.Join(dir, "bad.json")
+		ioutil.WriteFile(file, []byte(bad), 0644)
+		if _, err := LoadVEX([]string{file}); err == nil {
+			t.Errorf("Invalid document loaded: %s", bad)
+		}
+	}
+	if _, err := LoadVEX([]string{filepath.Join(dir, "missing.json")}); err == nil {
+		t.Errorf("Missing document loaded")
+	}
+}
+
+func TestWriteVEX(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "vex")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ignore")
+	ioutil.WriteFile(file, []byte("root-user\nGHSA-35jh-r3h4-6jhm vulnerable_code_not_in_execute_path # lodash\nCVE-2020-8203  only in the tests\nCVE-2022-0001\n"), 0644)
+	ids, reasons, err := LoadIgnoreFile(file)
+	if err != nil || len(ids) != 4 || len(reasons) != 2 || reasons["CVE-2020-8203"] != "only in the tests" {
+		t.Fatalf("Incorrect ignore file: %v %+v", ids, reasons)
+	}
+	cv := &CveTools{}
+	cv.SetIgnored(ids)
+	cv.SetIgnoreReasons(reasons)
+
+	scan := func() *ScanReport {
+		report := &ScanReport{
+			ScanResult: &share.ScanResult{Registry: "https://registry.corp:5000/", Repository: "team/app", Tag: "1.0", Digest: "sha256:0123", Vuls: []*share.ScanVulnerability{
+				{Name: "CVE-2022-0001", PackageName: "openssl"},
+				{Name: "CVE-2022-0001", PackageName: "libssl"},
+				{Name: "CVE-2021-23337", DBKey: "apps:CVE-2021-23337", PackageName: "lodash"},
+				{Name: "CVE-2020-8203", PackageName: "lodash"},
+				{Name: "CVE-2022-0002", PackageName: "zlib"},
+			}},
+			Provenance: &ScanProvenance{CVEDBCreateTime: "2022-01-02T00:00:00Z", StartedAt: time.Now().String()},
+			Aliases:    map[string][]string{"apps:CVE-2021-23337": {"GHSA-35jh-r3h4-6jhm"}},
+		}
+		cv.PostProcess(report)
+		return report
+	}
+	report := scan()
+	if len(report.Vuls) != 1 || len(report.Ignored) != 4 || report.Ignored[2].ID != "GHSA-35JH-R3H4-6JHM" {
+		t.Fatalf("Incorrect ignored findings: %+v", report.Ignored)
+	}
+	data, err := WriteVEX(report)
+	if err != nil {
+		t.Fatalf("Failed to write the VEX document: %v", err)
+	}
+	if again, _ := WriteVEX(scan()); !bytes.Equal(data, again) {
+		t.Errorf("The document is not deterministic:\n%s\n%s", data, again)
+	}
+
+	// a statement of each vulnerability, by the image purl, with the justification or the impact statement
+	statements, err := parseVEX(data, "out.json")
+	if err != nil || len(statements) != 3 {
+		t.Fatalf("Invalid VEX document: %v\n%s", err, data)
+	}
+	expect := []struct{ name, justification, impact string }{
+		{"CVE-2020-8203", "", "only in the tests"},
+		{"CVE-2021-23337", "vulnerable_code_not_in_execute_path", ""},
+		{"CVE-2022-0001", "", "Ignored by the ignore file of the scanner, no reason given"},
+	}
+	for i, st := range statements {
+		if st.Vulnerability != expect[i].name || st.Justification != expect[i].justification || st.Impact != expect[i].impact {
+			t.Errorf("Incorrect statement: %+v", st)
+		}
+	}
+	if p := statements[0].Products[0].ID; p != "pkg:oci/app@sha256%3A0123?repository_url=registry.corp%3A5000%2Fteam%2Fapp&tag=1.0" {
+		t.Errorf("Incorrect product: %s", p)
+	}
+	if a := statements[1].Aliases; len(a) != 1 || a[0] != "GHSA-35jh-r3h4-6jhm" {
+		t.Errorf("Incorrect aliases: %v", a)
+	}
+
+	// the document suppresses the same findings
+	report = &ScanReport{ScanResult: &share.ScanResult{Repository: "team/app", Digest: "sha256:0123", Vuls: []*share.ScanVulnerability{
+		{Name: "CVE-2022-0001", PackageName: "openssl"}, {Name: "CVE-2022-0002", PackageName: "zlib"},
+	}}}
+	applyVEX(report, statements)
+	if len(report.Vuls) != 1 || len(report.VEXSuppressed) != 1 {
+		t.Errorf("Incorrect suppressed findings: %+v", report.VEXSuppressed)
+	}
+}
@@ -0,0 +1,262 @@
+package cvetools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/neuvector/share/utils"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/detectors"
+)
+
+// the decisions of the scan on a vulnerability for a package of the image
+const (
+	DecisionReported    = "reported"
+	DecisionFixed       = "fixed"          // the installed version is the fixed version or later
+	DecisionNotAffected = "not-affected"   // the installed version is out of the affected range
+	DecisionIgnored     = "ignored"        // matched, removed by the ignore file
+	DecisionVEX         = "vex-suppressed" // matched, removed by a VEX statement
+	DecisionDropped     = "not-reported"   // matched, removed after the matching, like by a post-processor
+)
+
+// MatchDecision is why a vulnerability was or wasn't reported for a package of the image, by a record of the
+// database for the package
+type MatchDecision struct {
+	Package  string `json:"Package"`
+	Version  string `json:"Version"`
+	Source   string `json:"Source"` // the OS namespace or the application of the package
+	Record   string `json:"Record"` // the name of the vulnerability in the database, the ID or one having it as alias
+	Affected string `json:"Affected"`
+	Fixed    string `json:"Fixed,omitempty"`
+	Decision string `json:"Decision"`
+	Reason   string `json:"Reason"`
+}
+
+// ExplainMatch matches the packages of the report against the records of the vulnerability id in the database
+// of the scans, with the matching of the scans, and tells for each package having a record what was decided.
+// The vulnerability is found by its name, its CVEs or its aliases. The packages without a record of it are not
+// listed, an empty list means no package of the image is in the records.
+func (cv *CveTools) ExplainMatch(report *ScanReport, id string) ([]*MatchDecision, error) {
+	if report == nil || report.ScanResult == nil {
+		return nil, nil
+	}
+	cv.UpdateMux.RLock()
+	defer cv.UpdateMux.RUnlock()
+	h := cv.scanDB()
+
+	// the OS packages of the image namespace, or of another OS the packages were matched with
+	osModules := make(map[string][]*share.ScanModule)
+	var appModules []*share.ScanModule
+	for _, m := range report.Modules {
+		if m.Source == report.Namespace || releaseRegexp.MatchString(m.Source) {
+			osModules[m.Source] = append(osModules[m.Source], m)
+		} else {
+			appModules = append(appModules, m)
+		}
+	}
+
+	var decisions []*MatchDecision
+	namespaces := make([]string, 0, len(osModules))
+	for ns := range osModules {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		nsName, db := os2DB(ns)
+		if db == common.DBMax {
+			continue
+		}
+		tables, err := h.osTables(db)
+		if err != nil {
+			return nil, err
+		}
+		var records []common.VulShort
+		for _, v := range tables.short {
+			if strings.EqualFold(v.Name, id) || fullHasID(tables.full[fmt.Sprintf("%s:%s", v.Namespace, v.Name)], id) {
+				records = append(records, v)
+			}
+		}
+		mv := makeFeatureMap(records, nsName)
+		for _, m := range osModules[ns] {
+			decisions = append(decisions, explainOSModule(report, m, mv, nsName)...)
+		}
+	}
+
+	if len(appModules) > 0 {
+		modVuls, err := h.appVuls()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range appModules {
+			mv, found := modVuls[m.Name]
+			if !found && log4jComponents.Contains(m.Name) {
+				mv = modVuls[log4jModName]
+			}
+			for _, v := range mv {
+				if strings.EqualFold(v.VulName, id) || hasID(v.Aliases, id) {
+					decisions = append(decisions, explainAppModule(report, m, v))
+				}
+			}
+		}
+	}
+	return decisions, nil
+}
+
+func fullHasID(v common.VulFull, id string) bool {
+	return hasID(v.CVEs, id) || hasID(v.Aliases, id)
+}
+
+func hasID(ids []string, id string) bool {
+	for _, other := range ids {
+		if strings.EqualFold(other, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// explainOSModule decides each record of the OS package by searchAffectedFeature, a record at a time
+func explainOSModule(report *ScanReport, m *share.ScanModule, mv map[string][]common.VulShort, namespace string) []*MatchDecision {
+	name := m.Name
+	if a := strings.Index(name, "/"); a > 0 {
+		name = name[:a]
+	}
+	if val, ok := aliasMap[name]; ok {
+		name = val
+	}
+	featName := fmt.Sprintf("%s:%s", namespace, name)
+	ver, err := utils.NewVersion(m.Version)
+	if err != nil {
+		return nil
+	}
+	ft := detectors.FeatureVersion{Package: m.Name, Version: ver}
+	if len(m.CPEs) > 0 {
+		ft.CPEs = utils.NewSet()
+		for _, cpe := range m.CPEs {
+			ft.CPEs.Add(cpe)
+		}
+	}
+
+	var decisions []*MatchDecision
+	for _, v := range mv[featName] {
+		fix := v.Fixin[0]
+		d := &MatchDecision{Package: m.Name, Version: m.Version, Source: m.Source, Record: v.Name}
+		d.Affected, d.Fixed = RecordRange(fix.Version, fix.MinVer)
+		if affected, _ := searchAffectedFeature(map[string][]common.VulShort{featName: {v}}, namespace, ft); len(affected) > 0 {
+			d.Decision, d.Reason = reportedDecision(report, v.Name, m)
+		} else {
+			d.Decision, d.Reason = osUnaffectedReason(ft, v)
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+// RecordRange is the affected range and the fixed version of a fixed-in entry of an OS record, #MAXV# has no fix
+// and #MINV# is not affected
+func RecordRange(version, minVer string) (string, string) {
+	switch version {
+	case "#MAXV#":
+		if minVer != "" {
+			return ">=" + minVer, ""
+		}
+		return "all", ""
+	case "#MINV#":
+		return "none", ""
+	}
+	if minVer != "" {
+		return fmt.Sprintf(">=%s <%s", minVer, version), version
+	}
+	return "<" + version, version
+}
+
+// osUnaffectedReason tells which check of searchAffectedFeature the package didn't pass
+func osUnaffectedReason(ft detectors.FeatureVersion, v common.VulShort) (string, string) {
+	fix := v.Fixin[0]
+	if _, ok := overrideMap[v.Name]; ok {
+		return DecisionNotAffected, "out of the affected window the scanner overrides the record with"
+	}
+	if v.CPEs != nil && ft.CPEs != nil && ft.CPEs.Cardinality() > 0 {
+		match := false
+		for _, cpe := range v.CPEs {
+			match = match || ft.CPEs.Contains(cpe)
+		}
+		if !match {
+			return DecisionNotAffected, "the CPEs of the package are not of the record"
+		}
+	}
+	if fix.Version == "#MINV#" {
+		return DecisionNotAffected, "the database has the namespace not affected"
+	} else if fix.Version != "#MAXV#" {
+		if fixVer, err := utils.NewVersion(fix.Version); err != nil {
+			return DecisionNotAffected, fmt.Sprintf("the fixed version %s can't be parsed", fix.Version)
+		} else if ft.Version.Compare(fixVer) >= 0 {
+			return DecisionFixed, fmt.Sprintf("%s is the fixed version %s or later", ft.Version.String(), fix.Version)
+		}
+	}
+	if minVer, err := utils.NewVersion(fix.MinVer); fix.MinVer != "" && err == nil && ft.Version.Compare(minVer) < 0 {
+		return DecisionNotAffected, fmt.Sprintf("%s is earlier than the affected %s", ft.Version.String(), fix.MinVer)
+	}
+	return DecisionNotAffected, "the versions of the package and the record are not compared, like an upstream version or another major version"
+}
+
+// explainAppModule decides the record of the application module by checkForVulns
+func explainAppModule(report *ScanReport, m *share.ScanModule, v common.AppModuleVul) *MatchDecision {
+	app := detectors.AppFeatureVersion{AppPackage: scan.AppPackage{AppName: m.Source, ModuleName: m.Name, Version: m.Version}}
+	d := &MatchDecision{Package: m.Name, Version: m.Version, Source: m.Source, Record: v.VulName}
+	d.Affected = ModuleVersions(v.AffectedVer)
+	if len(v.UnaffectedVer) > 0 {
+		d.Affected = strings.TrimPrefix(d.Affected+", not "+ModuleVersions(v.UnaffectedVer), ", ")
+	}
+	d.Fixed = ModuleVersions(v.FixedVer)
+	if vuls := checkForVulns(app, 0, []detectors.AppFeatureVersion{app}, []common.AppModuleVul{v}); len(vuls) > 0 {
+		d.Decision, d.Reason = reportedDecision(report, v.VulName, m)
+	} else if len(v.UnaffectedVer) > 0 && compareAppVersion(m.Version, v.UnaffectedVer) {
+		d.Decision, d.Reason = DecisionNotAffected, fmt.Sprintf("%s is of the unaffected versions", m.Version)
+	} else if len(v.FixedVer) > 0 && compareAppVersion(m.Version, v.FixedVer) {
+		d.Decision, d.Reason = DecisionFixed, fmt.Sprintf("%s is of the fixed versions", m.Version)
+	} else {
+		d.Decision, d.Reason = DecisionNotAffected, fmt.Sprintf("%s is out of the affected versions", m.Version)
+	}
+	return d
+}
+
+// ModuleVersions writes the versions of an application record with the operators, like moduleVer2FixVer
+func ModuleVersions(versions []common.AppModuleVersion) string {
+	list := make([]string, len(versions))
+	for i, v := range versions {
+		op := strings.Replace(v.OpCode, "or", "||", -1)
+		op = strings.Replace(op, "gt", ">", -1)
+		op = strings.Replace(op, "lt", "<", -1)
+		op = strings.Replace(op, "eq", "=", -1)
+		list[i] = op + v.Version
+	}
+	return strings.Join(list, ";")
+}
+
+// reportedDecision finds the matched vulnerability of the package in the report, in the findings or in the ones
+// the ignore file or a VEX statement removed
+func reportedDecision(report *ScanReport, name string, m *share.ScanModule) (string, string) {
+	same := func(v *share.ScanVulnerability) bool {
+		return v.Name == name && v.PackageName == m.Name && v.PackageVersion == m.Version
+	}
+	for _, v := range report.Vuls {
+		if same(v) {
+			return DecisionReported, fmt.Sprintf("%s is affected, %s", m.Version, v.Severity)
+		}
+	}
+	for _, f := range report.Ignored {
+		if same(f.Vulnerability) {
+			return DecisionIgnored, strings.TrimSuffix(fmt.Sprintf("ignored by %s, %s", f.ID, f.Reason), ", ")
+		}
+	}
+	for _, f := range report.VEXSuppressed {
+		if same(f.Vulnerability) {
+			return DecisionVEX, fmt.Sprintf("%s by %s", f.Status, f.Document)
+		}
+	}
+	return DecisionDropped, fmt.Sprintf("%s is affected, the finding was removed after the matching", m.Version)
+}
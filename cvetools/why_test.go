@@ -0,0 +1,79 @@
+package cvetools
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/common"
+)
+
+func TestExplainMatch(t *testing.T) {
+	dir := t.TempDir()
+	var shorts, fulls []byte
+	for _, v := range []common.VulShort{
+		{Name: "CVE-2023-0001", Namespace: "debian:11", Fixin: []common.FeaShort{{Name: "openssl", Version: "1.2"}, {Name: "zlib", Version: "1.2"}}},
+		{Name: "CVE-2023-0001", Namespace: "debian:11", Fixin: []common.FeaShort{{Name: "curl", Version: "#MAXV#", MinVer: "7.80"}}},
+		{Name: "CVE-2023-0002", Namespace: "debian:11", Fixin: []common.FeaShort{{Name: "openssl", Version: "1.2"}}},
+	} {
+		short, _ := json.Marshal(v)
+		full, _ := json.Marshal(common.VulFull{Name: v.Name, Namespace: v.Namespace, Aliases: []string{"GHSA-" + v.Name[4:]}})
+		shorts, fulls = append(append(shorts, short...), '\n'), append(append(fulls, full...), '\n')
+	}
+	app, _ := json.Marshal(common.AppModuleVul{
+		VulName: "GHSA-aaaa-bbbb-cccc", AppName: "npm", ModuleName: "lodash", Aliases: []string{"CVE-2023-0001"},
+		AffectedVer: []common.AppModuleVersion{{OpCode: "lt", Version: "4.17.21"}}, FixedVer: []common.AppModuleVersion{{OpCode: "gteq", Version: "4.17.21"}},
+	})
+	ioutil.WriteFile(filepath.Join(dir, "debian_index.tb"), shorts, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "debian_full.tb"), fulls, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "apps.tb"), append(app, '\n'), 0644)
+	cv := NewCveTools("", nil)
+	cv.TbPath = dir
+	cv.SwapDB("1.000", "2022-01-02T00:00:00Z")
+
+	report := &ScanReport{ScanResult: &share.ScanResult{
+		Namespace: "debian:11",
+		Modules: []*share.ScanModule{
+			{Name: "openssl", Version: "1.1", Source: "debian:11"},
+			{Name: "zlib", Version: "1.2.1", Source: "debian:11"},
+			{Name: "curl", Version: "7.74", Source: "debian:11"},
+			{Name: "bash", Version: "5.1", Source: "debian:11"},
+			{Name: "lodash", Version: "4.17.15", Source: "npm"},
+			{Name: "lodash", Version: "4.17.21", Source: "npm"},
+		},
+		Vuls: []*share.ScanVulnerability{{Name: "CVE-2023-0001", PackageName: "openssl", PackageVersion: "1.1", Severity: "High"}},
+	}}
+	report.Ignored = []*IgnoredFinding{{
+		Vulnerability: &share.ScanVulnerability{Name: "GHSA-aaaa-bbbb-cccc", PackageName: "lodash", PackageVersion: "4.17.15"},
+		ID:            "CVE-2023-0001", Reason: "not reachable",
+	}}
+
+	decisions, err := cv.ExplainMatch(report, "cve-2023-0001")
+	if err != nil {
+		t.Fatalf("Failed to explain: %v", err)
+	}
+	expect := []struct{ pkg, version, record, decision, reason string }{
+		{"openssl", "1.1", "CVE-2023-0001", DecisionReported, "1.1 is affected, High"},
+		{"zlib", "1.2.1", "CVE-2023-0001", DecisionFixed, "1.2.1 is the fixed version 1.2 or later"},
+		{"curl", "7.74", "CVE-2023-0001", DecisionNotAffected, "7.74 is earlier than the affected 7.80"},
+		{"lodash", "4.17.15", "GHSA-aaaa-bbbb-cccc", DecisionIgnored, "ignored by CVE-2023-0001, not reachable"},
+		{"lodash", "4.17.21", "GHSA-aaaa-bbbb-cccc", DecisionFixed, "4.17.21 is of the fixed versions"},
+	}
+	if len(decisions) != len(expect) {
+		t.Fatalf("Incorrect decisions: %d", len(decisions))
+	}
+	for i, e := range expect {
+		d := decisions[i]
+		if d.Package != e.pkg || d.Version != e.version || d.Record != e.record || d.Decision != e.decision || d.Reason != e.reason {
+			t.Errorf("Incorrect decision %d: %+v", i, d)
+		}
+	}
+
+	// by the alias of the OS record, the module removed after the matching
+	report.Vuls = nil
+	if decisions, _ = cv.ExplainMatch(report, "GHSA-2023-0002"); len(decisions) != 1 || decisions[0].Decision != DecisionDropped {
+		t.Errorf("Incorrect decisions by the alias: %+v", decisions)
+	}
+}
@@ -0,0 +1,255 @@
+package cvetools
+
+import (
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+// ErrInsufficientDisk rejects a scan when the image working path is short of space
+var ErrInsufficientDisk = errors.New("Insufficient disk space")
+
+// DiskExpansionFactor estimates the scratch space of an image extracted in full, with FullExtraction, from its
+// compressed layer sizes
+var DiskExpansionFactor float64 = DefaultDiskExpansionFactor
+
+const DefaultDiskExpansionFactor = 3.0
+
+// CleanupRetries is the number of times a folder of the image working path is removed again when the removal
+// fails, like while files are briefly busy on a network or overlay file system
+var CleanupRetries int = DefaultCleanupRetries
+
+// CleanupBackoff is the wait before the first retry of a removal, doubled at each retry
+var CleanupBackoff time.Duration = DefaultCleanupBackoff
+
+const DefaultCleanupRetries = 3
+const DefaultCleanupBackoff = time.Millisecond * 200
+
+// removeAll is replaced by the tests to fail the removals
+var removeAll = os.RemoveAll
+
+// MinFreeSpace is the minimum free space in bytes under the image working path to accept a scan, 0 to skip the check
+var MinFreeSpace uint64
+
+var (
+	metricCleanups       = expvar.NewInt("scan_cleanups")
+	metricCleanupErrors  = expvar.NewInt("scan_cleanup_errors")
+	metricCleanupRetries = expvar.NewInt("scan_cleanup_retries")
+	metricSweptPaths     = expvar.NewInt("scan_swept_paths")
+	metricRejectedScans  = expvar.NewInt("scan_rejected_insufficient_disk")
+	metricFreeSpace      = expvar.NewInt("image_path_free_bytes")
+)
+
+// image folders of the scans in progress, which the sweeper must not touch
+var activePaths utils.Set = utils.NewSet()
+var activeMutex sync.Mutex
+
+func addActivePath(path string) {
+	activeMutex.Lock()
+	activePaths.Add(path)
+	activeMutex.Unlock()
+}
+
+func isActivePath(path string) bool {
+	activeMutex.Lock()
+	defer activeMutex.Unlock()
+	return activePaths.Contains(path)
+}
+
+// RemoveImagePath removes the working data of a scan
+func RemoveImagePath(path string) {
+	if path == "" {
+		return
+	}
+
+	activeMutex.Lock()
+	activePaths.Remove(path)
+	activeMutex.Unlock()
+
+	if err := removeAllRetry(path); err != nil {
+		metricCleanupErrors.Add(1)
+		log.WithFields(log.Fields{"error": err, "path": path, "retries": CleanupRetries}).Error("Failed to remove image path")
+		return
+	}
+	metricCleanups.Add(1)
+}
+
+// removeAllRetry removes the path, and retries with a doubling backoff up to CleanupRetries times if it fails
+func removeAllRetry(path string) error {
+	backoff := CleanupBackoff
+	err := removeAll(path)
+	for i := 0; err != nil && i < CleanupRetries; i++ {
+		metricCleanupRetries.Add(1)
+		log.WithFields(log.Fields{"error": err, "path": path, "retry": i + 1}).Debug("Retry to remove")
+		time.Sleep(backoff)
+		backoff *= 2
+		err = removeAll(path)
+	}
+	return err
+}
+
+// ResetImagePath removes all the folders left under the image working path, by a previous run that didn't exit
+// cleanly, and creates the path again
+func ResetImagePath() error {
+	if err := removeAllRetry(ImageWorkingPath); err != nil {
+		metricCleanupErrors.Add(1)
+		return err
+	}
+	return os.MkdirAll(ImageWorkingPath, 0755)
+}
+
+// FreeSpace returns the available space in bytes of the file system holding the image working path
+func FreeSpace() (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(ImageWorkingPath, &st); err != nil {
+		return 0, err
+	}
+	free := st.Bavail * uint64(st.Bsize)
+	metricFreeSpace.Set(int64(free))
+	return free, nil
+}
+
+// CheckFreeSpace returns ErrInsufficientDisk if the free space is below MinFreeSpace
+func CheckFreeSpace() error {
+	if MinFreeSpace == 0 {
+		return nil
+	}
+
+	free, err := FreeSpace()
+	if err != nil {
+		// not to block the scan if the file system can't be read
+		log.WithFields(log.Fields{"error": err, "path": ImageWorkingPath}).Error("Failed to read free space")
+		return nil
+	}
+	if free < MinFreeSpace {
+		metricRejectedScans.Add(1)
+		log.WithFields(log.Fields{"free": free, "min": MinFreeSpace}).Error("Insufficient disk space, reject the scan")
+		return ErrInsufficientDisk
+	}
+	return nil
+}
+
+// workFile returns an unlinked temporary file under the image working path, to spool the data of a layer that
+// is not kept in memory; its space is freed when it is closed. It is never created in the system temp folder,
+// a tmpfs in many containers, where it would take the memory instead of the disk of the working path.
+func workFile(prefix string) (*os.File, error) {
+	f, err := ioutil.TempFile(ImageWorkingPath, prefix)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(ImageWorkingPath, 0755); err == nil {
+			f, err = ioutil.TempFile(ImageWorkingPath, prefix)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	return f, nil
+}
+
+// estimateScratchSpace estimates the bytes needed to download and extract the layers. The streamed layers only
+// write the files the scan reads, or the blob that is not a tar, so they take up to their compressed size.
+func estimateScratchSpace(sizes map[string]int64) int64 {
+	if DiskExpansionFactor <= 0 {
+		return 0
+	}
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	if !FullExtraction {
+		return total
+	}
+	return int64(float64(total) * DiskExpansionFactor)
+}
+
+// ImagePathUsageMaxAge is how long the usage of the image working path is kept before ImagePathUsage walks the
+// path again, the interval of the periodic sweep, which measures it too
+var ImagePathUsageMaxAge = time.Minute * 10
+
+var imagePathUsage struct {
+	sync.Mutex
+	bytes    int64
+	measured time.Time
+}
+
+// ImagePathUsage returns the bytes used under the image working path by the downloaded layers, as measured
+// within ImagePathUsageMaxAge, so the metrics and the scanner info don't walk the path at each read
+func ImagePathUsage() int64 {
+	imagePathUsage.Lock()
+	defer imagePathUsage.Unlock()
+	if imagePathUsage.measured.IsZero() || time.Since(imagePathUsage.measured) > ImagePathUsageMaxAge {
+		imagePathUsage.bytes, imagePathUsage.measured = dirSize(ImageWorkingPath), time.Now()
+	}
+	return imagePathUsage.bytes
+}
+
+func measureImagePathUsage() {
+	used := dirSize(ImageWorkingPath)
+	imagePathUsage.Lock()
+	imagePathUsage.bytes, imagePathUsage.measured = used, time.Now()
+	imagePathUsage.Unlock()
+}
+
+// dirSize returns the total size of the regular files under the path
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// SweepImagePath removes the leftovers under the image working path that are not used by any scan
+// in progress and were not modified within the grace period. It returns the number of removed folders.
+func SweepImagePath(grace time.Duration) int {
+	cnt, _ := SweepImagePathBefore(time.Now().Add(-grace))
+	return cnt
+}
+
+// SweepImagePathBefore removes the leftovers under the image working path that are not used by any scan
+// in progress and were last modified before the time. It returns the number of removed folders and their bytes.
+func SweepImagePathBefore(before time.Time) (int, int64) {
+	entries, err := ioutil.ReadDir(ImageWorkingPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(log.Fields{"error": err, "path": ImageWorkingPath}).Error("Failed to read image path")
+		}
+		return 0, 0
+	}
+
+	var cnt int
+	var size int64
+	for _, e := range entries {
+		path := filepath.Join(ImageWorkingPath, e.Name())
+		if isActivePath(path) || !e.ModTime().Before(before) {
+			continue
+		}
+		used := dirSize(path)
+		if err := removeAllRetry(path); err != nil {
+			metricCleanupErrors.Add(1)
+			log.WithFields(log.Fields{"error": err, "path": path, "retries": CleanupRetries}).Error("Failed to sweep image path")
+			continue
+		}
+		cnt++
+		size += used
+	}
+	metricSweptPaths.Add(int64(cnt))
+	measureImagePathUsage()
+
+	free, _ := FreeSpace()
+	log.WithFields(log.Fields{"removed": cnt, "bytes": size, "free": free}).Debug()
+	return cnt, size
+}
@@ -0,0 +1,77 @@
+package cvetools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEstimateScratchSpace(t *testing.T) {
+	sizes := map[string]int64{"sha256:a": 100, "sha256:b": 50}
+
+	// the streamed layers only write the files the scan reads
+	if n := estimateScratchSpace(sizes); n != 150 {
+		t.Errorf("Incorrect estimate of the streamed layers: %d", n)
+	}
+	FullExtraction = true
+	if n := estimateScratchSpace(sizes); n != 450 {
+		t.Errorf("Incorrect estimate: %d", n)
+	}
+	FullExtraction = false
+
+	DiskExpansionFactor = 0
+	defer func() { DiskExpansionFactor = DefaultDiskExpansionFactor }()
+	if n := estimateScratchSpace(sizes); n != 0 {
+		t.Errorf("Estimate should be disabled: %d", n)
+	}
+}
+
+func TestRemoveAllRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	retries, backoff := CleanupRetries, CleanupBackoff
+	CleanupRetries, CleanupBackoff = 2, time.Millisecond
+	defer func() { CleanupRetries, CleanupBackoff, removeAll = retries, backoff, os.RemoveAll }()
+
+	// busy for the first removals
+	var calls, busy int
+	removeAll = func(path string) error {
+		if calls++; calls <= busy {
+			return syscall.EBUSY
+		}
+		return os.RemoveAll(path)
+	}
+
+	imagePath := ImageWorkingPath
+	ImageWorkingPath = filepath.Join(dir, "images")
+	defer func() { ImageWorkingPath = imagePath }()
+	left := filepath.Join(ImageWorkingPath, "left", "layer")
+	os.MkdirAll(left, 0755)
+
+	busy = 2
+	if err := ResetImagePath(); err != nil || calls != 3 {
+		t.Errorf("Busy working path not removed on retries: %v, %d removals", err, calls)
+	}
+	if _, err := os.Stat(left); !os.IsNotExist(err) {
+		t.Errorf("Leftover not removed")
+	}
+	if info, err := os.Stat(ImageWorkingPath); err != nil || !info.IsDir() {
+		t.Errorf("Working path not created again: %v", err)
+	}
+
+	calls, busy = 0, 3
+	failed := metricCleanupErrors.Value()
+	if err := ResetImagePath(); err != syscall.EBUSY || calls != 3 {
+		t.Errorf("Persistent failure not returned after the retries: %v, %d removals", err, calls)
+	}
+	if metricCleanupErrors.Value() != failed+1 {
+		t.Errorf("Persistent failure not counted")
+	}
+}
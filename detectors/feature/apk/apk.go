@@ -51,6 +51,7 @@ func (detector *RpmFeaturesDetector) Detect(namespace string, files map[string]*
 		if line == "" {
 			if pkg.Package != "" && pkg.Version.String() != "" {
 				pkg.InBase = f.InBase
+				pkg.File = "/" + apkPackageFile
 				packagesMap[pkg.Package+"#"+pkg.Version.String()] = pkg
 				pkg.Package = ""
 				pkg.Version = utils.Version{}
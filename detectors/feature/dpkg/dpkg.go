@@ -50,7 +50,7 @@ type dpkgPackage struct {
 	version string
 }
 
-func (detector *DpkgFeaturesDetector) addFeature(packagesMap map[string]detectors.FeatureVersion, pkg *dpkgPackage, inBase bool, installed bool) {
+func (detector *DpkgFeaturesDetector) addFeature(packagesMap map[string]detectors.FeatureVersion, pkg *dpkgPackage, file string, inBase bool, installed bool) {
 	// Add the package to the result array if we have all the informations
 	if (pkg.pkgName != "" || pkg.source != "") && pkg.version != "" { //
 		var name string
@@ -65,6 +65,7 @@ func (detector *DpkgFeaturesDetector) addFeature(packagesMap map[string]detector
 		ver, _ := utils.NewVersion(pkg.version)
 		fv := detectors.FeatureVersion{
 			Package: name,
+			File:    "/" + file,
 			Version: ver,
 			InBase:  inBase,
 		}
@@ -88,9 +89,9 @@ func (detector *DpkgFeaturesDetector) Detect(namespace string, files map[string]
 
 	for name, file := range files {
 		if name == dpkgPackageFile {
-			detector.parseFeatureFile(packagesMap, string(file.Data[:]), file.InBase, false)
+			detector.parseFeatureFile(packagesMap, string(file.Data[:]), name, file.InBase, false)
 		} else if strings.HasPrefix(name, dpkgPackageDir) {
-			detector.parseFeatureFile(packagesMap, string(file.Data[:]), file.InBase, true)
+			detector.parseFeatureFile(packagesMap, string(file.Data[:]), name, file.InBase, true)
 		}
 	}
 
@@ -103,7 +104,7 @@ func (detector *DpkgFeaturesDetector) Detect(namespace string, files map[string]
 	return packages, nil
 }
 
-func (detector *DpkgFeaturesDetector) parseFeatureFile(packagesMap map[string]detectors.FeatureVersion, f string, inBase bool, installed bool) error {
+func (detector *DpkgFeaturesDetector) parseFeatureFile(packagesMap map[string]detectors.FeatureVersion, f string, file string, inBase bool, installed bool) error {
 	var pkg dpkgPackage
 	scanner := bufio.NewScanner(strings.NewReader(f))
 	for scanner.Scan() {
@@ -147,12 +148,12 @@ func (detector *DpkgFeaturesDetector) parseFeatureFile(packagesMap map[string]de
 			}
 			pkg.version = ver.String()
 		} else if line == "" {
-			detector.addFeature(packagesMap, &pkg, inBase, installed)
+			detector.addFeature(packagesMap, &pkg, file, inBase, installed)
 			pkg = dpkgPackage{}
 		}
 	}
 
-	detector.addFeature(packagesMap, &pkg, inBase, installed)
+	detector.addFeature(packagesMap, &pkg, file, inBase, installed)
 	return nil
 }
 
@@ -36,12 +36,14 @@ func init() {
 
 func (detector *RpmFeaturesDetector) Detect(namespace string, files map[string]*detectors.FeatureFile, path string) ([]detectors.FeatureVersion, error) {
 	var rpmFF *detectors.FeatureFile
+	var rpmFile string
 	var max int
 
 	for fn, ff := range files {
 		// In case there are multiple rpm package files present, pick the largest
 		if scan.RPMPkgFiles.Contains(fn) && len(ff.Data) > max {
 			rpmFF = ff
+			rpmFile = "/" + fn
 			max = len(ff.Data)
 		}
 	}
@@ -114,6 +116,7 @@ func (detector *RpmFeaturesDetector) Detect(namespace string, files map[string]*
 			pkg := detectors.FeatureVersion{
 				Package: p.Name,
 				Version: version,
+				File:    rpmFile,
 				CPEs:    cpes,
 				InBase:  rpmFF.InBase,
 			}
@@ -146,6 +149,7 @@ func (detector *RpmFeaturesDetector) Detect(namespace string, files map[string]*
 			pkg := detectors.FeatureVersion{
 				Package: line[0],
 				Version: version,
+				File:    rpmFile,
 				CPEs:    cpes,
 				InBase:  rpmFF.InBase,
 			}
@@ -46,12 +46,14 @@ type FeatureVersion struct {
 	// Feature    Feature
 	Name       string
 	Package    string
-	File       string
+	File       string // the package database of an OS package, the file of an application module
 	Version    utils.Version
 	MinVer     utils.Version
 	ModuleVuls []ModuleVul
 	CPEs       utils.Set
 	InBase     bool
+	Detector   string // the detector which found the package
+	Namespace  string // set when the package is matched with another OS than the image's
 }
 
 type AppFeatureVersion struct {
@@ -96,11 +98,14 @@ func RegisterFeaturesDetector(name string, f FeaturesDetector) {
 func DetectFeatures(namespace string, data map[string]*FeatureFile, path string) ([]FeatureVersion, error) {
 	var packages []FeatureVersion
 
-	for _, detector := range featuresDetectors {
+	for name, detector := range featuresDetectors {
 		pkgs, err := detector.Detect(namespace, data, path)
 		if err != nil {
 			return []FeatureVersion{}, err
 		}
+		for i := range pkgs {
+			pkgs[i].Detector = name
+		}
 		packages = append(packages, pkgs...)
 	}
 
@@ -18,6 +18,7 @@ package detectors
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -80,6 +81,31 @@ func DetectNamespace(data map[string]*FeatureFile) *Namespace {
 	return nil
 }
 
+// DetectAllNamespaces returns every distinct OS found by the registered NamespaceDetectors,
+// os-release first. An image can hold the release files of more than one OS.
+func DetectAllNamespaces(data map[string]*FeatureFile) []*Namespace {
+	names := make([]string, 0, len(namespaceDetectors))
+	for name := range namespaceDetectors {
+		if name != highPriorityFile {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := namespaceDetectors[highPriorityFile]; ok {
+		names = append([]string{highPriorityFile}, names...)
+	}
+
+	var list []*Namespace
+	found := make(map[string]bool)
+	for _, name := range names {
+		if namespace := namespaceDetectors[name].Detect(data); namespace != nil && !found[namespace.Name] {
+			found[namespace.Name] = true
+			list = append(list, namespace)
+		}
+	}
+	return list
+}
+
 // GetRequiredFilesNamespace returns the list of files required for DetectNamespace for every
 // registered NamespaceDetector, without leading /.
 func GetRequiredFilesNamespace() (files []string) {
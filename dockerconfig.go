@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// dockerConfig is the .dockerconfigjson of a kubernetes pull secret, the same format as ~/.docker/config.json
+type dockerConfig struct {
+	Auths map[string]*dockerAuth `json:"auths"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth,omitempty"` // base64 of username:password
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"` // the refresh token of the registry token server
+}
+
+// loadDockerConfig reads the credentials of the -docker_config file, a kubernetes secret is also accepted
+// as it is, with the file in the base64 data
+func loadDockerConfig(path string) (*dockerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the docker config: %v", err)
+	}
+	return parseDockerConfig(data, path)
+}
+
+// parseDockerConfig parses a docker config, or a kubernetes secret of one, source names it in the errors
+func parseDockerConfig(data []byte, source string) (*dockerConfig, error) {
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Invalid docker config %s: %v", source, err)
+	}
+	if cfg.Auths == nil {
+		var secret struct {
+			Data map[string]string `json:"data"`
+		}
+		if json.Unmarshal(data, &secret) == nil && secret.Data[".dockerconfigjson"] != "" {
+			decoded, err := base64.StdEncoding.DecodeString(secret.Data[".dockerconfigjson"])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid docker config %s: %v", source, err)
+			}
+			if err := json.Unmarshal(decoded, &cfg); err != nil {
+				return nil, fmt.Errorf("Invalid docker config %s: %v", source, err)
+			}
+		} else if secret.Data[".dockercfg"] != "" {
+			// the legacy format of kubernetes.io/dockercfg, the auths without the key
+			decoded, err := base64.StdEncoding.DecodeString(secret.Data[".dockercfg"])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid docker config %s: %v", source, err)
+			}
+			if err := json.Unmarshal(decoded, &cfg.Auths); err != nil {
+				return nil, fmt.Errorf("Invalid docker config %s: %v", source, err)
+			}
+		}
+	}
+	if len(cfg.Auths) == 0 {
+		return nil, fmt.Errorf("No auths in the docker config %s", source)
+	}
+
+	for host, auth := range cfg.Auths {
+		if auth == nil {
+			return nil, fmt.Errorf("Invalid docker config auth of %s", host)
+		}
+		if auth.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid docker config auth of %s: %v", host, err)
+		}
+		i := strings.Index(string(decoded), ":")
+		if i == -1 {
+			return nil, fmt.Errorf("Invalid docker config auth of %s: no username", host)
+		}
+		auth.Username, auth.Password = string(decoded[:i]), string(decoded[i+1:])
+	}
+	return &cfg, nil
+}
+
+// dockerConfigHost returns the host of an auths key or a registry URL, like https://index.docker.io/v1/
+func dockerConfigHost(value string) string {
+	value = strings.ToLower(value)
+	if i := strings.Index(value, "://"); i != -1 {
+		value = value[i+3:]
+	}
+	if i := strings.Index(value, "/"); i != -1 {
+		value = value[:i]
+	}
+	return value
+}
+
+// credentials returns the username and password for the registry. The docker hub aliases share the
+// credentials, and an identity token is given as the password of cvetools.IdentityTokenUsername.
+func (cfg *dockerConfig) credentials(registry string) (string, string, bool) {
+	host := dockerConfigHost(registry)
+	if host == "" {
+		return "", "", false
+	}
+
+	keys := make([]string, 0, len(cfg.Auths))
+	for key := range cfg.Auths {
+		keys = append(keys, key)
+	}
+	var found, alias *dockerAuth
+	for _, key := range longestFirst(keys) {
+		h := dockerConfigHost(key)
+		if h == host {
+			found = cfg.Auths[key]
+			break
+		}
+		if alias == nil && dockerhubRegs.Contains(h) && dockerhubRegs.Contains(host) {
+			alias = cfg.Auths[key]
+		}
+	}
+	if found == nil {
+		found = alias
+	}
+	if found == nil {
+		return "", "", false
+	}
+	if found.IdentityToken != "" {
+		return cvetools.IdentityTokenUsername, found.IdentityToken, true
+	}
+	return found.Username, found.Password, true
+}
+
+// longestFirst sorts the registry keys, the longest first, so a registry matching more than one key, like
+// the docker hub aliases, takes the same one at every run
+func longestFirst(keys []string) []string {
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// applyDockerConfig sets the credentials of the registry if the request has none
+func applyDockerConfig(req *share.ScanImageRequest, cfg *dockerConfig) {
+	if cfg == nil || req.Username != "" || req.Password != "" || req.Token != "" {
+		return
+	}
+	if username, password, ok := cfg.credentials(req.Registry); ok {
+		req.Username, req.Password = username, password
+	}
+}
+
+// the service account of the pod, to read the pull secret with the kubernetes API
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// loadPullSecret reads the credentials of a kubernetes pull secret, "namespace/name" or the name in the
+// namespace of the pod. The secret is read with the kubernetes API, by the service account of the pod,
+// which needs to get the secret.
+func loadPullSecret(ref string) (*dockerConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not in a kubernetes pod, the pull secret can't be read")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the service account token: %v", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("No CA certificate of the service account")
+	}
+
+	namespace, name := "", ref
+	if i := strings.Index(ref, "/"); i != -1 {
+		namespace, name = ref[:i], ref[i+1:]
+	} else if data, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		namespace = strings.TrimSpace(string(data))
+	}
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("Invalid pull secret %q, namespace/name", ref)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		Timeout:   apiCallTimeout,
+	}
+	return readPullSecret(client, "https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), namespace, name)
+}
+
+func readPullSecret(client *http.Client, apiServer, token, namespace, name string) (*dockerConfig, error) {
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s", apiServer, namespace, name)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the pull secret: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the pull secret: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to read the pull secret %s/%s: %s", namespace, name, resp.Status)
+	}
+	return parseDockerConfig(data, fmt.Sprintf("secret %s/%s", namespace, name))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestDockerConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dockerconfig")
+	defer os.RemoveAll(dir)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("hubuser:hub:pass"))
+	config := fmt.Sprintf(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": %q},
+		"registry.corp:5000": {"username": "corp", "password": "secret"},
+		"corp.azurecr.io": {"identitytoken": "refresh-1"}
+	}}`, auth)
+	file := filepath.Join(dir, ".dockerconfigjson")
+	ioutil.WriteFile(file, []byte(config), 0600)
+	cfg, err := loadDockerConfig(file)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+
+	tests := map[string][2]string{
+		"https://registry.hub.docker.com": {"hubuser", "hub:pass"},
+		"https://docker.io/":              {"hubuser", "hub:pass"},
+		"https://registry.corp:5000/team": {"corp", "secret"},
+		"https://corp.azurecr.io":         {cvetools.IdentityTokenUsername, "refresh-1"},
+		"https://registry.corp":           {"", ""},
+		"":                                {"", ""},
+	}
+	for registry, expect := range tests {
+		user, pass, _ := cfg.credentials(registry)
+		if user != expect[0] || pass != expect[1] {
+			t.Errorf("Incorrect credentials of %s: %s %s", registry, user, pass)
+		}
+	}
+
+	// the credentials given by the options are kept
+	req := &share.ScanImageRequest{Registry: "https://registry.corp:5000", Username: "me", Password: "mine"}
+	applyDockerConfig(req, cfg)
+	if req.Username != "me" {
+		t.Errorf("Credentials are replaced: %s", req.Username)
+	}
+
+	// the kubernetes secret
+	secret := fmt.Sprintf(`{"kind": "Secret", "type": "kubernetes.io/dockerconfigjson", "data": {".dockerconfigjson": %q}}`,
+		base64.StdEncoding.EncodeToString([]byte(config)))
+	ioutil.WriteFile(file, []byte(secret), 0600)
+	if cfg, err = loadDockerConfig(file); err != nil || len(cfg.Auths) != 3 {
+		t.Errorf("Failed to load the secret: %v", err)
+	}
+
+	// the docker hub aliases take the longest key, at every run
+	cfg = &dockerConfig{Auths: map[string]*dockerAuth{
+		"docker.io":                   {Username: "short"},
+		"https://index.docker.io/v1/": {Username: "long"},
+		"registry-1.docker.io":        {Username: "middle"},
+	}}
+	for i := 0; i < 20; i++ {
+		if user, _, _ := cfg.credentials("https://registry.hub.docker.com"); user != "long" {
+			t.Fatalf("Incorrect docker hub alias: %s", user)
+		}
+	}
+	if user, _, _ := cfg.credentials("https://docker.io"); user != "short" {
+		t.Errorf("The exact host should be preferred over the aliases: %s", user)
+	}
+
+	ioutil.WriteFile(file, []byte(`{"auths": {"registry.corp": {"auth": "bm9jb2xvbg=="}}}`), 0600)
+	if _, err := loadDockerConfig(file); err == nil {
+		t.Errorf("Auth without the username should fail")
+	}
+}
+
+func TestPullSecret(t *testing.T) {
+	config := base64.StdEncoding.EncodeToString([]byte(`{"auths": {"registry.corp:5000": {"username": "corp", "password": "secret"}}}`))
+	legacy := base64.StdEncoding.EncodeToString([]byte(`{"registry.corp:5000": {"username": "old", "password": "secret"}}`))
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sa-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/team/secrets/regcred":
+			fmt.Fprintf(w, `{"kind": "Secret", "type": "kubernetes.io/dockerconfigjson", "data": {".dockerconfigjson": %q}}`, config)
+		case "/api/v1/namespaces/team/secrets/legacy":
+			fmt.Fprintf(w, `{"kind": "Secret", "type": "kubernetes.io/dockercfg", "data": {".dockercfg": %q}}`, legacy)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg, err := readPullSecret(srv.Client(), srv.URL, "sa-token", "team", "regcred")
+	if err != nil {
+		t.Fatalf("Failed to read the secret: %v", err)
+	}
+	if user, pass, ok := cfg.credentials("https://registry.corp:5000/"); !ok || user != "corp" || pass != "secret" {
+		t.Errorf("Incorrect credentials: %s %s", user, pass)
+	}
+	if cfg, err = readPullSecret(srv.Client(), srv.URL, "sa-token", "team", "legacy"); err != nil {
+		t.Fatalf("Failed to read the legacy secret: %v", err)
+	}
+	if user, _, ok := cfg.credentials("registry.corp:5000"); !ok || user != "old" {
+		t.Errorf("Incorrect legacy credentials: %s", user)
+	}
+
+	if _, err = readPullSecret(srv.Client(), srv.URL, "sa-token", "team", "missing"); err == nil {
+		t.Errorf("Missing secret accepted")
+	}
+	if _, err = readPullSecret(srv.Client(), srv.URL, "wrong", "team", "regcred"); err == nil {
+		t.Errorf("Unauthorized request accepted")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/v6/table"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// explainCve looks the vulnerability of -explain up in the loaded database and prints it, false if the
+// database has no record of it
+func explainCve(w io.Writer, path, id string) (bool, error) {
+	recs, err := common.FindCveRecords(path, id)
+	if err != nil {
+		return false, err
+	}
+	if len(recs.OS) == 0 && len(recs.Apps) == 0 {
+		return false, nil
+	}
+	writeCveExplain(w, id, recs)
+	return true, nil
+}
+
+// writeCveExplain prints the records of a vulnerability: the description, the highest CVSS scores, the other
+// IDs and the references, then a row per namespace or module of the affected and fixed versions, the ranges
+// the scans match the packages against
+func writeCveExplain(w io.Writer, id string, recs *common.CveRecords) {
+	var description, vectors, vectorsV3 string
+	var score, scoreV3 float64
+	ids := make(map[string]struct{})
+	links := make(map[string]struct{})
+	addIDs := func(names ...[]string) {
+		for _, list := range names {
+			for _, name := range list {
+				if name != "" && !strings.EqualFold(name, id) {
+					ids[name] = struct{}{}
+				}
+			}
+		}
+	}
+	addMeta := func(desc, link string, s float64, v string, s3 float64, v3 string) {
+		if description == "" {
+			description = desc
+		}
+		if link != "" {
+			links[link] = struct{}{}
+		}
+		if s > score {
+			score, vectors = s, v
+		}
+		if s3 > scoreV3 {
+			scoreV3, vectorsV3 = s3, v3
+		}
+	}
+
+	t := table.NewWriter()
+	t.SetOutputMirror(w)
+	t.AppendHeader(table.Row{"Namespace", "Package", "Affected", "Fixed", "Severity", "Published"})
+	for _, v := range recs.OS {
+		addIDs([]string{v.Name}, v.CVEs, v.Aliases)
+		addMeta(v.Description, v.Link, v.CVSSv2.Score, v.CVSSv2.Vectors, v.CVSSv3.Score, v.CVSSv3.Vectors)
+		published := v.IssuedDate.Format("2006-01-02")
+		if len(v.FixedIn) == 0 {
+			t.AppendRow(table.Row{v.Namespace, "", "", "", v.Severity, published})
+		}
+		for _, fi := range v.FixedIn {
+			affected, fixed := cvetools.RecordRange(fi.Version, fi.MinVer)
+			t.AppendRow(table.Row{v.Namespace, fi.Name, affected, fixed, v.Severity, published})
+		}
+	}
+	for _, v := range recs.Apps {
+		addIDs([]string{v.VulName}, v.Aliases)
+		addMeta(v.Description, v.Link, v.Score, v.Vectors, v.ScoreV3, v.VectorsV3)
+		affected := cvetools.ModuleVersions(v.AffectedVer)
+		if unaffected := cvetools.ModuleVersions(v.UnaffectedVer); unaffected != "" {
+			affected = strings.TrimPrefix(affected+", not "+unaffected, ", ")
+		}
+		t.AppendRow(table.Row{v.AppName, v.ModuleName, affected, cvetools.ModuleVersions(v.FixedVer), v.Severity, v.IssuedDate.Format("2006-01-02")})
+	}
+
+	fmt.Fprintf(w, "Vulnerability: %s\n", id)
+	if len(ids) > 0 {
+		fmt.Fprintf(w, "Aliases: %s\n", strings.Join(sortedKeys(ids), ", "))
+	}
+	if scoreV3 > 0 {
+		fmt.Fprintf(w, "CVSS v3: %.1f %s\n", scoreV3, vectorsV3)
+	}
+	if score > 0 {
+		fmt.Fprintf(w, "CVSS v2: %.1f %s\n", score, vectors)
+	}
+	if description != "" {
+		fmt.Fprintf(w, "Description: %s\n", description)
+	}
+	for _, link := range sortedKeys(links) {
+		fmt.Fprintf(w, "Reference: %s\n", link)
+	}
+	t.SetStyle(table.StyleLight)
+	t.Render()
+}
+
+// writeWhy prints the match decisions of -why for the scanned image, after the report, to stderr with the
+// stdout of -format jsonl
+func writeWhy(result *cvetools.ScanReport, opts *onDemandOptions) {
+	if result == nil || result.Error != share.ScanErrorCode_ScanErrNone {
+		return
+	}
+	decisions, err := cveTools.ExplainMatch(result, opts.why)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "why": opts.why}).Error("Failed to explain the matching")
+		return
+	}
+	w := io.Writer(os.Stdout)
+	if opts.format == formatJSONL {
+		w = os.Stderr
+	}
+	writeMatchDecisions(w, opts.why, decisions)
+}
+
+// writeMatchDecisions prints a row per package and database record of the vulnerability
+func writeMatchDecisions(w io.Writer, id string, decisions []*cvetools.MatchDecision) {
+	if len(decisions) == 0 {
+		fmt.Fprintf(w, "Why %s: no package of the image is in the records of the database\n", id)
+		return
+	}
+	fmt.Fprintf(w, "Why %s:\n", id)
+	t := table.NewWriter()
+	t.SetOutputMirror(w)
+	t.AppendHeader(table.Row{"Package", "Version", "Source", "Record", "Affected", "Fixed", "Decision", "Reason"})
+	for _, d := range decisions {
+		t.AppendRow(table.Row{d.Package, d.Version, d.Source, d.Record, d.Affected, d.Fixed, d.Decision, d.Reason})
+	}
+	t.SetStyle(table.StyleLight)
+	t.Render()
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
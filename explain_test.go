@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestWriteCveExplain(t *testing.T) {
+	issued := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	recs := &common.CveRecords{
+		OS: []common.VulFull{
+			{Name: "CVE-2023-1234", Namespace: "debian:11", Description: "overflow in the parser", Link: "https://security-tracker.debian.org/tracker/CVE-2023-1234",
+				Severity: "High", CVSSv3: common.CVSS{Score: 7.5, Vectors: "CVSS:3.1/AV:N"}, IssuedDate: issued,
+				FixedIn: []common.FeaFull{{Name: "libfoo", Version: "1.2-1", MinVer: "1.0"}, {Name: "libfoo-dev", Version: "#MAXV#"}}},
+		},
+		Apps: []common.AppModuleVul{
+			{VulName: "GHSA-aaaa-bbbb-cccc", AppName: "maven", ModuleName: "org.foo:foo", Severity: "Critical", Aliases: []string{"CVE-2023-1234"},
+				ScoreV3: 9.8, VectorsV3: "CVSS:3.1/AV:N/AC:L", IssuedDate: issued,
+				AffectedVer: []common.AppModuleVersion{{OpCode: "lt", Version: "2.0"}}, FixedVer: []common.AppModuleVersion{{OpCode: "gteq", Version: "2.0"}}},
+		},
+	}
+	var out strings.Builder
+	writeCveExplain(&out, "CVE-2023-1234", recs)
+	for _, line := range []string{
+		"Aliases: GHSA-aaaa-bbbb-cccc", "CVSS v3: 9.8 CVSS:3.1/AV:N/AC:L", "Description: overflow in the parser",
+		"Reference: https://security-tracker.debian.org/tracker/CVE-2023-1234",
+		"│ debian:11 │ libfoo      │ >=1.0 <1.2-1 │ 1.2-1 │ High     │ 2023-01-02 │",
+		"│ debian:11 │ libfoo-dev  │ all          │       │ High     │ 2023-01-02 │",
+		"│ maven     │ org.foo:foo │ <2.0         │ >=2.0 │ Critical │ 2023-01-02 │",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Missing %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestWriteMatchDecisions(t *testing.T) {
+	var out strings.Builder
+	writeMatchDecisions(&out, "CVE-2023-1234", nil)
+	if out.String() != "Why CVE-2023-1234: no package of the image is in the records of the database\n" {
+		t.Errorf("Incorrect output without decisions: %s", out.String())
+	}
+
+	out.Reset()
+	writeMatchDecisions(&out, "CVE-2023-1234", []*cvetools.MatchDecision{{
+		Package: "zlib", Version: "1.2.1", Source: "debian:11", Record: "CVE-2023-1234", Affected: "<1.2", Fixed: "1.2",
+		Decision: cvetools.DecisionFixed, Reason: "1.2.1 is the fixed version 1.2 or later",
+	}})
+	if !strings.Contains(out.String(), "│ zlib    │ 1.2.1   │ debian:11 │ CVE-2023-1234 │ <1.2     │ 1.2   │ fixed    │ 1.2.1 is the fixed version 1.2 or later │") {
+		t.Errorf("Incorrect decisions:\n%s", out.String())
+	}
+}
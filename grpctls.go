@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/cluster"
+	"github.com/neuvector/neuvector/share/utils"
+)
+
+// The grpc channels with the controller, the registration and the scans, and with the enforcers of the running
+// scans are authenticated by mTLS with the internal certificates of the cluster package, unless -grpc_cert,
+// -grpc_key and -grpc_ca_cert are given. The files are checked at the interval and the new certificates are used
+// by the next connections, the established connections keep theirs.
+
+// the environment variables setting the defaults of the grpc certificate options
+const (
+	grpcCertEnv     = "SCANNER_GRPC_CERT"
+	grpcKeyEnv      = "SCANNER_GRPC_KEY"
+	grpcCACertEnv   = "SCANNER_GRPC_CA_CERT"
+	grpcPeerNameEnv = "SCANNER_GRPC_PEER_NAME"
+)
+
+const grpcTLSReloadInterval = time.Duration(time.Second * 30)
+
+// the certificate in use is logged when it expires within the warning, at most once in the interval
+const (
+	grpcCertExpiryWarning     = 7 * 24 * time.Hour
+	grpcCertExpiryLogInterval = 24 * time.Hour
+)
+
+// controllerGRPCTLS is the mTLS of the grpc channel with the controller, nil for the internal certificates
+var controllerGRPCTLS *grpcTLS
+
+// grpcTLS is the certificate of the scanner, as the server of the scans and the client registering to the
+// controller, and the CA verifying the controller both ways
+type grpcTLS struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	peerName string // the name the certificate of the controller must have, the CN of the certificate if empty
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	name     string
+	modTimes []time.Time
+}
+
+// newGRPCTLS loads and validates the files of the grpc certificate options, nil if none is given
+func newGRPCTLS(certFile, keyFile, caFile, peerName string) (*grpcTLS, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		if peerName != "" {
+			return nil, errors.New("-grpc_peer_name requires -grpc_cert, -grpc_key and -grpc_ca_cert")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("-grpc_cert, -grpc_key and -grpc_ca_cert are all required")
+	}
+
+	t := &grpcTLS{certFile: certFile, keyFile: keyFile, caFile: caFile, peerName: peerName}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads and validates the files, the certificates in use are only replaced when all are valid
+func (t *grpcTLS) load() error {
+	modTimes, err := t.statFiles()
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(t.caFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read the CA certificate %s: %v", t.caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("No CA certificate found in %s", t.caFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load the certificate %s with the key %s: %v", t.certFile, t.keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Failed to parse the certificate %s: %v", t.certFile, err)
+	}
+	if err = checkValidity(leaf, time.Now()); err != nil {
+		return fmt.Errorf("The certificate %s %v", t.certFile, err)
+	}
+	if err = verifyChain(leaf, cert.Certificate[1:], pool, ""); err != nil {
+		return fmt.Errorf("The certificate %s is not verified by the CA of %s: %v", t.certFile, t.caFile, err)
+	}
+	if !hasExtKeyUsage(leaf, x509.ExtKeyUsageServerAuth) || !hasExtKeyUsage(leaf, x509.ExtKeyUsageClientAuth) {
+		return fmt.Errorf("The certificate %s is used by the scanner as the server and the client, its extended key usage must have both", t.certFile)
+	}
+	cert.Leaf = leaf
+
+	// like the cluster package, the controller has a certificate of the same name without the option
+	name := t.peerName
+	if name == "" {
+		name = leaf.Subject.CommonName
+	}
+
+	t.mutex.Lock()
+	t.cert, t.pool, t.name, t.modTimes = &cert, pool, name, modTimes
+	t.mutex.Unlock()
+	log.WithFields(log.Fields{
+		"cert": t.certFile, "ca": t.caFile, "subject": leaf.Subject.String(), "expiry": leaf.NotAfter, "peer": name,
+	}).Info("grpc certificates")
+	return nil
+}
+
+func (t *grpcTLS) statFiles() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range []string{t.certFile, t.keyFile, t.caFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %v", file, err)
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// reload loads the files again if any was modified, true if the certificates were replaced
+func (t *grpcTLS) reload() (bool, error) {
+	modTimes, err := t.statFiles()
+	if err != nil {
+		return false, err
+	}
+	t.mutex.RLock()
+	modified := false
+	for i, mt := range modTimes {
+		modified = modified || !mt.Equal(t.modTimes[i])
+	}
+	t.mutex.RUnlock()
+	if !modified {
+		return false, nil
+	}
+	return true, t.load()
+}
+
+// watch checks the files at the interval and reloads them when modified, and the expiry of the certificate in use
+func (t *grpcTLS) watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var logged time.Time
+		for now := range ticker.C {
+			if reloaded, err := t.reload(); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Keep the grpc certificates in use")
+			} else if reloaded {
+				log.WithFields(log.Fields{"cert": t.certFile}).Info("grpc certificates reloaded")
+				logged = time.Time{}
+			}
+			if now.Sub(logged) >= grpcCertExpiryLogInterval && t.checkExpiry(now) {
+				logged = now
+			}
+		}
+	}()
+}
+
+// checkExpiry logs the certificate in use expired or expiring within grpcCertExpiryWarning, it returns true if
+// it was logged
+func (t *grpcTLS) checkExpiry(now time.Time) bool {
+	cert, _, _ := t.current()
+	leaf := cert.Leaf
+	if err := checkValidity(leaf, now); err != nil {
+		log.WithFields(log.Fields{"cert": t.certFile, "error": err}).Error("The grpc certificate in use is not valid, the controller refuses the connections")
+		return true
+	}
+	if left := leaf.NotAfter.Sub(now); left < grpcCertExpiryWarning {
+		log.WithFields(log.Fields{"cert": t.certFile, "expiry": leaf.NotAfter, "left": left.Round(time.Minute)}).Warn("The grpc certificate in use expires soon")
+		return true
+	}
+	return false
+}
+
+func (t *grpcTLS) current() (*tls.Certificate, *x509.CertPool, string) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.cert, t.pool, t.name
+}
+
+// clientCreds verifies the controller by the CA and the name in use at the handshake, instead of the ones of
+// the dial, so a connection made after a reload uses the new files
+func (t *grpcTLS) clientCreds() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _, _ := t.current()
+			return cert, nil
+		},
+		// verified by VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, pool, name := t.current()
+			return verifyPeer("controller", rawCerts, pool, name, x509.ExtKeyUsageServerAuth)
+		},
+	})
+}
+
+// serverCreds requires the client certificate of the controller, by the CA and the name in use
+func (t *grpcTLS) serverCreds() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool, name := t.current()
+			return &tls.Config{
+				Certificates:             []tls.Certificate{*cert},
+				MinVersion:               tls.VersionTLS12,
+				PreferServerCipherSuites: true,
+				CipherSuites:             utils.GetSupportedTLSCipherSuites(),
+				// verified by VerifyPeerCertificate, with the name
+				ClientAuth: tls.RequireAnyClientCert,
+				VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+					return verifyPeer("client", rawCerts, pool, name, x509.ExtKeyUsageClientAuth)
+				},
+			}, nil
+		},
+	})
+}
+
+// verifyPeer verifies the certificate of the other side, the error tells what to fix as it is only seen in the
+// handshake error of grpc
+func verifyPeer(peer string, rawCerts [][]byte, pool *x509.CertPool, name string, usage x509.ExtKeyUsage) error {
+	var certs []*x509.Certificate
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("Failed to parse the %s certificate: %v", peer, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("No %s certificate", peer)
+	}
+	leaf := certs[0]
+	if err := checkValidity(leaf, time.Now()); err != nil {
+		return fmt.Errorf("The %s certificate %s %v", peer, leaf.Subject, err)
+	}
+	if err := verifyChain(leaf, rawCerts[1:], pool, name, usage); err != nil {
+		var hostErr x509.HostnameError
+		if errors.As(err, &hostErr) {
+			return fmt.Errorf("The %s certificate %s is not for %s, of -grpc_peer_name or the CN of -grpc_cert: it has %s",
+				peer, leaf.Subject, name, strings.Join(append(leaf.DNSNames, ipStrings(leaf.IPAddresses)...), ", "))
+		}
+		return fmt.Errorf("The %s certificate %s is not verified by the CA of -grpc_ca_cert: %v", peer, leaf.Subject, err)
+	}
+	return nil
+}
+
+// checkValidity returns the error of a certificate expired or not valid yet at the time
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("expired on %s", cert.NotAfter.Format(time.RFC3339))
+	} else if now.Before(cert.NotBefore) {
+		return fmt.Errorf("is not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// verifyChain verifies the certificate by the CA pool, with the intermediate certificates, for the name if given
+func verifyChain(leaf *x509.Certificate, intermediates [][]byte, pool *x509.CertPool, name string, usages ...x509.ExtKeyUsage) error {
+	opts := x509.VerifyOptions{Roots: pool, Intermediates: x509.NewCertPool(), DNSName: name, KeyUsages: usages}
+	if len(usages) == 0 {
+		opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	}
+	for _, raw := range intermediates {
+		if cert, err := x509.ParseCertificate(raw); err == nil {
+			opts.Intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(opts)
+	return err
+}
+
+// hasExtKeyUsage returns true if the certificate can be used for the usage, a certificate without the extended
+// key usage can be used for all
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	if len(cert.ExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func ipStrings(ips []net.IP) []string {
+	list := make([]string, len(ips))
+	for i, ip := range ips {
+		list[i] = ip.String()
+	}
+	return list
+}
+
+// tlsGRPCServer is the grpc server of the scans with the certificates of controllerGRPCTLS, it serves like the
+// server of the cluster package
+type tlsGRPCServer struct {
+	stopped bool
+	listen  net.Listener
+	server  *grpc.Server
+}
+
+func newTLSGRPCServer(endpoint string, t *grpcTLS) (*tlsGRPCServer, error) {
+	listen, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.ServerOption{
+		grpc.Creds(t.serverCreds()),
+		grpc.RPCCompressor(grpc.NewGZIPCompressor()),
+		grpc.RPCDecompressor(grpc.NewGZIPDecompressor()),
+		grpc.MaxMsgSize(cluster.GRPCMaxMsgSize),
+	}
+	return &tlsGRPCServer{stopped: true, listen: listen, server: grpc.NewServer(opts...)}, nil
+}
+
+func (s *tlsGRPCServer) GetServer() *grpc.Server {
+	return s.server
+}
+
+func (s *tlsGRPCServer) Start() {
+	s.stopped = false
+	for {
+		if err := s.server.Serve(s.listen); err != nil {
+			if s.stopped {
+				break
+			}
+			log.WithFields(log.Fields{"error": err}).Error("Fail to start grpc server")
+			time.Sleep(time.Second * 5)
+		}
+	}
+}
+
+func (s *tlsGRPCServer) Stop() {
+	s.stopped = true
+	s.server.Stop()
+}
+
+// the connections to the controller and the enforcers with the certificates of controllerGRPCTLS, by the keys of
+// the clients of the cluster package, controller and controllerCap, or the endpoint of an enforcer
+var tlsConns = make(map[string]*tlsConn)
+var tlsConnMutex sync.Mutex
+
+type tlsConn struct {
+	conn   *grpc.ClientConn
+	cancel context.CancelFunc
+}
+
+// getTLSConn returns the connection of the key, dialed if none. The compression is asked to isCompressed, like
+// the cluster package does, none if nil; cb is notified when the connection is lost.
+func getTLSConn(key, endpoint string, isCompressed cluster.IsCompressedFunc, cb cluster.GRPCCallback) (*grpc.ClientConn, error) {
+	tlsConnMutex.Lock()
+	defer tlsConnMutex.Unlock()
+	if c, ok := tlsConns[key]; ok {
+		return c.conn, nil
+	}
+
+	compress := false
+	if isCompressed != nil {
+		compress = isCompressed(endpoint)
+		log.WithFields(log.Fields{"endpoint": endpoint, "compress": compress}).Info("grpc channel")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := dialControllerTLS(ctx, endpoint, compress)
+	if err != nil {
+		cancel()
+		log.WithFields(log.Fields{"error": err, "ep": endpoint}).Error("Failed to dial to grpc server")
+		return nil, err
+	}
+	c := &tlsConn{conn: conn, cancel: cancel}
+	tlsConns[key] = c
+	go monitorTLSConn(ctx, key, c, cb)
+	return conn, nil
+}
+
+func dialControllerTLS(ctx context.Context, endpoint string, compress bool) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(controllerGRPCTLS.clientCreds()),
+		grpc.WithDecompressor(grpc.NewGZIPDecompressor()),
+		grpc.WithDefaultCallOptions(grpc.FailFast(true)),
+	}
+	if compress {
+		opts = append(opts, grpc.WithCompressor(grpc.NewGZIPCompressor()))
+	}
+	return grpc.DialContext(ctx, endpoint, opts...)
+}
+
+// isControllerTLSCompressed asks the controller if it installs the decompressor, like
+// cluster.IsControllerGRPCCommpressed
+func isControllerTLSCompressed(endpoint string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	conn, err := dialControllerTLS(ctx, endpoint, false)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to get controller cap client")
+		return false
+	}
+	defer conn.Close()
+
+	cap, err := share.NewControllerCapServiceClient(conn).IsGRPCCompressed(ctx, &share.RPCVoid{})
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to get controller cap")
+		return false
+	}
+	return cap != nil && cap.Value
+}
+
+// monitorTLSConn removes the connection once it fails, to be dialed again, and notifies cb
+func monitorTLSConn(ctx context.Context, key string, c *tlsConn, cb cluster.GRPCCallback) {
+	s := c.conn.GetState()
+	for {
+		if s == connectivity.TransientFailure {
+			// wait a second, the connection may be reconnecting
+			time.Sleep(time.Second)
+			s = c.conn.GetState()
+		}
+		if s == connectivity.Shutdown || s == connectivity.TransientFailure {
+			break
+		}
+		if !c.conn.WaitForStateChange(ctx, s) {
+			// deleted
+			return
+		}
+		s = c.conn.GetState()
+	}
+
+	tlsConnMutex.Lock()
+	if tlsConns[key] == c {
+		delete(tlsConns, key)
+	}
+	tlsConnMutex.Unlock()
+	c.cancel()
+	c.conn.Close()
+	if cb != nil {
+		cb.Shutdown()
+	}
+}
+
+// alwaysCompressed is the compression of the enforcer clients of the cluster package
+func alwaysCompressed(string) bool {
+	return true
+}
+
+// isTLSHandshakeError returns true if the grpc call failed the TLS handshake, by a certificate not verified
+// either way
+func isTLSHandshakeError(err error) bool {
+	return status.Code(err) == codes.Unavailable && strings.Contains(status.Convert(err).Message(), "authentication handshake failed")
+}
+
+// deleteTLSConn closes the connection of the key, without notifying the callback
+func deleteTLSConn(key string) {
+	tlsConnMutex.Lock()
+	c, ok := tlsConns[key]
+	delete(tlsConns, key)
+	tlsConnMutex.Unlock()
+	if ok {
+		c.cancel()
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+)
+
+// newTestCert writes a certificate of the name and its key to the folder, signed by the CA, or self-signed as
+// a CA if ca is nil
+func newTestCert(t *testing.T, dir, name string, ca *tls.Certificate, notAfter time.Time) *tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter,
+	}
+	parent, parentKey := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid, tmpl.KeyUsage = true, true, x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		parent, parentKey = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestGRPCTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpctls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	year := time.Now().Add(365 * 24 * time.Hour)
+	ca := newTestCert(t, dir, "ca", nil, year)
+	newTestCert(t, dir, "NeuVector", ca, year)
+	newTestCert(t, dir, "expired", ca, time.Now().Add(-time.Minute))
+	other := newTestCert(t, dir, "other-ca", nil, year)
+	newTestCert(t, dir, "stranger", other, year)
+
+	if tt, err := newGRPCTLS("", "", "", ""); tt != nil || err != nil {
+		t.Errorf("Certificates without the options: %v", err)
+	}
+	if _, err := newGRPCTLS(file("NeuVector.pem"), "", file("ca.pem"), ""); err == nil {
+		t.Errorf("Certificate without the key accepted")
+	}
+	if _, err := newGRPCTLS(file("expired.pem"), file("expired.key"), file("ca.pem"), ""); err == nil ||
+		!strings.Contains(err.Error(), file("expired.pem")+" expired on") {
+		t.Errorf("Incorrect error of an expired certificate: %v", err)
+	}
+	if _, err := newGRPCTLS(file("stranger.pem"), file("stranger.key"), file("ca.pem"), ""); err == nil ||
+		!strings.Contains(err.Error(), file("stranger.pem")+" is not verified by the CA of "+file("ca.pem")) {
+		t.Errorf("Incorrect error of a certificate of another CA: %v", err)
+	}
+	if _, err := newGRPCTLS(file("NeuVector.pem"), file("stranger.key"), file("ca.pem"), ""); err == nil ||
+		!strings.Contains(err.Error(), file("NeuVector.pem")) {
+		t.Errorf("Incorrect error of a certificate with another key: %v", err)
+	}
+
+	defer func(tt *grpcTLS) { controllerGRPCTLS = tt }(controllerGRPCTLS)
+	controllerGRPCTLS, err = newGRPCTLS(file("NeuVector.pem"), file("NeuVector.key"), file("ca.pem"), "")
+	if err != nil {
+		t.Fatalf("Failed to load the certificates: %v", err)
+	}
+	server, err := newTLSGRPCServer("127.0.0.1:0", controllerGRPCTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share.RegisterScannerServiceServer(server.GetServer(), new(rpcService))
+	go server.Start()
+	defer server.Stop()
+
+	ping := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		conn, err := dialControllerTLS(ctx, server.listen.Addr().String(), false)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = share.NewScannerServiceClient(conn).Ping(ctx, &share.RPCVoid{})
+		return err
+	}
+	if err := ping(); err != nil {
+		t.Errorf("Failed to call with the certificates: %v", err)
+	}
+
+	// the controller certificate without the name of -grpc_peer_name
+	controllerGRPCTLS.peerName = "controller.local"
+	controllerGRPCTLS.load()
+	if err := ping(); err == nil || !strings.Contains(err.Error(), "is not for controller.local") || !isTLSHandshakeError(err) {
+		t.Errorf("Incorrect error of the name mismatch: %v", err)
+	}
+	controllerGRPCTLS.peerName = ""
+	controllerGRPCTLS.load()
+
+	// the enforcers are called with the certificates too
+	ep := server.listen.Addr().String()
+	if _, err := findEnforcerServiceClient(ep); err != nil {
+		t.Errorf("Failed to get the enforcer client: %v", err)
+	}
+	tlsConnMutex.Lock()
+	_, ok := tlsConns[ep]
+	tlsConnMutex.Unlock()
+	if !ok {
+		t.Errorf("Enforcer not called with the certificates")
+	}
+	deleteTLSConn(ep)
+
+	// the certificate in use is logged as it expires
+	if controllerGRPCTLS.checkExpiry(time.Now()) || !controllerGRPCTLS.checkExpiry(year.Add(-24*time.Hour)) ||
+		!controllerGRPCTLS.checkExpiry(year.Add(time.Hour)) {
+		t.Errorf("Incorrect expiry check of the certificate in use")
+	}
+
+	// rotated to the certificate of another CA, the server and the client use it from the next connection
+	if reloaded, err := controllerGRPCTLS.reload(); reloaded || err != nil {
+		t.Errorf("Reloaded without a change: %v", err)
+	}
+	for _, ext := range []string{".pem", ".key"} {
+		data, _ := ioutil.ReadFile(file("stranger" + ext))
+		ioutil.WriteFile(file("NeuVector"+ext), data, 0644)
+		os.Chtimes(file("NeuVector"+ext), year, year)
+	}
+	if reloaded, err := controllerGRPCTLS.reload(); !reloaded || err == nil {
+		t.Errorf("Certificate of another CA reloaded: %v", err)
+	}
+	data, _ := ioutil.ReadFile(file("other-ca.pem"))
+	ioutil.WriteFile(file("ca.pem"), data, 0644)
+	os.Chtimes(file("ca.pem"), year, year)
+	if reloaded, err := controllerGRPCTLS.reload(); !reloaded || err != nil {
+		t.Errorf("Rotated certificates not reloaded: %v", err)
+	}
+	if cert, _, name := controllerGRPCTLS.current(); cert.Leaf.Subject.CommonName != "stranger" || name != "stranger" {
+		t.Errorf("Incorrect certificate in use: %s", cert.Leaf.Subject)
+	}
+	if err := ping(); err != nil {
+		t.Errorf("Failed to call with the rotated certificates: %v", err)
+	}
+}
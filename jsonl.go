@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// the records of -format jsonl, each is tagged with the image so the records of a batch can be demultiplexed
+const (
+	recordHeader  = "header"
+	recordFinding = "finding"
+	recordTrailer = "trailer"
+)
+
+type jsonlHeader struct {
+	Type          string `json:"type"`
+	Image         string `json:"image"`
+	SchemaVersion int    `json:"schema_version"`
+	Digest        string `json:"digest,omitempty"`
+	Platform      string `json:"platform,omitempty"`
+	CVEDBVersion  string `json:"cvedb_version,omitempty"`
+}
+
+type jsonlFinding struct {
+	Type  string `json:"type"`
+	Image string `json:"image"`
+	*onDemandVulnerability
+}
+
+type jsonlTrailer struct {
+	Type      string `json:"type"`
+	Image     string `json:"image"`
+	Status    string `json:"status"`
+	ErrorCode *int32 `json:"error_code,omitempty"` // the scan error code, none if the scan didn't start
+	ErrMsg    string `json:"error_message,omitempty"`
+	Phase     string `json:"phase,omitempty"` // the phase a failed scan stopped in
+	*scanCounts
+	Duration string `json:"duration"`
+}
+
+// jsonlWriter writes the records of the scans, a record is written at once as a line, so the records of the
+// parallel scans of a batch interleave without mixing, and the consumer gets each as soon as it is written
+type jsonlWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+var stdoutJSONL = &jsonlWriter{w: os.Stdout}
+
+func (jw *jsonlWriter) write(record interface{}) {
+	data, _ := json.Marshal(record)
+	jw.mutex.Lock()
+	jw.w.Write(append(data, '\n'))
+	jw.mutex.Unlock()
+}
+
+// jsonlScan writes the records of a scan: the header and the findings as soon as the vulnerabilities are
+// matched, before the scan ends, and the trailer when it ends. A batch streams the records of each image as its
+// scan goes, not when the batch ends.
+type jsonlScan struct {
+	jw       *jsonlWriter
+	req      *share.ScanImageRequest
+	opts     *onDemandOptions
+	mutex    sync.Mutex
+	streamed bool // the header and the findings are written
+}
+
+func newJSONLScan(jw *jsonlWriter, req *share.ScanImageRequest, opts *onDemandOptions) *jsonlScan {
+	return &jsonlScan{jw: jw, req: req, opts: opts}
+}
+
+// image tags the records, the request is of Docker Hub if the image is not found locally
+func (js *jsonlScan) image() string {
+	return fmt.Sprintf("%s%s:%s", js.req.Registry, js.req.Repository, js.req.Tag)
+}
+
+// withFindings returns the context of the scan to write the findings when they are matched, the scan context as
+// it is if the records are not written
+func (js *jsonlScan) withFindings(ctx context.Context) context.Context {
+	if !js.opts.printReport() {
+		return ctx
+	}
+	return cvetools.WithFindings(ctx, js.findings)
+}
+
+// findings writes the header and the findings of the matched vulnerabilities, post-processed as the result
+// will be: the ignore file, the VEX and the severity map apply
+func (js *jsonlScan) findings(report *cvetools.ScanReport) {
+	cveTools.PostProcess(report)
+	cvetools.SortScanResult(report.ScanResult)
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	js.writeFindings(report)
+}
+
+func (js *jsonlScan) writeFindings(result *cvetools.ScanReport) {
+	if js.streamed {
+		return
+	}
+	js.streamed = true
+	header := &jsonlHeader{Type: recordHeader, Image: js.image(), SchemaVersion: onDemandSchemaVersion, CVEDBVersion: resultDBVersion(result)}
+	if result != nil {
+		header.Digest = result.Digest
+		header.Platform = result.ImagePlatform.String()
+	}
+	js.jw.write(header)
+
+	if result != nil && result.Error == share.ScanErrorCode_ScanErrNone {
+		for _, v := range newOnDemandReport(result).Vuls {
+			js.jw.write(&jsonlFinding{Type: recordFinding, Image: js.image(), onDemandVulnerability: v})
+		}
+	}
+}
+
+// end writes the trailer of the scan, after the header and the findings of the result if they were not written
+// when the vulnerabilities were matched, like those of a scan failed before
+func (js *jsonlScan) end(result *cvetools.ScanReport, err error, elapsed time.Duration) {
+	if !js.opts.printReport() {
+		return
+	}
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	js.writeFindings(result)
+
+	trailer := &jsonlTrailer{
+		Type: recordTrailer, Image: js.image(), Status: "passed", scanCounts: countFindings(result, js.opts), Duration: elapsed.Round(time.Millisecond).String(),
+	}
+	if result != nil {
+		code := int32(result.Error)
+		trailer.ErrorCode = &code
+	}
+	if phase, msg := scanFailure(result, err); msg != "" {
+		trailer.Status, trailer.Phase, trailer.ErrMsg = "failed", phase, msg
+	}
+	js.jw.write(trailer)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestJSONLines(t *testing.T) {
+	req := &share.ScanImageRequest{Repository: "app", Tag: "1.0"}
+	result := cvetools.NewScanReport(&share.ScanResult{
+		Digest: "sha256:0123",
+		Vuls: []*share.ScanVulnerability{
+			{Name: "CVE-2022-0778", Severity: share.VulnSeverityHigh, PackageName: "openssl", FixedVersion: "1.1.1n"},
+			{Name: "CVE-2021-3712", Severity: share.VulnSeverityMedium, PackageName: "openssl"},
+		},
+		Secrets: &share.ScanSecretResult{},
+	})
+	result.Provenance = &cvetools.ScanProvenance{CVEDBVersion: "3.201"}
+
+	var buf strings.Builder
+	newJSONLScan(&jsonlWriter{w: &buf}, req, &onDemandOptions{}).end(result, nil, time.Second)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Incorrect records: %s", buf.String())
+	}
+	var header jsonlHeader
+	var finding map[string]interface{}
+	var trailer struct {
+		Type      string `json:"type"`
+		Status    string `json:"status"`
+		ErrorCode *int32 `json:"error_code"`
+		scanCounts
+	}
+	json.Unmarshal([]byte(lines[0]), &header)
+	json.Unmarshal([]byte(lines[1]), &finding)
+	json.Unmarshal([]byte(lines[3]), &trailer)
+	if header.Type != recordHeader || header.Image != "app:1.0" || header.Digest != "sha256:0123" || header.CVEDBVersion != "3.201" {
+		t.Errorf("Incorrect header: %s", lines[0])
+	}
+	if finding["type"] != recordFinding || finding["image"] != "app:1.0" || finding["name"] != "CVE-2022-0778" || finding["finding_id"] == "" {
+		t.Errorf("Incorrect finding: %s", lines[1])
+	}
+	if trailer.Type != recordTrailer || trailer.Status != "passed" || trailer.ErrorCode == nil || *trailer.ErrorCode != 0 ||
+		trailer.Findings != 2 || trailer.High != 1 || trailer.Fixable != 1 {
+		t.Errorf("Incorrect trailer: %s", lines[3])
+	}
+
+	// a scan not started has no error code
+	buf.Reset()
+	newJSONLScan(&jsonlWriter{w: &buf}, req, &onDemandOptions{}).end(nil, errors.New("insufficient disk space"), 0)
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"status":"failed","error_message":"insufficient disk space","phase":"setup"`) {
+		t.Errorf("Incorrect records of a failed scan: %s", buf.String())
+	}
+
+	// the findings are written when they are matched, before the scan ends, post-processed as the result
+	defer func(tools *cvetools.CveTools) { cveTools = tools }(cveTools)
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.SetIgnored([]string{"CVE-2021-3712"})
+	buf.Reset()
+	records := newJSONLScan(&jsonlWriter{w: &buf}, req, &onDemandOptions{})
+	matched := cvetools.NewScanReport(&share.ScanResult{Digest: "sha256:0123", Vuls: result.Vuls, Secrets: &share.ScanSecretResult{}})
+	cvetools.FindingsFromContext(records.withFindings(context.Background()))(matched)
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"name":"CVE-2022-0778"`) {
+		t.Fatalf("Incorrect records of the matched findings: %s", buf.String())
+	}
+	records.end(result, nil, time.Second)
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[2], `"type":"trailer"`) {
+		t.Errorf("Incorrect records after the matched findings: %s", buf.String())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/neuvector/neuvector/controller/api"
+	"github.com/neuvector/neuvector/share"
+	scanUtils "github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// the stdout formats of the on-demand scan
+const (
+	formatTable    = "table"
+	formatMarkdown = "markdown"
+	formatJSONL    = "jsonl"
+)
+
+const defaultTopFindings = 10
+
+// maxMarkdownSize keeps the report under the size limit of a merge request comment, 65536 characters on
+// github, the longest lists are truncated to fit
+const maxMarkdownSize = 60000
+
+func parseFormat(value string) (string, error) {
+	switch value {
+	case "", formatTable:
+		return formatTable, nil
+	case formatMarkdown, formatJSONL:
+		return value, nil
+	default:
+		return "", fmt.Errorf("Unsupported format %q, %s, %s or %s", value, formatTable, formatMarkdown, formatJSONL)
+	}
+}
+
+// markdownReport is a compact report of the scan for a merge request comment: the severity counts and the
+// top findings, the full lists are collapsed
+func markdownReport(req *share.ScanImageRequest, result *cvetools.ScanReport, opts *onDemandOptions) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Scan of `%s%s:%s`\n\n", req.Registry, req.Repository, req.Tag)
+	if result == nil {
+		b.WriteString("**Scan failed**\n")
+		return b.String()
+	} else if result.Error != share.ScanErrorCode_ScanErrNone {
+		msg := scanUtils.ScanErrorToStr(result.Error)
+		if result.ErrorMessage != "" {
+			msg = fmt.Sprintf("%s: %s", msg, result.ErrorMessage)
+		}
+		fmt.Fprintf(&b, "**Scan failed**: %s\n", mdEscape(msg))
+		return b.String()
+	}
+
+	rpt := scanUtils.ScanRepoResult2REST(result.ScanResult, nil)
+	if rpt.Digest != "" {
+		fmt.Fprintf(&b, "- Digest: `%s`\n", rpt.Digest)
+	}
+	if rpt.BaseOS != "" {
+		fmt.Fprintf(&b, "- Base OS: %s\n", mdEscape(rpt.BaseOS))
+	}
+	if cvetools.IsStaleImage(result, opts.maxImageAge) {
+		fmt.Fprintf(&b, "- Created: %s, older than %s\n", result.ImageCreated, opts.maxImageAge)
+	}
+	if sv := result.Signature; sv != nil {
+		if sv.Verified {
+			fmt.Fprintf(&b, "- Signature: verified by %s\n", mdEscape(sv.Signer))
+		} else {
+			fmt.Fprintf(&b, "- Signature: not verified, %s\n", mdEscape(sv.Error))
+		}
+	}
+
+	// the severities of -severity_source, the vulnerabilities are sorted again when it is not the vendor one
+	severities := make([]string, len(rpt.Vuls))
+	counts := make(map[string]int)
+	findings := opts.severities(result)
+	for i, v := range rpt.Vuls {
+		severity, disagree := findings.severity(v.Name, v.PackageName, v.Severity, v.Score, v.ScoreV3)
+		counts[severity]++
+		if severities[i] = severity; disagree {
+			severities[i] += "*"
+		}
+	}
+	b.WriteString("\n| Severity | Count |\n|---|---:|\n")
+	for _, sev := range []string{share.VulnSeverityCritical, share.VulnSeverityHigh, share.VulnSeverityMedium, share.VulnSeverityLow} {
+		fmt.Fprintf(&b, "| %s | %d |\n", sev, counts[sev])
+		delete(counts, sev)
+	}
+	var unknown int
+	for _, n := range counts {
+		unknown += n
+	}
+	fmt.Fprintf(&b, "| Unknown | %d |\n", unknown)
+
+	// the vulnerabilities are sorted by severity, the top ones come first
+	header := "| Vulnerability | Severity | Package | Version | Fixed Version |\n|---|---|---|---|---|\n"
+	order := make([]int, len(rpt.Vuls))
+	for i := range order {
+		order[i] = i
+	}
+	if opts.severitySource() != cvetools.SeveritySourceVendor {
+		sort.SliceStable(order, func(i, j int) bool {
+			return cvetools.SeverityRank(strings.TrimSuffix(severities[order[i]], "*")) > cvetools.SeverityRank(strings.TrimSuffix(severities[order[j]], "*"))
+		})
+	}
+	rows := make([]string, len(rpt.Vuls))
+	for i, k := range order {
+		rows[i] = mdVulRow(rpt.Vuls[k], severities[k])
+	}
+	if top := opts.topFindings; top > 0 && len(rows) > 0 {
+		if top > len(rows) {
+			top = len(rows)
+		}
+		fmt.Fprintf(&b, "\n**Top %d of %d findings**\n\n%s", top, len(rows), header)
+		for _, row := range rows[:top] {
+			b.WriteString(row)
+		}
+	}
+
+	// the secrets and the checks are short, the full list gets the rest of the space
+	var extra strings.Builder
+	if len(rpt.Secrets) > 0 {
+		secrets := make([]string, len(rpt.Secrets))
+		for i, s := range rpt.Secrets {
+			secrets[i] = fmt.Sprintf("| %s | `%s` | %s |\n", mdEscape(s.Type), mdEscape(s.File), mdEscape(s.Evidence))
+		}
+		mdDetails(&extra, fmt.Sprintf("Secrets (%d)", len(secrets)), "| Type | File | Evidence |\n|---|---|---|\n", secrets, maxMarkdownSize/8)
+	}
+	if len(result.Checks) > 0 {
+		checks := make([]string, len(result.Checks))
+		for i, c := range result.Checks {
+			checks[i] = fmt.Sprintf("| %s | %s | %s | %s |\n", c.ID, c.Severity, mdEscape(c.Description), mdEscape(c.Line))
+		}
+		mdDetails(&extra, fmt.Sprintf("Checks (%d)", len(checks)), "| ID | Severity | Description | History |\n|---|---|---|---|\n", checks, maxMarkdownSize/8)
+	}
+	if len(rows) > 0 {
+		mdDetails(&b, fmt.Sprintf("All %d findings", len(rows)), header, rows, maxMarkdownSize-b.Len()-extra.Len())
+	}
+	b.WriteString(extra.String())
+	return b.String()
+}
+
+// mdDetails writes a collapsed table of the rows that fit in the size, the rest are counted as omitted
+func mdDetails(b *strings.Builder, summary, header string, rows []string, size int) {
+	const omittedLine = "\n_%d more findings omitted_\n"
+	start := fmt.Sprintf("\n<details><summary>%s</summary>\n\n%s", summary, header)
+	const end = "\n</details>\n"
+	size -= len(start) + len(end) + len(omittedLine) + 10
+
+	b.WriteString(start)
+	var written int
+	for i, row := range rows {
+		if written+len(row) > size {
+			b.WriteString(fmt.Sprintf(omittedLine, len(rows)-i))
+			break
+		}
+		b.WriteString(row)
+		written += len(row)
+	}
+	b.WriteString(end)
+}
+
+func mdVulRow(v *api.RESTVulnerability, severity string) string {
+	name := mdEscape(v.Name)
+	if link := vulLink(v); link != "" {
+		name = fmt.Sprintf("[%s](%s)", name, link)
+	}
+	return fmt.Sprintf("| %s | %s | %s | %s | %s |\n", name, severity, mdEscape(v.PackageName), mdEscape(v.PackageVersion), mdEscape(v.FixedVersion))
+}
+
+// vulLink returns the link of the vulnerability in the database, or of the NVD for a CVE
+func vulLink(v *api.RESTVulnerability) string {
+	if strings.HasPrefix(v.Link, "https://") || strings.HasPrefix(v.Link, "http://") {
+		return v.Link
+	}
+	if strings.HasPrefix(v.Name, "CVE-") {
+		return "https://nvd.nist.gov/vuln/detail/" + v.Name
+	}
+	return ""
+}
+
+var mdReplacer = strings.NewReplacer("|", "\\|", "\n", " ", "\r", "", "<", "&lt;", ">", "&gt;")
+
+// mdEscape keeps a value in its table cell
+func mdEscape(s string) string {
+	return mdReplacer.Replace(s)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestMarkdownReport(t *testing.T) {
+	vuls := make([]*share.ScanVulnerability, 2000)
+	for i := range vuls {
+		vuls[i] = &share.ScanVulnerability{
+			Name: fmt.Sprintf("CVE-2023-%05d", i), Severity: share.VulnSeverityMedium, PackageName: "libfoo|bar", PackageVersion: "1.0",
+		}
+	}
+	vuls[0].Severity = share.VulnSeverityHigh
+	result := cvetools.NewScanReport(&share.ScanResult{Vuls: vuls, Secrets: &share.ScanSecretResult{}})
+	result.Checks = []*cvetools.ImageCheck{{ID: cvetools.CheckRootUser, Severity: share.VulnSeverityMedium, Description: "runs as root"}}
+	req := &share.ScanImageRequest{Registry: "https://registry.example.com/", Repository: "app", Tag: "1.0"}
+
+	md := markdownReport(req, result, &onDemandOptions{topFindings: 3})
+	if len(md) > maxMarkdownSize {
+		t.Errorf("Report too long: %d", len(md))
+	}
+	for _, s := range []string{
+		"| High | 1 |", "| Medium | 1999 |", "**Top 3 of 2000 findings**",
+		"| [CVE-2023-00000](https://nvd.nist.gov/vuln/detail/CVE-2023-00000) | High | libfoo\\|bar | 1.0 |  |",
+		"<details><summary>All 2000 findings</summary>", "more findings omitted_", "<details><summary>Checks (1)</summary>",
+	} {
+		if !strings.Contains(md, s) {
+			t.Errorf("Missing %q in the report:\n%s", s, md[:1000])
+		}
+	}
+
+	result.Error, result.ErrorMessage = share.ScanErrorCode_ScanErrSizeOverLimit, "Image size is over the limit"
+	if md = markdownReport(req, result, &onDemandOptions{}); !strings.Contains(md, "**Scan failed**") || strings.Contains(md, "Severity") {
+		t.Errorf("Incorrect failed scan report:\n%s", md)
+	}
+	if _, err := parseFormat("html"); err == nil {
+		t.Errorf("Unsupported format accepted")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// profileDir is the folder of -profile, the scanner tasks write their profiles there too
+var profileDir string
+
+// scanTiming is the timing file of -profile, with the sizes of the layers
+type scanTiming struct {
+	Image           string                  `json:"image"`
+	Digest          string                  `json:"digest,omitempty"`
+	Millis          int64                   `json:"millis"`
+	Error           string                  `json:"error,omitempty"`
+	Phases          []*cvetools.PhaseTiming `json:"phases,omitempty"`
+	ScratchEstimate int64                   `json:"scratch_estimate,omitempty"`
+	ScratchUsed     int64                   `json:"scratch_used,omitempty"`
+	ImageSize       *cvetools.ImageSize     `json:"image_size,omitempty"`
+	Profiles        []string                `json:"profiles,omitempty"`
+}
+
+// startScanProfile starts the profile of the scan of -profile, nil when disabled
+func startScanProfile() *cvetools.Profile {
+	if profileDir == "" {
+		return nil
+	}
+	profile, err := cvetools.StartProfile(profileDir, "")
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error()
+	}
+	return profile
+}
+
+// stopScanProfile writes the profiles and the timing of the scan, the files are named by the image digest
+func stopScanProfile(profile *cvetools.Profile, req *share.ScanImageRequest, result *cvetools.ScanReport, err error, elapsed time.Duration) {
+	if profileDir == "" {
+		return
+	}
+
+	image := req.Repository + ":" + req.Tag
+	timing := scanTiming{Image: image, Millis: elapsed.Milliseconds()}
+	if _, msg := scanFailure(result, err); msg != "" {
+		timing.Error = msg
+	}
+	if result != nil {
+		timing.Digest = result.Digest
+		timing.ImageSize = result.ImageSize
+		if result.Stats != nil {
+			timing.Phases = result.Stats.Phases
+			timing.ScratchEstimate, timing.ScratchUsed = result.Stats.ScratchEstimate, result.Stats.ScratchUsed
+		}
+	}
+	name := cvetools.ProfileName(timing.Digest, image)
+	timing.Profiles = profile.Stop(name)
+	if files, _ := filepath.Glob(filepath.Join(profileDir, name+".task.*.pprof")); len(files) > 0 {
+		timing.Profiles = append(timing.Profiles, files...)
+	}
+
+	file := filepath.Join(profileDir, name+".timing.json")
+	data, _ := json.MarshalIndent(&timing, "", "  ")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		log.WithFields(log.Fields{"error": err, "file": file}).Error("Failed to write the scan timing")
+		return
+	}
+	log.WithFields(log.Fields{"folder": profileDir, "name": name}).Info("Scan profiled")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestScanProfile(t *testing.T) {
+	// disabled, nothing is started
+	if profile := startScanProfile(); profile != nil {
+		t.Fatalf("Profile started without -profile")
+	}
+
+	profileDir = filepath.Join(t.TempDir(), "profiles")
+	defer func() { profileDir = "" }()
+
+	req := &share.ScanImageRequest{Repository: "library/app", Tag: "1.0"}
+	result := cvetools.NewScanReport(&share.ScanResult{Digest: "sha256:0123abcd"})
+	result.Stats = &cvetools.ScanStats{Phases: []*cvetools.PhaseTiming{{Phase: cvetools.PhaseDownload, Millis: 1200}}}
+	result.ImageSize = &cvetools.ImageSize{Layers: 1, Compressed: 1000, LayerSizes: []*cvetools.LayerSize{{Digest: "sha256:1", Compressed: 1000}}}
+
+	profile := startScanProfile()
+	if profile == nil {
+		t.Fatalf("Profile not started")
+	}
+	// the profiles of the scanner task are written beside
+	ioutil.WriteFile(filepath.Join(profileDir, "0123abcd.task.cpu.pprof"), []byte("cpu"), 0644)
+	stopScanProfile(profile, req, result, nil, 2*time.Second)
+
+	var timing scanTiming
+	data, err := ioutil.ReadFile(filepath.Join(profileDir, "0123abcd.timing.json"))
+	if err != nil || json.Unmarshal(data, &timing) != nil {
+		t.Fatalf("Failed to read the timing: %v", err)
+	}
+	if timing.Digest != "sha256:0123abcd" || timing.Millis != 2000 || len(timing.Phases) != 1 || len(timing.ImageSize.LayerSizes) != 1 {
+		t.Errorf("Incorrect timing: %+v", timing)
+	}
+	for _, name := range []string{"0123abcd.cpu.pprof", "0123abcd.heap.pprof", "0123abcd.task.cpu.pprof"} {
+		var found bool
+		for _, file := range timing.Profiles {
+			found = found || filepath.Base(file) == name
+		}
+		if info, err := os.Stat(filepath.Join(profileDir, name)); err != nil || info.Size() == 0 || !found {
+			t.Errorf("Missing profile %s: %v", name, err)
+		}
+	}
+
+	// a failed scan is named by the image
+	stopScanProfile(startScanProfile(), req, nil, errors.New("not found"), time.Second)
+	if _, err := os.Stat(filepath.Join(profileDir, "library_app_1.0.timing.json")); err != nil {
+		t.Errorf("Missing the timing of the failed scan: %v", err)
+	}
+}
@@ -0,0 +1,1438 @@
+// ScannerStreamService, served next to share.ScannerService. Run make proto after a change.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.26.0
+// 	protoc        (unknown)
+// source: scanner_stream_service.proto
+
+package rpc
+
+import (
+	context "context"
+	share "github.com/neuvector/neuvector/share"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// ScanImagePageRequest requests a page of vulnerabilities. Request is only needed for the first page.
+type ScanImagePageRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Request *share.ScanImageRequest `protobuf:"bytes,1,opt,name=Request,proto3" json:"Request,omitempty"`
+	ScanID  string                  `protobuf:"bytes,2,opt,name=ScanID,proto3" json:"ScanID,omitempty"`
+	Offset  uint32                  `protobuf:"varint,3,opt,name=Offset,proto3" json:"Offset,omitempty"`
+	Limit   uint32                  `protobuf:"varint,4,opt,name=Limit,proto3" json:"Limit,omitempty"`
+}
+
+func (x *ScanImagePageRequest) Reset() {
+	*x = ScanImagePageRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScanImagePageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanImagePageRequest) ProtoMessage() {}
+
+func (x *ScanImagePageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanImagePageRequest.ProtoReflect.Descriptor instead.
+func (*ScanImagePageRequest) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ScanImagePageRequest) GetRequest() *share.ScanImageRequest {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *ScanImagePageRequest) GetScanID() string {
+	if x != nil {
+		return x.ScanID
+	}
+	return ""
+}
+
+func (x *ScanImagePageRequest) GetOffset() uint32 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *ScanImagePageRequest) GetLimit() uint32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+// ScanResultPage is a page of vulnerabilities. The first page carries the image metadata and the total count.
+type ScanResultPage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Result *share.ScanResult `protobuf:"bytes,1,opt,name=Result,proto3" json:"Result,omitempty"`
+	ScanID string            `protobuf:"bytes,2,opt,name=ScanID,proto3" json:"ScanID,omitempty"`
+	Offset uint32            `protobuf:"varint,3,opt,name=Offset,proto3" json:"Offset,omitempty"`
+	Total  uint32            `protobuf:"varint,4,opt,name=Total,proto3" json:"Total,omitempty"`
+}
+
+func (x *ScanResultPage) Reset() {
+	*x = ScanResultPage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScanResultPage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanResultPage) ProtoMessage() {}
+
+func (x *ScanResultPage) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanResultPage.ProtoReflect.Descriptor instead.
+func (*ScanResultPage) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ScanResultPage) GetResult() *share.ScanResult {
+	if x != nil {
+		return x.Result
+	}
+	return nil
+}
+
+func (x *ScanResultPage) GetScanID() string {
+	if x != nil {
+		return x.ScanID
+	}
+	return ""
+}
+
+func (x *ScanResultPage) GetOffset() uint32 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *ScanResultPage) GetTotal() uint32 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+// ScanImageSummaryRequest requests the summary of an image scan, with at most Top vulnerabilities
+type ScanImageSummaryRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Request *share.ScanImageRequest `protobuf:"bytes,1,opt,name=Request,proto3" json:"Request,omitempty"`
+	Top     uint32                  `protobuf:"varint,2,opt,name=Top,proto3" json:"Top,omitempty"`
+}
+
+func (x *ScanImageSummaryRequest) Reset() {
+	*x = ScanImageSummaryRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScanImageSummaryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanImageSummaryRequest) ProtoMessage() {}
+
+func (x *ScanImageSummaryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanImageSummaryRequest.ProtoReflect.Descriptor instead.
+func (*ScanImageSummaryRequest) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ScanImageSummaryRequest) GetRequest() *share.ScanImageRequest {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *ScanImageSummaryRequest) GetTop() uint32 {
+	if x != nil {
+		return x.Top
+	}
+	return 0
+}
+
+// ScanResultSummary has the image metadata, the top vulnerabilities by severity and the count of each severity.
+// The layers and the modules are without their vulnerabilities. Give ScanID to ScanImagePage for the details.
+type ScanResultSummary struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Result   *share.ScanResult `protobuf:"bytes,1,opt,name=Result,proto3" json:"Result,omitempty"`
+	ScanID   string            `protobuf:"bytes,2,opt,name=ScanID,proto3" json:"ScanID,omitempty"`
+	Total    uint32            `protobuf:"varint,3,opt,name=Total,proto3" json:"Total,omitempty"`
+	Critical uint32            `protobuf:"varint,4,opt,name=Critical,proto3" json:"Critical,omitempty"`
+	High     uint32            `protobuf:"varint,5,opt,name=High,proto3" json:"High,omitempty"`
+	Medium   uint32            `protobuf:"varint,6,opt,name=Medium,proto3" json:"Medium,omitempty"`
+	Low      uint32            `protobuf:"varint,7,opt,name=Low,proto3" json:"Low,omitempty"`
+}
+
+func (x *ScanResultSummary) Reset() {
+	*x = ScanResultSummary{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScanResultSummary) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanResultSummary) ProtoMessage() {}
+
+func (x *ScanResultSummary) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanResultSummary.ProtoReflect.Descriptor instead.
+func (*ScanResultSummary) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ScanResultSummary) GetResult() *share.ScanResult {
+	if x != nil {
+		return x.Result
+	}
+	return nil
+}
+
+func (x *ScanResultSummary) GetScanID() string {
+	if x != nil {
+		return x.ScanID
+	}
+	return ""
+}
+
+func (x *ScanResultSummary) GetTotal() uint32 {
+	if x != nil {
+		return x.Total
+	}
+	return 0
+}
+
+func (x *ScanResultSummary) GetCritical() uint32 {
+	if x != nil {
+		return x.Critical
+	}
+	return 0
+}
+
+func (x *ScanResultSummary) GetHigh() uint32 {
+	if x != nil {
+		return x.High
+	}
+	return 0
+}
+
+func (x *ScanResultSummary) GetMedium() uint32 {
+	if x != nil {
+		return x.Medium
+	}
+	return 0
+}
+
+func (x *ScanResultSummary) GetLow() uint32 {
+	if x != nil {
+		return x.Low
+	}
+	return 0
+}
+
+// ScannerInfo is the database, the build, the features and the limits of the scanner
+type ScannerInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	CVEDBVersion    string        `protobuf:"bytes,1,opt,name=CVEDBVersion,proto3" json:"CVEDBVersion,omitempty"`
+	CVEDBCreateTime string        `protobuf:"bytes,2,opt,name=CVEDBCreateTime,proto3" json:"CVEDBCreateTime,omitempty"`
+	ScannerVersion  string        `protobuf:"bytes,3,opt,name=ScannerVersion,proto3" json:"ScannerVersion,omitempty"`
+	ScannerCommit   string        `protobuf:"bytes,4,opt,name=ScannerCommit,proto3" json:"ScannerCommit,omitempty"`
+	Features        []string      `protobuf:"bytes,5,rep,name=Features,proto3" json:"Features,omitempty"`
+	MaxImageSize    int64         `protobuf:"varint,6,opt,name=MaxImageSize,proto3" json:"MaxImageSize,omitempty"`      // bytes, 0 for no limit
+	ScanTimeout     uint64        `protobuf:"varint,7,opt,name=ScanTimeout,proto3" json:"ScanTimeout,omitempty"`        // seconds, 0 for no timeout
+	SiblingTags     uint32        `protobuf:"varint,8,opt,name=SiblingTags,proto3" json:"SiblingTags,omitempty"`        // 0 when disabled
+	MatchWorkers    uint32        `protobuf:"varint,9,opt,name=MatchWorkers,proto3" json:"MatchWorkers,omitempty"`      // goroutines matching an image
+	InflateWorkers  uint32        `protobuf:"varint,10,opt,name=InflateWorkers,proto3" json:"InflateWorkers,omitempty"` // goroutines of the layers of all the scans
+	MinFreeSpace    uint64        `protobuf:"varint,11,opt,name=MinFreeSpace,proto3" json:"MinFreeSpace,omitempty"`     // bytes, 0 when not checked
+	ScanTask        bool          `protobuf:"varint,12,opt,name=ScanTask,proto3" json:"ScanTask,omitempty"`             // the scans run in a scanner task
+	Usage           *ScannerUsage `protobuf:"bytes,13,opt,name=Usage,proto3" json:"Usage,omitempty"`
+}
+
+func (x *ScannerInfo) Reset() {
+	*x = ScannerInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScannerInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScannerInfo) ProtoMessage() {}
+
+func (x *ScannerInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScannerInfo.ProtoReflect.Descriptor instead.
+func (*ScannerInfo) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ScannerInfo) GetCVEDBVersion() string {
+	if x != nil {
+		return x.CVEDBVersion
+	}
+	return ""
+}
+
+func (x *ScannerInfo) GetCVEDBCreateTime() string {
+	if x != nil {
+		return x.CVEDBCreateTime
+	}
+	return ""
+}
+
+func (x *ScannerInfo) GetScannerVersion() string {
+	if x != nil {
+		return x.ScannerVersion
+	}
+	return ""
+}
+
+func (x *ScannerInfo) GetScannerCommit() string {
+	if x != nil {
+		return x.ScannerCommit
+	}
+	return ""
+}
+
+func (x *ScannerInfo) GetFeatures() []string {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+func (x *ScannerInfo) GetMaxImageSize() int64 {
+	if x != nil {
+		return x.MaxImageSize
+	}
+	return 0
+}
+
+func (x *ScannerInfo) GetScanTimeout() uint64 {
+	if x != nil {
+		return x.ScanTimeout
+	}
+	return 0
+}
+
+func (x *ScannerInfo) GetSiblingTags() uint32 {
+	if x != nil {
+		return x.SiblingTags
+	}
+	return 0
+}
+
+func (x *ScannerInfo) GetMatchWorkers() uint32 {
+	if x != nil {
+		return x.MatchWorkers
+	}
+	return 0
+}
+
+func (x *ScannerInfo) GetInflateWorkers() uint32 {
+	if x != nil {
+		return x.InflateWorkers
+	}
+	return 0
+}
+
+func (x *ScannerInfo) GetMinFreeSpace() uint64 {
+	if x != nil {
+		return x.MinFreeSpace
+	}
+	return 0
+}
+
+func (x *ScannerInfo) GetScanTask() bool {
+	if x != nil {
+		return x.ScanTask
+	}
+	return false
+}
+
+func (x *ScannerInfo) GetUsage() *ScannerUsage {
+	if x != nil {
+		return x.Usage
+	}
+	return nil
+}
+
+// ScannerUsage is the resource usage of the scanner when GetScannerInfo is called
+type ScannerUsage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	RSSBytes       int64   `protobuf:"varint,1,opt,name=RSSBytes,proto3" json:"RSSBytes,omitempty"`
+	CPUSeconds     float64 `protobuf:"fixed64,2,opt,name=CPUSeconds,proto3" json:"CPUSeconds,omitempty"`        // of the process and the scanner tasks
+	FreeBytes      uint64  `protobuf:"varint,3,opt,name=FreeBytes,proto3" json:"FreeBytes,omitempty"`           // under the image working path
+	UsedBytes      int64   `protobuf:"varint,4,opt,name=UsedBytes,proto3" json:"UsedBytes,omitempty"`           // under the image working path
+	ScansCompleted int64   `protobuf:"varint,5,opt,name=ScansCompleted,proto3" json:"ScansCompleted,omitempty"` // since the scanner started
+	ScansFailed    int64   `protobuf:"varint,6,opt,name=ScansFailed,proto3" json:"ScansFailed,omitempty"`
+}
+
+func (x *ScannerUsage) Reset() {
+	*x = ScannerUsage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScannerUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScannerUsage) ProtoMessage() {}
+
+func (x *ScannerUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScannerUsage.ProtoReflect.Descriptor instead.
+func (*ScannerUsage) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ScannerUsage) GetRSSBytes() int64 {
+	if x != nil {
+		return x.RSSBytes
+	}
+	return 0
+}
+
+func (x *ScannerUsage) GetCPUSeconds() float64 {
+	if x != nil {
+		return x.CPUSeconds
+	}
+	return 0
+}
+
+func (x *ScannerUsage) GetFreeBytes() uint64 {
+	if x != nil {
+		return x.FreeBytes
+	}
+	return 0
+}
+
+func (x *ScannerUsage) GetUsedBytes() int64 {
+	if x != nil {
+		return x.UsedBytes
+	}
+	return 0
+}
+
+func (x *ScannerUsage) GetScansCompleted() int64 {
+	if x != nil {
+		return x.ScansCompleted
+	}
+	return 0
+}
+
+func (x *ScannerUsage) GetScansFailed() int64 {
+	if x != nil {
+		return x.ScansFailed
+	}
+	return 0
+}
+
+// ScanPhaseStat is the aggregate time spent on a phase of the image scans since the scanner started
+type ScanPhaseStat struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Phase  string `protobuf:"bytes,1,opt,name=Phase,proto3" json:"Phase,omitempty"`
+	Count  uint64 `protobuf:"varint,2,opt,name=Count,proto3" json:"Count,omitempty"`
+	Millis uint64 `protobuf:"varint,3,opt,name=Millis,proto3" json:"Millis,omitempty"`
+	Bytes  uint64 `protobuf:"varint,4,opt,name=Bytes,proto3" json:"Bytes,omitempty"`
+}
+
+func (x *ScanPhaseStat) Reset() {
+	*x = ScanPhaseStat{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScanPhaseStat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanPhaseStat) ProtoMessage() {}
+
+func (x *ScanPhaseStat) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanPhaseStat.ProtoReflect.Descriptor instead.
+func (*ScanPhaseStat) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ScanPhaseStat) GetPhase() string {
+	if x != nil {
+		return x.Phase
+	}
+	return ""
+}
+
+func (x *ScanPhaseStat) GetCount() uint64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *ScanPhaseStat) GetMillis() uint64 {
+	if x != nil {
+		return x.Millis
+	}
+	return 0
+}
+
+func (x *ScanPhaseStat) GetBytes() uint64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+type ScanPhaseStats struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Phases []*ScanPhaseStat `protobuf:"bytes,1,rep,name=Phases,proto3" json:"Phases,omitempty"`
+}
+
+func (x *ScanPhaseStats) Reset() {
+	*x = ScanPhaseStats{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScanPhaseStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanPhaseStats) ProtoMessage() {}
+
+func (x *ScanPhaseStats) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanPhaseStats.ProtoReflect.Descriptor instead.
+func (*ScanPhaseStats) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ScanPhaseStats) GetPhases() []*ScanPhaseStat {
+	if x != nil {
+		return x.Phases
+	}
+	return nil
+}
+
+// ScanProgress is a message of ScanImageProgress, the progress of the scan, or a part of the result when Result is set
+type ScanProgress struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Phase       string            `protobuf:"bytes,1,opt,name=Phase,proto3" json:"Phase,omitempty"`
+	Done        bool              `protobuf:"varint,2,opt,name=Done,proto3" json:"Done,omitempty"`
+	Millis      uint64            `protobuf:"varint,3,opt,name=Millis,proto3" json:"Millis,omitempty"`           // the time of the phase, when done
+	Layers      uint32            `protobuf:"varint,4,opt,name=Layers,proto3" json:"Layers,omitempty"`           // downloaded
+	TotalLayers uint32            `protobuf:"varint,5,opt,name=TotalLayers,proto3" json:"TotalLayers,omitempty"` // to download
+	Bytes       uint64            `protobuf:"varint,6,opt,name=Bytes,proto3" json:"Bytes,omitempty"`             // downloaded, compressed
+	TotalBytes  uint64            `protobuf:"varint,7,opt,name=TotalBytes,proto3" json:"TotalBytes,omitempty"`   // to download, compressed
+	Findings    uint32            `protobuf:"varint,8,opt,name=Findings,proto3" json:"Findings,omitempty"`       // vulnerabilities found, once matched
+	Result      *share.ScanResult `protobuf:"bytes,9,opt,name=Result,proto3" json:"Result,omitempty"`
+}
+
+func (x *ScanProgress) Reset() {
+	*x = ScanProgress{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_scanner_stream_service_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ScanProgress) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ScanProgress) ProtoMessage() {}
+
+func (x *ScanProgress) ProtoReflect() protoreflect.Message {
+	mi := &file_scanner_stream_service_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ScanProgress.ProtoReflect.Descriptor instead.
+func (*ScanProgress) Descriptor() ([]byte, []int) {
+	return file_scanner_stream_service_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ScanProgress) GetPhase() string {
+	if x != nil {
+		return x.Phase
+	}
+	return ""
+}
+
+func (x *ScanProgress) GetDone() bool {
+	if x != nil {
+		return x.Done
+	}
+	return false
+}
+
+func (x *ScanProgress) GetMillis() uint64 {
+	if x != nil {
+		return x.Millis
+	}
+	return 0
+}
+
+func (x *ScanProgress) GetLayers() uint32 {
+	if x != nil {
+		return x.Layers
+	}
+	return 0
+}
+
+func (x *ScanProgress) GetTotalLayers() uint32 {
+	if x != nil {
+		return x.TotalLayers
+	}
+	return 0
+}
+
+func (x *ScanProgress) GetBytes() uint64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+func (x *ScanProgress) GetTotalBytes() uint64 {
+	if x != nil {
+		return x.TotalBytes
+	}
+	return 0
+}
+
+func (x *ScanProgress) GetFindings() uint32 {
+	if x != nil {
+		return x.Findings
+	}
+	return 0
+}
+
+func (x *ScanProgress) GetResult() *share.ScanResult {
+	if x != nil {
+		return x.Result
+	}
+	return nil
+}
+
+var File_scanner_stream_service_proto protoreflect.FileDescriptor
+
+var file_scanner_stream_service_proto_rawDesc = []byte{
+	0x0a, 0x1c, 0x73, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72, 0x5f, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x5f, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05,
+	0x73, 0x68, 0x61, 0x72, 0x65, 0x1a, 0x0c, 0x63, 0x6f, 0x6d, 0x6d, 0x6f, 0x6e, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x1a, 0x0a, 0x73, 0x63, 0x61, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a,
+	0x15, 0x73, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72, 0x5f, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x8f, 0x01, 0x0a, 0x14, 0x53, 0x63, 0x61, 0x6e, 0x49,
+	0x6d, 0x61, 0x67, 0x65, 0x50, 0x61, 0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x31, 0x0a, 0x07, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x17, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x6d, 0x61,
+	0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x52, 0x07, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x44, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x06, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x44, 0x12, 0x16, 0x0a, 0x06, 0x4f, 0x66,
+	0x66, 0x73, 0x65, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x4f, 0x66, 0x66, 0x73,
+	0x65, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x05, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x22, 0x81, 0x01, 0x0a, 0x0e, 0x53, 0x63, 0x61,
+	0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x50, 0x61, 0x67, 0x65, 0x12, 0x29, 0x0a, 0x06, 0x52,
+	0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x73, 0x68,
+	0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x52, 0x06,
+	0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x44,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x44, 0x12, 0x16,
+	0x0a, 0x06, 0x4f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06,
+	0x4f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x22, 0x5e, 0x0a, 0x17,
+	0x53, 0x63, 0x61, 0x6e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x53, 0x75, 0x6d, 0x6d, 0x61, 0x72, 0x79,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x31, 0x0a, 0x07, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65,
+	0x2e, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x52, 0x07, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x54, 0x6f,
+	0x70, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x03, 0x54, 0x6f, 0x70, 0x22, 0xc6, 0x01, 0x0a,
+	0x11, 0x53, 0x63, 0x61, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x53, 0x75, 0x6d, 0x6d, 0x61,
+	0x72, 0x79, 0x12, 0x29, 0x0a, 0x06, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x11, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x52,
+	0x65, 0x73, 0x75, 0x6c, 0x74, 0x52, 0x06, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x16, 0x0a,
+	0x06, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x44, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x53,
+	0x63, 0x61, 0x6e, 0x49, 0x44, 0x12, 0x14, 0x0a, 0x05, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x12, 0x1a, 0x0a, 0x08, 0x43,
+	0x72, 0x69, 0x74, 0x69, 0x63, 0x61, 0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x43,
+	0x72, 0x69, 0x74, 0x69, 0x63, 0x61, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x48, 0x69, 0x67, 0x68, 0x18,
+	0x05, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x48, 0x69, 0x67, 0x68, 0x12, 0x16, 0x0a, 0x06, 0x4d,
+	0x65, 0x64, 0x69, 0x75, 0x6d, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x4d, 0x65, 0x64,
+	0x69, 0x75, 0x6d, 0x12, 0x10, 0x0a, 0x03, 0x4c, 0x6f, 0x77, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x03, 0x4c, 0x6f, 0x77, 0x22, 0xe4, 0x03, 0x0a, 0x0b, 0x53, 0x63, 0x61, 0x6e, 0x6e, 0x65,
+	0x72, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x22, 0x0a, 0x0c, 0x43, 0x56, 0x45, 0x44, 0x42, 0x56, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x43, 0x56, 0x45,
+	0x44, 0x42, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x28, 0x0a, 0x0f, 0x43, 0x56, 0x45,
+	0x44, 0x42, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x54, 0x69, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0f, 0x43, 0x56, 0x45, 0x44, 0x42, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x54,
+	0x69, 0x6d, 0x65, 0x12, 0x26, 0x0a, 0x0e, 0x53, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72, 0x56, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0e, 0x53, 0x63, 0x61,
+	0x6e, 0x6e, 0x65, 0x72, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x24, 0x0a, 0x0d, 0x53,
+	0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72, 0x43, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0d, 0x53, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72, 0x43, 0x6f, 0x6d, 0x6d, 0x69,
+	0x74, 0x12, 0x1a, 0x0a, 0x08, 0x46, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x05, 0x20,
+	0x03, 0x28, 0x09, 0x52, 0x08, 0x46, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x12, 0x22, 0x0a,
+	0x0c, 0x4d, 0x61, 0x78, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x53, 0x69, 0x7a, 0x65, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x0c, 0x4d, 0x61, 0x78, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x53, 0x69, 0x7a,
+	0x65, 0x12, 0x20, 0x0a, 0x0b, 0x53, 0x63, 0x61, 0x6e, 0x54, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74,
+	0x18, 0x07, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0b, 0x53, 0x63, 0x61, 0x6e, 0x54, 0x69, 0x6d, 0x65,
+	0x6f, 0x75, 0x74, 0x12, 0x20, 0x0a, 0x0b, 0x53, 0x69, 0x62, 0x6c, 0x69, 0x6e, 0x67, 0x54, 0x61,
+	0x67, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x53, 0x69, 0x62, 0x6c, 0x69, 0x6e,
+	0x67, 0x54, 0x61, 0x67, 0x73, 0x12, 0x22, 0x0a, 0x0c, 0x4d, 0x61, 0x74, 0x63, 0x68, 0x57, 0x6f,
+	0x72, 0x6b, 0x65, 0x72, 0x73, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0c, 0x4d, 0x61, 0x74,
+	0x63, 0x68, 0x57, 0x6f, 0x72, 0x6b, 0x65, 0x72, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x49, 0x6e, 0x66,
+	0x6c, 0x61, 0x74, 0x65, 0x57, 0x6f, 0x72, 0x6b, 0x65, 0x72, 0x73, 0x18, 0x0a, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x0e, 0x49, 0x6e, 0x66, 0x6c, 0x61, 0x74, 0x65, 0x57, 0x6f, 0x72, 0x6b, 0x65, 0x72,
+	0x73, 0x12, 0x22, 0x0a, 0x0c, 0x4d, 0x69, 0x6e, 0x46, 0x72, 0x65, 0x65, 0x53, 0x70, 0x61, 0x63,
+	0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0c, 0x4d, 0x69, 0x6e, 0x46, 0x72, 0x65, 0x65,
+	0x53, 0x70, 0x61, 0x63, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x53, 0x63, 0x61, 0x6e, 0x54, 0x61, 0x73,
+	0x6b, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x53, 0x63, 0x61, 0x6e, 0x54, 0x61, 0x73,
+	0x6b, 0x12, 0x29, 0x0a, 0x05, 0x55, 0x73, 0x61, 0x67, 0x65, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x13, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72,
+	0x55, 0x73, 0x61, 0x67, 0x65, 0x52, 0x05, 0x55, 0x73, 0x61, 0x67, 0x65, 0x22, 0xd0, 0x01, 0x0a,
+	0x0c, 0x53, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72, 0x55, 0x73, 0x61, 0x67, 0x65, 0x12, 0x1a, 0x0a,
+	0x08, 0x52, 0x53, 0x53, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x08, 0x52, 0x53, 0x53, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x43, 0x50, 0x55,
+	0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0a, 0x43,
+	0x50, 0x55, 0x53, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x46, 0x72, 0x65,
+	0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x46, 0x72,
+	0x65, 0x65, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1c, 0x0a, 0x09, 0x55, 0x73, 0x65, 0x64, 0x42,
+	0x79, 0x74, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x55, 0x73, 0x65, 0x64,
+	0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x53, 0x63, 0x61, 0x6e, 0x73, 0x43, 0x6f,
+	0x6d, 0x70, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x53,
+	0x63, 0x61, 0x6e, 0x73, 0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x65, 0x64, 0x12, 0x20, 0x0a,
+	0x0b, 0x53, 0x63, 0x61, 0x6e, 0x73, 0x46, 0x61, 0x69, 0x6c, 0x65, 0x64, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x0b, 0x53, 0x63, 0x61, 0x6e, 0x73, 0x46, 0x61, 0x69, 0x6c, 0x65, 0x64, 0x22,
+	0x69, 0x0a, 0x0d, 0x53, 0x63, 0x61, 0x6e, 0x50, 0x68, 0x61, 0x73, 0x65, 0x53, 0x74, 0x61, 0x74,
+	0x12, 0x14, 0x0a, 0x05, 0x50, 0x68, 0x61, 0x73, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x50, 0x68, 0x61, 0x73, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x43, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x16, 0x0a, 0x06,
+	0x4d, 0x69, 0x6c, 0x6c, 0x69, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x4d, 0x69,
+	0x6c, 0x6c, 0x69, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x04, 0x52, 0x05, 0x42, 0x79, 0x74, 0x65, 0x73, 0x22, 0x3e, 0x0a, 0x0e, 0x53, 0x63,
+	0x61, 0x6e, 0x50, 0x68, 0x61, 0x73, 0x65, 0x53, 0x74, 0x61, 0x74, 0x73, 0x12, 0x2c, 0x0a, 0x06,
+	0x50, 0x68, 0x61, 0x73, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x73,
+	0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x50, 0x68, 0x61, 0x73, 0x65, 0x53, 0x74,
+	0x61, 0x74, 0x52, 0x06, 0x50, 0x68, 0x61, 0x73, 0x65, 0x73, 0x22, 0x87, 0x02, 0x0a, 0x0c, 0x53,
+	0x63, 0x61, 0x6e, 0x50, 0x72, 0x6f, 0x67, 0x72, 0x65, 0x73, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x50,
+	0x68, 0x61, 0x73, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x50, 0x68, 0x61, 0x73,
+	0x65, 0x12, 0x12, 0x0a, 0x04, 0x44, 0x6f, 0x6e, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52,
+	0x04, 0x44, 0x6f, 0x6e, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x4d, 0x69, 0x6c, 0x6c, 0x69, 0x73, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06, 0x4d, 0x69, 0x6c, 0x6c, 0x69, 0x73, 0x12, 0x16, 0x0a,
+	0x06, 0x4c, 0x61, 0x79, 0x65, 0x72, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x4c,
+	0x61, 0x79, 0x65, 0x72, 0x73, 0x12, 0x20, 0x0a, 0x0b, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x4c, 0x61,
+	0x79, 0x65, 0x72, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x54, 0x6f, 0x74, 0x61,
+	0x6c, 0x4c, 0x61, 0x79, 0x65, 0x72, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x42, 0x79, 0x74, 0x65, 0x73,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1e, 0x0a,
+	0x0a, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x42, 0x79, 0x74, 0x65, 0x73, 0x18, 0x07, 0x20, 0x01, 0x28,
+	0x04, 0x52, 0x0a, 0x54, 0x6f, 0x74, 0x61, 0x6c, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x1a, 0x0a,
+	0x08, 0x46, 0x69, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x08, 0x46, 0x69, 0x6e, 0x64, 0x69, 0x6e, 0x67, 0x73, 0x12, 0x29, 0x0a, 0x06, 0x52, 0x65, 0x73,
+	0x75, 0x6c, 0x74, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x73, 0x68, 0x61, 0x72,
+	0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x52, 0x06, 0x52, 0x65,
+	0x73, 0x75, 0x6c, 0x74, 0x32, 0x9d, 0x03, 0x0a, 0x14, 0x53, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72,
+	0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x3f, 0x0a,
+	0x0f, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x12, 0x17, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x6d, 0x61,
+	0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x11, 0x2e, 0x73, 0x68, 0x61, 0x72,
+	0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x30, 0x01, 0x12, 0x43,
+	0x0a, 0x11, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x50, 0x72, 0x6f, 0x67, 0x72,
+	0x65, 0x73, 0x73, 0x12, 0x17, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e,
+	0x49, 0x6d, 0x61, 0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x13, 0x2e, 0x73,
+	0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x50, 0x72, 0x6f, 0x67, 0x72, 0x65, 0x73,
+	0x73, 0x30, 0x01, 0x12, 0x43, 0x0a, 0x0d, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x6d, 0x61, 0x67, 0x65,
+	0x50, 0x61, 0x67, 0x65, 0x12, 0x1b, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61,
+	0x6e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x50, 0x61, 0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x15, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x52, 0x65,
+	0x73, 0x75, 0x6c, 0x74, 0x50, 0x61, 0x67, 0x65, 0x12, 0x4c, 0x0a, 0x10, 0x53, 0x63, 0x61, 0x6e,
+	0x49, 0x6d, 0x61, 0x67, 0x65, 0x53, 0x75, 0x6d, 0x6d, 0x61, 0x72, 0x79, 0x12, 0x1e, 0x2e, 0x73,
+	0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x49, 0x6d, 0x61, 0x67, 0x65, 0x53, 0x75,
+	0x6d, 0x6d, 0x61, 0x72, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x73,
+	0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x53,
+	0x75, 0x6d, 0x6d, 0x61, 0x72, 0x79, 0x12, 0x36, 0x0a, 0x0d, 0x47, 0x65, 0x74, 0x50, 0x68, 0x61,
+	0x73, 0x65, 0x53, 0x74, 0x61, 0x74, 0x73, 0x12, 0x0e, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e,
+	0x52, 0x50, 0x43, 0x56, 0x6f, 0x69, 0x64, 0x1a, 0x15, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e,
+	0x53, 0x63, 0x61, 0x6e, 0x50, 0x68, 0x61, 0x73, 0x65, 0x53, 0x74, 0x61, 0x74, 0x73, 0x12, 0x34,
+	0x0a, 0x0e, 0x47, 0x65, 0x74, 0x53, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72, 0x49, 0x6e, 0x66, 0x6f,
+	0x12, 0x0e, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x52, 0x50, 0x43, 0x56, 0x6f, 0x69, 0x64,
+	0x1a, 0x12, 0x2e, 0x73, 0x68, 0x61, 0x72, 0x65, 0x2e, 0x53, 0x63, 0x61, 0x6e, 0x6e, 0x65, 0x72,
+	0x49, 0x6e, 0x66, 0x6f, 0x42, 0x22, 0x5a, 0x20, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63,
+	0x6f, 0x6d, 0x2f, 0x6e, 0x65, 0x75, 0x76, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x2f, 0x73, 0x63, 0x61,
+	0x6e, 0x6e, 0x65, 0x72, 0x2f, 0x72, 0x70, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_scanner_stream_service_proto_rawDescOnce sync.Once
+	file_scanner_stream_service_proto_rawDescData = file_scanner_stream_service_proto_rawDesc
+)
+
+func file_scanner_stream_service_proto_rawDescGZIP() []byte {
+	file_scanner_stream_service_proto_rawDescOnce.Do(func() {
+		file_scanner_stream_service_proto_rawDescData = protoimpl.X.CompressGZIP(file_scanner_stream_service_proto_rawDescData)
+	})
+	return file_scanner_stream_service_proto_rawDescData
+}
+
+var file_scanner_stream_service_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_scanner_stream_service_proto_goTypes = []interface{}{
+	(*ScanImagePageRequest)(nil),    // 0: share.ScanImagePageRequest
+	(*ScanResultPage)(nil),          // 1: share.ScanResultPage
+	(*ScanImageSummaryRequest)(nil), // 2: share.ScanImageSummaryRequest
+	(*ScanResultSummary)(nil),       // 3: share.ScanResultSummary
+	(*ScannerInfo)(nil),             // 4: share.ScannerInfo
+	(*ScannerUsage)(nil),            // 5: share.ScannerUsage
+	(*ScanPhaseStat)(nil),           // 6: share.ScanPhaseStat
+	(*ScanPhaseStats)(nil),          // 7: share.ScanPhaseStats
+	(*ScanProgress)(nil),            // 8: share.ScanProgress
+	(*share.ScanImageRequest)(nil),  // 9: share.ScanImageRequest
+	(*share.ScanResult)(nil),        // 10: share.ScanResult
+	(*share.RPCVoid)(nil),           // 11: share.RPCVoid
+}
+var file_scanner_stream_service_proto_depIdxs = []int32{
+	9,  // 0: share.ScanImagePageRequest.Request:type_name -> share.ScanImageRequest
+	10, // 1: share.ScanResultPage.Result:type_name -> share.ScanResult
+	9,  // 2: share.ScanImageSummaryRequest.Request:type_name -> share.ScanImageRequest
+	10, // 3: share.ScanResultSummary.Result:type_name -> share.ScanResult
+	5,  // 4: share.ScannerInfo.Usage:type_name -> share.ScannerUsage
+	6,  // 5: share.ScanPhaseStats.Phases:type_name -> share.ScanPhaseStat
+	10, // 6: share.ScanProgress.Result:type_name -> share.ScanResult
+	9,  // 7: share.ScannerStreamService.ScanImageStream:input_type -> share.ScanImageRequest
+	9,  // 8: share.ScannerStreamService.ScanImageProgress:input_type -> share.ScanImageRequest
+	0,  // 9: share.ScannerStreamService.ScanImagePage:input_type -> share.ScanImagePageRequest
+	2,  // 10: share.ScannerStreamService.ScanImageSummary:input_type -> share.ScanImageSummaryRequest
+	11, // 11: share.ScannerStreamService.GetPhaseStats:input_type -> share.RPCVoid
+	11, // 12: share.ScannerStreamService.GetScannerInfo:input_type -> share.RPCVoid
+	10, // 13: share.ScannerStreamService.ScanImageStream:output_type -> share.ScanResult
+	8,  // 14: share.ScannerStreamService.ScanImageProgress:output_type -> share.ScanProgress
+	1,  // 15: share.ScannerStreamService.ScanImagePage:output_type -> share.ScanResultPage
+	3,  // 16: share.ScannerStreamService.ScanImageSummary:output_type -> share.ScanResultSummary
+	7,  // 17: share.ScannerStreamService.GetPhaseStats:output_type -> share.ScanPhaseStats
+	4,  // 18: share.ScannerStreamService.GetScannerInfo:output_type -> share.ScannerInfo
+	13, // [13:19] is the sub-list for method output_type
+	7,  // [7:13] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_scanner_stream_service_proto_init() }
+func file_scanner_stream_service_proto_init() {
+	if File_scanner_stream_service_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_scanner_stream_service_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScanImagePageRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_scanner_stream_service_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScanResultPage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_scanner_stream_service_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScanImageSummaryRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_scanner_stream_service_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScanResultSummary); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_scanner_stream_service_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScannerInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_scanner_stream_service_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScannerUsage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_scanner_stream_service_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScanPhaseStat); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_scanner_stream_service_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScanPhaseStats); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_scanner_stream_service_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ScanProgress); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_scanner_stream_service_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_scanner_stream_service_proto_goTypes,
+		DependencyIndexes: file_scanner_stream_service_proto_depIdxs,
+		MessageInfos:      file_scanner_stream_service_proto_msgTypes,
+	}.Build()
+	File_scanner_stream_service_proto = out.File
+	file_scanner_stream_service_proto_rawDesc = nil
+	file_scanner_stream_service_proto_goTypes = nil
+	file_scanner_stream_service_proto_depIdxs = nil
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// ScannerStreamServiceClient is the client API for ScannerStreamService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ScannerStreamServiceClient interface {
+	ScanImageStream(ctx context.Context, in *share.ScanImageRequest, opts ...grpc.CallOption) (ScannerStreamService_ScanImageStreamClient, error)
+	ScanImageProgress(ctx context.Context, in *share.ScanImageRequest, opts ...grpc.CallOption) (ScannerStreamService_ScanImageProgressClient, error)
+	ScanImagePage(ctx context.Context, in *ScanImagePageRequest, opts ...grpc.CallOption) (*ScanResultPage, error)
+	ScanImageSummary(ctx context.Context, in *ScanImageSummaryRequest, opts ...grpc.CallOption) (*ScanResultSummary, error)
+	GetPhaseStats(ctx context.Context, in *share.RPCVoid, opts ...grpc.CallOption) (*ScanPhaseStats, error)
+	GetScannerInfo(ctx context.Context, in *share.RPCVoid, opts ...grpc.CallOption) (*ScannerInfo, error)
+}
+
+type scannerStreamServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewScannerStreamServiceClient(cc grpc.ClientConnInterface) ScannerStreamServiceClient {
+	return &scannerStreamServiceClient{cc}
+}
+
+func (c *scannerStreamServiceClient) ScanImageStream(ctx context.Context, in *share.ScanImageRequest, opts ...grpc.CallOption) (ScannerStreamService_ScanImageStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ScannerStreamService_serviceDesc.Streams[0], "/share.ScannerStreamService/ScanImageStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &scannerStreamServiceScanImageStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ScannerStreamService_ScanImageStreamClient interface {
+	Recv() (*share.ScanResult, error)
+	grpc.ClientStream
+}
+
+type scannerStreamServiceScanImageStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *scannerStreamServiceScanImageStreamClient) Recv() (*share.ScanResult, error) {
+	m := new(share.ScanResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *scannerStreamServiceClient) ScanImageProgress(ctx context.Context, in *share.ScanImageRequest, opts ...grpc.CallOption) (ScannerStreamService_ScanImageProgressClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ScannerStreamService_serviceDesc.Streams[1], "/share.ScannerStreamService/ScanImageProgress", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &scannerStreamServiceScanImageProgressClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ScannerStreamService_ScanImageProgressClient interface {
+	Recv() (*ScanProgress, error)
+	grpc.ClientStream
+}
+
+type scannerStreamServiceScanImageProgressClient struct {
+	grpc.ClientStream
+}
+
+func (x *scannerStreamServiceScanImageProgressClient) Recv() (*ScanProgress, error) {
+	m := new(ScanProgress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *scannerStreamServiceClient) ScanImagePage(ctx context.Context, in *ScanImagePageRequest, opts ...grpc.CallOption) (*ScanResultPage, error) {
+	out := new(ScanResultPage)
+	err := c.cc.Invoke(ctx, "/share.ScannerStreamService/ScanImagePage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scannerStreamServiceClient) ScanImageSummary(ctx context.Context, in *ScanImageSummaryRequest, opts ...grpc.CallOption) (*ScanResultSummary, error) {
+	out := new(ScanResultSummary)
+	err := c.cc.Invoke(ctx, "/share.ScannerStreamService/ScanImageSummary", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scannerStreamServiceClient) GetPhaseStats(ctx context.Context, in *share.RPCVoid, opts ...grpc.CallOption) (*ScanPhaseStats, error) {
+	out := new(ScanPhaseStats)
+	err := c.cc.Invoke(ctx, "/share.ScannerStreamService/GetPhaseStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scannerStreamServiceClient) GetScannerInfo(ctx context.Context, in *share.RPCVoid, opts ...grpc.CallOption) (*ScannerInfo, error) {
+	out := new(ScannerInfo)
+	err := c.cc.Invoke(ctx, "/share.ScannerStreamService/GetScannerInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ScannerStreamServiceServer is the server API for ScannerStreamService service.
+type ScannerStreamServiceServer interface {
+	ScanImageStream(*share.ScanImageRequest, ScannerStreamService_ScanImageStreamServer) error
+	ScanImageProgress(*share.ScanImageRequest, ScannerStreamService_ScanImageProgressServer) error
+	ScanImagePage(context.Context, *ScanImagePageRequest) (*ScanResultPage, error)
+	ScanImageSummary(context.Context, *ScanImageSummaryRequest) (*ScanResultSummary, error)
+	GetPhaseStats(context.Context, *share.RPCVoid) (*ScanPhaseStats, error)
+	GetScannerInfo(context.Context, *share.RPCVoid) (*ScannerInfo, error)
+}
+
+// UnimplementedScannerStreamServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedScannerStreamServiceServer struct {
+}
+
+func (*UnimplementedScannerStreamServiceServer) ScanImageStream(*share.ScanImageRequest, ScannerStreamService_ScanImageStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ScanImageStream not implemented")
+}
+func (*UnimplementedScannerStreamServiceServer) ScanImageProgress(*share.ScanImageRequest, ScannerStreamService_ScanImageProgressServer) error {
+	return status.Errorf(codes.Unimplemented, "method ScanImageProgress not implemented")
+}
+func (*UnimplementedScannerStreamServiceServer) ScanImagePage(context.Context, *ScanImagePageRequest) (*ScanResultPage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ScanImagePage not implemented")
+}
+func (*UnimplementedScannerStreamServiceServer) ScanImageSummary(context.Context, *ScanImageSummaryRequest) (*ScanResultSummary, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ScanImageSummary not implemented")
+}
+func (*UnimplementedScannerStreamServiceServer) GetPhaseStats(context.Context, *share.RPCVoid) (*ScanPhaseStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPhaseStats not implemented")
+}
+func (*UnimplementedScannerStreamServiceServer) GetScannerInfo(context.Context, *share.RPCVoid) (*ScannerInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetScannerInfo not implemented")
+}
+
+func RegisterScannerStreamServiceServer(s *grpc.Server, srv ScannerStreamServiceServer) {
+	s.RegisterService(&_ScannerStreamService_serviceDesc, srv)
+}
+
+func _ScannerStreamService_ScanImageStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(share.ScanImageRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ScannerStreamServiceServer).ScanImageStream(m, &scannerStreamServiceScanImageStreamServer{stream})
+}
+
+type ScannerStreamService_ScanImageStreamServer interface {
+	Send(*share.ScanResult) error
+	grpc.ServerStream
+}
+
+type scannerStreamServiceScanImageStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *scannerStreamServiceScanImageStreamServer) Send(m *share.ScanResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ScannerStreamService_ScanImageProgress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(share.ScanImageRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ScannerStreamServiceServer).ScanImageProgress(m, &scannerStreamServiceScanImageProgressServer{stream})
+}
+
+type ScannerStreamService_ScanImageProgressServer interface {
+	Send(*ScanProgress) error
+	grpc.ServerStream
+}
+
+type scannerStreamServiceScanImageProgressServer struct {
+	grpc.ServerStream
+}
+
+func (x *scannerStreamServiceScanImageProgressServer) Send(m *ScanProgress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ScannerStreamService_ScanImagePage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScanImagePageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerStreamServiceServer).ScanImagePage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/share.ScannerStreamService/ScanImagePage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerStreamServiceServer).ScanImagePage(ctx, req.(*ScanImagePageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScannerStreamService_ScanImageSummary_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScanImageSummaryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerStreamServiceServer).ScanImageSummary(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/share.ScannerStreamService/ScanImageSummary",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerStreamServiceServer).ScanImageSummary(ctx, req.(*ScanImageSummaryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScannerStreamService_GetPhaseStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(share.RPCVoid)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerStreamServiceServer).GetPhaseStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/share.ScannerStreamService/GetPhaseStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerStreamServiceServer).GetPhaseStats(ctx, req.(*share.RPCVoid))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScannerStreamService_GetScannerInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(share.RPCVoid)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScannerStreamServiceServer).GetScannerInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/share.ScannerStreamService/GetScannerInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScannerStreamServiceServer).GetScannerInfo(ctx, req.(*share.RPCVoid))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _ScannerStreamService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "share.ScannerStreamService",
+	HandlerType: (*ScannerStreamServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ScanImagePage",
+			Handler:    _ScannerStreamService_ScanImagePage_Handler,
+		},
+		{
+			MethodName: "ScanImageSummary",
+			Handler:    _ScannerStreamService_ScanImageSummary_Handler,
+		},
+		{
+			MethodName: "GetPhaseStats",
+			Handler:    _ScannerStreamService_GetPhaseStats_Handler,
+		},
+		{
+			MethodName: "GetScannerInfo",
+			Handler:    _ScannerStreamService_GetScannerInfo_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ScanImageStream",
+			Handler:       _ScannerStreamService_ScanImageStream_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ScanImageProgress",
+			Handler:       _ScannerStreamService_ScanImageProgress_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "scanner_stream_service.proto",
+}
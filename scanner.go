@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -24,14 +32,162 @@ import (
 	"github.com/neuvector/scanner/cvetools"
 )
 
+// the exit codes, so that a pipeline can tell the cause of a failure
+const (
+	exitUsage       = 2 // invalid options
+	exitDBError     = 3 // the CVE database can't be read
+	exitScanError   = 4 // the scan failed in the strict mode
+	exitViolation   = 5 // the image violates the policy, like no verified signature with -fail_on_unsigned
+	exitSystemError = 6 // unsupported system, the controller address can't be resolved or its certificates don't verify, or the working path can't be cleaned up
+	exitOutputError = 7 // the result can't be written to the output file
+	exitSubmitError = 8 // the result can't be submitted to the controller
+)
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage: scan [OPTIONS]\n")
+	fmt.Fprintf(os.Stderr, "       scan sweep -registry <url> -result_dir <dir> [-repo_filter <glob>] [-tag_filter <glob>] [OPTIONS]\n")
 	flag.PrintDefaults()
-	os.Exit(2)
+	fmt.Fprintf(os.Stderr, "\nexit codes:\n"+
+		"  0  success\n"+
+		"  %d  invalid options\n"+
+		"  %d  failed to read the CVE database, or not read after -db_max_retries\n"+
+		"  %d  scan failed, with -strict\n"+
+		"  %d  no verified signature, with -fail_on_unsigned, or older than -max_image_age, with -fail_on_stale\n"+
+		"  %d  unsupported system, the controller address can't be resolved, not registered for -max_unregistered,\n"+
+		"     or the image working path can't be cleaned up, with -fail_on_cleanup_error\n"+
+		"  %d  failed to write the output file\n"+
+		"  %d  failed to submit the result to the controller\n",
+		exitUsage, exitDBError, exitScanError, exitViolation, exitSystemError, exitOutputError, exitSubmitError)
+	os.Exit(exitUsage)
+}
+
+// submitCommand runs: scan submit [OPTIONS] <file>..., the results saved in the spool folder are submitted
+// to the controller again, and removed once submitted
+func submitCommand(args []string) int {
+	fs := flag.NewFlagSet("submit", flag.ContinueOnError)
+	join := fs.String("j", "", "Controller join address")
+	joinPort := fs.Uint("join_port", uint(api.DefaultControllerRESTAPIPort), "Controller REST API port")
+	adv := fs.String("a", "", "Advertise address")
+	ctrlUser := fs.String("ctrl_username", "", "Controller REST API username")
+	ctrlPass := fs.String("ctrl_password", "", "Controller REST API password")
+	ctrlOpts := addControllerFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: scan submit [OPTIONS] <file>...\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 || *join == "" || !ctrlOpts.hasCredentials(*ctrlUser, *ctrlPass) {
+		fs.Usage()
+		return exitUsage
+	}
+	if err := ctrlOpts.apply(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	files := fs.Args()
+	results := make([]*share.ScanResult, len(files))
+	for i, file := range files {
+		result, err := readSpooledResult(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitUsage
+		}
+		results[i] = result
+	}
+	if *adv == "" {
+		_, addr, err := cluster.ResolveJoinAndBindAddr(*join, system.NewSystemTools())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitSystemError
+		}
+		*adv = addr
+	}
+
+	code := 0
+	errs := scanSubmitResults(*join, uint16(*joinPort), *adv, *ctrlUser, *ctrlPass, results)
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("%s: %v\n", files[i], err)
+			code = exitSubmitError
+		} else {
+			fmt.Printf("%s: submitted\n", files[i])
+			os.Remove(files[i])
+		}
+	}
+	return code
+}
+
+// registryCommand runs: scan registry check [OPTIONS] <host>, a ping of the registry with the settings
+// the scans would use for the host
+func registryCommand(args []string) int {
+	fs := flag.NewFlagSet("registry check", flag.ContinueOnError)
+	conf := fs.String("registries_conf", "", "Per-registry settings file")
+	user := fs.String("registry_username", "", "Registry username, the one of the settings file if not given")
+	pass := fs.String("registry_password", "", "Registry password")
+	clientCert := fs.String("registry_client_cert", "", "Client certificate file to authenticate to the registry by mTLS")
+	clientKey := fs.String("registry_client_key", "", "Client key file to authenticate to the registry by mTLS")
+	caCert := fs.String("registry_ca_cert", "", "CA certificate file to verify the registry with")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: scan registry check [OPTIONS] <host>\n")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "check" {
+		fs.Usage()
+		return exitUsage
+	}
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		if err == nil {
+			fs.Usage()
+		}
+		return exitUsage
+	}
+
+	if err := cvetools.SetRegistryTLS(*clientCert, *clientKey, *caCert); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	if *conf != "" {
+		if err := cvetools.LoadRegistriesConf(*conf); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	host := fs.Arg(0)
+	entry, err := cvetools.CheckRegistry(host, *user, *pass)
+	if entry != nil {
+		fmt.Printf("Settings: %s\n", entry.Host)
+	} else {
+		fmt.Printf("Settings: default\n")
+	}
+	if err != nil {
+		fmt.Printf("Registry %s: %v\n", host, err)
+		return exitScanError
+	}
+	fmt.Printf("Registry %s: OK\n", host)
+	return 0
+}
+
+// exitScan stops the tasker, which the deferred calls don't do with os.Exit
+func exitScan(code int) {
+	if scanTasker != nil {
+		scanTasker.Close()
+	}
+	os.Exit(code)
 }
 
 const taskerPath = "/usr/local/bin/scannerTask"
-const registerWaitTime = time.Duration(time.Second * 10)
+const defaultRegisterWaitTime = time.Duration(time.Second * 10)
+const defaultStartupMaxWait = time.Duration(time.Second * 15)
+const defaultStartupWait = time.Duration(time.Second * 15)
+const defaultMinFreeSpace = 256 // MB
+const defaultSweepInterval = time.Duration(time.Minute * 10)
+const registriesReloadInterval = time.Duration(time.Second * 30)
+const defaultSpoolDir = "/var/neuvector/spool"
+const dbMemoryFactor = 8 // the decrypted tables and the parsed data take a few times of the database file size
 const licenseTimeFormat string = "2006-01-02"
 const dockerSocket = "unix:///var/run/docker.sock"
 const defaultDockerhubReg = "https://registry.hub.docker.com"
@@ -48,90 +204,267 @@ var ntChan chan uint32 = make(chan uint32, 1)
 var cveTools *cvetools.CveTools // available inside package
 var scanTasker *Tasker          // available inside package
 var selfID string
+var dbInMemory bool
+var maxImageSize int64         // default limit of the image size in bytes, 0 for no limit
+var strictScan bool            // fail the image scans that skipped any layer
+var bestEffort bool            // scan the downloaded layers when some layers fail to download
+var complianceBenchmark string // check the images against the benchmark, like cis-docker
+var misconfigChecks bool       // check the image reference and its base are pinned
+var scanTimeout time.Duration  // default timeout of the image scans, 0 for no timeout
+var siblingTags int            // look up the other tags of the image in a repository of up to this many tags
+var excludePaths []string      // the patterns of the files not scanned
+
+// loadCveDb decrypts the database in memory, or expands it to the table path
+func loadCveDb(path string, encryptKey []byte) (string, string, error) {
+	if dbInMemory {
+		return common.LoadCveDbInMemory(path, encryptKey)
+	}
+	return common.LoadCveDb(path, cveTools.TbPath, encryptKey)
+}
+
+// cveDbFitsInMemory tells if the available memory can hold the decrypted database
+func cveDbFitsInMemory(path string, sys *system.SystemTools) bool {
+	var need uint64
+	for _, file := range common.DbSources(path) {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false
+		}
+		need += uint64(info.Size()) * dbMemoryFactor
+	}
+
+	var avail uint64
+	if stats, err := sys.GetContainerMemoryStats(); err == nil && stats.Usage.Limit > 0 && stats.Usage.Limit > stats.WorkingSet {
+		avail = stats.Usage.Limit - stats.WorkingSet
+	}
+	if free := readMemAvailable(); free > 0 && (avail == 0 || free < avail) {
+		avail = free
+	}
+
+	log.WithFields(log.Fields{"need": need, "available": avail}).Debug()
+	return avail > need
+}
+
+// the units of the sizes, the longer suffixes first
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+// parseImageSize accepts a number of bytes or a size with a unit, like "500MB" or "2G", empty for no limit
+func parseImageSize(input string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(input))
+	if value == "" {
+		return 0, nil
+	}
+
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/mult {
+		return 0, fmt.Errorf("Invalid image size: %s", input)
+	}
+	return size * mult, nil
+}
+
+// stringList collects the values of a flag given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// readMemAvailable returns MemAvailable of /proc/meminfo in bytes, 0 if unknown
+func readMemAvailable() uint64 {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			if kb, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				return kb * 1024
+			}
+		}
+	}
+	return 0
+}
+
+var (
+	metricDBReadRetries = expvar.NewInt("db_read_retries")        // consecutive failed reads, 0 when read
+	metricDBReadWait    = expvar.NewFloat("db_read_wait_seconds") // since the first failed read, 0 when read
+)
+
+// the wait before the second read of the CVE database, doubled at each retry up to dbRetryMaxWait
+const dbRetryWait = time.Second * 4
+const dbRetryMaxWait = time.Minute
+
+// dbRead reads the CVE database, the read is retried from dbRetryWait up to dbRetryMaxWait apart for maxRetry
+// attempts, 0 to retry forever. nil is returned if the attempts are exhausted. The error is of writing the
+// output, the database is nil if it can't be read.
+func dbRead(path string, maxRetry int, output string) (map[string]*share.ScanVulnerability, error) {
+	var dbData map[string]*share.ScanVulnerability
+	var writeErr error
+	loaded := dbLoad(path, maxRetry, func(version, createTime string) error {
+		var outCVEs []*common.OutputCVEVul
+		var err error
+		if dbData, outCVEs, err = common.ReadCveDbMeta(cveTools.TbPath, output != ""); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to load scanner db")
+			return err
+		}
+		// 此时是垃圾代码
+		if output != "" {
+			out := outputCVE{
+				Version:    version,
+				CreateTime: createTime,
+				CVEs:       outCVEs,
+			}
+			writeErr = writeCveDbJSON(output, &out)
+		}
+		return nil
+	})
+	if !loaded {
+		return nil, nil
+	}
+	return dbData, writeErr
+}
 
-//于读取cveDB数据库的函数
-// path: cvedb数据文件所在的路径
-// maxRetry :重试次数
-// output: cvedb文件加压目标路径
-func dbRead(path string, maxRetry int, output string) map[string]*share.ScanVulnerability {
-	// cvedb文件全路径
-	dbFile := path + share.DefaultCVEDBName
+// missingDbSource returns the first database file missing, empty if there is none
+func missingDbSource(sources []string) string {
+	for _, file := range sources {
+		if _, err := os.Stat(file); err != nil {
+			return file
+		}
+	}
+	return ""
+}
+
+// dbLoad loads the CVE database for the scans, and calls read with it if not nil, the load is retried as
+// dbRead does when either fails. It returns false if the attempts are exhausted.
+func dbLoad(path string, maxRetry int, read func(version, createTime string) error) bool {
+	// cvedb文件全路径, and the supplemental databases merged with it
+	sources := common.DbSources(path)
 	// cvedb文件解压密钥
 	encryptKey := common.GetCVEDBEncryptKey()
 
 	var retry int
 	var dbReady bool
-	var dbData map[string]*share.ScanVulnerability
-	var outCVEs []*common.OutputCVEVul
+	start := time.Now()
+	wait := dbRetryWait
 
 	for {
-		if _, err := os.Stat(dbFile); err != nil {
-			log.WithFields(log.Fields{"file": dbFile}).Error("cannot find scanner db")
-		} else {
+		missing := missingDbSource(sources)
+		if missing == "" {
 			cveTools.UpdateMux.Lock()
 			// 读取cvedb数据库的 版本号、创建时间
-			if verNew, createTime, err := common.LoadCveDb(path, cveTools.TbPath, encryptKey); err == nil {
-				cveTools.CveDBVersion = verNew
-				cveTools.CveDBCreateTime = createTime
-
-				if dbData, outCVEs, err = common.ReadCveDbMeta(cveTools.TbPath, output != ""); err != nil {
-					log.WithFields(log.Fields{"error": err}).Error("Failed to load scanner db")
-				} else {
-					dbReady = true
-					// 此时是垃圾代码
-					if output != "" {
-						out := outputCVE{
-							Version:    verNew,
-							CreateTime: createTime,
-							CVEs:       outCVEs,
-						}
-						file, _ := json.MarshalIndent(out, "", "    ")
-						_ = ioutil.WriteFile(output, file, 0644)
-
-					}
-				}
+			if verNew, createTime, err := loadCveDb(path, encryptKey); err == nil {
+				cveTools.SwapDB(verNew, createTime)
+				dbReady = read == nil || read(verNew, createTime) == nil
 			}
 			cveTools.UpdateMux.Unlock()
 		}
 
 		if !dbReady {
 			retry++
+			elapsed := time.Since(start)
+			metricDBReadRetries.Set(int64(retry))
+			metricDBReadWait.Set(elapsed.Seconds())
 			if maxRetry != 0 && retry == maxRetry {
-				return nil
+				log.WithFields(log.Fields{"attempts": retry, "elapsed": elapsed.Round(time.Second)}).Error("Failed to read scanner db, give up")
+				return false
+			}
+			fields := log.Fields{"attempts": retry, "max": maxRetry, "elapsed": elapsed.Round(time.Second), "wait": wait}
+			if missing != "" {
+				fields["missing"] = missing
 			}
+			log.WithFields(fields).Warn("Failed to read scanner db, retry")
 
-			time.Sleep(time.Second * 4)
+			time.Sleep(wait)
+			if wait *= 2; wait > dbRetryMaxWait {
+				wait = dbRetryMaxWait
+			}
 		} else {
-			return dbData
+			if retry > 0 {
+				log.WithFields(log.Fields{"attempts": retry + 1, "elapsed": time.Since(start).Round(time.Second)}).Info("Scanner db read after retries")
+			}
+			metricDBReadRetries.Set(0)
+			metricDBReadWait.Set(0)
+			return true
 		}
 	}
 }
 
-func connectController(path, advIP, joinIP, selfID string, advPort uint32, joinPort uint16) {
+// writeCveDbJSON writes the CVE database of the -o option, the error is logged
+func writeCveDbJSON(output string, out *outputCVE) error {
+	file, err := json.MarshalIndent(out, "", "    ")
+	if err == nil {
+		err = ioutil.WriteFile(output, file, 0644)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "output": output}).Error("Failed to write the CVE database")
+	}
+	return err
+}
+
+func connectController(path, advIP, joinIP string, id *scannerID, advPort uint32, joinPort uint16, registerWaitTime, maxUnregistered time.Duration, dbMaxRetries int) {
 	cb := &clientCallback{
 		shutCh:         make(chan interface{}, 1),
 		ignoreShutdown: true,
 	}
+	retry := newRegisterRetry(registerWaitTime, maxUnregistered)
 
 	for {
-		// forever retry
-		dbData := dbRead(path, 0, "")
+		// forever retry, unless -db_max_retries
+		var dbAttempts int
+		if dbMaxRetries > 0 {
+			dbAttempts = dbMaxRetries + 1
+		}
+		// the database is read again from the tables as it is sent
+		if !dbLoad(path, dbAttempts, nil) {
+			log.WithFields(log.Fields{"db_max_retries": dbMaxRetries}).Error("Scanner db not read, exit")
+			exitScan(exitDBError)
+		}
 		scanner := share.ScannerRegisterData{
 			CVEDBVersion:    cveTools.CveDBVersion,
 			CVEDBCreateTime: cveTools.CveDBCreateTime,
-			CVEDB:           dbData,
 			RPCServer:       advIP,
 			RPCServerPort:   advPort,
-			ID:              selfID,
+			ID:              id.get(),
 		}
 
-		for scannerRegister(joinIP, joinPort, &scanner, cb) != nil {
-			time.Sleep(registerWaitTime)
+		for {
+			err := scannerRegister(joinIP, joinPort, &scanner, cb)
+			if err == nil {
+				break
+			}
+			if isDuplicateIDError(err) && id.regenerate() {
+				log.WithFields(log.Fields{"rejected": scanner.ID, "id": id.get()}).Warn("Scanner ID in use, register with a new one")
+				scanner.ID = id.get()
+			}
+			wait, level, giveUp := retry.failed()
+			retry.logRegisterFailure(level, joinIP, joinPort, err)
+			if giveUp {
+				log.WithFields(log.Fields{"max_unregistered": maxUnregistered}).Error("Not registered for too long, exit")
+				exitScan(exitSystemError)
+			}
+			time.Sleep(wait)
 		}
-
-		// tagging it as a released-memory
-		scanner.CVEDB = nil
-		dbData = make(map[string]*share.ScanVulnerability) // zero size
+		retry.registered()
+		log.WithFields(log.Fields{"join": fmt.Sprintf("%s:%d", joinIP, joinPort)}).Info("Registered to the controller")
 
 		// start responding shutdown notice
 		cb.ignoreShutdown = false
@@ -165,7 +498,7 @@ func main() {
 	log.SetLevel(log.DebugLevel)
 	log.SetFormatter(&utils.LogFormatter{Module: "SCN"})
 	// cvedb的存放路径
-	dbPath := flag.String("d", "./dbgen/", "cve database file directory")
+	dbPath := flag.String("d", "./dbgen/", "cve database file directory, or a comma-separated list of database directories and files merged in order, the later ones override the vulnerabilities of the earlier ones; a directory gives its cvedb file and its supplemental databases named *.cvedb")
 	// nevector服务的地址
 	join := flag.String("j", "", "Controller join address")
 	joinPort := flag.Uint("join_port", 0, "Controller join port")
@@ -175,32 +508,146 @@ func main() {
 	// for on demand ci/cd scan
 	license := flag.String("license", "", "Scanner license") // it means on-demand stand-alone scanner
 	image := flag.String("image", "", "Scan image")          // overwrite registry, repository and tag
-	registry := flag.String("registry", "", "Scan image registry")
+	imageList := flag.String("image_list", "", "Standalone Mode: Scan the images listed in the file, one per line")
+	parallel := flag.Uint("parallel", 1, "Standalone Mode: Number of images of the image list scanned concurrently")
+	repoFilter := flag.String("repo_filter", "", "Sweep Mode: Glob of the repositories of the registry catalog to scan, e.g. team-a/*")
+	tagFilter := flag.String("tag_filter", "", "Sweep Mode: Glob of the tags to scan, e.g. v*")
+	latestPerRepo := flag.Int("latest_per_repo", 0, "Sweep Mode: Scan the tags of the N latest images of each repository, by the created time of the image config, 0 for all")
+	semverRange := flag.String("semver", "", "Sweep Mode: Scan the tags parsed as semver in the range, e.g. '>=1.2.0 <2', the other tags are not scanned")
+	maxTagAge := flag.String("max_tag_age", "", "Sweep Mode: Scan the tags of the images created within the age, e.g. 90d, the images of an unknown age are scanned")
+	dryRun := flag.Bool("dry_run", false, "Sweep Mode: Print the images the sweep would scan, without scanning them")
+	resultDir := flag.String("result_dir", "", "Sweep Mode: Folder of the results of the images, named by digest, and of the index")
+	rateLimit := flag.Int("rate_limit", 0, "Sweep Mode: Requests per minute to each registry host, shared by the parallel scans, 0 for no budget; the requests slow down when the registry throttles them anyway")
+	maxBlobDownloads := flag.Int("max_blob_downloads", 0, "Sweep Mode: Concurrent layer downloads from each registry host, 0 for no limit")
+	nice := flag.Duration("nice", 0, "Sweep Mode: Spread the scans of the sweep over the duration, e.g. 8h, to keep the registry load low")
+	progressInterval := flag.Duration("progress_interval", time.Minute, "Sweep Mode: Interval of the progress of the sweep, printed and kept in the state file, 0 to disable")
+	sweepStatePath := flag.String("sweep_state", "", "Sweep Mode: State file of the digests scanned, to continue an interrupted sweep, "+sweepStateFile+" of -result_dir by default")
+	registry := flag.String("registry", "", "Scan image registry, can have a path prefix, e.g. https://host/registry; with -image, the prefix is taken off the image repository")
 	repository := flag.String("repository", "", "Scan image repository")
 	tag := flag.String("tag", "latest", "Scan image tag")
 	regUser := flag.String("registry_username", "", "Registry username")
 	regPass := flag.String("registry_password", "", "Registry password")
+	dockerCfgFile := flag.String("docker_config", "", "Standalone Mode: Docker config or .dockerconfigjson file of a pull secret, for the credentials of the image registry without -registry_username")
+	credsFilePath := flag.String("creds_file", "", "Standalone Mode: Yaml or json file of the credentials of the registries by host pattern, like *.internal.corp, the most specific pattern is used for each image")
 	scanLayers := flag.Bool("scan_layers", false, "Scan image layers")
+	pullSecret := flag.String("pull_secret", "", "Standalone Mode: Kubernetes pull secret, namespace/name, for the credentials of the image registry, read by the service account of the pod")
 	baseImage := flag.String("base_image", "", "Base image")
 	ctrlUser := flag.String("ctrl_username", "", "Controller REST API username")
 	ctrlPass := flag.String("ctrl_password", "", "Controller REST API password")
-	noWait := flag.Bool("no_wait", false, "No initial wait")
+	ctrlOpts := addControllerFlags(flag.CommandLine)
+	spoolDir := flag.String("submit_spool_dir", defaultSpoolDir, "Standalone Mode: Save the results that failed to be submitted to the controller in the folder, empty to disable")
+	noWait := flag.Bool("no_wait", false, "No initial wait, skip the controller readiness probe and startup delay")
+	startupMaxWait := flag.Duration("startup_max_wait", defaultStartupMaxWait, "Maximum wait for the controller to be ready before registering")
+	startupWait := flag.Duration("startup_wait", defaultStartupWait, "Wait after the controller is ready, before registering, for the scanner IP to reach the enforcers")
+	flag.DurationVar(startupWait, "startup_delay", defaultStartupWait, "Same as -startup_wait")
+	registerWaitTime := flag.Duration("register_retry_interval", defaultRegisterWaitTime, "Initial wait time between registration retries, doubled after each failure up to 5m")
+	maxUnregistered := flag.Duration("max_unregistered", 0, "Exit if not registered to the controller for the duration, so the pod is restarted, 0 to retry forever")
+	dbMaxRetries := flag.Int("db_max_retries", 0, "Exit if the CVE database can't be read after the retries, from 4s up to a minute apart, so the pod is restarted, 0 to retry forever")
+	idFile := flag.String("scanner_id_file", defaultScannerIDFile, "File to keep the unique part of the scanner ID, when not running in a container")
 
-	verbose := flag.Bool("x", false, "more debug")
+	var verbosity verbosityFlags
+	flag.BoolVar(&verbosity.quiet, "q", false, "Same as -verbosity quiet, log the errors only, in standalone mode print the result and the errors only")
+	flag.StringVar(&verbosity.level, "verbosity", "", "Level of the logs: silent, summary or quiet log the errors only, and in standalone mode print nothing, the summary only or the result only; info, debug or trace, the debug logs of the scanner tasks too; info by default in standalone mode, trace with the controller")
+	flag.BoolVar(&verbosity.trace, "vv", false, "Same as -verbosity trace")
+	flag.BoolVar(&verbosity.legacy, "x", false, "Deprecated, same as -vv")
 	output := flag.String("o", "", "Output CVEDB in json format, specify the output file")
-	show := flag.String("show", "", "Standalone Mode: Stdout print options, cmd,module")
+	why := flag.String("why", "", "Standalone Mode: Print why the vulnerability, e.g. CVE-2023-1234, was or wasn't reported for each package of the scanned -image the database has a record of it for")
+	explain := flag.String("explain", "", "Print what the CVE database has of a vulnerability, e.g. CVE-2023-1234 or a GHSA ID: the description, the CVSS scores, the references and the affected and fixed versions of each namespace and module, without scanning")
+	show := flag.String("show", "", "Standalone Mode: Stdout print options, cmd,module,checks")
+	format := flag.String("format", formatTable, "Standalone Mode: Stdout format, table, markdown, a compact report for merge request comments, or jsonl, a record per line streamed as the scans end")
+	groupBy := flag.String("group_by", "", "Standalone Mode: Group the vulnerabilities by package, to remediate per package, empty for the flat list")
+	severitySource := flag.String("severity_source", cvetools.SeveritySourceVendor, "Standalone Mode: The severity of the counts, the summary and the table and markdown outputs, vendor, the rating of the database, nvd, the rating of the CVSS scores, or max, the higher of the two")
+	flag.IntVar(&verbosity.quietLevel, "quiet", 0, "Standalone Mode: 1 for -verbosity summary, the summary on stderr without the report on stdout, 2 for -verbosity silent, neither")
+	progress := flag.Bool("progress", false, "Standalone Mode: write the progress events of the scan to stderr as JSON lines")
+	profile := flag.String("profile", "", "Standalone Mode: Write the CPU and heap profiles, of the scanner and its task, and the phase timings of the scan of -image to the folder")
+	topFindings := flag.Int("top_findings", defaultTopFindings, "Standalone Mode: Number of the top findings listed by -format markdown")
+	maxImageAge := flag.String("max_image_age", "", "Standalone Mode: Flag images created earlier than the age, e.g. 180d or 4320h")
+	failStale := flag.Bool("fail_on_stale", false, "Standalone Mode: Exit with an error if the image is older than -max_image_age")
 	getVer := flag.Bool("v", false, "show cve database version")
+	getBinVer := flag.Bool("binary_version", false, "show the version, git commit, build date and go version of the scanner binary")
+	dbExpand := flag.Bool("db_expand", false, "Expand the decrypted cve database to disk instead of loading it in memory")
+	minFreeSpace := flag.Uint64("min_free_space", defaultMinFreeSpace, "Reject scans when the free space of the image working path is below the value in MB, 0 to disable")
+	cleanupRetries := flag.Int("cleanup_retries", cvetools.DefaultCleanupRetries, "Number of retries to remove a folder of the image working path, like while its files are busy on a network or overlay file system")
+	cleanupBackoff := flag.Duration("cleanup_backoff", cvetools.DefaultCleanupBackoff, "Wait before the first retry to remove a folder of the image working path, doubled at each retry")
+	failCleanup := flag.Bool("fail_on_cleanup_error", false, "Exit with an error at startup if the image working path can't be cleaned up")
+	sweepInterval := flag.Duration("sweep_interval", defaultSweepInterval, "Interval to remove leftovers from the image working path, 0 to disable")
+	metricsPort := flag.Uint("metrics_port", 0, "Serve the counters at /debug/vars on the port, 0 to disable")
+	maxSize := flag.String("max_image_size", "", "Reject images whose compressed layers are larger than the size, e.g. 500MB or 2GB, empty for no limit")
+	platform := flag.String("platform", "", "Standalone Mode: Platform to scan of a multi-platform image, e.g. linux/arm64, the default prefers linux/amd64")
+	strict := flag.Bool("strict", false, "Fail the image scan, or exit with an error in standalone mode, if any layer was skipped or partially scanned")
+	partial := flag.Bool("best_effort", false, "Return the findings of the downloaded layers when some layers of the image fail to download")
+	userAgent := flag.String("registry_user_agent", cvetools.DefaultUserAgent(), "User agent of the registry requests, followed by the scan ID, can be set by "+cvetools.UserAgentEnv)
+	flag.StringVar(userAgent, "user_agent", cvetools.DefaultUserAgent(), "Deprecated, same as -registry_user_agent")
+	clientCert := flag.String("registry_client_cert", "", "Client certificate file to authenticate to the registry by mTLS")
+	clientKey := flag.String("registry_client_key", "", "Client key file to authenticate to the registry by mTLS")
+	caCert := flag.String("registry_ca_cert", "", "CA certificate file to verify the registry with, the registry certificate is not verified without it")
+	grpcCert := flag.String("grpc_cert", os.Getenv(grpcCertEnv), "Certificate file of the grpc channel with the controller, as the server of the scans and the client registering, can be set by "+grpcCertEnv+", the internal certificate by default")
+	grpcKey := flag.String("grpc_key", os.Getenv(grpcKeyEnv), "Key file of -grpc_cert, can be set by "+grpcKeyEnv)
+	grpcCACert := flag.String("grpc_ca_cert", os.Getenv(grpcCACertEnv), "CA certificate file to verify the controller with, both ways, can be set by "+grpcCACertEnv)
+	grpcPeerName := flag.String("grpc_peer_name", os.Getenv(grpcPeerNameEnv), "Name the certificate of the controller must have, the CN of -grpc_cert by default, can be set by "+grpcPeerNameEnv)
+	verifySig := flag.Bool("verify_signature", false, "Standalone Mode: Verify the cosign signatures of the image with the keys of -cosign_key")
+	var cosignKeys stringList
+	flag.Var(&cosignKeys, "cosign_key", "Standalone Mode: Cosign public key file, can be given more than once, a signature verified by any key is accepted")
+	certIdentity := flag.String("certificate_identity", "", "Standalone Mode: Verify the keyless signatures by the email or URI identity of the signing certificate")
+	certIssuer := flag.String("certificate_oidc_issuer", "", "Standalone Mode: OIDC issuer of the keyless signing certificate, e.g. https://token.actions.githubusercontent.com")
+	fulcioRoot := flag.String("fulcio_root", cvetools.DefaultFulcioRoot, "Standalone Mode: Fulcio root certificate file to verify the keyless signing certificates")
+	rekorKey := flag.String("rekor_public_key", cvetools.DefaultRekorKey, "Standalone Mode: Rekor public key file to verify the signed entry timestamps of the keyless signatures")
+	failUnsigned := flag.Bool("fail_on_unsigned", false, "Standalone Mode: Exit with an error if the image has no signature verified by the cosign keys")
+	matchWorkers := flag.Int("match_workers", 0, "Number of goroutines matching the packages of an image against the database, 0 for the number of CPUs")
+	inflateWorkers := flag.Int("inflate_workers", 0, "Number of goroutines hashing, inflating and extracting the image layers of all the scans, 0 for the number of CPUs")
+	fullExtraction := flag.Bool("full_extraction", false, "Write all the files of the image layers to disk, instead of only the files the scan reads")
+	expansion := flag.Float64("disk_expansion_factor", cvetools.DefaultDiskExpansionFactor, "Estimate the disk space of an image extracted with -full_extraction as its compressed size times the factor, a streamed image takes up to its compressed size, 0 to disable the check")
+	registriesConf := flag.String("registries_conf", "", "Per-registry CA, TLS, plain HTTP and credential settings in json, reloaded when modified in the controller mode")
+	timeout := flag.Duration("scan_timeout", 0, "Default timeout of the image scans requested by the controller, 0 for no timeout, a request can set its own")
+	siblingMax := flag.Int("sibling_tags", 0, "Report the other tags of the image when the repository has up to this many tags, e.g. 100, 0 to disable, a request can set its own")
+	var excludes stringList
+	flag.Var(&excludes, "exclude_paths", "Glob pattern of the paths in the image not to scan, like /usr/share/doc or node_modules/**/test, comma separated or given more than once")
+	enableMisconfig := flag.Bool("enable_misconfig", false, "Report the mutable latest tag of the scanned image, the base image not pinned by its digest, and the entrypoint without an init as PID 1, with the image checks")
+	compliance := flag.String("compliance", "", "Check the images against the compliance benchmark: cis-docker, the image controls of the CIS Docker Benchmark")
+	ignoreFile := flag.String("ignore_file", "", "Standalone Mode: File of the IDs of the image checks and the vulnerabilities to ignore, one per line, like root-user, CVE-2021-44228 or a GHSA ID, followed by the reason")
+	vexOut := flag.String("vex_out", "", "Standalone Mode: Write the OpenVEX document of the vulnerabilities ignored by -ignore_file to the file")
+	var vexFiles stringList
+	flag.Var(&vexFiles, "vex", "Standalone Mode: OpenVEX document or folder of them, can be given more than once, the findings of a not_affected or fixed statement are suppressed")
+	severityMapFile := flag.String("severity_map", "", "Severity map file, remaps the severity of the CVEs to the internal risk rating, like CVE-2021-44228: critical")
 
 	flag.Usage = usage
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "registry" {
+		os.Exit(registryCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "submit" {
+		os.Exit(submitCommand(os.Args[2:]))
+	}
+	// scan sweep [OPTIONS] takes the options of the scans
+	args := os.Args[1:]
+	sweeping := len(args) > 0 && args[0] == "sweep"
+	if sweeping {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+
+	level, verr := verbosity.resolve(*license != "" || sweeping)
+	if verr != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", verr)
+		os.Exit(exitUsage)
+	}
+	showTaskDebug := setVerbosity(level)
+
+	// show the build of the binary, -v is kept for the cve database version
+	if *getBinVer {
+		fmt.Printf("Scanner version: %s\n", cvetools.ScannerVersion)
+		fmt.Printf("Git commit: %s\n", cvetools.ScannerCommit)
+		fmt.Printf("Build date: %s\n", cvetools.ScannerBuildDate)
+		fmt.Printf("Go version: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		return
+	}
 
 	// show cve database version
 	if *getVer {
 		if v, _, err := common.GetDbVersion(*dbPath); err == nil {
-			fmt.Printf("CVE database version: %.3f\n", v)
+			fmt.Printf("CVE database version: %s\n", v)
 		} else {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(-2)
+			os.Exit(exitDBError)
 		}
 		return
 	}
@@ -209,38 +656,335 @@ func main() {
 	sys := system.NewSystemTools()
 	// cvetools默认属性tbPath = "/tmp/neuvector/db/"
 	cveTools = cvetools.NewCveTools(*rtSock, scan.NewScanUtil(sys))
+	if *severityMapFile != "" {
+		m, err := cvetools.LoadSeverityMap(*severityMapFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error()
+			os.Exit(exitUsage)
+		}
+		cveTools.SetSeverityMap(m)
+		log.WithFields(log.Fields{"file": *severityMapFile, "entries": len(m)}).Info("Severity map")
+	}
+	// the results sent to the controller have no field of the ignored and the suppressed vulnerabilities, they
+	// would be dropped silently
+	if (*ignoreFile != "" || len(vexFiles) > 0) && *license == "" && !sweeping {
+		log.Error("-ignore_file and -vex only apply to the standalone scans")
+		os.Exit(exitUsage)
+	}
+	if *ignoreFile != "" {
+		ids, reasons, err := cvetools.LoadIgnoreFile(*ignoreFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error()
+			os.Exit(exitUsage)
+		}
+		cveTools.SetIgnored(ids)
+		cveTools.SetIgnoreReasons(reasons)
+		log.WithFields(log.Fields{"file": *ignoreFile, "entries": len(ids)}).Info("Ignore file")
+	}
+	if len(vexFiles) > 0 {
+		statements, err := cvetools.LoadVEX(vexFiles)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error()
+			os.Exit(exitUsage)
+		}
+		cveTools.SetVEX(statements)
+		log.WithFields(log.Fields{"files": vexFiles, "statements": len(statements)}).Info("VEX")
+	}
+	// the provenance of the reports records the filters of their findings, for the audits
+	if *license != "" || sweeping {
+		filters := &cvetools.ScanFilters{SeveritySource: *severitySource}
+		for _, f := range []struct {
+			path string
+			hash *string
+		}{{*severityMapFile, &filters.SeverityMapHash}, {*ignoreFile, &filters.IgnoreFileHash}} {
+			if f.path == "" {
+				continue
+			}
+			hash, err := cvetools.FileHash(f.path)
+			if err != nil {
+				log.WithFields(log.Fields{"file": f.path, "error": err}).Error("Failed to hash the filter file")
+				os.Exit(exitUsage)
+			}
+			*f.hash = hash
+		}
+		cveTools.SetScanFilters(filters)
+	}
+
+	// Keep the decrypted database in memory unless asked not to, or the memory is short
+	if !*dbExpand {
+		dbInMemory = cveDbFitsInMemory(*dbPath, sys)
+	}
+	log.WithFields(log.Fields{"inMemory": dbInMemory}).Info("CVE database")
 
 	// output cvedb in json format
 	// 垃圾代码
 	if *output != "" {
-		dbRead(*dbPath, 3, *output)
+		if err := checkWritable(*output); err != nil {
+			log.WithFields(log.Fields{"error": err, "output": *output}).Error("Output file is not writable")
+			os.Exit(exitUsage)
+		}
+		if dbData, err := dbRead(*dbPath, 3, *output); dbData == nil {
+			os.Exit(exitDBError)
+		} else if err != nil {
+			os.Exit(exitOutputError)
+		}
+		log.WithFields(log.Fields{"output": *output}).Info("CVE database written")
+		return
+	}
+
+	// look a vulnerability up in the database the scans match with
+	if *explain != "" {
+		var found bool
+		var err error
+		if !dbLoad(*dbPath, 3, func(version, createTime string) error {
+			found, err = explainCve(os.Stdout, cveTools.TbPath, *explain)
+			return err
+		}) {
+			os.Exit(exitDBError)
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "%s is not in the CVE database\n", *explain)
+			os.Exit(exitUsage)
+		}
 		return
 	}
 
 	onDemand := false
-	showTaskDebug := true
+	opts := &onDemandOptions{verbosity: level}
 
 	// If license parameter is given, this is an on-demand scanner, no register to the controller,
 	// but if join address is given, the scan result are sent to the controller.
 	// 如果不连接到服务端，进行扫描操作，license必须不为空
-	if *license != "" {
-		if (*repository == "" || *tag == "") && *image == "" {
+	var sweep *sweepOptions
+	if *license != "" || sweeping {
+		if sweeping {
+			policy, err := newTagPolicy(*tagFilter, *semverRange, *maxTagAge, *latestPerRepo)
+			if err == nil {
+				sweep, err = newSweepOptions(*registry, *repoFilter, *resultDir, *sweepStatePath, policy, *dryRun)
+			}
+			if err == nil {
+				err = sweep.setSchedule(*rateLimit, *maxBlobDownloads, *nice, *progressInterval)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error()
+				os.Exit(exitUsage)
+			} else if *image != "" || *imageList != "" {
+				log.Error("The sweep scans the images of -registry, without -image or -image_list")
+				os.Exit(exitUsage)
+			}
+		} else if (*repository == "" || *tag == "") && *image == "" && *imageList == "" {
 			log.Error("Missing the repository name and tag of the image to be scanned")
-			os.Exit(-2)
+			os.Exit(exitUsage)
+		}
+
+		age, err := parseImageAge(*maxImageAge)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error()
+			os.Exit(exitUsage)
+		}
+		opts.maxImageAge = age
+		opts.failStale = *failStale
+		opts.show = *show
+		if opts.format, err = parseFormat(*format); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error()
+			os.Exit(exitUsage)
+		} else if opts.format == formatJSONL {
+			// the stdout has only the records
+			log.SetOutput(os.Stderr)
+		}
+		opts.topFindings = *topFindings
+		if *groupBy != "" && *groupBy != groupByPackage {
+			log.WithFields(log.Fields{"group_by": *groupBy}).Error("Unsupported group, only package")
+			os.Exit(exitUsage)
+		}
+		opts.groupBy = *groupBy
+		switch *severitySource {
+		case cvetools.SeveritySourceVendor, cvetools.SeveritySourceNVD, cvetools.SeveritySourceMax:
+			opts.severitySrc = *severitySource
+		default:
+			log.WithFields(log.Fields{"severity_source": *severitySource}).Error("Unsupported severity source, vendor, nvd or max")
+			os.Exit(exitUsage)
+		}
+		opts.progress = *progress
+		if *profile != "" {
+			if *image == "" || *imageList != "" {
+				log.Error("-profile profiles the scan of a single -image")
+				os.Exit(exitUsage)
+			}
+			profileDir = *profile
+		}
+		if err := ctrlOpts.apply(); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Invalid controller options")
+			os.Exit(exitUsage)
+		}
+		if *dockerCfgFile != "" && *pullSecret != "" {
+			log.Error("Only one of -docker_config and -pull_secret can be given")
+			os.Exit(exitUsage)
+		}
+		if *dockerCfgFile != "" {
+			cfg, err := loadDockerConfig(*dockerCfgFile)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error()
+				os.Exit(exitUsage)
+			}
+			opts.dockerConfig = cfg
+		} else if *pullSecret != "" {
+			cfg, err := loadPullSecret(*pullSecret)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "secret": *pullSecret}).Error()
+				os.Exit(exitUsage)
+			}
+			opts.dockerConfig = cfg
+		}
+		if *credsFilePath != "" {
+			creds, err := loadCredsFile(*credsFilePath)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error()
+				os.Exit(exitUsage)
+			}
+			opts.creds = creds
+		}
+		if *platform != "" {
+			if _, err := cvetools.ParseImagePlatform(*platform); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error()
+				os.Exit(exitUsage)
+			}
+			opts.platform = *platform
+		}
+		if *verifySig || *failUnsigned {
+			if len(cosignKeys) == 0 && *certIdentity == "" && *certIssuer == "" {
+				log.Error("Missing the cosign key or the certificate identity to verify the image signature")
+				os.Exit(exitUsage)
+			}
+			if *certIdentity != "" || *certIssuer != "" {
+				policy, err := cvetools.LoadKeylessPolicy(*certIdentity, *certIssuer, *fulcioRoot, *rekorKey)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Invalid keyless verification options")
+					os.Exit(exitUsage)
+				}
+				opts.keyless = policy
+			}
+			for _, path := range cosignKeys {
+				key, err := cvetools.LoadCosignKey(path)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Invalid cosign key")
+					os.Exit(exitUsage)
+				}
+				opts.cosignKeys = append(opts.cosignKeys, key)
+			}
+			opts.failUnsigned = *failUnsigned
+		}
+
+		// fail before the scan, not after it, if the result can't be saved
+		output := filepath.Join(scanOutputDir, scanOutputFile)
+		if sweep != nil {
+			output = filepath.Join(sweep.resultDir, sweepIndexFile)
+		}
+		if sweep != nil && sweep.dryRun {
+			// nothing is written
+		} else if err := checkWritable(output); err != nil {
+			log.WithFields(log.Fields{"error": err, "output": filepath.Dir(output)}).Error("Output folder is not writable")
+			os.Exit(exitUsage)
+		}
+		if *vexOut != "" {
+			if sweep != nil || *imageList != "" {
+				log.Error("-vex_out writes the document of a single image scan")
+				os.Exit(exitUsage)
+			}
+			if err := checkWritable(*vexOut); err != nil {
+				log.WithFields(log.Fields{"error": err, "output": *vexOut}).Error("VEX output is not writable")
+				os.Exit(exitUsage)
+			}
+			opts.vexOut = *vexOut
+		}
+		if *why != "" {
+			if sweep != nil || *imageList != "" {
+				log.Error("-why explains the matching of a single image scan")
+				os.Exit(exitUsage)
+			}
+			opts.why = *why
 		}
 
 		onDemand = true
+	}
 
-		// Less debug in interactive mode
-		if *image != "" && *verbose == false {
-			log.SetLevel(log.InfoLevel)
-			showTaskDebug = false
+	if size, err := parseImageSize(*maxSize); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error()
+		os.Exit(exitUsage)
+	} else {
+		maxImageSize = size
+		opts.maxSize = size
+	}
+	strictScan = *strict
+	opts.strict = *strict
+	bestEffort = *partial
+	opts.bestEffort = *partial
+	if benchmark, err := cvetools.ParseCompliance(*compliance); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error()
+		os.Exit(exitUsage)
+	} else {
+		complianceBenchmark = benchmark
+	}
+	opts.compliance = complianceBenchmark
+	misconfigChecks = *enableMisconfig
+	opts.misconfig = *enableMisconfig
+	scanTimeout = *timeout
+	if *siblingMax < 0 {
+		log.WithFields(log.Fields{"sibling_tags": *siblingMax}).Error("Invalid sibling tags")
+		os.Exit(exitUsage)
+	}
+	siblingTags = *siblingMax
+	opts.siblingTags = *siblingMax
+	for _, value := range excludes {
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				excludePaths = append(excludePaths, pattern)
+			}
 		}
 	}
+	if err := cvetools.ValidateExcludePaths(excludePaths); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error()
+		os.Exit(exitUsage)
+	}
+	opts.excludePaths = excludePaths
 
 	// recovered, clean up all possible previous image folders
-	os.RemoveAll(cvetools.ImageWorkingPath)
-	os.MkdirAll(cvetools.ImageWorkingPath, 0755)
+	cvetools.CleanupRetries = *cleanupRetries
+	cvetools.CleanupBackoff = *cleanupBackoff
+	if err := cvetools.ResetImagePath(); err != nil {
+		log.WithFields(log.Fields{"error": err, "path": cvetools.ImageWorkingPath}).Error("Failed to clean up the image working path")
+		if *failCleanup {
+			os.Exit(exitSystemError)
+		}
+	}
+	cvetools.MinFreeSpace = *minFreeSpace * 1024 * 1024
+	cvetools.DiskExpansionFactor = *expansion
+	cvetools.MatchWorkers = *matchWorkers
+	cvetools.FullExtraction = *fullExtraction
+	cvetools.InflateWorkers = *inflateWorkers
+	cvetools.UserAgent = *userAgent
+	if err := cvetools.SetRegistryTLS(*clientCert, *clientKey, *caCert); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid registry TLS options")
+		os.Exit(exitUsage)
+	}
+	if *registriesConf != "" {
+		if err := cvetools.LoadRegistriesConf(*registriesConf); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error()
+			os.Exit(exitUsage)
+		}
+	}
+	if free, err := cvetools.FreeSpace(); err == nil {
+		log.WithFields(log.Fields{"free": free, "min": cvetools.MinFreeSpace}).Info("Image working path")
+	}
+
+	if *metricsPort != 0 {
+		go func() {
+			// expvar publishes the counters at /debug/vars
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), nil); err != nil {
+				log.WithFields(log.Fields{"error": err, "port": *metricsPort}).Error("Failed to serve metrics")
+			}
+		}()
+	}
 
 	var err error
 	// 判断scanner是否在容器中运行,判断当前系统是否支持操作
@@ -248,7 +992,7 @@ func main() {
 		selfID, _, err = sys.GetSelfContainerID() // it is a POD ID in the k8s cgroup v2; otherwise, a real container ID
 		if selfID == "" {
 			log.WithFields(log.Fields{"error": err}).Error("Unsupported system. Exit!")
-			os.Exit(-2)
+			os.Exit(exitSystemError)
 		}
 	} else {
 		log.Debug("Not running in container.")
@@ -261,7 +1005,11 @@ func main() {
 		}
 	}
 	// 初始化扫描任务
-	scanTasker = newTasker(taskerPath, *rtSock, showTaskDebug, sys)
+	var taskDbPath string
+	if dbInMemory {
+		taskDbPath = *dbPath
+	}
+	scanTasker = newTasker(taskerPath, *rtSock, taskDbPath, showTaskDebug, sys)
 	if scanTasker != nil {
 		// tasker初始化成功
 		log.Debug("Use scannerTask")
@@ -278,14 +1026,180 @@ func main() {
 	}()
 
 	if onDemand {
+		// submit the scan results in one session if join address is given, returns the number of failed
+		submitResults := func(reports []*cvetools.ScanReport) int {
+			var results []*share.ScanResult
+			for _, result := range reports {
+				if result != nil && result.Error == share.ScanErrorCode_ScanErrNone {
+					results = append(results, result.ScanResult)
+				}
+			}
+			if len(results) == 0 || *join == "" || !ctrlOpts.hasCredentials(*ctrlUser, *ctrlPass) {
+				return 0
+			}
+			if *adv == "" {
+				_, addr, err := cluster.ResolveJoinAndBindAddr(*join, sys)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Error()
+					os.Exit(exitSystemError)
+				}
+
+				adv = &addr
+			}
+			if *joinPort == 0 {
+				port := (uint)(api.DefaultControllerRESTAPIPort)
+				joinPort = &port
+			}
+
+			var failed int
+			errs := scanSubmitResults(*join, (uint16)(*joinPort), *adv, *ctrlUser, *ctrlPass, results)
+			for i, err := range errs {
+				if err != nil {
+					log.WithFields(log.Fields{
+						"error": err, "repo": results[i].Repository, "tag": results[i].Tag,
+					}).Error("Failed to submit scan result")
+					failed++
+					if *spoolDir == "" {
+						continue
+					}
+					if file, err := spoolResult(*spoolDir, results[i]); err != nil {
+						log.WithFields(log.Fields{"error": err, "dir": *spoolDir}).Error("Failed to save scan result")
+					} else {
+						log.WithFields(log.Fields{"file": file}).Info("Scan result saved, submit it later with: scan submit <file>")
+					}
+				}
+			}
+			log.WithFields(log.Fields{"submitted": len(results) - failed, "failed": failed}).Info("Scan results submitted.")
+			return failed
+		}
+
+		// newBatchScans returns the scans of the images with the registry options of the command line
+		newBatchScans := func(images []string) []*batchScan {
+			scans := make([]*batchScan, len(images))
+			for i, img := range images {
+				reg, repo, tag := parseImageValue(img)
+				reg, repo = applyRegistryPrefix(reg, repo, *registry)
+				if repo == "" || tag == "" {
+					log.WithFields(log.Fields{"image": img}).Error("Invalid image value.")
+					os.Exit(exitUsage)
+				}
+				scans[i] = &batchScan{image: img, req: &share.ScanImageRequest{
+					Registry:    reg,
+					Repository:  repo,
+					Tag:         tag,
+					Username:    *regUser,
+					Password:    *regPass,
+					ScanLayers:  true,
+					ScanSecrets: false,
+					BaseImage:   *baseImage,
+				}}
+				applyCredsFile(scans[i].req, opts.creds)
+				applyDockerConfig(scans[i].req, opts.dockerConfig)
+			}
+			return scans
+		}
+
+		// scanBatch scans the images of the database set, writes and submits the results, and exits by the outcome
+		scanBatch := func(scans []*batchScan) {
+			// Ctrl-C cancels the scans in progress and the ones not started
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-done
+				cancel()
+			}()
+
+			start := time.Now()
+			scanImageList(ctx, scans, int(*parallel), opts)
+			failed, writeErr := writeBatchResults(scans, time.Since(start), opts)
+			cancel()
+
+			var unsigned int
+			reports := make([]*cvetools.ScanReport, len(scans))
+			for i, s := range scans {
+				reports[i] = s.result
+				if opts.unsigned(s.result) || opts.stale(s.result) {
+					unsigned++
+				}
+			}
+			unsubmitted := submitResults(reports)
+			if writeErr != nil {
+				exitScan(exitOutputError)
+			} else if unsubmitted > 0 {
+				exitScan(exitSubmitError)
+			} else if opts.strict && failed > 0 {
+				exitScan(exitScanError)
+			} else if unsigned > 0 {
+				exitScan(exitViolation)
+			}
+		}
+
+		if sweep != nil {
+			template := &share.ScanImageRequest{
+				Registry:    sweep.registry,
+				Username:    *regUser,
+				Password:    *regPass,
+				ScanLayers:  true,
+				ScanSecrets: false,
+				BaseImage:   *baseImage,
+			}
+			applyCredsFile(template, opts.creds)
+			applyDockerConfig(template, opts.dockerConfig)
+
+			if sweep.dryRun {
+				// the images already scanned with the database are skipped, the database is not loaded
+				dbVersion, _, _ := common.GetDbVersion(*dbPath)
+				if code := dryRunSweep(context.Background(), os.Stdout, sweep, template, dbVersion, common.GetDbSources(*dbPath)); code != 0 {
+					exitScan(code)
+				}
+				return
+			}
+
+			dbData, _ := dbRead(*dbPath, 3, "")
+			if dbData == nil {
+				exitScan(exitDBError)
+			}
+			setOnDemandDB(dbData)
+
+			// Ctrl-C stops the sweep, the state has the images scanned
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-done
+				cancel()
+			}()
+			code := runSweep(ctx, sweep, template, int(*parallel), opts)
+			cancel()
+			if code != 0 {
+				exitScan(code)
+			}
+			return
+		}
+
+		if *imageList != "" {
+			images, err := readImageList(*imageList)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Failed to read image list")
+				os.Exit(exitUsage)
+			}
+			scans := newBatchScans(images)
+
+			dbData, _ := dbRead(*dbPath, 3, "")
+			if dbData == nil {
+				exitScan(exitDBError)
+			}
+			setOnDemandDB(dbData)
+			scanBatch(scans)
+			return
+		}
+
 		var req *share.ScanImageRequest
 
 		if *image != "" {
 			// This normally is the case when scanner runs by the command line
 			reg, repo, tag := parseImageValue(*image)
+			reg, repo = applyRegistryPrefix(reg, repo, *registry)
 			if repo == "" || tag == "" {
 				log.Error("Invalid image value.")
-				return
+				os.Exit(exitUsage)
 			}
 
 			req = &share.ScanImageRequest{
@@ -311,54 +1225,79 @@ func main() {
 			}
 		}
 
+		applyCredsFile(req, opts.creds)
+		applyDockerConfig(req, opts.dockerConfig)
+
 		// DB read error printed inside dbRead()
-		dbData := dbRead(*dbPath, 3, "")
+		dbData, _ := dbRead(*dbPath, 3, "")
 		if dbData != nil {
-			result := scanOnDemand(req, dbData, *show)
-
-			// submit scan result if join address is given
-			if result != nil && result.Error == share.ScanErrorCode_ScanErrNone &&
-				*join != "" && *ctrlUser != "" && *ctrlPass != "" {
-				if *adv == "" {
-					_, addr, err := cluster.ResolveJoinAndBindAddr(*join, sys)
-					if err != nil {
-						log.WithFields(log.Fields{"error": err}).Error()
-						os.Exit(-2)
-					}
-
-					adv = &addr
-				}
-				if *joinPort == 0 {
-					port := (uint)(api.DefaultControllerRESTAPIPort)
-					joinPort = &port
-				}
-
-				err := scanSubmitResult(*join, (uint16)(*joinPort), *adv, *ctrlUser, *ctrlPass, result)
-				if err != nil {
-					log.WithFields(log.Fields{"error": err}).Error("Failed to sumit scan result")
-				} else {
-					log.Info("Scan result submitted.")
-				}
+			result, writeErr := scanOnDemand(req, dbData, opts)
+			if result != nil && result.Artifact != nil && result.Artifact.Subject == "" && len(result.Artifact.Images) > 0 && writeErr == nil {
+				// the images of a helm chart, instead of the chart
+				log.WithFields(log.Fields{"images": result.Artifact.Images}).Info("Scan the images referenced by the artifact")
+				scanBatch(newBatchScans(result.Artifact.Images))
+				return
 			}
+			unsubmitted := submitResults([]*cvetools.ScanReport{result})
+			if writeErr != nil {
+				exitScan(exitOutputError)
+			} else if unsubmitted > 0 {
+				exitScan(exitSubmitError)
+			} else if opts.strict && (result == nil || result.Error != share.ScanErrorCode_ScanErrNone) {
+				exitScan(exitScanError)
+			} else if opts.unsigned(result) || opts.stale(result) {
+				exitScan(exitViolation)
+			}
+		} else {
+			exitScan(exitDBError)
 		}
 
 		return
 	}
+	if *noWait {
+		*startupMaxWait = 0
+		*startupWait = 0
+	}
+	if *startupMaxWait < 0 || *startupWait < 0 || *registerWaitTime < 0 {
+		log.WithFields(log.Fields{
+			"startup_max_wait": *startupMaxWait, "startup_wait": *startupWait, "register_retry_interval": *registerWaitTime,
+		}).Error("Negative wait time")
+		os.Exit(exitUsage)
+	}
+	log.WithFields(log.Fields{
+		"startup_max_wait": *startupMaxWait, "startup_wait": *startupWait, "register_retry_interval": *registerWaitTime,
+	}).Info()
+
+	if *sweepInterval > 0 {
+		// remove what failed scans left behind, cleanup of a single scan can be skipped when it is killed
+		cvetools.ImagePathUsageMaxAge = *sweepInterval
+		go func() {
+			for range time.Tick(*sweepInterval) {
+				cvetools.SweepImagePath(*sweepInterval)
+			}
+		}()
+	}
+
+	if *registriesConf != "" {
+		cvetools.WatchRegistriesConf(registriesReloadInterval)
+	}
+
+	if controllerGRPCTLS, err = newGRPCTLS(*grpcCert, *grpcKey, *grpcCACert, *grpcPeerName); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid grpc certificates")
+		os.Exit(exitUsage)
+	} else if controllerGRPCTLS != nil {
+		controllerGRPCTLS.watch(grpcTLSReloadInterval)
+	}
+
 	// Block until server is up.
 	grpcServer := startGRPCServer()
 	defer grpcServer.Stop()
 
-	if !(*noWait) {
-		// Intentionally introduce some delay so scanner IP can be populated to all enforcers
-		log.Info("Wait 15s .........................")
-		time.Sleep(time.Second * 15)
-	}
-
 	if *adv == "" {
 		_, addr, err := cluster.ResolveJoinAndBindAddr(*join, sys)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error()
-			os.Exit(-2)
+			os.Exit(exitSystemError)
 		}
 
 		adv = &addr
@@ -372,16 +1311,33 @@ func main() {
 		joinPort = &port
 	}
 
+	var id *scannerID
 	if selfID == "" {
-		// if not running in container
-		selfID = *adv
+		// if not running in container, the address can be shared by other scanners
+		id = newFallbackScannerID(*adv, *idFile)
+		log.WithFields(log.Fields{"id": id.get()}).Info("Scanner ID")
+	} else {
+		id = newScannerID(selfID)
+	}
+
+	if *startupMaxWait > 0 {
+		// Wait for the controller to answer, the registration fails until it does. It doesn't tell the scanner IP
+		// has reached the enforcers, the startup delay still waits for it.
+		if err := waitControllerReady(*join, (uint16)(*joinPort), *startupMaxWait); isTLSHandshakeError(err) {
+			os.Exit(exitSystemError)
+		}
+	}
+	if *startupWait > 0 {
+		// Intentionally introduce some delay so scanner IP can be populated to all enforcers
+		log.Infof("Wait %v .........................", *startupWait)
+		time.Sleep(*startupWait)
 	}
 
 	// Use the original address, which is the service name, so when controller changes,
 	// new IP can be resolved
-	go connectController(*dbPath, *adv, *join, selfID, (uint32)(*advPort), (uint16)(*joinPort))
+	go connectController(*dbPath, *adv, *join, id, (uint32)(*advPort), (uint16)(*joinPort), *registerWaitTime, *maxUnregistered, *dbMaxRetries)
 	<-done
 
 	log.Info("Exiting ...")
-	scannerDeregister(*join, (uint16)(*joinPort), selfID)
+	scannerDeregister(*join, (uint16)(*joinPort), id.get())
 }
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
 )
 
 func TestImageParsing(t *testing.T) {
@@ -19,6 +28,14 @@ func TestImageParsing(t *testing.T) {
 		{"http://example.com:5000/nginx:2.1", "http://example.com:5000", "nginx", "2.1"},
 		{"registry.hub.docker.com/python:3.4", "https://registry.hub.docker.com", "library/python", "3.4"},
 		{"registry.hub.docker.com/test/python:3.4", "https://registry.hub.docker.com", "test/python", "3.4"},
+		{"[::1]:5000/test/nginx:v2", "https://[::1]:5000", "test/nginx", "v2"},
+		{"[::1]:5000/nginx", "https://[::1]:5000", "nginx", "latest"},
+		{"[fd00::10]/test/nginx:v2", "https://[fd00::10]", "test/nginx", "v2"},
+		{"[fd00::10]/nginx", "https://[fd00::10]", "nginx", "latest"},
+		{"http://[fd00::10]:5000/test/nginx:v2", "http://[fd00::10]:5000", "test/nginx", "v2"},
+		{"http://[fd00::10]/nginx:2.1", "http://[fd00::10]", "nginx", "2.1"},
+		{"[::1]:5000", "https://[::1]:5000", "", ""},
+		{"[fd00::10]", "https://[fd00::10]", "", ""},
 	}
 
 	for _, c := range cases {
@@ -28,3 +45,129 @@ func TestImageParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestParseImageSize(t *testing.T) {
+	tests := map[string]int64{
+		"":       0,
+		"0":      0,
+		"1024":   1024,
+		"500MB":  500 << 20,
+		"2g":     2 << 30,
+		" 3 GB ": 3 << 30,
+		"10KB":   10 << 10,
+		"7B":     7,
+	}
+	for value, expect := range tests {
+		if size, err := parseImageSize(value); err != nil || size != expect {
+			t.Errorf("Unexpected size: value=%q size=%d expect=%d err=%v", value, size, expect, err)
+		}
+	}
+
+	for _, value := range []string{"abc", "-1", "1.5GB", "99999999999TB"} {
+		if _, err := parseImageSize(value); err == nil {
+			t.Errorf("Expect an error: value=%q", value)
+		}
+	}
+}
+
+func TestWriteCveDbJSON(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cvedb")
+	defer os.RemoveAll(dir)
+
+	out := &outputCVE{Version: "3.100", CreateTime: "2026-01-02T00:00:00Z"}
+	output := filepath.Join(dir, "cvedb.json")
+	if err := writeCveDbJSON(output, out); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	var read outputCVE
+	if data, err := ioutil.ReadFile(output); err != nil || json.Unmarshal(data, &read) != nil || read.Version != out.Version {
+		t.Errorf("Incorrect output: %+v %v", read, err)
+	}
+
+	if err := writeCveDbJSON(filepath.Join(output, "cvedb.json"), out); err == nil {
+		t.Errorf("Write under a file should fail")
+	}
+}
+
+func TestDBReadMaxRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cvedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// no database in the folder, the single attempt gives up without a wait
+	if data, _ := dbRead(dir+"/", 1, ""); data != nil {
+		t.Errorf("Unexpected database read")
+	}
+	if v := metricDBReadRetries.Value(); v != 1 {
+		t.Errorf("Incorrect retries metric: %d", v)
+	}
+}
+
+// linkProcessor sets the link of the vulnerabilities
+type linkProcessor struct{}
+
+func (p linkProcessor) Name() string { return "link" }
+
+func (p linkProcessor) Process(image *cvetools.ImageMetadata, vuls []*share.ScanVulnerability) ([]*share.ScanVulnerability, error) {
+	for _, v := range vuls {
+		v.Link = "https://tickets.corp/" + v.Name
+	}
+	return vuls, nil
+}
+
+func TestPostProcessedScans(t *testing.T) {
+	defer func(tools *cvetools.CveTools, tasker *Tasker) { cveTools, scanTasker = tools, tasker }(cveTools, scanTasker)
+	scanTasker = nil
+	dir := t.TempDir()
+	writeTestTables(t, dir)
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.TbPath = dir + "/"
+	cveTools.SwapDB("1.000", "2022-01-02T00:00:00Z")
+	cveTools.RegisterPostProcessor(linkProcessor{})
+
+	// the scans without a report are post-processed like the ones of an image
+	rs := new(rpcService)
+	result, err := rs.ScanAppPackage(context.Background(), &share.ScanAppRequest{Packages: []*share.ScanAppPackage{
+		{AppName: "npm", ModuleName: "lodash", Version: "4.17.15", FileName: "app/package.json"},
+	}})
+	if err != nil || result == nil || len(result.Vuls) != 1 {
+		t.Fatalf("Incorrect scan: %+v, %v", result, err)
+	}
+	if v := result.Vuls[0]; v.Link != "https://tickets.corp/CVE-2022-0002" {
+		t.Errorf("Vulnerability not post-processed: %+v", v)
+	}
+
+	// a failed scan is returned as it is
+	failed := &share.ScanResult{Error: share.ScanErrorCode_ScanErrNetwork}
+	if r, err := postProcessed(failed, nil); r != failed || err != nil || r.Error != share.ScanErrorCode_ScanErrNetwork {
+		t.Errorf("Incorrect failed scan: %+v, %v", r, err)
+	}
+}
+
+func TestGetScannerInfo(t *testing.T) {
+	defer func(tools *cvetools.CveTools, size int64, benchmark string, workers int) {
+		cveTools, maxImageSize, complianceBenchmark, cvetools.MatchWorkers = tools, size, benchmark, workers
+	}(cveTools, maxImageSize, complianceBenchmark, cvetools.MatchWorkers)
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.SwapDB("3.456", "2026-10-01T00:00:00Z")
+	maxImageSize = 2 << 30
+	complianceBenchmark = "cis-docker"
+	cvetools.MatchWorkers = 4
+
+	// not delayed by a database update waiting for the scans
+	cveTools.UpdateMux.Lock()
+	info, err := (&rpcStreamService{}).GetScannerInfo(context.Background(), &share.RPCVoid{})
+	cveTools.UpdateMux.Unlock()
+	if err != nil || info.CVEDBVersion != "3.456" || info.CVEDBCreateTime != "2026-10-01T00:00:00Z" || info.ScannerVersion != cvetools.ScannerVersion {
+		t.Fatalf("Incorrect info: %v %+v", err, info)
+	}
+	if info.MaxImageSize != 2<<30 || info.MatchWorkers != 4 || info.InflateWorkers == 0 || info.ScanTask {
+		t.Errorf("Incorrect limits: %+v", info)
+	}
+	features := strings.Join(info.Features, ",")
+	if !strings.Contains(features, "platform,") || !strings.Contains(features, "signature-verification") || !strings.Contains(features, "scan-progress") || !strings.HasSuffix(features, ",compliance:cis-docker") {
+		t.Errorf("Incorrect features: %s", features)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultScannerIDFile = "/var/neuvector/scanner_id"
+
+// scannerID is the ID the scanner registers and deregisters with. Out of a container, the ID falls back to
+// the advertised address, which is not unique: the scanners behind the same NAT address would replace each
+// other in the controller. A random suffix kept in a file is appended, so the ID is the same after a restart
+// and the controller doesn't keep the ghost scanners.
+type scannerID struct {
+	mutex sync.RWMutex
+	id    string
+	addr  string // the advertised address of the fallback ID, empty for a container ID
+	file  string
+}
+
+func newScannerID(id string) *scannerID {
+	return &scannerID{id: id}
+}
+
+// newFallbackScannerID returns the ID of the advertised address and the suffix of the file. If the file can't
+// be written, the suffix is a hash of the hostname and the MAC addresses, which is stable too.
+func newFallbackScannerID(addr, file string) *scannerID {
+	s := &scannerID{addr: addr, file: file}
+	suffix, err := readIDSuffix(file)
+	if err != nil {
+		suffix = randomIDSuffix()
+		if err = writeIDSuffix(file, suffix); err != nil {
+			suffix = hostIDSuffix()
+			log.WithFields(log.Fields{"file": file, "error": err}).Warn("Failed to save the scanner ID, use the host hash")
+		}
+	}
+	s.id = addr + "-" + suffix
+	return s
+}
+
+func (s *scannerID) get() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.id
+}
+
+// regenerate replaces the suffix of the fallback ID rejected by the controller as a duplicate. It returns
+// false for a container ID, which is unique.
+func (s *scannerID) regenerate() bool {
+	if s.addr == "" {
+		return false
+	}
+	suffix := randomIDSuffix()
+	if err := writeIDSuffix(s.file, suffix); err != nil {
+		log.WithFields(log.Fields{"file": s.file, "error": err}).Warn("Failed to save the scanner ID, it changes after a restart")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.id = s.addr + "-" + suffix
+	return true
+}
+
+func readIDSuffix(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	suffix := strings.TrimSpace(string(data))
+	if suffix == "" {
+		return "", errors.New("Empty scanner ID file")
+	}
+	return suffix, nil
+}
+
+func writeIDSuffix(file, suffix string) error {
+	if file == "" {
+		return errors.New("No scanner ID file")
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(suffix+"\n"), 0644)
+}
+
+func randomIDSuffix() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hostIDSuffix hashes the hostname and the MAC addresses of the host
+func hostIDSuffix() string {
+	hostname, _ := os.Hostname()
+	macs := make([]string, 0)
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if len(iface.HardwareAddr) > 0 {
+				macs = append(macs, iface.HardwareAddr.String())
+			}
+		}
+	}
+	sort.Strings(macs)
+	sum := sha256.Sum256([]byte(hostname + "," + strings.Join(macs, ",")))
+	return hex.EncodeToString(sum[:4])
+}
+
+// isDuplicateIDError returns true if the controller rejected the registration because the ID is in use
+func isDuplicateIDError(err error) bool {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) && se.GRPCStatus().Code() == codes.AlreadyExists {
+		return true
+	}
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "duplicate")
+}
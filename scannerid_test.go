@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestScannerID(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "neuvector", "scanner_id")
+
+	id := newFallbackScannerID("10.1.1.1", file)
+	if !strings.HasPrefix(id.get(), "10.1.1.1-") || len(id.get()) != len("10.1.1.1-")+8 {
+		t.Fatalf("Incorrect scanner ID: %s", id.get())
+	}
+	// the same ID after a restart
+	if again := newFallbackScannerID("10.1.1.1", file); again.get() != id.get() {
+		t.Errorf("Scanner ID changed after restart: %s, %s", id.get(), again.get())
+	}
+
+	// a duplicate is replaced, and kept for the next restart
+	rejected := id.get()
+	if !id.regenerate() || id.get() == rejected {
+		t.Errorf("Scanner ID not regenerated: %s", id.get())
+	}
+	if again := newFallbackScannerID("10.1.1.1", file); again.get() != id.get() {
+		t.Errorf("Regenerated scanner ID not kept: %s, %s", id.get(), again.get())
+	}
+
+	// the host hash if the file can't be written
+	blocked := filepath.Join(t.TempDir(), "file")
+	ioutil.WriteFile(blocked, nil, 0644)
+	a, b := newFallbackScannerID("10.1.1.1", filepath.Join(blocked, "scanner_id")), newFallbackScannerID("10.1.1.1", filepath.Join(blocked, "scanner_id"))
+	if a.get() != b.get() || a.get() != "10.1.1.1-"+hostIDSuffix() {
+		t.Errorf("Incorrect host scanner ID: %s, %s", a.get(), b.get())
+	}
+
+	// a container ID is unique
+	if c := newScannerID("f0e1d2c3"); c.regenerate() || c.get() != "f0e1d2c3" {
+		t.Errorf("Container ID regenerated: %s", c.get())
+	}
+
+	if !isDuplicateIDError(fmt.Errorf("Failed to send register request: %w", status.Error(codes.AlreadyExists, "scanner exists"))) {
+		t.Errorf("Duplicate ID error not detected")
+	}
+	if isDuplicateIDError(fmt.Errorf("Failed to send register request: %w", status.Error(codes.Unavailable, "connection refused"))) {
+		t.Errorf("Unavailable error detected as a duplicate ID")
+	}
+}
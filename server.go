@@ -2,16 +2,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/neuvector/neuvector/share"
 	"github.com/neuvector/neuvector/share/cluster"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/cvetools"
+	"github.com/neuvector/scanner/rpc"
 )
 
 func createEnforcerScanServiceWrapper(conn *grpc.ClientConn) cluster.Service {
@@ -19,6 +30,13 @@ func createEnforcerScanServiceWrapper(conn *grpc.ClientConn) cluster.Service {
 }
 
 func findEnforcerServiceClient(ep string) (share.EnforcerScanServiceClient, error) {
+	if controllerGRPCTLS != nil {
+		conn, err := getTLSConn(ep, ep, alwaysCompressed, nil)
+		if err != nil {
+			return nil, err
+		}
+		return share.NewEnforcerScanServiceClient(conn), nil
+	}
 	if cluster.GetGRPCClientEndpoint(ep) == "" {
 		cluster.CreateGRPCClient(ep, ep, true, createEnforcerScanServiceWrapper)
 	}
@@ -31,6 +49,14 @@ func findEnforcerServiceClient(ep string) (share.EnforcerScanServiceClient, erro
 	}
 }
 
+// checkScanSpace rejects a new scan when the image working path is short of space
+func checkScanSpace() error {
+	if err := cvetools.CheckFreeSpace(); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return nil
+}
+
 type rpcService struct {
 }
 
@@ -38,17 +64,18 @@ func (rs *rpcService) Ping(ctx context.Context, v *share.RPCVoid) (*share.RPCVoi
 	return &share.RPCVoid{}, nil
 }
 
-func (rs *rpcService) ScanRunning(ctx context.Context, req *share.ScanRunningRequest) (*share.ScanResult, error) {
-	var result *share.ScanResult
-
+func (rs *rpcService) ScanRunning(ctx context.Context, req *share.ScanRunningRequest) (result *share.ScanResult, err error) {
+	defer func() { countScan(result, err) }()
 	log.WithFields(log.Fields{"id": req.ID, "type": req.Type, "agent": req.AgentRPCEndPoint}).Debug("")
+	if err := checkScanSpace(); err != nil {
+		return nil, err
+	}
 	// 依据AgentRPCEdingPoint 获取EnforceServiceCleint
 	client, err := findEnforcerServiceClient(req.AgentRPCEndPoint)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Fail to connect to agent")
 
-		result = &share.ScanResult{Version: cveTools.CveDBVersion, CVEDBCreateTime: cveTools.CveDBCreateTime, Error: share.ScanErrorCode_ScanErrNetwork}
-		return result, nil
+		return withDBVersion(&share.ScanResult{Error: share.ScanErrorCode_ScanErrNetwork}, nil)
 	}
 	//获取扫描请求数据
 	data, err := client.ScanGetFiles(ctx, req)
@@ -64,8 +91,7 @@ func (rs *rpcService) ScanRunning(ctx context.Context, req *share.ScanRunningReq
 		// actual result from enforcer with only 3 conditions
 		switch data.Error {
 		case share.ScanErrorCode_ScanErrContainerExit: // no longer live
-			result = &share.ScanResult{Version: cveTools.CveDBVersion, CVEDBCreateTime: cveTools.CveDBCreateTime, Error: data.Error}
-			return result, nil
+			return withDBVersion(&share.ScanResult{Error: data.Error}, nil)
 		case share.ScanErrorCode_ScanErrInProgress: // in progress
 			return nil, nil
 		case share.ScanErrorCode_ScanErrNone: // a good result within time, proceed to scan procedure
@@ -73,65 +99,313 @@ func (rs *rpcService) ScanRunning(ctx context.Context, req *share.ScanRunningReq
 	} else if data == nil {
 		// rpc request not made
 		log.WithFields(log.Fields{"error": err}).Error("Fail to make rpc call")
-		result = &share.ScanResult{Version: cveTools.CveDBVersion, CVEDBCreateTime: cveTools.CveDBCreateTime, Error: share.ScanErrorCode_ScanErrNetwork}
-		return result, nil
+		return withDBVersion(&share.ScanResult{Error: share.ScanErrorCode_ScanErrNetwork}, nil)
 	} else if err != nil || data.Error != share.ScanErrorCode_ScanErrNone {
 		log.WithFields(log.Fields{"error": err}).Error("Fail to read files")
-		result = &share.ScanResult{Version: cveTools.CveDBVersion, CVEDBCreateTime: cveTools.CveDBCreateTime, Error: data.Error}
-		return result, nil
+		return withDBVersion(&share.ScanResult{Error: data.Error}, nil)
 	}
 
 	log.WithFields(log.Fields{"id": req.ID, "type": req.Type}).Debug("File read done")
 	if scanTasker != nil {
-		return scanTasker.Run(ctx, *data)
+		return postProcessed(withDBVersion(scanTasker.Run(ctx, *data)))
+	}
+	return postProcessed(cveTools.ScanImageData(data))
+}
+
+// withDBVersion makes sure the result tells the CVE database that produced it. The result of a scan task has
+// the version of the database the task loaded, a task that failed early may leave it empty.
+func withDBVersion(result *share.ScanResult, err error) (*share.ScanResult, error) {
+	if result != nil && result.Version == "" {
+		cveTools.SetDBVersion(result)
 	}
-	return cveTools.ScanImageData(data)
+	return result, err
 }
 
-func (rs *rpcService) ScanImageData(ctx context.Context, data *share.ScanData) (*share.ScanResult, error) {
+// postProcessed runs the post-processors and orders the result of a scan that has no report, like ScanImage
+// does with the report of an image
+func postProcessed(result *share.ScanResult, err error) (*share.ScanResult, error) {
+	if result != nil {
+		cveTools.PostProcess(&cvetools.ScanReport{ScanResult: result})
+		cvetools.SortScanResult(result)
+	}
+	return result, err
+}
+
+func (rs *rpcService) ScanImageData(ctx context.Context, data *share.ScanData) (result *share.ScanResult, err error) {
+	defer func() { countScan(result, err) }()
 	log.Debug("")
+	if err := checkScanSpace(); err != nil {
+		return nil, err
+	}
 	if scanTasker != nil {
-		return scanTasker.Run(ctx, *data)
+		return postProcessed(withDBVersion(scanTasker.Run(ctx, *data)))
 	}
-	return cveTools.ScanImageData(data)
+	return postProcessed(cveTools.ScanImageData(data))
 }
 
-func (rs *rpcService) ScanImage(ctx context.Context, req *share.ScanImageRequest) (*share.ScanResult, error) {
+func (rs *rpcService) ScanImage(ctx context.Context, req *share.ScanImageRequest) (result *share.ScanResult, err error) {
+	defer func() { countScan(result, err) }()
+	scanID := cvetools.NewScanID()
 	log.WithFields(log.Fields{
-		"Registry": req.Registry, "image": fmt.Sprintf("%s:%s", req.Repository, req.Tag),
+		"Registry": req.Registry, "image": fmt.Sprintf("%s:%s", req.Repository, req.Tag), "scan": scanID,
 	}).Debug()
 
+	if err := checkScanSpace(); err != nil {
+		return nil, err
+	}
+	scanReq := &cvetools.ImageScanRequest{
+		ScanImageRequest: *req,
+		MaxImageSize:     requestMaxImageSize(ctx),
+		Strict:           strictScan,
+		Platform:         requestPlatform(ctx),
+		BestEffort:       bestEffort,
+		ScanID:           scanID,
+		Compliance:       complianceBenchmark,
+		SiblingTags:      requestSiblingTags(ctx),
+		Misconfig:        misconfigChecks,
+		ExcludePaths:     excludePaths,
+	}
+	if policy := requestSignaturePolicy(ctx); policy != nil {
+		scanReq.CosignKeys, scanReq.Keyless = policy.CosignKeys, policy.Keyless
+	}
+
+	scanCtx := ctx
+	timeout := requestScanTimeout(ctx)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		scanCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var report *cvetools.ScanReport
 	if scanTasker != nil {
-		return scanTasker.Run(ctx, *req)
+		report, err = scanTasker.RunReport(scanCtx, *scanReq)
+	} else {
+		report, err = cveTools.ScanImageReport(scanCtx, scanReq, "")
 	}
-	return cveTools.ScanImage(ctx, req, "")
+	report, err = scanTimeoutReport(ctx, scanCtx, timeout, report, err)
+	if report == nil {
+		return nil, err
+	}
+	cvetools.RecordPhaseStats(report.Stats)
+	cveTools.PostProcess(report)
+	cvetools.SortScanResult(report.ScanResult)
+	withDBVersion(report.ScanResult, nil)
+	sendSignatureVerification(ctx, report.Signature)
+	return report.ScanResult, err
 }
 
-func (rs *rpcService) ScanAppPackage(ctx context.Context, req *share.ScanAppRequest) (*share.ScanResult, error) {
+// grpc metadata key of the per-request image size limit, in bytes or with a unit like "2GB"
+const maxImageSizeMetadata = "max-image-size"
+
+// grpc metadata key of the per-request scan timeout, a duration like "30m" or seconds
+const scanTimeoutMetadata = "scan-timeout"
+
+// grpc metadata key of the largest repository to look up the other tags of the image in, "0" to disable
+const siblingTagsMetadata = "sibling-tags"
+
+// grpc metadata key of the platform to scan of a multi-platform image, like "linux/arm64"
+const platformMetadata = "platform"
+
+// grpc metadata key of the signature policy of the request, the JSON of signaturePolicy
+const signaturePolicyMetadata = "signature-policy"
+
+// grpc header key of the signature verification outcome, the JSON of cvetools.SignatureVerification.
+// share.ScanResult only has the satisfied verifiers of the roots of trust. This is a stop-gap until
+// share.ScanResult has a field for the outcome, the controllers don't read the header.
+const signatureVerificationMetadata = "signature-verification"
+
+// grpc metadata key of the register request with scannerCapabilities. This is a stop-gap until
+// share.ScannerRegisterData has a field for them, the controllers don't read the key.
+const capabilitiesMetadata = "scanner-capabilities"
+
+// scannerCapabilities are the calls and headers served beyond share.ScannerService, listed by GetScannerInfo
+var scannerCapabilities = []string{"signature-verification", "scan-progress"}
+
+// scannerFeatures are the features a scan request can use, the grpc metadata of the requests and the capabilities,
+// followed by the checks enabled by the options of the scanner
+func scannerFeatures() []string {
+	features := []string{platformMetadata, maxImageSizeMetadata, scanTimeoutMetadata, siblingTagsMetadata, "secret-scan"}
+	features = append(features, scannerCapabilities...)
+	if complianceBenchmark != "" {
+		features = append(features, "compliance:"+complianceBenchmark)
+	}
+	if misconfigChecks {
+		features = append(features, "misconfig")
+	}
+	if strictScan {
+		features = append(features, "strict")
+	}
+	if bestEffort {
+		features = append(features, "best-effort")
+	}
+	return features
+}
+
+type signaturePolicy struct {
+	CosignKeys []*cvetools.CosignKey   `json:"CosignKeys,omitempty"`
+	Keyless    *cvetools.KeylessPolicy `json:"Keyless,omitempty"`
+}
+
+// requestSignaturePolicy returns the keys and the keyless identity to verify the image signatures with
+func requestSignaturePolicy(ctx context.Context) *signaturePolicy {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	values := md.Get(signaturePolicyMetadata)
+	if len(values) == 0 {
+		return nil
+	}
+
+	var policy signaturePolicy
+	if err := json.Unmarshal([]byte(values[0]), &policy); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid signature policy")
+		return nil
+	}
+	if k := policy.Keyless; k != nil && (k.Identity == "" || k.Issuer == "" || k.FulcioRoots == "" || k.RekorKey == "") {
+		// kept, the keyless signatures fail the verification instead of being accepted or not checked
+		log.Error("Incomplete keyless signature policy, the Fulcio root and the Rekor key are required")
+	}
+	return &policy
+}
+
+// sendSignatureVerification returns the signature verification outcome in the response header
+func sendSignatureVerification(ctx context.Context, sv *cvetools.SignatureVerification) {
+	if sv == nil {
+		return
+	}
+	value, _ := json.Marshal(sv)
+	if err := grpc.SetHeader(ctx, metadata.Pairs(signatureVerificationMetadata, string(value))); err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("Failed to set the signature verification header")
+	}
+}
+
+func requestPlatform(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(platformMetadata); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// requestMaxImageSize returns the size limit of the image, which the caller can override with the
+// grpc metadata, e.g. "0" to allow a big image explicitly.
+func requestMaxImageSize(ctx context.Context) int64 {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(maxImageSizeMetadata); len(values) > 0 {
+			if size, err := parseImageSize(values[0]); err == nil {
+				return size
+			}
+			log.WithFields(log.Fields{"value": values[0]}).Error("Invalid max image size")
+		}
+	}
+	return maxImageSize
+}
+
+// requestSiblingTags returns the largest number of tags of a repository to look up the other tags of the
+// image in. Each tag costs a registry request, so the caller opts in with the grpc metadata.
+func requestSiblingTags(ctx context.Context) int {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(siblingTagsMetadata); len(values) > 0 {
+			if max, err := strconv.ParseUint(values[0], 10, 16); err == nil {
+				return int(max)
+			}
+			log.WithFields(log.Fields{"value": values[0]}).Error("Invalid sibling tags")
+		}
+	}
+	return siblingTags
+}
+
+// requestScanTimeout returns the timeout of the scan, which the caller can override with the grpc metadata,
+// e.g. a longer one for a big image
+func requestScanTimeout(ctx context.Context) time.Duration {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(scanTimeoutMetadata); len(values) > 0 {
+			if timeout, err := parseScanTimeout(values[0]); err == nil {
+				return timeout
+			}
+			log.WithFields(log.Fields{"value": values[0]}).Error("Invalid scan timeout")
+		}
+	}
+	return scanTimeout
+}
+
+// parseScanTimeout accepts a go duration or a number of seconds, 0 for no timeout
+func parseScanTimeout(value string) (time.Duration, error) {
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("Invalid scan timeout: %s", value)
+	}
+	return timeout, nil
+}
+
+// scanTimeoutReport returns the timeout error when the scan was aborted by the timeout of the request, and
+// not by the caller, so the controller can retry it with a longer timeout. A scan that completed before the
+// deadline passed keeps its result.
+func scanTimeoutReport(ctx, scanCtx context.Context, timeout time.Duration, report *cvetools.ScanReport, err error) (*cvetools.ScanReport, error) {
+	if scanCtx.Err() != context.DeadlineExceeded || ctx.Err() != nil {
+		return report, err
+	}
+	if err == nil && report != nil && report.ScanResult != nil && report.Error == share.ScanErrorCode_ScanErrNone {
+		return report, err
+	}
+	if report == nil || report.ScanResult == nil {
+		report = cvetools.NewScanReport(&share.ScanResult{})
+	}
+	log.WithFields(log.Fields{"timeout": timeout, "error": err}).Error("Scan timed out")
+	report.Error = share.ScanErrorCode_ScanErrTimeout
+	report.ErrorMessage = fmt.Sprintf("Scan timed out after %v", timeout)
+	return report, nil
+}
+
+func (rs *rpcService) ScanAppPackage(ctx context.Context, req *share.ScanAppRequest) (result *share.ScanResult, err error) {
+	defer func() { countScan(result, err) }()
 	log.WithFields(log.Fields{"Packages": req.Packages}).Debug("")
+	if err := checkScanSpace(); err != nil {
+		return nil, err
+	}
 	if scanTasker != nil {
-		return scanTasker.Run(ctx, *req)
+		return postProcessed(withDBVersion(scanTasker.Run(ctx, *req)))
 	}
-	return cveTools.ScanAppPackage(req, "")
+	return postProcessed(cveTools.ScanAppPackage(req, ""))
 }
 
-func (rs *rpcService) ScanAwsLambda(ctx context.Context, req *share.ScanAwsLambdaRequest) (*share.ScanResult, error) {
+func (rs *rpcService) ScanAwsLambda(ctx context.Context, req *share.ScanAwsLambdaRequest) (result *share.ScanResult, err error) {
+	defer func() { countScan(result, err) }()
 	log.WithFields(log.Fields{"LambdaFunc": req.FuncName}).Debug("")
+	if err := checkScanSpace(); err != nil {
+		return nil, err
+	}
 	if scanTasker != nil {
-		return scanTasker.Run(ctx, *req)
+		return postProcessed(withDBVersion(scanTasker.Run(ctx, *req)))
 	}
-	return cveTools.ScanAwsLambda(req, "")
+	return postProcessed(cveTools.ScanAwsLambda(req, ""))
 }
 
-func startGRPCServer() *cluster.GRPCServer {
-	var grpc *cluster.GRPCServer
+// scanGRPCServer is the grpc server of the scans, of the cluster package or with the certificates of -grpc_cert
+type scanGRPCServer interface {
+	GetServer() *grpc.Server
+	Start()
+	Stop()
+}
+
+func startGRPCServer() scanGRPCServer {
+	var server scanGRPCServer
 	var err error
 	// 默认端口18402
 	port := cluster.DefaultScannerGRPCPort
 
 	log.WithFields(log.Fields{"port": port}).Info("")
 	for {
-		grpc, err = cluster.NewGRPCServerTCP(fmt.Sprintf(":%d", port))
+		if controllerGRPCTLS != nil {
+			server, err = newTLSGRPCServer(fmt.Sprintf(":%d", port), controllerGRPCTLS)
+		} else {
+			server, err = cluster.NewGRPCServerTCP(fmt.Sprintf(":%d", port))
+		}
 		if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("Fail to create GRPC server")
 			time.Sleep(time.Second * 5)
@@ -141,11 +415,12 @@ func startGRPCServer() *cluster.GRPCServer {
 	}
 
 	svc := new(rpcService)
-	share.RegisterScannerServiceServer(grpc.GetServer(), svc)
-	go grpc.Start()
+	share.RegisterScannerServiceServer(server.GetServer(), svc)
+	rpc.RegisterScannerStreamServiceServer(server.GetServer(), &rpcStreamService{rs: svc})
+	go server.Start()
 
 	log.Info("GRPC server started")
-	return grpc
+	return server
 }
 
 const controller string = "controller"
@@ -155,142 +430,356 @@ func createControllerScanServiceWrapper(conn *grpc.ClientConn) cluster.Service {
 }
 
 func getControllerServiceClient(joinIP string, joinPort uint16, cb cluster.GRPCCallback) (share.ControllerScanServiceClient, error) {
+	if controllerGRPCTLS != nil {
+		conn, err := getTLSConn(controller, fmt.Sprintf("%s:%v", joinIP, joinPort), isControllerTLSCompressed, cb)
+		if err != nil {
+			return nil, err
+		}
+		return share.NewControllerScanServiceClient(conn), nil
+	}
 	if cluster.GetGRPCClientEndpoint(controller) == "" {
 		ep := fmt.Sprintf("%s:%v", joinIP, joinPort)
 		cluster.CreateGRPCClient(controller, ep, true, createControllerScanServiceWrapper)
 	}
-	c, err := cluster.GetGRPCClient(controller, nil, cb)
+	c, err := cluster.GetGRPCClient(controller, isControllerCompressed, cb)
 	if err == nil {
 		return c.(share.ControllerScanServiceClient), nil
 	} else {
-		log.WithFields(log.Fields{"err": err}).Error("Failed to connect to grpc server")
+		log.WithFields(log.Fields{"err": err}).Debug("Failed to connect to grpc server")
 		return nil, err
 	}
 }
 
-type clientCallback struct {
-	shutCh         chan interface{}
-	ignoreShutdown bool
+// isControllerCompressed negotiates gzip compression with the controller, mainly for the cve database
+// sent at registration. Older controllers don't install the decompressor, so fall back to uncompressed.
+func isControllerCompressed(endpoint string) bool {
+	compress := cluster.IsControllerGRPCCommpressed(endpoint)
+	log.WithFields(log.Fields{"endpoint": endpoint, "compress": compress}).Info("Controller grpc channel")
+	return compress
 }
 
-func (cb *clientCallback) Shutdown() {
-	log.Debug()
-	if !cb.ignoreShutdown {
-		cb.shutCh <- nil
-	}
-}
+const controllerCap string = "controllerCap"
+const controllerProbeInterval = time.Second * 2
 
-const cvedbChunkMax = 32 * 1024
+func createControllerCapServiceWrapper(conn *grpc.ClientConn) cluster.Service {
+	return share.NewControllerCapServiceClient(conn)
+}
 
-func scannerRegisterStream(ctx context.Context, client share.ControllerScanServiceClient, data *share.ScannerRegisterData) error {
-	stream, err := client.ScannerRegisterStream(ctx)
+// getControllerCapClient returns the client of the capability calls, made to probe the controller
+func getControllerCapClient(joinIP string, joinPort uint16) (share.ControllerCapServiceClient, error) {
+	ep := fmt.Sprintf("%s:%v", joinIP, joinPort)
+	if controllerGRPCTLS != nil {
+		conn, err := getTLSConn(controllerCap, ep, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return share.NewControllerCapServiceClient(conn), nil
+	}
+	if cluster.GetGRPCClientEndpoint(controllerCap) == "" {
+		cluster.CreateGRPCClient(controllerCap, ep, true, createControllerCapServiceWrapper)
+	}
+	c, err := cluster.GetGRPCClient(controllerCap, nil, nil)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to get stream")
-		return errors.New("Failed to  to controller")
+		return nil, err
 	}
+	return c.(share.ControllerCapServiceClient), nil
+}
 
-	// send a block without data to test if stream API is supported
-	cvedb := data.CVEDB
-	defer func() {
-		data.CVEDB = cvedb
-	}()
+// deleteControllerCapClient closes the client of the capability calls
+func deleteControllerCapClient() {
+	if controllerGRPCTLS != nil {
+		deleteTLSConn(controllerCap)
+		return
+	}
+	cluster.DeleteGRPCClient(controllerCap)
+}
 
-	data.CVEDB = make(map[string]*share.ScanVulnerability)
-	err = stream.Send(data)
-	if err == io.EOF {
-		log.Info("Stream register API is not supported")
-		return errors.New("Stream register API is not supported")
-	} else if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to send")
+// probeController makes a cheap capability call to tell if the controller grpc service is up
+func probeController(joinIP string, joinPort uint16) error {
+	c, err := getControllerCapClient(joinIP, joinPort)
+	if err != nil {
 		return err
 	}
 
-	// clone the cvedb
-	clone := make(map[string]*share.ScanVulnerability, len(cvedb))
-	for k, v := range cvedb {
-		clone[k] = v
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
 
-	for {
-		var count int
+	_, err = c.IsGRPCCompressed(ctx, &share.RPCVoid{})
+	return err
+}
 
-		if len(clone) > cvedbChunkMax {
-			count = cvedbChunkMax
-		} else {
-			count = len(clone)
+// waitControllerReady polls the controller until it answers or maxWait expires. It returns the error of the last
+// probe, on timeout or at once on a TLS handshake error.
+func waitControllerReady(joinIP string, joinPort uint16, maxWait time.Duration) error {
+	defer deleteControllerCapClient()
+
+	start := time.Now()
+	for {
+		err := probeController(joinIP, joinPort)
+		if err == nil {
+			log.WithFields(log.Fields{"elapsed": time.Since(start)}).Info("Controller is ready")
+			return nil
+		}
+		if isTLSHandshakeError(err) {
+			// not fixed by waiting, the certificates of either side have to be replaced
+			log.WithFields(log.Fields{"error": err}).Error("The grpc certificates of the controller and the scanner don't verify each other")
+			return err
+		}
+		if time.Since(start) >= maxWait {
+			log.WithFields(log.Fields{"error": err, "wait": maxWait}).Warn("Controller is not ready, proceed anyway")
+			return err
 		}
+		log.WithFields(log.Fields{"error": err}).Debug("Controller is not ready")
+		time.Sleep(controllerProbeInterval)
+	}
+}
 
-		send := make(map[string]*share.ScanVulnerability, count)
+type clientCallback struct {
+	shutCh         chan interface{}
+	ignoreShutdown bool
+}
 
-		for k, v := range clone {
-			send[k] = v
-			delete(clone, k)
+func (cb *clientCallback) Shutdown() {
+	log.Debug()
+	if !cb.ignoreShutdown {
+		cb.shutCh <- nil
+	}
+}
 
-			count--
-			if count == 0 {
-				break
-			}
+// the entries of the database in a message of the streamed registration
+var cvedbChunkMax = 32 * 1024
+
+// dbWalker calls fn with each vulnerability of the database, until fn returns an error
+type dbWalker func(fn func(name string, v *share.ScanVulnerability) error) error
+
+// errDBReplaced fails a walk of the database replaced while it was read
+var errDBReplaced = errors.New("The CVE database was replaced while it was read")
+
+// walkCveDb reads the metadata of the database loaded for the scans a table line at a time. The database is
+// only locked while the lines are read, not while fn sends them, so an update doesn't wait for the controller;
+// the walk fails if the database was replaced in between.
+func walkCveDb(fn func(name string, v *share.ScanVulnerability) error) error {
+	cveTools.UpdateMux.RLock()
+	defer cveTools.UpdateMux.RUnlock()
+	db := cveTools.CurrentDB()
+	return common.WalkCveDbMeta(cveTools.TbPath, func(name string, v *share.ScanVulnerability) error {
+		cveTools.UpdateMux.RUnlock()
+		err := fn(name, v)
+		cveTools.UpdateMux.RLock()
+		if err == nil && cveTools.CurrentDB() != db {
+			err = errDBReplaced
 		}
+		return err
+	})
+}
 
-		log.WithFields(log.Fields{"entries": len(send)}).Info("Stream send")
+// errStreamUnsupported is returned by scannerRegisterStream when the controller has no streamed registration
+var errStreamUnsupported = errors.New("Stream register API is not supported")
 
-		data.CVEDB = send
-		err = stream.Send(data)
+// scannerRegisterStream sends the database in chunks of cvedbChunkMax entries, read from the tables as they
+// are sent, so only a chunk is in memory
+func scannerRegisterStream(ctx context.Context, client share.ControllerScanServiceClient, data *share.ScannerRegisterData, walk dbWalker) error {
+	stream, err := client.ScannerRegisterStream(ctx)
+	if status.Code(err) == codes.Unimplemented {
+		log.Info("Stream register API is not supported")
+		return errStreamUnsupported
+	} else if err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("Failed to get stream")
+		return fmt.Errorf("Failed to connect to controller: %w", err)
+	}
+
+	defer func() {
+		data.CVEDB = nil
+	}()
+
+	send := func(chunk map[string]*share.ScanVulnerability) error {
+		data.CVEDB = chunk
+		err := stream.Send(data)
 		if err == io.EOF {
-			log.Info("Stream register API is not supported")
-			return errors.New("Stream register API is not supported")
-		} else if err != nil {
-			log.WithFields(log.Fields{"error": err}).Error("Failed to send")
+			// the stream is ended by the controller, the status tells why
+			if _, err = stream.CloseAndRecv(); err == nil || err == io.EOF || status.Code(err) == codes.Unimplemented {
+				log.Info("Stream register API is not supported")
+				return errStreamUnsupported
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Debug("Failed to send")
 			return err
 		}
+		return nil
+	}
+	// send a block without data to test if stream API is supported
+	if err = send(make(map[string]*share.ScanVulnerability)); err != nil {
+		return err
+	}
 
-		if len(clone) == 0 {
-			break
+	var entries, chunks int
+	chunk := make(map[string]*share.ScanVulnerability, cvedbChunkMax)
+	err = walk(func(name string, v *share.ScanVulnerability) error {
+		chunk[name] = v
+		if len(chunk) < cvedbChunkMax {
+			return nil
 		}
+		entries, chunks = entries+len(chunk), chunks+1
+		log.WithFields(log.Fields{"entries": len(chunk)}).Debug("Stream send")
+		err := send(chunk)
+		chunk = make(map[string]*share.ScanVulnerability, cvedbChunkMax)
+		return err
+	})
+	if err == nil && len(chunk) > 0 {
+		entries, chunks = entries+len(chunk), chunks+1
+		err = send(chunk)
+	}
+	if err != nil {
+		return err
 	}
 
-	log.Info("Stream send done")
-	if _, err = stream.CloseAndRecv(); err != nil && err != io.EOF {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to close")
+	log.WithFields(log.Fields{"entries": entries, "chunks": chunks}).Info("Stream send done")
+	if _, err = stream.CloseAndRecv(); status.Code(err) == codes.Unimplemented {
+		log.Info("Stream register API is not supported")
+		return errStreamUnsupported
+	} else if err != nil && err != io.EOF {
+		log.WithFields(log.Fields{"error": err}).Debug("Failed to close")
 		return err
 	}
 
 	return nil
 }
 
+// scannerRegister registers with the database streamed, or with the whole database in a request if the
+// controller doesn't support the stream
 func scannerRegister(joinIP string, joinPort uint16, data *share.ScannerRegisterData, cb cluster.GRPCCallback) error {
 	log.WithFields(log.Fields{
-		"join": fmt.Sprintf("%s:%d", joinIP, joinPort), "version": data.CVEDBVersion, "entries": len(data.CVEDB),
+		"join": fmt.Sprintf("%s:%d", joinIP, joinPort), "version": data.CVEDBVersion,
 	}).Debug()
 
 	client, err := getControllerServiceClient(joinIP, joinPort, cb)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to find ctrl client")
-		return errors.New("Failed to connect to controller")
+		log.WithFields(log.Fields{"error": err}).Debug("Failed to find ctrl client")
+		return fmt.Errorf("Failed to connect to controller: %w", err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
 	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, capabilitiesMetadata, strings.Join(scannerCapabilities, ","))
+
+	// a failed stream is retried as a stream, the whole database is only sent to the older controllers
+	if err = scannerRegisterStream(ctx, client, data, walkCveDb); err != errStreamUnsupported {
+		return err
+	}
+	return scannerRegisterWhole(ctx, client, data, walkCveDb)
+}
 
-	if err = scannerRegisterStream(ctx, client, data); err == nil {
+// scannerRegisterWhole registers with the whole database in memory, for the controllers without the stream
+func scannerRegisterWhole(ctx context.Context, client share.ControllerScanServiceClient, data *share.ScannerRegisterData, walk dbWalker) error {
+	cvedb := make(map[string]*share.ScanVulnerability)
+	err := walk(func(name string, v *share.ScanVulnerability) error {
+		cvedb[name] = v
 		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("Failed to read the database")
+		return err
 	}
+	data.CVEDB = cvedb
+	defer func() {
+		data.CVEDB = nil
+	}()
 
 	_, err = client.ScannerRegister(ctx, data)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Failed to register")
-		return errors.New("Failed to send register request")
+		log.WithFields(log.Fields{"error": err}).Debug("Failed to register")
+		return fmt.Errorf("Failed to send register request: %w", err)
 	}
 	return nil
 }
 
+// the registration failures are logged at a higher level the longer the scanner is not registered
+const (
+	registerInfoAfter  = time.Duration(time.Minute)
+	registerWarnAfter  = time.Duration(time.Minute * 5)
+	registerErrorAfter = time.Duration(time.Minute * 15)
+	maxRegisterWait    = time.Duration(time.Minute * 5)
+)
+
+var (
+	metricRegisterFailures = expvar.NewInt("controller_register_failures") // consecutive, 0 when registered
+	metricRegistered       = expvar.NewInt("controller_registered")        // 1 when registered
+)
+
+// registerRetry tracks the consecutive registration failures, the wait between the retries doubles from the
+// retry interval up to maxRegisterWait
+type registerRetry struct {
+	interval        time.Duration
+	maxUnregistered time.Duration // give up after not registered for so long, 0 to retry forever
+	now             func() time.Time
+
+	since    time.Time
+	failures int64
+	wait     time.Duration
+}
+
+func newRegisterRetry(interval, maxUnregistered time.Duration) *registerRetry {
+	return &registerRetry{interval: interval, maxUnregistered: maxUnregistered, now: time.Now}
+}
+
+// failed records the failure, and returns the wait before the next retry, the level to log the failure
+// at, and true to give up
+func (r *registerRetry) failed() (time.Duration, log.Level, bool) {
+	if r.failures == 0 {
+		r.since = r.now()
+		r.wait = r.interval
+	} else if r.wait < maxRegisterWait {
+		if r.wait *= 2; r.wait > maxRegisterWait {
+			r.wait = maxRegisterWait
+		}
+	}
+	r.failures++
+	metricRegisterFailures.Set(r.failures)
+	metricRegistered.Set(0)
+
+	elapsed := r.now().Sub(r.since)
+	level := log.DebugLevel
+	switch {
+	case elapsed >= registerErrorAfter:
+		level = log.ErrorLevel
+	case elapsed >= registerWarnAfter:
+		level = log.WarnLevel
+	case elapsed >= registerInfoAfter:
+		level = log.InfoLevel
+	}
+	return r.wait, level, r.maxUnregistered > 0 && elapsed >= r.maxUnregistered
+}
+
+func (r *registerRetry) registered() {
+	r.failures = 0
+	metricRegisterFailures.Set(0)
+	metricRegistered.Set(1)
+}
+
+// logRegisterFailure logs the failure at the level, with the resolved controller addresses from the warning up
+func (r *registerRetry) logRegisterFailure(level log.Level, joinIP string, joinPort uint16, err error) {
+	fields := log.Fields{
+		"join": fmt.Sprintf("%s:%d", joinIP, joinPort), "failures": r.failures,
+		"unregistered": r.now().Sub(r.since).Round(time.Second), "error": err,
+	}
+	if level <= log.WarnLevel {
+		if addrs, lerr := net.LookupHost(joinIP); lerr == nil {
+			fields["resolved"] = addrs
+		} else {
+			fields["resolved"] = lerr.Error()
+		}
+	}
+	log.WithFields(fields).Log(level, "Not registered to the controller")
+}
+
 func scannerDeregister(joinIP string, joinPort uint16, id string) error {
 	log.Debug()
 
 	client, err := getControllerServiceClient(joinIP, joinPort, nil)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Failed to find ctrl client")
-		return errors.New("Failed to connect to controller")
+		return fmt.Errorf("Failed to connect to controller: %w", err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/cluster"
+	"github.com/neuvector/scanner/common"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestRequestSignaturePolicy(t *testing.T) {
+	if policy := requestSignaturePolicy(context.Background()); policy != nil {
+		t.Errorf("Unexpected policy without metadata: %+v", policy)
+	}
+
+	value := `{"CosignKeys":[{"Name":"release","PEM":"-----BEGIN PUBLIC KEY-----"}],"Keyless":{"Identity":"dev@example.com","Issuer":"https://accounts.example.com"}}`
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(signaturePolicyMetadata, value))
+	policy := requestSignaturePolicy(ctx)
+	if policy == nil || len(policy.CosignKeys) != 1 || policy.CosignKeys[0].Name != "release" {
+		t.Fatalf("Incorrect policy: %+v", policy)
+	}
+	if policy.Keyless == nil || policy.Keyless.Identity != "dev@example.com" {
+		t.Errorf("Expect the keyless policy without the Fulcio root kept to fail the verification: %+v", policy.Keyless)
+	}
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(signaturePolicyMetadata, "{"))
+	if policy := requestSignaturePolicy(ctx); policy != nil {
+		t.Errorf("Unexpected policy of invalid metadata: %+v", policy)
+	}
+}
+
+func TestRegisterRetry(t *testing.T) {
+	now := time.Now()
+	r := newRegisterRetry(10*time.Second, 20*time.Minute)
+	r.now = func() time.Time { return now }
+
+	expect := []struct {
+		after time.Duration // since the first failure
+		wait  time.Duration
+		level log.Level
+	}{
+		{0, 10 * time.Second, log.DebugLevel},
+		{10 * time.Second, 20 * time.Second, log.DebugLevel},
+		{30 * time.Second, 40 * time.Second, log.DebugLevel},
+		{70 * time.Second, 80 * time.Second, log.InfoLevel},
+		{150 * time.Second, 160 * time.Second, log.InfoLevel},
+		{310 * time.Second, 300 * time.Second, log.WarnLevel},
+		{16 * time.Minute, 300 * time.Second, log.ErrorLevel},
+	}
+	start := now
+	for i, e := range expect {
+		now = start.Add(e.after)
+		wait, level, giveUp := r.failed()
+		if wait != e.wait || level != e.level || giveUp {
+			t.Errorf("Incorrect retry %d: wait=%v level=%v giveUp=%v", i, wait, level, giveUp)
+		}
+	}
+	if v := metricRegisterFailures.Value(); v != int64(len(expect)) {
+		t.Errorf("Incorrect failure counter: %d", v)
+	}
+
+	now = start.Add(20 * time.Minute)
+	if _, _, giveUp := r.failed(); !giveUp {
+		t.Errorf("Should give up after the max unregistered duration")
+	}
+
+	// the wait and the escalation start over after registered
+	r.registered()
+	if wait, level, _ := r.failed(); wait != 10*time.Second || level != log.DebugLevel || metricRegisterFailures.Value() != 1 {
+		t.Errorf("Incorrect retry after registered: wait=%v level=%v", wait, level)
+	}
+}
+
+func TestScanTimeout(t *testing.T) {
+	scanTimeout = time.Minute * 10
+	defer func() { scanTimeout = 0 }()
+
+	if timeout := requestScanTimeout(context.Background()); timeout != time.Minute*10 {
+		t.Errorf("Incorrect default timeout: %v", timeout)
+	}
+	for value, expect := range map[string]time.Duration{"90": time.Second * 90, "1h30m": time.Minute * 90, "0": 0, "soon": time.Minute * 10} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(scanTimeoutMetadata, value))
+		if timeout := requestScanTimeout(ctx); timeout != expect {
+			t.Errorf("Incorrect timeout of %s: %v", value, timeout)
+		}
+	}
+
+	// aborted by the timeout of the request, a task killed returns no report
+	ctx := context.Background()
+	scanCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	<-scanCtx.Done()
+	report, err := scanTimeoutReport(ctx, scanCtx, time.Millisecond, nil, scanCtx.Err())
+	if err != nil || report == nil || report.Error != share.ScanErrorCode_ScanErrTimeout {
+		t.Errorf("Incorrect timeout result: %+v, %v", report, err)
+	}
+
+	// completed as the deadline passed, the result is kept
+	done := cvetools.NewScanReport(&share.ScanResult{Vuls: []*share.ScanVulnerability{{Name: "CVE-2022-0001"}}})
+	if report, err = scanTimeoutReport(ctx, scanCtx, time.Millisecond, done, nil); report != done || report.Error != share.ScanErrorCode_ScanErrNone {
+		t.Errorf("Incorrect completed result: %+v, %v", report, err)
+	}
+
+	// cancelled by the caller, not a timeout
+	ctx, cancelCaller := context.WithCancel(context.Background())
+	scanCtx, cancel = context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+	cancelCaller()
+	if report, err = scanTimeoutReport(ctx, scanCtx, time.Hour, nil, ctx.Err()); report != nil || err != context.Canceled {
+		t.Errorf("Incorrect cancelled result: %+v, %v", report, err)
+	}
+}
+
+// registerClient is a controller receiving the streamed registrations, or only the whole one
+type registerClient struct {
+	share.ControllerScanServiceClient
+	noStream  bool
+	streamErr error // of opening the stream
+	chunks    []int
+	whole     int
+}
+
+func (c *registerClient) ScannerRegisterStream(ctx context.Context, opts ...grpc.CallOption) (share.ControllerScanService_ScannerRegisterStreamClient, error) {
+	if c.streamErr != nil {
+		return nil, c.streamErr
+	}
+	return &registerStream{c: c}, nil
+}
+
+func (c *registerClient) ScannerRegister(ctx context.Context, in *share.ScannerRegisterData, opts ...grpc.CallOption) (*share.RPCVoid, error) {
+	c.whole = len(in.CVEDB)
+	return &share.RPCVoid{}, nil
+}
+
+type registerStream struct {
+	grpc.ClientStream
+	c *registerClient
+}
+
+func (s *registerStream) Send(data *share.ScannerRegisterData) error {
+	if s.c.noStream {
+		return io.EOF
+	}
+	s.c.chunks = append(s.c.chunks, len(data.CVEDB))
+	return nil
+}
+
+func (s *registerStream) CloseAndRecv() (*share.RPCVoid, error) {
+	if s.c.noStream {
+		return nil, status.Error(codes.Unimplemented, "unknown method ScannerRegisterStream")
+	}
+	return &share.RPCVoid{}, nil
+}
+
+func TestRegisterStream(t *testing.T) {
+	saved := cvedbChunkMax
+	defer func() { cvedbChunkMax = saved }()
+	cvedbChunkMax = 4
+
+	var maxHeld int // the most entries read and not sent yet
+	client := &registerClient{}
+	walk := func(fn func(name string, v *share.ScanVulnerability) error) error {
+		for i := 0; i < 10; i++ {
+			held := i + 1
+			for _, n := range client.chunks {
+				held -= n
+			}
+			if held > maxHeld {
+				maxHeld = held
+			}
+			if err := fn(fmt.Sprintf("debian:CVE-2022-%04d", i), &share.ScanVulnerability{Severity: "High"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data := &share.ScannerRegisterData{CVEDBVersion: "3.201"}
+	if err := scannerRegisterStream(context.Background(), client, data, walk); err != nil {
+		t.Fatalf("Failed to stream: %v", err)
+	}
+	// the empty block probing the stream, then the chunks
+	if fmt.Sprint(client.chunks) != "[0 4 4 2]" || maxHeld > cvedbChunkMax || data.CVEDB != nil {
+		t.Errorf("Incorrect chunks: %v, %d entries held", client.chunks, maxHeld)
+	}
+
+	// the whole database for a controller without the stream
+	client = &registerClient{noStream: true}
+	if err := scannerRegisterStream(context.Background(), client, data, walk); err != errStreamUnsupported {
+		t.Fatalf("Stream should not be supported: %v", err)
+	}
+	if err := scannerRegisterWhole(context.Background(), client, data, walk); err != nil || client.whole != 10 || data.CVEDB != nil {
+		t.Errorf("Incorrect whole registration: %v, %d entries", err, client.whole)
+	}
+
+	// the cause of a failure is kept for the retry log
+	client = &registerClient{streamErr: status.Error(codes.Unavailable, "connection refused")}
+	if err := scannerRegisterStream(context.Background(), client, data, walk); !errors.Is(err, client.streamErr) {
+		t.Errorf("Incorrect stream failure: %v", err)
+	}
+}
+
+// testController is a controller on a unix socket, which tells if it installs the decompressor and records if
+// each register message was compressed
+type testController struct {
+	compressed bool
+	inflated   int64 // the messages decompressed
+	messages   []bool
+}
+
+func (c *testController) IsGRPCCompressed(ctx context.Context, v *share.RPCVoid) (*share.CLUSBoolean, error) {
+	return &share.CLUSBoolean{Value: c.compressed}, nil
+}
+
+func (c *testController) ScannerRegister(ctx context.Context, data *share.ScannerRegisterData) (*share.RPCVoid, error) {
+	return &share.RPCVoid{}, nil
+}
+
+func (c *testController) ScannerRegisterStream(stream share.ControllerScanService_ScannerRegisterStreamServer) error {
+	for {
+		inflated := atomic.LoadInt64(&c.inflated)
+		if _, err := stream.Recv(); err == io.EOF {
+			return stream.SendAndClose(&share.RPCVoid{})
+		} else if err != nil {
+			return err
+		}
+		c.messages = append(c.messages, atomic.LoadInt64(&c.inflated) > inflated)
+	}
+}
+
+func (c *testController) ScannerDeregister(ctx context.Context, data *share.ScannerDeregisterData) (*share.RPCVoid, error) {
+	return &share.RPCVoid{}, nil
+}
+
+func (c *testController) SubmitScanResult(ctx context.Context, result *share.ScanResult) (*share.RPCVoid, error) {
+	return &share.RPCVoid{}, nil
+}
+
+// countedDecompressor counts the messages it decompresses
+type countedDecompressor struct {
+	grpc.Decompressor
+	count *int64
+}
+
+func (d countedDecompressor) Do(r io.Reader) ([]byte, error) {
+	atomic.AddInt64(d.count, 1)
+	return d.Decompressor.Do(r)
+}
+
+func TestRegisterCompression(t *testing.T) {
+	defer func(tools *cvetools.CveTools) { cveTools = tools }(cveTools)
+	dir, _ := ioutil.TempDir("", "register")
+	defer os.RemoveAll(dir)
+	for i := 0; i < common.DBMax; i++ {
+		ioutil.WriteFile(filepath.Join(dir, common.DBS.Buffers[i].Name+"_full.tb"), nil, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "apps.tb"), []byte(`{"VN":"CVE-2022-0001","SE":"High"}`+"\n"), 0644)
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.TbPath = dir + "/"
+	cveTools.SwapDB("3.201", "")
+
+	for _, compressed := range []bool{true, false} {
+		ctrl := &testController{compressed: compressed}
+		socket := filepath.Join(dir, fmt.Sprintf("controller-%v.sock", compressed))
+		listen, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := grpc.NewServer(grpc.RPCDecompressor(countedDecompressor{grpc.NewGZIPDecompressor(), &ctrl.inflated}))
+		share.RegisterControllerCapServiceServer(server, ctrl)
+		share.RegisterControllerScanServiceServer(server, ctrl)
+		go server.Serve(listen)
+
+		// the client of the controller is of the socket, the join address is not dialed
+		cluster.CreateGRPCClient(controller, socket, true, createControllerScanServiceWrapper)
+		err = scannerRegister("", 0, &share.ScannerRegisterData{CVEDBVersion: "3.201"}, nil)
+		cluster.DeleteGRPCClient(controller)
+		server.Stop()
+
+		if err != nil || len(ctrl.messages) < 2 {
+			t.Fatalf("Failed to register, the controller decompresses %v: %v, %d messages", compressed, err, len(ctrl.messages))
+		}
+		for i, c := range ctrl.messages {
+			if c != compressed {
+				t.Errorf("Incorrect compression of the register message %d: %v, the controller decompresses %v", i, c, compressed)
+			}
+		}
+	}
+}
+
+func TestWalkCveDb(t *testing.T) {
+	defer func(tools *cvetools.CveTools) { cveTools = tools }(cveTools)
+	dir, _ := ioutil.TempDir("", "cvedb")
+	defer os.RemoveAll(dir)
+	for i := 0; i < common.DBMax; i++ {
+		ioutil.WriteFile(filepath.Join(dir, common.DBS.Buffers[i].Name+"_full.tb"), nil, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "apps.tb"), []byte(`{"VN":"CVE-2022-0001","SE":"High"}`+"\n"+`{"VN":"CVE-2022-0002","SE":"Low"}`+"\n"), 0644)
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.TbPath = dir + "/"
+	cveTools.SwapDB("3.201", "")
+
+	names := make([]string, 0)
+	err := walkCveDb(func(name string, v *share.ScanVulnerability) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil || fmt.Sprint(names) != "[apps:CVE-2022-0001 apps:CVE-2022-0002]" {
+		t.Fatalf("Incorrect walk: %v %v", err, names)
+	}
+
+	// the database is not locked while an entry is sent, and the walk fails if it was replaced meanwhile
+	err = walkCveDb(func(name string, v *share.ScanVulnerability) error {
+		cveTools.UpdateMux.Lock()
+		cveTools.SwapDB("3.202", "")
+		cveTools.UpdateMux.Unlock()
+		return nil
+	})
+	if err != errDBReplaced {
+		t.Errorf("Unexpected walk of the replaced database: %v", err)
+	}
+}
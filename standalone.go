@@ -4,12 +4,19 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,6 +26,7 @@ import (
 	"github.com/neuvector/neuvector/controller/api"
 	"github.com/neuvector/neuvector/share"
 	scanUtils "github.com/neuvector/neuvector/share/scan"
+	"github.com/neuvector/scanner/cvetools"
 )
 
 // The user must mount volume to /var/neuvector and the result will be written to the mounted folder
@@ -27,9 +35,242 @@ const scanOutputFile = "scan_result.json"
 
 const apiCallTimeout = time.Duration(30 * time.Second)
 
+// version of the on-demand report fields, bumped as cvetools.ReportSchemaVersion
+const onDemandSchemaVersion = 19
+
 type scanOnDemandReportData struct {
-	ErrMsg string                  `json:"error_message"`
-	Report *api.RESTScanRepoReport `json:"report"`
+	SchemaVersion int                             `json:"schema_version"`
+	Provenance    *cvetools.ScanProvenance        `json:"provenance,omitempty"`
+	ErrMsg        string                          `json:"error_message"`
+	Report        *onDemandReport                 `json:"report"`
+	Platform      string                          `json:"platform,omitempty"`
+	ImageCreated  string                          `json:"image_created,omitempty"`
+	StaleImage    bool                            `json:"stale_image,omitempty"`
+	UnknownAge    bool                            `json:"image_age_unknown,omitempty"`
+	RepoTags      []string                        `json:"repo_tags,omitempty"`
+	Packages      []*cvetools.PackageFindings     `json:"packages,omitempty"`
+	Coverage      *cvetools.ScanCoverage          `json:"coverage,omitempty"`
+	Timings       []*cvetools.PhaseTiming         `json:"timings,omitempty"`
+	LayerTimings  []*cvetools.LayerTiming         `json:"layer_timings,omitempty"`
+	Locations     []*cvetools.ModuleLocation      `json:"module_locations,omitempty"`
+	Signature     *cvetools.SignatureVerification `json:"signature_verification,omitempty"`
+	Overrides     []*cvetools.SeverityOverride    `json:"severity_overrides,omitempty"`
+	Artifact      *cvetools.ArtifactInfo          `json:"artifact,omitempty"`
+	Checks        []*cvetools.ImageCheck          `json:"checks,omitempty"`
+	ImageSize     *cvetools.ImageSize             `json:"image_size,omitempty"`
+	Compliance    *cvetools.ComplianceReport      `json:"compliance,omitempty"`
+	VEXSuppressed []*cvetools.VEXFinding          `json:"vex_suppressed,omitempty"`
+}
+
+// onDemandReport is the REST report of the scan, with the finding ID of each vulnerability
+type onDemandReport struct {
+	*api.RESTScanRepoReport
+	Vuls []*onDemandVulnerability `json:"vulnerabilities"`
+}
+
+// onDemandVulnerability has the severity of the database and the NVD rating of the CVSS scores, the NVD one
+// is empty for a vulnerability without a score, and the aliases of the database
+type onDemandVulnerability struct {
+	*api.RESTVulnerability
+	NVDSeverity string   `json:"nvd_severity"`
+	NVDScore    float32  `json:"nvd_score,omitempty"`
+	Aliases     []string `json:"aliases,omitempty"`
+	FindingID   string   `json:"finding_id"`
+}
+
+// newOnDemandReport converts the result to the REST report, the vulnerabilities are converted in order
+func newOnDemandReport(result *cvetools.ScanReport) *onDemandReport {
+	rpt := &onDemandReport{RESTScanRepoReport: scanUtils.ScanRepoResult2REST(result.ScanResult, nil)}
+	rpt.Vuls = make([]*onDemandVulnerability, len(rpt.RESTScanRepoReport.Vuls))
+	for i, v := range rpt.RESTScanRepoReport.Vuls {
+		rpt.Vuls[i] = &onDemandVulnerability{
+			RESTVulnerability: v, Aliases: result.Aliases[result.Vuls[i].DBKey], FindingID: cvetools.FindingID(result.Vuls[i]),
+		}
+		rpt.Vuls[i].NVDSeverity, rpt.Vuls[i].NVDScore = cvetools.NVDSeverity(v.Score, v.ScoreV3)
+	}
+	return rpt
+}
+
+// groupByPackage aggregates the vulnerabilities of each package in the output
+const groupByPackage = "package"
+
+// options of the on-demand scan given from the command line
+type onDemandOptions struct {
+	show         string                  // stdout print options
+	format       string                  // stdout format, table or markdown
+	topFindings  int                     // the top findings listed in the markdown report
+	groupBy      string                  // group the vulnerabilities by package, empty for the flat list
+	severitySrc  string                  // the severity of the counts and the outputs, vendor, nvd or max
+	verbosity    int                     // below verbosityInfo prints less, see printReport and printSummary
+	progress     bool                    // write the progress events of the scans to stderr
+	maxImageAge  time.Duration           // flag images created earlier than this, 0 to disable
+	maxSize      int64                   // reject images larger than this in bytes, 0 for no limit
+	strict       bool                    // fail incomplete scans
+	platform     string                  // platform to scan of a multi-platform image
+	bestEffort   bool                    // scan the downloaded layers when some fail to download
+	cosignKeys   []*cvetools.CosignKey   // verify the image signatures with the keys
+	keyless      *cvetools.KeylessPolicy // verify the keyless signatures by the signer identity
+	failUnsigned bool                    // fail the images without a verified signature
+	failStale    bool                    // fail the images older than maxImageAge
+	siblingTags  int                     // report the other tags of the image in a repository of up to this many tags
+	compliance   string                  // the compliance benchmark to check, like cis-docker
+	misconfig    bool                    // check the image reference and its base are pinned
+	excludePaths []string                // the patterns of the files not scanned
+	rate         *sweepRate              // the share of the sweep budget of each scanner task, nil for none
+	dockerConfig *dockerConfig           // credentials of the registries of -docker_config
+	creds        credsFile               // credentials of the registries by host pattern, of -creds_file
+	vexOut       string                  // the OpenVEX document of the ignored vulnerabilities, of -vex_out
+	why          string                  // the vulnerability whose match decisions are printed, of -why
+}
+
+// printReport tells if the report is printed to stdout, not with -verbosity summary or silent
+func (opts *onDemandOptions) printReport() bool {
+	return opts.verbosity > verbositySummary
+}
+
+// printSummary tells if the summary line is printed to stderr, not with -verbosity quiet or silent
+func (opts *onDemandOptions) printSummary() bool {
+	return opts.verbosity != verbosityQuiet && opts.verbosity != verbositySilent
+}
+
+// findingSeverities selects the severities of the findings of a report by -severity_source
+type findingSeverities struct {
+	source     string
+	overridden map[string]bool // by the name and the package, the findings remapped by -severity_map
+}
+
+// severities indexes the severity overrides of the report once for the severities of its findings
+func (opts *onDemandOptions) severities(result *cvetools.ScanReport) *findingSeverities {
+	s := &findingSeverities{source: opts.severitySrc, overridden: make(map[string]bool, len(result.SeverityOverrides))}
+	for _, o := range result.SeverityOverrides {
+		s.overridden[o.Name+"\x00"+o.Package] = true
+	}
+	return s
+}
+
+// severity returns the severity of the finding of -severity_source, and if its vendor and NVD ratings
+// disagree. A severity remapped by -severity_map is kept whatever the source.
+func (s *findingSeverities) severity(name, pkg, severity string, score, scoreV3 float32) (string, bool) {
+	if s.overridden[name+"\x00"+pkg] {
+		return severity, false
+	}
+	return cvetools.SelectSeverity(s.source, severity, score, scoreV3)
+}
+
+// vulSeverity is the severity of a vulnerability of the scan result
+func (s *findingSeverities) vulSeverity(v *share.ScanVulnerability) (string, bool) {
+	return s.severity(v.Name, v.PackageName, v.Severity, v.Score, v.ScoreV3)
+}
+
+// severitySource returns the source of the severity of the outputs, the vendor one by default
+func (opts *onDemandOptions) severitySource() string {
+	if opts.severitySrc == "" {
+		return cvetools.SeveritySourceVendor
+	}
+	return opts.severitySrc
+}
+
+// unsigned returns true if the image has to fail for a missing or invalid signature
+func (opts *onDemandOptions) unsigned(result *cvetools.ScanReport) bool {
+	return opts.failUnsigned && (result == nil || result.Signature == nil || !result.Signature.Verified)
+}
+
+// stale returns true if the image has to fail for being older than the maximum age
+func (opts *onDemandOptions) stale(result *cvetools.ScanReport) bool {
+	return opts.failStale && cvetools.IsStaleImage(result, opts.maxImageAge)
+}
+
+// scanRequest adds the command line options to the request
+func (opts *onDemandOptions) scanRequest(req *share.ScanImageRequest) *cvetools.ImageScanRequest {
+	return &cvetools.ImageScanRequest{
+		ScanImageRequest: *req,
+		MaxImageSize:     opts.maxSize,
+		Strict:           opts.strict,
+		Platform:         opts.platform,
+		BestEffort:       opts.bestEffort,
+		CosignKeys:       opts.cosignKeys,
+		Keyless:          opts.keyless,
+		ScanID:           cvetools.NewScanID(),
+		Compliance:       opts.compliance,
+		MaxImageAge:      opts.maxImageAge,
+		SiblingTags:      opts.siblingTags,
+		Misconfig:        opts.misconfig,
+		ExcludePaths:     opts.excludePaths,
+		RateLimit:        opts.rate.taskLimit(),
+	}
+}
+
+// parseImageAge accepts a number of days, like "180d", or a go duration, like "4320h"
+func parseImageAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	var age time.Duration
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseUint(strings.TrimSuffix(value, "d"), 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid image age: %s", value)
+		}
+		age = time.Duration(days) * time.Hour * 24
+	} else {
+		var err error
+		if age, err = time.ParseDuration(value); err != nil || age < 0 {
+			return 0, fmt.Errorf("Invalid image age: %s", value)
+		}
+	}
+	return age, nil
+}
+
+// applyRegistryPrefix moves the path prefix of the registry, served behind a reverse proxy or an api gateway,
+// from the repository parsed from an image name back to the registry.
+// For example, host/registry/app:1.0 with the registry https://host/registry is the repository app.
+func applyRegistryPrefix(registry, repository, prefixed string) (string, string) {
+	base := cvetools.RegistryBaseURL(prefixed)
+	i := strings.Index(base, "://")
+	if i == -1 {
+		return registry, repository
+	}
+	j := strings.Index(base[i+3:], "/")
+	if j == -1 {
+		return registry, repository
+	}
+	host, prefix := base[i+3:i+3+j], base[i+4+j:]
+	if strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://") != host ||
+		!strings.HasPrefix(repository, prefix+"/") {
+		return registry, repository
+	}
+	return base, strings.TrimPrefix(repository, prefix+"/")
+}
+
+// splitBracketedHost splits the registry of an IPv6 literal, with or without the port, from the rest of
+// the image value, e.g. [fd00::1]:5000/team/app:1.0 => [fd00::1]:5000, team/app:1.0
+func splitBracketedHost(value string) (string, string, bool) {
+	if !strings.HasPrefix(value, "[") {
+		return "", "", false
+	}
+	end := strings.Index(value, "]")
+	if end == -1 {
+		return "", "", false
+	}
+	addr := value[1:end]
+	if i := strings.Index(addr, "%"); i != -1 {
+		addr = addr[:i] // zone
+	}
+	if ip := net.ParseIP(addr); ip == nil || ip.To4() != nil {
+		return "", "", false
+	}
+
+	host, rest := value, ""
+	if i := strings.Index(value[end:], "/"); i != -1 {
+		host, rest = value[:end+i], value[end+i+1:]
+	}
+	if port := host[end+1:]; port != "" {
+		if n, err := strconv.Atoi(strings.TrimPrefix(port, ":")); err != nil || port[0] != ':' || n <= 0 || n > 65535 {
+			return "", "", false
+		}
+	}
+	return host, rest, true
 }
 
 func parseImageValue(value string) (string, string, string) {
@@ -40,19 +281,31 @@ func parseImageValue(value string) (string, string, string) {
 		// The input URL includes a protocol (e.g., "http://", "https://", "docker://").
 		// We remove it to parse the rest of the URL.
 		proto = value[:i+3]
-		parts = strings.Split(value[i+3:], "/")
+		value = value[i+3:]
+	}
+
+	if host, rest, ok := splitBracketedHost(value); ok {
+		// the colons of the IPv6 address are not the tag separator
+		registry = host
+		if rest != "" {
+			parts = strings.Split(rest, "/")
+		}
+	} else if proto != "" {
+		parts = strings.Split(value, "/")
 	} else {
 		// The input URL does not include a protocol.
 		parts = strings.SplitN(value, "/", 2)
 	}
 
-	if len(parts) > 1 {
+	if registry != "" {
+		// IPv6 registry
+	} else if len(parts) > 1 {
 		if strings.ContainsAny(parts[0], ":.") {
 			// Image has a registry
 			registry = parts[0]
 			parts = parts[1:]
 		}
-	} else {
+	} else if len(parts) == 1 {
 		dot := strings.Index(parts[0], ".")
 		colon := strings.Index(parts[0], ":")
 		if dot != -1 && dot < colon {
@@ -90,30 +343,84 @@ func parseImageValue(value string) (string, string, string) {
 	return registry, repository, tag
 }
 
-func writeResultToFile(req *share.ScanImageRequest, result *share.ScanResult, err error) {
-	var rptData scanOnDemandReportData
+// checkWritable creates the folder of the output file if missing, and checks a file can be written in it,
+// so a long scan isn't lost to an unwritable output
+func checkWritable(output string) error {
+	dir := filepath.Dir(output)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	if _, err := os.Stat(output); err == nil {
+		f, err := os.OpenFile(output, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	f, err := ioutil.TempFile(dir, ".write-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// writeResultToFile writes the report of the scan, the error is returned and logged
+func writeResultToFile(req *share.ScanImageRequest, result *cvetools.ScanReport, err error, opts *onDemandOptions, output string) error {
+	rptData := scanOnDemandReportData{SchemaVersion: onDemandSchemaVersion}
+	if result != nil {
+		rptData.Provenance = result.Provenance
+		rptData.Signature = result.Signature
+		rptData.Artifact = result.Artifact
+		rptData.Checks = result.Checks
+		rptData.ImageSize = result.ImageSize
+		if result.Stats != nil {
+			rptData.Timings = result.Stats.Phases
+			rptData.LayerTimings = result.Stats.Layers
+		}
+	}
 
 	if result == nil {
 		rptData.ErrMsg = err.Error()
 	} else if result.Error != share.ScanErrorCode_ScanErrNone {
 		rptData.ErrMsg = scanUtils.ScanErrorToStr(result.Error)
+		if result.ErrorMessage != "" {
+			rptData.ErrMsg = fmt.Sprintf("%s: %s", rptData.ErrMsg, result.ErrorMessage)
+		}
+		// the packages of an extracted image are kept when the database fails the matching
+		if result.Error == share.ScanErrorCode_ScanErrDatabase {
+			rptData.Platform = result.ImagePlatform.String()
+			rptData.Locations = result.Locations
+		}
 	} else {
-		rpt := scanUtils.ScanRepoResult2REST(result, nil)
-		rptData.Report = rpt
+		rptData.Report = newOnDemandReport(result)
+		rptData.Platform = result.ImagePlatform.String()
+		rptData.ImageCreated = result.ImageCreated
+		rptData.StaleImage = cvetools.IsStaleImage(result, opts.maxImageAge)
+		rptData.UnknownAge = result.ImageAgeUnknown
+		rptData.RepoTags = result.RepoTags
+		if opts.groupBy == groupByPackage {
+			rptData.Packages = cvetools.GroupByPackage(result.Vuls, opts.severities(result).vulSeverity)
+		}
+		rptData.Coverage = result.Coverage
+		rptData.Locations = result.Locations
+		rptData.Overrides = result.SeverityOverrides
+		rptData.Compliance = result.Compliance
+		rptData.VEXSuppressed = result.VEXSuppressed
 	}
 
 	data, _ := json.MarshalIndent(rptData, "", "    ")
 
-	if _, err = os.Stat(scanOutputDir); os.IsNotExist(err) {
-		if err = os.MkdirAll(scanOutputDir, 0775); err != nil {
+	outputDir := filepath.Dir(output)
+	if _, err = os.Stat(outputDir); os.IsNotExist(err) {
+		if err = os.MkdirAll(outputDir, 0775); err != nil {
 			log.WithFields(log.Fields{
-				"registry": req.Registry, "repo": req.Repository, "tag": req.Tag, "error": err.Error(), "output": scanOutputDir,
+				"registry": req.Registry, "repo": req.Repository, "tag": req.Tag, "error": err.Error(), "output": outputDir,
 			}).Error("Failed to create output directory")
-			return
+			return err
 		}
 	}
 
-	output := fmt.Sprintf("%s/%s", scanOutputDir, scanOutputFile)
 	err = ioutil.WriteFile(output, data, 0644)
 	if err == nil {
 		log.WithFields(log.Fields{
@@ -124,37 +431,250 @@ func writeResultToFile(req *share.ScanImageRequest, result *share.ScanResult, er
 			"registry": req.Registry, "repo": req.Repository, "tag": req.Tag, "error": err.Error(), "output": output,
 		}).Error("Failed to write scan result")
 	}
+	return err
 }
 
-func writeResultToStdout(req *share.ScanImageRequest, result *share.ScanResult, showOptions string) {
-	var rpt *api.RESTScanRepoReport
-	var high, med, low, unk int
+// writeVEXFile writes the OpenVEX document of the vulnerabilities ignored in the successful scan, the error
+// is returned and logged. A failed scan has no document, its file is left as it was.
+func writeVEXFile(result *cvetools.ScanReport, output string) error {
+	if result == nil || result.Error != share.ScanErrorCode_ScanErrNone {
+		return nil
+	}
+	data, err := cvetools.WriteVEX(result)
+	if err == nil {
+		err = ioutil.WriteFile(output, data, 0644)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "output": output}).Error("Failed to write the VEX document")
+		return err
+	}
+	log.WithFields(log.Fields{"output": output, "ignored": len(result.Ignored)}).Info("VEX document written")
+	return nil
+}
 
-	if result != nil && result.Error == share.ScanErrorCode_ScanErrNone {
-		rpt = scanUtils.ScanRepoResult2REST(result, nil)
-	} else {
+// writeScanSummary prints a line of the outcome of the scan to stderr, for the CI logs to grep. The keys are
+// always printed in the same order, a failed scan has the phase it failed in and the error.
+func writeScanSummary(w io.Writer, req *share.ScanImageRequest, result *cvetools.ScanReport, err error, elapsed time.Duration, opts *onDemandOptions) {
+	if !opts.printSummary() {
 		return
 	}
 
-	for _, v := range rpt.Vuls {
-		switch v.Severity {
+	status := "passed"
+	var failure string
+	if phase, msg := scanFailure(result, err); msg != "" {
+		status = "failed"
+		failure = fmt.Sprintf(" phase=%s error=%s", phase, strconv.Quote(msg))
+	}
+	c := countFindings(result, opts)
+	fmt.Fprintf(w, "scan-summary image=%s%s:%s status=%s%s findings=%d critical=%d high=%d medium=%d low=%d unknown=%d fixable=%d secrets=%d duration=%s cvedb=%s\n",
+		req.Registry, req.Repository, req.Tag, status, failure, c.Findings,
+		c.Critical, c.High, c.Medium, c.Low, c.Unknown, c.Fixable, c.Secrets, elapsed.Round(time.Millisecond), resultDBVersion(result))
+}
+
+// scanCounts are the findings of a successful scan by severity
+type scanCounts struct {
+	Findings int `json:"findings"`
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	Medium   int `json:"medium"`
+	Low      int `json:"low"`
+	Unknown  int `json:"unknown"`
+	Fixable  int `json:"fixable"`
+	Secrets  int `json:"secrets"`
+}
+
+// countFindings counts the findings by the severity of -severity_source
+func countFindings(result *cvetools.ScanReport, opts *onDemandOptions) *scanCounts {
+	c := &scanCounts{}
+	if result == nil || result.Error != share.ScanErrorCode_ScanErrNone {
+		return c
+	}
+	severities := opts.severities(result)
+	for _, v := range result.Vuls {
+		c.Findings++
+		severity, _ := severities.vulSeverity(v)
+		switch severity {
+		case share.VulnSeverityCritical:
+			c.Critical++
 		case share.VulnSeverityHigh:
-			high++
+			c.High++
 		case share.VulnSeverityMedium:
-			med++
+			c.Medium++
 		case share.VulnSeverityLow:
-			low++
+			c.Low++
 		default:
-			unk++
+			c.Unknown++
 		}
+		if v.FixedVersion != "" {
+			c.Fixable++
+		}
+	}
+	if result.Secrets != nil {
+		c.Secrets = len(result.Secrets.Logs)
 	}
+	return c
+}
+
+// scanFailure returns the phase and the error of a failed scan, the error is empty if the scan passed
+func scanFailure(result *cvetools.ScanReport, err error) (string, string) {
+	switch {
+	case result == nil:
+		msg := "scan not started"
+		if err != nil {
+			msg = err.Error()
+		}
+		return "setup", msg
+	case result.Error != share.ScanErrorCode_ScanErrNone:
+		msg := scanUtils.ScanErrorToStr(result.Error)
+		if result.ErrorMessage != "" {
+			msg = fmt.Sprintf("%s: %s", msg, result.ErrorMessage)
+		}
+		return failedPhase(result), msg
+	}
+	return "", ""
+}
+
+// resultDBVersion returns the database version the image was matched with, or of the loaded database
+func resultDBVersion(result *cvetools.ScanReport) string {
+	if result != nil && result.Provenance != nil && result.Provenance.CVEDBVersion != "" {
+		return result.Provenance.CVEDBVersion
+	} else if cveTools != nil {
+		return cveTools.CveDBVersion
+	}
+	return ""
+}
+
+// resultDBSources returns the hash of the sources of the database the image was matched with, as resultDBVersion
+func resultDBSources(result *cvetools.ScanReport) string {
+	if result != nil && result.Provenance != nil && result.Provenance.CVEDBVersion != "" {
+		return result.Provenance.CVEDBSources
+	} else if cveTools != nil {
+		return cveTools.CveDBSources
+	}
+	return ""
+}
+
+// failedPhase returns the phase a failed scan stopped in, the phase is recorded before its error is checked
+func failedPhase(result *cvetools.ScanReport) string {
+	if result.Stats == nil || len(result.Stats.Phases) == 0 {
+		return "setup"
+	}
+	return result.Stats.Phases[len(result.Stats.Phases)-1].Phase
+}
+
+func writeResultToStdout(req *share.ScanImageRequest, result *cvetools.ScanReport, opts *onDemandOptions) {
+	var rpt *api.RESTScanRepoReport
+
+	if !opts.printReport() {
+		return
+	}
+
+	if opts.format == formatMarkdown {
+		fmt.Print(markdownReport(req, result, opts))
+		return
+	} else if opts.format == formatJSONL {
+		// streamed by jsonlScan as the scans go
+		return
+	}
+
+	if result != nil && result.Error == share.ScanErrorCode_ScanErrNone {
+		rpt = scanUtils.ScanRepoResult2REST(result.ScanResult, nil)
+	} else {
+		return
+	}
+
 
 	fmt.Printf("Image: %s%s:%s\n", req.Registry, req.Repository, req.Tag)
+	if result.ImagePlatform != nil {
+		fmt.Printf("Digest: %s (%s)\n", rpt.Digest, result.ImagePlatform)
+	} else if rpt.Digest != "" {
+		fmt.Printf("Digest: %s\n", rpt.Digest)
+	}
+	if result.ImageCreated != "" {
+		if cvetools.IsStaleImage(result, opts.maxImageAge) {
+			fmt.Printf("Created: %s (older than %s)\n", result.ImageCreated, opts.maxImageAge)
+		} else {
+			fmt.Printf("Created: %s\n", result.ImageCreated)
+		}
+	} else if result.ImageAgeUnknown {
+		fmt.Printf("Created: unknown age\n")
+	}
+	if len(result.RepoTags) > 0 {
+		fmt.Printf("Tags: %s\n", strings.Join(result.RepoTags, ", "))
+	}
 	fmt.Printf("Base OS: %s\n", rpt.BaseOS)
+	if is := result.ImageSize; is != nil {
+		fmt.Printf("Image size: %d layers, %d bytes compressed, %d bytes extracted\n", is.Layers, is.Compressed, is.Uncompressed)
+	}
+	if sv := result.Signature; sv != nil {
+		if sv.Verified {
+			if sv.Issuer != "" {
+				fmt.Printf("Signature: verified, signed by %s of %s, identity: %s\n", sv.Signer, sv.Issuer, sv.Identity)
+			} else {
+				fmt.Printf("Signature: verified by %s, identity: %s\n", sv.Signer, sv.Identity)
+			}
+		} else {
+			fmt.Printf("Signature: not verified, %s\n", sv.Error)
+		}
+	}
+	if cov := result.Coverage; cov != nil {
+		// a clean result is not verified if some layers were not inspected
+		fmt.Printf("Coverage: %d scanned, %d skipped\n", cov.Scanned, cov.Skipped)
+		for _, l := range cov.Layers {
+			if l.Reason != "" {
+				fmt.Printf("  %s %s: %s\n", l.Status, l.Digest, l.Reason)
+			}
+		}
+		for _, n := range cov.Notes {
+			fmt.Printf("  %s\n", n)
+		}
+	}
+	if len(result.SeverityOverrides) > 0 {
+		fmt.Printf("Severity overrides: %d\n", len(result.SeverityOverrides))
+		for _, o := range result.SeverityOverrides {
+			fmt.Printf("  %s %s: %s, was %s\n", o.Name, o.Package, o.Severity, o.Original)
+		}
+	}
+	if len(result.VEXSuppressed) > 0 {
+		fmt.Printf("Suppressed by VEX: %d\n", len(result.VEXSuppressed))
+		for _, f := range result.VEXSuppressed {
+			reason := f.Justification
+			if reason == "" {
+				reason = f.Impact
+			}
+			fmt.Printf("  %s %s %s: %s %s\n", f.Vulnerability.Name, f.Vulnerability.PackageName, f.Vulnerability.PackageVersion, f.Status, reason)
+		}
+	}
+
+	if cr := result.Compliance; cr != nil {
+		fmt.Printf("\nCompliance %s %s: %.2f%%, %d passed, %d failed, %d not applicable\n", cr.Benchmark, cr.Version, cr.Score, cr.Passed, cr.Failed, cr.NotApplicable)
+		t := table.NewWriter()
+		t.SetOutputMirror(os.Stdout)
+		t.AppendHeader(table.Row{"Control", "Result", "Title", "Detail"})
+		for _, c := range cr.Controls {
+			t.AppendRow(table.Row{c.ID, c.Result, c.Title, c.Detail})
+		}
+		t.SetStyle(table.StyleLight)
+		t.Render()
+	}
 
 	// Print vulnerability
-	fmt.Printf("\nVulnerabilities: %d, HIGH: %d, MEDIUM: %d, LOW: %d, UNKNOWN: %d\n", len(rpt.Vuls), high, med, low, unk)
+	c := countFindings(result, opts)
+	if c.Critical > 0 {
+		fmt.Printf("\nVulnerabilities: %d, CRITICAL: %d, HIGH: %d, MEDIUM: %d, LOW: %d, UNKNOWN: %d\n", len(rpt.Vuls), c.Critical, c.High, c.Medium, c.Low, c.Unknown)
+	} else {
+		fmt.Printf("\nVulnerabilities: %d, HIGH: %d, MEDIUM: %d, LOW: %d, UNKNOWN: %d\n", len(rpt.Vuls), c.High, c.Medium, c.Low, c.Unknown)
+	}
+	if len(rpt.Vuls) > 0 {
+		fmt.Printf("Severity: %s, * where the vendor and NVD ratings disagree\n", opts.severitySource())
+	}
+	if opts.groupBy == groupByPackage {
+		writePackagesToStdout(cvetools.GroupByPackage(result.Vuls, opts.severities(result).vulSeverity))
+		writeShowOptions(rpt, result, opts)
+		return
+	}
 
+	severities := opts.severities(result)
 	files := make([]string, 0)
 	fileMap := make(map[string][]*api.RESTVulnerability)
 	for _, v := range rpt.Vuls {
@@ -184,8 +704,12 @@ func writeResultToStdout(req *share.ScanImageRequest, result *share.ScanResult,
 			t.SetOutputMirror(os.Stdout)
 			t.AppendHeader(table.Row{"Package", "Vulnerability", "Severity", "Version", "Fixed Version", "Published"})
 			for _, v := range list {
+				severity, disagree := severities.severity(v.Name, v.PackageName, v.Severity, v.Score, v.ScoreV3)
+				if disagree {
+					severity += "*"
+				}
 				t.AppendRow(table.Row{
-					v.PackageName, v.Name, v.Severity, v.PackageVersion, v.FixedVersion, time.Unix(v.PublishedTS, 0).UTC().Format("2006-01-02"),
+					v.PackageName, v.Name, severity, v.PackageVersion, v.FixedVersion, time.Unix(v.PublishedTS, 0).UTC().Format("2006-01-02"),
 				}, rowConfigAutoMerge)
 			}
 			t.SetColumnConfigs([]table.ColumnConfig{
@@ -204,8 +728,36 @@ func writeResultToStdout(req *share.ScanImageRequest, result *share.ScanResult,
 			t.Render()
 		}
 	}
+	writeShowOptions(rpt, result, opts)
+}
 
-	options := strings.Split(showOptions, ",")
+// writePackagesToStdout prints the vulnerabilities grouped by package
+func writePackagesToStdout(pfs []*cvetools.PackageFindings) {
+	if len(pfs) == 0 {
+		return
+	}
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"Package", "Version", "Fixed Version", "Severity", "Vulnerabilities", "File"})
+	for _, pf := range pfs {
+		vuls := strings.Join(pf.Vulnerabilities, "\n")
+		if pf.Unfixed > 0 {
+			vuls += fmt.Sprintf("\n(%d without a fix)", pf.Unfixed)
+		}
+		severity := pf.Severity
+		if pf.Disagree {
+			severity += "*"
+		}
+		t.AppendRow(table.Row{pf.Package, pf.Version, pf.FixedVersion, severity, vuls, pf.File})
+	}
+	t.SetStyle(table.StyleLight)
+	t.Style().Options.SeparateRows = true
+	t.Render()
+}
+
+// writeShowOptions prints the sections of -show
+func writeShowOptions(rpt *api.RESTScanRepoReport, result *cvetools.ScanReport, opts *onDemandOptions) {
+	options := strings.Split(opts.show, ",")
 	for _, o := range options {
 		switch o {
 		case "cmd":
@@ -224,31 +776,99 @@ func writeResultToStdout(req *share.ScanImageRequest, result *share.ScanResult,
 			}
 		case "module":
 			fmt.Printf("\nModules:\n")
-			for _, m := range rpt.Modules {
-				fmt.Printf("%s %s\n", m.Name, m.Version)
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendHeader(table.Row{"Module", "Version", "Source", "Path"})
+			if len(result.Locations) > 0 {
+				for _, l := range result.Locations {
+					t.AppendRow(table.Row{l.Name, l.Version, l.Source, l.Path})
+				}
+			} else {
+				// a report without the module locations
+				for _, m := range rpt.Modules {
+					t.AppendRow(table.Row{m.Name, m.Version, m.Source, ""})
+				}
+			}
+			t.SetStyle(table.StyleLight)
+			t.Render()
+		case "checks":
+			fmt.Printf("\nChecks:\n")
+			t := table.NewWriter()
+			t.SetOutputMirror(os.Stdout)
+			t.AppendHeader(table.Row{"ID", "Severity", "Description", "History"})
+			for _, c := range result.Checks {
+				t.AppendRow(table.Row{c.ID, c.Severity, c.Description, c.Line})
 			}
+			t.SetStyle(table.StyleLight)
+			t.Render()
 		}
 	}
 }
 
-func scanOnDemand(req *share.ScanImageRequest, cvedb map[string]*share.ScanVulnerability, showOptions string) *share.ScanResult {
-	var result *share.ScanResult
-	var err error
-
+func setOnDemandDB(cvedb map[string]*share.ScanVulnerability) {
 	newDB := &share.CLUSScannerDB{
 		CVEDBVersion:    cveTools.CveDBVersion,
 		CVEDBCreateTime: cveTools.CveDBCreateTime,
 		CVEDB:           cvedb,
 	}
 	scanUtils.SetScannerDB(newDB)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*20)
-	if scanTasker != nil {
-		result, err = scanTasker.Run(ctx, *req)
-	} else {
-		result, err = cveTools.ScanImage(ctx, req, "")
+// scanOnDemand scans the image, and returns the result with the error of writing it to the output file
+func scanOnDemand(req *share.ScanImageRequest, cvedb map[string]*share.ScanVulnerability, opts *onDemandOptions) (*cvetools.ScanReport, error) {
+	setOnDemandDB(cvedb)
+
+	ctx := context.Background()
+	var records *jsonlScan
+	if opts.format == formatJSONL {
+		records = newJSONLScan(stdoutJSONL, req, opts)
+		ctx = records.withFindings(ctx)
+	}
+	profile := startScanProfile()
+	start := time.Now()
+	result, err := runOnDemandScan(ctx, req, opts)
+	elapsed := time.Since(start)
+	stopScanProfile(profile, req, result, err, elapsed)
+
+	if records != nil {
+		records.end(result, err, elapsed)
+	}
+	writeErr := writeResultToFile(req, result, err, opts, fmt.Sprintf("%s/%s", scanOutputDir, scanOutputFile))
+	if opts.vexOut != "" && writeErr == nil {
+		writeErr = writeVEXFile(result, opts.vexOut)
+	}
+	writeResultToStdout(req, result, opts)
+	if opts.why != "" {
+		writeWhy(result, opts)
+	}
+	writeScanSummary(os.Stderr, req, result, err, elapsed, opts)
+
+	return result, writeErr
+}
+
+// stderrProgress writes the progress events of -progress, shared by the scans of a batch
+var stderrProgress = cvetools.ProgressJSONWriter(os.Stderr)
+
+// runOnDemandScan scans the image, and retries from docker hub if the image is not found locally
+func runOnDemandScan(parent context.Context, req *share.ScanImageRequest, opts *onDemandOptions) (*cvetools.ScanReport, error) {
+	var result *cvetools.ScanReport
+	var err error
+
+	if opts.progress {
+		parent = cvetools.WithProgress(parent, stderrProgress)
+	}
+
+	// rejected with a nil result if the disk is short of space
+	if err = cvetools.CheckFreeSpace(); err == nil {
+		ctx, cancel := context.WithTimeout(parent, time.Minute*20)
+		scanReq := opts.scanRequest(req)
+		if scanTasker != nil {
+			result, err = scanTasker.RunReport(ctx, *scanReq)
+		} else {
+			result, err = cveTools.ScanImageReport(ctx, scanReq, "")
+		}
+		cancel()
 	}
-	cancel()
 
 	if req.Registry == "" && result != nil &&
 		(result.Error == share.ScanErrorCode_ScanErrImageNotFound || result.Error == share.ScanErrorCode_ScanErrContainerAPI) {
@@ -257,15 +877,21 @@ func scanOnDemand(req *share.ScanImageRequest, cvedb map[string]*share.ScanVulne
 			req.Repository = fmt.Sprintf("library/%s", req.Repository)
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Minute*20)
+		ctx, cancel := context.WithTimeout(parent, time.Minute*20)
+		scanReq := opts.scanRequest(req)
 		if scanTasker != nil {
-			result, err = scanTasker.Run(ctx, *req)
+			result, err = scanTasker.RunReport(ctx, *scanReq)
 		} else {
-			result, err = cveTools.ScanImage(ctx, req, "")
+			result, err = cveTools.ScanImageReport(ctx, scanReq, "")
 		}
 		cancel()
 	}
 
+	if result != nil {
+		cveTools.PostProcess(result)
+		cvetools.SortScanResult(result.ScanResult)
+	}
+
 	if result == nil {
 		log.WithFields(log.Fields{
 			"registry": req.Registry, "repo": req.Repository, "tag": req.Tag, "error": err.Error(),
@@ -273,39 +899,110 @@ func scanOnDemand(req *share.ScanImageRequest, cvedb map[string]*share.ScanVulne
 	} else if result.Error != share.ScanErrorCode_ScanErrNone {
 		log.WithFields(log.Fields{
 			"registry": req.Registry, "repo": req.Repository, "tag": req.Tag, "error": scanUtils.ScanErrorToStr(result.Error),
+			"detail": result.ErrorMessage,
 		}).Error("Failed to scan repository")
 	} else {
 		// log.WithFields(log.Fields{
 		// 	"registry": req.Registry, "repo": req.Repository, "tag": req.Tag,
 		// }).Info("Scan repository finish")
+		if cvetools.IsStaleImage(result, opts.maxImageAge) {
+			log.WithFields(log.Fields{
+				"registry": req.Registry, "repo": req.Repository, "tag": req.Tag, "created": result.ImageCreated,
+			}).Warn("Image is older than the maximum image age")
+		}
 	}
 
-	writeResultToFile(req, result, err)
-	writeResultToStdout(req, result, showOptions)
-
-	return result
+	return result, err
 }
 
 type apiClient struct {
 	urlBase string
 	token   string
+	apikey  string // instead of the login token
 	client  *http.Client
 }
 
+// the TLS settings of the controller REST client, verified by the system pool by default
+var controllerTLS = &tls.Config{}
+
+// controllerAPIKey is the API key, name:secret, used instead of the username and password
+var controllerAPIKey string
+
+// controllerOptions are the options of the controller REST client
+type controllerOptions struct {
+	caCert     *string
+	clientCert *string
+	clientKey  *string
+	insecure   *bool
+	token      *string
+}
+
+func addControllerFlags(fs *flag.FlagSet) *controllerOptions {
+	return &controllerOptions{
+		caCert:     fs.String("ctrl_ca_cert", "", "CA certificate file to verify the controller REST API with, the system pool by default"),
+		clientCert: fs.String("ctrl_client_cert", "", "Client certificate file to authenticate to the controller REST API by mTLS"),
+		clientKey:  fs.String("ctrl_client_key", "", "Client key file to authenticate to the controller REST API by mTLS"),
+		insecure:   fs.Bool("ctrl_insecure_skip_verify", false, "Don't verify the certificate of the controller REST API"),
+		token:      fs.String("ctrl_token", "", "Controller API key, name:secret, instead of -ctrl_username and -ctrl_password"),
+	}
+}
+
+// apply sets the TLS settings and the API key of the controller REST client
+func (o *controllerOptions) apply() error {
+	cfg := &tls.Config{InsecureSkipVerify: *o.insecure}
+	if *o.clientCert != "" || *o.clientKey != "" {
+		if *o.clientCert == "" || *o.clientKey == "" {
+			return fmt.Errorf("Both the controller client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(*o.clientCert, *o.clientKey)
+		if err != nil {
+			return fmt.Errorf("Failed to load the controller client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if *o.caCert != "" {
+		data, err := ioutil.ReadFile(*o.caCert)
+		if err != nil {
+			return fmt.Errorf("Failed to read the controller CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No CA certificate found in %s", *o.caCert)
+		}
+		cfg.RootCAs = pool
+	}
+	controllerTLS = cfg
+	controllerAPIKey = *o.token
+	return nil
+}
+
+// hasCredentials returns true if the result can be submitted with the username and password or the API key
+func (o *controllerOptions) hasCredentials(user, pass string) bool {
+	return *o.token != "" || (user != "" && pass != "")
+}
+
 func newAPIClient(ctrlIP string, ctrlPort uint16) *apiClient {
 	return &apiClient{
-		urlBase: fmt.Sprintf("https://%s:%d", ctrlIP, ctrlPort),
+		urlBase: fmt.Sprintf("https://%s", net.JoinHostPort(ctrlIP, strconv.Itoa(int(ctrlPort)))),
+		apikey:  controllerAPIKey,
 		client: &http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
+				TLSClientConfig: controllerTLS.Clone(),
 			},
 			Timeout: apiCallTimeout,
 		},
 	}
 }
 
+// setAuthHeader sets the API key, or the token of the login
+func (c *apiClient) setAuthHeader(req *http.Request) {
+	if c.apikey != "" {
+		req.Header.Set(api.RESTAPIKeyHeader, c.apikey)
+	} else {
+		req.Header.Set(api.RESTTokenHeader, c.token)
+	}
+}
+
 func apiLogin(c *apiClient, myIP string, user, pass string) error {
 	data := api.RESTAuthData{ClientIP: myIP, Password: &api.RESTAuthPassword{Username: user, Password: pass}}
 	body, _ := json.Marshal(&data)
@@ -325,7 +1022,7 @@ func apiLogin(c *apiClient, myIP string, user, pass string) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("Login failed with status code %d", resp.StatusCode)
+		return &apiStatusError{op: "Login", status: resp.StatusCode}
 	}
 
 	body, err = ioutil.ReadAll(resp.Body)
@@ -359,13 +1056,15 @@ func apiLogout(c *apiClient) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("Logout failed with status code %d", resp.StatusCode)
+		return &apiStatusError{op: "Logout", status: resp.StatusCode}
 	}
 
 	c.token = ""
 	return nil
 }
 
+// apiSubmitResult submits the result. The controller replies without a body, the result has no identifier
+// other than the image digest.
 func apiSubmitResult(c *apiClient, result *share.ScanResult) error {
 	data := api.RESTScanRepoSubmitData{Result: result}
 	body, _ := json.Marshal(&data)
@@ -377,7 +1076,7 @@ func apiSubmitResult(c *apiClient, result *share.ScanResult) error {
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set(api.RESTTokenHeader, c.token)
+	c.setAuthHeader(req)
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -386,26 +1085,144 @@ func apiSubmitResult(c *apiClient, result *share.ScanResult) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("Submit scan result failed with status code %d", resp.StatusCode)
+		return &apiStatusError{op: "Submit scan result", status: resp.StatusCode}
 	}
-
 	return nil
 }
 
-func scanSubmitResult(ctrlIP string, ctrlPort uint16, myIP string, user, pass string, result *share.ScanResult) error {
+// the attempts to submit the result to the controller, the wait doubles after each failure
+const submitMaxAttempts = 4
+
+var submitRetryWait = time.Duration(2 * time.Second)
+
+// apiStatusError is a response of the controller REST API with a failure status
+type apiStatusError struct {
+	op     string
+	status int
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("%s failed with status code %d", e.op, e.status)
+}
+
+// retryableSubmitError returns true for the network errors, and the controller busy or failing for now.
+// The controller certificate that fails the verification won't pass with a retry.
+func retryableSubmitError(err error) bool {
+	if se, ok := err.(*apiStatusError); ok {
+		return se.status == http.StatusTooManyRequests || se.status >= 500
+	}
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	return !errors.As(err, &unknown) && !errors.As(err, &hostname) && !errors.As(err, &invalid)
+}
+
+// resultSubmitter submits the scan results with one controller session, the login and the connection
+// are reused for all the results
+type resultSubmitter struct {
+	c        *apiClient
+	myIP     string
+	user     string
+	pass     string
+	loginErr error // the login failed, not for a reason to retry
+}
+
+func newResultSubmitter(ctrlIP string, ctrlPort uint16, myIP string, user, pass string) *resultSubmitter {
 	log.WithFields(log.Fields{"join": fmt.Sprintf("%s:%d", ctrlIP, ctrlPort)}).Debug()
+	return &resultSubmitter{c: newAPIClient(ctrlIP, ctrlPort), myIP: myIP, user: user, pass: pass}
+}
 
-	c := newAPIClient(ctrlIP, ctrlPort)
+// submit sends the result, with the retries. It logs in again if the session expired.
+func (s *resultSubmitter) submit(result *share.ScanResult) error {
+	var err error
+	wait := submitRetryWait
+	for attempt := 1; ; attempt++ {
+		if s.c.token == "" && s.c.apikey == "" {
+			if err = apiLogin(s.c, s.myIP, s.user, s.pass); err != nil && !retryableSubmitError(err) {
+				s.loginErr = err
+			}
+		}
+		if s.c.token != "" || s.c.apikey != "" {
+			if err = apiSubmitResult(s.c, result); err == nil {
+				log.WithFields(log.Fields{"repo": result.Repository, "tag": result.Tag, "digest": result.Digest}).Info("Scan result submitted")
+				return nil
+			}
+			if se, ok := err.(*apiStatusError); ok && se.status == http.StatusUnauthorized && s.c.apikey != "" {
+				// the API key is not accepted, the rest can't be submitted either
+				s.loginErr = err
+			} else if ok && se.status == http.StatusUnauthorized {
+				s.c.token = ""
+				if attempt < submitMaxAttempts {
+					continue
+				}
+			}
+		}
+		if attempt == submitMaxAttempts || !retryableSubmitError(err) {
+			return fmt.Errorf("Scan result not submitted after %d attempts: %v", attempt, err)
+		}
+		log.WithFields(log.Fields{"error": err, "attempt": attempt, "wait": wait}).Warn("Failed to submit scan result, retry")
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
 
-	if err := apiLogin(c, myIP, user, pass); err != nil {
-		return err
+// close logs out, the results are recorded, so a failed logout is not an error of the submission
+func (s *resultSubmitter) close() {
+	if s.c.token == "" {
+		return
 	}
-	if err := apiSubmitResult(c, result); err != nil {
-		return err
+	if err := apiLogout(s.c); err != nil {
+		log.WithFields(log.Fields{"error": err}).Warn("Failed to logout")
 	}
-	if err := apiLogout(c); err != nil {
-		return err
+}
+
+// spoolResult saves the result that failed to be submitted, to be submitted later by: scan submit <file>
+// The results have the image details and the findings, only the owner reads them.
+func spoolResult(dir string, result *share.ScanResult) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(fmt.Sprintf("%s_%s", result.Repository, result.Tag))
+	file := filepath.Join(dir, fmt.Sprintf("%s-%d.json", name, time.Now().UnixNano()))
+	data, _ := json.Marshal(result)
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return "", err
 	}
+	return file, nil
+}
 
-	return nil
+// readSpooledResult reads the result saved by spoolResult
+func readSpooledResult(file string) (*share.ScanResult, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var result share.ScanResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("Invalid scan result %s: %v", file, err)
+	}
+	return &result, nil
+}
+
+func scanSubmitResult(ctrlIP string, ctrlPort uint16, myIP string, user, pass string, result *share.ScanResult) error {
+	return scanSubmitResults(ctrlIP, ctrlPort, myIP, user, pass, []*share.ScanResult{result})[0]
+}
+
+// scanSubmitResults submits the results in one controller session, and returns the error of each result
+func scanSubmitResults(ctrlIP string, ctrlPort uint16, myIP string, user, pass string, results []*share.ScanResult) []error {
+	s := newResultSubmitter(ctrlIP, ctrlPort, myIP, user, pass)
+	defer s.close()
+
+	errs := make([]error, len(results))
+	for i, result := range results {
+		errs[i] = s.submit(result)
+		if s.loginErr != nil {
+			// no session, the rest can't be submitted either
+			for j := i + 1; j < len(results); j++ {
+				errs[j] = errs[i]
+			}
+			break
+		}
+	}
+	return errs
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/controller/api"
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestRegistryPrefix(t *testing.T) {
+	cases := [][4]string{
+		// image, registry flag, expected registry and repository
+		{"example.com/registry/team/app:1.0", "https://example.com/registry", "https://example.com/registry", "team/app"},
+		{"example.com/registry/team/app:1.0", "https://example.com/registry/v2/", "https://example.com/registry", "team/app"},
+		{"example.com/team/app:1.0", "https://example.com/registry", "https://example.com", "team/app"},
+		{"other.com/registry/app:1.0", "https://example.com/registry", "https://other.com", "registry/app"},
+		{"example.com/registry/app:1.0", "", "https://example.com", "registry/app"},
+		{"example.com/registry/app:1.0", "https://example.com", "https://example.com", "registry/app"},
+	}
+
+	for _, c := range cases {
+		reg, repo, _ := parseImageValue(c[0])
+		reg, repo = applyRegistryPrefix(reg, repo, c[1])
+		if reg != c[2] || repo != c[3] {
+			t.Errorf("Incorrect result: %s with %s => %s, %s\n", c[0], c[1], reg, repo)
+		}
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "output")
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "result", "scan_result.json")
+	if err := checkWritable(output); err != nil {
+		t.Errorf("Output should be writable: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(output)); len(files) != 0 {
+		t.Errorf("The check file is left: %v", files)
+	}
+
+	// a folder that can't be created, as the parent is a file
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+	if err := checkWritable(filepath.Join(file, "scan_result.json")); err == nil {
+		t.Errorf("Output under a file should not be writable")
+	}
+	if os.Geteuid() != 0 {
+		os.Chmod(file, 0444)
+		if err := checkWritable(file); err == nil {
+			t.Errorf("Read-only output should not be writable")
+		}
+	}
+}
+
+func TestSubmitResultRetry(t *testing.T) {
+	saved := submitRetryWait
+	defer func() { submitRetryWait = saved }()
+	submitRetryWait = time.Millisecond
+
+	var logins, submits int
+	var loginStatus, failedSubmits int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/auth" && r.Method == http.MethodPost:
+			logins++
+			if loginStatus != 0 {
+				w.WriteHeader(loginStatus)
+				return
+			}
+			w.Write([]byte(`{"token": {"token": "t1"}}`))
+		case r.URL.Path == "/v1/auth":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/v1/scan/result/repository":
+			submits++
+			if submits <= failedSubmits {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+	defer trustController(srv)()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	p, _ := strconv.Atoi(port)
+	submit := func() error {
+		return scanSubmitResult(host, uint16(p), "127.0.0.1", "admin", "pass", &share.ScanResult{})
+	}
+
+	failedSubmits = 2
+	if err := submit(); err != nil || submits != 3 {
+		t.Errorf("Retry failed: submits=%d error=%v", submits, err)
+	}
+
+	submits, failedSubmits = 0, 100
+	if err := submit(); err == nil || submits != submitMaxAttempts {
+		t.Errorf("Submit should fail after %d attempts: submits=%d error=%v", submitMaxAttempts, submits, err)
+	}
+
+	// not retried with the wrong password
+	logins, loginStatus = 0, http.StatusUnauthorized
+	if err := submit(); err == nil || logins != 1 {
+		t.Errorf("Login failure should not be retried: logins=%d error=%v", logins, err)
+	}
+}
+
+func TestSubmitResultsBatch(t *testing.T) {
+	var logins, logouts, submits, conns int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/auth" && r.Method == http.MethodPost:
+			logins++
+			w.Write([]byte(fmt.Sprintf(`{"token": {"token": "t%d"}}`, logins)))
+		case r.URL.Path == "/v1/auth":
+			logouts++
+		case r.URL.Path == "/v1/scan/result/repository":
+			submits++
+			if submits == 3 && r.Header.Get("X-Auth-Token") == "t1" {
+				// the session expired
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns++
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	defer trustController(srv)()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	p, _ := strconv.Atoi(port)
+	results := make([]*share.ScanResult, 5)
+	for i := range results {
+		results[i] = &share.ScanResult{Repository: fmt.Sprintf("app%d", i)}
+	}
+	errs := scanSubmitResults(host, uint16(p), "127.0.0.1", "admin", "pass", results)
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Result %d not submitted: %v", i, err)
+		}
+	}
+	if logins != 2 || logouts != 1 || submits != 6 || conns != 1 {
+		t.Errorf("Incorrect session: logins=%d logouts=%d submits=%d conns=%d", logins, logouts, submits, conns)
+	}
+}
+
+func TestSpoolResult(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	result := &share.ScanResult{Registry: "https://registry.corp", Repository: "team/app", Tag: "1.0", Version: "3.100"}
+	file, err := spoolResult(filepath.Join(dir, "spool"), result)
+	if err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	if !strings.HasPrefix(filepath.Base(file), "team_app_1.0-") {
+		t.Errorf("Incorrect file name: %s", file)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("The spooled result is readable by the others: %v %v", info.Mode(), err)
+	}
+	read, err := readSpooledResult(file)
+	if err != nil || read.Repository != result.Repository || read.Tag != result.Tag || read.Version != result.Version {
+		t.Errorf("Incorrect result: %+v %v", read, err)
+	}
+
+	var submitted api.RESTScanRepoSubmitData
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&submitted)
+	}))
+	defer srv.Close()
+	c := &apiClient{urlBase: srv.URL, client: srv.Client()}
+	if err := apiSubmitResult(c, read); err != nil || submitted.Result == nil || submitted.Result.Repository != result.Repository {
+		t.Errorf("Incorrect submission: %+v %v", submitted.Result, err)
+	}
+}
+
+// trustController verifies the test controller by its certificate, and returns the function to restore
+func trustController(srv *httptest.Server) func() {
+	saved := controllerTLS
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	controllerTLS = &tls.Config{RootCAs: pool}
+	return func() { controllerTLS = saved }
+}
+
+func TestControllerOptions(t *testing.T) {
+	savedTLS, savedKey := controllerTLS, controllerAPIKey
+	defer func() { controllerTLS, controllerAPIKey = savedTLS, savedKey }()
+
+	var logins, submits int
+	var apikeys []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth":
+			logins++
+		case "/v1/scan/result/repository":
+			submits++
+			apikeys = append(apikeys, r.Header.Get("X-Auth-Apikey"))
+			if r.Header.Get("X-Auth-Apikey") != "ci:secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "controller")
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644)
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+	p, _ := strconv.Atoi(port)
+	submit := func(args ...string) error {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		opts := addControllerFlags(fs)
+		fs.Parse(args)
+		if err := opts.apply(); err != nil {
+			return err
+		}
+		return scanSubmitResult(host, uint16(p), "127.0.0.1", "", "", &share.ScanResult{})
+	}
+
+	// verified by the system pool by default, and a certificate error is not retried
+	if err := submit("-ctrl_token", "ci:secret"); err == nil || !strings.Contains(err.Error(), "after 1 attempts") {
+		t.Errorf("Unknown controller certificate should fail: %v", err)
+	}
+	if err := submit("-ctrl_token", "ci:secret", "-ctrl_ca_cert", caFile); err != nil {
+		t.Errorf("Submit with the CA failed: %v", err)
+	}
+	if err := submit("-ctrl_token", "ci:secret", "-ctrl_insecure_skip_verify"); err != nil {
+		t.Errorf("Submit without verification failed: %v", err)
+	}
+	if logins != 0 || submits != 2 || apikeys[0] != "ci:secret" {
+		t.Errorf("Incorrect requests: logins=%d submits=%d apikeys=%v", logins, submits, apikeys)
+	}
+
+	// a wrong API key is not retried
+	if err := submit("-ctrl_token", "ci:wrong", "-ctrl_ca_cert", caFile); err == nil || submits != 3 {
+		t.Errorf("Wrong API key should fail once: submits=%d %v", submits, err)
+	}
+	if err := submit("-ctrl_client_cert", caFile); err == nil {
+		t.Errorf("Client certificate without the key should fail")
+	}
+}
+
+func TestFindingID(t *testing.T) {
+	vul := &share.ScanVulnerability{
+		Name: "CVE-2022-0778", PackageName: "openssl", PackageVersion: "1.1.1k", FileName: "usr/local/bin/openssl",
+		Score: 7.5, Description: "infinite loop in BN_mod_sqrt()",
+	}
+	id := cvetools.FindingID(vul)
+	if len(id) != 32 {
+		t.Fatalf("Incorrect finding ID: %s", id)
+	}
+
+	// the metadata doesn't change the finding
+	updated := *vul
+	updated.Score, updated.Description, updated.Link = 5.9, "updated description", "https://nvd.nist.gov"
+	if cvetools.FindingID(&updated) != id {
+		t.Errorf("Finding ID changed by the metadata")
+	}
+	fixed := *vul
+	fixed.PackageVersion = "1.1.1n"
+	if cvetools.FindingID(&fixed) == id {
+		t.Errorf("Same finding ID of another version")
+	}
+
+	rpt := newOnDemandReport(cvetools.NewScanReport(&share.ScanResult{Vuls: []*share.ScanVulnerability{vul}, Secrets: &share.ScanSecretResult{}}))
+	data, _ := json.Marshal(rpt)
+	var out struct {
+		Vuls []struct {
+			Name      string `json:"name"`
+			FindingID string `json:"finding_id"`
+		} `json:"vulnerabilities"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil || len(out.Vuls) != 1 {
+		t.Fatalf("Incorrect report: %s, %v", data, err)
+	}
+	if out.Vuls[0].Name != vul.Name || out.Vuls[0].FindingID != id {
+		t.Errorf("Incorrect vulnerability: %+v", out.Vuls[0])
+	}
+}
+
+func TestScanSummary(t *testing.T) {
+	req := &share.ScanImageRequest{Repository: "app", Tag: "1.0"}
+	result := cvetools.NewScanReport(&share.ScanResult{
+		Vuls: []*share.ScanVulnerability{
+			{Name: "CVE-2022-0778", Severity: share.VulnSeverityHigh, FixedVersion: "1.1.1n"},
+			{Name: "CVE-2021-3712", Severity: share.VulnSeverityMedium},
+			{Name: "CVE-2023-0001", Severity: "Negligible"},
+		},
+		Secrets: &share.ScanSecretResult{Logs: []*share.ScanSecretLog{{File: "/root/.aws/credentials"}}},
+	})
+	result.Provenance = &cvetools.ScanProvenance{CVEDBVersion: "3.201"}
+
+	var buf strings.Builder
+	writeScanSummary(&buf, req, result, nil, 1500*time.Millisecond, &onDemandOptions{})
+	expect := "scan-summary image=app:1.0 status=passed findings=3 critical=0 high=1 medium=1 low=0 unknown=1 fixable=1 secrets=1 duration=1.5s cvedb=3.201\n"
+	if buf.String() != expect {
+		t.Errorf("Incorrect summary: %s", buf.String())
+	}
+
+	// the failure names the phase it failed in
+	failed := cvetools.NewScanReport(&share.ScanResult{Error: share.ScanErrorCode_ScanErrRegistryAPI})
+	failed.Stats = &cvetools.ScanStats{Phases: []*cvetools.PhaseTiming{{Phase: cvetools.PhaseManifest}, {Phase: cvetools.PhaseDownload}}}
+	buf.Reset()
+	writeScanSummary(&buf, req, failed, nil, time.Second, &onDemandOptions{})
+	if s := buf.String(); !strings.Contains(s, "status=failed phase=download error=") || !strings.Contains(s, " findings=0 ") {
+		t.Errorf("Incorrect failed summary: %s", s)
+	}
+	buf.Reset()
+	writeScanSummary(&buf, req, nil, errors.New("insufficient disk space"), 0, &onDemandOptions{})
+	if s := buf.String(); !strings.Contains(s, `phase=setup error="insufficient disk space"`) {
+		t.Errorf("Incorrect summary of a scan not started: %s", s)
+	}
+
+	buf.Reset()
+	writeScanSummary(&buf, req, result, nil, time.Second, &onDemandOptions{verbosity: verbositySilent})
+	if buf.Len() != 0 {
+		t.Errorf("Summary not suppressed: %s", buf.String())
+	}
+
+	writeScanSummary(&buf, req, result, nil, time.Second, &onDemandOptions{verbosity: verbosityQuiet})
+	if buf.Len() != 0 {
+		t.Errorf("Summary not suppressed by -q: %s", buf.String())
+	}
+}
+
+func TestSeveritySource(t *testing.T) {
+	result := cvetools.NewScanReport(&share.ScanResult{Vuls: []*share.ScanVulnerability{
+		{Name: "CVE-2023-00001", Severity: share.VulnSeverityHigh, ScoreV3: 7.5, PackageName: "libfoo"},
+		{Name: "CVE-2023-00002", Severity: share.VulnSeverityMedium, ScoreV3: 9.8, PackageName: "libfoo"},
+		{Name: "CVE-2023-00003", Severity: share.VulnSeverityLow, PackageName: "libbar"},
+		{Name: "CVE-2023-00004", Severity: share.VulnSeverityCritical, ScoreV3: 5.3, PackageName: "libbar"},
+	}, Secrets: &share.ScanSecretResult{}})
+	result.SeverityOverrides = []*cvetools.SeverityOverride{
+		{Name: "CVE-2023-00004", Package: "libbar", Original: share.VulnSeverityLow, Severity: share.VulnSeverityCritical},
+	}
+
+	for _, c := range []struct {
+		source                      string
+		critical, high, medium, low int
+	}{
+		{cvetools.SeveritySourceVendor, 1, 1, 1, 1},
+		{cvetools.SeveritySourceNVD, 2, 1, 0, 1},
+		{cvetools.SeveritySourceMax, 2, 1, 0, 1},
+	} {
+		n := countFindings(result, &onDemandOptions{severitySrc: c.source})
+		if n.Critical != c.critical || n.High != c.high || n.Medium != c.medium || n.Low != c.low {
+			t.Errorf("Incorrect %s counts: %+v", c.source, n)
+		}
+	}
+
+	// the index of a batch counts the same
+	entry := newBatchIndexEntry(&batchScan{image: "app:1.0", result: result}, "app.json", &onDemandOptions{severitySrc: cvetools.SeveritySourceNVD})
+	if entry.Vuls != 4 || entry.Critical != 2 || entry.High != 1 || entry.Medium != 0 {
+		t.Errorf("Incorrect index entry: %+v", entry)
+	}
+
+	md := markdownReport(&share.ScanImageRequest{Repository: "app", Tag: "1.0"}, result, &onDemandOptions{topFindings: 1, severitySrc: cvetools.SeveritySourceNVD})
+	if !strings.Contains(md, "| Critical | 2 |") || !strings.Contains(md, "CVE-2023-00002) | Critical* |") {
+		t.Errorf("Incorrect nvd report:\n%s", md)
+	}
+
+	// a package of -group_by is rated by the source too, a remapped severity is kept
+	pfs := cvetools.GroupByPackage(result.Vuls, (&onDemandOptions{severitySrc: cvetools.SeveritySourceNVD}).severities(result).vulSeverity)
+	if len(pfs) != 2 || pfs[0].Package != "libbar" || pfs[0].Severity != share.VulnSeverityCritical || pfs[0].Disagree ||
+		pfs[1].Package != "libfoo" || pfs[1].Severity != share.VulnSeverityCritical || !pfs[1].Disagree {
+		t.Errorf("Incorrect nvd packages: %+v", pfs)
+	}
+
+	rpt := newOnDemandReport(result)
+	if v := rpt.Vuls[1]; v.Severity != share.VulnSeverityMedium || v.NVDSeverity != share.VulnSeverityCritical || v.NVDScore != 9.8 {
+		t.Errorf("Incorrect severities: %+v", v)
+	}
+	if v := rpt.Vuls[2]; v.NVDSeverity != "" || v.NVDScore != 0 {
+		t.Errorf("Incorrect severities without a score: %+v", v)
+	}
+}
+
+func TestMatchFailureInventory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "output")
+	defer os.RemoveAll(dir)
+
+	// the database failed the matching of the extracted image, its packages are kept with the error
+	result := cvetools.NewScanReport(&share.ScanResult{Error: share.ScanErrorCode_ScanErrDatabase})
+	result.ImagePlatform = &cvetools.ImagePlatform{OS: "linux", Architecture: "amd64"}
+	result.Locations = []*cvetools.ModuleLocation{{Name: "openssl", Version: "1.1.1", Source: "dpkg", Path: "var/lib/dpkg/status"}}
+	output := filepath.Join(dir, "scan_result.json")
+	req := &share.ScanImageRequest{Repository: "app", Tag: "1.0"}
+	if err := writeResultToFile(req, result, nil, &onDemandOptions{}, output); err != nil {
+		t.Fatalf("Failed to write the result: %v", err)
+	}
+	var rpt scanOnDemandReportData
+	data, _ := ioutil.ReadFile(output)
+	json.Unmarshal(data, &rpt)
+	if rpt.ErrMsg == "" || rpt.Report != nil || len(rpt.Locations) != 1 || rpt.Platform != "linux/amd64" {
+		t.Errorf("Incorrect report of the failed matching: %s", data)
+	}
+
+	// the other failures have no packages
+	result.Error = share.ScanErrorCode_ScanErrImageNotFound
+	writeResultToFile(req, result, nil, &onDemandOptions{}, output)
+	rpt = scanOnDemandReportData{}
+	data, _ = ioutil.ReadFile(output)
+	json.Unmarshal(data, &rpt)
+	if len(rpt.Locations) != 0 {
+		t.Errorf("Unexpected packages of the failed scan: %s", data)
+	}
+}
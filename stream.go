@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+	"github.com/neuvector/scanner/rpc"
+)
+
+const streamVulBatchMax = 1000
+const pageVulLimitMax = 5000
+const pageCacheTimeout = time.Minute * 5
+const pageCacheMax = 32 // the results kept for paging, the one expiring first is dropped for a new one
+const summaryTopDefault = 10
+const summaryTopMax = 100
+const progressEventBuffer = 64
+
+// splitScanResult breaks a result into messages of at most batch vulnerabilities each.
+// The first message is a copy of the result with the first batch of vulnerabilities.
+func splitScanResult(result *share.ScanResult, batch int) []*share.ScanResult {
+	if batch <= 0 || len(result.Vuls) <= batch {
+		return []*share.ScanResult{result}
+	}
+
+	first := *result
+	first.Vuls = result.Vuls[:batch]
+	list := []*share.ScanResult{&first}
+	for i := batch; i < len(result.Vuls); i += batch {
+		end := i + batch
+		if end > len(result.Vuls) {
+			end = len(result.Vuls)
+		}
+		list = append(list, &share.ScanResult{Vuls: result.Vuls[i:end]})
+	}
+	return list
+}
+
+// sortVulsForPaging orders the vulnerabilities by severity, then by CVE name and package, so pages are stable
+func sortVulsForPaging(vuls []*share.ScanVulnerability) {
+	sort.SliceStable(vuls, func(i, j int) bool {
+		if ri, rj := cvetools.SeverityRank(vuls[i].Severity), cvetools.SeverityRank(vuls[j].Severity); ri != rj {
+			return ri > rj
+		}
+		if vuls[i].Name != vuls[j].Name {
+			return vuls[i].Name < vuls[j].Name
+		}
+		if vuls[i].PackageName != vuls[j].PackageName {
+			return vuls[i].PackageName < vuls[j].PackageName
+		}
+		return vuls[i].PackageVersion < vuls[j].PackageVersion
+	})
+}
+
+// getResultPage cuts a page out of a sorted result. The first page is a copy of the result.
+func getResultPage(result *share.ScanResult, offset, limit uint32) *rpc.ScanResultPage {
+	total := uint32(len(result.Vuls))
+	if limit == 0 || limit > pageVulLimitMax {
+		limit = pageVulLimitMax
+	}
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	page := &rpc.ScanResultPage{Offset: offset, Total: total}
+	if offset == 0 {
+		first := *result
+		page.Result = &first
+	} else {
+		page.Result = &share.ScanResult{}
+	}
+	page.Result.Vuls = result.Vuls[offset:end]
+	return page
+}
+
+// getResultSummary cuts the top vulnerabilities out of a sorted result and counts the severities
+func getResultSummary(result *share.ScanResult, top uint32) *rpc.ScanResultSummary {
+	if top == 0 {
+		top = summaryTopDefault
+	} else if top > summaryTopMax {
+		top = summaryTopMax
+	}
+
+	sum := &rpc.ScanResultSummary{Total: uint32(len(result.Vuls))}
+	for _, v := range result.Vuls {
+		switch v.Severity {
+		case share.VulnSeverityCritical:
+			sum.Critical++
+		case share.VulnSeverityHigh:
+			sum.High++
+		case share.VulnSeverityMedium:
+			sum.Medium++
+		case share.VulnSeverityLow:
+			sum.Low++
+		}
+	}
+
+	brief := *result
+	if uint32(len(brief.Vuls)) > top {
+		brief.Vuls = brief.Vuls[:top]
+	}
+	brief.Layers = make([]*share.ScanLayerResult, len(result.Layers))
+	for i, l := range result.Layers {
+		brief.Layers[i] = &share.ScanLayerResult{Digest: l.Digest, Cmds: l.Cmds, Size: l.Size}
+	}
+	brief.Modules = make([]*share.ScanModule, len(result.Modules))
+	for i, m := range result.Modules {
+		brief.Modules[i] = &share.ScanModule{Name: m.Name, Version: m.Version, Source: m.Source, CPEs: m.CPEs}
+	}
+	sum.Result = &brief
+	return sum
+}
+
+type pageCacheEntry struct {
+	result  *share.ScanResult
+	expires time.Time
+}
+
+// rpcStreamService serves rpc.ScannerStreamService, the calls are described in rpc/scanner_stream_service.proto
+type rpcStreamService struct {
+	rs        *rpcService
+	pageMutex sync.Mutex
+	pageCache map[string]*pageCacheEntry
+	// scans the image of the stream service calls, rs.ScanImage if nil
+	scanImage func(context.Context, *share.ScanImageRequest) (*share.ScanResult, error)
+}
+
+// scanner returns the function scanning the image of a call
+func (ss *rpcStreamService) scanner() func(context.Context, *share.ScanImageRequest) (*share.ScanResult, error) {
+	if ss.scanImage != nil {
+		return ss.scanImage
+	}
+	return ss.rs.ScanImage
+}
+
+// getCachedResult looks up a scan result kept for paging, and removes the expired ones
+func (ss *rpcStreamService) getCachedResult(id string) *share.ScanResult {
+	ss.pageMutex.Lock()
+	defer ss.pageMutex.Unlock()
+
+	now := time.Now()
+	for key, e := range ss.pageCache {
+		if now.After(e.expires) {
+			delete(ss.pageCache, key)
+		}
+	}
+	if e, ok := ss.pageCache[id]; ok {
+		e.expires = now.Add(pageCacheTimeout)
+		return e.result
+	}
+	return nil
+}
+
+func (ss *rpcStreamService) putCachedResult(result *share.ScanResult) string {
+	ss.pageMutex.Lock()
+	defer ss.pageMutex.Unlock()
+
+	if ss.pageCache == nil {
+		ss.pageCache = make(map[string]*pageCacheEntry)
+	}
+	now := time.Now()
+	for key, e := range ss.pageCache {
+		if now.After(e.expires) {
+			delete(ss.pageCache, key)
+		}
+	}
+	for len(ss.pageCache) >= pageCacheMax {
+		var oldest string
+		for key, e := range ss.pageCache {
+			if oldest == "" || e.expires.Before(ss.pageCache[oldest].expires) {
+				oldest = key
+			}
+		}
+		log.WithFields(log.Fields{"id": oldest}).Info("Drop the cached scan result")
+		delete(ss.pageCache, oldest)
+	}
+	id := uuid.New().String()
+	ss.pageCache[id] = &pageCacheEntry{result: result, expires: now.Add(pageCacheTimeout)}
+	return id
+}
+
+func (ss *rpcStreamService) ScanImagePage(ctx context.Context, req *rpc.ScanImagePageRequest) (*rpc.ScanResultPage, error) {
+	log.WithFields(log.Fields{"id": req.ScanID, "offset": req.Offset, "limit": req.Limit}).Debug()
+
+	if req.ScanID != "" {
+		result := ss.getCachedResult(req.ScanID)
+		if result == nil {
+			return nil, status.Errorf(codes.NotFound, "scan result %s expired", req.ScanID)
+		}
+		page := getResultPage(result, req.Offset, req.Limit)
+		page.ScanID = req.ScanID
+		return page, nil
+	}
+
+	if req.Request == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing scan request")
+	}
+	result, err := ss.scanner()(ctx, req.Request)
+	if err != nil {
+		return nil, err
+	} else if result == nil {
+		return nil, status.Error(codes.NotFound, "no scan result")
+	}
+
+	sortVulsForPaging(result.Vuls)
+	page := getResultPage(result, 0, req.Limit)
+	if page.Total > uint32(len(page.Result.Vuls)) {
+		// more pages to come
+		page.ScanID = ss.putCachedResult(result)
+	}
+	return page, nil
+}
+
+func (ss *rpcStreamService) ScanImageSummary(ctx context.Context, req *rpc.ScanImageSummaryRequest) (*rpc.ScanResultSummary, error) {
+	log.WithFields(log.Fields{"top": req.Top}).Debug()
+
+	if req.Request == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing scan request")
+	}
+	result, err := ss.scanner()(ctx, req.Request)
+	if err != nil {
+		return nil, err
+	} else if result == nil {
+		return nil, status.Error(codes.NotFound, "no scan result")
+	}
+
+	sortVulsForPaging(result.Vuls)
+	sum := getResultSummary(result, req.Top)
+	if sum.Total > 0 {
+		// for the details left out
+		sum.ScanID = ss.putCachedResult(result)
+	}
+	return sum, nil
+}
+
+func (ss *rpcStreamService) ScanImageStream(req *share.ScanImageRequest, stream rpc.ScannerStreamService_ScanImageStreamServer) error {
+	log.WithFields(log.Fields{
+		"Registry": req.Registry, "image": fmt.Sprintf("%s:%s", req.Repository, req.Tag),
+	}).Debug()
+
+	ctx := stream.Context()
+	result, err := ss.rs.ScanImage(ctx, req)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+
+	list := splitScanResult(result, streamVulBatchMax)
+	for i, msg := range list {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := stream.Send(msg); err != nil {
+			log.WithFields(log.Fields{"error": err, "batch": i, "batches": len(list)}).Error("Failed to send result")
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *rpcStreamService) ScanImageProgress(req *share.ScanImageRequest, stream rpc.ScannerStreamService_ScanImageProgressServer) error {
+	log.WithFields(log.Fields{
+		"Registry": req.Registry, "image": fmt.Sprintf("%s:%s", req.Repository, req.Tag),
+	}).Debug()
+
+	// the events come from the goroutines of the scan, or the relay of the scanner task: a download event is
+	// dropped when the stream is behind, the next one has the count, and the scan waits for the stream to take
+	// the end of a phase
+	events := make(chan *cvetools.ProgressEvent, progressEventBuffer)
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	ctx = cvetools.WithProgress(ctx, func(ev *cvetools.ProgressEvent) {
+		if ev.Done {
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+			}
+			return
+		}
+		select {
+		case events <- ev:
+		default:
+		}
+	})
+
+	scan := ss.scanner()
+	var result *share.ScanResult
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err = scan(ctx, req)
+	}()
+
+	send := func(ev *cvetools.ProgressEvent) error {
+		if serr := stream.Send(progressMessage(ev)); serr != nil {
+			log.WithFields(log.Fields{"error": serr, "phase": ev.Phase}).Error("Failed to send progress")
+			cancel()
+			<-done
+			return serr
+		}
+		return nil
+	}
+	for running := true; running; {
+		select {
+		case ev := <-events:
+			if serr := send(ev); serr != nil {
+				return serr
+			}
+		case <-done:
+			running = false
+		}
+	}
+	for len(events) > 0 {
+		if serr := send(<-events); serr != nil {
+			return serr
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	list := splitScanResult(result, streamVulBatchMax)
+	for i, msg := range list {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := stream.Send(&rpc.ScanProgress{Result: msg}); err != nil {
+			log.WithFields(log.Fields{"error": err, "batch": i, "batches": len(list)}).Error("Failed to send result")
+			return err
+		}
+	}
+	return nil
+}
+
+// progressMessage converts a progress event of the scan to its grpc message
+func progressMessage(ev *cvetools.ProgressEvent) *rpc.ScanProgress {
+	return &rpc.ScanProgress{
+		Phase: ev.Phase, Done: ev.Done, Millis: uint64(ev.Millis), Layers: uint32(ev.Layers), TotalLayers: uint32(ev.TotalLayers),
+		Bytes: uint64(ev.Bytes), TotalBytes: uint64(ev.TotalBytes), Findings: uint32(ev.Findings),
+	}
+}
+
+// GetPhaseStats returns the time spent on each phase of the image scans, to tell the registry latency from
+// the cpu-bound matching across the scanners
+func (ss *rpcStreamService) GetPhaseStats(ctx context.Context, v *share.RPCVoid) (*rpc.ScanPhaseStats, error) {
+	stats := &rpc.ScanPhaseStats{}
+	for _, ps := range cvetools.PhaseStats() {
+		stats.Phases = append(stats.Phases, &rpc.ScanPhaseStat{
+			Phase: ps.Phase, Count: uint64(ps.Count), Millis: uint64(ps.Millis), Bytes: uint64(ps.Bytes),
+		})
+	}
+	return stats, nil
+}
+
+// GetScannerInfo returns what a client needs to know of the scanner before sending it scans. It reads the
+// state of the process only, the scanner tasks and the scans in progress don't delay it.
+func (ss *rpcStreamService) GetScannerInfo(ctx context.Context, v *share.RPCVoid) (*rpc.ScannerInfo, error) {
+	info := &rpc.ScannerInfo{
+		ScannerVersion: cvetools.ScannerVersion,
+		ScannerCommit:  cvetools.ScannerCommit,
+		Features:       scannerFeatures(),
+		MaxImageSize:   maxImageSize,
+		ScanTimeout:    uint64(scanTimeout / time.Second),
+		SiblingTags:    uint32(siblingTags),
+		MatchWorkers:   uint32(workerCount(cvetools.MatchWorkers)),
+		InflateWorkers: uint32(workerCount(cvetools.InflateWorkers)),
+		MinFreeSpace:   cvetools.MinFreeSpace,
+		ScanTask:       scanTasker != nil,
+		Usage:          scannerUsage(),
+	}
+	// the handle of the database, not DBVersion, a database update holds UpdateMux until the scans end
+	if cveTools != nil {
+		if h := cveTools.CurrentDB(); h != nil {
+			info.CVEDBVersion, info.CVEDBCreateTime = h.Version, h.CreateTime
+		}
+	}
+	return info, nil
+}
+
+// workerCount resolves a number of workers of the options, 0 for the number of CPUs
+func workerCount(n int) int {
+	if n <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return n
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/status"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+	"github.com/neuvector/scanner/rpc"
+)
+
+// mergeScanResult reassembles a streamed result on the receiving side, recv is the stream's Recv().
+func mergeScanResult(recv func() (*share.ScanResult, error)) (*share.ScanResult, error) {
+	var result *share.ScanResult
+	for {
+		msg, err := recv()
+		if err == io.EOF && result != nil {
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = msg
+		} else {
+			result.Vuls = append(result.Vuls, msg.Vuls...)
+		}
+	}
+}
+
+// mergeProgressResult reassembles the result of ScanImageProgress on the receiving side, passing the progress
+// messages to fn, recv is the stream's Recv()
+func mergeProgressResult(recv func() (*rpc.ScanProgress, error), fn func(*rpc.ScanProgress)) (*share.ScanResult, error) {
+	return mergeScanResult(func() (*share.ScanResult, error) {
+		for {
+			msg, err := recv()
+			if err != nil {
+				return nil, err
+			}
+			if msg.Result != nil {
+				return msg.Result, nil
+			}
+			if fn != nil {
+				fn(msg)
+			}
+		}
+	})
+}
+
+func TestSplitScanResult(t *testing.T) {
+	result := &share.ScanResult{Repository: "nginx", Tag: "latest"}
+	for i := 0; i < 25; i++ {
+		result.Vuls = append(result.Vuls, &share.ScanVulnerability{Name: fmt.Sprintf("CVE-%d", i)})
+	}
+
+	list := splitScanResult(result, 10)
+	if len(list) != 3 {
+		t.Fatalf("Incorrect batches: %d", len(list))
+	}
+	if list[0].Repository != "nginx" || list[1].Repository != "" || len(list[2].Vuls) != 5 {
+		t.Errorf("Incorrect batch content")
+	}
+
+	i := 0
+	merged, err := mergeScanResult(func() (*share.ScanResult, error) {
+		if i == len(list) {
+			return nil, io.EOF
+		}
+		i++
+		return list[i-1], nil
+	})
+	if err != nil || merged.Tag != "latest" || len(merged.Vuls) != 25 || merged.Vuls[24].Name != "CVE-24" {
+		t.Errorf("Incorrect merged result: %+v", merged)
+	}
+
+	if list = splitScanResult(&share.ScanResult{}, 10); len(list) != 1 {
+		t.Errorf("Incorrect batches for empty result: %d", len(list))
+	}
+}
+
+func TestResultPaging(t *testing.T) {
+	result := &share.ScanResult{Repository: "nginx", Vuls: []*share.ScanVulnerability{
+		{Name: "CVE-3", Severity: "Low"},
+		{Name: "CVE-2", Severity: "High"},
+		{Name: "CVE-1", Severity: "Low"},
+		{Name: "CVE-4", Severity: "Critical"},
+		{Name: "CVE-5", Severity: "Medium"},
+	}}
+	sortVulsForPaging(result.Vuls)
+
+	var names []string
+	for _, v := range result.Vuls {
+		names = append(names, v.Name)
+	}
+	if strings.Join(names, ",") != "CVE-4,CVE-2,CVE-5,CVE-1,CVE-3" {
+		t.Errorf("Incorrect order: %v", names)
+	}
+
+	page := getResultPage(result, 0, 2)
+	if page.Total != 5 || page.Result.Repository != "nginx" || len(page.Result.Vuls) != 2 {
+		t.Errorf("Incorrect first page: %+v", page)
+	}
+	page = getResultPage(result, 4, 2)
+	if page.Offset != 4 || page.Result.Repository != "" || len(page.Result.Vuls) != 1 || page.Result.Vuls[0].Name != "CVE-3" {
+		t.Errorf("Incorrect last page: %+v", page)
+	}
+	if page = getResultPage(result, 10, 2); len(page.Result.Vuls) != 0 {
+		t.Errorf("Incorrect page beyond the end: %+v", page)
+	}
+
+	// the page messages must go through the grpc codec
+	codec := encoding.GetCodec("proto")
+	data, err := codec.Marshal(getResultPage(result, 0, 2))
+	if err != nil {
+		t.Fatalf("Failed to marshal page: %v", err)
+	}
+	decoded := &rpc.ScanResultPage{}
+	if err = codec.Unmarshal(data, decoded); err != nil || decoded.Total != 5 || len(decoded.Result.Vuls) != 2 {
+		t.Errorf("Incorrect decoded page: %+v, %v", decoded, err)
+	}
+
+	// the cache keeps the latest results
+	ss := &rpcStreamService{}
+	first := ss.putCachedResult(result)
+	for i := 0; i < pageCacheMax; i++ {
+		ss.putCachedResult(result)
+	}
+	if len(ss.pageCache) != pageCacheMax || ss.getCachedResult(first) != nil {
+		t.Errorf("Incorrect cached results: %d", len(ss.pageCache))
+	}
+
+	// a scan without a result is not found
+	ss.scanImage = func(ctx context.Context, req *share.ScanImageRequest) (*share.ScanResult, error) { return nil, nil }
+	if _, err := ss.ScanImagePage(context.Background(), &rpc.ScanImagePageRequest{Request: &share.ScanImageRequest{}}); status.Code(err) != codes.NotFound {
+		t.Errorf("Incorrect error of a scan without a result: %v", err)
+	}
+	if _, err := ss.ScanImagePage(context.Background(), &rpc.ScanImagePageRequest{ScanID: first}); status.Code(err) != codes.NotFound {
+		t.Errorf("Incorrect error of a dropped result: %v", err)
+	}
+}
+
+func TestResultSummary(t *testing.T) {
+	result := &share.ScanResult{Repository: "nginx", Vuls: []*share.ScanVulnerability{
+		{Name: "CVE-3", Severity: "Low"},
+		{Name: "CVE-2", Severity: "High"},
+		{Name: "CVE-1", Severity: "Low"},
+		{Name: "CVE-4", Severity: "Critical"},
+		{Name: "CVE-5", Severity: "Medium"},
+	}}
+	result.Layers = []*share.ScanLayerResult{{Digest: "sha256:1111", Vuls: result.Vuls[:2], Size: 100}}
+	result.Modules = []*share.ScanModule{{Name: "openssl", Version: "1.1", Vuls: []*share.ScanModuleVul{{Name: "CVE-2"}}}}
+	sortVulsForPaging(result.Vuls)
+
+	sum := getResultSummary(result, 2)
+	if sum.Total != 5 || sum.Critical != 1 || sum.High != 1 || sum.Medium != 1 || sum.Low != 2 {
+		t.Errorf("Incorrect counts: %+v", sum)
+	}
+	if len(sum.Result.Vuls) != 2 || sum.Result.Vuls[0].Name != "CVE-4" || sum.Result.Repository != "nginx" {
+		t.Errorf("Incorrect top vulnerabilities: %+v", sum.Result.Vuls)
+	}
+	if len(sum.Result.Layers) != 1 || len(sum.Result.Layers[0].Vuls) != 0 || sum.Result.Layers[0].Size != 100 ||
+		len(sum.Result.Modules) != 1 || len(sum.Result.Modules[0].Vuls) != 0 {
+		t.Errorf("Incorrect layers and modules: %+v", sum.Result)
+	}
+	if len(result.Vuls) != 5 || len(result.Layers[0].Vuls) != 2 || len(result.Modules[0].Vuls) != 1 {
+		t.Errorf("The full result is changed: %+v", result)
+	}
+	if sum = getResultSummary(result, 0); len(sum.Result.Vuls) != 5 {
+		t.Errorf("Incorrect default top: %d", len(sum.Result.Vuls))
+	}
+
+	codec := encoding.GetCodec("proto")
+	data, err := codec.Marshal(getResultSummary(result, 2))
+	if err != nil {
+		t.Fatalf("Failed to marshal summary: %v", err)
+	}
+	decoded := &rpc.ScanResultSummary{}
+	if err = codec.Unmarshal(data, decoded); err != nil || decoded.Low != 2 || len(decoded.Result.Vuls) != 2 {
+		t.Errorf("Incorrect decoded summary: %+v, %v", decoded, err)
+	}
+
+	// a scan without a result is not found
+	ss := &rpcStreamService{scanImage: func(ctx context.Context, req *share.ScanImageRequest) (*share.ScanResult, error) { return nil, nil }}
+	if _, err := ss.ScanImageSummary(context.Background(), &rpc.ScanImageSummaryRequest{Request: &share.ScanImageRequest{}}); status.Code(err) != codes.NotFound {
+		t.Errorf("Incorrect error of a scan without a result: %v", err)
+	}
+}
+
+func TestProgressResult(t *testing.T) {
+	result := &share.ScanResult{Repository: "nginx", Tag: "latest"}
+	for i := 0; i < 15; i++ {
+		result.Vuls = append(result.Vuls, &share.ScanVulnerability{Name: fmt.Sprintf("CVE-%d", i)})
+	}
+	msgs := []*rpc.ScanProgress{
+		progressMessage(&cvetools.ProgressEvent{Phase: cvetools.PhaseDownload, Layers: 1, TotalLayers: 3, Bytes: 100, TotalBytes: 300}),
+		progressMessage(&cvetools.ProgressEvent{Phase: cvetools.PhaseMatching, Done: true, Millis: 20, Findings: 15}),
+	}
+	for _, msg := range splitScanResult(result, 10) {
+		msgs = append(msgs, &rpc.ScanProgress{Result: msg})
+	}
+
+	var phases []string
+	i := 0
+	merged, err := mergeProgressResult(func() (*rpc.ScanProgress, error) {
+		if i == len(msgs) {
+			return nil, io.EOF
+		}
+		i++
+		return msgs[i-1], nil
+	}, func(p *rpc.ScanProgress) {
+		phases = append(phases, fmt.Sprintf("%s:%v:%d/%d:%d", p.Phase, p.Done, p.Layers, p.TotalLayers, p.Findings))
+	})
+	if err != nil || merged.Tag != "latest" || len(merged.Vuls) != 15 {
+		t.Errorf("Incorrect merged result: %v %+v", err, merged)
+	}
+	if strings.Join(phases, ",") != "download:false:1/3:0,matching:true:0/0:15" {
+		t.Errorf("Incorrect progress: %v", phases)
+	}
+}
+
+// progressStream is the server stream of ScanImageProgress, slow to send
+type progressStream struct {
+	grpc.ServerStream
+	msgs []*rpc.ScanProgress
+}
+
+func (s *progressStream) Context() context.Context { return context.Background() }
+
+func (s *progressStream) Send(p *rpc.ScanProgress) error {
+	time.Sleep(time.Millisecond)
+	s.msgs = append(s.msgs, p)
+	return nil
+}
+
+func TestScanImageProgress(t *testing.T) {
+	result := &share.ScanResult{Repository: "nginx", Tag: "latest", Vuls: []*share.ScanVulnerability{{Name: "CVE-2022-0778"}}}
+	ss := &rpcStreamService{scanImage: func(ctx context.Context, req *share.ScanImageRequest) (*share.ScanResult, error) {
+		progress := cvetools.ProgressFromContext(ctx)
+		for _, phase := range []string{cvetools.PhaseManifest, cvetools.PhaseDownload, cvetools.PhaseMatching} {
+			// more download events than the stream takes, faster than it sends them
+			for i := 0; i < 2*progressEventBuffer; i++ {
+				progress(&cvetools.ProgressEvent{Phase: cvetools.PhaseDownload, Layers: i})
+			}
+			progress(&cvetools.ProgressEvent{Phase: phase, Done: true, Findings: 1})
+		}
+		return result, nil
+	}}
+
+	stream := &progressStream{}
+	if err := ss.ScanImageProgress(&share.ScanImageRequest{Repository: "nginx", Tag: "latest"}, stream); err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	var done []string
+	for _, msg := range stream.msgs {
+		if msg.Done {
+			done = append(done, msg.Phase)
+		}
+	}
+	// every phase end is sent, then the result
+	last := stream.msgs[len(stream.msgs)-1]
+	if strings.Join(done, ",") != "manifest,download,matching" || last.Result == nil || len(last.Result.Vuls) != 1 {
+		t.Errorf("Incorrect progress: %v, %d messages", done, len(stream.msgs))
+	}
+	if len(stream.msgs) >= 6*progressEventBuffer {
+		t.Errorf("The download events are not dropped: %d messages", len(stream.msgs))
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// In sweep mode, the standalone scanner scans the images of a whole registry: the repositories of the catalog
+// and their tags selected by the tag policies, each digest once, however many tags point at it. The result of each
+// image is written to the result folder named by its digest, with an index of the images. The state file
+// records the digests scanned, so an interrupted sweep continues where it stopped, and a digest scanned
+// with the same database version is not scanned again.
+//
+// The requests to each registry host are within the budget of the sweep, shared by the scanner tasks, and
+// slow down when the registry throttles them or responds slower. A nice sweep spreads its scans over a
+// wall-clock duration. The progress is printed periodically and kept in the state file.
+
+const sweepIndexFile = "index.json"
+const sweepStateFile = "sweep_state.json"
+
+type sweepOptions struct {
+	registry   string
+	repoFilter string              // glob of the repositories, like team-a/*, empty for all
+	policy     *cvetools.TagPolicy // the tags of the repositories to scan
+	resultDir  string
+	stateFile  string
+	dryRun     bool // print the images the sweep would scan, without scanning
+
+	rateLimit cvetools.RateLimit // of each registry host, for the whole sweep
+	nice      time.Duration      // to spread the scans over, 0 to scan them as fast as the budget allows
+	progress  time.Duration      // the interval of the progress, 0 for none
+}
+
+// sweepEntry is the index entry of an image of the sweep, and its record in the state file
+type sweepEntry struct {
+	batchIndexEntry
+	Digest    string   `json:"digest"`
+	Tags      []string `json:"tags"`
+	DBVersion string   `json:"db_version,omitempty"`
+	DBSources string   `json:"db_sources,omitempty"` // the hash of the sources of a merged database
+}
+
+// sweepState is the state file of a sweep, the entries of the images scanned by their digest
+type sweepState struct {
+	Registry string                 `json:"registry"`
+	Images   map[string]*sweepEntry `json:"images"`
+	Progress *sweepProgress         `json:"progress,omitempty"` // of the last sweep
+}
+
+// sweepProgress is the progress of a sweep, the images scanned or skipped are done, and a repository is done
+// with all its images
+type sweepProgress struct {
+	Started      string  `json:"started"`
+	Updated      string  `json:"updated"`
+	Repositories int     `json:"repositories"`
+	ReposDone    int     `json:"repositories_done"`
+	Images       int     `json:"images"`
+	ImagesDone   int     `json:"images_done"`
+	ETA          string  `json:"eta,omitempty"`       // by the scans done so far, or the end of a nice sweep
+	Rate         float64 `json:"requests_per_minute"` // since the last progress
+	Slowdown     float64 `json:"slowdown,omitempty"`  // of the requests, by the throttling of the registry
+	Throttled    int     `json:"throttled,omitempty"`
+}
+
+// newSweepOptions checks the options of: scan sweep -registry <url> -result_dir <dir> [OPTIONS]. The result
+// folder is not needed by a dry run.
+func newSweepOptions(registry, repoFilter, resultDir, stateFile string, policy *cvetools.TagPolicy, dryRun bool) (*sweepOptions, error) {
+	if registry == "" || (resultDir == "" && !dryRun) {
+		return nil, fmt.Errorf("The sweep needs -registry and -result_dir")
+	}
+	if !strings.Contains(registry, "://") {
+		registry = "https://" + registry
+	}
+	if _, err := path.Match(repoFilter, ""); err != nil {
+		return nil, fmt.Errorf("Invalid filter %s: %v", repoFilter, err)
+	}
+	if stateFile == "" && resultDir != "" {
+		stateFile = filepath.Join(resultDir, sweepStateFile)
+	}
+	return &sweepOptions{registry: registry, repoFilter: repoFilter, policy: policy, resultDir: resultDir, stateFile: stateFile, dryRun: dryRun}, nil
+}
+
+// setSchedule checks the rate limit and the schedule options of the sweep
+func (sw *sweepOptions) setSchedule(requestsPerMinute, blobDownloads int, nice, progress time.Duration) error {
+	if requestsPerMinute < 0 || blobDownloads < 0 {
+		return fmt.Errorf("Invalid rate limit: %d requests per minute, %d blob downloads", requestsPerMinute, blobDownloads)
+	}
+	if nice < 0 || progress < 0 {
+		return fmt.Errorf("Invalid sweep duration: %v, progress interval: %v", nice, progress)
+	}
+	sw.rateLimit = cvetools.RateLimit{RequestsPerMinute: requestsPerMinute, BlobDownloads: blobDownloads}
+	sw.nice, sw.progress = nice, progress
+	return nil
+}
+
+// newTagPolicy checks the tag selection options of the sweep, they compose
+func newTagPolicy(filter, semver, maxAge string, latest int) (*cvetools.TagPolicy, error) {
+	policy := &cvetools.TagPolicy{Filter: filter, LatestPerRepo: latest}
+	if _, err := path.Match(filter, ""); err != nil {
+		return nil, fmt.Errorf("Invalid filter %s: %v", filter, err)
+	}
+	if latest < 0 {
+		return nil, fmt.Errorf("Invalid latest images per repository: %d", latest)
+	}
+	if semver != "" {
+		r, err := cvetools.ParseSemverRange(semver)
+		if err != nil {
+			return nil, err
+		}
+		policy.Semver = r
+	}
+	age, err := parseImageAge(maxAge)
+	if err != nil {
+		return nil, err
+	}
+	policy.MaxAge = age
+	return policy, nil
+}
+
+// loadSweepState reads the state of an earlier sweep of the registry, an empty state if there is none
+func loadSweepState(file, registry string) (*sweepState, error) {
+	state := &sweepState{Registry: registry, Images: make(map[string]*sweepEntry)}
+	if file == "" {
+		return state, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read the sweep state: %v", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Invalid sweep state %s: %v", file, err)
+	}
+	if state.Registry != registry {
+		return nil, fmt.Errorf("The sweep state %s is of the registry %s", file, state.Registry)
+	}
+	if state.Images == nil {
+		state.Images = make(map[string]*sweepEntry)
+	}
+	return state, nil
+}
+
+// save writes the state to a temporary file renamed over the state file, an interrupted write keeps the old state
+func (st *sweepState) save(file string) error {
+	data, _ := json.MarshalIndent(st, "", "    ")
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// scanned tells if the image was scanned without error with the database version and sources, so it's not
+// scanned again
+func (st *sweepState) scanned(digest, dbVersion, dbSources string) bool {
+	entry, ok := st.Images[digest]
+	return ok && entry.ErrMsg == "" && entry.DBVersion == dbVersion && entry.DBSources == dbSources
+}
+
+// sweepResultFile names the result file of the image by its digest
+func sweepResultFile(digest string) string {
+	return cvetools.ProfileName(digest, "") + ".json"
+}
+
+// sweepRate hands out the requests of the scanner tasks from the budget of the sweep process, on a unix
+// socket, so the spacing, the blob downloads and the slow-down of each host are the ones of the whole sweep
+type sweepRate struct {
+	limit cvetools.RateLimit
+}
+
+// newSweepRate serves the requests of the scanner tasks until the context ends
+func newSweepRate(ctx context.Context, limit cvetools.RateLimit) (*sweepRate, error) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("scanner_rate_%d.sock", os.Getpid()))
+	if err := cvetools.ServeRateLimit(ctx, socket); err != nil {
+		return nil, err
+	}
+	limit.Socket = socket
+	return &sweepRate{limit: limit}, nil
+}
+
+// taskLimit returns the rate limit of a scanner task, nil for none
+func (r *sweepRate) taskLimit() *cvetools.RateLimit {
+	if r == nil {
+		return nil
+	}
+	limit := r.limit
+	return &limit
+}
+
+// sweepRateStats returns the requests of the sweep, of the sweep process and of the scanner tasks
+func sweepRateStats() (requests, throttled int, slowdown float64) {
+	slowdown = 1
+	if s := cvetools.RateLimitStats(); s != nil {
+		requests, throttled, slowdown = s.Requests, s.Throttled, s.Slowdown
+	}
+	return requests, throttled, slowdown
+}
+
+// niceSchedule spreads the start of the scans evenly over the duration
+func niceSchedule(scans []*batchScan, start time.Time, nice time.Duration) {
+	if nice <= 0 || len(scans) == 0 {
+		return
+	}
+	step := nice / time.Duration(len(scans))
+	for i, s := range scans {
+		s.notBefore = start.Add(step * time.Duration(i))
+	}
+}
+
+// sweepTracker follows the images done by the sweep, for its progress
+type sweepTracker struct {
+	start    time.Time
+	end      time.Time // of a nice sweep
+	images   []*cvetools.RegistryImage
+	done     map[string]bool // the digests scanned or skipped
+	skipped  int
+	last     time.Time
+	requests int // at the last progress
+}
+
+func newSweepTracker(images []*cvetools.RegistryImage, start time.Time, nice time.Duration) *sweepTracker {
+	t := &sweepTracker{start: start, images: images, done: make(map[string]bool), last: start}
+	if nice > 0 {
+		t.end = start.Add(nice)
+	}
+	return t
+}
+
+// progress returns the progress at the time, the rate is the one since the last progress
+func (t *sweepTracker) progress(now time.Time) *sweepProgress {
+	p := &sweepProgress{
+		Started: t.start.Format(time.RFC3339), Updated: now.Format(time.RFC3339), Images: len(t.images), ImagesDone: len(t.done),
+	}
+
+	// the repositories of the tags, done when all their images are
+	repos := make(map[string]bool)
+	for _, img := range t.images {
+		for _, tag := range img.Tags {
+			repo := tag
+			if i := strings.LastIndex(tag, ":"); i > 0 {
+				repo = tag[:i]
+			}
+			if _, ok := repos[repo]; !ok {
+				repos[repo] = true
+			}
+			if !t.done[img.Digest] {
+				repos[repo] = false
+			}
+		}
+	}
+	p.Repositories = len(repos)
+	for _, done := range repos {
+		if done {
+			p.ReposDone++
+		}
+	}
+
+	if scanned, left := len(t.done)-t.skipped, len(t.images)-len(t.done); scanned > 0 && left > 0 {
+		eta := now.Add(now.Sub(t.start) / time.Duration(scanned) * time.Duration(left))
+		if eta.Before(t.end) {
+			eta = t.end
+		}
+		p.ETA = eta.Format(time.RFC3339)
+	}
+
+	var requests int
+	requests, p.Throttled, p.Slowdown = sweepRateStats()
+	if elapsed := now.Sub(t.last); elapsed > 0 {
+		p.Rate = math.Round(float64(requests-t.requests)/elapsed.Minutes()*10) / 10
+	}
+	t.last, t.requests = now, requests
+	return p
+}
+
+// listSweep lists the images of the registry selected by the sweep, and the state of the earlier sweeps
+func listSweep(ctx context.Context, sw *sweepOptions, template *share.ScanImageRequest) ([]*cvetools.RegistryImage, *sweepState, int) {
+	state, err := loadSweepState(sw.stateFile, sw.registry)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error()
+		return nil, nil, exitUsage
+	}
+	images, err := cvetools.ListRegistryImages(ctx, sw.registry, template.Token, template.Username, template.Password, sw.repoFilter, sw.policy)
+	if err != nil {
+		log.WithFields(log.Fields{"registry": sw.registry, "error": err}).Error("Failed to list the images")
+		return nil, nil, exitScanError
+	}
+	return images, state, 0
+}
+
+// dryRunSweep prints the images the sweep would scan with the database version, and the ones it would skip
+func dryRunSweep(ctx context.Context, w io.Writer, sw *sweepOptions, template *share.ScanImageRequest, dbVersion, dbSources string) int {
+	images, state, code := listSweep(ctx, sw, template)
+	if code != 0 {
+		return code
+	}
+	var tags, skipped int
+	for _, img := range images {
+		tags += len(img.Tags)
+		status := "scan"
+		if state.scanned(img.Digest, dbVersion, dbSources) {
+			status = "skip, scanned with the database " + dbVersion
+			skipped++
+		}
+		created := ""
+		if img.Created != "" {
+			created = ", created " + img.Created
+		}
+		fmt.Fprintf(w, "%s@%s (%s%s): %s\n", img.Repository, img.Digest, status, created, strings.Join(img.Tags, " "))
+	}
+	fmt.Fprintf(w, "\nDry run: %d images of %d tags, %d to scan, %d already scanned\n", len(images), tags, len(images)-skipped, skipped)
+	return 0
+}
+
+// writeSweepProgress prints a line of the progress of the sweep
+func writeSweepProgress(w io.Writer, p *sweepProgress) {
+	eta := ""
+	if p.ETA != "" {
+		eta = ", ETA " + p.ETA
+	}
+	fmt.Fprintf(w, "Sweep progress: %d/%d repositories, %d/%d images, %.1f requests/min, slowdown x%.1f, %d throttled%s\n",
+		p.ReposDone, p.Repositories, p.ImagesDone, p.Images, p.Rate, p.Slowdown, p.Throttled, eta)
+}
+
+// runSweep lists the images of the registry, scans the ones not scanned yet, writes their results, the state
+// and the index, and returns the exit code. Each scan is a copy of the template request, by the digest.
+func runSweep(ctx context.Context, sw *sweepOptions, template *share.ScanImageRequest, parallel int, opts *onDemandOptions) int {
+	// the requests of the sweep process, the listing and the scans without the scanner tasks, and the ones
+	// of the scanner tasks, handed out by the sweep process
+	cvetools.SetRateLimit(&sw.rateLimit)
+	defer cvetools.SetRateLimit(nil)
+	if scanTasker != nil {
+		rateCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		rate, err := newSweepRate(rateCtx, sw.rateLimit)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to serve the rate limit of the scanner tasks")
+			return exitSystemError
+		}
+		opts.rate = rate
+	}
+
+	images, state, code := listSweep(ctx, sw, template)
+	if code != 0 {
+		return code
+	}
+
+	start := time.Now()
+	tracker := newSweepTracker(images, start, sw.nice)
+	dbVersion, dbSources := resultDBVersion(nil), resultDBSources(nil)
+	var mutex sync.Mutex
+	var writeErr error
+	done := func(s *batchScan, img *cvetools.RegistryImage) {
+		if ctx.Err() != nil {
+			// stopped by the interruption, scanned again by the next sweep
+			return
+		}
+		file := sweepResultFile(img.Digest)
+		werr := writeResultToFile(s.req, s.result, s.err, opts, filepath.Join(sw.resultDir, file))
+		writeScanSummary(os.Stderr, s.req, s.result, s.err, s.elapsed, opts)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		tracker.done[img.Digest] = true
+		state.Images[img.Digest] = &sweepEntry{
+			batchIndexEntry: *newBatchIndexEntry(s, file, opts), Digest: img.Digest, Tags: img.Tags, DBVersion: resultDBVersion(s.result),
+			DBSources: resultDBSources(s.result),
+		}
+		if werr == nil {
+			werr = state.save(sw.stateFile)
+		}
+		if werr != nil && writeErr == nil {
+			writeErr = werr
+		}
+	}
+
+	var scans []*batchScan
+	var tags, skipped int
+	for _, img := range images {
+		tags += len(img.Tags)
+		if state.scanned(img.Digest, dbVersion, dbSources) {
+			log.WithFields(log.Fields{"digest": img.Digest, "tags": img.Tags}).Debug("Already scanned")
+			state.Images[img.Digest].Tags = img.Tags
+			tracker.done[img.Digest] = true
+			tracker.skipped++
+			skipped++
+			continue
+		}
+		req := *template
+		req.Repository, req.Tag = img.Repository, img.Digest
+		img := img
+		scans = append(scans, &batchScan{
+			image: img.Repository + "@" + img.Digest,
+			req:   &req,
+			done:  func(s *batchScan) { done(s, img) },
+		})
+	}
+	log.WithFields(log.Fields{
+		"registry": sw.registry, "images": len(images), "tags": tags, "skipped": skipped,
+		"rate_limit": sw.rateLimit.RequestsPerMinute, "nice": sw.nice,
+	}).Info("Sweep the registry")
+
+	niceSchedule(scans, start, sw.nice)
+	stop := make(chan struct{})
+	if sw.progress > 0 {
+		go func() {
+			ticker := time.NewTicker(sw.progress)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					mutex.Lock()
+					state.Progress = tracker.progress(time.Now())
+					writeSweepProgress(os.Stderr, state.Progress)
+					if err := state.save(sw.stateFile); err != nil {
+						log.WithFields(log.Fields{"error": err}).Error("Failed to save the sweep progress")
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	scanImageList(ctx, scans, parallel, opts)
+	close(stop)
+	mutex.Lock()
+	state.Progress = tracker.progress(time.Now())
+	mutex.Unlock()
+
+	var failed, unsigned int
+	index := make([]*sweepEntry, 0, len(images))
+	for _, img := range images {
+		if entry, ok := state.Images[img.Digest]; ok {
+			index = append(index, entry)
+			if entry.ErrMsg != "" {
+				failed++
+			}
+		} else {
+			index = append(index, &sweepEntry{
+				batchIndexEntry: batchIndexEntry{Image: img.Repository + "@" + img.Digest, ErrMsg: "not scanned"},
+				Digest:          img.Digest, Tags: img.Tags,
+			})
+		}
+	}
+	for _, s := range scans {
+		if opts.unsigned(s.result) || opts.stale(s.result) {
+			unsigned++
+		}
+	}
+	sort.SliceStable(index, func(i, j int) bool { return index[i].Image < index[j].Image })
+	data, _ := json.MarshalIndent(index, "", "    ")
+	output := filepath.Join(sw.resultDir, sweepIndexFile)
+	if err := ioutil.WriteFile(output, data, 0644); err != nil {
+		log.WithFields(log.Fields{"error": err, "output": output}).Error("Failed to write sweep index")
+		if writeErr == nil {
+			writeErr = err
+		}
+	}
+	if writeErr == nil {
+		// the state of the tags of the skipped images
+		writeErr = state.save(sw.stateFile)
+	}
+
+	// the stdout of -format jsonl has only the records
+	var w io.Writer = os.Stdout
+	if opts.format == formatJSONL {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "\nSwept %d images of %d tags, %d scanned, %d already scanned with the database %s, %d failed, wall-clock time: %s\n",
+		len(images), tags, len(scans), skipped, dbVersion, failed, time.Since(start).Round(time.Second))
+
+	if writeErr != nil {
+		log.WithFields(log.Fields{"error": writeErr}).Error("Failed to write the sweep results")
+		return exitOutputError
+	} else if ctx.Err() != nil {
+		log.WithFields(log.Fields{"state": sw.stateFile}).Error("Sweep interrupted, run it again to continue")
+		return exitScanError
+	} else if opts.strict && failed > 0 {
+		return exitScanError
+	} else if unsigned > 0 {
+		return exitViolation
+	}
+	return 0
+}
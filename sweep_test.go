@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestRegistrySweep(t *testing.T) {
+	if _, err := newSweepOptions("", "", "/tmp/results", "", nil, false); err == nil {
+		t.Errorf("Sweep without the registry accepted")
+	}
+	if _, err := newSweepOptions("harbor.local", "team-a/[", "/tmp/results", "", nil, false); err == nil {
+		t.Errorf("Invalid filter accepted")
+	}
+	if _, err := newSweepOptions("harbor.local", "", "", "", nil, true); err != nil {
+		t.Errorf("Dry run without the result folder not accepted: %v", err)
+	}
+	for _, args := range [][]string{{"[", "", ""}, {"", "~1.2", ""}, {"", "", "90x"}} {
+		if _, err := newTagPolicy(args[0], args[1], args[2], 0); err == nil {
+			t.Errorf("Invalid tag policy accepted: %v", args)
+		}
+	}
+	policy, err := newTagPolicy("v*", ">=1.0 <2", "90d", 0)
+	if err != nil || policy.MaxAge != 90*24*time.Hour || !policy.Semver.Matches("v1.0.0") {
+		t.Errorf("Incorrect tag policy: %+v %v", policy, err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/_catalog":
+			w.Write([]byte(`{"repositories":["team-a/app"]}`))
+		case r.URL.Path == "/v2/team-a/app/tags/list":
+			w.Write([]byte(`{"name":"team-a/app","tags":["v1","v1.0","v2"]}`))
+		case r.Method == http.MethodHead && strings.HasPrefix(r.URL.Path, "/v2/team-a/app/manifests/v2"):
+			w.Header().Set("Docker-Content-Digest", "sha256:2222")
+		case r.Method == http.MethodHead:
+			w.Header().Set("Docker-Content-Digest", "sha256:1111")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	sw, err := newSweepOptions(srv.URL, "team-a/*", dir, "", &cvetools.TagPolicy{Filter: "v*"}, false)
+	if err != nil || sw.stateFile != filepath.Join(dir, sweepStateFile) {
+		t.Fatalf("Incorrect sweep options: %+v %v", sw, err)
+	}
+
+	// both digests scanned by an interrupted sweep with the same database, v1.0 tagged since
+	state := &sweepState{Registry: srv.URL, Images: map[string]*sweepEntry{
+		"sha256:1111": {batchIndexEntry: batchIndexEntry{Image: "team-a/app@sha256:1111", File: "1111.json", Vuls: 3}, Digest: "sha256:1111", Tags: []string{"team-a/app:v1"}},
+		"sha256:2222": {batchIndexEntry: batchIndexEntry{Image: "team-a/app@sha256:2222", File: "2222.json"}, Digest: "sha256:2222", Tags: []string{"team-a/app:v2"}},
+	}}
+	if err := state.save(sw.stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if !state.scanned("sha256:1111", "", "") || state.scanned("sha256:1111", "3.001", "") || state.scanned("sha256:1111", "", "1a2b3c4d") ||
+		state.scanned("sha256:3333", "", "") {
+		t.Errorf("Incorrect scanned digests")
+	}
+
+	opts := &onDemandOptions{format: formatJSONL}
+	if code := runSweep(context.Background(), sw, &share.ScanImageRequest{Registry: srv.URL}, 2, opts); code != 0 {
+		t.Fatalf("Incorrect sweep exit code: %d", code)
+	}
+	var index []*sweepEntry
+	data, _ := ioutil.ReadFile(filepath.Join(dir, sweepIndexFile))
+	if err := json.Unmarshal(data, &index); err != nil || len(index) != 2 {
+		t.Fatalf("Incorrect index: %s %v", data, err)
+	}
+	if index[0].Digest != "sha256:1111" || index[0].Vuls != 3 || strings.Join(index[0].Tags, ",") != "team-a/app:v1,team-a/app:v1.0" {
+		t.Errorf("Incorrect index entry: %+v", index[0])
+	}
+	if saved, err := loadSweepState(sw.stateFile, srv.URL); err != nil || len(saved.Images["sha256:1111"].Tags) != 2 {
+		t.Errorf("Incorrect saved state: %+v %v", saved, err)
+	}
+
+	// the dry run skips the images scanned with the database
+	var out strings.Builder
+	if code := dryRunSweep(context.Background(), &out, sw, &share.ScanImageRequest{Registry: srv.URL}, "3.001", ""); code != 0 ||
+		!strings.Contains(out.String(), "team-a/app@sha256:1111 (scan): team-a/app:v1 team-a/app:v1.0") ||
+		!strings.Contains(out.String(), "2 images of 3 tags, 2 to scan, 0 already scanned") {
+		t.Errorf("Incorrect dry run: %d\n%s", code, out.String())
+	}
+
+	// the state of another registry
+	if _, err := loadSweepState(sw.stateFile, "https://other.local"); err == nil {
+		t.Errorf("State of another registry accepted")
+	}
+}
+
+func TestSweepSchedule(t *testing.T) {
+	sw := &sweepOptions{}
+	if err := sw.setSchedule(-1, 0, 0, 0); err == nil {
+		t.Errorf("Negative rate limit accepted")
+	}
+	if err := sw.setSchedule(100, 3, 8*time.Hour, time.Minute); err != nil || sw.rateLimit.RequestsPerMinute != 100 {
+		t.Errorf("Incorrect sweep schedule: %+v %v", sw, err)
+	}
+
+	// the tasks ask the sweep process for their requests
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rate, err := newSweepRate(ctx, sw.rateLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := rate.taskLimit(); limit.RequestsPerMinute != 100 || limit.BlobDownloads != 3 || limit.Socket == "" {
+		t.Errorf("Incorrect task limit: %+v", limit)
+	} else if _, err := os.Stat(limit.Socket); err != nil {
+		t.Errorf("Socket not served: %v", err)
+	}
+	if (*sweepRate)(nil).taskLimit() != nil {
+		t.Errorf("Limit without the sweep budget")
+	}
+
+	// the nice sweep spreads the scans over the duration
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	scans := []*batchScan{{}, {}, {}, {}}
+	niceSchedule(scans, start, 8*time.Hour)
+	if !scans[0].notBefore.Equal(start) || !scans[3].notBefore.Equal(start.Add(6*time.Hour)) {
+		t.Errorf("Incorrect nice schedule: %v %v", scans[0].notBefore, scans[3].notBefore)
+	}
+
+	// a repository is done with all its images
+	images := []*cvetools.RegistryImage{
+		{Digest: "sha256:1111", Tags: []string{"team-a/app:v1", "team-b/app:v1"}},
+		{Digest: "sha256:2222", Tags: []string{"team-a/app:v2"}},
+		{Digest: "sha256:3333", Tags: []string{"team-c/app:v1"}},
+	}
+	tracker := newSweepTracker(images, start, 0)
+	tracker.done["sha256:1111"] = true
+	tracker.done["sha256:3333"] = true
+	tracker.skipped = 1
+	p := tracker.progress(start.Add(time.Minute))
+	if p.Repositories != 3 || p.ReposDone != 2 || p.Images != 3 || p.ImagesDone != 2 || p.Rate != 0 || p.Slowdown != 1 {
+		t.Errorf("Incorrect sweep progress: %+v", p)
+	}
+	if p.ETA != start.Add(2*time.Minute).Format(time.RFC3339) {
+		t.Errorf("Incorrect sweep ETA: %s", p.ETA)
+	}
+	var out strings.Builder
+	writeSweepProgress(&out, p)
+	if !strings.Contains(out.String(), "2/3 repositories, 2/3 images, 0.0 requests/min, slowdown x1.0") {
+		t.Errorf("Incorrect progress line: %s", out.String())
+	}
+}
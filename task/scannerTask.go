@@ -34,12 +34,29 @@ var ntChan chan uint32 = make(chan uint32, 1)
 var cveTools *cvetools.CveTools // available inside package
 
 ////
-func checkDbReady() bool {
+func checkDbReady(dbPath string, dbFd int) bool {
+	if dbFd > 0 {
+		// the database loaded in memory by the scanner
+		newVer, createTime, err := common.LoadSharedCveDb(os.NewFile(uintptr(dbFd), "cvedb"))
+		if err == nil {
+			cveTools.SwapDB(newVer, createTime)
+			return true
+		}
+		log.WithFields(log.Fields{"error": err}).Error("Failed to map the database of the scanner, load it")
+	}
+
 	var dbReady bool
 	for {
-		if newVer, createTime, err := common.CheckExpandedDb(cveTools.TbPath, false); err == nil {
-			cveTools.CveDBVersion = fmt.Sprintf("%.3f", newVer)
-			cveTools.CveDBCreateTime = createTime
+		var newVer, createTime string
+		var err error
+		if dbPath != "" {
+			// the database is not expanded, decrypt it in memory
+			newVer, createTime, err = common.LoadCveDbInMemory(dbPath, common.GetCVEDBEncryptKey())
+		} else {
+			newVer, createTime, err = common.ExpandedDbVersion(cveTools.TbPath)
+		}
+		if err == nil {
+			cveTools.SwapDB(newVer, createTime)
 			dbReady = true
 			break
 		} else {
@@ -62,8 +79,8 @@ func processRequest(tm *taskMain, scanType, infile, workingPath string) int {
 
 	// selector
 	switch scanType {
-	case "reg": // registry scan: images
-		var req share.ScanImageRequest
+	case "reg": // registry scan: images, with the scanner options
+		var req cvetools.ImageScanRequest
 		if err = json.Unmarshal(byteValue, &req); err == nil {
 			return tm.doScanTask(req, workingPath)
 		}
@@ -101,12 +118,51 @@ func main() {
 	infile := flag.String("i", "input.json", "input json name")         // uuid input filename
 	outfile := flag.String("o", "/tmp/result.json", "output json name") // uuid output filename
 	rtSock := flag.String("u", "", "Container socket URL")              // used for scan local image
+	dbPath := flag.String("d", "", "cve database file directory, load the database in memory")
+	dbFd := flag.Int("db_fd", 0, "file descriptor of the database loaded in memory by the scanner, mapped instead of loading -d")
+	expansion := flag.Float64("expansion", cvetools.DefaultDiskExpansionFactor, "disk expansion factor of the compressed layers")
+	matchWorkers := flag.Int("match_workers", 0, "number of goroutines matching the packages, 0 for the number of CPUs")
+	inflateWorkers := flag.Int("inflate_workers", 0, "number of goroutines streaming the layers, 0 for the number of CPUs")
+	fullExtraction := flag.Bool("full_extraction", false, "write all the files of the layers")
+	userAgent := flag.String("user_agent", cvetools.DefaultUserAgent(), "user agent of the registry requests")
+	clientCert := flag.String("registry_client_cert", "", "client certificate file of the registry")
+	clientKey := flag.String("registry_client_key", "", "client key file of the registry")
+	caCert := flag.String("registry_ca_cert", "", "CA certificate file of the registry")
+	registriesConf := flag.String("registries_conf", "", "per-registry settings file")
+	progressFd := flag.Int("progress_fd", 0, "file descriptor to write the progress events to as JSON lines, 0 to disable")
+	profileDir := flag.String("profile_dir", "", "folder to write the CPU and heap profiles of the scan to, empty to disable")
+	handshake := flag.Bool("handshake", false, "print the version and the protocol of the task as json, and exit")
+	protocol := flag.Int("protocol", 0, "the task protocol version of the scanner, the task exits with 2 if it's not its own")
 	flag.Usage = usage
 	flag.Parse()
 
+	// before any log, the stdout has the handshake only
+	if *handshake {
+		data, _ := json.Marshal(cvetools.NewTaskHandshake())
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+	if *protocol != 0 && *protocol != cvetools.TaskProtocolVersion {
+		log.WithFields(log.Fields{"protocol": *protocol, "task": cvetools.TaskProtocolVersion}).Error("Incompatible task protocol")
+		os.Exit(2)
+	}
+
 	// acquire tool
 	sys := system.NewSystemTools()
 	cveTools = cvetools.NewCveTools(*rtSock, scan.NewScanUtil(sys))
+	cvetools.DiskExpansionFactor = *expansion
+	cvetools.MatchWorkers = *matchWorkers
+	cvetools.FullExtraction = *fullExtraction
+	cvetools.InflateWorkers = *inflateWorkers
+	cvetools.UserAgent = *userAgent
+	if err := cvetools.SetRegistryTLS(*clientCert, *clientKey, *caCert); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to set the registry TLS")
+	}
+	if *registriesConf != "" {
+		if err := cvetools.LoadRegistriesConf(*registriesConf); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to load the registries configuration")
+		}
+	}
 
 	// create an imgPath from the input file
 	var imageWorkingPath string
@@ -118,7 +174,7 @@ func main() {
 		imageWorkingPath = filepath.Join(cvetools.ImageWorkingPath, uid)
 	}
 	log.WithFields(log.Fields{"imageWorkingPath": imageWorkingPath}).Debug()
-	defer os.RemoveAll(imageWorkingPath) // either delete from caller (kill -9) or self-deleted
+	// either delete from caller (kill -9) or self-deleted, os.Exit() below skips the deferred calls
 
 	log.Info("Running ... ")
 	start := time.Now()
@@ -133,8 +189,30 @@ func main() {
 
 	go func() {
 		nRet := -1
-		if checkDbReady() { // check if loaded and unzipped in the target path
-			if tm, ok := InitTaskMain(*outfile); ok {
+		var profile *cvetools.Profile
+		if *profileDir != "" {
+			var err error
+			if profile, err = cvetools.StartProfile(*profileDir, ".task"); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error()
+			}
+		}
+		// stopped before the exit, which skips the deferred calls, the profile of a failed task is kept too
+		var tm *taskMain
+		defer func() {
+			var digest, image string
+			if tm != nil {
+				digest, image = tm.digest, tm.image
+			}
+			profile.Stop(cvetools.ProfileName(digest, image))
+			done <- nRet
+		}()
+		if checkDbReady(*dbPath, *dbFd) { // check if loaded and unzipped in the target path
+			var ok bool
+			if tm, ok = InitTaskMain(*outfile); ok {
+				if *progressFd > 0 {
+					progress := cvetools.ProgressJSONWriter(os.NewFile(uintptr(*progressFd), "progress"))
+					tm.ctx = cvetools.WithFindings(cvetools.WithProgress(tm.ctx, progress), cvetools.ProgressFindings(progress))
+				}
 				fmt.Println("---------------scanType:", *scanType)
 				fmt.Println("----------------input:", *infile)
 				fmt.Println("----------------ouput:", *outfile)
@@ -149,10 +227,10 @@ func main() {
 			log.Error("Failed to init. Exit!")
 			nRet = -10
 		}
-		done <- nRet
 	}()
 
 	rc := <-done
 	log.WithFields(log.Fields{"imageWorkingPath": imageWorkingPath, "used": time.Now().Sub(start).Seconds()}).Info("Exiting ...")
+	cvetools.RemoveImagePath(imageWorkingPath)
 	os.Exit(rc)
 }
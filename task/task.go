@@ -6,16 +6,20 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
 )
 
 // global control data
 type taskMain struct {
 	ctx     context.Context
 	outfile string
+	image   string // repository:tag of the image scanned
+	digest  string // of the image scanned, to name the profiles
 }
 
 /////////////
@@ -28,12 +32,17 @@ func InitTaskMain(filename string) (*taskMain, bool) {
 }
 
 // 扫描镜像库
-func (tm *taskMain) ScanImage(req share.ScanImageRequest, imgPath string) (*share.ScanResult, error) {
+func (tm *taskMain) ScanImage(req cvetools.ImageScanRequest, imgPath string) (*cvetools.ScanReport, error) {
 	log.WithFields(log.Fields{
 		"Registry": req.Registry, "image": fmt.Sprintf("%s:%s", req.Repository, req.Tag), "base": req.BaseImage,
+		"maxSize": req.MaxImageSize, "platform": req.Platform,
 	}).Debug()
 
-	return cveTools.ScanImage(tm.ctx, &req, imgPath)
+	// the requests are handed out by the sweep, which keeps their stats
+	if req.RateLimit != nil {
+		cvetools.SetRateLimit(req.RateLimit)
+	}
+	return cveTools.ScanImageReport(tm.ctx, &req, imgPath)
 }
 
 /////
@@ -60,12 +69,14 @@ func (rs *taskMain) ScanAwsLambda(data share.ScanAwsLambdaRequest, imgPath strin
 ///// worker
 func (tm *taskMain) doScanTask(request interface{}, workingPath string) int {
 	var err error
-	var res *share.ScanResult
+	var res interface{}
 
+	start := time.Now()
 	switch request.(type) {
-	case share.ScanImageRequest:
+	case cvetools.ImageScanRequest:
 		log.WithFields(log.Fields{"扫描类型": "Registry"}).Info("开始扫描...")
-		req := request.(share.ScanImageRequest)
+		req := request.(cvetools.ImageScanRequest)
+		tm.image = req.Repository + ":" + req.Tag
 		res, err = tm.ScanImage(req, workingPath)
 	case share.ScanAppRequest:
 		log.WithFields(log.Fields{"扫描类型": "APP"}).Info("开始扫描...")
@@ -87,6 +98,17 @@ func (tm *taskMain) doScanTask(request interface{}, workingPath string) int {
 		return -1
 	}
 
+	// the image report is stamped by the scan, the others are wrapped for the version and provenance
+	if r, ok := res.(*share.ScanResult); ok && r != nil {
+		report := cvetools.NewScanReport(r)
+		report.SetProvenance(cveTools, start, nil)
+		res = report
+	}
+	if report, ok := res.(*cvetools.ScanReport); ok && report != nil {
+		cvetools.SortScanResult(report.ScanResult)
+		tm.digest = report.Digest
+	}
+
 	// log.WithFields(log.Fields{"result": res}).Info("")
 	// 反序列化结果数据
 	data, _ := json.Marshal(res)
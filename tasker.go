@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -17,12 +22,16 @@ import (
 
 	"github.com/neuvector/neuvector/share"
 	"github.com/neuvector/neuvector/share/system"
+	"github.com/neuvector/scanner/common"
 	"github.com/neuvector/scanner/cvetools"
 )
 
 const reqTemplate = "/tmp/%s_i.json"
 const resTemplate = "/tmp/%s_o.json"
 
+// taskExitUsage is the exit code of a task refusing its flags, of another protocol or unknown to it
+const taskExitUsage = 2
+
 /////
 type Tasker struct {
 	bEnable    bool
@@ -30,26 +39,99 @@ type Tasker struct {
 	mutex      sync.Mutex
 	taskPath   string
 	rtSock     string // Container socket URL
+	dbPath     string // cve database directory, given when the task loads the database in memory
 	sys        *system.SystemTools
+	handshake  *cvetools.TaskHandshake // of the task binary
 }
 
+// taskHandshakeTimeout bounds the handshake of the task binary
+const taskHandshakeTimeout = 10 * time.Second
+
+// the start of the scanner process, the task files older than it are left by a previous process
+var processStart = time.Now()
+
 /////
-func newTasker(taskPath, rtSock string, showDebug bool, sys *system.SystemTools) *Tasker {
+func newTasker(taskPath, rtSock, dbPath string, showDebug bool, sys *system.SystemTools) *Tasker {
 	log.WithFields(log.Fields{"showDebug": showDebug}).Debug()
 	if _, err := os.Stat(taskPath); err != nil {
 		return nil
 	}
 
+	// a task binary left by an upgrade misreads the requests, the scans run in the scanner process instead
+	handshake, err := taskHandshake(taskPath)
+	if err == nil {
+		err = handshake.Check()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"task": taskPath, "version": cvetools.ScannerVersion, "error": err}).Error("Incompatible scanner task, the scans run in the scanner process")
+		return nil
+	} else if handshake.ScannerVersion != cvetools.ScannerVersion {
+		log.WithFields(log.Fields{"task": handshake.ScannerVersion, "version": cvetools.ScannerVersion}).Warn("The scanner task is of another build, with the same protocol")
+	}
+
+	// a scanner killed during the scans leaves the task files, and the task folders of a scratch volume
+	files, fileBytes := sweepTaskFiles(filepath.Dir(reqTemplate), processStart)
+	dirs, dirBytes := cvetools.SweepImagePathBefore(processStart)
+	if files > 0 || dirs > 0 {
+		log.WithFields(log.Fields{"files": files, "folders": dirs, "bytes": fileBytes + dirBytes}).Info("Removed the stale task files")
+	}
+
 	ts := &Tasker{
 		bEnable:    true,
 		taskPath:   taskPath, // sannnerTask path
 		rtSock:     rtSock,   // Container socket URL
+		dbPath:     dbPath,
 		bShowDebug: showDebug,
 		sys:        sys,
+		handshake:  handshake,
 	}
 	return ts
 }
 
+// taskHandshake runs the task binary for its version and protocol; a binary older than the handshake fails
+// on the unknown flag
+func taskHandshake(taskPath string) (*cvetools.TaskHandshake, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), taskHandshakeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, taskPath, "-handshake").Output()
+	if err != nil {
+		return nil, fmt.Errorf("The scanner task has no handshake, it's older than the scanner: %v", err)
+	}
+	var h cvetools.TaskHandshake
+	if err := json.Unmarshal(bytes.TrimSpace(out), &h); err != nil || h.Protocol == 0 {
+		return nil, fmt.Errorf("Invalid handshake of the scanner task: %.200s", out)
+	}
+	return &h, nil
+}
+
+// taskFileName matches the request and result files of the tasks, named by the task uuid
+var taskFileName = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}_[io]\.json$`)
+
+// sweepTaskFiles removes the request and result files in the folder last modified before the time.
+// It returns the number of removed files and their bytes.
+func sweepTaskFiles(dir string, before time.Time) (int, int64) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "dir": dir}).Error("Failed to read the task files")
+		return 0, 0
+	}
+
+	var cnt int
+	var size int64
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !taskFileName.MatchString(e.Name()) || !e.ModTime().Before(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			log.WithFields(log.Fields{"error": err, "file": e.Name()}).Error("Failed to remove the task file")
+			continue
+		}
+		cnt++
+		size += e.Size()
+	}
+	return cnt, size
+}
+
 //////
 func (ts *Tasker) putInputFile(request interface{}) (string, []string, error) {
 	var args []string
@@ -57,11 +139,29 @@ func (ts *Tasker) putInputFile(request interface{}) (string, []string, error) {
 	var data []byte
 
 	switch request.(type) {
-	case share.ScanImageRequest:
-		req := request.(share.ScanImageRequest)
-		data, _ = json.Marshal(req)
+	case share.ScanImageRequest, cvetools.ImageScanRequest:
+		data, _ = json.Marshal(request)
 		args = append(args, "-t", "reg")
 		args = append(args, "-u", ts.rtSock)
+		args = append(args, "-expansion", strconv.FormatFloat(cvetools.DiskExpansionFactor, 'g', -1, 64))
+		args = append(args, "-user_agent", cvetools.UserAgent)
+		args = append(args, "-match_workers", strconv.Itoa(cvetools.MatchWorkers))
+		args = append(args, "-inflate_workers", strconv.Itoa(cvetools.InflateWorkers))
+		if cvetools.FullExtraction {
+			args = append(args, "-full_extraction")
+		}
+		if profileDir != "" {
+			args = append(args, "-profile_dir", profileDir)
+		}
+		if cvetools.RegistryClientCert != "" {
+			args = append(args, "-registry_client_cert", cvetools.RegistryClientCert, "-registry_client_key", cvetools.RegistryClientKey)
+		}
+		if cvetools.RegistryCACert != "" {
+			args = append(args, "-registry_ca_cert", cvetools.RegistryCACert)
+		}
+		if conf := cvetools.RegistriesConfFile(); conf != "" {
+			args = append(args, "-registries_conf", conf)
+		}
 	case share.ScanAppRequest:
 		req := request.(share.ScanAppRequest)
 		data, _ = json.Marshal(req)
@@ -78,6 +178,11 @@ func (ts *Tasker) putInputFile(request interface{}) (string, []string, error) {
 		return "", args, errors.New("Invalid type")
 	}
 
+	if ts.dbPath != "" {
+		args = append(args, "-d", ts.dbPath)
+	}
+	args = append(args, "-protocol", strconv.Itoa(cvetools.TaskProtocolVersion))
+
 	/// lock the allocation
 	ts.mutex.Lock()
 	defer ts.mutex.Unlock()
@@ -97,7 +202,7 @@ func (ts *Tasker) putInputFile(request interface{}) (string, []string, error) {
 }
 
 /////
-func (ts *Tasker) getResultFile(uid string) (*share.ScanResult, error) {
+func (ts *Tasker) getResultFile(uid string) (*cvetools.ScanReport, error) {
 	jsonFile, err := os.Open(fmt.Sprintf(resTemplate, uid))
 	if err != nil {
 		log.WithFields(log.Fields{"error": err, "uid": uid}).Error("Failed to open result")
@@ -106,17 +211,26 @@ func (ts *Tasker) getResultFile(uid string) (*share.ScanResult, error) {
 	byteValue, _ := ioutil.ReadAll(jsonFile)
 	jsonFile.Close()
 
-	var res share.ScanResult
-	if err = json.Unmarshal(byteValue, &res); err != nil {
+	res, err := cvetools.DecodeScanReport(byteValue)
+	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Failed to parse result")
 		return nil, err
 	}
-	log.Debug("Completed")
-	return &res, nil
+	log.WithFields(log.Fields{"schema": res.SchemaVersion}).Debug("Completed")
+	return res, nil
 }
 
 // 解析requst生成扫描参数列表，并调用shell命令来启动扫描
 func (ts *Tasker) Run(ctx context.Context, request interface{}) (*share.ScanResult, error) {
+	report, err := ts.RunReport(ctx, request)
+	if report == nil {
+		return nil, err
+	}
+	return report.ScanResult, err
+}
+
+// RunReport is Run but keeps the scanner-only details of the result
+func (ts *Tasker) RunReport(ctx context.Context, request interface{}) (*cvetools.ScanReport, error) {
 	if !ts.bEnable {
 		return nil, fmt.Errorf("session ended")
 	}
@@ -135,7 +249,35 @@ func (ts *Tasker) Run(ctx context.Context, request interface{}) (*share.ScanResu
 
 	// image working folder
 	workingFolder := cvetools.CreateImagePath(uid)
-	defer os.RemoveAll(workingFolder)
+	defer cvetools.RemoveImagePath(workingFolder)
+
+	// the files given to the task, from the fd 3 after stdin, stdout and stderr
+	var extraFiles []*os.File
+	extraFd := func(f *os.File) string {
+		extraFiles = append(extraFiles, f)
+		return strconv.Itoa(2 + len(extraFiles))
+	}
+
+	// the task maps the database loaded in memory by the scanner, instead of decrypting it again
+	if ts.dbPath != "" {
+		if db, err := common.SharedCveDb(); err == nil {
+			args = append(args, "-db_fd", extraFd(db))
+		} else {
+			log.WithFields(log.Fields{"error": err}).Error("The task loads the database")
+		}
+	}
+
+	// the task writes the progress events and the matched vulnerabilities of the scan to a pipe
+	var relayed chan struct{}
+	fn, findings := cvetools.ProgressFromContext(ctx), cvetools.FindingsFromContext(ctx)
+	if fn != nil || findings != nil {
+		if r, progress, err := os.Pipe(); err == nil {
+			defer r.Close()
+			args = append(args, "-progress_fd", extraFd(progress))
+			relayed = make(chan struct{})
+			go relayProgress(r, fn, findings, relayed)
+		}
+	}
 
 	log.WithFields(log.Fields{"cmd": ts.taskPath, "wpath": workingFolder, "args": args}).Debug()
 	// 调用shell命令来启动扫描
@@ -145,8 +287,14 @@ func (ts *Tasker) Run(ctx context.Context, request interface{}) (*share.ScanResu
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 	}
+	cmd.ExtraFiles = extraFiles
 
-	if err := cmd.Start(); err != nil {
+	err = cmd.Start()
+	for _, f := range extraFiles {
+		// the task holds its own, the relay ends when the task exits
+		f.Close()
+	}
+	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Start")
 		return nil, err
 	}
@@ -171,12 +319,19 @@ func (ts *Tasker) Run(ctx context.Context, request interface{}) (*share.ScanResu
 
 	err = cmd.Wait()
 	bRunning = false
+	if relayed != nil {
+		<-relayed
+	}
 	if ctxError {
 		err = ctx.Err()
 	} else {
 		ts.sys.RemoveToolProcess(pgid, false)
 	}
 
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == taskExitUsage {
+		// the task binary was replaced since the handshake
+		err = fmt.Errorf("The scanner task %s refused the request, it's not of the scanner version %s: %v", ts.taskPath, cvetools.ScannerVersion, err)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Done")
 		return nil, err
@@ -184,6 +339,29 @@ func (ts *Tasker) Run(ctx context.Context, request interface{}) (*share.ScanResu
 	return ts.getResultFile(uid)
 }
 
+// relayProgress calls fn with the progress events written by the task, and findings with the vulnerabilities
+// matched, until the task closes the pipe. Either can be nil.
+func relayProgress(r io.Reader, fn cvetools.ProgressFunc, findings cvetools.FindingsFunc, done chan struct{}) {
+	defer close(done)
+	dec := json.NewDecoder(r)
+	for {
+		var ev cvetools.ProgressEvent
+		if err := dec.Decode(&ev); err != nil {
+			// drained, the task must not block on a full pipe
+			io.Copy(ioutil.Discard, r)
+			return
+		}
+		switch {
+		case ev.Matched != nil:
+			if findings != nil {
+				findings(ev.Matched)
+			}
+		case fn != nil:
+			fn(&ev)
+		}
+	}
+}
+
 /////
 func (ts *Tasker) Close() {
 	log.Debug()
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/neuvector/share/system"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+// taskHelperEnv runs the test binary as the scanner task of TestTaskerRequestRoundTrip, with the tables of
+// the folder
+const taskHelperEnv = "SCANNER_TEST_TASK_DB"
+
+// TestTaskHelperProcess is the scanner task of the tests: it reads the request file, scans the image as the
+// task does and writes the result file
+func TestTaskHelperProcess(t *testing.T) {
+	dbDir := os.Getenv(taskHelperEnv)
+	if dbDir == "" {
+		return
+	}
+	var input, output string
+	args := flag.Args()
+	for i := 0; i < len(args)-1; i++ {
+		switch args[i] {
+		case "-i":
+			input = args[i+1]
+		case "-o":
+			output = args[i+1]
+		}
+	}
+	data, err := ioutil.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req cvetools.ImageScanRequest
+	if err = json.Unmarshal(data, &req); err != nil {
+		t.Fatal(err)
+	}
+	cveTools = cvetools.NewCveTools("", nil)
+	cveTools.TbPath = dbDir + "/"
+	cveTools.SwapDB("1.000", "2022-01-02T00:00:00Z")
+	report, err := cveTools.ScanImageReport(context.Background(), &req, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = json.Marshal(report)
+	if err = ioutil.WriteFile(output, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The scanner task reads the request file into cvetools.ImageScanRequest, every option must survive the trip
+// to the task and its result back
+func TestTaskerRequestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTables(t, dir)
+	amd64 := newTestPlatformImage(t, "amd64", testDebianFiles)
+	arm64 := newTestPlatformImage(t, "arm64", testDebianFiles)
+	images := newTestRegistry(t, map[string]*testImage{"team/app:amd64": amd64, "team/app:arm64": arm64})
+	list, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+		"manifests": []map[string]interface{}{
+			{"digest": blobDigest(amd64.manifest), "platform": map[string]string{"os": "linux", "architecture": "amd64"}},
+			{"digest": blobDigest(arm64.manifest), "platform": map[string]string{"os": "linux", "architecture": "arm64"}},
+		},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/team/app/manifests/1.21" {
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+			w.Write(list)
+			return
+		}
+		images.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// the task is the test binary, run by a script as the tasker gives its flags only
+	task := filepath.Join(dir, "task")
+	script := fmt.Sprintf("#!/bin/sh\nexec %s -test.run='^TestTaskHelperProcess$' -- \"$@\"\n", os.Args[0])
+	if err := ioutil.WriteFile(task, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(taskHelperEnv, dir)
+	defer os.Unsetenv(taskHelperEnv)
+
+	ts := &Tasker{bEnable: true, taskPath: task, rtSock: "unix:///var/run/docker.sock", sys: system.NewSystemTools()}
+	req := cvetools.ImageScanRequest{
+		ScanImageRequest: share.ScanImageRequest{
+			Registry: srv.URL, Repository: "team/app", Tag: "1.21", ScanLayers: true, ScanSecrets: true,
+		},
+		MaxImageSize: 1 << 30,
+		Strict:       true,
+		Platform:     "linux/arm64",
+	}
+	report, err := ts.RunReport(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Failed to run the task: %v", err)
+	}
+	if report.Error != share.ScanErrorCode_ScanErrNone || report.ImagePlatform.String() != "linux/arm64" || report.Digest != blobDigest(arm64.manifest) {
+		t.Errorf("Requested platform not scanned by the task: error=%v platform=%s digest=%s", report.Error, report.ImagePlatform, report.Digest)
+	}
+	if opts := report.Provenance.Options; opts.Platform != "linux/arm64" || !opts.ScanSecrets || !opts.Strict || opts.MaxImageSize != 1<<30 {
+		t.Errorf("Request changed by the tasker: %+v", opts)
+	}
+	if len(report.Vuls) == 0 {
+		t.Errorf("No vulnerability in the result of the task")
+	}
+}
+
+func TestSweepTaskFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tasker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imagePath := cvetools.ImageWorkingPath
+	cvetools.ImageWorkingPath = filepath.Join(dir, "images")
+	defer func() { cvetools.ImageWorkingPath = imagePath }()
+
+	start := time.Now()
+	old := start.Add(-time.Hour)
+	plant := func(path string, isDir bool, mtime time.Time) {
+		if isDir {
+			os.MkdirAll(filepath.Join(path, "layer"), 0755)
+			ioutil.WriteFile(filepath.Join(path, "layer", "data"), make([]byte, 100), 0644)
+		} else {
+			ioutil.WriteFile(path, make([]byte, 10), 0644)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	staleReq := filepath.Join(dir, "2f1c2a4e-7a0b-4c6b-9a51-0d6f1f2a3b4c_i.json")
+	staleRes := filepath.Join(dir, "2f1c2a4e-7a0b-4c6b-9a51-0d6f1f2a3b4c_o.json")
+	freshReq := filepath.Join(dir, "8e3d1b7c-1f2a-4b3c-8d4e-5f6a7b8c9d0e_i.json")
+	other := filepath.Join(dir, "settings.json")
+	plant(staleReq, false, old)
+	plant(staleRes, false, old)
+	plant(freshReq, false, start.Add(time.Second))
+	plant(other, false, old)
+
+	staleDir := filepath.Join(cvetools.ImageWorkingPath, "2f1c2a4e-7a0b-4c6b-9a51-0d6f1f2a3b4c")
+	plant(staleDir, true, old)
+	// the folder of a task in progress, old but in use
+	activeDir := cvetools.CreateImagePath("5a6b7c8d-9e0f-4a1b-8c2d-3e4f5a6b7c8d")
+	defer cvetools.RemoveImagePath(activeDir)
+	plant(activeDir, true, old)
+
+	if cnt, size := sweepTaskFiles(dir, start); cnt != 2 || size != 20 {
+		t.Errorf("Incorrect task files removed: %d files, %d bytes", cnt, size)
+	}
+	if cnt, size := cvetools.SweepImagePathBefore(start); cnt != 1 || size < 100 {
+		t.Errorf("Incorrect task folders removed: %d folders, %d bytes", cnt, size)
+	}
+
+	for _, path := range []string{staleReq, staleRes, staleDir} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Stale %s not removed", path)
+		}
+	}
+	for _, path := range []string{freshReq, other, activeDir} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s removed: %v", path, err)
+		}
+	}
+}
+
+func TestRelayProgress(t *testing.T) {
+	input := `{"Phase":"download","Layers":1}` + "\n" + `{"Phase":"matching","Done":true,"Findings":1,"Matched":{"Digest":"sha256:0123"}}` + "\n"
+	var phases []string
+	var matched *cvetools.ScanReport
+	done := make(chan struct{})
+	relayProgress(strings.NewReader(input), func(ev *cvetools.ProgressEvent) { phases = append(phases, ev.Phase) },
+		func(r *cvetools.ScanReport) { matched = r }, done)
+	<-done
+	if fmt.Sprint(phases) != "[download]" || matched == nil || matched.Digest != "sha256:0123" {
+		t.Errorf("Incorrect relay: %v %+v", phases, matched)
+	}
+}
+
+// A task binary left by an upgrade is found by the handshake, before any scan runs in it
+func TestTaskHandshake(t *testing.T) {
+	dir := t.TempDir()
+	task := func(name, script string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	h, err := taskHandshake(task("current", fmt.Sprintf(`echo '{"ScannerVersion":"v2","Protocol":%d,"SchemaVersion":%d}'`, cvetools.TaskProtocolVersion, cvetools.ReportSchemaVersion)))
+	if err != nil || h.ScannerVersion != "v2" || h.Check() != nil {
+		t.Errorf("Compatible task refused: %+v %v", h, err)
+	}
+	if h, err := taskHandshake(task("newer", `echo '{"ScannerVersion":"v3","Protocol":99,"SchemaVersion":1}'`)); err != nil || h.Check() == nil {
+		t.Errorf("Task of another protocol accepted: %+v %v", h, err)
+	}
+	// older than the handshake, the flag is unknown
+	if _, err := taskHandshake(task("older", `echo "flag provided but not defined: -handshake" >&2; exit 2`)); err == nil {
+		t.Errorf("Task without the handshake accepted")
+	}
+	if _, err := taskHandshake(task("garbled", `echo hello`)); err == nil {
+		t.Errorf("Invalid handshake accepted")
+	}
+	if ts := newTasker(filepath.Join(dir, "older"), "", "", false, nil); ts != nil {
+		t.Errorf("Incompatible task used")
+	}
+}
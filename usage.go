@@ -0,0 +1,79 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+	"github.com/neuvector/scanner/rpc"
+)
+
+var (
+	metricScansCompleted = expvar.NewInt("scans_completed")
+	metricScansFailed    = expvar.NewInt("scans_failed")
+)
+
+func init() {
+	expvar.Publish("process_resident_memory_bytes", expvar.Func(func() interface{} { return residentMemory() }))
+	expvar.Publish("process_cpu_seconds", expvar.Func(func() interface{} { return cpuSeconds() }))
+	expvar.Publish("image_path_used_bytes", expvar.Func(func() interface{} { return cvetools.ImagePathUsage() }))
+}
+
+// countScan counts the scan of the controller as completed or failed, a scan still in progress is not counted
+func countScan(result *share.ScanResult, err error) {
+	if result == nil && err == nil {
+		return
+	}
+	if err != nil || result.Error != share.ScanErrorCode_ScanErrNone {
+		metricScansFailed.Add(1)
+	} else {
+		metricScansCompleted.Add(1)
+	}
+}
+
+// scannerUsage is the resource usage of the scanner, served by GetScannerInfo so the controller can stop
+// assigning the scans to a scanner short of disk or memory. The controller API has no call to push it, it is
+// polled; the scan counts are since the scanner started.
+func scannerUsage() *rpc.ScannerUsage {
+	u := &rpc.ScannerUsage{
+		RSSBytes:       residentMemory(),
+		CPUSeconds:     cpuSeconds(),
+		UsedBytes:      cvetools.ImagePathUsage(),
+		ScansCompleted: metricScansCompleted.Value(),
+		ScansFailed:    metricScansFailed.Value(),
+	}
+	u.FreeBytes, _ = cvetools.FreeSpace()
+	return u
+}
+
+// residentMemory returns the resident set size of the process in bytes
+func residentMemory() int64 {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, _ := strconv.ParseInt(fields[1], 10, 64)
+	return pages * int64(os.Getpagesize())
+}
+
+// cpuSeconds returns the user and system CPU time of the process and of the scanner tasks it waited for
+func cpuSeconds() float64 {
+	var total time.Duration
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var ru syscall.Rusage
+		if syscall.Getrusage(who, &ru) == nil {
+			total += time.Duration(ru.Utime.Nano()) + time.Duration(ru.Stime.Nano())
+		}
+	}
+	return total.Seconds()
+}
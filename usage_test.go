@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neuvector/neuvector/share"
+	"github.com/neuvector/scanner/cvetools"
+)
+
+func TestScannerUsage(t *testing.T) {
+	completed, failed := metricScansCompleted.Value(), metricScansFailed.Value()
+	countScan(&share.ScanResult{}, nil)
+	countScan(&share.ScanResult{Error: share.ScanErrorCode_ScanErrImageNotFound}, nil)
+	countScan(nil, errors.New("insufficient disk"))
+	countScan(nil, nil) // in progress
+
+	info, _ := (&rpcStreamService{}).GetScannerInfo(context.Background(), &share.RPCVoid{})
+	u := info.Usage
+	if u == nil || u.ScansCompleted != completed+1 || u.ScansFailed != failed+2 {
+		t.Fatalf("Incorrect scan counts: %+v", u)
+	}
+	if u.RSSBytes <= 0 || u.CPUSeconds <= 0 {
+		t.Errorf("No resource usage: %+v", u)
+	}
+
+	// the usage of the image working path is measured again by the sweep, not at each read
+	defer func(path string, age time.Duration) {
+		cvetools.ImageWorkingPath, cvetools.ImagePathUsageMaxAge = path, age
+	}(cvetools.ImageWorkingPath, cvetools.ImagePathUsageMaxAge)
+	cvetools.ImageWorkingPath, cvetools.ImagePathUsageMaxAge = t.TempDir(), time.Hour
+	cvetools.SweepImagePath(time.Hour)
+	os.Mkdir(filepath.Join(cvetools.ImageWorkingPath, "scan"), 0755)
+	ioutil.WriteFile(filepath.Join(cvetools.ImageWorkingPath, "scan", "layer"), make([]byte, 100), 0644)
+	if used := cvetools.ImagePathUsage(); used != 0 {
+		t.Errorf("Usage measured again before the sweep: %d", used)
+	}
+	cvetools.SweepImagePath(time.Hour)
+	if used := cvetools.ImagePathUsage(); used != 100 {
+		t.Errorf("Incorrect usage after the sweep: %d", used)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the levels of the logs and of the output of the on-demand scan, set by -q, -quiet, -verbosity and -vv
+const (
+	verbositySilent  = -3 // the errors only, the on-demand scan prints neither the result nor the summary
+	verbositySummary = -2 // the errors only, the on-demand scan prints the summary and not the result
+	verbosityQuiet   = -1 // the errors only, the on-demand scan prints the result and nothing else
+	verbosityInfo    = 0
+	verbosityDebug   = 1
+	verbosityTrace   = 2 // the debug logs of the scanner tasks too
+)
+
+var verbosityNames = map[string]int{
+	"silent":  verbositySilent,
+	"summary": verbositySummary,
+	"quiet":   verbosityQuiet,
+	"info":    verbosityInfo,
+	"debug":   verbosityDebug,
+	"trace":   verbosityTrace,
+}
+
+// the levels of -quiet, 1 is -verbosity summary and 2 is -verbosity silent
+var quietLevels = map[int]int{
+	1: verbositySummary,
+	2: verbositySilent,
+}
+
+// verbosityFlags are the flags setting the level of the logs. -x is the deprecated -vv.
+type verbosityFlags struct {
+	quiet      bool   // -q
+	quietLevel int    // -quiet
+	level      string // -verbosity
+	trace      bool   // -vv
+	legacy     bool   // -x
+}
+
+// resolve returns the level of the logs. Without a flag, the on-demand scan logs the info, the scanner serving
+// the controller keeps the debug logs of its tasks, as its logs are collected with the pod.
+func (vf *verbosityFlags) resolve(onDemand bool) (int, error) {
+	var levels []int
+	if vf.quiet {
+		levels = append(levels, verbosityQuiet)
+	}
+	if vf.quietLevel != 0 {
+		level, ok := quietLevels[vf.quietLevel]
+		if !ok {
+			return 0, fmt.Errorf("unsupported -quiet %d, 1 or 2", vf.quietLevel)
+		}
+		levels = append(levels, level)
+	}
+	if vf.level != "" {
+		level, ok := verbosityNames[vf.level]
+		if !ok {
+			return 0, fmt.Errorf("unsupported verbosity %q, silent, summary, quiet, info, debug or trace", vf.level)
+		}
+		levels = append(levels, level)
+	}
+	if vf.trace || vf.legacy {
+		levels = append(levels, verbosityTrace)
+	}
+
+	switch {
+	case len(levels) == 0 && onDemand:
+		return verbosityInfo, nil
+	case len(levels) == 0:
+		return verbosityTrace, nil
+	}
+	for _, level := range levels[1:] {
+		if level != levels[0] {
+			return 0, fmt.Errorf("only one of -q, -quiet, -verbosity and -vv can be given")
+		}
+	}
+	return levels[0], nil
+}
+
+// setVerbosity sets the level of the logs, it returns true if the logs of the scanner tasks are shown
+func setVerbosity(level int) bool {
+	switch {
+	case level < verbosityInfo:
+		log.SetLevel(log.ErrorLevel)
+	case level == verbosityInfo:
+		log.SetLevel(log.InfoLevel)
+	default:
+		log.SetLevel(log.DebugLevel)
+	}
+	return level >= verbosityTrace
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestVerbosity(t *testing.T) {
+	cases := []struct {
+		flags    verbosityFlags
+		onDemand bool
+		level    int
+	}{
+		{verbosityFlags{}, true, verbosityInfo},
+		{verbosityFlags{}, false, verbosityTrace},
+		{verbosityFlags{quiet: true}, true, verbosityQuiet},
+		{verbosityFlags{quiet: true}, false, verbosityQuiet},
+		{verbosityFlags{level: "debug"}, true, verbosityDebug},
+		{verbosityFlags{trace: true}, true, verbosityTrace},
+		{verbosityFlags{legacy: true}, true, verbosityTrace},
+		{verbosityFlags{trace: true, level: "trace", legacy: true}, true, verbosityTrace},
+		{verbosityFlags{quietLevel: 1}, true, verbositySummary},
+		{verbosityFlags{quietLevel: 2, level: "silent"}, true, verbositySilent},
+	}
+	for _, c := range cases {
+		if level, err := c.flags.resolve(c.onDemand); err != nil || level != c.level {
+			t.Errorf("Incorrect verbosity of %+v: %d, expected %d, error %v", c.flags, level, c.level, err)
+		}
+	}
+
+	for _, flags := range []verbosityFlags{{quiet: true, trace: true}, {quiet: true, level: "info"}, {level: "verbose"},
+		{quiet: true, quietLevel: 1}, {quietLevel: 1, level: "silent"}, {quietLevel: 3}} {
+		if _, err := flags.resolve(true); err == nil {
+			t.Errorf("Expected an error of %+v", flags)
+		}
+	}
+
+	defer log.SetLevel(log.GetLevel())
+	if setVerbosity(verbosityQuiet) || log.GetLevel() != log.ErrorLevel {
+		t.Errorf("Incorrect quiet level: %v", log.GetLevel())
+	}
+	if setVerbosity(verbositySilent) || log.GetLevel() != log.ErrorLevel {
+		t.Errorf("Incorrect silent level: %v", log.GetLevel())
+	}
+	if !setVerbosity(verbosityTrace) || log.GetLevel() != log.DebugLevel {
+		t.Errorf("Incorrect trace level: %v", log.GetLevel())
+	}
+}